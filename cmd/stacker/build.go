@@ -2,7 +2,9 @@ package main
 
 import (
 	"fmt"
+	"os"
 
+	"github.com/pkg/errors"
 	cli "github.com/urfave/cli/v2"
 	"stackerbuild.io/stacker/pkg/squashfs"
 	"stackerbuild.io/stacker/pkg/stacker"
@@ -25,11 +27,15 @@ func initBuildFlags() []cli.Flag {
 			Aliases: []string{"f"},
 			Usage:   "the input stackerfile",
 			Value:   "stacker.yaml",
+		},
+		&cli.BoolFlag{
+			Name:  "list-imports",
+			Usage: "list the http(s) imports of the build, and whether they are cached, without building anything",
 		})
 }
 
 func initCommonBuildFlags() []cli.Flag {
-	return []cli.Flag{
+	return append([]cli.Flag{
 		&cli.BoolFlag{
 			Name:  "no-cache",
 			Usage: "don't use the previous build cache",
@@ -72,7 +78,65 @@ func initCommonBuildFlags() []cli.Flag {
 			Usage: "set OCI annotations namespace in the OCI image manifest",
 			Value: "io.stackeroci",
 		},
-	}
+		&cli.IntFlag{
+			Name:  "jobs",
+			Usage: "how many layers that don't depend on each other to build at once",
+			Value: 1,
+		},
+		&cli.StringFlag{
+			Name:  "cache-from",
+			Usage: "import the build cache exported with --cache-to from this image reference (e.g. docker://registry:5000/project/cache:main)",
+		},
+		&cli.StringFlag{
+			Name:  "cache-to",
+			Usage: "export the build cache to this image reference after building",
+		},
+		&cli.BoolFlag{
+			Name:  "cache-skip-tls",
+			Usage: "skip TLS verification of the registry of --cache-from and --cache-to",
+		},
+		&cli.StringSliceFlag{
+			Name:  "platforms",
+			Usage: "build for these platforms (e.g. linux/amd64,linux/arm64) into an image index; foreign ones need qemu-user-static",
+		},
+		&cli.StringFlag{
+			Name:  "sbom",
+			Usage: "generate an SBOM of each built layer in this format (spdx, cyclonedx) and attach it to its image",
+		},
+		&cli.BoolFlag{
+			Name:  "provenance",
+			Usage: "generate the SLSA provenance of each built layer and attach it to its image",
+		},
+		&cli.BoolFlag{
+			Name:  "reproducible-strict",
+			Usage: "make the layers that are built reproducible: clamp their timestamps to $SOURCE_DATE_EPOCH, and leave build times out of their history",
+		},
+		&cli.BoolFlag{
+			Name:  "no-network",
+			Usage: "run the run sections of all layers without network access, as if they had network: none",
+		},
+		&cli.StringFlag{
+			Name:  "memory",
+			Usage: "the most memory the run section of each layer that doesn't set resources: memory can use, e.g. 4GiB",
+		},
+		&cli.Float64Flag{
+			Name:  "cpus",
+			Usage: "how many CPUs worth of time the run section of each layer that doesn't set resources: cpus gets, e.g. 1.5",
+		},
+		&cli.Int64Flag{
+			Name:  "pids-limit",
+			Usage: "how many processes the run section of each layer that doesn't set resources: pids can have at once",
+		},
+		&cli.StringFlag{
+			Name:  "tar-compression",
+			Usage: "compress tar layers with gzip, zstd or estargz (gzip that can be pulled lazily)",
+			Value: types.GzipCompression,
+		},
+		&cli.IntFlag{
+			Name:  "tar-compression-level",
+			Usage: "compression level of tar layers (gzip and estargz 1-9, zstd 1-22); the compressor's default if 0",
+		},
+	}, initMetricsFlags()...)
 }
 
 func beforeBuild(ctx *cli.Context) error {
@@ -87,7 +151,23 @@ func beforeBuild(ctx *cli.Context) error {
 	if err != nil {
 		return err
 	}
-	return nil
+
+	err = validateJobsFlag(ctx)
+	if err != nil {
+		return err
+	}
+
+	err = validateCacheFlags(ctx)
+	if err != nil {
+		return err
+	}
+
+	err = validateMetricsFlags(ctx)
+	if err != nil {
+		return err
+	}
+
+	return validateSBOMFlag(ctx)
 }
 
 func newBuildArgs(ctx *cli.Context) (stacker.BuildArgs, error) {
@@ -101,8 +181,46 @@ func newBuildArgs(ctx *cli.Context) (stacker.BuildArgs, error) {
 		HashRequired:         ctx.Bool("require-hash"),
 		Progress:             shouldShowProgress(ctx),
 		AnnotationsNamespace: ctx.String("annotations-namespace"),
+		Jobs:                 ctx.Int("jobs"),
+		CacheFrom:            ctx.String("cache-from"),
+		CacheTo:              ctx.String("cache-to"),
+		CacheSkipTLS:         ctx.Bool("cache-skip-tls"),
+		SBOM:                 ctx.String("sbom"),
+		Provenance:           ctx.Bool("provenance"),
+		NoNetwork:            ctx.Bool("no-network"),
+		Resources: types.Resources{
+			Memory: ctx.String("memory"),
+			CPUs:   ctx.Float64("cpus"),
+			Pids:   ctx.Int64("pids-limit"),
+		},
+	}
+	if err := args.Resources.Validate(); err != nil {
+		return args, err
+	}
+	for _, platform := range ctx.StringSlice("platforms") {
+		p, err := stacker.ParsePlatform(platform)
+		if err != nil {
+			return args, err
+		}
+		args.Platforms = append(args.Platforms, p)
+	}
+	if ctx.Bool("reproducible-strict") {
+		// mksquashfs reads it from the environment too
+		epoch, ok := os.LookupEnv("SOURCE_DATE_EPOCH")
+		if !ok {
+			return args, errors.Errorf("--reproducible-strict needs SOURCE_DATE_EPOCH to be set, e.g. to $(git log -1 --format=%%ct)")
+		}
+		t, err := stacker.ParseSourceDateEpoch(epoch)
+		if err != nil {
+			return args, err
+		}
+		args.Config.SourceDateEpoch = &t
 	}
 	var err error
+	args.Config.TarCompression, err = types.NewTarCompression(ctx.String("tar-compression"), ctx.Int("tar-compression-level"))
+	if err != nil {
+		return args, err
+	}
 	verity := squashfs.VerityMetadata(!ctx.Bool("no-squashfs-verity"))
 	args.LayerTypes, err = types.NewLayerTypes(ctx.StringSlice("layer-type"), verity)
 	return args, err
@@ -115,5 +233,26 @@ func doBuild(ctx *cli.Context) error {
 	}
 
 	builder := stacker.NewBuilder(&args)
-	return builder.BuildMultiple([]string{ctx.String("stacker-file")})
+	if ctx.Bool("list-imports") {
+		return listImports(builder, []string{ctx.String("stacker-file")})
+	}
+	err = builder.BuildMultiple([]string{ctx.String("stacker-file")})
+	return finishMetrics(ctx, builder.Metrics(), err)
+}
+
+func listImports(builder *stacker.Builder, paths []string) error {
+	imports, err := builder.ListImports(paths)
+	if err != nil {
+		return err
+	}
+
+	for _, i := range imports {
+		status := "not cached"
+		if i.Cached {
+			status = "cached"
+		}
+		fmt.Printf("%s\t%s\t%s\n", i.Layer, status, i.URL)
+	}
+
+	return nil
 }
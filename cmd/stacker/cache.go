@@ -0,0 +1,174 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"runtime"
+
+	"github.com/dustin/go-humanize"
+	"github.com/pkg/errors"
+	cli "github.com/urfave/cli/v2"
+	"stackerbuild.io/stacker/pkg/log"
+	"stackerbuild.io/stacker/pkg/stacker"
+)
+
+var cacheCmd = cli.Command{
+	Name:  "cache",
+	Usage: "maintain stacker's import cache",
+	Subcommands: []*cli.Command{
+		&cli.Command{
+			Name:   "scan",
+			Usage:  "verifies every cached import against its recorded digest",
+			Action: doCacheScan,
+			Flags: []cli.Flag{
+				&cli.BoolFlag{
+					Name:  "repair",
+					Usage: "download corrupt imports again from where they came from",
+				},
+				&cli.IntFlag{
+					Name:  "jobs",
+					Usage: "number of imports to verify at once",
+					Value: runtime.NumCPU(),
+				},
+			},
+		},
+		&cli.Command{
+			Name:   "prune",
+			Usage:  "removes cached imports that haven't been used in a while",
+			Action: doCachePrune,
+			Flags: []cli.Flag{
+				&cli.DurationFlag{
+					Name:  "max-age",
+					Usage: "remove imports that haven't been used for longer than this",
+				},
+				&cli.StringFlag{
+					Name:  "max-size",
+					Usage: "remove the least recently used imports until the cache is no bigger than this (e.g. 10GB)",
+				},
+				&cli.StringSliceFlag{
+					Name:  "cache-dir",
+					Usage: "also prune this cache dir (e.g. that of stacker grab); can be supplied multiple times",
+				},
+				&cli.BoolFlag{
+					Name:  "dry-run",
+					Usage: "only list what would be removed",
+				},
+			},
+		},
+	},
+}
+
+func doCacheScan(ctx *cli.Context) error {
+	opts, err := downloadOptions()
+	if err != nil {
+		return err
+	}
+
+	results, err := stacker.ScanCache(path.Join(config.StackerDir, "imports"), ctx.Int("jobs"), ctx.Bool("repair"), opts)
+	if err != nil {
+		return err
+	}
+
+	counts := map[stacker.CacheStatus]int{}
+	for _, r := range results {
+		counts[r.Status]++
+		switch {
+		case r.Err != nil:
+			log.Errorf("%s: %s, couldn't repair: %v", r.Path, r.Status, r.Err)
+		case r.Status == stacker.CacheCorrupt || r.Status == stacker.CacheRepaired:
+			log.Infof("%s: %s", r.Path, r.Status)
+		}
+	}
+
+	fmt.Printf("%d ok, %d corrupt, %d repaired, %d unverifiable\n",
+		counts[stacker.CacheOK], counts[stacker.CacheCorrupt], counts[stacker.CacheRepaired], counts[stacker.CacheUnverifiable])
+
+	if counts[stacker.CacheCorrupt] > 0 {
+		return errors.Errorf("%d cached imports are corrupt", counts[stacker.CacheCorrupt])
+	}
+
+	return nil
+}
+
+// downloadOptions are the options of the downloads stacker makes outside of
+// builds: as the current user, retried and sent the way the config says
+// imports are.
+func downloadOptions() (stacker.DownloadOptions, error) {
+	creds, err := stacker.NewCredentials(config.DownloadCredentials)
+	if err != nil {
+		return stacker.DownloadOptions{}, err
+	}
+
+	return stacker.DownloadOptions{
+		Uid: os.Getuid(),
+		Gid: os.Getgid(),
+		RetryOptions: stacker.RetryOptions{
+			Retries:          config.DownloadRetries,
+			RetryBackoff:     config.DownloadRetryBackoff,
+			RetryStatusCodes: config.DownloadRetryStatusCodes,
+		},
+		TransportOptions: stacker.TransportOptions{
+			ConnectTimeout: config.ConnectTimeout,
+			StallTimeout:   config.StallTimeout,
+			CacheProxy:     config.CacheProxy,
+			Credentials:    creds,
+			Network:        config.DownloadNetwork,
+			RateLimiter:    stacker.NewRateLimiter(config.DownloadRateLimits),
+		},
+	}, nil
+}
+
+func doCachePrune(ctx *cli.Context) error {
+	opts := stacker.PruneOptions{MaxAge: ctx.Duration("max-age"), DryRun: ctx.Bool("dry-run")}
+	if ctx.IsSet("max-size") {
+		size, err := humanize.ParseBytes(ctx.String("max-size"))
+		if err != nil {
+			return errors.Wrapf(err, "invalid max size %s", ctx.String("max-size"))
+		}
+		opts.MaxSize = int64(size)
+	}
+
+	if opts.MaxAge <= 0 && opts.MaxSize <= 0 {
+		return errors.Errorf("nothing to prune by, give --max-age or --max-size")
+	}
+
+	// builds must not lose their imports from under them
+	_, locks, err := stacker.NewStorage(config)
+	if err != nil {
+		return err
+	}
+	defer locks.Unlock()
+
+	// every layer has its own cache dir
+	importsDir := path.Join(config.StackerDir, "imports")
+	dirs := []string{}
+	layers, err := os.ReadDir(importsDir)
+	if err != nil && !os.IsNotExist(err) {
+		return errors.WithStack(err)
+	}
+	for _, l := range layers {
+		if l.IsDir() {
+			dirs = append(dirs, path.Join(importsDir, l.Name()))
+		}
+	}
+	dirs = append(dirs, ctx.StringSlice("cache-dir")...)
+
+	results, err := stacker.PruneCache(dirs, opts)
+	if err != nil {
+		return err
+	}
+
+	freed := int64(0)
+	for _, r := range results {
+		log.Infof("%s: %s, last used %s (%s)", r.Path, humanize.Bytes(uint64(r.Size)), humanize.Time(r.LastUsed), r.Reason)
+		freed += r.Size
+	}
+
+	verb := "removed"
+	if opts.DryRun {
+		verb = "would remove"
+	}
+	fmt.Printf("%s %d cached imports, %s\n", verb, len(results), humanize.Bytes(uint64(freed)))
+	return nil
+}
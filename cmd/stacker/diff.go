@@ -0,0 +1,87 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/dustin/go-humanize"
+	"github.com/opencontainers/umoci"
+	"github.com/pkg/errors"
+	cli "github.com/urfave/cli/v2"
+	"stackerbuild.io/stacker/pkg/stacker"
+)
+
+var diffCmd = cli.Command{
+	Name:   "diff",
+	Usage:  "print the files that are different in two images",
+	Action: doDiff,
+	Flags: []cli.Flag{
+		&cli.StringSliceFlag{
+			Name:  "path",
+			Usage: "only compare the files at or under this path (may be given more than once)",
+		},
+		&cli.BoolFlag{
+			Name:  "json",
+			Usage: "print the differences as json",
+		},
+	},
+	ArgsUsage: `<tag-a> <tag-b>
+
+<tag-a> and <tag-b> are the tags of the images in the OCI layout to compare;
+what's different in <tag-b> is printed. Only tar layers can be compared.`,
+}
+
+// describeFile is the mode and size of a file, as ls would print them.
+func describeFile(f *stacker.ImageFile) string {
+	desc := fmt.Sprintf("%s %d:%d", f.Mode, f.Uid, f.Gid)
+	if f.Mode.IsRegular() {
+		desc += " " + humanize.Bytes(uint64(f.Size))
+	}
+	if f.Linkname != "" {
+		desc += " -> " + f.Linkname
+	}
+	return desc
+}
+
+func doDiff(ctx *cli.Context) error {
+	if ctx.Args().Len() != 2 {
+		return errors.Errorf("wrong number of args for diff")
+	}
+
+	oci, err := umoci.OpenLayout(config.OCIDir)
+	if err != nil {
+		return err
+	}
+	defer oci.Close()
+
+	changes, err := stacker.Diff(oci, ctx.Args().Get(0), ctx.Args().Get(1), ctx.StringSlice("path"))
+	if err != nil {
+		return err
+	}
+
+	if ctx.Bool("json") {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(changes)
+	}
+
+	for _, change := range changes {
+		switch change.Change {
+		case stacker.FileAdded:
+			fmt.Printf("A %s (%s)\n", change.Path, describeFile(change.After))
+		case stacker.FileRemoved:
+			fmt.Printf("D %s (%s)\n", change.Path, describeFile(change.Before))
+		case stacker.FileModified:
+			before, after := describeFile(change.Before), describeFile(change.After)
+			if before == after {
+				// only the content changed
+				fmt.Printf("M %s (%s)\n", change.Path, after)
+			} else {
+				fmt.Printf("M %s (%s => %s)\n", change.Path, before, after)
+			}
+		}
+	}
+
+	return nil
+}
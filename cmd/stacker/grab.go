@@ -2,34 +2,54 @@ package main
 
 import (
 	"os"
+	"path"
 	"strings"
 
 	"github.com/pkg/errors"
 	cli "github.com/urfave/cli/v2"
+	"stackerbuild.io/stacker/pkg/lib"
 	"stackerbuild.io/stacker/pkg/stacker"
 )
 
 var grabCmd = cli.Command{
 	Name:   "grab",
-	Usage:  "grabs a file from the layer's filesystem",
+	Usage:  "grabs a file from the layer's filesystem, or downloads a url",
 	Action: doGrab,
-	ArgsUsage: `<tag>:<path>
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:  "hash",
+			Usage: "sha256 a downloaded url must have",
+		},
+		&cli.StringFlag{
+			Name:  "cache-dir",
+			Usage: "where downloaded urls are cached, by default $STACKER_CACHE, $XDG_CACHE_HOME/stacker or ~/.cache/stacker",
+		},
+	},
+	ArgsUsage: `<tag>:<path> | <url> [-]
 
 <tag> is the tag in a built stacker image to extract the file from.
 
-<path> is the path to extract (relative to /) in the image's rootfs.`,
+<path> is the path to extract (relative to /) in the image's rootfs.
+
+<url> is an http(s), s3:// or gs:// url to download (through stacker's cache, and verified
+like an import) into the current directory, or, if followed by -, to stdout.`,
 }
 
 func doGrab(ctx *cli.Context) error {
+	arg := ctx.Args().First()
+	if stacker.IsRemoteURL(arg) {
+		return doGrabURL(ctx, arg)
+	}
+
 	s, locks, err := stacker.NewStorage(config)
 	if err != nil {
 		return err
 	}
 	defer locks.Unlock()
 
-	parts := strings.SplitN(ctx.Args().First(), ":", 2)
+	parts := strings.SplitN(arg, ":", 2)
 	if len(parts) < 2 {
-		return errors.Errorf("invalid grab argument: %s", ctx.Args().First())
+		return errors.Errorf("invalid grab argument: %s", arg)
 	}
 
 	name, cleanup, err := s.TemporaryWritableSnapshot(parts[0])
@@ -45,3 +65,38 @@ func doGrab(ctx *cli.Context) error {
 
 	return stacker.Grab(config, s, name, parts[1], cwd, "", nil, -1, -1)
 }
+
+func doGrabURL(ctx *cli.Context, url string) error {
+	policy, err := stacker.ParseChecksumPolicy(config.ChecksumPolicy)
+	if err != nil {
+		return err
+	}
+
+	opts, err := downloadOptions()
+	if err != nil {
+		return err
+	}
+	// the bar goes to stderr, which may well be a terminal when stdout
+	// isn't
+	opts.Progress = !ctx.Bool("no-progress")
+	opts.ExpectedHash = ctx.String("hash")
+	opts.ChecksumPolicy = policy
+
+	cacheDir := ctx.String("cache-dir")
+	if cacheDir == "" {
+		cacheDir = stacker.DefaultCacheDir()
+	}
+
+	switch dest := ctx.Args().Get(1); dest {
+	case "-":
+		return stacker.DownloadTo(os.Stdout, cacheDir, url, opts)
+	case "":
+		name, err := stacker.DownloadWithOptions(cacheDir, url, opts)
+		if err != nil {
+			return err
+		}
+		return lib.FileCopyNoPerms(path.Base(name), name)
+	default:
+		return errors.Errorf("invalid grab destination %s: only - (stdout) is supported", dest)
+	}
+}
@@ -1,24 +1,28 @@
 package main
 
 import (
-	"context"
 	"encoding/json"
 	"fmt"
+	"os"
+	"sort"
+	"strings"
 
 	"github.com/dustin/go-humanize"
-	ispec "github.com/opencontainers/image-spec/specs-go/v1"
 	"github.com/opencontainers/umoci"
-	"github.com/opencontainers/umoci/oci/casext"
-	"github.com/pkg/errors"
 	cli "github.com/urfave/cli/v2"
-	stackeroci "stackerbuild.io/stacker/pkg/oci"
+	"stackerbuild.io/stacker/pkg/stacker"
 )
 
 var inspectCmd = cli.Command{
 	Name:   "inspect",
-	Usage:  "print the json representation of an OCI image",
+	Usage:  "print what's known about the OCI images stacker built",
 	Action: doInspect,
-	Flags:  []cli.Flag{},
+	Flags: []cli.Flag{
+		&cli.BoolFlag{
+			Name:  "json",
+			Usage: "print it as json",
+		},
+	},
 	ArgsUsage: `[tag]
 
 <tag> is the tag in the stackerfile to inspect. If none is supplied, inspect
@@ -32,60 +36,149 @@ func doInspect(ctx *cli.Context) error {
 	}
 	defer oci.Close()
 
-	arg := ctx.Args().Get(0)
-	if arg != "" {
-		return renderManifest(oci, arg)
-	}
-
-	tags, err := oci.ListReferences(context.Background())
-	if err != nil {
-		return err
+	tags := []string{ctx.Args().Get(0)}
+	if tags[0] == "" {
+		tags, err = stacker.InspectableTags(oci)
+		if err != nil {
+			return err
+		}
 	}
 
+	inspections := []*stacker.Inspection{}
 	for _, t := range tags {
-		err = renderManifest(oci, t)
+		inspection, err := stacker.Inspect(oci, t)
 		if err != nil {
 			return err
 		}
+		inspections = append(inspections, inspection)
 	}
 
+	if ctx.Bool("json") {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if ctx.Args().Get(0) != "" {
+			return enc.Encode(inspections[0])
+		}
+		return enc.Encode(inspections)
+	}
+
+	for _, inspection := range inspections {
+		renderInspection(inspection)
+	}
 	return nil
 }
 
-func renderManifest(oci casext.Engine, name string) error {
-	man, err := stackeroci.LookupManifest(oci, name)
-	if err != nil {
-		return err
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
 	}
+	sort.Strings(keys)
+	return keys
+}
 
-	fmt.Printf("%s\n", name)
-	for i, l := range man.Layers {
+func renderInspection(inspection *stacker.Inspection) {
+	fmt.Printf("%s (%s)\n", inspection.Tag, inspection.Digest)
+	for i, l := range inspection.Layers {
 		fmt.Printf("\tlayer %d: %s... (%s, %s)\n", i, l.Digest.Encoded()[:12], humanize.Bytes(uint64(l.Size)), l.MediaType)
 	}
 
-	if len(man.Annotations) > 0 {
+	build := inspection.Build
+	annotations := []string{}
+	for _, k := range sortedKeys(inspection.Annotations) {
+		if strings.HasSuffix(k, strings.TrimPrefix(stacker.StackerContentsAnnotation, "%s")) {
+			// printed with the rest of the build below
+			continue
+		}
+		annotations = append(annotations, k)
+	}
+	if len(annotations) > 0 {
 		fmt.Printf("Annotations:\n")
-		for k, v := range man.Annotations {
-			fmt.Printf("  %s: %s\n", k, v)
+		for _, k := range annotations {
+			fmt.Printf("  %s: %s\n", k, inspection.Annotations[k])
 		}
 	}
 
-	configBlob, err := oci.FromDescriptor(context.Background(), man.Config)
-	if err != nil {
-		return err
+	config := inspection.Config
+	fmt.Printf("Image config:\n")
+	fmt.Printf("  platform: %s/%s\n", config.OS, config.Architecture)
+	if config.Created != nil {
+		fmt.Printf("  created: %s\n", config.Created)
+	}
+	if config.Config.User != "" {
+		fmt.Printf("  user: %s\n", config.Config.User)
+	}
+	if config.Config.WorkingDir != "" {
+		fmt.Printf("  working dir: %s\n", config.Config.WorkingDir)
+	}
+	if len(config.Config.Entrypoint) > 0 {
+		fmt.Printf("  entrypoint: %q\n", config.Config.Entrypoint)
+	}
+	if len(config.Config.Cmd) > 0 {
+		fmt.Printf("  cmd: %q\n", config.Config.Cmd)
+	}
+	for _, env := range config.Config.Env {
+		fmt.Printf("  env: %s\n", env)
+	}
+	volumes := []string{}
+	for v := range config.Config.Volumes {
+		volumes = append(volumes, v)
+	}
+	sort.Strings(volumes)
+	for _, volume := range volumes {
+		fmt.Printf("  volume: %s\n", volume)
+	}
+	for _, k := range sortedKeys(config.Config.Labels) {
+		fmt.Printf("  label: %s=%s\n", k, config.Config.Labels[k])
 	}
 
-	if configBlob.Descriptor.MediaType != ispec.MediaTypeImageConfig {
-		return errors.Errorf("bad image config type: %s", configBlob.Descriptor.MediaType)
+	if len(config.History) > 0 {
+		fmt.Printf("History:\n")
+		for _, h := range config.History {
+			created := ""
+			if h.Created != nil {
+				created = h.Created.String()
+			}
+			empty := ""
+			if h.EmptyLayer {
+				empty = " (no layer)"
+			}
+			fmt.Printf("  %s %s%s\n", created, strings.TrimSpace(h.CreatedBy+" "+h.Comment), empty)
+		}
 	}
 
-	config := configBlob.Data.(ispec.Image)
+	if build == nil {
+		return
+	}
 
-	fmt.Printf("Image config:\n")
-	pretty, err := json.MarshalIndent(config, "", "  ")
-	if err != nil {
-		return err
+	fmt.Printf("Build:\n")
+	if build.StackerVersion != "" {
+		fmt.Printf("  stacker version: %s\n", build.StackerVersion)
+	}
+	if build.GitVersion != "" {
+		fmt.Printf("  git version: %s\n", build.GitVersion)
+	}
+	if !build.Provenance {
+		fmt.Printf("  (built without --provenance, so the substitutions and the digests of the imports weren't recorded)\n")
+	}
+	for _, k := range sortedKeys(build.Substitutions) {
+		fmt.Printf("  substitution: %s=%s\n", k, build.Substitutions[k])
+	}
+	for _, dep := range build.Dependencies {
+		name := dep.URI
+		if name == "" {
+			name = dep.Name
+		}
+		digests := []string{}
+		for _, algorithm := range sortedKeys(dep.Digest) {
+			digests = append(digests, algorithm+":"+dep.Digest[algorithm])
+		}
+		fmt.Printf("  dependency: %s %s\n", name, strings.Join(digests, " "))
+	}
+	if build.Stackerfile != "" {
+		fmt.Printf("  stacker file:\n")
+		for _, line := range strings.Split(strings.TrimRight(build.Stackerfile, "\n"), "\n") {
+			fmt.Printf("    %s\n", line)
+		}
 	}
-	fmt.Println(string(pretty))
-	return nil
 }
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
 	"os"
 	"path"
@@ -14,6 +15,7 @@ import (
 	"stackerbuild.io/stacker/pkg/lib"
 	"stackerbuild.io/stacker/pkg/log"
 	"stackerbuild.io/stacker/pkg/overlay"
+	"stackerbuild.io/stacker/pkg/stacker"
 )
 
 var internalGoCmd = cli.Command{
@@ -32,10 +34,18 @@ var internalGoCmd = cli.Command{
 			Name:   "chown",
 			Action: doChown,
 		},
+		&cli.Command{
+			Name:   "scan-packages",
+			Action: doScanPackages,
+		},
 		&cli.Command{
 			Name:   "check-aa-profile",
 			Action: doCheckAAProfile,
 		},
+		&cli.Command{
+			Name:   "check-storage",
+			Action: doCheckStorage,
+		},
 		/*
 		 * these are not actually used by stacker, but are entrypoints
 		 * to the code for use in the test suite.
@@ -94,6 +104,24 @@ func doTestsuiteCheckOverlay(ctx *cli.Context) error {
 	return nil
 }
 
+// doCheckStorage checks whether the storage type given as its argument works
+// for the user it is run as, for unpriv-setup. Like testsuite-check-overlay,
+// it exit(50)s if it doesn't.
+func doCheckStorage(ctx *cli.Context) error {
+	err := os.MkdirAll(config.RootFSDir, 0755)
+	if err != nil {
+		return errors.Wrapf(err, "couldn't make rootfs dir for storage check")
+	}
+
+	err = stacker.CheckStorage(config, ctx.Args().Get(0))
+	if err != nil {
+		log.Infof("%s", err)
+		os.Exit(50)
+	}
+
+	return nil
+}
+
 func doImageCopy(ctx *cli.Context) error {
 	if ctx.Args().Len() != 2 {
 		return errors.Errorf("wrong number of args")
@@ -106,6 +134,24 @@ func doImageCopy(ctx *cli.Context) error {
 	})
 }
 
+func doScanPackages(ctx *cli.Context) error {
+	if ctx.Args().Len() != 1 {
+		return errors.Errorf("wrong number of args")
+	}
+
+	pkgs, err := stacker.ScanInstalledPackages("/")
+	if err != nil {
+		return err
+	}
+
+	content, err := json.Marshal(pkgs)
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(ctx.Args().Get(0), content, 0644)
+}
+
 func doCP(ctx *cli.Context) error {
 	if ctx.Args().Len() != 2 {
 		return errors.Errorf("wrong number of args")
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"github.com/pkg/errors"
+	cli "github.com/urfave/cli/v2"
+	"stackerbuild.io/stacker/pkg/stacker"
+)
+
+var loadCmd = cli.Command{
+	Name:   "load",
+	Usage:  "loads built images into the local docker daemon or containerd",
+	Action: doLoad,
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:  "runtime",
+			Usage: "where to load the images: docker (the daemon of $DOCKER_HOST, if set) or containerd",
+			Value: stacker.RuntimeDocker,
+		},
+		&cli.StringFlag{
+			Name:  "namespace",
+			Usage: "the containerd namespace to load the images into, e.g. k8s.io for kubernetes",
+			Value: "default",
+		},
+		&cli.StringFlag{
+			Name:  "repository",
+			Usage: "what the names of the loaded images start with, e.g. registry.example.com/team",
+		},
+		&cli.StringFlag{
+			Name:  "tag",
+			Usage: "the tag of the loaded images",
+			Value: "latest",
+		},
+	},
+	ArgsUsage: `<tag>...
+
+<tag> is the tag of an image in the OCI layout, which is loaded as
+[<repository>/]<tag>:<tag flag>. Only images of tar layers can be loaded.`,
+}
+
+func doLoad(ctx *cli.Context) error {
+	if ctx.Args().Len() < 1 {
+		return errors.Errorf("load needs the tags of the images to load")
+	}
+
+	return stacker.Load(config, ctx.Args().Slice(), stacker.LoadArgs{
+		Runtime:    ctx.String("runtime"),
+		Namespace:  ctx.String("namespace"),
+		Repository: ctx.String("repository"),
+		Tag:        ctx.String("tag"),
+		Progress:   shouldShowProgress(ctx),
+	})
+}
@@ -9,6 +9,8 @@ import (
 	"path"
 	"path/filepath"
 	"runtime/debug"
+	"slices"
+	"strings"
 	"syscall"
 
 	"github.com/apex/log"
@@ -19,6 +21,7 @@ import (
 	"stackerbuild.io/stacker/pkg/container"
 	"stackerbuild.io/stacker/pkg/lib"
 	stackerlog "stackerbuild.io/stacker/pkg/log"
+	"stackerbuild.io/stacker/pkg/stacker"
 	"stackerbuild.io/stacker/pkg/types"
 )
 
@@ -35,6 +38,11 @@ func shouldShowProgress(ctx *cli.Context) bool {
 		return true
 	}
 
+	/* the bars would be drawn into the json that's logged to stderr */
+	if ctx.String("log-format") == "json" && ctx.String("log-file") == "" {
+		return false
+	}
+
 	/* otherise, show it when we're attached to a terminal */
 	return term.IsTerminal(int(os.Stdout.Fd()))
 }
@@ -67,7 +75,7 @@ func shouldSkipInternalUserns(ctx *cli.Context) bool {
 	}
 	arg0 := ctx.Args().Get(0)
 
-	if arg0 == "internal-go" && ctx.Args().Get(1) == "testsuite-check-overlay" {
+	if arg0 == "internal-go" && (ctx.Args().Get(1) == "testsuite-check-overlay" || ctx.Args().Get(1) == "check-storage") {
 		return false
 	}
 
@@ -115,11 +123,15 @@ func main() {
 		&chrootCmd,
 		&cleanCmd,
 		&inspectCmd,
+		&diffCmd,
 		&grabCmd,
 		&internalGoCmd,
 		&unprivSetupCmd,
 		&gcCmd,
 		&checkCmd,
+		&cacheCmd,
+		&verifyCmd,
+		&loadCmd,
 	}
 
 	app.DisableSliceFlagSeparator = true
@@ -167,9 +179,63 @@ func main() {
 			Usage: "whether to log a timestamp prefix",
 		},
 		&cli.StringFlag{
-			Name:  "storage-type",
-			Usage: "storage type (must be \"overlay\", left for compatibility)",
-			Value: "overlay",
+			Name:  "log-format",
+			Usage: "the format of the logs: \"text\", or \"json\" for an object per line with the events of the build",
+			Value: "text",
+		},
+		&cli.StringFlag{
+			Name:    "storage-type",
+			Aliases: []string{"storage-driver"},
+			Usage:   "storage type: \"overlay\", or \"fuse-overlayfs\" for kernels without unprivileged overlayfs (defaults to the previous run's, or what unpriv-setup found works)",
+			Value:   "overlay",
+		},
+		&cli.DurationFlag{
+			Name:  "connect-timeout",
+			Usage: "give up connecting to a server to download an import after this long (0 means never)",
+		},
+		&cli.DurationFlag{
+			Name:  "stall-timeout",
+			Usage: "give up downloading an import when the server sends nothing for this long (0 means never)",
+		},
+		&cli.IntFlag{
+			Name:  "download-retries",
+			Usage: "how many more times to try downloading an import that failed with a transient (5xx, 429 or connection) error",
+		},
+		&cli.DurationFlag{
+			Name:  "download-retry-backoff",
+			Usage: "how long to wait before retrying a failed download, doubled for every retry (default 1s)",
+		},
+		&cli.IntFlag{
+			Name:  "download-concurrency",
+			Usage: "how many of a layer's imports to download at once",
+		},
+		&cli.StringSliceFlag{
+			Name:  "base-stacker-dir",
+			Usage: "read-only stacker dir whose import cache is used before downloading; can be supplied multiple times",
+		},
+		&cli.BoolFlag{
+			Name:  "cache-dir-per-build",
+			Usage: "start with an empty import cache, only re-using imports from --base-stacker-dir",
+		},
+		&cli.StringFlag{
+			Name:  "checksum-policy",
+			Usage: "how much to insist on verifying downloads: none, prefer (any available checksum), require or agree (all available checksums must match)",
+		},
+		&cli.StringFlag{
+			Name:  "size-change-policy",
+			Usage: "what to do when a cached import with a pinned hash changes size upstream: refetch, warn or error",
+		},
+		&cli.StringFlag{
+			Name:  "cache-proxy",
+			Usage: "download imports through this pull-through cache, as <cache-proxy>/<scheme>/<host>/<path>",
+		},
+		&cli.StringFlag{
+			Name:  "download-network",
+			Usage: "connect to servers to download imports over tcp4 or tcp6 only (default: both)",
+		},
+		&cli.StringSliceFlag{
+			Name:  "log-scope-level",
+			Usage: "set the log level of a subsystem in place of --debug/--quiet, e.g. network=warn or network=debug; can be supplied multiple times",
 		},
 		&cli.BoolFlag{
 			Name:   "internal-userns",
@@ -265,6 +331,30 @@ func main() {
 			return err
 		}
 
+		err = config.Security.Validate()
+		if err != nil {
+			return errors.Wrapf(err, "invalid security config")
+		}
+		if config.Security.SeccompProfile != "" {
+			config.Security.SeccompProfile, err = filepath.Abs(config.Security.SeccompProfile)
+			if err != nil {
+				return errors.WithStack(err)
+			}
+		}
+
+		for i, key := range config.BaseImagePolicy.Keys {
+			config.BaseImagePolicy.Keys[i], err = filepath.Abs(key)
+			if err != nil {
+				return errors.WithStack(err)
+			}
+		}
+		if config.BaseImagePolicy.PolicyFile != "" {
+			config.BaseImagePolicy.PolicyFile, err = filepath.Abs(config.BaseImagePolicy.PolicyFile)
+			if err != nil {
+				return errors.WithStack(err)
+			}
+		}
+
 		config.StackerDir, err = filepath.Abs(config.StackerDir)
 		if err != nil {
 			return err
@@ -280,6 +370,69 @@ func main() {
 		}
 
 		config.StorageType = ctx.String("storage-type")
+		if !ctx.IsSet("storage-type") {
+			recorded, err := stacker.RecordedStorageType(config)
+			if err != nil {
+				return err
+			}
+			if slices.Contains(stacker.StorageTypes, recorded) {
+				config.StorageType = recorded
+			}
+		}
+
+		if ctx.IsSet("connect-timeout") {
+			config.ConnectTimeout = ctx.Duration("connect-timeout")
+		}
+		if ctx.IsSet("stall-timeout") {
+			config.StallTimeout = ctx.Duration("stall-timeout")
+		}
+		if ctx.IsSet("download-retries") {
+			config.DownloadRetries = ctx.Int("download-retries")
+		}
+		if config.DownloadRetries < 0 {
+			return errors.Errorf("invalid download retries %d: cannot be negative", config.DownloadRetries)
+		}
+		if ctx.IsSet("download-retry-backoff") {
+			config.DownloadRetryBackoff = ctx.Duration("download-retry-backoff")
+		}
+		if config.DownloadRetryBackoff == 0 {
+			config.DownloadRetryBackoff = stacker.DefaultOptions().RetryBackoff
+		}
+		if ctx.IsSet("download-concurrency") {
+			config.DownloadConcurrency = ctx.Int("download-concurrency")
+		}
+		if config.DownloadConcurrency < 0 {
+			return errors.Errorf("invalid download concurrency %d: cannot be negative", config.DownloadConcurrency)
+		}
+		if ctx.IsSet("base-stacker-dir") {
+			config.BaseStackerDirs = ctx.StringSlice("base-stacker-dir")
+		}
+		if ctx.IsSet("cache-dir-per-build") {
+			config.CacheDirPerBuild = ctx.Bool("cache-dir-per-build")
+		}
+		if ctx.IsSet("cache-proxy") {
+			config.CacheProxy = ctx.String("cache-proxy")
+		}
+		if ctx.IsSet("download-network") {
+			config.DownloadNetwork = ctx.String("download-network")
+		}
+		switch config.DownloadNetwork {
+		case "", "tcp", "tcp4", "tcp6":
+		default:
+			return errors.Errorf("invalid download network %q: must be tcp, tcp4 or tcp6", config.DownloadNetwork)
+		}
+		if ctx.IsSet("checksum-policy") {
+			config.ChecksumPolicy = ctx.String("checksum-policy")
+		}
+		if _, err := stacker.ParseChecksumPolicy(config.ChecksumPolicy); err != nil {
+			return err
+		}
+		if ctx.IsSet("size-change-policy") {
+			config.SizeChangePolicy = ctx.String("size-change-policy")
+		}
+		if _, err := stacker.ParseSizeChangePolicy(config.SizeChangePolicy); err != nil {
+			return err
+		}
 
 		fi, err := os.Stat(config.CacheFile())
 		if err != nil {
@@ -297,17 +450,40 @@ func main() {
 			}
 		}
 
-		var handler log.Handler
-		handler = stackerlog.NewTextHandler(os.Stderr, ctx.Bool("log-timestamp"))
+		logOut := os.Stderr
 		if ctx.String("log-file") != "" {
 			logFile, err = os.Create(ctx.String("log-file"))
 			if err != nil {
 				return errors.Wrapf(err, "failed to access %v", logFile)
 			}
-			handler = stackerlog.NewTextHandler(logFile, ctx.Bool("log-timestamp"))
+			logOut = logFile
+		}
+
+		var handler log.Handler
+		switch ctx.String("log-format") {
+		case "text":
+			handler = stackerlog.NewTextHandler(logOut, ctx.Bool("log-timestamp"))
+		case "json":
+			handler = stackerlog.NewJSONHandler(logOut)
+			stackerlog.EnableEvents(true)
+		default:
+			return errors.Errorf("invalid log format %s, expected text or json", ctx.String("log-format"))
 		}
 
 		stackerlog.FilterNonStackerLogs(handler, logLevel)
+		for _, scopeLevel := range ctx.StringSlice("log-scope-level") {
+			scope, level, ok := strings.Cut(scopeLevel, "=")
+			if !ok {
+				return errors.Errorf("invalid log scope level %s, expected <scope>=<level>", scopeLevel)
+			}
+
+			lvl, err := log.ParseLevel(level)
+			if err != nil {
+				return errors.Wrapf(err, "invalid log scope level %s", scopeLevel)
+			}
+
+			stackerlog.SetScopeLevel(scope, lvl)
+		}
 		stackerlog.Debugf("stacker version %s", lib.StackerVersion)
 
 		if !ctx.Bool("internal-userns") && !shouldSkipInternalUserns(ctx) && len(os.Args) > 1 {
@@ -0,0 +1,40 @@
+package main
+
+import (
+	cli "github.com/urfave/cli/v2"
+	stackerlog "stackerbuild.io/stacker/pkg/log"
+	"stackerbuild.io/stacker/pkg/stacker"
+)
+
+func initMetricsFlags() []cli.Flag {
+	return []cli.Flag{
+		&cli.StringFlag{
+			Name:  "metrics-file",
+			Usage: "write how long each step took, what was downloaded and cached, and the image sizes to this file",
+		},
+		&cli.StringFlag{
+			Name:  "metrics-format",
+			Usage: "the format of --metrics-file: \"json\", or \"prometheus\" for a textfile collector",
+			Value: stacker.MetricsJSON,
+		},
+	}
+}
+
+// finishMetrics logs the summary of metrics, and writes them to --metrics-file
+// if it was given, even if the build or publish failed with err.
+func finishMetrics(ctx *cli.Context, metrics *stacker.BuildMetrics, err error) error {
+	metrics.LogSummary()
+
+	if ctx.String("metrics-file") == "" {
+		return err
+	}
+
+	writeErr := metrics.Write(ctx.String("metrics-file"), ctx.String("metrics-format"))
+	if err != nil {
+		if writeErr != nil {
+			stackerlog.Errorf("%v", writeErr)
+		}
+		return err
+	}
+	return writeErr
+}
@@ -1,6 +1,10 @@
 package main
 
 import (
+	"os"
+	"time"
+
+	"github.com/dustin/go-humanize"
 	"github.com/pkg/errors"
 	cli "github.com/urfave/cli/v2"
 	"stackerbuild.io/stacker/pkg/lib"
@@ -13,7 +17,7 @@ var publishCmd = cli.Command{
 	Name:   "publish",
 	Usage:  "publishes OCI images previously built from one or more stacker yaml files",
 	Action: doPublish,
-	Flags: []cli.Flag{
+	Flags: append([]cli.Flag{
 		&cli.StringFlag{
 			Name:    "stacker-file",
 			Aliases: []string{"f"},
@@ -35,9 +39,9 @@ var publishCmd = cli.Command{
 			Aliases: []string{"d"},
 			Usage:   "directory under which to search for stackerfiles to publish",
 		},
-		&cli.StringFlag{
+		&cli.StringSliceFlag{
 			Name:  "url",
-			Usage: "url where to publish the OCI images",
+			Usage: "url where to publish the OCI images; can be supplied multiple times",
 		},
 		&cli.StringFlag{
 			Name:  "username",
@@ -53,7 +57,7 @@ var publishCmd = cli.Command{
 		},
 		&cli.StringSliceFlag{
 			Name:  "tag",
-			Usage: "tag to be used when publishing",
+			Usage: "tag to be used when publishing, which may have ${{FOO}} placeholders, e.g. ${{STACKER_GIT_SHA}}; can be supplied multiple times",
 		},
 		&cli.StringSliceFlag{
 			Name:  "substitute",
@@ -76,7 +80,58 @@ var publishCmd = cli.Command{
 			Name:  "image",
 			Usage: "specific image to be published when a stacker file has many images; can be specified multiple times",
 		},
-	},
+		&cli.StringFlag{
+			Name:  "sign",
+			Usage: "sign the published images with this cosign private key file (its passphrase is read from $COSIGN_PASSWORD), or \"keyless\" with an OIDC identity; KMS keys aren't supported",
+		},
+		&cli.StringFlag{
+			Name:    "sign-identity-token",
+			Usage:   "OIDC identity token to sign keyless with; without one, the identity is logged in to interactively",
+			EnvVars: []string{"SIGSTORE_ID_TOKEN"},
+		},
+		&cli.StringFlag{
+			Name:  "sign-fulcio-url",
+			Usage: "fulcio server that issues keyless signing certificates",
+			Value: stacker.DefaultFulcioURL,
+		},
+		&cli.StringFlag{
+			Name:  "sign-oidc-issuer",
+			Usage: "OIDC issuer to log in to interactively for keyless signing",
+			Value: stacker.DefaultOIDCIssuer,
+		},
+		&cli.StringFlag{
+			Name:  "sign-oidc-client-id",
+			Usage: "OIDC client id to log in to interactively for keyless signing",
+			Value: stacker.DefaultOIDCClientID,
+		},
+		&cli.StringFlag{
+			Name:  "sign-rekor-url",
+			Usage: "rekor transparency log to upload signatures to (by default, only keyless ones are, to " + stacker.DefaultRekorURL + ")",
+		},
+		&cli.StringFlag{
+			Name:  "tar-compression",
+			Usage: "recompress tar layers with gzip or zstd as they are published, if they were built compressed otherwise",
+		},
+		&cli.IntFlag{
+			Name:  "tar-compression-level",
+			Usage: "compression level of recompressed tar layers (gzip 1-9, zstd 1-22); the compressor's default if 0",
+		},
+		&cli.StringFlag{
+			Name:  "upload-chunk-size",
+			Usage: "how much of a blob to upload to the registry per request, so that a failed upload resumes from the last chunk",
+			Value: "64MiB",
+		},
+		&cli.IntFlag{
+			Name:  "upload-retries",
+			Usage: "how many more times in a row to try uploading a blob that failed with a transient (5xx, 429 or connection) error",
+			Value: 5,
+		},
+		&cli.DurationFlag{
+			Name:  "upload-retry-backoff",
+			Usage: "how long to wait before retrying a failed upload, doubled for every retry in a row",
+			Value: time.Second,
+		},
+	}, initMetricsFlags()...),
 	Before: beforePublish,
 }
 
@@ -100,11 +155,19 @@ func beforePublish(ctx *cli.Context) error {
 			password)
 	}
 
-	if len(ctx.String("url")) == 0 {
+	if len(ctx.StringSlice("url")) == 0 {
 		return errors.Errorf("--url is a mandatory argument for publishing")
 	}
 
-	return nil
+	chunkSize, err := humanize.ParseBytes(ctx.String("upload-chunk-size"))
+	if err != nil || chunkSize == 0 {
+		return errors.Errorf("invalid upload chunk size %q", ctx.String("upload-chunk-size"))
+	}
+	if ctx.Int("upload-retries") < 0 {
+		return errors.Errorf("invalid upload retries %d: cannot be negative", ctx.Int("upload-retries"))
+	}
+
+	return validateMetricsFlags(ctx)
 }
 
 func doPublish(ctx *cli.Context) error {
@@ -120,7 +183,7 @@ func doPublish(ctx *cli.Context) error {
 		Substitute:     ctx.StringSlice("substitute"),
 		SubstituteFile: ctx.String("substitute-file"),
 		Tags:           ctx.StringSlice("tag"),
-		Url:            ctx.String("url"),
+		Urls:           ctx.StringSlice("url"),
 		Username:       ctx.String("username"),
 		Password:       ctx.String("password"),
 		Force:          ctx.Bool("force"),
@@ -128,6 +191,42 @@ func doPublish(ctx *cli.Context) error {
 		SkipTLS:        ctx.Bool("skip-tls"),
 		LayerTypes:     layerTypes,
 		Images:         ctx.StringSlice("image"),
+
+		UploadRetries:      ctx.Int("upload-retries"),
+		UploadRetryBackoff: ctx.Duration("upload-retry-backoff"),
+	}
+
+	// validated before
+	chunkSize, _ := humanize.ParseBytes(ctx.String("upload-chunk-size"))
+	args.UploadChunkSize = int64(chunkSize)
+
+	if ctx.String("sign") != "" {
+		args.Sign = stacker.SignOpts{
+			Key:           ctx.String("sign"),
+			FulcioURL:     ctx.String("sign-fulcio-url"),
+			OIDCIssuer:    ctx.String("sign-oidc-issuer"),
+			OIDCClientID:  ctx.String("sign-oidc-client-id"),
+			IdentityToken: ctx.String("sign-identity-token"),
+			RekorURL:      ctx.String("sign-rekor-url"),
+		}
+		if passphrase, ok := os.LookupEnv("COSIGN_PASSWORD"); ok {
+			args.Sign.Passphrase = []byte(passphrase)
+		}
+		if args.Sign.Key == stacker.SignKeyless && args.Sign.RekorURL == "" {
+			args.Sign.RekorURL = stacker.DefaultRekorURL
+		}
+	}
+
+	if ctx.String("tar-compression") != "" {
+		compression, err := types.NewTarCompression(ctx.String("tar-compression"), ctx.Int("tar-compression-level"))
+		if err != nil {
+			return err
+		}
+		if compression.Name() == types.EstargzCompression {
+			return errors.Errorf("tar layers can't be recompressed with %s as they are published, build them with --tar-compression %s instead",
+				types.EstargzCompression, types.EstargzCompression)
+		}
+		args.TarCompression = &compression
 	}
 
 	var stackerFiles []string
@@ -143,5 +242,6 @@ func doPublish(ctx *cli.Context) error {
 	}
 
 	publisher := stacker.NewPublisher(&args)
-	return publisher.PublishMultiple(stackerFiles)
+	err = publisher.PublishMultiple(stackerFiles)
+	return finishMetrics(ctx, publisher.Metrics(), err)
 }
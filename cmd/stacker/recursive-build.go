@@ -53,7 +53,7 @@ func beforeRecursiveBuild(ctx *cli.Context) error {
 		return err
 	}
 
-	return nil
+	return validateMetricsFlags(ctx)
 }
 
 func doRecursiveBuild(ctx *cli.Context) error {
@@ -68,5 +68,6 @@ func doRecursiveBuild(ctx *cli.Context) error {
 	}
 
 	builder := stacker.NewBuilder(&args)
-	return builder.BuildMultiple(stackerFiles)
+	err = builder.BuildMultiple(stackerFiles)
+	return finishMetrics(ctx, builder.Metrics(), err)
 }
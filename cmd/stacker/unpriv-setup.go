@@ -1,12 +1,18 @@
 package main
 
 import (
+	"fmt"
 	"os"
+	"os/exec"
+	"path"
 	"path/filepath"
 	"strconv"
+	"strings"
+	"syscall"
 
 	"github.com/pkg/errors"
 	cli "github.com/urfave/cli/v2"
+	"stackerbuild.io/stacker/pkg/log"
 	"stackerbuild.io/stacker/pkg/stacker"
 )
 
@@ -98,5 +104,56 @@ func doUnprivSetup(ctx *cli.Context) error {
 		return err
 	}
 
-	return recursiveChown(config.RootFSDir, uid, gid)
+	err = recursiveChown(config.RootFSDir, uid, gid)
+	if err != nil {
+		return err
+	}
+
+	if ctx.IsSet("storage-type") {
+		return nil
+	}
+
+	// as root, any storage works; find one that works for the user
+	storageType, err := detectUnprivStorageType(uid, gid)
+	if err != nil {
+		log.Infof("WARNING: couldn't find a storage type that works for %s, using %s: %v", username, config.StorageType, err)
+		return nil
+	}
+
+	log.Infof("using storage type %s for %s", storageType, username)
+	config.StorageType = storageType
+	err = stacker.RecordStorageType(config)
+	if err != nil {
+		return err
+	}
+	return os.Chown(path.Join(config.StackerDir, "storage.type"), uid, gid)
+}
+
+// detectUnprivStorageType returns the first of the storage types that works
+// for the user uid, checking each as them, in their user namespace.
+func detectUnprivStorageType(uid int, gid int) (string, error) {
+	binary, err := os.Readlink("/proc/self/exe")
+	if err != nil {
+		return "", err
+	}
+
+	errs := []string{}
+	for _, storageType := range stacker.StorageTypes {
+		cmd := exec.Command(binary,
+			"--stacker-dir", config.StackerDir,
+			"--roots-dir", config.RootFSDir,
+			"--oci-dir", config.OCIDir,
+			"--storage-type", storageType,
+			"internal-go", "check-storage", storageType)
+		cmd.SysProcAttr = &syscall.SysProcAttr{Credential: &syscall.Credential{Uid: uint32(uid), Gid: uint32(gid)}}
+		output, err := cmd.CombinedOutput()
+		if err == nil {
+			return storageType, nil
+		}
+
+		log.Debugf("storage type %s doesn't work: %v: %s", storageType, err, output)
+		errs = append(errs, fmt.Sprintf("%s: %s", storageType, strings.TrimSpace(string(output))))
+	}
+
+	return "", errors.Errorf("none of the storage types work: %s", strings.Join(errs, "; "))
 }
@@ -38,6 +38,48 @@ func validateBuildFailureFlags(ctx *cli.Context) error {
 	return nil
 }
 
+func validateJobsFlag(ctx *cli.Context) error {
+	jobs := ctx.Int("jobs")
+	if jobs < 1 {
+		return errors.Errorf("--jobs must be at least 1, not %d", jobs)
+	}
+
+	// the command would have to share the terminal with the other layers
+	if jobs > 1 && ctx.String("on-run-failure") != "" {
+		return errors.Errorf("--on-run-failure and --shell-fail are interactive, they can't be used with --jobs")
+	}
+
+	return nil
+}
+
+func validateCacheFlags(ctx *cli.Context) error {
+	// the build cache is removed before each stackerfile is built
+	if ctx.Bool("no-cache") && ctx.String("cache-from") != "" {
+		return errors.Errorf("--no-cache and --cache-from can't be used together")
+	}
+
+	return nil
+}
+
+func validateMetricsFlags(ctx *cli.Context) error {
+	switch ctx.String("metrics-format") {
+	case stacker.MetricsJSON, stacker.MetricsPrometheus:
+		return nil
+	}
+
+	return errors.Errorf("--metrics-format must be %s or %s, not %s", stacker.MetricsJSON, stacker.MetricsPrometheus,
+		ctx.String("metrics-format"))
+}
+
+func validateSBOMFlag(ctx *cli.Context) error {
+	if ctx.String("sbom") == "" {
+		return nil
+	}
+
+	_, err := stacker.SBOMMediaType(ctx.String("sbom"))
+	return err
+}
+
 func validateLayerTypeFlags(ctx *cli.Context) error {
 	layerTypes := ctx.StringSlice("layer-type")
 	if len(layerTypes) == 0 {
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/pkg/errors"
+	cli "github.com/urfave/cli/v2"
+	"stackerbuild.io/stacker/pkg/stacker"
+)
+
+var verifyCmd = cli.Command{
+	Name:   "verify",
+	Usage:  "checks the imports, the OCI layout and the base images of a stackerfile without building it",
+	Action: doVerify,
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:    "stacker-file",
+			Aliases: []string{"f"},
+			Usage:   "the input stackerfile",
+			Value:   "stacker.yaml",
+		},
+		&cli.StringSliceFlag{
+			Name:  "substitute",
+			Usage: "variable substitution in stackerfiles, FOO=bar format",
+		},
+		&cli.StringFlag{
+			Name:  "substitute-file",
+			Usage: "file containing variable substitution in stackerfiles, 'FOO: bar' yaml format",
+		},
+		&cli.StringFlag{
+			Name:  "key",
+			Usage: "cosign public key the docker base images must be signed with, instead of the config's base_image_policy",
+		},
+		&cli.BoolFlag{
+			Name:  "skip-tls",
+			Usage: "skip verifying the certificates of the registries signatures are fetched from",
+		},
+	},
+	ArgsUsage: `
+
+Checks that the imports with a hash (http(s) ones once they are downloaded)
+still have it, that every blob of the images in the OCI layout exists and has
+its digest, and that the docker base images are signed with the --key, or else
+allowed by the base_image_policy of the stacker config.
+Every problem found is printed, and stacker exits non-zero if there are any.`,
+}
+
+func doVerify(ctx *cli.Context) error {
+	args := stacker.BuildArgs{
+		Config:         config,
+		Substitute:     ctx.StringSlice("substitute"),
+		SubstituteFile: ctx.String("substitute-file"),
+	}
+
+	builder := stacker.NewBuilder(&args)
+	problems, err := builder.Verify([]string{ctx.String("stacker-file")}, stacker.VerifyArgs{
+		Key:     ctx.String("key"),
+		SkipTLS: ctx.Bool("skip-tls"),
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, p := range problems {
+		fmt.Println(p)
+	}
+	if len(problems) > 0 {
+		return errors.Errorf("%d problems found", len(problems))
+	}
+
+	return nil
+}
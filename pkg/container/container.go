@@ -25,6 +25,10 @@ const (
 type Container struct {
 	sc types.StackerConfig
 	c  *lxc.Container
+
+	// outputPrefix is put in front of every line of output of
+	// non-interactive commands, see SetOutputPrefix.
+	outputPrefix string
 }
 
 func New(sc types.StackerConfig, name string) (*Container, error) {
@@ -91,6 +95,16 @@ func (c *Container) SetConfig(name string, value string) error {
 	return nil
 }
 
+// SetSecretEnv sets the environment variable name of the container to the
+// secret value, which unlike SetConfig it never puts in errors.
+func (c *Container) SetSecretEnv(name string, value string) error {
+	err := c.c.SetConfigItem("lxc.environment", fmt.Sprintf("%s=%s", name, value))
+	if err != nil {
+		return errors.Errorf("failed setting secret environment variable %s: %v", name, err)
+	}
+	return nil
+}
+
 // containerError tries its best to report as much context about an LXC error
 // as possible.
 func (c *Container) containerError(theErr error, msg string) error {
@@ -118,6 +132,12 @@ func (c *Container) containerError(theErr error, msg string) error {
 	return errors.Wrapf(theErr, msg)
 }
 
+// SetOutputPrefix makes the output of non-interactive commands run in c have
+// prefix in front of each line, e.g. when several containers run at once.
+func (c *Container) SetOutputPrefix(prefix string) {
+	c.outputPrefix = prefix
+}
+
 func (c *Container) Execute(args []string, stdin io.Reader) error {
 	f, err := os.CreateTemp("", fmt.Sprintf("stacker_%s_run", c.c.Name()))
 	if err != nil {
@@ -160,7 +180,13 @@ func (c *Container) Execute(args []string, stdin io.Reader) error {
 
 		go func() {
 			defer reader.Close()
-			_, err := io.Copy(os.Stdout, reader)
+			var out io.Writer = os.Stdout
+			if c.outputPrefix != "" {
+				pw := log.NewPrefixWriter(os.Stdout, c.outputPrefix)
+				defer pw.Close()
+				out = pw
+			}
+			_, err := io.Copy(out, reader)
 			if err != nil {
 				log.Infof("err from stdout copy: %s", err)
 			}
@@ -1,7 +1,11 @@
 package lib
 
 import (
+	"crypto/sha1"
+	"crypto/sha512"
+	"encoding/hex"
 	"fmt"
+	"hash"
 	"io"
 	"os"
 
@@ -10,17 +14,67 @@ import (
 	"github.com/pkg/errors"
 )
 
+const (
+	// files bigger than this are read in the background while hashing,
+	// see copyOverlapped.
+	overlappedHashThreshold = 64 * 1024 * 1024
+	overlappedHashChunkSize = 4 * 1024 * 1024
+	overlappedHashBuffers   = 3
+)
+
 func HashFile(path string, includeMode bool) (string, error) {
 	h := sha256.New()
+	err := hashFile(h, path, includeMode)
+	if err != nil {
+		return "", err
+	}
+
+	d := digest.NewDigest("sha256", h)
+	return d.String(), nil
+}
+
+// HashFileAlgorithm returns the hex encoded digest of path's content using
+// algorithm, one of sha256, sha512 or sha1.
+func HashFileAlgorithm(path string, algorithm string) (string, error) {
+	var h hash.Hash
+	switch algorithm {
+	case "sha256":
+		h = sha256.New()
+	case "sha512":
+		h = sha512.New()
+	case "sha1":
+		h = sha1.New()
+	default:
+		return "", errors.Errorf("unsupported hash algorithm %s", algorithm)
+	}
+
+	err := hashFile(h, path, false)
+	if err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func hashFile(h hash.Hash, path string, includeMode bool) error {
 	f, err := os.Open(path)
 	if err != nil {
-		return "", errors.Wrapf(err, "couldn't open %s for hashing", path)
+		return errors.Wrapf(err, "couldn't open %s for hashing", path)
 	}
 	defer f.Close()
 
-	_, err = io.Copy(h, f)
+	fi, err := f.Stat()
+	if err != nil {
+		return errors.Wrapf(err, "couldn't stat %s for hashing", path)
+	}
+
+	if fi.Size() > overlappedHashThreshold {
+		err = copyOverlapped(h, f)
+	} else {
+		_, err = io.Copy(h, f)
+	}
 	if err != nil {
-		return "", errors.Wrapf(err, "couldn't copy %s for hashing", path)
+		return errors.Wrapf(err, "couldn't copy %s for hashing", path)
 	}
 
 	if includeMode {
@@ -28,18 +82,56 @@ func HashFile(path string, includeMode bool) (string, error) {
 		// In general we want to do this, but not all external
 		// tooling includes it, so we can't compare it with the hash
 		// in the reply of a HTTP HEAD call
-
-		fi, err := f.Stat()
+		_, err = h.Write([]byte(fmt.Sprintf("%v", fi.Mode())))
 		if err != nil {
-			return "", errors.Wrapf(err, "couldn't stat %s for hashing", path)
+			return errors.Wrapf(err, "couldn't write mode")
 		}
+	}
 
-		_, err = h.Write([]byte(fmt.Sprintf("%v", fi.Mode())))
-		if err != nil {
-			return "", errors.Wrapf(err, "couldn't write mode")
+	return nil
+}
+
+// copyOverlapped is io.Copy, except that the next chunk of r is read while w
+// is busy with the previous one. sha256 itself can't be split up, but for big
+// files on slow disks, overlapping the reads with the hashing is most of the
+// win.
+func copyOverlapped(w io.Writer, r io.Reader) error {
+	free := make(chan []byte, overlappedHashBuffers)
+	for i := 0; i < overlappedHashBuffers; i++ {
+		free <- make([]byte, overlappedHashChunkSize)
+	}
+
+	filled := make(chan []byte, overlappedHashBuffers)
+	readErr := make(chan error, 1)
+	go func() {
+		defer close(filled)
+		for buf := range free {
+			n, err := io.ReadFull(r, buf)
+			if n > 0 {
+				filled <- buf[:n]
+			}
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				readErr <- nil
+				return
+			}
+			if err != nil {
+				readErr <- err
+				return
+			}
+		}
+	}()
+
+	var writeErr error
+	for buf := range filled {
+		// keep draining on errors, so the reader doesn't block
+		if writeErr == nil {
+			_, writeErr = w.Write(buf)
 		}
+		free <- buf[:cap(buf)]
 	}
 
-	d := digest.NewDigest("sha256", h)
-	return d.String(), nil
+	if err := <-readErr; err != nil {
+		return err
+	}
+	return writeErr
 }
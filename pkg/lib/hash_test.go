@@ -0,0 +1,40 @@
+package lib_test
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"os"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"stackerbuild.io/stacker/pkg/lib"
+)
+
+func TestHashFile(t *testing.T) {
+	Convey("HashFile", t, func() {
+		for _, size := range []int64{12, 64*1024*1024 + 4*1024*1024*2 + 7} {
+			f, err := os.CreateTemp("", "hash")
+			So(err, ShouldBeNil)
+			defer os.Remove(f.Name())
+
+			_, err = f.WriteString("hello world!")
+			So(err, ShouldBeNil)
+			So(f.Truncate(size), ShouldBeNil)
+			_, err = f.WriteAt([]byte("the end"), size-7)
+			So(err, ShouldBeNil)
+			So(f.Close(), ShouldBeNil)
+
+			f, err = os.Open(f.Name())
+			So(err, ShouldBeNil)
+			h := sha256.New()
+			_, err = io.Copy(h, f)
+			f.Close()
+			So(err, ShouldBeNil)
+
+			hash, err := lib.HashFile(f.Name(), false)
+			So(err, ShouldBeNil)
+			So(hash, ShouldEqual, fmt.Sprintf("sha256:%x", h.Sum(nil)))
+		}
+	})
+}
@@ -3,13 +3,19 @@ package lib
 import (
 	"context"
 	"io"
+	"os"
+	"path"
 	"strings"
 
 	"github.com/containers/image/v5/copy"
 	"github.com/containers/image/v5/docker"
+	dockerarchive "github.com/containers/image/v5/docker/archive"
 	"github.com/containers/image/v5/docker/daemon"
+	ociarchive "github.com/containers/image/v5/oci/archive"
 	"github.com/containers/image/v5/oci/layout"
+	"github.com/containers/image/v5/pkg/compression"
 	"github.com/containers/image/v5/signature"
+	"github.com/containers/image/v5/signature/signer"
 	"github.com/containers/image/v5/types"
 	ispec "github.com/opencontainers/image-spec/specs-go/v1"
 	"github.com/opencontainers/umoci"
@@ -31,6 +37,8 @@ func init() {
 	RegisterURLScheme("oci", layout.ParseReference)
 	RegisterURLScheme("docker", docker.ParseReference)
 	RegisterURLScheme("docker-daemon", daemon.ParseReference)
+	RegisterURLScheme("docker-archive", dockerarchive.ParseReference)
+	RegisterURLScheme("oci-archive", ociarchive.ParseReference)
 }
 
 func localRefParser(ref string) (types.ImageReference, error) {
@@ -59,8 +67,37 @@ type ImageCopyOpts struct {
 	DestSkipTLS       bool
 	Progress          io.Writer
 	Context           context.Context
+
+	// Platform, if set, picks the image for that platform out of a
+	// multi-platform source, instead of the one for the running system.
+	Platform *ispec.Platform
+
+	// AllImages copies all the images of a multi-platform source, along
+	// with the index of them, instead of only one of them.
+	AllImages bool
+
+	// Signers sign the images that are copied, as they are pushed. The
+	// signatures are pushed next to them as sigstore attachments, so Dest
+	// needs to be a registry.
+	Signers []*signer.Signer
+
+	// Compression, if set, is what the layers that are copied are
+	// recompressed with (gzip or zstd) unless they already are, at
+	// CompressionLevel if it isn't zero.
+	Compression      string
+	CompressionLevel int
+
+	// Registries, if set, are how images are pulled from and pushed to
+	// registries, instead of the system's registries.conf and certs.d.
+	Registries []Registry
 }
 
+// sigstoreAttachments is a registries.d config that makes containers/image
+// push sigstore signatures to the registry the image is pushed to.
+const sigstoreAttachments = `default-docker:
+  use-sigstore-attachments: true
+`
+
 func ImageCopy(opts ImageCopyOpts) error {
 	if opts.Context == nil {
 		opts.Context = context.Background()
@@ -71,7 +108,16 @@ func ImageCopy(opts ImageCopyOpts) error {
 		return err
 	}
 
-	destRef, err := localRefParser(opts.Dest)
+	dest := opts.Dest
+	if name, ok := strings.CutPrefix(dest, "docker://"); ok && len(opts.Registries) > 0 {
+		ref, err := docker.ParseReference("//" + name)
+		if err != nil {
+			return err
+		}
+		dest = "docker://" + RewriteReference(ref.DockerReference().String(), opts.Registries)
+	}
+
+	destRef, err := localRefParser(dest)
 	if err != nil {
 		return err
 	}
@@ -118,9 +164,68 @@ func ImageCopy(opts ImageCopyOpts) error {
 		}
 	}
 
+	if opts.Platform != nil {
+		args.SourceCtx.OSChoice = opts.Platform.OS
+		args.SourceCtx.ArchitectureChoice = opts.Platform.Architecture
+		args.SourceCtx.VariantChoice = opts.Platform.Variant
+	}
+
+	if opts.AllImages {
+		args.ImageListSelection = copy.CopyAllImages
+	}
+
+	if len(opts.Signers) > 0 {
+		if destRef.Transport().Name() != "docker" {
+			return errors.Errorf("can't sign %s: signatures can only be pushed to a registry", opts.Dest)
+		}
+
+		dir, err := os.MkdirTemp("", "stacker-registries.d-")
+		if err != nil {
+			return errors.Wrapf(err, "couldn't create registries.d")
+		}
+		defer os.RemoveAll(dir)
+
+		err = os.WriteFile(path.Join(dir, "stacker.yaml"), []byte(sigstoreAttachments), 0644)
+		if err != nil {
+			return errors.Wrapf(err, "couldn't create registries.d")
+		}
+
+		args.Signers = opts.Signers
+		args.DestinationCtx.RegistriesDirPath = dir
+	}
+
+	if len(opts.Registries) > 0 {
+		dir, err := os.MkdirTemp("", "stacker-registries-")
+		if err != nil {
+			return errors.Wrapf(err, "couldn't create registries.conf")
+		}
+		defer os.RemoveAll(dir)
+
+		err = registriesContext(args.SourceCtx, opts.Registries, dir)
+		if err != nil {
+			return err
+		}
+		args.DestinationCtx.SystemRegistriesConfPath = args.SourceCtx.SystemRegistriesConfPath
+		args.DestinationCtx.SystemRegistriesConfDirPath = args.SourceCtx.SystemRegistriesConfDirPath
+		args.DestinationCtx.DockerPerHostCertDirPath = args.SourceCtx.DockerPerHostCertDirPath
+	}
+
 	args.SourceCtx.OCIAcceptUncompressedLayers = true
 	args.DestinationCtx.OCIAcceptUncompressedLayers = true
 
+	if opts.Compression != "" {
+		algorithm, err := compression.AlgorithmByName(opts.Compression)
+		if err != nil {
+			return errors.Wrapf(err, "can't compress layers with %s", opts.Compression)
+		}
+		args.DestinationCtx.CompressionFormat = &algorithm
+		if opts.CompressionLevel != 0 {
+			args.DestinationCtx.CompressionLevel = &opts.CompressionLevel
+		}
+		// or OCI layouts keep the layers as they are
+		args.DestinationCtx.OCIAcceptUncompressedLayers = false
+	}
+
 	// Set ForceManifestMIMEType
 	// Supported manifest type :- https://github.com/containers/image/blob/master/manifest/manifest.go#L49
 	// ImageCopy caller should set correct manifest type at its end.
@@ -97,6 +97,33 @@ func TestImageCompressionCopy(t *testing.T) {
 	}
 }
 
+func TestImageCopyArchive(t *testing.T) {
+	assert := assert.New(t)
+	dir := t.TempDir()
+
+	oci, err := umoci.CreateLayout(path.Join(dir, "oci"))
+	assert.NoError(err)
+	assert.NoError(umoci.NewImage(oci, "foo"))
+	oci.Close()
+
+	assert.NoError(ImageCopy(ImageCopyOpts{
+		Src:  fmt.Sprintf("oci:%s/oci:foo", dir),
+		Dest: fmt.Sprintf("oci-archive:%s/foo.tar", dir),
+	}))
+
+	assert.NoError(ImageCopy(ImageCopyOpts{
+		Src:  fmt.Sprintf("oci-archive:%s/foo.tar", dir),
+		Dest: fmt.Sprintf("oci:%s/oci2:bar", dir),
+	}))
+
+	oci, err = umoci.OpenLayout(path.Join(dir, "oci2"))
+	assert.NoError(err)
+	defer oci.Close()
+	descPaths, err := oci.ResolveReference(context.Background(), "bar")
+	assert.NoError(err)
+	assert.Len(descPaths, 1)
+}
+
 func TestForceManifestTypeOption(t *testing.T) {
 	assert := assert.New(t)
 	dir, err := os.MkdirTemp("", "stacker-force-manifesttype-test")
@@ -0,0 +1,233 @@
+package lib
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"github.com/containers/image/v5/pkg/sysregistriesv2"
+	"github.com/containers/image/v5/types"
+	"github.com/pkg/errors"
+)
+
+// Registry is how the images whose references start with Prefix (e.g.
+// docker.io, or registry.example.com/project) are pulled and pushed.
+type Registry struct {
+	Prefix string `yaml:"prefix"`
+
+	// Location, if set, is where the images really are, replacing Prefix
+	// in their references, when they are both pulled and pushed.
+	Location string `yaml:"location,omitempty"`
+
+	RegistryEndpoint `yaml:",inline"`
+
+	// Mirrors are tried in order before Location when pulling, e.g. a
+	// pull-through cache.
+	Mirrors []RegistryMirror `yaml:"mirrors,omitempty"`
+}
+
+// RegistryMirror is a mirror of a Registry that its images are pulled from.
+type RegistryMirror struct {
+	Location         string `yaml:"location"`
+	RegistryEndpoint `yaml:",inline"`
+}
+
+// RegistryEndpoint is how to talk to a registry or a mirror.
+type RegistryEndpoint struct {
+	// Insecure skips verifying the registry's certificate.
+	Insecure bool `yaml:"insecure,omitempty"`
+
+	// PlainHTTP is for registries only served over http. containers/image
+	// only falls back to http for registries whose certificates aren't
+	// verified, so it implies Insecure.
+	PlainHTTP bool `yaml:"plain_http,omitempty"`
+
+	// CAFile is a bundle of the certificates of the CAs that the
+	// registry's certificate is verified with, e.g. a private CA.
+	CAFile string `yaml:"ca_file,omitempty"`
+}
+
+func (e RegistryEndpoint) insecure() bool {
+	return e.Insecure || e.PlainHTTP
+}
+
+// registryHost is the host[:port] of a registry location.
+func registryHost(location string) string {
+	host, _, _ := strings.Cut(location, "/")
+	return host
+}
+
+// matchesPrefix returns true if the reference ref is one of the images of
+// prefix.
+func matchesPrefix(ref string, prefix string) bool {
+	rest, ok := strings.CutPrefix(ref, prefix)
+	return ok && (rest == "" || strings.ContainsAny(rest[:1], "/:@"))
+}
+
+// RewriteReference returns where the image with the reference ref is pushed
+// to, according to registries: at the Location of the registry with the
+// longest matching prefix, if it has one.
+func RewriteReference(ref string, registries []Registry) string {
+	var match *Registry
+	for i, r := range registries {
+		if matchesPrefix(ref, r.Prefix) && (match == nil || len(r.Prefix) > len(match.Prefix)) {
+			match = &registries[i]
+		}
+	}
+	if match == nil || match.Location == "" {
+		return ref
+	}
+	return match.Location + strings.TrimPrefix(ref, match.Prefix)
+}
+
+// PlainHTTP returns true if the registry at host is only served over http,
+// according to registries.
+func PlainHTTP(host string, registries []Registry) bool {
+	for _, r := range registries {
+		location := r.Location
+		if location == "" {
+			location = r.Prefix
+		}
+		if registryHost(location) == host && r.PlainHTTP {
+			return true
+		}
+	}
+	return false
+}
+
+// TLSConfig returns how to talk to the registry at host, according to
+// registries: trusting the CAs of its ca_file along with the system's, and
+// not verifying its certificate if skipVerify or it's insecure.
+func TLSConfig(host string, skipVerify bool, registries []Registry) (*tls.Config, error) {
+	config := &tls.Config{InsecureSkipVerify: skipVerify}
+
+	endpoints := map[string]RegistryEndpoint{}
+	for _, r := range registries {
+		location := r.Location
+		if location == "" {
+			location = r.Prefix
+		}
+		endpoints[location] = r.RegistryEndpoint
+		for _, m := range r.Mirrors {
+			endpoints[m.Location] = m.RegistryEndpoint
+		}
+	}
+
+	for location, endpoint := range endpoints {
+		if registryHost(location) != host {
+			continue
+		}
+		if endpoint.insecure() {
+			config.InsecureSkipVerify = true
+		}
+		if endpoint.CAFile == "" {
+			continue
+		}
+
+		if config.RootCAs == nil {
+			pool, err := x509.SystemCertPool()
+			if err != nil {
+				pool = x509.NewCertPool()
+			}
+			config.RootCAs = pool
+		}
+		content, err := os.ReadFile(endpoint.CAFile)
+		if err != nil {
+			return nil, errors.Wrapf(err, "couldn't read the CA bundle of %s", host)
+		}
+		if !config.RootCAs.AppendCertsFromPEM(content) {
+			return nil, errors.Errorf("no certificates in the CA bundle %s of %s", endpoint.CAFile, host)
+		}
+	}
+
+	return config, nil
+}
+
+// registriesContext configures sys to pull and push according to registries,
+// with a registries.conf and a certs.d directory made for them in dir, which
+// replace the system's ones.
+func registriesContext(sys *types.SystemContext, registries []Registry, dir string) error {
+	conf := sysregistriesv2.V2RegistriesConf{}
+	certs := map[string][]string{}
+	for _, r := range registries {
+		if r.Prefix == "" {
+			return errors.Errorf("registries need a prefix")
+		}
+
+		location := r.Location
+		if location == "" {
+			location = r.Prefix
+		}
+
+		reg := sysregistriesv2.Registry{
+			Prefix: r.Prefix,
+			Endpoint: sysregistriesv2.Endpoint{
+				Location: location,
+				Insecure: r.insecure(),
+			},
+		}
+		if r.CAFile != "" {
+			certs[registryHost(location)] = append(certs[registryHost(location)], r.CAFile)
+		}
+
+		for _, m := range r.Mirrors {
+			if m.Location == "" {
+				return errors.Errorf("the mirrors of %s need a location", r.Prefix)
+			}
+			reg.Mirrors = append(reg.Mirrors, sysregistriesv2.Endpoint{Location: m.Location, Insecure: m.insecure()})
+			if m.CAFile != "" {
+				certs[registryHost(m.Location)] = append(certs[registryHost(m.Location)], m.CAFile)
+			}
+		}
+
+		conf.Registries = append(conf.Registries, reg)
+		if location != r.Prefix {
+			// for what is pushed to the location
+			conf.Registries = append(conf.Registries, sysregistriesv2.Registry{
+				Prefix:   location,
+				Endpoint: sysregistriesv2.Endpoint{Location: location, Insecure: r.insecure()},
+			})
+		}
+	}
+
+	content := bytes.Buffer{}
+	if err := toml.NewEncoder(&content).Encode(conf); err != nil {
+		return errors.Wrapf(err, "couldn't write registries.conf")
+	}
+	if err := os.WriteFile(path.Join(dir, "registries.conf"), content.Bytes(), 0644); err != nil {
+		return errors.Wrapf(err, "couldn't write registries.conf")
+	}
+	sys.SystemRegistriesConfPath = path.Join(dir, "registries.conf")
+	// so that the system's drop-ins don't override it
+	sys.SystemRegistriesConfDirPath = path.Join(dir, "registries.conf.d")
+
+	if len(certs) == 0 {
+		return nil
+	}
+
+	for host, files := range certs {
+		bundle := []byte{}
+		for _, f := range files {
+			content, err := os.ReadFile(f)
+			if err != nil {
+				return errors.Wrapf(err, "couldn't read the CA bundle of %s", host)
+			}
+			bundle = append(append(bundle, content...), '\n')
+		}
+
+		hostDir := path.Join(dir, "certs.d", host)
+		if err := os.MkdirAll(hostDir, 0755); err != nil {
+			return errors.WithStack(err)
+		}
+		if err := os.WriteFile(path.Join(hostDir, "ca.crt"), bundle, 0644); err != nil {
+			return errors.WithStack(err)
+		}
+	}
+	sys.DockerPerHostCertDirPath = path.Join(dir, "certs.d")
+
+	return nil
+}
@@ -0,0 +1,77 @@
+package lib
+
+import (
+	"os"
+	"path"
+	"testing"
+
+	"github.com/containers/image/v5/pkg/sysregistriesv2"
+	"github.com/containers/image/v5/types"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRewriteReference(t *testing.T) {
+	assert := assert.New(t)
+
+	registries := []Registry{
+		{Prefix: "docker.io", Location: "mirror.lab/dockerhub"},
+		{Prefix: "docker.io/library", Location: "mirror.lab/library"},
+		{Prefix: "registry.example.com", RegistryEndpoint: RegistryEndpoint{PlainHTTP: true}},
+	}
+
+	assert.Equal("mirror.lab/dockerhub/foo/bar:1", RewriteReference("docker.io/foo/bar:1", registries))
+	assert.Equal("mirror.lab/library/busybox:latest", RewriteReference("docker.io/library/busybox:latest", registries))
+	assert.Equal("registry.example.com/foo:1", RewriteReference("registry.example.com/foo:1", registries))
+	assert.Equal("docker.iox/foo:1", RewriteReference("docker.iox/foo:1", registries))
+
+	assert.True(PlainHTTP("registry.example.com", registries))
+	assert.False(PlainHTTP("mirror.lab", registries))
+}
+
+func TestRegistriesContext(t *testing.T) {
+	assert := assert.New(t)
+
+	dir := t.TempDir()
+	ca := path.Join(dir, "lab-ca.pem")
+	assert.NoError(os.WriteFile(ca, []byte("not really a certificate"), 0644))
+
+	registries := []Registry{
+		{
+			Prefix: "docker.io",
+			Mirrors: []RegistryMirror{
+				{Location: "mirror.lab:5000/dockerhub", RegistryEndpoint: RegistryEndpoint{CAFile: ca}},
+				{Location: "cache.lab/dockerhub", RegistryEndpoint: RegistryEndpoint{PlainHTTP: true}},
+			},
+		},
+		{Prefix: "quay.io", Location: "mirror.lab:5000/quay", RegistryEndpoint: RegistryEndpoint{Insecure: true}},
+	}
+
+	sys := &types.SystemContext{}
+	if !assert.NoError(registriesContext(sys, registries, dir)) {
+		return
+	}
+
+	reg, err := sysregistriesv2.FindRegistry(sys, "docker.io/library/busybox:latest")
+	assert.NoError(err)
+	if assert.NotNil(reg) {
+		assert.Equal("docker.io", reg.Location)
+		assert.False(reg.Insecure)
+		assert.Len(reg.Mirrors, 2)
+		assert.Equal("mirror.lab:5000/dockerhub", reg.Mirrors[0].Location)
+		assert.False(reg.Mirrors[0].Insecure)
+		assert.True(reg.Mirrors[1].Insecure)
+	}
+
+	// what's pushed to quay.io goes to the location, which is insecure too
+	reg, err = sysregistriesv2.FindRegistry(sys, "mirror.lab:5000/quay/foo:1")
+	assert.NoError(err)
+	if assert.NotNil(reg) {
+		assert.True(reg.Insecure)
+	}
+
+	content, err := os.ReadFile(path.Join(sys.DockerPerHostCertDirPath, "mirror.lab:5000", "ca.crt"))
+	assert.NoError(err)
+	assert.Contains(string(content), "not really a certificate")
+
+	assert.Error(registriesContext(sys, []Registry{{Location: "foo"}}, dir))
+}
@@ -0,0 +1,152 @@
+package lib
+
+import (
+	"context"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/containers/image/v5/docker/reference"
+	"github.com/containers/image/v5/image"
+	"github.com/containers/image/v5/signature"
+	"github.com/containers/image/v5/transports"
+	"github.com/containers/image/v5/types"
+	"github.com/pkg/errors"
+)
+
+// BaseImagePolicy is which images docker type layers may be built from: the
+// ones signed with the cosign private key of one of the public keys Keys, or
+// that the containers-policy.json(5) PolicyFile accepts, and, if
+// AllowDigests, the ones pinned by digest, signed or not. Every image is
+// allowed if it's empty.
+type BaseImagePolicy struct {
+	Keys         []string `yaml:"keys,omitempty"`
+	PolicyFile   string   `yaml:"policy_file,omitempty"`
+	AllowDigests bool     `yaml:"allow_digests,omitempty"`
+}
+
+// Empty returns true if p allows every image.
+func (p BaseImagePolicy) Empty() bool {
+	return len(p.Keys) == 0 && p.PolicyFile == "" && !p.AllowDigests
+}
+
+// Check returns an error unless p allows the image src (a containers/image
+// reference, e.g. docker://alpine:3.19).
+func (p BaseImagePolicy) Check(ctx context.Context, src string, skipTLS bool, registries []Registry) error {
+	if p.Empty() {
+		return nil
+	}
+
+	ref, err := localRefParser(src)
+	if err != nil {
+		return err
+	}
+
+	if _, ok := ref.DockerReference().(reference.Canonical); ok && p.AllowDigests {
+		return nil
+	}
+
+	reasons := []string{}
+	if p.AllowDigests {
+		reasons = append(reasons, "it isn't pinned by digest")
+	}
+
+	for _, key := range p.Keys {
+		err = VerifySigstoreSignature(ctx, src, key, skipTLS, registries)
+		if err == nil {
+			return nil
+		}
+		reasons = append(reasons, err.Error())
+	}
+
+	if p.PolicyFile != "" {
+		policy, err := signature.NewPolicyFromFile(p.PolicyFile)
+		if err != nil {
+			return errors.Wrapf(err, "couldn't read the policy %s", p.PolicyFile)
+		}
+
+		err = checkPolicy(ctx, ref, policy, skipTLS, registries)
+		if err == nil {
+			return nil
+		}
+		reasons = append(reasons, errors.Wrapf(err, "not accepted by %s", p.PolicyFile).Error())
+	}
+
+	return errors.Errorf("%s isn't allowed by the base image policy: %s", src, strings.Join(reasons, "; "))
+}
+
+// VerifySigstoreSignature returns an error unless the image src (a
+// containers/image reference, e.g. docker://alpine:3.19) has a sigstore
+// signature, as cosign makes them, made with the private key of the public key
+// file key. Like cosign's, the signature only has to be of the image's
+// repository, not of its tag.
+func VerifySigstoreSignature(ctx context.Context, src string, key string, skipTLS bool, registries []Registry) error {
+	ref, err := localRefParser(src)
+	if err != nil {
+		return err
+	}
+
+	req, err := signature.NewPRSigstoreSignedKeyPath(key, signature.NewPRMMatchRepository())
+	if err != nil {
+		return errors.Wrapf(err, "couldn't use the key %s", key)
+	}
+
+	err = checkPolicy(ctx, ref, &signature.Policy{Default: []signature.PolicyRequirement{req}}, skipTLS, registries)
+	if err != nil {
+		return errors.Wrapf(err, "not signed with %s", key)
+	}
+
+	return nil
+}
+
+// checkPolicy returns an error unless policy allows the image ref, whose
+// signatures are looked for where cosign pushes them.
+func checkPolicy(ctx context.Context, ref types.ImageReference, policy *signature.Policy, skipTLS bool, registries []Registry) error {
+	pc, err := signature.NewPolicyContext(policy)
+	if err != nil {
+		return err
+	}
+	defer pc.Destroy()
+
+	dir, err := os.MkdirTemp("", "stacker-verify-")
+	if err != nil {
+		return errors.Wrapf(err, "couldn't create registries.d")
+	}
+	defer os.RemoveAll(dir)
+
+	err = os.Mkdir(path.Join(dir, "registries.d"), 0755)
+	if err != nil {
+		return errors.Wrapf(err, "couldn't create registries.d")
+	}
+	err = os.WriteFile(path.Join(dir, "registries.d", "stacker.yaml"), []byte(sigstoreAttachments), 0644)
+	if err != nil {
+		return errors.Wrapf(err, "couldn't create registries.d")
+	}
+
+	sys := &types.SystemContext{RegistriesDirPath: path.Join(dir, "registries.d")}
+	if skipTLS {
+		sys.DockerInsecureSkipTLSVerify = types.OptionalBoolTrue
+	}
+	if len(registries) > 0 {
+		err = registriesContext(sys, registries, dir)
+		if err != nil {
+			return err
+		}
+	}
+
+	source, err := ref.NewImageSource(ctx, sys)
+	if err != nil {
+		return errors.Wrapf(err, "couldn't open %s", transports.ImageName(ref))
+	}
+	defer source.Close()
+
+	allowed, err := pc.IsRunningImageAllowed(ctx, image.UnparsedInstance(source, nil))
+	if err != nil {
+		return err
+	}
+	if !allowed {
+		return errors.Errorf("%s isn't allowed", transports.ImageName(ref))
+	}
+
+	return nil
+}
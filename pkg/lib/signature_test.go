@@ -0,0 +1,62 @@
+package lib
+
+import (
+	"context"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/opencontainers/umoci"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestVerifySigstoreSignatureUnsigned(t *testing.T) {
+	assert := assert.New(t)
+	dir := t.TempDir()
+
+	oci, err := umoci.CreateLayout(path.Join(dir, "oci"))
+	assert.NoError(err)
+	assert.NoError(umoci.NewImage(oci, "unsigned"))
+	oci.Close()
+
+	key := path.Join(dir, "cosign.pub")
+	assert.NoError(os.WriteFile(key, []byte("not really a key\n"), 0644))
+
+	err = VerifySigstoreSignature(context.Background(), "oci:"+path.Join(dir, "oci")+":unsigned", key, false, nil)
+	assert.ErrorContains(err, "no signature exists")
+}
+
+func TestBaseImagePolicy(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	oci, err := umoci.CreateLayout(path.Join(dir, "oci"))
+	assert.NoError(err)
+	assert.NoError(umoci.NewImage(oci, "unsigned"))
+	oci.Close()
+	unsigned := "oci:" + path.Join(dir, "oci") + ":unsigned"
+
+	assert.NoError(BaseImagePolicy{}.Check(ctx, unsigned, false, nil))
+
+	// pinned images aren't even looked at
+	digests := BaseImagePolicy{AllowDigests: true}
+	pinned := "docker://registry.invalid/alpine@sha256:" + strings.Repeat("0", 64)
+	assert.NoError(digests.Check(ctx, pinned, false, nil))
+	assert.ErrorContains(digests.Check(ctx, "docker://registry.invalid/alpine:3.19", false, nil), "isn't pinned by digest")
+
+	key := path.Join(dir, "cosign.pub")
+	assert.NoError(os.WriteFile(key, []byte("not really a key\n"), 0644))
+	err = BaseImagePolicy{Keys: []string{key}}.Check(ctx, unsigned, false, nil)
+	assert.ErrorContains(err, "isn't allowed by the base image policy")
+	assert.ErrorContains(err, "not signed with "+key)
+
+	policyFile := path.Join(dir, "policy.json")
+	assert.NoError(os.WriteFile(policyFile, []byte(`{"default": [{"type": "insecureAcceptAnything"}]}`), 0644))
+	assert.NoError(BaseImagePolicy{Keys: []string{key}, PolicyFile: policyFile}.Check(ctx, unsigned, false, nil))
+
+	assert.NoError(os.WriteFile(policyFile, []byte(`{"default": [{"type": "reject"}]}`), 0644))
+	err = BaseImagePolicy{PolicyFile: policyFile}.Check(ctx, unsigned, false, nil)
+	assert.ErrorContains(err, "not accepted by "+policyFile)
+}
@@ -1,8 +1,12 @@
 package log
 
 import (
+	"bytes"
+	"encoding/json"
 	"fmt"
 	"io"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/apex/log"
@@ -58,6 +62,71 @@ func Fatalf(msg string, v ...interface{}) {
 	addStackerLogSentinel(log.NewEntry(log.Log.(*log.Logger))).Fatalf(msg, v...)
 }
 
+// Scope logs the messages of a subsystem, whose level can be set separately
+// (see SetScopeLevel) to make it quieter or noisier than the rest of stacker.
+// Scopes without a level of their own log at the global level.
+type Scope struct {
+	name string
+}
+
+var (
+	scopeLevelsMu sync.RWMutex
+	scopeLevels   = map[string]log.Level{}
+)
+
+func NewScope(name string) *Scope {
+	return &Scope{name}
+}
+
+// SetScopeLevel sets the level of the messages logged by scope name, in place
+// of the global level: e.g. debug messages of the scope are logged at the info
+// level, and its info messages aren't at the debug level.
+func SetScopeLevel(name string, level log.Level) {
+	scopeLevelsMu.Lock()
+	defer scopeLevelsMu.Unlock()
+	scopeLevels[name] = level
+}
+
+func (s *Scope) logf(level log.Level, msg string, v ...interface{}) {
+	scopeLevelsMu.RLock()
+	min, ok := scopeLevels[s.name]
+	scopeLevelsMu.RUnlock()
+
+	logger := log.Log.(*log.Logger)
+	if !ok {
+		min = logger.Level
+	}
+	if level < min {
+		return
+	}
+
+	// not logged through the logger, which would drop it below the
+	// global level
+	_ = logger.Handler.HandleLog(&log.Entry{
+		Logger:    logger,
+		Fields:    log.Fields{"isStacker": &thisIsAStackerLog},
+		Level:     level,
+		Timestamp: time.Now(),
+		Message:   fmt.Sprintf(msg, v...),
+	})
+}
+
+func (s *Scope) Debugf(msg string, v ...interface{}) {
+	s.logf(log.DebugLevel, msg, v...)
+}
+
+func (s *Scope) Infof(msg string, v ...interface{}) {
+	s.logf(log.InfoLevel, msg, v...)
+}
+
+func (s *Scope) Warnf(msg string, v ...interface{}) {
+	s.logf(log.WarnLevel, msg, v...)
+}
+
+func (s *Scope) Errorf(msg string, v ...interface{}) {
+	s.logf(log.ErrorLevel, msg, v...)
+}
+
 type TextHandler struct {
 	out       io.StringWriter
 	timestamp bool
@@ -94,3 +163,150 @@ func (th *TextHandler) HandleLog(e *log.Entry) error {
 
 	return nil
 }
+
+// JSONHandler logs each message as a json object on a line of its own, with
+// its time, level and fields, for programs to parse.
+type JSONHandler struct {
+	mu  sync.Mutex
+	out io.Writer
+}
+
+func NewJSONHandler(out io.Writer) log.Handler {
+	return &JSONHandler{out: out}
+}
+
+func (jh *JSONHandler) HandleLog(e *log.Entry) error {
+	entry := map[string]interface{}{}
+	for name, v := range e.Fields {
+		if err, ok := v.(error); ok {
+			// errors would be marshalled as {}
+			v = err.Error()
+		}
+		entry[name] = v
+	}
+	entry["time"] = e.Timestamp.Format(time.RFC3339Nano)
+	entry["level"] = e.Level.String()
+	entry["msg"] = e.Message
+
+	content, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	jh.mu.Lock()
+	defer jh.mu.Unlock()
+	_, err = jh.out.Write(append(content, '\n'))
+	return err
+}
+
+// Fields are what an event is about.
+type Fields = log.Fields
+
+var eventsEnabled atomic.Bool
+
+// EnableEvents sets whether Event logs anything. Events are only useful to a
+// program reading the log, so they are enabled with the json log format.
+func EnableEvents(enabled bool) {
+	eventsEnabled.Store(enabled)
+}
+
+func EventsEnabled() bool {
+	return eventsEnabled.Load()
+}
+
+// Event logs that something happened during a build, e.g. a layer started
+// building, with an "event" field set to name. Events are logged whatever the
+// log level, so that --quiet leaves only them.
+func Event(name string, fields Fields) {
+	if !EventsEnabled() {
+		return
+	}
+
+	merged := Fields{"isStacker": &thisIsAStackerLog, "event": name}
+	for k, v := range fields {
+		merged[k] = v
+	}
+
+	// not logged through the logger, which would drop it below its level
+	logger := log.Log.(*log.Logger)
+	_ = logger.Handler.HandleLog(&log.Entry{
+		Logger:    logger,
+		Fields:    merged,
+		Level:     log.InfoLevel,
+		Timestamp: time.Now(),
+		Message:   name,
+	})
+}
+
+// Prefix logs the messages of one of several things going on at once, e.g.
+// the layers built in parallel, with the prefix in front of each of them so
+// that they can be told apart.
+type Prefix string
+
+func (p Prefix) Debugf(msg string, v ...interface{}) {
+	Debugf("%s"+msg, append([]interface{}{string(p)}, v...)...)
+}
+
+func (p Prefix) Infof(msg string, v ...interface{}) {
+	Infof("%s"+msg, append([]interface{}{string(p)}, v...)...)
+}
+
+func (p Prefix) Warnf(msg string, v ...interface{}) {
+	Warnf("%s"+msg, append([]interface{}{string(p)}, v...)...)
+}
+
+func (p Prefix) Errorf(msg string, v ...interface{}) {
+	Errorf("%s"+msg, append([]interface{}{string(p)}, v...)...)
+}
+
+// prefixWritersMu keeps the lines of different PrefixWriters from being
+// written into each other.
+var prefixWritersMu sync.Mutex
+
+// PrefixWriter writes what is written to it to an underlying writer a line at
+// a time, with a prefix in front of each line.
+type PrefixWriter struct {
+	out     io.Writer
+	prefix  string
+	partial []byte
+}
+
+func NewPrefixWriter(out io.Writer, prefix string) *PrefixWriter {
+	return &PrefixWriter{out: out, prefix: prefix}
+}
+
+func (w *PrefixWriter) Write(p []byte) (int, error) {
+	w.partial = append(w.partial, p...)
+
+	for {
+		idx := bytes.IndexByte(w.partial, '\n')
+		if idx < 0 {
+			return len(p), nil
+		}
+
+		err := w.writeLine(w.partial[:idx+1])
+		w.partial = w.partial[idx+1:]
+		if err != nil {
+			return len(p), err
+		}
+	}
+}
+
+// Close writes what is left of an unterminated last line.
+func (w *PrefixWriter) Close() error {
+	if len(w.partial) == 0 {
+		return nil
+	}
+
+	err := w.writeLine(append(w.partial, '\n'))
+	w.partial = nil
+	return err
+}
+
+func (w *PrefixWriter) writeLine(line []byte) error {
+	prefixWritersMu.Lock()
+	defer prefixWritersMu.Unlock()
+
+	_, err := w.out.Write(append([]byte(w.prefix), line...))
+	return err
+}
@@ -1,10 +1,15 @@
 package log_test
 
 import (
+	"bytes"
+	"encoding/json"
+	"errors"
 	"os"
+	"strings"
 
 	"testing"
 
+	apexlog "github.com/apex/log"
 	. "github.com/smartystreets/goconvey/convey"
 	"stackerbuild.io/stacker/pkg/log"
 )
@@ -40,3 +45,86 @@ func TestLog(t *testing.T) {
 		So(func() { log.Errorf("error msg") }, ShouldNotPanic)
 	})
 }
+
+type recordingHandler struct {
+	messages []string
+}
+
+func (h *recordingHandler) HandleLog(e *apexlog.Entry) error {
+	h.messages = append(h.messages, e.Message)
+	return nil
+}
+
+func TestScope(t *testing.T) {
+	Convey("Scoped levels", t, func() {
+		handler := &recordingHandler{}
+		log.FilterNonStackerLogs(handler, apexlog.DebugLevel)
+
+		scope := log.NewScope("test")
+		scope.Infof("before")
+
+		log.SetScopeLevel("test", apexlog.WarnLevel)
+		scope.Infof("quiet")
+		scope.Warnf("loud")
+		log.Infof("unscoped")
+
+		So(handler.messages, ShouldResemble, []string{"before", "loud", "unscoped"})
+	})
+
+	Convey("Scoped levels override the global level", t, func() {
+		handler := &recordingHandler{}
+		log.FilterNonStackerLogs(handler, apexlog.WarnLevel)
+
+		log.SetScopeLevel("noisy", apexlog.DebugLevel)
+		log.NewScope("noisy").Debugf("debug %d", 1)
+		log.NewScope("other").Infof("quiet")
+		log.Infof("unscoped")
+
+		So(handler.messages, ShouldResemble, []string{"debug 1"})
+	})
+}
+
+func TestPrefix(t *testing.T) {
+	Convey("Prefixed messages and lines", t, func() {
+		handler := &recordingHandler{}
+		log.FilterNonStackerLogs(handler, apexlog.DebugLevel)
+
+		log.Prefix("[layer] ").Infof("building %s", "it")
+		So(handler.messages, ShouldResemble, []string{"[layer] building it"})
+
+		out := bytes.Buffer{}
+		w := log.NewPrefixWriter(&out, "[layer] ")
+		_, err := w.Write([]byte("one\ntw"))
+		So(err, ShouldBeNil)
+		_, err = w.Write([]byte("o\nthree"))
+		So(err, ShouldBeNil)
+		So(w.Close(), ShouldBeNil)
+		So(out.String(), ShouldEqual, "[layer] one\n[layer] two\n[layer] three\n")
+	})
+}
+
+func TestJSON(t *testing.T) {
+	Convey("Json messages and events", t, func() {
+		out := bytes.Buffer{}
+		log.FilterNonStackerLogs(log.NewJSONHandler(&out), apexlog.FatalLevel)
+		defer log.EnableEvents(false)
+
+		log.Event("ignored", nil)
+		log.EnableEvents(true)
+		log.Infof("quiet")
+		log.Event("layer-finished", log.Fields{"layer": "foo", "error": errors.New("failed")})
+
+		lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+		So(lines, ShouldHaveLength, 1)
+
+		entry := map[string]interface{}{}
+		So(json.Unmarshal([]byte(lines[0]), &entry), ShouldBeNil)
+		So(entry["msg"], ShouldEqual, "layer-finished")
+		So(entry["event"], ShouldEqual, "layer-finished")
+		So(entry["level"], ShouldEqual, "info")
+		So(entry["layer"], ShouldEqual, "foo")
+		So(entry["error"], ShouldEqual, "failed")
+		So(entry, ShouldNotContainKey, "isStacker")
+		So(entry["time"], ShouldNotBeEmpty)
+	})
+}
@@ -0,0 +1,100 @@
+package overlay
+
+import (
+	"io"
+	"runtime"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/klauspost/pgzip"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/opencontainers/umoci/mutate"
+	"github.com/pkg/errors"
+	"stackerbuild.io/stacker/pkg/log"
+	"stackerbuild.io/stacker/pkg/types"
+)
+
+// levelCompressor compresses tar layers at a level umoci's compressors don't
+// let us choose.
+type levelCompressor struct {
+	compression types.TarCompression
+}
+
+func (lc levelCompressor) newWriter(w io.Writer) (io.WriteCloser, error) {
+	switch lc.compression.Name() {
+	case types.ZstdCompression:
+		level := zstd.EncoderLevelFromZstd(lc.compression.Level)
+		return zstd.NewWriter(w, zstd.WithEncoderLevel(level))
+	default:
+		gzw, err := pgzip.NewWriterLevel(w, lc.compression.Level)
+		if err != nil {
+			return nil, err
+		}
+		err = gzw.SetConcurrency(int(gzipBlockSize), 2*runtime.NumCPU())
+		if err != nil {
+			return nil, err
+		}
+		return gzw, nil
+	}
+}
+
+func (lc levelCompressor) Compress(reader io.Reader) (io.ReadCloser, error) {
+	pipeReader, pipeWriter := io.Pipe()
+
+	w, err := lc.newWriter(pipeWriter)
+	if err != nil {
+		return nil, errors.Wrapf(err, "couldn't set up %s compression", lc.compression)
+	}
+
+	go func() {
+		_, err := io.Copy(w, reader)
+		if err != nil {
+			log.Warnf("couldn't compress layer with %s: %v", lc.compression, err)
+			pipeWriter.CloseWithError(errors.Wrapf(err, "compressing layer"))
+			return
+		}
+		err = w.Close()
+		if err != nil {
+			pipeWriter.CloseWithError(errors.Wrapf(err, "couldn't finish compressing layer"))
+			return
+		}
+		pipeWriter.Close()
+	}()
+
+	return pipeReader, nil
+}
+
+func (lc levelCompressor) MediaTypeSuffix() string {
+	return lc.compression.Name()
+}
+
+func (lc levelCompressor) WithOpt(mutate.CompressorOpt) mutate.Compressor {
+	return lc
+}
+
+// tarCompressor is what compresses tar layers the way c says to.
+func tarCompressor(c types.TarCompression) mutate.Compressor {
+	if c.Level != 0 {
+		return levelCompressor{compression: c}
+	}
+
+	if c.Name() == types.ZstdCompression {
+		return mutate.ZstdCompressor
+	}
+	return mutate.GzipCompressor.WithOpt(gzipBlockSize)
+}
+
+// decompressLayer decompresses the tar layer blob of type mediaType.
+func decompressLayer(mediaType string, blob io.Reader) (io.ReadCloser, error) {
+	switch mediaType {
+	case ispec.MediaTypeImageLayerZstd:
+		zr, err := zstd.NewReader(blob)
+		if err != nil {
+			return nil, err
+		}
+		return zr.IOReadCloser(), nil
+	case ispec.MediaTypeImageLayer:
+		return io.NopCloser(blob), nil
+	default:
+		return pgzip.NewReader(blob)
+	}
+}
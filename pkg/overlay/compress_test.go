@@ -0,0 +1,35 @@
+package overlay
+
+import (
+	"bytes"
+	"io"
+	"testing"
+
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/assert"
+	"stackerbuild.io/stacker/pkg/types"
+)
+
+func TestTarCompressor(t *testing.T) {
+	assert := assert.New(t)
+
+	content := bytes.Repeat([]byte("stacker "), 1<<16)
+	for _, c := range []types.TarCompression{
+		{},
+		{Algorithm: types.GzipCompression, Level: 9},
+		{Algorithm: types.ZstdCompression},
+		{Algorithm: types.ZstdCompression, Level: 19},
+	} {
+		compressor := tarCompressor(c)
+		assert.Equal(c.MediaType(), ispec.MediaTypeImageLayer+"+"+compressor.MediaTypeSuffix(), c.String())
+
+		compressed, err := compressor.Compress(bytes.NewReader(content))
+		assert.NoError(err, c.String())
+		uncompressed, err := decompressLayer(c.MediaType(), compressed)
+		assert.NoError(err, c.String())
+		result, err := io.ReadAll(uncompressed)
+		assert.NoError(err, c.String())
+		assert.NoError(uncompressed.Close())
+		assert.Equal(content, result, c.String())
+	}
+}
@@ -0,0 +1,165 @@
+package overlay
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+
+	"github.com/containerd/stargz-snapshotter/estargz"
+	"github.com/klauspost/pgzip"
+	"github.com/opencontainers/go-digest"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/opencontainers/umoci/mutate"
+	"github.com/opencontainers/umoci/oci/casext"
+	"github.com/pkg/errors"
+	"stackerbuild.io/stacker/pkg/types"
+)
+
+// addEstargzLayer adds the tar layer blob to mutator as an eStargz blob,
+// with the annotations the stargz snapshotter needs to pull it lazily. Unlike
+// the other compressions, eStargz rewrites the tar (adding its TOC to it), so
+// the layer's diff id is that of what the blob decompresses to, rather than of
+// blob.
+func addEstargzLayer(config types.StackerConfig, oci casext.Engine, mutator *mutate.Mutator, blob io.Reader, history *ispec.History) (ispec.Descriptor, error) {
+	// estargz reads the tar more than once to build the TOC
+	tmp, err := os.CreateTemp(config.StackerDir, "estargz-")
+	if err != nil {
+		return ispec.Descriptor{}, errors.Wrapf(err, "couldn't create estargz tmpfile")
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	size, err := io.Copy(tmp, blob)
+	if err != nil {
+		return ispec.Descriptor{}, errors.Wrapf(err, "couldn't generate tar layer")
+	}
+
+	level := config.TarCompression.Level
+	if level == 0 {
+		level = gzip.BestCompression
+	}
+	esgz, err := estargz.Build(io.NewSectionReader(tmp, 0, size), estargz.WithCompression(newEstargzGzip(level)))
+	if err != nil {
+		return ispec.Descriptor{}, errors.Wrapf(err, "couldn't convert tar layer to estargz")
+	}
+	defer esgz.Close()
+
+	ctx := context.Background()
+	layerDigest, layerSize, err := oci.PutBlob(ctx, esgz)
+	if err != nil {
+		return ispec.Descriptor{}, errors.Wrapf(err, "couldn't put estargz layer")
+	}
+
+	uncompressedSize, err := estargzUncompressedSize(ctx, oci, layerDigest)
+	if err != nil {
+		return ispec.Descriptor{}, err
+	}
+
+	desc := ispec.Descriptor{
+		MediaType: ispec.MediaTypeImageLayerGzip,
+		Digest:    layerDigest,
+		Size:      layerSize,
+		Annotations: map[string]string{
+			estargz.TOCJSONDigestAnnotation:         esgz.TOCDigest().String(),
+			estargz.StoreUncompressedSizeAnnotation: fmt.Sprintf("%d", uncompressedSize),
+		},
+	}
+	err = mutator.AddExisting(ctx, desc, history, esgz.DiffID())
+	if err != nil {
+		return ispec.Descriptor{}, err
+	}
+	return desc, nil
+}
+
+// estargzGzip is estargz's gzip compression, but with a footer that doesn't
+// depend on what the gzip of the go version stacker is built with makes of
+// nothing: estargz panics if it isn't exactly estargz.FooterSize bytes, which
+// with newer versions of go it isn't.
+type estargzGzip struct {
+	*estargz.GzipCompressor
+	*estargz.GzipDecompressor
+	level int
+}
+
+func newEstargzGzip(level int) *estargzGzip {
+	return &estargzGzip{estargz.NewGzipCompressorWithLevel(level), &estargz.GzipDecompressor{}, level}
+}
+
+// WriteTOCAndFooter writes the TOC as a tar file of its own gzip stream, like
+// estargz does, and then the footer.
+func (eg *estargzGzip) WriteTOCAndFooter(w io.Writer, off int64, toc *estargz.JTOC, diffHash hash.Hash) (digest.Digest, error) {
+	tocJSON, err := json.MarshalIndent(toc, "", "\t")
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+
+	gz, err := gzip.NewWriterLevel(w, eg.level)
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+	gw := io.Writer(gz)
+	if diffHash != nil {
+		gw = io.MultiWriter(gz, diffHash)
+	}
+	tw := tar.NewWriter(gw)
+	err = tw.WriteHeader(&tar.Header{Typeflag: tar.TypeReg, Name: estargz.TOCTarName, Size: int64(len(tocJSON))})
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+	if _, err := tw.Write(tocJSON); err != nil {
+		return "", errors.WithStack(err)
+	}
+	if err := tw.Close(); err != nil {
+		return "", errors.WithStack(err)
+	}
+	if err := gz.Close(); err != nil {
+		return "", errors.WithStack(err)
+	}
+
+	if _, err := w.Write(estargzFooter(off)); err != nil {
+		return "", errors.WithStack(err)
+	}
+	return digest.FromBytes(tocJSON), nil
+}
+
+// estargzFooter is the footer of an estargz blob whose TOC is at tocOff: an
+// empty gzip stream whose header's extra field says where the TOC is. It's
+// what go's gzip used to write at NoCompression, with the empty deflate
+// stream as a stored block.
+func estargzFooter(tocOff int64) []byte {
+	extra := fmt.Sprintf("%016xSTARGZ", tocOff)
+
+	footer := []byte{0x1f, 0x8b, 8, 0x04, 0, 0, 0, 0, 0, 0xff}
+	footer = binary.LittleEndian.AppendUint16(footer, uint16(4+len(extra)))
+	footer = append(footer, 'S', 'G')
+	footer = binary.LittleEndian.AppendUint16(footer, uint16(len(extra)))
+	footer = append(footer, extra...)
+	// the final, empty, stored block; and the crc and size of nothing
+	footer = append(footer, 0x01, 0x00, 0x00, 0xff, 0xff)
+	return append(footer, make([]byte, 8)...)
+}
+
+// estargzUncompressedSize is the size of what the estargz blob d decompresses
+// to, which the stargz snapshotter wants to know without downloading it.
+func estargzUncompressedSize(ctx context.Context, oci casext.Engine, d digest.Digest) (int64, error) {
+	blob, err := oci.GetBlob(ctx, d)
+	if err != nil {
+		return 0, errors.Wrapf(err, "couldn't read estargz layer")
+	}
+	defer blob.Close()
+
+	gzr, err := pgzip.NewReader(blob)
+	if err != nil {
+		return 0, errors.Wrapf(err, "couldn't decompress estargz layer")
+	}
+	defer gzr.Close()
+
+	size, err := io.Copy(io.Discard, gzr)
+	return size, errors.Wrapf(err, "couldn't decompress estargz layer")
+}
@@ -0,0 +1,97 @@
+package overlay
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"path"
+	"testing"
+
+	"github.com/containerd/stargz-snapshotter/estargz"
+	"github.com/klauspost/pgzip"
+	"github.com/opencontainers/go-digest"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/opencontainers/umoci"
+	"github.com/opencontainers/umoci/mutate"
+	"github.com/stretchr/testify/assert"
+	"stackerbuild.io/stacker/pkg/types"
+)
+
+func TestAddEstargzLayer(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+
+	dir := t.TempDir()
+	oci, err := umoci.CreateLayout(path.Join(dir, "oci"))
+	if !assert.NoError(err) {
+		return
+	}
+	defer oci.Close()
+	assert.NoError(umoci.NewImage(oci, "img"))
+	descPaths, err := oci.ResolveReference(ctx, "img")
+	assert.NoError(err)
+	mutator, err := mutate.New(oci, descPaths[0])
+	assert.NoError(err)
+
+	layer := bytes.Buffer{}
+	tw := tar.NewWriter(&layer)
+	assert.NoError(tw.WriteHeader(&tar.Header{Name: "etc/", Typeflag: tar.TypeDir, Mode: 0755}))
+	motd := bytes.Repeat([]byte("hello "), 1<<12)
+	assert.NoError(tw.WriteHeader(&tar.Header{Name: "etc/motd", Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(motd))}))
+	_, err = tw.Write(motd)
+	assert.NoError(err)
+	assert.NoError(tw.Close())
+
+	config := types.StackerConfig{
+		StackerDir:     dir,
+		TarCompression: types.TarCompression{Algorithm: types.EstargzCompression},
+	}
+	desc, err := addEstargzLayer(config, oci, mutator, &layer, &ispec.History{CreatedBy: "test"})
+	if !assert.NoError(err) {
+		return
+	}
+	assert.Equal(ispec.MediaTypeImageLayerGzip, desc.MediaType)
+	assert.Contains(desc.Annotations, estargz.TOCJSONDigestAnnotation)
+
+	blob, err := oci.GetBlob(ctx, desc.Digest)
+	assert.NoError(err)
+	content, err := io.ReadAll(blob)
+	assert.NoError(err)
+	assert.NoError(blob.Close())
+
+	// the diff id is that of what the blob decompresses to, TOC and all
+	gzr, err := pgzip.NewReader(bytes.NewReader(content))
+	assert.NoError(err)
+	uncompressed, err := io.ReadAll(gzr)
+	assert.NoError(err)
+	imageConfig, err := mutator.Config(ctx)
+	assert.NoError(err)
+	assert.Equal([]digest.Digest{digest.FromBytes(uncompressed)}, imageConfig.RootFS.DiffIDs)
+	assert.Equal(desc.Annotations[estargz.StoreUncompressedSizeAnnotation], fmt.Sprintf("%d", len(uncompressed)))
+
+	r, err := estargz.Open(io.NewSectionReader(bytes.NewReader(content), 0, int64(len(content))))
+	if !assert.NoError(err) {
+		return
+	}
+	assert.Equal(desc.Annotations[estargz.TOCJSONDigestAnnotation], r.TOCDigest().String())
+	entry, ok := r.Lookup("etc/motd")
+	assert.True(ok)
+	assert.EqualValues(len(motd), entry.Size)
+}
+
+func TestEstargzFooter(t *testing.T) {
+	assert := assert.New(t)
+
+	footer := estargzFooter(0x1234)
+	assert.Len(footer, estargz.FooterSize)
+
+	gzr, err := gzip.NewReader(bytes.NewReader(footer))
+	assert.NoError(err)
+	assert.Equal("SG\x16\x00"+"0000000000001234STARGZ", string(gzr.Header.Extra))
+	content, err := io.ReadAll(gzr)
+	assert.NoError(err)
+	assert.Empty(content)
+}
@@ -0,0 +1,206 @@
+package overlay
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/pkg/xattr"
+	"golang.org/x/sys/unix"
+	"stackerbuild.io/stacker/pkg/lib"
+	"stackerbuild.io/stacker/pkg/log"
+	"stackerbuild.io/stacker/pkg/types"
+)
+
+var _ types.Storage = &fuseOverlay{}
+var _ types.RootfsMounter = &fuseOverlay{}
+
+// fuseOpaqueXattr is how fuse-overlayfs marks directories opaque when it
+// isn't allowed to use trusted.overlay.opaque, i.e. in a user namespace.
+const fuseOpaqueXattr = "user.fuseoverlayfs.opaque"
+
+// fuseOverlayMount returns the command that mounts the overlay of lowerdirs
+// (bottom most first), upperdir and workdir at mountpoint with
+// fuse-overlayfs.
+func fuseOverlayMount(lowerdirs []string, upperdir string, workdir string, mountpoint string) []string {
+	// fuse-overlayfs wants the top most lowerdir first, like overlayfs
+	reversed := make([]string, 0, len(lowerdirs))
+	for i := len(lowerdirs) - 1; i >= 0; i-- {
+		reversed = append(reversed, lowerdirs[i])
+	}
+
+	// allow_other, since the container's processes aren't all the user
+	// that mounted it
+	opts := fmt.Sprintf("lowerdir=%s,upperdir=%s,workdir=%s,allow_other",
+		strings.Join(reversed, ":"), upperdir, workdir)
+	return []string{"fuse-overlayfs", "-o", opts, mountpoint}
+}
+
+// unmountFuse unmounts a fuse filesystem: as root (in our user namespace)
+// that's just umount, fusermount is for everyone else.
+func unmountFuse(mountpoint string) error {
+	err := unix.Unmount(mountpoint, 0)
+	if err == nil {
+		return nil
+	}
+
+	for _, fusermount := range []string{"fusermount3", "fusermount"} {
+		if _, lookErr := exec.LookPath(fusermount); lookErr != nil {
+			continue
+		}
+		output, err := exec.Command(fusermount, "-u", mountpoint).CombinedOutput()
+		if err != nil {
+			return errors.Wrapf(err, "couldn't unmount %s: %s", mountpoint, output)
+		}
+		return nil
+	}
+
+	return errors.Wrapf(err, "couldn't unmount %s", mountpoint)
+}
+
+// canMountFuseOverlay detects whether the current task can mount overlays
+// with fuse-overlayfs, which needs the binary and /dev/fuse.
+func canMountFuseOverlay() error {
+	if _, err := exec.LookPath("fuse-overlayfs"); err != nil {
+		return errors.Errorf("couldn't find fuse-overlayfs, install it to use the fuse-overlayfs storage")
+	}
+
+	dir, err := os.MkdirTemp("", "stacker-fuse-overlay-mount-")
+	if err != nil {
+		return errors.Wrapf(err, "couldn't create fuse-overlayfs tmpdir")
+	}
+	defer os.RemoveAll(dir)
+
+	dirs := map[string]string{}
+	for _, name := range []string{"lower", "upper", "work", "mountpoint"} {
+		dirs[name] = path.Join(dir, name)
+		err = os.Mkdir(dirs[name], 0755)
+		if err != nil {
+			return errors.Wrapf(err, "couldn't create fuse-overlayfs %s dir", name)
+		}
+	}
+
+	args := fuseOverlayMount([]string{dirs["lower"]}, dirs["upper"], dirs["work"], dirs["mountpoint"])
+	output, err := exec.Command(args[0], args[1:]...).CombinedOutput()
+	if err != nil {
+		return errors.Wrapf(err, "couldn't mount fuse-overlayfs: %s", output)
+	}
+
+	return unmountFuse(dirs["mountpoint"])
+}
+
+// CheckFuse returns an error if the fuse-overlayfs storage can't work here.
+// Like overlay, it still needs to write whiteouts.
+func CheckFuse(config types.StackerConfig) error {
+	err := canMountFuseOverlay()
+	if err != nil {
+		return err
+	}
+
+	return canWriteWhiteouts(config)
+}
+
+// fuseOverlay is the overlay storage, but with the rootfs of containers
+// mounted by fuse-overlayfs rather than overlayfs, for kernels that don't let
+// unprivileged users mount overlayfs. The layers are stored the same way.
+type fuseOverlay struct {
+	*overlay
+}
+
+func NewFuseOverlay(config types.StackerConfig) (types.Storage, error) {
+	return &fuseOverlay{&overlay{config}}, nil
+}
+
+func (o *fuseOverlay) Name() string {
+	return "fuse-overlayfs"
+}
+
+// GetLXCRootfsConfig returns the rootfs dir of name, which the LXCRootfsHooks
+// mount the overlay on.
+func (o *fuseOverlay) GetLXCRootfsConfig(name string) (string, error) {
+	return "dir:" + path.Join(o.config.RootFSDir, name, "rootfs"), nil
+}
+
+func (o *fuseOverlay) LXCRootfsHooks(name string) (string, string, error) {
+	ovl, err := readOverlayMetadata(o.config.RootFSDir, name)
+	if err != nil {
+		return "", "", err
+	}
+
+	lowerdirs, err := ovl.lowerdirs(o.config, name)
+	if err != nil {
+		return "", "", err
+	}
+
+	workdir := path.Join(o.config.RootFSDir, name, "fuse-work")
+	err = os.MkdirAll(workdir, 0755)
+	if err != nil {
+		return "", "", errors.Wrapf(err, "couldn't make fuse-overlayfs work dir")
+	}
+
+	mountpoint := path.Join(o.config.RootFSDir, name, "rootfs")
+	args := fuseOverlayMount(lowerdirs, path.Join(o.config.RootFSDir, name, "overlay"), workdir, mountpoint)
+	for i := range args {
+		args[i] = shellQuote(args[i])
+	}
+	log.Debugf("fuse-overlayfs rootfs mount %s", strings.Join(args, " "))
+
+	// LXC runs hooks with sh -c, adding the container's name and such as
+	// arguments, which the inner sh ignores
+	mount := fmt.Sprintf("sh -c %s stacker-hook", shellQuote(strings.Join(args, " ")))
+	unmount := fmt.Sprintf("sh -c %s stacker-hook", shellQuote("umount "+shellQuote(mountpoint)+
+		" || fusermount3 -u "+shellQuote(mountpoint)+" || fusermount -u "+shellQuote(mountpoint)))
+	return mount, unmount, nil
+}
+
+// shellQuote quotes s for sh.
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// translateFuseOpaques turns the opaque directories fuse-overlayfs marked in
+// dir into ones marked like overlayfs does unprivileged, which is what
+// repacking the layer (and fuse-overlayfs, when it's a lowerdir) looks for.
+func translateFuseOpaques(dir string) error {
+	return filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.IsDir() || lib.IsSymlink(p) {
+			return nil
+		}
+
+		value, err := xattr.LGet(p, fuseOpaqueXattr)
+		if err != nil {
+			// not opaque
+			return nil
+		}
+
+		err = xattr.LSet(p, "user.overlay.opaque", value)
+		if err != nil {
+			return errors.Wrapf(err, "couldn't mark %s opaque", p)
+		}
+		return errors.Wrapf(xattr.LRemove(p, fuseOpaqueXattr), "couldn't mark %s opaque", p)
+	})
+}
+
+func (o *fuseOverlay) Repack(name string, layerTypes []types.LayerType, sfm types.StackerFiles) error {
+	err := translateFuseOpaques(path.Join(o.config.RootFSDir, name, "overlay"))
+	if err != nil {
+		return err
+	}
+
+	return o.overlay.Repack(name, layerTypes, sfm)
+}
+
+// Delete unmounts the rootfs of thing too, in case a container using it
+// didn't get to.
+func (o *fuseOverlay) Delete(thing string) error {
+	unix.Unmount(path.Join(o.config.RootFSDir, thing, "rootfs"), unix.MNT_DETACH)
+	return o.overlay.Delete(thing)
+}
@@ -0,0 +1,50 @@
+package overlay
+
+import (
+	"os"
+	"os/exec"
+	"path"
+	"testing"
+
+	"github.com/pkg/xattr"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFuseOverlayMount(t *testing.T) {
+	assert := assert.New(t)
+
+	args := fuseOverlayMount([]string{"/bottom", "/middle", "/top"}, "/upper", "/work", "/rootfs")
+	assert.Equal([]string{
+		"fuse-overlayfs", "-o", "lowerdir=/top:/middle:/bottom,upperdir=/upper,workdir=/work,allow_other", "/rootfs",
+	}, args)
+}
+
+func TestShellQuote(t *testing.T) {
+	assert := assert.New(t)
+
+	output, err := exec.Command("sh", "-c", "echo "+shellQuote(`it's a "dir" with $HOME`)).CombinedOutput()
+	assert.NoError(err)
+	assert.Equal("it's a \"dir\" with $HOME\n", string(output))
+}
+
+func TestTranslateFuseOpaques(t *testing.T) {
+	assert := assert.New(t)
+
+	dir := t.TempDir()
+	opaque := path.Join(dir, "a", "opaque")
+	assert.NoError(os.MkdirAll(opaque, 0755))
+	if err := xattr.LSet(opaque, fuseOpaqueXattr, []byte("y")); err != nil {
+		t.Skipf("no user xattrs in %s: %v", dir, err)
+	}
+
+	assert.NoError(translateFuseOpaques(dir))
+
+	value, err := xattr.LGet(opaque, "user.overlay.opaque")
+	assert.NoError(err)
+	assert.Equal("y", string(value))
+	_, err = xattr.LGet(opaque, fuseOpaqueXattr)
+	assert.Error(err)
+
+	_, err = xattr.LGet(path.Join(dir, "a"), "user.overlay.opaque")
+	assert.Error(err)
+}
@@ -48,6 +48,12 @@ func generateOverlayDirLayer(name string, layerType types.LayerType, overlayDir
 	defer oci.Close()
 
 	contents := path.Join(config.RootFSDir, name, "overlay_dirs", path.Base(overlayDir.Source))
+	if config.SourceDateEpoch != nil {
+		if err := clampTimesUnder(contents, *config.SourceDateEpoch); err != nil {
+			return ispec.Descriptor{}, err
+		}
+	}
+
 	blob, mediaType, rootHash, err := generateBlob(layerType, contents, config.OCIDir)
 	if err != nil {
 		return ispec.Descriptor{}, err
@@ -11,9 +11,7 @@ import (
 	"runtime"
 	"strings"
 	"sync"
-	"time"
 
-	"github.com/klauspost/pgzip"
 	"github.com/opencontainers/go-digest"
 	ispec "github.com/opencontainers/image-spec/specs-go/v1"
 	"github.com/opencontainers/umoci"
@@ -289,7 +287,22 @@ func (o *overlay) Repack(name string, layerTypes []types.LayerType, sfm types.St
 		return err
 	}
 
-	return repackOverlay(o.config, name, layerTypes)
+	err = repackOverlay(o.config, name, layerTypes)
+	if err != nil {
+		return err
+	}
+
+	l, ok := sfm.LookupLayerDefinition(name)
+	if !ok || l.Squash == types.SquashNone {
+		return nil
+	}
+
+	kept, err := keptLayers(o.config, name, l.Squash, sfm)
+	if err != nil {
+		return err
+	}
+
+	return squashOverlay(o.config, name, layerTypes, kept)
 }
 
 // generateBlob generates either a tar blob or a squashfs blob based on layerType
@@ -419,9 +432,8 @@ func generateLayer(config types.StackerConfig, oci casext.Engine, mutators []*mu
 		return false, nil
 	}
 
-	now := time.Now()
 	history := &ispec.History{
-		Created:    &now,
+		Created:    historyCreated(config),
 		CreatedBy:  fmt.Sprintf("stacker build of %s", name),
 		EmptyLayer: false,
 	}
@@ -430,52 +442,90 @@ func generateLayer(config types.StackerConfig, oci casext.Engine, mutators []*mu
 		return false, err
 	}
 
+	if config.SourceDateEpoch != nil {
+		if err := clampTimesUnder(dir, *config.SourceDateEpoch); err != nil {
+			return false, err
+		}
+	}
+
 	descs := []ispec.Descriptor{}
 	for i, layerType := range layerTypes {
-		mutator := mutators[i]
-		var desc ispec.Descriptor
-
-		blob, mediaType, rootHash, err := generateBlob(layerType, dir, config.OCIDir)
+		desc, err := addLayer(config, oci, mutators[i], layerType, dir, history)
 		if err != nil {
 			return false, err
 		}
-		defer blob.Close()
+		descs = append(descs, desc)
+	}
 
-		if layerType.Type == "tar" {
-			desc, err = mutator.Add(context.Background(), mediaType, blob, history, mutate.GzipCompressor.WithOpt(gzipBlockSize), nil)
-			if err != nil {
-				return false, err
-			}
-		} else {
-			annotations := map[string]string{}
-			if rootHash != "" {
-				annotations[squashfs.VerityRootHashAnnotation] = rootHash
-			}
-			desc, err = mutator.Add(context.Background(), mediaType, blob, history, mutate.NoopCompressor, annotations)
-			if err != nil {
-				return false, err
-			}
-		}
-		log.Debugf("generated %v layer %s from %s", layerType, desc.Digest, dir)
+	err = moveLayerContents(config, dir, descs)
+	if err != nil {
+		return false, err
+	}
 
-		descs = append(descs, desc)
+	err = os.MkdirAll(dir, 0755)
+	if err != nil {
+		return false, errors.Wrapf(err, "couldn't re-make overlay contents for %s", dir)
+	}
+
+	return true, nil
+}
+
+// addLayer adds the layerType layer of the contents of dir to the image of
+// mutator.
+func addLayer(config types.StackerConfig, oci casext.Engine, mutator *mutate.Mutator, layerType types.LayerType,
+	dir string, history *ispec.History,
+) (ispec.Descriptor, error) {
+	var desc ispec.Descriptor
+
+	blob, mediaType, rootHash, err := generateBlob(layerType, dir, config.OCIDir)
+	if err != nil {
+		return desc, err
+	}
+	defer blob.Close()
+
+	if layerType.Type == "tar" && config.TarCompression.Name() == types.EstargzCompression {
+		desc, err = addEstargzLayer(config, oci, mutator, blob, history)
+		if err != nil {
+			return desc, err
+		}
+	} else if layerType.Type == "tar" {
+		desc, err = mutator.Add(context.Background(), mediaType, blob, history, tarCompressor(config.TarCompression), nil)
+		if err != nil {
+			return desc, err
+		}
+	} else {
+		annotations := map[string]string{}
+		if rootHash != "" {
+			annotations[squashfs.VerityRootHashAnnotation] = rootHash
+		}
+		desc, err = mutator.Add(context.Background(), mediaType, blob, history, mutate.NoopCompressor, annotations)
+		if err != nil {
+			return desc, err
+		}
 	}
+	log.Debugf("generated %v layer %s from %s", layerType, desc.Digest, dir)
+
+	return desc, nil
+}
 
+// moveLayerContents moves dir, the contents of the layers descs (one of each
+// layer type), to where their overlay dirs are.
+func moveLayerContents(config types.StackerConfig, dir string, descs []ispec.Descriptor) error {
 	// we're going to update the manifest at the end with these generated
 	// layers, so we need to "extract" them. but there's no need to
 	// actually extract them, we can just rename the contents we already
 	// have for the generated hash, since that's where it came from.
 	target := overlayPath(config.RootFSDir, descs[0].Digest)
-	err = os.MkdirAll(target, 0755)
+	err := os.MkdirAll(target, 0755)
 	if err != nil {
-		return false, errors.Wrapf(err, "couldn't make new layer overlay dir")
+		return errors.Wrapf(err, "couldn't make new layer overlay dir")
 	}
 
 	log.Debugf("renaming %s -> %s", dir, path.Join(target, "overlay"))
 	err = os.Rename(dir, path.Join(target, "overlay"))
 	if err != nil {
 		if !os.IsExist(err) {
-			return false, errors.Wrapf(err, "couldn't move overlay data to new location")
+			return errors.Wrapf(err, "couldn't move overlay data to new location")
 		}
 		// however, it's possible that we've *already* generated a layer that
 		// has this hash. This can happen when two filesystems are based on the
@@ -488,15 +538,10 @@ func generateLayer(config types.StackerConfig, oci casext.Engine, mutators []*mu
 		log.Debugf("target exists, simply removing %s", dir)
 		err = os.RemoveAll(dir)
 		if err != nil {
-			return false, errors.Wrapf(err, "couldn't delete duplicate layer")
+			return errors.Wrapf(err, "couldn't delete duplicate layer")
 		}
 	}
 
-	err = os.MkdirAll(dir, 0755)
-	if err != nil {
-		return false, errors.Wrapf(err, "couldn't re-make overlay contents for %s", dir)
-	}
-
 	// now, as we do in convertAndOutput, we make a symlink for the hash
 	// for each additional layer type so that they see the same data
 	for _, desc := range descs[1:] {
@@ -508,7 +553,7 @@ func generateLayer(config types.StackerConfig, oci casext.Engine, mutators []*mu
 			// as above, this symlink may already exist; if it does, we can
 			// skip symlinking
 			if !os.IsExist(err) {
-				return false, errors.Wrapf(err, "couldn't symlink additional layer type")
+				return errors.Wrapf(err, "couldn't symlink additional layer type")
 			}
 
 			// This sucks. Ideally, we'd be able to do:
@@ -544,7 +589,7 @@ func generateLayer(config types.StackerConfig, oci casext.Engine, mutators []*mu
 
 	}
 
-	return true, nil
+	return nil
 }
 
 func repackOverlay(config types.StackerConfig, name string, layerTypes []types.LayerType) error {
@@ -585,9 +630,8 @@ func repackOverlay(config types.StackerConfig, name string, layerTypes []types.L
 		mutator := mutators[i]
 
 		for _, od := range ods {
-			now := time.Now()
 			history := &ispec.History{
-				Created:    &now,
+				Created:    historyCreated(config),
 				CreatedBy:  fmt.Sprintf("stacker overlay dir for %s", name),
 				EmptyLayer: false,
 			}
@@ -704,7 +748,7 @@ func unpackOne(l ispec.Descriptor, ociDir string, extractDir string) error {
 			path.Join(ociDir, "blobs", "sha256", l.Digest.Encoded()), extractDir)
 	}
 	switch l.MediaType {
-	case ispec.MediaTypeImageLayer, ispec.MediaTypeImageLayerGzip:
+	case ispec.MediaTypeImageLayer, ispec.MediaTypeImageLayerGzip, ispec.MediaTypeImageLayerZstd:
 		tarEx.Lock()
 		defer tarEx.Unlock()
 
@@ -720,10 +764,11 @@ func unpackOne(l ispec.Descriptor, ociDir string, extractDir string) error {
 		}
 		defer compressed.Close()
 
-		uncompressed, err := pgzip.NewReader(compressed)
+		uncompressed, err := decompressLayer(l.MediaType, compressed)
 		if err != nil {
 			return err
 		}
+		defer uncompressed.Close()
 
 		// always unpack with Overlay whiteout mode to prevent ignoring whiteouts in tar layers
 		// see test/publish.bats: "building from published images with whiteouts" for more details
@@ -0,0 +1,45 @@
+package overlay
+
+import (
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+	"stackerbuild.io/stacker/pkg/types"
+)
+
+// clampTimesUnder sets the modification time of everything under dirPath
+// that was modified after epoch to epoch, without following symlinks.
+func clampTimesUnder(dirPath string, epoch time.Time) error {
+	ts := []unix.Timespec{
+		{Nsec: unix.UTIME_OMIT},
+		unix.NsecToTimespec(epoch.UnixNano()),
+	}
+
+	return filepath.Walk(dirPath, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if !info.ModTime().After(epoch) {
+			return nil
+		}
+
+		err = unix.UtimesNanoAt(unix.AT_FDCWD, p, ts, unix.AT_SYMLINK_NOFOLLOW)
+		return errors.Wrapf(err, "couldn't clamp the mtime of %s", p)
+	})
+}
+
+// historyCreated is when the history of a layer built now says it was
+// created: not at all for reproducible builds, so that it doesn't change
+// the image between them.
+func historyCreated(config types.StackerConfig) *time.Time {
+	if config.SourceDateEpoch != nil {
+		return nil
+	}
+
+	now := time.Now()
+	return &now
+}
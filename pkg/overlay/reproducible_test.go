@@ -0,0 +1,50 @@
+package overlay
+
+import (
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"stackerbuild.io/stacker/pkg/types"
+)
+
+func TestClampTimesUnder(t *testing.T) {
+	assert := assert.New(t)
+
+	dir := t.TempDir()
+	epoch := time.Unix(1700000000, 0)
+	older := epoch.Add(-time.Hour)
+
+	assert.NoError(os.MkdirAll(path.Join(dir, "sub"), 0755))
+	assert.NoError(os.WriteFile(path.Join(dir, "sub", "new"), []byte("new"), 0644))
+	assert.NoError(os.WriteFile(path.Join(dir, "old"), []byte("old"), 0644))
+	assert.NoError(os.Chtimes(path.Join(dir, "old"), older, older))
+	assert.NoError(os.Symlink("old", path.Join(dir, "link")))
+
+	assert.NoError(clampTimesUnder(dir, epoch))
+
+	for _, p := range []string{"", "sub", "sub/new", "link"} {
+		fi, err := os.Lstat(path.Join(dir, p))
+		assert.NoError(err)
+		assert.True(epoch.Equal(fi.ModTime()), p)
+	}
+
+	// files older than the epoch keep their mtime, and the link wasn't
+	// followed to clamp them
+	fi, err := os.Lstat(path.Join(dir, "old"))
+	assert.NoError(err)
+	assert.True(older.Equal(fi.ModTime()))
+}
+
+func TestHistoryCreated(t *testing.T) {
+	assert := assert.New(t)
+
+	config := types.StackerConfig{}
+	assert.NotNil(historyCreated(config))
+
+	epoch := time.Unix(1700000000, 0)
+	config.SourceDateEpoch = &epoch
+	assert.Nil(historyCreated(config))
+}
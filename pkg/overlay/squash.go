@@ -0,0 +1,327 @@
+package overlay
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/opencontainers/umoci"
+	"github.com/opencontainers/umoci/mutate"
+	"github.com/opencontainers/umoci/oci/casext"
+	"github.com/pkg/errors"
+	"github.com/pkg/xattr"
+	"stackerbuild.io/stacker/pkg/log"
+	"stackerbuild.io/stacker/pkg/types"
+)
+
+// keptLayers returns how many of the bottom layers of the image of name are
+// kept when it's squashed: none when squashing all of them, otherwise those of
+// the image the first base of name that isn't built is.
+func keptLayers(config types.StackerConfig, name string, squash types.Squash, sfm types.StackerFiles) (int, error) {
+	if squash == types.SquashAll {
+		return 0, nil
+	}
+
+	base, ok := sfm.LookupLayerDefinition(name)
+	if !ok {
+		return 0, errors.Errorf("couldn't find layer %s", name)
+	}
+	for base.From.Type == types.BuiltLayer {
+		tag, err := base.From.ParseTag()
+		if err != nil {
+			return 0, err
+		}
+
+		base, ok = sfm.LookupLayerDefinition(tag)
+		if !ok {
+			return 0, errors.Errorf("missing base layer: %s?", tag)
+		}
+	}
+
+	if !types.IsContainersImageLayer(base.From.Type) {
+		return 0, nil
+	}
+
+	tag, err := base.From.ParseTag()
+	if err != nil {
+		return 0, err
+	}
+	manifest, err := lookupManifestInDir(path.Join(config.StackerDir, "layer-bases", "oci"), tag)
+	if err != nil {
+		return 0, err
+	}
+
+	return len(manifest.Layers), nil
+}
+
+// isWhiteout returns true if fi is an overlay whiteout.
+func isWhiteout(fi fs.FileInfo) bool {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	return ok && fi.Mode()&fs.ModeCharDevice != 0 && st.Rdev == 0
+}
+
+// isOpaque returns true if the directory p is marked opaque, by overlayfs or
+// (since it's translated) fuse-overlayfs, privileged or not.
+func isOpaque(p string) bool {
+	for _, attr := range []string{"trusted.overlay.opaque", "user.overlay.opaque"} {
+		value, err := xattr.LGet(p, attr)
+		if err == nil && string(value) == "y" {
+			return true
+		}
+	}
+	return false
+}
+
+// mergeOverlayDir merges the overlay dir of a layer, src, over what the
+// layers below it merged into dest, like overlayfs would show it. With
+// whiteouts, what src deletes is deleted with whiteouts as well, for the
+// layers below dest; otherwise it's just gone. Files are hard linked rather
+// than copied: neither side is changed afterwards.
+func mergeOverlayDir(src string, dest string, whiteouts bool) error {
+	src, err := filepath.EvalSymlinks(src)
+	if err != nil {
+		return errors.Wrapf(err, "couldn't resolve %s", src)
+	}
+
+	dirs := map[string]fs.FileInfo{}
+	err = filepath.Walk(src, func(p string, fi fs.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(src, p)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		target := path.Join(dest, rel)
+
+		if isWhiteout(fi) {
+			err = os.RemoveAll(target)
+			if err != nil {
+				return errors.Wrapf(err, "couldn't remove %s", target)
+			}
+			if !whiteouts {
+				return nil
+			}
+			return errors.Wrapf(os.Link(p, target), "couldn't link %s", p)
+		}
+
+		if !fi.IsDir() {
+			err = os.RemoveAll(target)
+			if err != nil {
+				return errors.Wrapf(err, "couldn't remove %s", target)
+			}
+			return errors.Wrapf(os.Link(p, target), "couldn't link %s", p)
+		}
+
+		existing, err := os.Lstat(target)
+		if err == nil && (!existing.IsDir() || isOpaque(p)) {
+			err = os.RemoveAll(target)
+			if err != nil {
+				return errors.Wrapf(err, "couldn't remove %s", target)
+			}
+		}
+		err = os.Mkdir(target, 0755)
+		if err != nil && !os.IsExist(err) {
+			return errors.Wrapf(err, "couldn't make %s", target)
+		}
+
+		err = copyDirMetadata(p, target, fi, whiteouts)
+		if err != nil {
+			return err
+		}
+		dirs[target] = fi
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// after filling them in, which changed them
+	for target, fi := range dirs {
+		err = os.Chtimes(target, fi.ModTime(), fi.ModTime())
+		if err != nil {
+			return errors.Wrapf(err, "couldn't set the times of %s", target)
+		}
+	}
+
+	return nil
+}
+
+// copyDirMetadata gives the directory target the owner, mode and xattrs of
+// the directory p (whose info is fi), but only marks it opaque if whiteouts.
+func copyDirMetadata(p string, target string, fi fs.FileInfo, whiteouts bool) error {
+	st := fi.Sys().(*syscall.Stat_t)
+	err := os.Lchown(target, int(st.Uid), int(st.Gid))
+	if err != nil {
+		return errors.Wrapf(err, "couldn't chown %s", target)
+	}
+
+	err = os.Chmod(target, fi.Mode()&(fs.ModePerm|fs.ModeSetuid|fs.ModeSetgid|fs.ModeSticky))
+	if err != nil {
+		return errors.Wrapf(err, "couldn't chmod %s", target)
+	}
+
+	attrs, err := xattr.LList(p)
+	if err != nil {
+		return errors.Wrapf(err, "couldn't list the xattrs of %s", p)
+	}
+	for _, attr := range attrs {
+		if strings.HasSuffix(attr, ".overlay.opaque") && !whiteouts {
+			continue
+		}
+
+		value, err := xattr.LGet(p, attr)
+		if err != nil {
+			return errors.Wrapf(err, "couldn't get xattr %s of %s", attr, p)
+		}
+		err = xattr.LSet(target, attr, value)
+		if err != nil {
+			return errors.Wrapf(err, "couldn't set xattr %s of %s", attr, target)
+		}
+	}
+
+	return nil
+}
+
+// keptHistory returns the history entries of the first kept layers of an
+// image, along with the empty layer ones in between.
+func keptHistory(history []ispec.History, kept int) []ispec.History {
+	ret := []ispec.History{}
+	layers := 0
+	for _, h := range history {
+		if layers == kept {
+			break
+		}
+		ret = append(ret, h)
+		if !h.EmptyLayer {
+			layers++
+		}
+	}
+	return ret
+}
+
+// squashOverlay collapses all but the kept bottom layers of the image of name
+// into one layer, in the output and in the storage.
+func squashOverlay(config types.StackerConfig, name string, layerTypes []types.LayerType, kept int) error {
+	ctx := context.Background()
+
+	ovl, err := readOverlayMetadata(config.RootFSDir, name)
+	if err != nil {
+		return err
+	}
+
+	layers := ovl.Manifests[layerTypes[0]].Layers
+	if kept > len(layers) {
+		kept = len(layers)
+	}
+	if len(layers)-kept < 2 {
+		// nothing to squash
+		return nil
+	}
+
+	dir, err := os.MkdirTemp(config.RootFSDir, fmt.Sprintf("squash-%s-", name))
+	if err != nil {
+		return errors.Wrapf(err, "couldn't make squash dir")
+	}
+	defer os.RemoveAll(dir)
+
+	contents := path.Join(dir, "overlay")
+	err = os.Mkdir(contents, 0755)
+	if err != nil {
+		return errors.Wrapf(err, "couldn't make squash dir")
+	}
+
+	// the layer types all have the same contents
+	for _, layer := range layers[kept:] {
+		layerContents := overlayPath(config.RootFSDir, layer.Digest, "overlay")
+		if _, err := os.Stat(layerContents); os.IsNotExist(err) {
+			// an empty tar layer, as in lowerdirs()
+			continue
+		}
+
+		err = mergeOverlayDir(layerContents, contents, kept > 0)
+		if err != nil {
+			return err
+		}
+	}
+
+	oci, err := umoci.OpenLayout(config.OCIDir)
+	if err != nil {
+		return err
+	}
+	defer oci.Close()
+
+	history := &ispec.History{
+		Created:    historyCreated(config),
+		CreatedBy:  fmt.Sprintf("stacker squash of %s", name),
+		EmptyLayer: false,
+	}
+
+	descs := []ispec.Descriptor{}
+	for _, layerType := range layerTypes {
+		manifest := ovl.Manifests[layerType]
+		imageConfig := ovl.Configs[layerType]
+
+		// the image the squashed layer goes on top of
+		imageConfig.RootFS.DiffIDs = imageConfig.RootFS.DiffIDs[:kept]
+		imageConfig.History = keptHistory(imageConfig.History, kept)
+		configDigest, configSize, err := oci.PutBlobJSON(ctx, imageConfig)
+		if err != nil {
+			return err
+		}
+		manifest.Config = ispec.Descriptor{MediaType: ispec.MediaTypeImageConfig, Digest: configDigest, Size: configSize}
+		manifest.Layers = manifest.Layers[:kept]
+
+		manifestDigest, manifestSize, err := oci.PutBlobJSON(ctx, manifest)
+		if err != nil {
+			return err
+		}
+		base := ispec.Descriptor{MediaType: ispec.MediaTypeImageManifest, Digest: manifestDigest, Size: manifestSize}
+
+		mutator, err := mutate.New(oci, casext.DescriptorPath{Walk: []ispec.Descriptor{base}})
+		if err != nil {
+			return err
+		}
+
+		desc, err := addLayer(config, oci, mutator, layerType, contents, history)
+		if err != nil {
+			return err
+		}
+		descs = append(descs, desc)
+
+		newPath, err := mutator.Commit(ctx)
+		if err != nil {
+			return err
+		}
+
+		ovl.Manifests[layerType], err = mutator.Manifest(ctx)
+		if err != nil {
+			return err
+		}
+
+		ovl.Configs[layerType], err = mutator.Config(ctx)
+		if err != nil {
+			return err
+		}
+
+		err = oci.UpdateReference(ctx, layerType.LayerName(name), newPath.Root())
+		if err != nil {
+			return err
+		}
+	}
+	log.Debugf("squashed %d layers of %s into %s", len(layers)-kept, name, descs[0].Digest)
+
+	err = moveLayerContents(config, contents, descs)
+	if err != nil {
+		return err
+	}
+
+	return ovl.write(config, name)
+}
@@ -0,0 +1,81 @@
+package overlay
+
+import (
+	"os"
+	"path"
+	"testing"
+
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/xattr"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/sys/unix"
+)
+
+func TestMergeOverlayDir(t *testing.T) {
+	assert := assert.New(t)
+
+	dir := t.TempDir()
+	lower := path.Join(dir, "lower")
+	upper := path.Join(dir, "upper")
+	for _, p := range []string{"lower/etc", "lower/opaque/old", "upper/etc", "upper/opaque"} {
+		assert.NoError(os.MkdirAll(path.Join(dir, p), 0755))
+	}
+	assert.NoError(os.WriteFile(path.Join(lower, "etc", "a"), []byte("a"), 0644))
+	assert.NoError(os.WriteFile(path.Join(lower, "etc", "b"), []byte("b"), 0644))
+	assert.NoError(os.WriteFile(path.Join(upper, "etc", "a"), []byte("changed"), 0644))
+	assert.NoError(os.Symlink("a", path.Join(upper, "etc", "link")))
+	assert.NoError(os.Chmod(path.Join(upper, "etc"), 0700))
+	if err := unix.Mknod(path.Join(upper, "etc", "b"), unix.S_IFCHR, 0); err != nil {
+		t.Skipf("can't make whiteouts: %v", err)
+	}
+	if err := xattr.LSet(path.Join(upper, "opaque"), "user.overlay.opaque", []byte("y")); err != nil {
+		t.Skipf("no user xattrs in %s: %v", dir, err)
+	}
+
+	for _, whiteouts := range []bool{false, true} {
+		merged := path.Join(dir, "merged")
+		assert.NoError(os.RemoveAll(merged))
+		assert.NoError(os.Mkdir(merged, 0755))
+		assert.NoError(mergeOverlayDir(lower, merged, whiteouts))
+		assert.NoError(mergeOverlayDir(upper, merged, whiteouts))
+
+		content, err := os.ReadFile(path.Join(merged, "etc", "a"))
+		assert.NoError(err)
+		assert.Equal("changed", string(content))
+		target, err := os.Readlink(path.Join(merged, "etc", "link"))
+		assert.NoError(err)
+		assert.Equal("a", target)
+
+		fi, err := os.Stat(path.Join(merged, "etc"))
+		assert.NoError(err)
+		assert.Equal(os.FileMode(0700), fi.Mode().Perm())
+
+		_, err = os.Stat(path.Join(merged, "opaque", "old"))
+		assert.True(os.IsNotExist(err))
+		_, err = xattr.LGet(path.Join(merged, "opaque"), "user.overlay.opaque")
+		assert.Equal(whiteouts, err == nil)
+
+		fi, err = os.Lstat(path.Join(merged, "etc", "b"))
+		if whiteouts {
+			assert.NoError(err)
+			assert.True(isWhiteout(fi))
+		} else {
+			assert.True(os.IsNotExist(err))
+		}
+	}
+}
+
+func TestKeptHistory(t *testing.T) {
+	assert := assert.New(t)
+
+	history := []ispec.History{
+		{CreatedBy: "base"},
+		{CreatedBy: "base config", EmptyLayer: true},
+		{CreatedBy: "base 2"},
+		{CreatedBy: "stacker config", EmptyLayer: true},
+		{CreatedBy: "stacker build"},
+	}
+	assert.Empty(keptHistory(history, 0))
+	assert.Equal(history[:1], keptHistory(history, 1))
+	assert.Equal(history[:3], keptHistory(history, 2))
+}
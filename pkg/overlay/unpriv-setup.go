@@ -7,3 +7,7 @@ import (
 func UnprivSetup(config types.StackerConfig, uid, gid int) error {
 	return Check(config)
 }
+
+func UnprivSetupFuse(config types.StackerConfig, uid, gid int) error {
+	return CheckFuse(config)
+}
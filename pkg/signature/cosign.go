@@ -0,0 +1,68 @@
+package signature
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"io"
+	"strings"
+
+	"github.com/minio/sha256-simd"
+	"github.com/pkg/errors"
+)
+
+// CosignVerifier checks signatures made by `cosign sign-blob --key`: a base64
+// encoded signature of the sha256 of the artifact.
+type CosignVerifier struct {
+	key crypto.PublicKey
+}
+
+// NewCosignVerifier parses a PEM encoded (cosign.pub style) public key.
+func NewCosignVerifier(publicKey []byte) (*CosignVerifier, error) {
+	block, _ := pem.Decode(publicKey)
+	if block == nil {
+		return nil, errors.Errorf("couldn't find a PEM encoded public key")
+	}
+
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, errors.Wrapf(err, "couldn't parse public key")
+	}
+
+	switch key.(type) {
+	case *ecdsa.PublicKey, *rsa.PublicKey:
+	default:
+		return nil, errors.Errorf("unsupported public key type %T", key)
+	}
+
+	return &CosignVerifier{key: key}, nil
+}
+
+func (v *CosignVerifier) Verify(artifact io.Reader, signature []byte) error {
+	sig, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(signature)))
+	if err != nil {
+		return errors.Wrapf(err, "couldn't decode signature")
+	}
+
+	h := sha256.New()
+	_, err = io.Copy(h, artifact)
+	if err != nil {
+		return errors.Wrapf(err, "couldn't hash artifact")
+	}
+	digest := h.Sum(nil)
+
+	switch key := v.key.(type) {
+	case *ecdsa.PublicKey:
+		if !ecdsa.VerifyASN1(key, digest, sig) {
+			return errors.Errorf("invalid signature")
+		}
+		return nil
+	case *rsa.PublicKey:
+		return errors.WithStack(rsa.VerifyPKCS1v15(key, crypto.SHA256, digest, sig))
+	}
+
+	return errors.Errorf("unsupported public key type %T", v.key)
+}
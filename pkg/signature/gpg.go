@@ -0,0 +1,41 @@
+// Package signature contains implementations of stacker.SignatureVerifier for
+// the common detached signature formats.
+package signature
+
+import (
+	"bytes"
+	"io"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/pkg/errors"
+)
+
+// GPGVerifier checks detached (armored or binary) OpenPGP signatures, i.e.
+// the .asc and .sig files produced by gpg --detach-sign.
+type GPGVerifier struct {
+	keyring openpgp.EntityList
+}
+
+// NewGPGVerifier reads an (armored or binary) OpenPGP keyring; signatures
+// made by any key in it are accepted.
+func NewGPGVerifier(keyring []byte) (*GPGVerifier, error) {
+	el, err := openpgp.ReadArmoredKeyRing(bytes.NewReader(keyring))
+	if err != nil {
+		el, err = openpgp.ReadKeyRing(bytes.NewReader(keyring))
+		if err != nil {
+			return nil, errors.Wrapf(err, "couldn't read gpg keyring")
+		}
+	}
+
+	return &GPGVerifier{keyring: el}, nil
+}
+
+func (v *GPGVerifier) Verify(artifact io.Reader, signature []byte) error {
+	var err error
+	if bytes.HasPrefix(bytes.TrimSpace(signature), []byte("-----BEGIN PGP")) {
+		_, err = openpgp.CheckArmoredDetachedSignature(v.keyring, artifact, bytes.NewReader(signature), nil)
+	} else {
+		_, err = openpgp.CheckDetachedSignature(v.keyring, artifact, bytes.NewReader(signature), nil)
+	}
+	return errors.WithStack(err)
+}
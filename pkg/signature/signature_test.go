@@ -0,0 +1,66 @@
+package signature
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"testing"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/armor"
+	"github.com/minio/sha256-simd"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGPGVerifier(t *testing.T) {
+	assert := assert.New(t)
+
+	entity, err := openpgp.NewEntity("stacker", "", "stacker@example.com", nil)
+	assert.NoError(err)
+
+	keyring := bytes.NewBuffer(nil)
+	w, err := armor.Encode(keyring, openpgp.PublicKeyType, nil)
+	assert.NoError(err)
+	assert.NoError(entity.Serialize(w))
+	assert.NoError(w.Close())
+
+	artifact := []byte("a very important tarball")
+	sig := bytes.NewBuffer(nil)
+	assert.NoError(openpgp.ArmoredDetachSign(sig, entity, bytes.NewReader(artifact), nil))
+
+	v, err := NewGPGVerifier(keyring.Bytes())
+	assert.NoError(err)
+
+	assert.NoError(v.Verify(bytes.NewReader(artifact), sig.Bytes()))
+	assert.Error(v.Verify(bytes.NewReader([]byte("a tampered tarball")), sig.Bytes()))
+}
+
+func TestCosignVerifier(t *testing.T) {
+	assert := assert.New(t)
+
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(err)
+
+	der, err := x509.MarshalPKIXPublicKey(&priv.PublicKey)
+	assert.NoError(err)
+	pub := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})
+
+	artifact := []byte("a very important tarball")
+	digest := sha256.Sum256(artifact)
+	raw, err := ecdsa.SignASN1(rand.Reader, priv, digest[:])
+	assert.NoError(err)
+	sig := []byte(base64.StdEncoding.EncodeToString(raw) + "\n")
+
+	v, err := NewCosignVerifier(pub)
+	assert.NoError(err)
+
+	assert.NoError(v.Verify(bytes.NewReader(artifact), sig))
+	assert.Error(v.Verify(bytes.NewReader([]byte("a tampered tarball")), sig))
+
+	_, err = NewCosignVerifier([]byte("not a key"))
+	assert.Error(err)
+}
@@ -0,0 +1,129 @@
+package stacker
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"os"
+
+	"github.com/opencontainers/image-spec/specs-go"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/opencontainers/umoci/oci/casext"
+)
+
+// attachedTag is the tag of what of kind (e.g. its sbom) is attached to the
+// image tagged layerName in an OCI layout.
+func attachedTag(layerName string, kind string) string {
+	return layerName + "." + kind
+}
+
+// writeAttached adds content to oci as an artifact of mediaType referring to
+// subject, tagged tag.
+func writeAttached(oci casext.Engine, tag string, subject ispec.Descriptor, mediaType string, content []byte) error {
+	ctx := context.Background()
+
+	contentDigest, contentSize, err := oci.PutBlob(ctx, bytes.NewReader(content))
+	if err != nil {
+		return err
+	}
+
+	_, _, err = oci.PutBlob(ctx, bytes.NewReader(ispec.DescriptorEmptyJSON.Data))
+	if err != nil {
+		return err
+	}
+
+	manifest := ispec.Manifest{
+		Versioned:    specs.Versioned{SchemaVersion: 2},
+		MediaType:    ispec.MediaTypeImageManifest,
+		ArtifactType: mediaType,
+		Config:       ispec.DescriptorEmptyJSON,
+		Subject: &ispec.Descriptor{
+			MediaType: subject.MediaType,
+			Digest:    subject.Digest,
+			Size:      subject.Size,
+		},
+		Layers: []ispec.Descriptor{{
+			MediaType: mediaType,
+			Digest:    contentDigest,
+			Size:      contentSize,
+		}},
+	}
+
+	manifestDigest, manifestSize, err := oci.PutBlobJSON(ctx, manifest)
+	if err != nil {
+		return err
+	}
+
+	return oci.UpdateReference(ctx, tag, ispec.Descriptor{
+		MediaType:    ispec.MediaTypeImageManifest,
+		ArtifactType: mediaType,
+		Digest:       manifestDigest,
+		Size:         manifestSize,
+	})
+}
+
+// readAttached returns the manifest of the artifact tagged tag in oci, if it
+// is one of mediaType that refers to subject.
+func readAttached(oci casext.Engine, tag string, subject ispec.Descriptor, mediaType string) (*ispec.Manifest, bool, error) {
+	ctx := context.Background()
+
+	descPaths, err := oci.ResolveReference(ctx, tag)
+	if err != nil || len(descPaths) != 1 {
+		return nil, false, err
+	}
+
+	blob, err := oci.FromDescriptor(ctx, descPaths[0].Descriptor())
+	if err != nil {
+		return nil, false, err
+	}
+	defer blob.Close()
+
+	manifest, ok := blob.Data.(ispec.Manifest)
+	if !ok || manifest.ArtifactType != mediaType || manifest.Subject == nil || manifest.Subject.Digest != subject.Digest || len(manifest.Layers) != 1 {
+		return nil, false, nil
+	}
+
+	return &manifest, true, nil
+}
+
+// findAttached returns the manifest of the artifact tagged tag in oci, if it
+// is one of any of mediaTypes that refers to the image tagged layerName.
+func findAttached(oci casext.Engine, layerName string, tag string, mediaTypes ...string) (*ispec.Manifest, bool, error) {
+	descPaths, err := oci.ResolveReference(context.Background(), layerName)
+	if err != nil || len(descPaths) != 1 {
+		return nil, false, err
+	}
+
+	for _, mediaType := range mediaTypes {
+		manifest, ok, err := readAttached(oci, tag, descPaths[0].Descriptor(), mediaType)
+		if err != nil || ok {
+			return manifest, ok, err
+		}
+	}
+
+	return nil, false, nil
+}
+
+// extractAttached writes the content of the artifact of manifest in oci to a
+// temporary file in dir, and returns its path.
+func extractAttached(oci casext.Engine, manifest *ispec.Manifest, dir string) (string, error) {
+	reader, err := oci.GetVerifiedBlob(context.Background(), manifest.Layers[0])
+	if err != nil {
+		return "", err
+	}
+	defer reader.Close()
+
+	f, err := os.CreateTemp(dir, "attached-*.json")
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	_, err = io.Copy(f, reader)
+	if err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+
+	return f.Name(), nil
+}
@@ -0,0 +1,218 @@
+package stacker
+
+import (
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/pkg/errors"
+	"stackerbuild.io/stacker/pkg/types"
+)
+
+// Credentials authenticate the requests made for downloads. The credentials
+// from the stacker config for the longest URL prefix of the request's URL are
+// used, or else those of the request's host in the netrc file. Requests that
+// already carry an Authorization header (see DownloadOptions.Headers) are
+// left alone, and, as net/http drops the header when following a redirect to
+// another host, credentials are only ever sent to the host they are for.
+type Credentials struct {
+	config []types.DownloadCredential
+	netrc  []netrcEntry
+}
+
+// netrcEntry is a machine (or, if machine is empty, the default) in a netrc
+// file.
+type netrcEntry struct {
+	machine  string
+	login    string
+	password string
+}
+
+// NewCredentials returns the Credentials for downloads, from config and the
+// netrc file ($NETRC, or ~/.netrc), if there is one.
+func NewCredentials(config []types.DownloadCredential) (*Credentials, error) {
+	return newCredentials(config, netrcPath())
+}
+
+func newCredentials(config []types.DownloadCredential, netrcFile string) (*Credentials, error) {
+	for _, c := range config {
+		if c.URL == "" {
+			return nil, errors.Errorf("download credentials without a url")
+		}
+		if c.TokenEnv == "" && c.Username == "" {
+			return nil, errors.Errorf("download credentials for %s need a username or a token_env", c.URL)
+		}
+	}
+
+	creds := &Credentials{config: config}
+	if netrcFile == "" {
+		return creds, nil
+	}
+
+	content, err := os.ReadFile(netrcFile)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return creds, nil
+		}
+		return nil, errors.Wrapf(err, "couldn't read %s", netrcFile)
+	}
+
+	creds.netrc = parseNetrc(string(content))
+	return creds, nil
+}
+
+func netrcPath() string {
+	if p := os.Getenv("NETRC"); p != "" {
+		return p
+	}
+
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+
+	return path.Join(home, ".netrc")
+}
+
+// parseNetrc returns the entries of a netrc file that have a login. Tokens it
+// doesn't know about are skipped, as are macro definitions.
+func parseNetrc(content string) []netrcEntry {
+	entries := []netrcEntry{}
+	var cur *netrcEntry
+
+	lines := strings.Split(content, "\n")
+	for i := 0; i < len(lines); i++ {
+		fields := strings.Fields(lines[i])
+		for j := 0; j < len(fields); j++ {
+			value := ""
+			if j+1 < len(fields) {
+				value = fields[j+1]
+			}
+
+			switch fields[j] {
+			case "machine":
+				entries = appendNetrcEntry(entries, cur)
+				cur = &netrcEntry{machine: value}
+				j++
+			case "default":
+				entries = appendNetrcEntry(entries, cur)
+				cur = &netrcEntry{}
+			case "login":
+				if cur != nil {
+					cur.login = value
+				}
+				j++
+			case "password":
+				if cur != nil {
+					cur.password = value
+				}
+				j++
+			case "account":
+				j++
+			case "macdef":
+				// the macro goes on until the next empty line
+				for i++; i < len(lines) && strings.TrimSpace(lines[i]) != ""; i++ {
+				}
+				j = len(fields)
+			}
+		}
+	}
+
+	return appendNetrcEntry(entries, cur)
+}
+
+func appendNetrcEntry(entries []netrcEntry, e *netrcEntry) []netrcEntry {
+	if e == nil || e.login == "" {
+		return entries
+	}
+	return append(entries, *e)
+}
+
+// authorize adds the credentials for rawURL, if there are any, to req.
+func (c *Credentials) authorize(req *http.Request, rawURL string) error {
+	if c == nil || req.Header.Get("Authorization") != "" {
+		return nil
+	}
+
+	if cred, ok := c.forURL(rawURL); ok {
+		if cred.TokenEnv != "" {
+			token := os.Getenv(cred.TokenEnv)
+			if token == "" {
+				return errors.Errorf("$%s is not set, it has the token for %s", cred.TokenEnv, rawURL)
+			}
+
+			netLog.Debugf("authenticating to %s with the token in $%s", rawURL, cred.TokenEnv)
+			req.Header.Set("Authorization", "Bearer "+token)
+			return nil
+		}
+
+		password := cred.Password
+		if cred.PasswordEnv != "" {
+			password = os.Getenv(cred.PasswordEnv)
+			if password == "" {
+				return errors.Errorf("$%s is not set, it has the password for %s", cred.PasswordEnv, rawURL)
+			}
+		}
+
+		netLog.Debugf("authenticating to %s as %s", rawURL, cred.Username)
+		req.SetBasicAuth(cred.Username, password)
+		return nil
+	}
+
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return errors.Wrapf(err, "couldn't parse %s", rawURL)
+	}
+
+	if e, ok := c.forHost(u.Hostname()); ok {
+		netLog.Debugf("authenticating to %s as %s, from netrc", rawURL, e.login)
+		req.SetBasicAuth(e.login, e.password)
+	}
+
+	return nil
+}
+
+// forURL returns the configured credentials with the longest URL prefix of
+// rawURL.
+func (c *Credentials) forURL(rawURL string) (types.DownloadCredential, bool) {
+	best, found := types.DownloadCredential{}, false
+	for _, cred := range c.config {
+		if urlHasPrefix(rawURL, cred.URL) && (!found || len(cred.URL) > len(best.URL)) {
+			best, found = cred, true
+		}
+	}
+
+	return best, found
+}
+
+// forHost returns the netrc entry of host, or the default entry.
+func (c *Credentials) forHost(host string) (netrcEntry, bool) {
+	for _, e := range c.netrc {
+		if e.machine == host {
+			return e, true
+		}
+	}
+
+	for _, e := range c.netrc {
+		if e.machine == "" {
+			return e, true
+		}
+	}
+
+	return netrcEntry{}, false
+}
+
+// urlHasPrefix returns true if rawURL starts with prefix, at a path boundary:
+// https://example.com/foo is a prefix of https://example.com/foo/bar, but not
+// of https://example.com/foobar, and https://example.com not of
+// https://example.com.evil.org.
+func urlHasPrefix(rawURL string, prefix string) bool {
+	if !strings.HasPrefix(rawURL, prefix) {
+		return false
+	}
+
+	rest := rawURL[len(prefix):]
+	return rest == "" || strings.HasSuffix(prefix, "/") || strings.ContainsAny(rest[:1], "/?#")
+}
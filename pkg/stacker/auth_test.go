@@ -0,0 +1,74 @@
+package stacker
+
+import (
+	"context"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"stackerbuild.io/stacker/pkg/types"
+)
+
+func TestParseNetrc(t *testing.T) {
+	assert := assert.New(t)
+
+	entries := parseNetrc(`machine artifacts.example.com login builder password hunter2
+macdef init
+cd /pub
+get foo
+
+machine other.example.com
+	account ignored
+	login other
+	password secret
+default login anonymous password me@example.com
+`)
+	assert.Equal([]netrcEntry{
+		{machine: "artifacts.example.com", login: "builder", password: "hunter2"},
+		{machine: "other.example.com", login: "other", password: "secret"},
+		{login: "anonymous", password: "me@example.com"},
+	}, entries)
+}
+
+func TestDownloadCredentials(t *testing.T) {
+	assert := assert.New(t)
+
+	netrc := path.Join(t.TempDir(), "netrc")
+	err := os.WriteFile(netrc, []byte("machine netrc.example.com login builder password hunter2\n"), 0600)
+	assert.NoError(err)
+
+	t.Setenv("STACKER_TEST_TOKEN", "s3cret")
+	creds, err := newCredentials([]types.DownloadCredential{
+		{URL: "https://artifacts.example.com", Username: "ci", Password: "pw"},
+		{URL: "https://artifacts.example.com/private/", TokenEnv: "STACKER_TEST_TOKEN"},
+		{URL: "https://missing.example.com", TokenEnv: "STACKER_TEST_UNSET"},
+	}, netrc)
+	assert.NoError(err)
+
+	authorization := func(url string) string {
+		transport := &fakeTransport{body: "hello world"}
+		opts := DownloadOptions{Uid: os.Getuid(), Gid: os.Getgid(), TransportOptions: TransportOptions{Transport: transport, Credentials: creds}}
+		_, err := fileInfo(context.Background(), url, opts)
+		assert.NoError(err)
+		_, err = DownloadWithOptions(t.TempDir(), url, opts)
+		assert.NoError(err)
+
+		assert.Len(transport.requests, 2)
+		assert.Equal(transport.requests[0].Header.Get("Authorization"), transport.requests[1].Header.Get("Authorization"))
+		return transport.requests[0].Header.Get("Authorization")
+	}
+
+	assert.Equal("Basic Y2k6cHc=", authorization("https://artifacts.example.com/foo"))
+	assert.Equal("Bearer s3cret", authorization("https://artifacts.example.com/private/foo"))
+	assert.Equal("Basic YnVpbGRlcjpodW50ZXIy", authorization("https://netrc.example.com/foo"))
+	assert.Equal("", authorization("https://artifacts.example.com.evil.org/foo"))
+	assert.Equal("", authorization("https://example.com/foo"))
+
+	_, err = DownloadWithOptions(t.TempDir(), "https://missing.example.com/foo",
+		DownloadOptions{TransportOptions: TransportOptions{Transport: &fakeTransport{}, Credentials: creds}})
+	assert.ErrorContains(err, "STACKER_TEST_UNSET is not set")
+
+	_, err = newCredentials([]types.DownloadCredential{{URL: "https://example.com"}}, "")
+	assert.Error(err)
+}
@@ -1,12 +1,14 @@
 package stacker
 
 import (
+	"context"
 	"fmt"
 	"io"
 	"os"
 	"path"
 
 	"github.com/klauspost/pgzip"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
 	"github.com/opencontainers/umoci"
 	"github.com/opencontainers/umoci/oci/casext"
 	"github.com/opencontainers/umoci/oci/layer"
@@ -40,9 +42,11 @@ func GetBase(o BaseLayerOpts) error {
 			return err
 		}
 
-		_, err := acquireUrl(o.Config, o.Storage, o.Layer.From.Url, cacheDir, "", "", nil, -1, -1, o.Progress)
+		_, err := acquireUrl(o.Config, o.Storage, o.Layer.From.Url, cacheDir, "", 0, 0, "", nil, -1, -1, o.Progress, nil)
 		return err
 	/* now we can do all the containers/image types */
+	case types.DockerArchiveLayer, types.OCIArchiveLayer:
+		fallthrough
 	case types.OCILayer:
 		fallthrough
 	case types.DockerLayer:
@@ -92,6 +96,8 @@ func SetupRootfs(o BaseLayerOpts) error {
 			return err
 		}
 		return setupTarRootfs(o)
+	case types.DockerArchiveLayer, types.OCIArchiveLayer:
+		fallthrough
 	case types.OCILayer:
 		fallthrough
 	case types.DockerLayer:
@@ -138,12 +144,31 @@ func importContainersImage(is types.ImageSource, config types.StackerConfig, pro
 		progressWriter = os.Stderr
 	}
 
+	// building for another platform needs its image of the base
+	var platform *ispec.Platform
+	if config.Platform != "" {
+		p, err := ParsePlatform(config.Platform)
+		if err != nil {
+			return err
+		}
+		platform = &p
+	}
+
+	if is.Type == types.DockerLayer {
+		err = config.BaseImagePolicy.Check(context.Background(), toImport, is.Insecure, config.Registries)
+		if err != nil {
+			return err
+		}
+	}
+
 	log.Infof("loading %s", toImport)
 	err = lib.ImageCopy(lib.ImageCopyOpts{
 		Src:        toImport,
 		Dest:       fmt.Sprintf("oci:%s:%s", cacheDir, tag),
 		SrcSkipTLS: is.Insecure,
 		Progress:   progressWriter,
+		Platform:   platform,
+		Registries: config.Registries,
 	})
 	if err != nil {
 		return errors.Wrapf(err, "couldn't import base layer %s", tag)
@@ -9,6 +9,7 @@ import (
 	"path"
 	"path/filepath"
 	"strings"
+	"sync"
 	"time"
 
 	ispec "github.com/opencontainers/image-spec/specs-go/v1"
@@ -16,6 +17,7 @@ import (
 	"github.com/opencontainers/umoci/mutate"
 	"github.com/opencontainers/umoci/oci/casext"
 	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
 	"gopkg.in/yaml.v2"
 	"stackerbuild.io/stacker/pkg/container"
 	"stackerbuild.io/stacker/pkg/lib"
@@ -43,12 +45,63 @@ type BuildArgs struct {
 	AnnotationsNamespace string
 	Username             string
 	Password             string
+
+	// CacheFrom, if set, is a build cache exported with CacheTo that
+	// is imported before building, for the layers that aren't in the
+	// local build cache.
+	CacheFrom string
+
+	// CacheTo, if set, is where the build cache is exported to after
+	// building, e.g. docker://registry:5000/project/cache:main.
+	CacheTo string
+
+	// CacheSkipTLS is whether CacheFrom and CacheTo are accessed
+	// without TLS verification.
+	CacheSkipTLS bool
+
+	// Platforms, if set, are the platforms the stackerfiles are built
+	// for, each layer's image being an index of the image for each of
+	// them. Foreign architectures are run with qemu-user-static.
+	Platforms []ispec.Platform
+
+	// SBOM, if set, is the format (spdx or cyclonedx) of the SBOM that is
+	// generated of each layer that is built, and added to the OCI layout
+	// as an artifact referring to its image.
+	SBOM string
+
+	// Provenance adds the SLSA provenance of each layer that is built to
+	// the OCI layout, as an artifact referring to its image: what it was
+	// built from and by whom.
+	Provenance bool
+
+	// NoNetwork runs the run sections of all layers without network
+	// access, as if they all had network: none.
+	NoNetwork bool
+
+	// Resources are the limits of the run sections of the layers that
+	// don't set their own.
+	Resources types.Resources
+
+	// Jobs is how many layers of a stackerfile may be built at once, as
+	// long as they don't build on each other; 0 or 1 builds them one at
+	// a time.
+	Jobs int
 }
 
 // Builder is responsible for building the layers based on stackerfiles
 type Builder struct {
 	builtStackerfiles types.StackerFiles // Keep track of all the Stackerfiles which were built
 	opts              *BuildArgs         // Build options
+
+	// baseMu and outputMu are held by layers built in parallel while
+	// they set up their base, and add their output, respectively.
+	baseMu   sync.Mutex
+	outputMu sync.Mutex
+
+	// metrics are shared with the builders of each platform, whose
+	// layers are measured as built for platform.
+	metrics  *BuildMetrics
+	platform string
 }
 
 func substitutionExists(key string, subs []string) (string, bool) {
@@ -90,9 +143,15 @@ func NewBuilder(opts *BuildArgs) *Builder {
 	return &Builder{
 		builtStackerfiles: make(map[string]*types.Stackerfile, 1),
 		opts:              opts,
+		metrics:           NewBuildMetrics(),
 	}
 }
 
+// Metrics returns the measurements of what was built so far.
+func (b *Builder) Metrics() *BuildMetrics {
+	return b.metrics
+}
+
 func (b *Builder) updateOCIConfigForOutput(sf *types.Stackerfile, s types.Storage, oci casext.Engine, layerType types.LayerType, l types.Layer, name string) error {
 	opts := b.opts
 
@@ -260,7 +319,25 @@ func (b *Builder) updateOCIConfigForOutput(sf *types.Stackerfile, s types.Storag
 	meta.Created = time.Now()
 	meta.Architecture = *l.Arch
 	meta.OS = *l.OS
+	variant := ""
+	if opts.Config.Platform != "" {
+		p, err := ParsePlatform(opts.Config.Platform)
+		if err != nil {
+			return err
+		}
+		meta.Architecture = p.Architecture
+		meta.OS = p.OS
+		variant = p.Variant
+	}
 	meta.Author = author
+	historyCreated := &meta.Created
+	if opts.Config.SourceDateEpoch != nil {
+		// the user and host that built it would make the image
+		// different everywhere it is built
+		meta.Created = *opts.Config.SourceDateEpoch
+		meta.Author = ""
+		historyCreated = nil
+	}
 
 	annotations, err := mutator.Annotations(context.Background())
 	if err != nil {
@@ -288,9 +365,9 @@ func (b *Builder) updateOCIConfigForOutput(sf *types.Stackerfile, s types.Storag
 
 	history := ispec.History{
 		EmptyLayer: true, // this is only the history for imageConfig edit
-		Created:    &meta.Created,
+		Created:    historyCreated,
 		CreatedBy:  "stacker build",
-		Author:     author,
+		Author:     meta.Author,
 	}
 
 	err = mutator.Set(context.Background(), imageConfig, meta, annotations, &history)
@@ -308,6 +385,10 @@ func (b *Builder) updateOCIConfigForOutput(sf *types.Stackerfile, s types.Storag
 		return err
 	}
 
+	if variant != "" {
+		return setImageVariant(oci, layerName, variant)
+	}
+
 	return nil
 }
 
@@ -357,230 +438,429 @@ func (b *Builder) build(s types.Storage, file string) error {
 		return err
 	}
 
+	deps := map[string][]string{}
 	for _, name := range order {
-		l, ok := sf.Get(name)
-		if !ok {
-			return errors.Errorf("%s not present in stackerfile?", name)
-		}
-
-		// if a container builds on another container in a stacker
-		// file, we can't correctly render the dependent container's
-		// filesystem, since we don't know what the output of the
-		// parent build will be. so let's refuse to run in setup-only
-		// mode in this case.
-		if opts.SetupOnly && l.From.Type == types.BuiltLayer {
-			return errors.Errorf("no built type layers (%s) allowed in setup mode", name)
+		deps[name], err = sf.LayerDependencies(name)
+		if err != nil {
+			return err
 		}
+	}
 
-		log.Infof("preparing image %s...", name)
-		inDir := types.InternalStackerDir
-		if l.WasLegacyImport {
-			log.Debugf("image %s uses legacy import syntax, will also mount imports at %s",
-				name, types.LegacyInternalStackerDir)
-			inDir = types.LegacyInternalStackerDir
+	bases := map[string]bool{}
+	for _, layerDeps := range deps {
+		for _, dep := range layerDeps {
+			bases[dep] = true
 		}
+	}
 
-		// We need to run the imports first since we now compare
-		// against imports for caching layers. Since we don't do
-		// network copies if the files are present and we use rsync to
-		// copy things across, hopefully this isn't too expensive.
-		err = CleanImportsDir(opts.Config, name, l.Imports, buildCache)
+	lb := layerBuild{storage: s, sf: sf, oci: oci, cache: buildCache, bases: bases}
+	err = scheduleLayers(order, deps, opts.Jobs, func(name string) error {
+		log.Event("layer-started", log.Fields{"layer": name, "stackerfile": file})
+		lm := b.metrics.layer(name, b.platform)
+		started := time.Now()
+		err := b.buildLayer(lb, name, lm)
+		lm.Seconds = time.Since(started).Seconds()
+		finished := log.Fields{"layer": name, "seconds": lm.Seconds}
 		if err != nil {
-			return err
+			finished["error"] = err.Error()
 		}
+		log.Event("layer-finished", finished)
+		return err
+	})
+	if err != nil {
+		return err
+	}
 
-		if err := Import(opts.Config, s, name, l.Imports, &l.OverlayDirs, opts.Progress); err != nil {
-			return err
-		}
+	return oci.GC(context.Background())
+}
 
-		log.Debugf("overlay-dirs, possibly modified after import: %v", l.OverlayDirs)
+// layerBuild is what the layers of a stackerfile are built with.
+type layerBuild struct {
+	storage types.Storage
+	sf      *types.Stackerfile
+	oci     casext.Engine
+	cache   *BuildCache
 
-		// Need to check if the image has bind mounts, if the image has bind mounts,
-		// it needs to be rebuilt regardless of the build cache
-		// The reason is that tracking build cache for bind mounted folders
-		// is too expensive, so we don't do it
-		baseOpts := BaseLayerOpts{
-			Config:     opts.Config,
-			Name:       name,
-			Layer:      l,
-			Cache:      buildCache,
-			OCI:        oci,
-			LayerTypes: opts.LayerTypes,
-			Storage:    s,
-			Progress:   opts.Progress,
-		}
+	// bases are the layers other layers of sf are built on or import
+	// from, which need their rootfs even if they weren't rebuilt.
+	bases map[string]bool
+}
 
-		if err := GetBase(baseOpts); err != nil {
-			return err
-		}
+// buildLayer builds the layer name of lb.sf, whose dependencies are built.
+// When layers are built in parallel, what they share is only changed by one
+// of them at a time: the base images and rootfs they are set up from, and the
+// OCI layout and the build cache they are added to.
+func (b *Builder) buildLayer(lb layerBuild, name string, lm *LayerMetrics) error {
+	opts := b.opts
+	s, sf, oci, buildCache := lb.storage, lb.sf, lb.oci, lb.cache
+	started := time.Now().UTC()
+
+	lg := log.Prefix("")
+	progress := opts.Progress
+	if opts.Jobs > 1 {
+		lg = log.Prefix(fmt.Sprintf("[%s] ", name))
+		// the bars of several layers would draw over each other
+		progress = false
+	}
 
-		cacheEntry, cacheHit, err := buildCache.Lookup(name)
-		if err != nil {
-			return err
-		}
-		if cacheHit && (len(l.Binds) == 0) {
-			if l.BuildOnly {
-				if cacheEntry.Name != name {
-					err = s.Snapshot(cacheEntry.Name, name)
+	l, ok := sf.Get(name)
+	if !ok {
+		return errors.Errorf("%s not present in stackerfile?", name)
+	}
+
+	// if a container builds on another container in a stacker
+	// file, we can't correctly render the dependent container's
+	// filesystem, since we don't know what the output of the
+	// parent build will be. so let's refuse to run in setup-only
+	// mode in this case.
+	if opts.SetupOnly && l.From.Type == types.BuiltLayer {
+		return errors.Errorf("no built type layers (%s) allowed in setup mode", name)
+	}
+
+	lg.Infof("preparing image %s...", name)
+	inDir := types.InternalStackerDir
+	if l.WasLegacyImport {
+		lg.Debugf("image %s uses legacy import syntax, will also mount imports at %s",
+			name, types.LegacyInternalStackerDir)
+		inDir = types.LegacyInternalStackerDir
+	}
+
+	// We need to run the imports first since we now compare
+	// against imports for caching layers. Since we don't do
+	// network copies if the files are present and we use rsync to
+	// copy things across, hopefully this isn't too expensive.
+	err := CleanImportsDir(opts.Config, name, l.Imports, buildCache)
+	if err != nil {
+		return err
+	}
+
+	importsStarted := time.Now()
+	if err := Import(opts.Config, s, name, l.Imports, &l.OverlayDirs, progress, lm); err != nil {
+		return err
+	}
+	lm.ImportSeconds = time.Since(importsStarted).Seconds()
+
+	lg.Debugf("overlay-dirs, possibly modified after import: %v", l.OverlayDirs)
+
+	// Need to check if the image has bind mounts, if the image has bind mounts,
+	// it needs to be rebuilt regardless of the build cache
+	// The reason is that tracking build cache for bind mounted folders
+	// is too expensive, so we don't do it
+	baseOpts := BaseLayerOpts{
+		Config:     opts.Config,
+		Name:       name,
+		Layer:      l,
+		Cache:      buildCache,
+		OCI:        oci,
+		LayerTypes: opts.LayerTypes,
+		Storage:    s,
+		Progress:   progress,
+	}
+
+	b.baseMu.Lock()
+	err = GetBase(baseOpts)
+	b.baseMu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	cacheEntry, cacheHit, err := buildCache.Lookup(name)
+	if err != nil {
+		return err
+	}
+	if cacheHit && (len(l.Binds) == 0) {
+		if l.BuildOnly {
+			if cacheEntry.Name != name {
+				err = s.Snapshot(cacheEntry.Name, name)
+				if err != nil {
+					return err
+				}
+			}
+			lm.Cached = true
+			log.Event("cache-hit", log.Fields{"layer": name})
+			return nil
+		} else {
+			foundCount := 0
+			b.outputMu.Lock()
+			for _, layerType := range opts.LayerTypes {
+				blob, ok := cacheEntry.Manifests[layerType]
+				layerName := layerType.LayerName(name)
+				if ok && opts.SBOM != "" {
+					ok, err = hasSBOM(oci, layerName, blob, opts.SBOM)
 					if err != nil {
+						b.outputMu.Unlock()
 						return err
 					}
+					if !ok {
+						lg.Infof("cache miss because the sbom of %s is not generated", layerName)
+					}
 				}
-				continue
-			} else {
-				foundCount := 0
-				for _, layerType := range opts.LayerTypes {
-					blob, ok := cacheEntry.Manifests[layerType]
-					if ok {
-						foundCount += 1
-						layerName := layerType.LayerName(name)
-						err = oci.UpdateReference(context.Background(), layerName, blob)
-						if err != nil {
-							return err
-						}
-						log.Infof("found cached layer %s", layerName)
+				if ok && opts.Provenance {
+					ok, err = hasProvenance(oci, layerName, blob)
+					if err != nil {
+						b.outputMu.Unlock()
+						return err
+					}
+					if !ok {
+						lg.Infof("cache miss because the provenance of %s is not generated", layerName)
 					}
 				}
-
-				if foundCount == len(opts.LayerTypes) {
-					continue
+				if ok {
+					foundCount += 1
+					err = oci.UpdateReference(context.Background(), layerName, blob)
+					if err != nil {
+						b.outputMu.Unlock()
+						return err
+					}
+					lg.Infof("found cached layer %s", layerName)
 				}
+			}
+			b.outputMu.Unlock()
 
-				log.Infof("missing some cached layer output types, building anyway")
+			if foundCount == len(opts.LayerTypes) {
+				if lb.bases[name] && !s.Exists(name) {
+					b.baseMu.Lock()
+					err = restoreCachedRootfs(opts.Config, s, name, opts.LayerTypes[0].LayerName(name))
+					b.baseMu.Unlock()
+					if err != nil {
+						return err
+					}
+				}
+				lm.Cached = true
+				log.Event("cache-hit", log.Fields{"layer": name})
+				b.outputMu.Lock()
+				err = lm.recordOutputs(oci, name, opts.LayerTypes)
+				b.outputMu.Unlock()
+				return err
 			}
-		} else if cacheHit && (len(l.Binds) > 0) {
-			log.Infof("rebuilding cached layer due to use of binds in stacker file")
+
+			lg.Infof("missing some cached layer output types, building anyway")
 		}
+	} else if cacheHit && (len(l.Binds) > 0) {
+		lg.Infof("rebuilding cached layer due to use of binds in stacker file")
+	}
+
+	log.Event("cache-miss", log.Fields{"layer": name})
 
-		err = SetupRootfs(baseOpts)
+	b.baseMu.Lock()
+	err = SetupRootfs(baseOpts)
+	b.baseMu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	err = s.SetOverlayDirs(name, l.OverlayDirs, opts.LayerTypes)
+	if err != nil {
+		return err
+	}
+
+	c, err := container.New(opts.Config, name)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	c.SetOutputPrefix(string(lg))
+
+	err = SetupBuildContainerConfig(opts.Config, s, c, inDir, name)
+	if err != nil {
+		return err
+	}
+
+	err = SetupLayerConfig(opts.Config, c, l, inDir, name)
+	if err != nil {
+		return err
+	}
+
+	if opts.NoNetwork || l.Network == types.NetworkNone {
+		// "none" would share the host's network; "empty" only has a
+		// loopback interface
+		err = c.SetConfig("lxc.net.0.type", "empty")
 		if err != nil {
 			return err
 		}
+	}
+
+	limits, err := l.Resources.Or(opts.Resources).CgroupConfigs()
+	if err != nil {
+		return errors.Wrapf(err, "%s", name)
+	}
+	err = c.SetConfigs(limits)
+	if err != nil {
+		return err
+	}
+
+	security, err := l.Security.Or(opts.Config.Security).LXCConfigs()
+	if err != nil {
+		return errors.Wrapf(err, "%s", name)
+	}
+	err = c.SetConfigs(security)
+	if err != nil {
+		return err
+	}
 
-		err = s.SetOverlayDirs(name, l.OverlayDirs, opts.LayerTypes)
+	if opts.SetupOnly {
+		err = c.SaveConfigFile(filepath.Join(opts.Config.RootFSDir, name, "lxc.conf"))
 		if err != nil {
-			return err
+			return errors.Wrapf(err, "error saving config file for %s", name)
 		}
 
-		c, err := container.New(opts.Config, name)
+		lg.Infof("setup for %s complete", name)
+		return nil
+	}
+
+	if len(l.Run) != 0 {
+		rootfs := filepath.Join(opts.Config.RootFSDir, name, "rootfs")
+		shellScript := filepath.Join(opts.Config.StackerDir, "imports", name, ".stacker-run.sh")
+		err = generateShellForRunning(rootfs, l.Run, shellScript)
 		if err != nil {
 			return err
 		}
-		defer c.Close()
 
-		err = SetupBuildContainerConfig(opts.Config, s, c, inDir, name)
+		secrets, err := setupSecrets(opts.Config, c, s, name, l.Secrets)
 		if err != nil {
 			return err
 		}
+		defer secrets.Cleanup()
 
-		err = SetupLayerConfig(opts.Config, c, l, inDir, name)
+		cacheDirs, err := setupCacheDirs(opts.Config, c, s, name, l.CacheDirs)
 		if err != nil {
 			return err
 		}
+		defer cacheDirs.remove("cache dir")
 
-		if opts.SetupOnly {
-			err = c.SaveConfigFile(filepath.Join(opts.Config.RootFSDir, name, "lxc.conf"))
-			if err != nil {
-				return errors.Wrapf(err, "error saving config file for %s", name)
+		// These should all be non-interactive; let's ensure that.
+		err = c.Execute([]string{filepath.Join(inDir, "imports", ".stacker-run.sh")}, nil)
+		if err != nil {
+			if opts.OnRunFailure != "" {
+				err2 := c.Execute([]string{opts.OnRunFailure}, os.Stdin)
+				if err2 != nil {
+					lg.Infof("failed executing %s: %s\n", opts.OnRunFailure, err2)
+				}
 			}
-
-			log.Infof("setup for %s complete", name)
-			continue
+			return errors.Errorf("run commands failed: %s", err)
 		}
 
-		if len(l.Run) != 0 {
-			rootfs := filepath.Join(opts.Config.RootFSDir, name, "rootfs")
-			shellScript := filepath.Join(opts.Config.StackerDir, "imports", name, ".stacker-run.sh")
-			err = generateShellForRunning(rootfs, l.Run, shellScript)
-			if err != nil {
-				return err
-			}
+		// the secrets' and cache dirs' mountpoints mustn't end up in
+		// the layer
+		err = secrets.Cleanup()
+		if err != nil {
+			return err
+		}
 
-			// These should all be non-interactive; let's ensure that.
-			err = c.Execute([]string{filepath.Join(inDir, "imports", ".stacker-run.sh")}, nil)
-			if err != nil {
-				if opts.OnRunFailure != "" {
-					err2 := c.Execute([]string{opts.OnRunFailure}, os.Stdin)
-					if err2 != nil {
-						log.Infof("failed executing %s: %s\n", opts.OnRunFailure, err2)
-					}
-				}
-				return errors.Errorf("run commands failed: %s", err)
-			}
+		err = cacheDirs.remove("cache dir")
+		if err != nil {
+			return err
 		}
+	}
 
-		// build artifacts such as BOMs, etc
-		if l.Bom != nil && l.Bom.Generate {
-			log.Debugf("generating layer artifacts for %s", name)
+	// build artifacts such as BOMs, etc
+	if l.Bom != nil && l.Bom.Generate {
+		lg.Debugf("generating layer artifacts for %s", name)
 
-			if err := ImportArtifacts(opts.Config, l.From, name); err != nil {
-				log.Errorf("unable to import previously built artifacts, err:%v", err)
+		if err := ImportArtifacts(opts.Config, l.From, name); err != nil {
+			lg.Errorf("unable to import previously built artifacts, err:%v", err)
+			return err
+		}
+
+		for _, pkg := range l.Bom.Packages {
+			if err := BuildLayerArtifacts(opts.Config, s, l, name, pkg); err != nil {
+				lg.Errorf("failed to generate layer artifacts for %s - %v", name, err)
 				return err
 			}
+		}
 
-			for _, pkg := range l.Bom.Packages {
-				if err := BuildLayerArtifacts(opts.Config, s, l, name, pkg); err != nil {
-					log.Errorf("failed to generate layer artifacts for %s - %v", name, err)
-					return err
-				}
-			}
+		if err := VerifyLayerArtifacts(opts.Config, s, l, name); err != nil {
+			lg.Errorf("failed to validate layer artifacts for %s - %v", name, err)
+			// the generated bom is invalid, remove it so we don't publish it and also get a cache miss for rebuilds
+			_ = os.Remove(path.Join(opts.Config.StackerDir, "artifacts", name, fmt.Sprintf("%s.json", name)))
+			return err
+		}
+	}
 
-			if err := VerifyLayerArtifacts(opts.Config, s, l, name); err != nil {
-				log.Errorf("failed to validate layer artifacts for %s - %v", name, err)
-				// the generated bom is invalid, remove it so we don't publish it and also get a cache miss for rebuilds
-				_ = os.Remove(path.Join(opts.Config.StackerDir, "artifacts", name, fmt.Sprintf("%s.json", name)))
-				return err
-			}
+	// This is a build only layer, meaning we don't need to include
+	// it in the final image, as outputs from it are going to be
+	// imported into future images. Let's just snapshot it and add
+	// a bogus entry to our cache.
+	if l.BuildOnly {
+		lg.Debugf("build only layer, skipping OCI diff generation")
+
+		// A small hack: for build only layers, we keep track
+		// of the name, so we can make sure it exists when
+		// there is a cache hit. We should probably make this
+		// into some sort of proper Either type.
+		manifests := map[types.LayerType]ispec.Descriptor{opts.LayerTypes[0]: ispec.Descriptor{}}
+		if err := buildCache.Put(name, manifests); err != nil {
+			return err
 		}
+		return nil
+	}
 
-		// This is a build only layer, meaning we don't need to include
-		// it in the final image, as outputs from it are going to be
-		// imported into future images. Let's just snapshot it and add
-		// a bogus entry to our cache.
-		if l.BuildOnly {
-			log.Debugf("build only layer, skipping OCI diff generation")
-
-			// A small hack: for build only layers, we keep track
-			// of the name, so we can make sure it exists when
-			// there is a cache hit. We should probably make this
-			// into some sort of proper Either type.
-			manifests := map[types.LayerType]ispec.Descriptor{opts.LayerTypes[0]: ispec.Descriptor{}}
-			if err := buildCache.Put(name, manifests); err != nil {
-				return err
-			}
-			continue
+	var pkgs []InstalledPackage
+	if opts.SBOM != "" {
+		lg.Debugf("scanning the installed packages of %s", name)
+		pkgs, err = scanLayerPackages(opts.Config, s, name)
+		if err != nil {
+			return err
 		}
+	}
+
+	b.outputMu.Lock()
+	defer b.outputMu.Unlock()
+
+	err = s.Repack(name, opts.LayerTypes, b.builtStackerfiles)
+	if err != nil {
+		return err
+	}
 
-		err = s.Repack(name, opts.LayerTypes, b.builtStackerfiles)
+	manifests := map[types.LayerType]ispec.Descriptor{}
+	for _, layerType := range opts.LayerTypes {
+		err = b.updateOCIConfigForOutput(sf, s, oci, layerType, l, name)
 		if err != nil {
 			return err
 		}
 
-		manifests := map[types.LayerType]ispec.Descriptor{}
-		for _, layerType := range opts.LayerTypes {
-			err = b.updateOCIConfigForOutput(sf, s, oci, layerType, l, name)
-			if err != nil {
-				return err
-			}
+		descPaths, err := oci.ResolveReference(context.Background(), layerType.LayerName(name))
+		if err != nil {
+			return err
+		}
 
-			descPaths, err := oci.ResolveReference(context.Background(), layerType.LayerName(name))
-			if err != nil {
-				return err
-			}
+		manifests[layerType] = descPaths[0].Descriptor()
 
-			manifests[layerType] = descPaths[0].Descriptor()
+	}
 
+	if opts.SBOM != "" {
+		err = attachSBOMs(opts.Config, oci, opts.SBOM, l, name, pkgs, manifests)
+		if err != nil {
+			return err
 		}
+	}
 
-		if err := buildCache.Put(name, manifests); err != nil {
+	if opts.Provenance {
+		err = attachProvenance(opts.Config, oci, sf, l, name, opts.Substitute, manifests, started)
+		if err != nil {
 			return err
 		}
+	}
 
-		log.Infof("filesystem %s built successfully", name)
+	if err := buildCache.Put(name, manifests); err != nil {
+		return err
+	}
 
+	err = lm.recordOutputs(oci, name, opts.LayerTypes)
+	if err != nil {
+		return err
 	}
 
-	return oci.GC(context.Background())
+	for _, layerType := range opts.LayerTypes {
+		log.Event("layer-committed", log.Fields{
+			"layer":  name,
+			"tag":    layerType.LayerName(name),
+			"digest": manifests[layerType].Digest.String(),
+		})
+	}
+
+	lg.Infof("filesystem %s built successfully", name)
+	return nil
 }
 
 // BuildMultiple builds a list of stackerfiles
@@ -622,6 +902,17 @@ func (b *Builder) BuildMultiple(paths []string) error {
 		return nil
 	}
 
+	if len(opts.Platforms) > 0 {
+		return b.buildPlatforms(stackerFiles, paths)
+	}
+
+	if opts.CacheFrom != "" {
+		err = ImportCache(opts.Config, b.remoteCacheOpts(opts.CacheFrom))
+		if err != nil {
+			return err
+		}
+	}
+
 	// Build all Stackerfiles
 	for i, p := range sortedPaths {
 		log.Debugf("building: %d %s", i, p)
@@ -632,9 +923,17 @@ func (b *Builder) BuildMultiple(paths []string) error {
 		}
 	}
 
+	if opts.CacheTo != "" {
+		return ExportCache(opts.Config, b.remoteCacheOpts(opts.CacheTo))
+	}
+
 	return nil
 }
 
+func (b *Builder) remoteCacheOpts(ref string) RemoteCacheOpts {
+	return RemoteCacheOpts{Ref: ref, SkipTLS: b.opts.CacheSkipTLS, Progress: b.opts.Progress}
+}
+
 // generateShellForRunning generates a shell script to run inside the
 // container, and writes it to the contianer. It checks that the script already
 // have a shebang? If so, it leaves it as is, otherwise it prepends a shebang.
@@ -747,6 +1046,18 @@ func SetupBuildContainerConfig(config types.StackerConfig, storage types.Storage
 		return err
 	}
 
+	if mounter, ok := storage.(types.RootfsMounter); ok {
+		mount, unmount, err := mounter.LXCRootfsHooks(name)
+		if err != nil {
+			return err
+		}
+
+		err = c.SetConfigs(map[string]string{"lxc.hook.pre-start": mount, "lxc.hook.post-stop": unmount})
+		if err != nil {
+			return err
+		}
+	}
+
 	// liblxc inserts an apparmor profile if we don't set one by default.
 	// however, since we may be statically linked with no packaging
 	// support, the host may not have this default profile. let's check for
@@ -826,5 +1137,44 @@ func SetupLayerConfig(config types.StackerConfig, c *container.Container, l type
 		}
 	}
 
+	for _, device := range l.Devices {
+		rule, err := deviceCgroupRule(device)
+		if err != nil {
+			return err
+		}
+
+		err = c.SetConfig("lxc.cgroup2.devices.allow", rule)
+		if err != nil {
+			return err
+		}
+
+		err = c.BindMount(device.Path, device.DestPath(), "")
+		if err != nil {
+			return err
+		}
+	}
+
 	return err
 }
+
+// deviceCgroupRule is the devices cgroup rule that lets the container use
+// device.
+func deviceCgroupRule(device types.Device) (string, error) {
+	st := unix.Stat_t{}
+	err := unix.Stat(device.Path, &st)
+	if err != nil {
+		return "", errors.Wrapf(err, "couldn't find device %s", device.Path)
+	}
+
+	kind := ""
+	switch st.Mode & unix.S_IFMT {
+	case unix.S_IFCHR:
+		kind = "c"
+	case unix.S_IFBLK:
+		kind = "b"
+	default:
+		return "", errors.Errorf("%s isn't a device", device.Path)
+	}
+
+	return fmt.Sprintf("%s %d:%d %s", kind, unix.Major(st.Rdev), unix.Minor(st.Rdev), device.CgroupPermissions()), nil
+}
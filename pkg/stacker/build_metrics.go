@@ -0,0 +1,294 @@
+package stacker
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dustin/go-humanize"
+	"github.com/opencontainers/umoci/oci/casext"
+	"github.com/pkg/errors"
+	"stackerbuild.io/stacker/pkg/log"
+	stackeroci "stackerbuild.io/stacker/pkg/oci"
+	"stackerbuild.io/stacker/pkg/types"
+)
+
+const (
+	MetricsJSON       = "json"
+	MetricsPrometheus = "prometheus"
+)
+
+// BuildMetrics are where the time of a build or a publish went: how long
+// each layer took, what it downloaded, whether it was cached and how big its
+// images are, and how long each image took to publish. They are safe for
+// concurrent use by layers built in parallel.
+type BuildMetrics struct {
+	mu      sync.Mutex
+	started time.Time
+
+	Seconds float64 `json:"seconds"`
+
+	// CacheHitRatio is the share of Layers that were found in the build
+	// cache.
+	CacheHitRatio float64           `json:"cacheHitRatio"`
+	Layers        []*LayerMetrics   `json:"layers"`
+	Published     []*PublishMetrics `json:"published,omitempty"`
+}
+
+// LayerMetrics are the measurements of a layer that was built. It is also the
+// DownloadMetrics of the layer's imports.
+type LayerMetrics struct {
+	mu sync.Mutex
+
+	Name     string  `json:"name"`
+	Platform string  `json:"platform,omitempty"`
+	Seconds  float64 `json:"seconds"`
+	Cached   bool    `json:"cached"`
+
+	// ImportSeconds is how long getting the layer's imports took,
+	// whether they were downloaded or cached.
+	ImportSeconds float64 `json:"importSeconds"`
+
+	// DownloadedBytes is what was received while downloading the
+	// imports; RemoteImports is how many of them are from servers, and
+	// RemoteImportsCached how many of those were used from the cache.
+	DownloadedBytes     int64 `json:"downloadedBytes"`
+	RemoteImports       int   `json:"remoteImports"`
+	RemoteImportsCached int   `json:"remoteImportsCached"`
+
+	Outputs []OutputMetrics `json:"outputs,omitempty"`
+}
+
+// OutputMetrics are the size of the image of a layer for one layer type.
+type OutputMetrics struct {
+	Tag string `json:"tag"`
+
+	// Size is the size of all the layers of the image, and LayerSize that
+	// of the last one, which this build added.
+	Size      int64 `json:"size"`
+	LayerSize int64 `json:"layerSize"`
+}
+
+// PublishMetrics are how long publishing an image took.
+type PublishMetrics struct {
+	Tag     string  `json:"tag"`
+	Url     string  `json:"url"`
+	Seconds float64 `json:"seconds"`
+}
+
+func NewBuildMetrics() *BuildMetrics {
+	return &BuildMetrics{started: time.Now(), Layers: []*LayerMetrics{}}
+}
+
+// layer returns the metrics of a layer that's starting to be built.
+func (m *BuildMetrics) layer(name string, platform string) *LayerMetrics {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	lm := &LayerMetrics{Name: name, Platform: platform}
+	m.Layers = append(m.Layers, lm)
+	return lm
+}
+
+func (m *BuildMetrics) published(tag string, url string, took time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.Published = append(m.Published, &PublishMetrics{Tag: tag, Url: url, Seconds: took.Seconds()})
+}
+
+// Finish computes the totals, once the build or publish is over.
+func (m *BuildMetrics) Finish() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.Seconds = time.Since(m.started).Seconds()
+	m.CacheHitRatio = 0
+	if len(m.Layers) > 0 {
+		cached := 0
+		for _, lm := range m.Layers {
+			if lm.Cached {
+				cached++
+			}
+		}
+		m.CacheHitRatio = float64(cached) / float64(len(m.Layers))
+	}
+}
+
+// LogSummary logs a line with the totals, and the measurements of each layer
+// at debug level.
+func (m *BuildMetrics) LogSummary() {
+	m.Finish()
+
+	took := time.Duration(m.Seconds * float64(time.Second)).Round(time.Millisecond)
+	if len(m.Layers) > 0 {
+		var downloaded int64
+		for _, lm := range m.Layers {
+			downloaded += lm.DownloadedBytes
+		}
+		log.Infof("built %d layers in %s, %.0f%% cached, %s downloaded", len(m.Layers), took,
+			m.CacheHitRatio*100, humanize.Bytes(uint64(downloaded)))
+	}
+	for _, lm := range m.Layers {
+		log.Debugf("layer %s: %.1fs (imports %.1fs, %d of %d remote ones cached, %s downloaded), cached: %v",
+			lm.Name, lm.Seconds, lm.ImportSeconds, lm.RemoteImportsCached, lm.RemoteImports,
+			humanize.Bytes(uint64(lm.DownloadedBytes)), lm.Cached)
+	}
+	if len(m.Published) > 0 {
+		log.Infof("published %d images in %s", len(m.Published), took)
+	}
+}
+
+// Write writes the metrics to path, as json or as a Prometheus textfile (e.g.
+// for node_exporter's textfile collector), depending on format.
+func (m *BuildMetrics) Write(path string, format string) error {
+	m.Finish()
+
+	var content []byte
+	switch format {
+	case MetricsJSON:
+		var err error
+		content, err = json.MarshalIndent(m, "", "  ")
+		if err != nil {
+			return err
+		}
+		content = append(content, '\n')
+	case MetricsPrometheus:
+		content = m.prometheusText()
+	default:
+		return errors.Errorf("unknown metrics format %s, expected %s or %s", format, MetricsJSON, MetricsPrometheus)
+	}
+
+	// textfile collectors may read it at any time; don't let them see
+	// half of it
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, content, 0644); err != nil {
+		return errors.Wrapf(err, "couldn't write metrics to %s", path)
+	}
+	return errors.Wrapf(os.Rename(tmp, path), "couldn't write metrics to %s", path)
+}
+
+// prometheusLabels formats the labels of a sample, in the order given as
+// name, value pairs.
+func prometheusLabels(pairs ...string) string {
+	labels := []string{}
+	for i := 0; i+1 < len(pairs); i += 2 {
+		if pairs[i+1] == "" {
+			continue
+		}
+		value := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(pairs[i+1])
+		labels = append(labels, fmt.Sprintf(`%s="%s"`, pairs[i], value))
+	}
+	if len(labels) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(labels, ",") + "}"
+}
+
+func (m *BuildMetrics) prometheusText() []byte {
+	out := bytes.Buffer{}
+	metric := func(name string, help string, samples map[string]float64) {
+		if len(samples) == 0 {
+			return
+		}
+		fmt.Fprintf(&out, "# HELP %s %s\n# TYPE %s gauge\n", name, help, name)
+		labels := make([]string, 0, len(samples))
+		for l := range samples {
+			labels = append(labels, l)
+		}
+		sort.Strings(labels)
+		for _, l := range labels {
+			fmt.Fprintf(&out, "%s%s %g\n", name, l, samples[l])
+		}
+	}
+
+	metric("stacker_build_duration_seconds", "How long the build or publish took.",
+		map[string]float64{"": m.Seconds})
+	if len(m.Layers) > 0 {
+		metric("stacker_build_cache_hit_ratio", "The share of the layers that were found in the build cache.",
+			map[string]float64{"": m.CacheHitRatio})
+	}
+
+	seconds, cached, imports, downloaded := map[string]float64{}, map[string]float64{}, map[string]float64{}, map[string]float64{}
+	remote, remoteCached := map[string]float64{}, map[string]float64{}
+	sizes, layerSizes := map[string]float64{}, map[string]float64{}
+	for _, lm := range m.Layers {
+		labels := prometheusLabels("layer", lm.Name, "platform", lm.Platform)
+		seconds[labels] = lm.Seconds
+		cached[labels] = 0
+		if lm.Cached {
+			cached[labels] = 1
+		}
+		imports[labels] = lm.ImportSeconds
+		downloaded[labels] = float64(lm.DownloadedBytes)
+		remote[labels] = float64(lm.RemoteImports)
+		remoteCached[labels] = float64(lm.RemoteImportsCached)
+		for _, output := range lm.Outputs {
+			labels := prometheusLabels("layer", lm.Name, "platform", lm.Platform, "tag", output.Tag)
+			sizes[labels] = float64(output.Size)
+			layerSizes[labels] = float64(output.LayerSize)
+		}
+	}
+	metric("stacker_layer_duration_seconds", "How long building the layer took.", seconds)
+	metric("stacker_layer_cached", "Whether the layer was found in the build cache.", cached)
+	metric("stacker_layer_import_duration_seconds", "How long getting the imports of the layer took.", imports)
+	metric("stacker_layer_download_bytes", "Bytes received while downloading the imports of the layer.", downloaded)
+	metric("stacker_layer_remote_imports", "How many imports of the layer are from servers.", remote)
+	metric("stacker_layer_remote_imports_cached", "How many imports of the layer from servers were used from the cache.", remoteCached)
+	metric("stacker_image_size_bytes", "The size of all the layers of the image.", sizes)
+	metric("stacker_image_layer_size_bytes", "The size of the last layer of the image.", layerSizes)
+
+	published := map[string]float64{}
+	for _, pm := range m.Published {
+		published[prometheusLabels("tag", pm.Tag, "url", pm.Url)] = pm.Seconds
+	}
+	metric("stacker_publish_duration_seconds", "How long publishing the image took.", published)
+
+	return out.Bytes()
+}
+
+// recordOutputs records the sizes of the images of the layer name in oci.
+func (lm *LayerMetrics) recordOutputs(oci casext.Engine, name string, layerTypes []types.LayerType) error {
+	for _, layerType := range layerTypes {
+		tag := layerType.LayerName(name)
+		manifest, err := stackeroci.LookupManifest(oci, tag)
+		if err != nil {
+			return err
+		}
+
+		output := OutputMetrics{Tag: tag}
+		for _, layer := range manifest.Layers {
+			output.Size += layer.Size
+		}
+		if len(manifest.Layers) > 0 {
+			output.LayerSize = manifest.Layers[len(manifest.Layers)-1].Size
+		}
+		lm.Outputs = append(lm.Outputs, output)
+	}
+	return nil
+}
+
+func (lm *LayerMetrics) BytesDownloaded(host string, n int64) {
+	lm.mu.Lock()
+	defer lm.mu.Unlock()
+	lm.DownloadedBytes += n
+}
+
+func (lm *LayerMetrics) DownloadFinished(host string, outcome string, duration time.Duration) {
+	lm.mu.Lock()
+	defer lm.mu.Unlock()
+	lm.RemoteImports++
+}
+
+func (lm *LayerMetrics) CacheHit(host string) {
+	lm.mu.Lock()
+	defer lm.mu.Unlock()
+	lm.RemoteImportsCached++
+}
+
+func (lm *LayerMetrics) Retried(host string) {}
@@ -0,0 +1,61 @@
+package stacker
+
+import (
+	"encoding/json"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBuildMetrics(t *testing.T) {
+	assert := assert.New(t)
+
+	m := NewBuildMetrics()
+	a := m.layer("a", "")
+	a.Cached = true
+	b := m.layer("b", "linux/arm64")
+	b.Seconds = 2.5
+	b.BytesDownloaded("example.com", 1024)
+	b.DownloadFinished("example.com", "ok", time.Second)
+	b.DownloadFinished("example.com", "ok", 0)
+	b.CacheHit("example.com")
+	b.Outputs = []OutputMetrics{{Tag: "b", Size: 300, LayerSize: 100}}
+	m.published("b", `docker://registry/"b"`, 3*time.Second)
+
+	dir := t.TempDir()
+	jsonFile := path.Join(dir, "metrics.json")
+	if !assert.NoError(m.Write(jsonFile, MetricsJSON)) {
+		return
+	}
+	content, err := os.ReadFile(jsonFile)
+	assert.NoError(err)
+	written := BuildMetrics{}
+	assert.NoError(json.Unmarshal(content, &written))
+	assert.Equal(0.5, written.CacheHitRatio)
+	assert.Len(written.Layers, 2)
+	assert.Equal(int64(1024), written.Layers[1].DownloadedBytes)
+	assert.Equal(2, written.Layers[1].RemoteImports)
+	assert.Equal(1, written.Layers[1].RemoteImportsCached)
+	assert.Equal(3.0, written.Published[0].Seconds)
+
+	promFile := path.Join(dir, "stacker.prom")
+	if !assert.NoError(m.Write(promFile, MetricsPrometheus)) {
+		return
+	}
+	content, err = os.ReadFile(promFile)
+	assert.NoError(err)
+	lines := strings.Split(string(content), "\n")
+	assert.Contains(lines, "stacker_build_cache_hit_ratio 0.5")
+	assert.Contains(lines, `stacker_layer_cached{layer="a"} 1`)
+	assert.Contains(lines, `stacker_layer_duration_seconds{layer="b",platform="linux/arm64"} 2.5`)
+	assert.Contains(lines, `stacker_layer_download_bytes{layer="b",platform="linux/arm64"} 1024`)
+	assert.Contains(lines, `stacker_image_layer_size_bytes{layer="b",platform="linux/arm64",tag="b"} 100`)
+	assert.Contains(lines, `stacker_publish_duration_seconds{tag="b",url="docker://registry/\"b\""} 3`)
+	assert.Contains(lines, "# TYPE stacker_layer_cached gauge")
+
+	assert.Error(m.Write(path.Join(dir, "metrics"), "xml"))
+}
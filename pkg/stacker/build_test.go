@@ -0,0 +1,26 @@
+package stacker
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"stackerbuild.io/stacker/pkg/types"
+)
+
+func TestDeviceCgroupRule(t *testing.T) {
+	assert := assert.New(t)
+
+	rule, err := deviceCgroupRule(types.Device{Path: "/dev/null"})
+	assert.NoError(err)
+	assert.Equal("c 1:3 rwm", rule)
+
+	rule, err = deviceCgroupRule(types.Device{Path: "/dev/null", Permissions: "r"})
+	assert.NoError(err)
+	assert.Equal("c 1:3 r", rule)
+
+	_, err = deviceCgroupRule(types.Device{Path: "/dev"})
+	assert.ErrorContains(err, "/dev isn't a device")
+
+	_, err = deviceCgroupRule(types.Device{Path: "/dev/no-such-device"})
+	assert.ErrorContains(err, "couldn't find device")
+}
@@ -10,6 +10,8 @@ import (
 	"os"
 	"path"
 	"reflect"
+	"sync"
+	"time"
 
 	"github.com/mitchellh/hashstructure"
 	ispec "github.com/opencontainers/image-spec/specs-go/v1"
@@ -22,7 +24,7 @@ import (
 	"stackerbuild.io/stacker/pkg/types"
 )
 
-const currentCacheVersion = 14
+const currentCacheVersion = 19
 
 type ImportType int
 
@@ -70,6 +72,17 @@ type CacheEntry struct {
 	// mismatch with the current base layer's CacheEntry, the layer should
 	// be rebuilt.
 	Base string
+
+	// SourceDateEpoch is what the timestamps of the layer were clamped to
+	// when it was built reproducibly. It isn't part of the hash of the
+	// entry, so the hashes of entries from before it was added don't
+	// change; layers built on it compare their own.
+	SourceDateEpoch *time.Time `json:",omitempty" hash:"ignore"`
+
+	// TarCompression is how the tar layers of the layer were compressed.
+	// Entries from before it was added have the zero value, gzip, which is
+	// how theirs were.
+	TarCompression types.TarCompression `hash:"ignore"`
 }
 
 type BuildCache struct {
@@ -77,6 +90,9 @@ type BuildCache struct {
 	Cache   map[string]CacheEntry `json:"cache"`
 	Version int                   `json:"version"`
 	config  types.StackerConfig
+
+	// mu guards Cache while layers are built in parallel.
+	mu sync.RWMutex
 }
 
 type versionCheck struct {
@@ -173,6 +189,14 @@ func walkImport(path string) (*mtree.DirectoryHierarchy, error) {
 	return mtree.Walk(path, nil, mtreeKeywords, nil)
 }
 
+// get returns the cache entry of name, if there is one.
+func (c *BuildCache) get(name string) (CacheEntry, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	ent, ok := c.Cache[name]
+	return ent, ok
+}
+
 func (c *BuildCache) Lookup(name string) (*CacheEntry, bool, error) {
 	l, ok := c.sfm.LookupLayerDefinition(name)
 
@@ -180,7 +204,7 @@ func (c *BuildCache) Lookup(name string) (*CacheEntry, bool, error) {
 		return nil, false, nil
 	}
 
-	result, ok := c.Cache[name]
+	result, ok := c.get(name)
 	if !ok {
 		// cache miss because the layer was not previously found. we
 		// don't log a message here because it's probably not found
@@ -206,6 +230,16 @@ func (c *BuildCache) Lookup(name string) (*CacheEntry, bool, error) {
 		return nil, false, nil
 	}
 
+	if !sameSourceDateEpoch(result.SourceDateEpoch, c.config.SourceDateEpoch) {
+		log.Infof("cache miss because SOURCE_DATE_EPOCH was changed")
+		return nil, false, nil
+	}
+
+	if result.TarCompression.String() != c.config.TarCompression.String() {
+		log.Infof("cache miss because tar layer compression was changed from %s", result.TarCompression)
+		return nil, false, nil
+	}
+
 	for _, imp := range l.Imports {
 		if imp.Dest != "" {
 			// ignore imports which are copied
@@ -218,7 +252,7 @@ func (c *BuildCache) Lookup(name string) (*CacheEntry, bool, error) {
 			return nil, false, nil
 		}
 
-		fname := path.Base(imp.Path)
+		fname := importBaseName(imp.Path)
 		importsDir := path.Join(c.config.StackerDir, "imports")
 		diskPath := path.Join(importsDir, name, fname)
 		st, err := os.Stat(diskPath)
@@ -390,6 +424,16 @@ func getEncodedMtree(path string) (string, error) {
 	return base64.StdEncoding.EncodeToString(buf.Bytes()), nil
 }
 
+// sameSourceDateEpoch returns true if a layer whose timestamps were clamped to
+// a (or not, if it is nil) has the timestamps a build clamping them to b would
+// give it.
+func sameSourceDateEpoch(a *time.Time, b *time.Time) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return a.Equal(*b)
+}
+
 // getBaseHash returns some kind of "hash" for the base layer, whatever type it
 // may be.
 func (c *BuildCache) getBaseHash(name string) (string, error) {
@@ -423,6 +467,8 @@ func (c *BuildCache) getBaseHash(name string) (string, error) {
 		cacheDir := path.Join(c.config.StackerDir, "layer-bases")
 		tar := path.Join(cacheDir, path.Base(l.From.Url))
 		return lib.HashFile(tar, true)
+	case types.DockerArchiveLayer, types.OCIArchiveLayer:
+		fallthrough
 	case types.OCILayer:
 		fallthrough
 	case types.DockerLayer:
@@ -471,6 +517,9 @@ func (c *BuildCache) Put(name string, manifests map[types.LayerType]ispec.Descri
 		Name:        name,
 		Layer:       l,
 		Base:        baseHash,
+
+		SourceDateEpoch: c.config.SourceDateEpoch,
+		TarCompression:  c.config.TarCompression,
 	}
 
 	for _, imp := range l.Imports {
@@ -479,7 +528,7 @@ func (c *BuildCache) Put(name string, manifests map[types.LayerType]ispec.Descri
 			continue
 		}
 
-		fname := path.Base(imp.Path)
+		fname := importBaseName(imp.Path)
 		importsDir := path.Join(c.config.StackerDir, "imports")
 		diskPath := path.Join(importsDir, name, fname)
 		st, err := os.Stat(diskPath)
@@ -514,6 +563,8 @@ func (c *BuildCache) Put(name string, manifests map[types.LayerType]ispec.Descri
 		ent.OverlayDirs[overlayDir.Source] = odh
 	}
 
+	c.mu.Lock()
+	defer c.mu.Unlock()
 	c.Cache[name] = ent
 	return c.persist()
 }
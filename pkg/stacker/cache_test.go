@@ -125,5 +125,29 @@ func TestCacheEntryChanged(t *testing.T) {
 	// This test works because the type information is included in the
 	// hashstructure hash above, so using a zero valued CacheEntry is
 	// enough to capture changes in types.
-	assert.Equal(uint64(0xa26696f335211127), h)
+	assert.Equal(uint64(0x715e4497e4a56b49), h)
+}
+
+func TestCacheEntryHashesSecurity(t *testing.T) {
+	assert := assert.New(t)
+
+	// layers built on one whose run sections ran with another seccomp
+	// profile or other capabilities must be rebuilt too
+	h, err := hashstructure.Hash(CacheEntry{}, nil)
+	assert.NoError(err)
+	secure, err := hashstructure.Hash(CacheEntry{Layer: types.Layer{Security: types.Security{Capabilities: []string{"chown"}}}}, nil)
+	assert.NoError(err)
+	assert.NotEqual(h, secure)
+}
+
+func TestCacheEntryHashesDevices(t *testing.T) {
+	assert := assert.New(t)
+
+	// like binds, the devices a layer's run sections had decide what
+	// they built
+	h, err := hashstructure.Hash(CacheEntry{}, nil)
+	assert.NoError(err)
+	withDevices, err := hashstructure.Hash(CacheEntry{Layer: types.Layer{Devices: types.Devices{{Path: "/dev/fuse"}}}}, nil)
+	assert.NoError(err)
+	assert.NotEqual(h, withDevices)
 }
@@ -0,0 +1,63 @@
+package stacker
+
+import (
+	"os"
+	"sync"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+// checkedCacheDirs are the dirs checkCacheDir found usable, so that they are
+// only checked once per build. Dirs that weren't are checked again, since
+// whatever was wrong with them may have been fixed in the meantime.
+var checkedCacheDirs sync.Map
+
+// checkCacheDir makes sure files can be written to dir, returning an error
+// that says why not otherwise; rather than failing later, in the middle of a
+// download, with a bare errno.
+func checkCacheDir(dir string) error {
+	if _, ok := checkedCacheDirs.Load(dir); ok {
+		return nil
+	}
+
+	err := probeCacheDir(dir)
+	if err != nil {
+		return err
+	}
+
+	checkedCacheDirs.Store(dir, true)
+	return nil
+}
+
+func probeCacheDir(dir string) error {
+	var st unix.Statfs_t
+	err := unix.Statfs(dir, &st)
+	if err != nil {
+		return errors.Wrapf(err, "couldn't stat cache filesystem of %s", dir)
+	}
+
+	if st.Flags&unix.ST_RDONLY != 0 {
+		return errors.Errorf("cache directory %s is read-only", dir)
+	}
+
+	if st.Bavail == 0 {
+		return errors.Errorf("cache filesystem of %s is full", dir)
+	}
+
+	f, err := os.CreateTemp(dir, ".stacker-write-check-")
+	if err != nil {
+		switch {
+		case errors.Is(err, unix.EROFS):
+			return errors.Errorf("cache directory %s is read-only", dir)
+		case errors.Is(err, unix.ENOSPC), errors.Is(err, unix.EDQUOT):
+			return errors.Errorf("cache filesystem of %s is full", dir)
+		case errors.Is(err, unix.EACCES), errors.Is(err, unix.EPERM):
+			return errors.Errorf("cache directory %s is not writable by uid %d", dir, os.Geteuid())
+		}
+		return errors.Wrapf(err, "couldn't write to cache directory %s", dir)
+	}
+	f.Close()
+
+	return errors.WithStack(os.Remove(f.Name()))
+}
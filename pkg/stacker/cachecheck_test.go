@@ -0,0 +1,65 @@
+package stacker
+
+import (
+	"net/http"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCheckCacheDir(t *testing.T) {
+	assert := assert.New(t)
+
+	dir := path.Join(t.TempDir(), "cache")
+	assert.ErrorContains(checkCacheDir(dir), "couldn't stat cache filesystem")
+
+	// a failure isn't kept: the dir is checked again once it's fixed...
+	assert.NoError(os.Mkdir(dir, 0755))
+	assert.NoError(checkCacheDir(dir))
+
+	// ...but success is, so that it isn't checked for every file
+	assert.NoError(os.Remove(dir))
+	assert.NoError(checkCacheDir(dir))
+}
+
+func TestCheckCacheCorrupted(t *testing.T) {
+	assert := assert.New(t)
+
+	gets := 0
+	srv := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet {
+			gets++
+		}
+		w.Write([]byte("hello world"))
+	})
+
+	url := srv.URL + "/file"
+	opts := DownloadOptions{Uid: os.Getuid(), Gid: os.Getgid(), ChecksumOptions: ChecksumOptions{
+		// sha256 of "hello world"
+		ExpectedHash: "b94d27b9934d3e08a52e52d7da7dabfac484efe37a5380ee9088f7ace2efcde9",
+	}}
+	name, err := DownloadWithOptions(t.TempDir(), url, opts)
+	assert.NoError(err)
+
+	c, err := checkCache(name, url, true, opts)
+	assert.NoError(err)
+	assert.True(c.cached)
+
+	// a cached copy that was corrupted in place is not used, even though
+	// it has the same size...
+	assert.NoError(os.WriteFile(name, []byte("hello wOrld"), 0644))
+	c, err = checkCache(name, url, true, opts)
+	assert.NoError(err)
+	assert.False(c.cached)
+	assert.Equal("cached copy doesn't match its pinned checksum", c.why)
+
+	// ...but downloaded again
+	name, err = DownloadWithOptions(path.Dir(name), url, opts)
+	assert.NoError(err)
+	assert.Equal(2, gets)
+	content, err := os.ReadFile(name)
+	assert.NoError(err)
+	assert.Equal("hello world", string(content))
+}
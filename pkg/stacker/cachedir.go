@@ -0,0 +1,41 @@
+package stacker
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// defaultCacheDirEnv names the environment variable overriding where
+// DefaultCacheDir is.
+const defaultCacheDirEnv = "STACKER_CACHE"
+
+// DefaultCacheDir returns the download cache dir for callers that aren't given
+// one: $STACKER_CACHE if it is set, else stacker under $XDG_CACHE_HOME, else
+// ~/.cache/stacker. Per the XDG spec, a relative $XDG_CACHE_HOME is ignored.
+// The dir is created, only accessible to its owner, if it doesn't exist yet;
+// if that fails the dir is still returned, and downloading into it will
+// report why.
+func DefaultCacheDir() string {
+	dir := defaultCacheDir()
+	if err := createCacheDir(dir, 0700); err != nil {
+		netLog.Warnf("couldn't create cache dir %s: %v", dir, err)
+	}
+	return dir
+}
+
+func defaultCacheDir() string {
+	if dir := os.Getenv(defaultCacheDirEnv); dir != "" {
+		return dir
+	}
+
+	if xdg := os.Getenv("XDG_CACHE_HOME"); filepath.IsAbs(xdg) {
+		return filepath.Join(xdg, "stacker")
+	}
+
+	home, err := os.UserHomeDir()
+	if err != nil {
+		// nowhere better to put it
+		return filepath.Join(os.TempDir(), "stacker-cache")
+	}
+	return filepath.Join(home, ".cache", "stacker")
+}
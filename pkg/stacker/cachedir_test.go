@@ -0,0 +1,37 @@
+package stacker
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDefaultCacheDir(t *testing.T) {
+	assert := assert.New(t)
+
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	t.Setenv(defaultCacheDirEnv, "")
+	t.Setenv("XDG_CACHE_HOME", "")
+
+	dir := DefaultCacheDir()
+	assert.Equal(filepath.Join(home, ".cache", "stacker"), dir)
+	fi, err := os.Stat(dir)
+	assert.NoError(err)
+	assert.Equal(os.FileMode(0700), fi.Mode().Perm())
+
+	// relative XDG_CACHE_HOMEs are ignored
+	t.Setenv("XDG_CACHE_HOME", "relative")
+	assert.Equal(filepath.Join(home, ".cache", "stacker"), DefaultCacheDir())
+
+	xdg := t.TempDir()
+	t.Setenv("XDG_CACHE_HOME", xdg)
+	assert.Equal(filepath.Join(xdg, "stacker"), DefaultCacheDir())
+
+	override := filepath.Join(t.TempDir(), "cache")
+	t.Setenv(defaultCacheDirEnv, override)
+	assert.Equal(override, DefaultCacheDir())
+	assert.DirExists(override)
+}
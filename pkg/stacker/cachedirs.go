@@ -0,0 +1,44 @@
+package stacker
+
+import (
+	"os"
+	"path"
+
+	"github.com/pkg/errors"
+	"stackerbuild.io/stacker/pkg/container"
+	"stackerbuild.io/stacker/pkg/log"
+	"stackerbuild.io/stacker/pkg/types"
+)
+
+// cacheDirsDir is where the cache dirs of layers are kept in the stacker dir,
+// each in the directory named by its ID.
+const cacheDirsDir = "cache-dirs"
+
+// setupCacheDirs mounts the cacheDirs of the layer name into c, for its run
+// section. The mountpoints that are created for them are returned, to be
+// removed from the layer once it ran.
+func setupCacheDirs(config types.StackerConfig, c *container.Container, s types.Storage, name string, cacheDirs types.CacheDirs) (*mountpoints, error) {
+	m := &mountpoints{upperDir: s.TarExtractLocation(name)}
+
+	for _, cd := range cacheDirs {
+		source := cd.Source
+		if source == "" {
+			source = path.Join(config.StackerDir, cacheDirsDir, cd.CacheID())
+		}
+
+		err := os.MkdirAll(source, 0755)
+		if err != nil {
+			return nil, errors.Wrapf(err, "couldn't create cache dir %s", source)
+		}
+
+		m.record(cd.Dest)
+		err = c.BindMount(source, cd.Dest, "")
+		if err != nil {
+			m.remove("cache dir")
+			return nil, err
+		}
+		log.Debugf("mounting cache dir %s at %s", source, cd.Dest)
+	}
+
+	return m, nil
+}
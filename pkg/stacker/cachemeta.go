@@ -0,0 +1,348 @@
+package stacker
+
+import (
+	"encoding/json"
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// metaDirName is the directory inside a download cache dir that holds the
+// sidecar files (signatures, metadata) describing the cached files. It is
+// kept out of the way so that the cache dir itself only contains imports.
+const metaDirName = ".stacker-meta"
+
+// sidecarPath returns where the sidecar with extension ext of the cached file
+// name lives.
+func sidecarPath(name string, ext string) string {
+	return path.Join(path.Dir(name), metaDirName, path.Base(name)+ext)
+}
+
+// createSidecar creates (or truncates) the sidecar with extension ext of the
+// cached file name.
+func createSidecar(name string, ext string, opts DownloadOptions) (*os.File, error) {
+	err := createCacheDir(path.Join(path.Dir(name), metaDirName), opts.DirMode)
+	if err != nil {
+		return nil, err
+	}
+
+	return createCacheFile(sidecarPath(name, ext), os.O_RDWR|os.O_TRUNC, opts.SidecarMode)
+}
+
+// partialExt is the sidecar extension of files that are being downloaded.
+const partialExt = ".partial"
+
+// removeSidecars removes all the sidecars of the cached file name.
+func removeSidecars(name string) error {
+	matches, err := fs.Glob(os.DirFS(path.Join(path.Dir(name), metaDirName)), path.Base(name)+".*")
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	for _, m := range matches {
+		err = os.RemoveAll(path.Join(path.Dir(name), metaDirName, m))
+		if err != nil {
+			return errors.WithStack(err)
+		}
+	}
+
+	return nil
+}
+
+// cacheMeta is what we know about a cached file beyond its content.
+type cacheMeta struct {
+	// Source is where the cached file came from.
+	Source string `json:"source"`
+
+	// FinalURL is where Source redirected to, i.e. where the cached file
+	// was actually downloaded from; empty if it didn't redirect.
+	FinalURL string `json:"final_url,omitempty"`
+
+	// Layers is, for files imported from an OCI image, the digests of the
+	// layer the file was found in and of all the layers above it.
+	Layers []string `json:"layers,omitempty"`
+
+	// Commit is, for git imports, the commit the cached tree was checked
+	// out at.
+	Commit string `json:"commit,omitempty"`
+
+	// Range is, for slices of files (see DownloadOptions.Range), the
+	// byte range that was downloaded.
+	Range string `json:"range,omitempty"`
+
+	// Digest is the sha256 of the cached file when it was last verified,
+	// at VerifiedAt.
+	Digest     string    `json:"digest,omitempty"`
+	VerifiedAt time.Time `json:"verified_at"`
+
+	// Size and ModTime are those of the cached file when Digest was
+	// recorded; as long as they are unchanged, Digest is trusted without
+	// re-hashing the file (see cachedDigest).
+	Size    int64     `json:"size,omitempty"`
+	ModTime time.Time `json:"mod_time"`
+
+	// UncompressedDigest is the sha256 of the decompressed content of the
+	// cached file, recorded along with Digest.
+	UncompressedDigest string `json:"uncompressed_digest,omitempty"`
+
+	// ExpiresAt is when the cached file becomes stale, if it was
+	// downloaded with a TTL.
+	ExpiresAt time.Time `json:"expires_at"`
+
+	// ETag and LastModified are the validators the server sent with the
+	// cached file.
+	ETag         string `json:"etag,omitempty"`
+	LastModified string `json:"last_modified,omitempty"`
+}
+
+const cacheMetaExt = ".json"
+
+// describes returns true if meta was recorded for the cached copy of url that
+// is still there, unchanged, as fi.
+func (meta cacheMeta) describes(url string, fi os.FileInfo) bool {
+	return meta.Source == url && meta.Size == fi.Size() && meta.ModTime.Equal(fi.ModTime())
+}
+
+// readCacheMeta returns the metadata of the cached file name; if there is
+// none, it returns an empty cacheMeta.
+func readCacheMeta(name string) (cacheMeta, error) {
+	meta := cacheMeta{}
+
+	content, err := os.ReadFile(sidecarPath(name, cacheMetaExt))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return meta, nil
+		}
+		return meta, errors.WithStack(err)
+	}
+
+	err = json.Unmarshal(content, &meta)
+	if err != nil {
+		return cacheMeta{}, errors.Wrapf(err, "couldn't parse cache metadata of %s", name)
+	}
+
+	return meta, nil
+}
+
+func writeCacheMeta(name string, meta cacheMeta, opts DownloadOptions) error {
+	content, err := json.Marshal(meta)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	f, err := createSidecar(name, cacheMetaExt, opts)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = f.Write(content)
+	return errors.Wrapf(err, "couldn't write cache metadata of %s", name)
+}
+
+// recordVerified notes in name's metadata that it was downloaded from url and
+// has just been verified.
+func recordVerified(name string, url string, opts DownloadOptions) error {
+	hash, err := sha256File(name)
+	if err != nil {
+		return err
+	}
+
+	meta, err := readCacheMeta(name)
+	if err != nil {
+		return err
+	}
+
+	meta.Source = url
+	meta.Digest = hash
+	return recordDigest(name, meta, opts)
+}
+
+// recordDigest writes meta, whose Digest has just been verified to be that of
+// name, stamping it with name's current size and mtime.
+func recordDigest(name string, meta cacheMeta, opts DownloadOptions) error {
+	fi, err := os.Stat(name)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	meta.VerifiedAt = time.Now()
+	meta.Size = fi.Size()
+	meta.ModTime = fi.ModTime()
+	return writeCacheMeta(name, meta, opts)
+}
+
+// cachedDigest returns the (hex encoded) sha256 of the cached copy name of
+// url. The digest recorded in name's metadata is used if name's size and mtime
+// are unchanged since it was recorded; the file is only hashed if they
+// changed, or if opts.VerifyOnRead asks for every read to be verified.
+func cachedDigest(name string, url string, opts DownloadOptions) (string, error) {
+	if !opts.VerifyOnRead {
+		meta, err := readCacheMeta(name)
+		if err != nil {
+			return "", err
+		}
+
+		fi, err := os.Stat(name)
+		if err != nil {
+			return "", errors.WithStack(err)
+		}
+
+		if meta.Digest != "" && meta.describes(url, fi) {
+			netLog.Debugf("%s unchanged since it was hashed, using recorded digest %s", name, meta.Digest)
+			return meta.Digest, nil
+		}
+	}
+
+	return sha256File(name)
+}
+
+// recheckCache returns true if the cached name can still be used, re-hashing
+// it first if it was last verified more than opts.RecheckInterval ago. Entries
+// that no longer match their recorded digest are removed.
+func recheckCache(name string, url string, opts DownloadOptions) (bool, error) {
+	meta, err := readCacheMeta(name)
+	if err != nil {
+		return false, err
+	}
+
+	if meta.Digest != "" && meta.Source == url && time.Since(meta.VerifiedAt) < opts.RecheckInterval {
+		return true, nil
+	}
+
+	if meta.Digest != "" && meta.Source == url {
+		hash, err := sha256File(name)
+		if err != nil {
+			return false, err
+		}
+
+		if hash != meta.Digest {
+			netLog.Warnf("cached copy of %s changed since it was downloaded (%s != %s), downloading it again",
+				url, hash, meta.Digest)
+			return false, errors.WithStack(os.RemoveAll(name))
+		}
+
+		return true, recordDigest(name, meta, opts)
+	}
+
+	// nothing recorded yet (or recorded for a different url): trust what we
+	// have now, it was validated by cacheIsValid
+	return true, recordVerified(name, url, opts)
+}
+
+// recordFetched notes what we know about the freshly downloaded name in its
+// metadata.
+func recordFetched(name string, url string, result fetchResult, opts DownloadOptions) error {
+	meta, err := readCacheMeta(name)
+	if err != nil {
+		return err
+	}
+
+	meta.Source = url
+	meta.ETag = result.etag
+	meta.LastModified = result.lastModified
+	meta.FinalURL = ""
+	if result.finalURL != url {
+		meta.FinalURL = result.finalURL
+	}
+	// fetchTo just checked the download against it
+	meta.UncompressedDigest = opts.ExpectedUncompressedHash
+	meta.ExpiresAt = time.Time{}
+	if opts.TTL != 0 {
+		meta.ExpiresAt = time.Now().Add(opts.TTL)
+	}
+
+	switch {
+	case opts.RecheckInterval != 0:
+		err = writeCacheMeta(name, meta, opts)
+		if err != nil {
+			return err
+		}
+		return recordVerified(name, url, opts)
+	case opts.ExpectedHash != "" && !opts.CacheUncompressed:
+		meta.Digest = opts.ExpectedHash
+		return recordDigest(name, meta, opts)
+	case meta.UncompressedDigest != "":
+		meta.Digest = ""
+		return recordDigest(name, meta, opts)
+	case result.etag == "" && result.lastModified == "" && meta.Digest == "" && meta.FinalURL == "" && opts.TTL == 0:
+		// nothing to record, but what was recorded is of the previous
+		// download, maybe of another url
+		return errors.WithStack(os.RemoveAll(sidecarPath(name, cacheMetaExt)))
+	}
+
+	// whatever digest was recorded is that of the previous download
+	meta.Digest = ""
+	return writeCacheMeta(name, meta, opts)
+}
+
+// cacheExpired returns true if the cached copy name of url has outlived the
+// TTL it was downloaded with. Copies downloaded without a TTL are considered
+// expired, so that they get one.
+func cacheExpired(name string, url string) (bool, error) {
+	meta, err := readCacheMeta(name)
+	if err != nil {
+		return false, err
+	}
+
+	return meta.Source != url || meta.ExpiresAt.IsZero() || time.Now().After(meta.ExpiresAt), nil
+}
+
+// renewExpiry restarts the TTL of the cached name, after the server confirmed
+// it is still current.
+func renewExpiry(name string, opts DownloadOptions) error {
+	if opts.TTL == 0 {
+		return nil
+	}
+
+	meta, err := readCacheMeta(name)
+	if err != nil {
+		return err
+	}
+
+	meta.ExpiresAt = time.Now().Add(opts.TTL)
+	return writeCacheMeta(name, meta, opts)
+}
+
+// validatorsUnchanged returns true if the validators the server just reported
+// for url (opts.RemoteETag, or else opts.RemoteLastModified) are those it sent
+// with the cached copy name. Weak ETags aren't compared, see cachedValidators.
+func validatorsUnchanged(name string, url string, opts DownloadOptions) (bool, error) {
+	meta, err := readCacheMeta(name)
+	if err != nil || meta.Source != url {
+		return false, err
+	}
+
+	if meta.ETag != "" && opts.RemoteETag != "" && !strings.HasPrefix(meta.ETag, "W/") {
+		return meta.ETag == opts.RemoteETag, nil
+	}
+
+	return meta.LastModified != "" && meta.LastModified == opts.RemoteLastModified, nil
+}
+
+// cachedValidators returns the headers making a request for url conditional
+// on the cached name having changed. Both validators are sent per RFC 7232,
+// servers that understand If-None-Match then ignore If-Modified-Since. Weak
+// ETags only promise semantically equivalent content, not the same bytes, so
+// they aren't used; we fall back on Last-Modified instead.
+func cachedValidators(name string, url string) (http.Header, error) {
+	meta, err := readCacheMeta(name)
+	if err != nil || meta.Source != url {
+		return nil, err
+	}
+
+	validators := http.Header{}
+	if meta.ETag != "" && !strings.HasPrefix(meta.ETag, "W/") {
+		validators.Set("If-None-Match", meta.ETag)
+	}
+	if meta.LastModified != "" {
+		validators.Set("If-Modified-Since", meta.LastModified)
+	}
+
+	return validators, nil
+}
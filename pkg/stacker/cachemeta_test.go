@@ -0,0 +1,232 @@
+package stacker
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/minio/sha256-simd"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCachedDigest(t *testing.T) {
+	assert := assert.New(t)
+
+	dir := t.TempDir()
+	url := "https://example.com/foo"
+	opts := DownloadOptions{
+		Uid: os.Getuid(),
+		Gid: os.Getgid(),
+		ChecksumOptions: ChecksumOptions{
+			// sha256 of "hello world"
+			ExpectedHash: "b94d27b9934d3e08a52e52d7da7dabfac484efe37a5380ee9088f7ace2efcde9",
+		},
+		TransportOptions: TransportOptions{
+			Transport: &fakeTransport{body: "hello world"},
+		},
+	}
+
+	name, err := DownloadWithOptions(dir, url, opts)
+	assert.NoError(err)
+
+	// same size and mtime: the recorded digest is trusted
+	fi, err := os.Stat(name)
+	assert.NoError(err)
+	assert.NoError(os.WriteFile(name, []byte("hello wOrld"), 0644))
+	assert.NoError(os.Chtimes(name, fi.ModTime(), fi.ModTime()))
+
+	digest, err := cachedDigest(name, url, opts)
+	assert.NoError(err)
+	assert.Equal(opts.ExpectedHash, digest)
+
+	opts.VerifyOnRead = true
+	digest, err = cachedDigest(name, url, opts)
+	assert.NoError(err)
+	assert.NotEqual(opts.ExpectedHash, digest)
+
+	opts.VerifyOnRead = false
+	assert.NoError(os.Chtimes(name, fi.ModTime(), fi.ModTime().Add(time.Second)))
+	digest, err = cachedDigest(name, url, opts)
+	assert.NoError(err)
+	assert.NotEqual(opts.ExpectedHash, digest)
+}
+
+func TestCachedValidators(t *testing.T) {
+	const lastModified = "Wed, 21 Oct 2015 07:28:00 GMT"
+
+	for _, tc := range []struct {
+		name              string
+		etag              string
+		lastModified      string
+		source            string
+		ifNoneMatch       string
+		ifModifiedSince   string
+		expectNoValidator bool
+	}{
+		{name: "none", expectNoValidator: true},
+		{name: "strong etag", etag: `"v1"`, ifNoneMatch: `"v1"`},
+		{name: "weak etag", etag: `W/"v1"`, expectNoValidator: true},
+		{name: "last modified", lastModified: lastModified, ifModifiedSince: lastModified},
+		{name: "both", etag: `"v1"`, lastModified: lastModified, ifNoneMatch: `"v1"`, ifModifiedSince: lastModified},
+		{name: "weak etag and last modified", etag: `W/"v1"`, lastModified: lastModified, ifModifiedSince: lastModified},
+		{name: "other source", etag: `"v1"`, source: "https://example.com/bar", expectNoValidator: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			assert := assert.New(t)
+
+			dir := t.TempDir()
+			name := path.Join(dir, "foo")
+
+			source := tc.source
+			if source == "" {
+				source = "https://example.com/foo"
+			}
+			err := writeCacheMeta(name, cacheMeta{Source: source, ETag: tc.etag, LastModified: tc.lastModified}, DownloadOptions{})
+			assert.NoError(err)
+
+			validators, err := cachedValidators(name, "https://example.com/foo")
+			assert.NoError(err)
+			if tc.expectNoValidator {
+				assert.Empty(validators)
+				return
+			}
+			assert.Equal(tc.ifNoneMatch, validators.Get("If-None-Match"))
+			assert.Equal(tc.ifModifiedSince, validators.Get("If-Modified-Since"))
+		})
+	}
+}
+
+func TestDownloadRevalidate(t *testing.T) {
+	assert := assert.New(t)
+
+	content := "v1"
+	srv := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		etag := fmt.Sprintf(`"%s"`, content)
+		w.Header().Set("ETag", etag)
+		if r.Header.Get("If-None-Match") == etag {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Write([]byte(content))
+	})
+
+	dir := t.TempDir()
+	opts := DownloadOptions{Uid: os.Getuid(), Gid: os.Getgid(), CacheOptions: CacheOptions{Revalidate: true}}
+
+	for _, v := range []string{"v1", "v1", "v2"} {
+		content = v
+
+		name, err := DownloadWithOptions(dir, srv.URL+"/foo", opts)
+		assert.NoError(err)
+
+		cached, err := os.ReadFile(name)
+		assert.NoError(err)
+		assert.Equal(v, string(cached))
+	}
+}
+
+func TestDownloadRemoteValidators(t *testing.T) {
+	assert := assert.New(t)
+
+	requests := 0
+	srv := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.Header().Set("ETag", `"v1"`)
+		w.Header().Set("Last-Modified", "Mon, 02 Jan 2006 15:04:05 GMT")
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Write([]byte("v1"))
+	})
+
+	dir := t.TempDir()
+	url := srv.URL + "/foo"
+	_, err := DownloadWithOptions(dir, url, DownloadOptions{CacheOptions: CacheOptions{Revalidate: true}})
+	assert.NoError(err)
+	assert.Equal(1, requests)
+
+	info, err := FileInfo(context.Background(), url)
+	assert.NoError(err)
+	assert.Equal(2, requests)
+
+	// what the server just said is what the cached copy has, no need to ask again
+	opts := DownloadOptions{CacheOptions: CacheOptions{Revalidate: true, RemoteETag: info.ETag, RemoteLastModified: info.LastModified}}
+	_, err = DownloadWithOptions(dir, url, opts)
+	assert.NoError(err)
+	assert.Equal(2, requests)
+
+	// a different ETag makes it ask
+	opts.RemoteETag = `"v2"`
+	_, err = DownloadWithOptions(dir, url, opts)
+	assert.NoError(err)
+	assert.Equal(3, requests)
+
+	// without an ETag, Last-Modified decides
+	opts = DownloadOptions{CacheOptions: CacheOptions{Revalidate: true, RemoteLastModified: info.LastModified}}
+	_, err = DownloadWithOptions(dir, url, opts)
+	assert.NoError(err)
+	assert.Equal(3, requests)
+}
+
+func TestDownloadRecheck(t *testing.T) {
+	assert := assert.New(t)
+
+	content := "hello world"
+	gets := 0
+	srv := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet {
+			gets++
+		}
+		w.Write([]byte(content))
+	})
+
+	cacheDir := t.TempDir()
+	url := srv.URL + "/file"
+	opts := DownloadOptions{Uid: os.Getuid(), Gid: os.Getgid(), CacheOptions: CacheOptions{RecheckInterval: time.Hour}}
+	download := func(expected string) string {
+		name, err := DownloadWithOptions(cacheDir, url, opts)
+		assert.NoError(err)
+		got, err := os.ReadFile(name)
+		assert.NoError(err)
+		assert.Equal(expected, string(got))
+		return name
+	}
+
+	name := download("hello world")
+	assert.Equal(1, gets)
+
+	// within the interval the cached copy is trusted as it is
+	assert.NoError(os.WriteFile(name, []byte("hello wOrld"), 0644))
+	download("hello wOrld")
+	assert.Equal(1, gets)
+
+	// past it, it is re-hashed, and downloaded again if it changed
+	meta, err := readCacheMeta(name)
+	assert.NoError(err)
+	meta.VerifiedAt = time.Now().Add(-2 * time.Hour)
+	assert.NoError(writeCacheMeta(name, meta, opts))
+	download("hello world")
+	assert.Equal(2, gets)
+
+	meta, err = readCacheMeta(name)
+	assert.NoError(err)
+	assert.Equal("b94d27b9934d3e08a52e52d7da7dabfac484efe37a5380ee9088f7ace2efcde9", meta.Digest)
+	assert.WithinDuration(time.Now(), meta.VerifiedAt, time.Minute)
+
+	// and a copy the server says changed upstream is downloaded again
+	// and recorded as verified afresh
+	content = "HOWDY, world"
+	opts.RemoteHash = fmt.Sprintf("%x", sha256.Sum256([]byte(content)))
+	opts.RemoteSize = "12"
+	download("HOWDY, world")
+	assert.Equal(3, gets)
+
+	meta, err = readCacheMeta(name)
+	assert.NoError(err)
+	assert.Equal(opts.RemoteHash, meta.Digest)
+}
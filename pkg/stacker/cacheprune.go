@@ -0,0 +1,253 @@
+package stacker
+
+import (
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// usedExt is the sidecar extension of the empty file whose mtime is when the
+// cached file was last used, for PruneCache. A sidecar is used rather than
+// the file's atime, which most filesystems are mounted not to keep up to date.
+const usedExt = ".used"
+
+// markUsed notes that the cached name was just used. It is best effort: a
+// cache that can't be written to just isn't pruned as accurately.
+func markUsed(name string, opts DownloadOptions) {
+	now := time.Now()
+	err := os.Chtimes(sidecarPath(name, usedExt), now, now)
+	if os.IsNotExist(err) {
+		var f *os.File
+		f, err = createSidecar(name, usedExt, opts)
+		if err == nil {
+			f.Close()
+		}
+	}
+	if err != nil {
+		netLog.Debugf("couldn't note that %s was used: %v", name, err)
+	}
+}
+
+// lastUsed returns when the cached name was last used: when it was marked
+// used, or else when it was last modified.
+func lastUsed(name string, fi os.FileInfo) time.Time {
+	used, err := os.Stat(sidecarPath(name, usedExt))
+	if err != nil {
+		return fi.ModTime()
+	}
+	return used.ModTime()
+}
+
+// PruneOptions are how PruneCache decides what to remove.
+type PruneOptions struct {
+	// MaxAge, if set, removes the entries that haven't been used for
+	// longer than that.
+	MaxAge time.Duration
+
+	// MaxSize, if set, is how many bytes the entries may take in all; the
+	// least recently used ones are removed until they fit.
+	MaxSize int64
+
+	// DryRun only reports what would be removed.
+	DryRun bool
+}
+
+// PruneResult is an entry PruneCache removed (or, with DryRun, would have).
+type PruneResult struct {
+	Path     string
+	Size     int64
+	LastUsed time.Time
+	// Reason is "age" or "size", the policy that removed the entry, or
+	// "unreferenced" for cached content no url points at anymore.
+	Reason string
+}
+
+// cacheEntry is a file, or a directory imported as a whole, in a cache dir.
+type cacheEntry struct {
+	path     string
+	size     int64
+	lastUsed time.Time
+
+	// also are removed along with path, e.g. the blob a cached file is
+	// linked to (see contentstore.go)
+	also []string
+
+	// unreferenced entries are always removed
+	unreferenced bool
+}
+
+// PruneCache removes the entries of the cache dirs that opts says are stale,
+// along with their sidecars, and returns them. Each of dirs is a single cache
+// dir, e.g. that of one layer's imports: its entries are the files and
+// directories directly in it, and the content kept for urls whose cached file
+// was replaced (see contentstore.go).
+func PruneCache(dirs []string, opts PruneOptions) ([]PruneResult, error) {
+	entries := []cacheEntry{}
+	for _, dir := range dirs {
+		dirEntries, err := listCacheEntries(dir)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, dirEntries...)
+	}
+
+	// unreferenced first, then least recently used first
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].unreferenced != entries[j].unreferenced {
+			return entries[i].unreferenced
+		}
+		return entries[i].lastUsed.Before(entries[j].lastUsed)
+	})
+
+	total := int64(0)
+	for _, e := range entries {
+		total += e.size
+	}
+
+	results := []PruneResult{}
+	for _, e := range entries {
+		reason := ""
+		switch {
+		case e.unreferenced:
+			reason = "unreferenced"
+		case opts.MaxAge != 0 && time.Since(e.lastUsed) > opts.MaxAge:
+			reason = "age"
+		case opts.MaxSize != 0 && total > opts.MaxSize:
+			reason = "size"
+		default:
+			continue
+		}
+
+		if !opts.DryRun {
+			err := removeSidecars(e.path)
+			if err != nil {
+				return results, err
+			}
+
+			err = os.RemoveAll(e.path)
+			if err != nil {
+				return results, errors.Wrapf(err, "couldn't remove %s", e.path)
+			}
+
+			for _, p := range e.also {
+				err = os.Remove(p)
+				if err != nil && !os.IsNotExist(err) {
+					return results, errors.Wrapf(err, "couldn't remove %s", p)
+				}
+			}
+		}
+
+		total -= e.size
+		results = append(results, PruneResult{Path: e.path, Size: e.size, LastUsed: e.lastUsed, Reason: reason})
+	}
+
+	return results, nil
+}
+
+// listCacheEntries returns the entries of the cache dir dir, if it exists.
+func listCacheEntries(dir string) ([]cacheEntry, error) {
+	dirEntries, err := os.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, errors.Wrapf(err, "couldn't read cache dir %s", dir)
+	}
+
+	blobs, err := listCacheBlobs(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	entries := blobs.evicted
+	for _, d := range dirEntries {
+		if d.Name() == metaDirName {
+			continue
+		}
+
+		name := path.Join(dir, d.Name())
+		fi, err := os.Lstat(name)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+
+		size := fi.Size()
+		if fi.IsDir() {
+			size, err = dirSize(name)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		entries = append(entries, cacheEntry{path: name, size: size, lastUsed: lastUsed(name, fi), also: blobs.of(fi)})
+	}
+
+	orphans, err := orphanedSidecars(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	return append(entries, orphans...), nil
+}
+
+// orphanedSidecars returns the sidecars in dir of files that aren't there
+// (anymore), e.g. partial downloads that were never resumed, as entries of
+// their own.
+func orphanedSidecars(dir string) ([]cacheEntry, error) {
+	metaDir := path.Join(dir, metaDirName)
+	sidecars, err := os.ReadDir(metaDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, errors.Wrapf(err, "couldn't read %s", metaDir)
+	}
+
+	orphans := []cacheEntry{}
+	for _, d := range sidecars {
+		// not a sidecar, e.g. DownloadAll's journal
+		if strings.HasPrefix(d.Name(), ".") || !d.Type().IsRegular() {
+			continue
+		}
+
+		owner := path.Join(dir, strings.TrimSuffix(d.Name(), path.Ext(d.Name())))
+		if _, err := os.Lstat(owner); err == nil || !os.IsNotExist(err) {
+			continue
+		}
+
+		fi, err := d.Info()
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+
+		orphans = append(orphans, cacheEntry{path: path.Join(metaDir, d.Name()), size: fi.Size(), lastUsed: fi.ModTime()})
+	}
+
+	return orphans, nil
+}
+
+func dirSize(dir string) (int64, error) {
+	size := int64(0)
+	err := filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if d.Type().IsRegular() {
+			fi, err := d.Info()
+			if err != nil {
+				return err
+			}
+			size += fi.Size()
+		}
+		return nil
+	})
+
+	return size, errors.Wrapf(err, "couldn't walk %s", dir)
+}
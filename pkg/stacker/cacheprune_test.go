@@ -0,0 +1,69 @@
+package stacker
+
+import (
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPruneCache(t *testing.T) {
+	assert := assert.New(t)
+
+	cacheDir := t.TempDir()
+	entry := func(name string, size int, age time.Duration) string {
+		p := path.Join(cacheDir, name)
+		assert.NoError(os.WriteFile(p, make([]byte, size), 0644))
+		markUsed(p, DownloadOptions{})
+		then := time.Now().Add(-age)
+		assert.NoError(os.Chtimes(sidecarPath(p, usedExt), then, then))
+		return p
+	}
+
+	old := entry("old.tar.gz", 100, 60*24*time.Hour)
+	big := entry("big.tar.gz", 1000, 2*24*time.Hour)
+	recent := entry("recent.tar.gz", 100, time.Hour)
+
+	repo := path.Join(cacheDir, "repo")
+	assert.NoError(os.MkdirAll(path.Join(repo, "src"), 0755))
+	assert.NoError(os.WriteFile(path.Join(repo, "src", "main.go"), make([]byte, 50), 0644))
+	markUsed(repo, DownloadOptions{})
+
+	// a download that was never resumed
+	partial, err := createSidecar(path.Join(cacheDir, "gone.tar.gz"), partialExt, DownloadOptions{})
+	assert.NoError(err)
+	partial.Close()
+	then := time.Now().Add(-40 * 24 * time.Hour)
+	assert.NoError(os.Chtimes(partial.Name(), then, then))
+
+	results, err := PruneCache([]string{cacheDir}, PruneOptions{MaxAge: 30 * 24 * time.Hour, DryRun: true})
+	assert.NoError(err)
+	assert.Len(results, 2)
+	assert.FileExists(old)
+
+	results, err = PruneCache([]string{cacheDir}, PruneOptions{MaxAge: 30 * 24 * time.Hour})
+	assert.NoError(err)
+	assert.Equal([]string{old, partial.Name()}, []string{results[0].Path, results[1].Path})
+	assert.Equal("age", results[0].Reason)
+	assert.NoFileExists(old)
+	assert.NoFileExists(sidecarPath(old, usedExt))
+	assert.NoFileExists(partial.Name())
+
+	// the least recently used go first
+	results, err = PruneCache([]string{cacheDir}, PruneOptions{MaxSize: 200})
+	assert.NoError(err)
+	assert.Len(results, 1)
+	assert.Equal(big, results[0].Path)
+	assert.Equal("size", results[0].Reason)
+	assert.FileExists(recent)
+	assert.FileExists(path.Join(repo, "src", "main.go"))
+
+	// entries are only removed as a whole
+	results, err = PruneCache([]string{cacheDir, path.Join(cacheDir, "missing")}, PruneOptions{MaxSize: 120})
+	assert.NoError(err)
+	assert.Len(results, 1)
+	assert.Equal(recent, results[0].Path)
+	assert.DirExists(repo)
+}
@@ -0,0 +1,162 @@
+package stacker
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// CacheStatus is what ScanCache found out about a cached file.
+type CacheStatus int
+
+const (
+	// CacheOK entries match the digest recorded when they were verified.
+	CacheOK CacheStatus = iota
+	// CacheCorrupt entries don't match their recorded digest.
+	CacheCorrupt
+	// CacheRepaired entries were corrupt, and have been downloaded again.
+	CacheRepaired
+	// CacheUnverifiable entries have no recorded digest to check against.
+	CacheUnverifiable
+)
+
+func (s CacheStatus) String() string {
+	switch s {
+	case CacheOK:
+		return "ok"
+	case CacheCorrupt:
+		return "corrupt"
+	case CacheRepaired:
+		return "repaired"
+	case CacheUnverifiable:
+		return "unverifiable"
+	}
+	return "unknown"
+}
+
+// CacheScanResult is the outcome of verifying one cached file.
+type CacheScanResult struct {
+	Path   string
+	Source string
+	Status CacheStatus
+	// Err is why a corrupt entry couldn't be repaired, if it was tried.
+	Err error
+}
+
+// ScanCache verifies every file cached under dir against the digest recorded
+// in its metadata, using up to workers goroutines. With repair, corrupt files
+// that were downloaded over http(s) are downloaded again from their recorded
+// source, configured by opts.
+func ScanCache(dir string, workers int, repair bool, opts DownloadOptions) ([]CacheScanResult, error) {
+	names := []string{}
+	err := filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if d.IsDir() && d.Name() == metaDirName {
+			return filepath.SkipDir
+		}
+
+		if d.Type().IsRegular() {
+			names = append(names, p)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "couldn't walk cache dir %s", dir)
+	}
+
+	if workers < 1 {
+		workers = 1
+	}
+
+	results := make([]CacheScanResult, len(names))
+	work := make(chan int)
+	wg := sync.WaitGroup{}
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range work {
+				results[i] = scanCacheEntry(names[i], repair, opts)
+			}
+		}()
+	}
+
+	for i := range names {
+		work <- i
+	}
+	close(work)
+	wg.Wait()
+
+	return results, nil
+}
+
+func scanCacheEntry(name string, repair bool, opts DownloadOptions) CacheScanResult {
+	result := CacheScanResult{Path: name}
+
+	meta, err := readCacheMeta(name)
+	if err != nil || meta.Digest == "" {
+		result.Status = CacheUnverifiable
+		return result
+	}
+	result.Source = meta.Source
+
+	hash, err := sha256File(name)
+	if err != nil {
+		result.Status = CacheCorrupt
+		result.Err = err
+		return result
+	}
+
+	if hash == meta.Digest {
+		result.Status = CacheOK
+		return result
+	}
+
+	netLog.Warnf("cached copy of %s changed since it was verified (%s != %s)", name, hash, meta.Digest)
+	result.Status = CacheCorrupt
+	if !repair {
+		return result
+	}
+
+	if !isRemoteURL(meta.Source) {
+		result.Err = errors.Errorf("can't download %s again from %q", name, meta.Source)
+		return result
+	}
+
+	result.Err = repairCacheEntry(name, meta, opts)
+	if result.Err == nil {
+		result.Status = CacheRepaired
+	}
+	return result
+}
+
+// repairCacheEntry downloads the corrupt name again from its recorded source,
+// insisting on the digest it had when it was verified.
+func repairCacheEntry(name string, meta cacheMeta, opts DownloadOptions) error {
+	fi, err := os.Stat(name)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	mode := fi.Mode().Perm()
+
+	err = os.Remove(name)
+	if err != nil {
+		return errors.Wrapf(err, "couldn't remove corrupt %s", name)
+	}
+
+	opts.Dest = name
+	opts.Mode = &mode
+	opts.ExpectedHash = meta.Digest
+	_, err = DownloadWithOptions(filepath.Dir(name), meta.Source, opts)
+	if err != nil {
+		return err
+	}
+
+	return recordVerified(name, meta.Source, opts)
+}
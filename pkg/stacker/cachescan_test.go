@@ -0,0 +1,52 @@
+package stacker
+
+import (
+	"net/http"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestScanCache(t *testing.T) {
+	assert := assert.New(t)
+
+	srv := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hello world"))
+	})
+
+	dir := t.TempDir()
+	opts := DownloadOptions{Uid: os.Getuid(), Gid: os.Getgid(), CacheOptions: CacheOptions{RecheckInterval: 1}}
+
+	good, err := DownloadWithOptions(path.Join(dir, "a"), srv.URL+"/good", opts)
+	assert.NoError(err)
+	bad, err := DownloadWithOptions(path.Join(dir, "b"), srv.URL+"/bad", opts)
+	assert.NoError(err)
+	assert.NoError(os.WriteFile(bad, []byte("hello wOrld"), 0644))
+	assert.NoError(os.WriteFile(path.Join(dir, "unknown"), []byte("?"), 0644))
+
+	statuses := func(results []CacheScanResult) map[string]CacheStatus {
+		m := map[string]CacheStatus{}
+		for _, r := range results {
+			m[r.Path] = r.Status
+		}
+		return m
+	}
+
+	results, err := ScanCache(dir, 2, false, opts)
+	assert.NoError(err)
+	assert.Equal(map[string]CacheStatus{
+		good:                      CacheOK,
+		bad:                       CacheCorrupt,
+		path.Join(dir, "unknown"): CacheUnverifiable,
+	}, statuses(results))
+
+	results, err = ScanCache(dir, 2, true, opts)
+	assert.NoError(err)
+	assert.Equal(CacheRepaired, statuses(results)[bad])
+
+	content, err := os.ReadFile(bad)
+	assert.NoError(err)
+	assert.Equal("hello world", string(content))
+}
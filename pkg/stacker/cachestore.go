@@ -0,0 +1,165 @@
+package stacker
+
+import (
+	"os"
+	"path"
+	"slices"
+	"sync"
+
+	"github.com/pkg/errors"
+	"stackerbuild.io/stacker/pkg/lib"
+)
+
+// CacheStore is somewhere Download can find previously downloaded files.
+type CacheStore interface {
+	// Path returns where the store keeps (or would keep) the cached file
+	// called name.
+	Path(name string) string
+
+	// ReadOnly returns true if Download must never add files to the store.
+	ReadOnly() bool
+}
+
+type dirCacheStore struct {
+	dir      string
+	readOnly bool
+}
+
+// NewDirCacheStore returns a store that keeps its files in dir.
+func NewDirCacheStore(dir string, readOnly bool) CacheStore {
+	return dirCacheStore{dir: dir, readOnly: readOnly}
+}
+
+func (s dirCacheStore) Path(name string) string {
+	return path.Join(s.dir, name)
+}
+
+func (s dirCacheStore) ReadOnly() bool {
+	return s.readOnly
+}
+
+// MemCacheStore is a CacheStore whose content is set up in memory, e.g. for
+// tests of code that calls Download. Download hashes, copies and renames real
+// files, so an entry is written to a private temporary directory the first
+// time its path is asked for. Close removes that directory again.
+type MemCacheStore struct {
+	mu        sync.Mutex
+	files     map[string][]byte
+	dir       string
+	requested []string
+}
+
+// NewMemCacheStore returns a MemCacheStore that has files, keyed by name.
+func NewMemCacheStore(files map[string][]byte) *MemCacheStore {
+	s := &MemCacheStore{files: map[string][]byte{}}
+	for name, content := range files {
+		s.files[name] = content
+	}
+	return s
+}
+
+// Put adds (or replaces) the cached file name.
+func (s *MemCacheStore) Put(name string, content []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.files[name] = content
+	if s.dir != "" {
+		// make Path write it out again
+		os.RemoveAll(path.Join(s.dir, name))
+	}
+}
+
+// Requested returns the names Download looked for in the store, in the order
+// they were first asked for.
+func (s *MemCacheStore) Requested() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string{}, s.requested...)
+}
+
+// Path returns where the file name is available on disk; if the store doesn't
+// have it, nothing exists there.
+func (s *MemCacheStore) Path(name string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !slices.Contains(s.requested, name) {
+		s.requested = append(s.requested, name)
+	}
+
+	if s.dir == "" {
+		dir, err := os.MkdirTemp("", "stacker-mem-cache-")
+		if err != nil {
+			// nothing can be found here then
+			return path.Join(os.TempDir(), "stacker-mem-cache", name)
+		}
+		s.dir = dir
+	}
+
+	p := path.Join(s.dir, name)
+	content, ok := s.files[name]
+	if _, err := os.Stat(p); ok && os.IsNotExist(err) {
+		if err := os.WriteFile(p, content, 0644); err != nil {
+			netLog.Warnf("couldn't write %s of in-memory cache: %v", name, err)
+		}
+	}
+	return p
+}
+
+// ReadOnly returns true, Download never adds files to a store.
+func (s *MemCacheStore) ReadOnly() bool {
+	return true
+}
+
+// Close removes the files the store has written out.
+func (s *MemCacheStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.dir == "" {
+		return nil
+	}
+	err := os.RemoveAll(s.dir)
+	s.dir = ""
+	return errors.WithStack(err)
+}
+
+// lookupCacheStores returns the first of stores that has a valid cached copy
+// of name, downloaded from url.
+func lookupCacheStores(stores []CacheStore, name string, url string, opts DownloadOptions) (CacheStore, error) {
+	for _, s := range stores {
+		p := s.Path(name)
+
+		hit, err := cacheIsValid(p, url, opts)
+		if err != nil {
+			return nil, err
+		}
+
+		if hit.ok() && verifyImportFileHash(p, opts.ExpectedHash) == nil {
+			return s, nil
+		}
+	}
+
+	return nil, nil
+}
+
+// seedFromBaseCaches copies a valid cached copy of url from one of
+// opts.BaseCaches to name, if name isn't cached yet. The base caches
+// themselves are only ever read.
+func seedFromBaseCaches(name string, url string, opts DownloadOptions) error {
+	if len(opts.BaseCaches) == 0 {
+		return nil
+	}
+
+	if _, err := os.Stat(name); err == nil {
+		return nil
+	}
+
+	s, err := lookupCacheStores(opts.BaseCaches, path.Base(name), url, opts)
+	if err != nil || s == nil {
+		return err
+	}
+
+	netLog.Infof("seeding %s from %s", name, s.Path(path.Base(name)))
+	return lib.FileCopy(name, s.Path(path.Base(name)), opts.Mode, opts.Uid, opts.Gid)
+}
@@ -0,0 +1,40 @@
+package stacker
+
+import (
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMemCacheStore(t *testing.T) {
+	assert := assert.New(t)
+
+	store := NewMemCacheStore(map[string][]byte{"foo": []byte("hello world")})
+	defer store.Close()
+
+	transport := &fakeTransport{body: "not from the store"}
+	opts := DownloadOptions{
+		Uid: os.Getuid(),
+		Gid: os.Getgid(),
+		CacheOptions: CacheOptions{
+			BaseCaches: []CacheStore{store},
+		},
+		TransportOptions: TransportOptions{
+			Transport: transport,
+		},
+	}
+
+	name, err := DownloadWithOptions(t.TempDir(), "https://example.com/foo", opts)
+	assert.NoError(err)
+	assert.Empty(transport.requests)
+	assert.Equal([]string{"foo"}, store.Requested())
+
+	content, err := os.ReadFile(name)
+	assert.NoError(err)
+	assert.Equal("hello world", string(content))
+
+	_, err = DownloadWithOptions(t.TempDir(), "https://example.com/bar", opts)
+	assert.NoError(err)
+	assert.Len(transport.requests, 1)
+}
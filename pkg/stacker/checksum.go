@@ -0,0 +1,115 @@
+package stacker
+
+import (
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// ChecksumPolicy is how much Download insists on verifying what it downloads.
+type ChecksumPolicy int
+
+const (
+	// ChecksumNone verifies only pinned hashes, and trusts cached files
+	// whose size matches what the server reports.
+	ChecksumNone ChecksumPolicy = iota
+	// ChecksumPrefer verifies against any checksum that is available, but
+	// downloads files without one.
+	ChecksumPrefer
+	// ChecksumRequire fails downloads that have no checksum to verify
+	// against.
+	ChecksumRequire
+	// ChecksumAgree is ChecksumPrefer, but when more than one checksum is
+	// available, they must all be the same: sources that disagree mean a
+	// mirror or its metadata can't be trusted.
+	ChecksumAgree
+)
+
+func (p ChecksumPolicy) String() string {
+	switch p {
+	case ChecksumNone:
+		return "none"
+	case ChecksumPrefer:
+		return "prefer"
+	case ChecksumRequire:
+		return "require"
+	case ChecksumAgree:
+		return "agree"
+	}
+	return "unknown"
+}
+
+// ParseChecksumPolicy parses a policy as named by ChecksumPolicy.String(); the
+// empty string is ChecksumNone.
+func ParseChecksumPolicy(s string) (ChecksumPolicy, error) {
+	switch s {
+	case "", "none":
+		return ChecksumNone, nil
+	case "prefer":
+		return ChecksumPrefer, nil
+	case "require":
+		return ChecksumRequire, nil
+	case "agree":
+		return ChecksumAgree, nil
+	}
+	return ChecksumNone, errors.Errorf("unknown checksum policy %q (expected none, prefer, require or agree)", s)
+}
+
+const checksumFragment = "#sha256="
+
+// splitChecksumFragment splits a url#sha256=<hash> into the url and hash.
+func splitChecksumFragment(url string) (string, string) {
+	idx := strings.LastIndex(url, checksumFragment)
+	if idx < 0 {
+		return url, ""
+	}
+
+	return url[:idx], url[idx+len(checksumFragment):]
+}
+
+// applyChecksumPolicy picks the checksum url is verified against under
+// opts.ChecksumPolicy: a pinned hash, then one from the URL's fragment, then
+// the one the server advertised. It returns opts with ExpectedHash set to it.
+func applyChecksumPolicy(url string, fragmentHash string, opts DownloadOptions) (DownloadOptions, error) {
+	if opts.ChecksumPolicy == ChecksumNone {
+		if opts.ExpectedHash == "" {
+			opts.ExpectedHash = fragmentHash
+		}
+		return opts, nil
+	}
+
+	source := ""
+	switch {
+	case opts.ExpectedHash != "":
+		source = "pinned"
+	case fragmentHash != "":
+		source = "url fragment"
+		opts.ExpectedHash = fragmentHash
+	case opts.remoteSHA256() != "":
+		source = "server"
+		opts.ExpectedHash = opts.remoteSHA256()
+	}
+
+	if source == "" {
+		if opts.ChecksumPolicy == ChecksumRequire {
+			return opts, errors.Errorf("checksum policy %s: no checksum available for %s", opts.ChecksumPolicy, url)
+		}
+		netLog.Infof("checksum policy %s: no checksum available for %s", opts.ChecksumPolicy, url)
+		return opts, nil
+	}
+
+	if fragmentHash != "" && fragmentHash != opts.ExpectedHash {
+		return opts, errors.Errorf("checksum of %s in its url (%s) doesn't match the %s one (%s)",
+			url, fragmentHash, source, opts.ExpectedHash)
+	}
+
+	// only a sha256 from the server can be compared
+	remote := opts.remoteSHA256()
+	if opts.ChecksumPolicy == ChecksumAgree && remote != "" && remote != opts.ExpectedHash {
+		return opts, errors.Errorf("checksum policy %s: the server's checksum of %s (%s) doesn't match the %s one (%s)",
+			opts.ChecksumPolicy, url, remote, source, opts.ExpectedHash)
+	}
+
+	netLog.Infof("checksum policy %s: verifying %s against %s checksum %s", opts.ChecksumPolicy, url, source, opts.ExpectedHash)
+	return opts, nil
+}
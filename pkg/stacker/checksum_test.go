@@ -0,0 +1,116 @@
+package stacker
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestChecksumPolicy(t *testing.T) {
+	assert := assert.New(t)
+
+	a := strings.Repeat("a", 64)
+	b := strings.Repeat("b", 64)
+
+	for _, tc := range []struct {
+		desc     string
+		policy   ChecksumPolicy
+		pinned   string
+		fragment string
+		server   string
+		expected string
+		errstr   string
+	}{
+		{desc: "none ignores the server", policy: ChecksumNone, server: a, expected: ""},
+		{desc: "none uses the fragment", policy: ChecksumNone, fragment: a, expected: a},
+		{desc: "none keeps the pin", policy: ChecksumNone, pinned: a, fragment: b, expected: a},
+		{desc: "prefer without a checksum", policy: ChecksumPrefer, expected: ""},
+		{desc: "prefer uses the server's", policy: ChecksumPrefer, server: a, expected: a},
+		{desc: "prefer uses the fragment over the server's", policy: ChecksumPrefer, fragment: a, server: b, expected: a},
+		{desc: "prefer uses the pin over the server's", policy: ChecksumPrefer, pinned: a, server: b, expected: a},
+		{desc: "prefer rejects a fragment that doesn't match the pin", policy: ChecksumPrefer, pinned: a, fragment: b, errstr: "in its url"},
+		{desc: "require without a checksum", policy: ChecksumRequire, errstr: "no checksum available"},
+		{desc: "require uses the server's", policy: ChecksumRequire, server: a, expected: a},
+	} {
+		t.Run(tc.desc, func(t *testing.T) {
+			opts := DownloadOptions{ChecksumOptions: ChecksumOptions{ChecksumPolicy: tc.policy, ExpectedHash: tc.pinned}, CacheOptions: CacheOptions{RemoteHash: tc.server}}
+			opts, err := applyChecksumPolicy("https://example.com/file", tc.fragment, opts)
+			if tc.errstr != "" {
+				assert.ErrorContains(err, tc.errstr)
+				return
+			}
+			assert.NoError(err)
+			assert.Equal(tc.expected, opts.ExpectedHash)
+		})
+	}
+}
+
+func TestParseChecksumPolicy(t *testing.T) {
+	assert := assert.New(t)
+
+	for _, policy := range []ChecksumPolicy{ChecksumNone, ChecksumPrefer, ChecksumRequire, ChecksumAgree} {
+		parsed, err := ParseChecksumPolicy(policy.String())
+		assert.NoError(err)
+		assert.Equal(policy, parsed)
+	}
+
+	policy, err := ParseChecksumPolicy("")
+	assert.NoError(err)
+	assert.Equal(ChecksumNone, policy)
+
+	_, err = ParseChecksumPolicy("sometimes")
+	assert.ErrorContains(err, "unknown checksum policy")
+}
+
+func TestSplitChecksumFragment(t *testing.T) {
+	assert := assert.New(t)
+
+	url, hash := splitChecksumFragment("https://example.com/file#sha256=abc")
+	assert.Equal("https://example.com/file", url)
+	assert.Equal("abc", hash)
+
+	url, hash = splitChecksumFragment("https://example.com/file")
+	assert.Equal("https://example.com/file", url)
+	assert.Equal("", hash)
+}
+
+func TestChecksumPolicyAgree(t *testing.T) {
+	assert := assert.New(t)
+
+	a := strings.Repeat("a", 64)
+	b := strings.Repeat("b", 64)
+
+	for _, tc := range []struct {
+		desc     string
+		pinned   string
+		fragment string
+		server   string
+		expected string
+		errstr   string
+	}{
+		{desc: "no checksum", expected: ""},
+		{desc: "only the server's", server: a, expected: a},
+		{desc: "only pinned", pinned: a, expected: a},
+		{desc: "all agree", pinned: a, fragment: a, server: strings.ToUpper(a), expected: a},
+		{desc: "server disagrees", pinned: a, server: b, errstr: "the server's checksum"},
+		{desc: "fragment disagrees with server", fragment: a, server: b, errstr: "the server's checksum"},
+		{desc: "fragment disagrees with pinned", pinned: a, fragment: b, server: a, errstr: "in its url"},
+	} {
+		t.Run(tc.desc, func(t *testing.T) {
+			opts := DownloadOptions{ChecksumOptions: ChecksumOptions{ChecksumPolicy: ChecksumAgree, ExpectedHash: tc.pinned}, CacheOptions: CacheOptions{RemoteHash: tc.server}}
+			opts, err := applyChecksumPolicy("https://example.com/file", tc.fragment, opts)
+			if tc.errstr != "" {
+				assert.ErrorContains(err, tc.errstr)
+				return
+			}
+			assert.NoError(err)
+			assert.Equal(tc.expected, opts.ExpectedHash)
+		})
+	}
+
+	// prefer doesn't care what the server says once there is a pin
+	opts, err := applyChecksumPolicy("https://example.com/file", "", DownloadOptions{ChecksumOptions: ChecksumOptions{ChecksumPolicy: ChecksumPrefer, ExpectedHash: a}, CacheOptions: CacheOptions{RemoteHash: b}})
+	assert.NoError(err)
+	assert.Equal(a, opts.ExpectedHash)
+}
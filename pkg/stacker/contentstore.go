@@ -0,0 +1,411 @@
+package stacker
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"path"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/minio/sha256-simd"
+	"github.com/pkg/errors"
+)
+
+// Downloads are kept in their cache dir by what they are rather than only by
+// the name they are imported as: in the cache dir's metaDirName,
+// blobs/sha256/<digest> has the content and index/<sha256 of the url>.json
+// says which blob a url was last downloaded as. The cached file of a url is a
+// hard link to its blob, so this takes no extra space; but when another url
+// with the same name replaces it, the blob stays, and the cached file is
+// linked back to it the next time the first url is imported instead of
+// downloading it again. Blobs and index entries are only ever replaced whole,
+// by renaming, so concurrent builds may share a cache dir.
+
+// contentIndexEntry is what the index says about a url.
+type contentIndexEntry struct {
+	URL    string `json:"url"`
+	Digest string `json:"digest"`
+
+	// Meta is the cache metadata of the download, so that a cached file
+	// linked back to its blob can be revalidated as if it had just been
+	// downloaded.
+	Meta cacheMeta `json:"meta"`
+}
+
+func urlKey(url string) string {
+	sum := sha256.Sum256([]byte(url))
+	return hex.EncodeToString(sum[:])
+}
+
+func blobDir(cacheDir string) string {
+	return path.Join(cacheDir, metaDirName, "blobs", "sha256")
+}
+
+func blobPath(cacheDir string, digest string) string {
+	return path.Join(blobDir(cacheDir), digest)
+}
+
+func indexDir(cacheDir string) string {
+	return path.Join(cacheDir, metaDirName, "index")
+}
+
+func indexPath(cacheDir string, url string) string {
+	return path.Join(indexDir(cacheDir), urlKey(url)+".json")
+}
+
+// lookupContent returns the index entry of url in cacheDir, if cacheDir has
+// its blob.
+func lookupContent(cacheDir string, url string) (contentIndexEntry, bool, error) {
+	entry := contentIndexEntry{}
+
+	content, err := os.ReadFile(indexPath(cacheDir, url))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return entry, false, nil
+		}
+		return entry, false, errors.WithStack(err)
+	}
+
+	err = json.Unmarshal(content, &entry)
+	if err != nil {
+		netLog.Warnf("ignoring corrupt cache index entry %s: %v", indexPath(cacheDir, url), err)
+		return entry, false, nil
+	}
+
+	// a hash collision is as likely as the index entry of another url
+	// ending up here, but either way it isn't ours
+	if entry.URL != url || entry.Digest == "" {
+		return entry, false, nil
+	}
+
+	if _, err := os.Stat(blobPath(cacheDir, entry.Digest)); err != nil {
+		return entry, false, nil
+	}
+
+	return entry, true, nil
+}
+
+// relinkContent links the cached name back to the blob url was last
+// downloaded as, unless name already is a copy of url. It returns true if it
+// did.
+func relinkContent(name string, url string, opts DownloadOptions) (bool, error) {
+	meta, err := readCacheMeta(name)
+	if err != nil {
+		return false, err
+	}
+	if _, err := os.Stat(name); err == nil && meta.Source == url {
+		return false, nil
+	}
+
+	cacheDir := path.Dir(name)
+	entry, ok, err := lookupContent(cacheDir, url)
+	if err != nil || !ok {
+		return false, err
+	}
+
+	if opts.ExpectedHash != "" && entry.Digest != opts.ExpectedHash {
+		return false, nil
+	}
+
+	// make sure nothing changed the blob since, e.g. through a cached
+	// file that was linked to it
+	blob := blobPath(cacheDir, entry.Digest)
+	hash, err := sha256File(blob)
+	if err != nil {
+		return false, err
+	}
+	if hash != entry.Digest {
+		netLog.Warnf("removing corrupt cached copy %s of %s", blob, url)
+		os.Remove(blob)
+		os.Remove(indexPath(cacheDir, url))
+		return false, nil
+	}
+
+	err = removeSidecars(name)
+	if err != nil {
+		return false, err
+	}
+
+	err = linkAtomically(blob, name)
+	if err != nil {
+		return false, err
+	}
+
+	// for PruneCache
+	now := time.Now()
+	_ = os.Chtimes(indexPath(cacheDir, url), now, now)
+
+	// the blob is the file the metadata was recorded for, so it still
+	// describes it: what was verified of it then still holds, and no more
+	netLog.Infof("linking %s back to its cached copy from %s (%s)", name, url, entry.Digest)
+	entry.Meta.Source = url
+	return true, writeCacheMeta(name, entry.Meta, opts)
+}
+
+// storeContent links the cached name, downloaded from url, to its blob. The
+// blob only saves downloading url again, so failing to is just logged.
+func storeContent(name string, url string, opts DownloadOptions) {
+	err := linkContent(name, url, opts)
+	if err != nil {
+		netLog.Warnf("couldn't keep %s by its digest: %v", url, err)
+	}
+}
+
+func linkContent(name string, url string, opts DownloadOptions) error {
+	meta, err := readCacheMeta(name)
+	if err != nil {
+		return err
+	}
+
+	// relinkContent only links back copies of url; plain downloads don't
+	// record that they are one, but name was just used as one
+	switch meta.Source {
+	case url:
+	case "":
+		meta.Source = url
+		err = writeCacheMeta(name, meta, opts)
+		if err != nil {
+			return err
+		}
+	default:
+		return nil
+	}
+
+	// this is only the name of the blob; only the checks the download
+	// went through say whether it is what url has
+	digest, err := cachedDigest(name, url, opts)
+	if err != nil {
+		return err
+	}
+
+	cacheDir := path.Dir(name)
+	blob := blobPath(cacheDir, digest)
+	if !sameFile(name, blob) {
+		err = createCacheDir(path.Dir(blob), opts.DirMode)
+		if err != nil {
+			return err
+		}
+
+		// downloads replace cached files by renaming, so the blob
+		// can be the cached file itself; if another file had the same
+		// content, it keeps its own copy
+		err = linkAtomically(name, blob)
+		if err != nil {
+			return err
+		}
+	}
+
+	entry, ok, err := lookupContent(cacheDir, url)
+	if err != nil {
+		return err
+	}
+	if ok && entry.Digest == digest {
+		// for PruneCache
+		now := time.Now()
+		return errors.WithStack(os.Chtimes(indexPath(cacheDir, url), now, now))
+	}
+
+	content, err := json.Marshal(contentIndexEntry{URL: url, Digest: digest, Meta: meta})
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	return writeIndexEntry(indexPath(cacheDir, url), content, opts)
+}
+
+// writeIndexEntry writes content to p through a temporary file in the same
+// directory, so that readers see either the old or the new entry.
+func writeIndexEntry(p string, content []byte, opts DownloadOptions) error {
+	err := createCacheDir(path.Dir(p), opts.DirMode)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := tempName(path.Dir(p))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp)
+
+	f, err := createCacheFile(tmp, os.O_RDWR|os.O_TRUNC, opts.SidecarMode)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	_, err = f.Write(content)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return errors.Wrapf(err, "couldn't write %s", p)
+	}
+
+	return errors.WithStack(os.Rename(tmp, p))
+}
+
+// tempName returns a name in dir that nothing else uses, for a file that is
+// then renamed into place.
+func tempName(dir string) (string, error) {
+	f, err := os.CreateTemp(dir, ".tmp-")
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+	f.Close()
+	return f.Name(), errors.WithStack(os.Remove(f.Name()))
+}
+
+// linkAtomically makes dst a hard link to src, replacing whatever dst was
+// whole.
+func linkAtomically(src string, dst string) error {
+	tmp, err := tempName(path.Dir(dst))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp)
+
+	err = os.Link(src, tmp)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	return errors.WithStack(os.Rename(tmp, dst))
+}
+
+func sameFile(a string, b string) bool {
+	afi, err := os.Stat(a)
+	if err != nil {
+		return false
+	}
+	bfi, err := os.Stat(b)
+	if err != nil {
+		return false
+	}
+	return os.SameFile(afi, bfi)
+}
+
+// contentIndex returns the index entries of cacheDir by the digest of the
+// blob they point at.
+func contentIndex(cacheDir string) (map[string][]string, error) {
+	index := map[string][]string{}
+
+	dirEntries, err := os.ReadDir(indexDir(cacheDir))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return index, nil
+		}
+		return nil, errors.WithStack(err)
+	}
+
+	for _, d := range dirEntries {
+		if strings.HasPrefix(d.Name(), ".") {
+			continue
+		}
+
+		p := path.Join(indexDir(cacheDir), d.Name())
+		entry := contentIndexEntry{}
+		content, err := os.ReadFile(p)
+		if err == nil {
+			err = json.Unmarshal(content, &entry)
+		}
+		if err != nil {
+			continue
+		}
+
+		index[entry.Digest] = append(index[entry.Digest], p)
+	}
+
+	return index, nil
+}
+
+// cacheBlobs are the blobs of a cache dir, for PruneCache.
+type cacheBlobs struct {
+	// evicted are the blobs no cached file is linked to anymore, i.e.
+	// those only the index keeps, as cache entries of their own
+	evicted []cacheEntry
+
+	// linked are the other blobs by inode, which go along with the
+	// cached file linked to them
+	linked map[inode]string
+
+	index map[string][]string
+}
+
+// inode is what two hard links to the same file have in common.
+type inode struct {
+	dev uint64
+	ino uint64
+}
+
+func inodeOf(fi os.FileInfo) (inode, uint64, bool) {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return inode{}, 0, false
+	}
+	return inode{dev: uint64(st.Dev), ino: st.Ino}, uint64(st.Nlink), true
+}
+
+func listCacheBlobs(cacheDir string) (cacheBlobs, error) {
+	b := cacheBlobs{linked: map[inode]string{}}
+
+	blobs, err := os.ReadDir(blobDir(cacheDir))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return b, nil
+		}
+		return b, errors.WithStack(err)
+	}
+
+	b.index, err = contentIndex(cacheDir)
+	if err != nil {
+		return b, err
+	}
+
+	for _, d := range blobs {
+		if strings.HasPrefix(d.Name(), ".") {
+			continue
+		}
+
+		p := path.Join(blobDir(cacheDir), d.Name())
+		fi, err := d.Info()
+		if err != nil {
+			return b, errors.WithStack(err)
+		}
+
+		if ino, nlink, ok := inodeOf(fi); ok && nlink > 1 {
+			b.linked[ino] = p
+			continue
+		}
+
+		// a blob was last used when one of its urls was last
+		// downloaded or linked back to it; it is garbage once none
+		// is
+		e := cacheEntry{path: p, size: fi.Size(), lastUsed: fi.ModTime(), also: b.index[d.Name()]}
+		e.unreferenced = len(e.also) == 0
+		for _, ip := range e.also {
+			if ifi, err := os.Stat(ip); err == nil && ifi.ModTime().After(e.lastUsed) {
+				e.lastUsed = ifi.ModTime()
+			}
+		}
+		b.evicted = append(b.evicted, e)
+	}
+
+	return b, nil
+}
+
+// of returns the blob the cached file with fi is linked to, if any, along
+// with the index entries pointing at it.
+func (b cacheBlobs) of(fi os.FileInfo) []string {
+	ino, _, ok := inodeOf(fi)
+	if !ok {
+		return nil
+	}
+
+	blob, ok := b.linked[ino]
+	if !ok {
+		return nil
+	}
+
+	return append(b.index[path.Base(blob)], blob)
+}
@@ -0,0 +1,80 @@
+package stacker
+
+import (
+	"net/http"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCacheByDigest(t *testing.T) {
+	assert := assert.New(t)
+
+	gets := 0
+	srv := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet {
+			gets++
+		}
+		w.Write([]byte(r.URL.Path))
+	})
+
+	cacheDir := t.TempDir()
+	opts := DownloadOptions{Uid: os.Getuid(), Gid: os.Getgid(), CacheOptions: CacheOptions{FileMode: 0600, SidecarMode: 0600, DirMode: 0700}}
+	download := func(p string) string {
+		name, err := DownloadWithOptions(cacheDir, srv.URL+p, opts)
+		assert.NoError(err)
+		assert.Equal(path.Join(cacheDir, "rootfs.tar.gz"), name)
+		content, err := os.ReadFile(name)
+		assert.NoError(err)
+		assert.Equal(p, string(content))
+		return name
+	}
+
+	// the same name from two urls doesn't mean downloading them again
+	download("/a/rootfs.tar.gz")
+	download("/b/rootfs.tar.gz")
+	name := download("/a/rootfs.tar.gz")
+	assert.Equal(2, gets)
+
+	// the cached file is its content, not a copy of it
+	entry, ok, err := lookupContent(cacheDir, srv.URL+"/a/rootfs.tar.gz")
+	assert.NoError(err)
+	assert.True(ok)
+	assert.True(sameFile(name, blobPath(cacheDir, entry.Digest)))
+
+	// with the configured modes
+	fi, err := os.Stat(blobDir(cacheDir))
+	assert.NoError(err)
+	assert.Equal(os.FileMode(0700), fi.Mode().Perm())
+	fi, err = os.Stat(blobPath(cacheDir, entry.Digest))
+	assert.NoError(err)
+	assert.Equal(os.FileMode(0600), fi.Mode().Perm())
+	fi, err = os.Stat(indexPath(cacheDir, srv.URL+"/a/rootfs.tar.gz"))
+	assert.NoError(err)
+	assert.Equal(os.FileMode(0600), fi.Mode().Perm())
+
+	// content that changed is not used
+	entry, ok, err = lookupContent(cacheDir, srv.URL+"/b/rootfs.tar.gz")
+	assert.NoError(err)
+	assert.True(ok)
+	assert.NoError(os.WriteFile(blobPath(cacheDir, entry.Digest), []byte("changed"), 0644))
+	download("/b/rootfs.tar.gz")
+	assert.Equal(3, gets)
+
+	// content is pruned along with the cached file linked to it, and
+	// content no url points at always is
+	download("/a/rootfs.tar.gz")
+	assert.NoError(os.WriteFile(blobPath(cacheDir, "unreferenced"), nil, 0644))
+	results, err := PruneCache([]string{cacheDir}, PruneOptions{MaxSize: 1})
+	assert.NoError(err)
+	assert.Len(results, 3)
+	assert.Equal("unreferenced", results[0].Reason)
+	blobs, err := os.ReadDir(blobDir(cacheDir))
+	assert.NoError(err)
+	assert.Empty(blobs)
+	_, ok, err = lookupContent(cacheDir, srv.URL+"/a/rootfs.tar.gz")
+	assert.NoError(err)
+	assert.False(ok)
+}
@@ -2,9 +2,12 @@ package stacker
 
 import (
 	"fmt"
+	"io/fs"
+	"maps"
 	"os"
 	"path/filepath"
 	"regexp"
+	"slices"
 	"strconv"
 	"strings"
 
@@ -35,10 +38,30 @@ type Converter struct {
 	vols      int
 	args      []string
 	env       map[string]string
+	// the stages of the Dockerfile in order, and what each passes on to
+	// the stages built on it
+	stages []string
+	state  map[string]*stage
+	// instructions that couldn't be converted, which are left as TODO
+	// comments at the top of the stackerfile
+	todos []todo
 	// per-layer state
-	currDir string
-	currUid string
-	currGid string
+	currDir   string
+	currUid   string
+	currGid   string
+	currNamed bool
+	onbuild   []Command
+}
+
+// stage is what a stage of a Dockerfile passes on to the stages that are
+// built on it (FROM <stage>).
+type stage struct {
+	named   bool
+	env     map[string]string
+	dir     string
+	uid     string
+	gid     string
+	onbuild []Command
 }
 
 // NewConverter initializes a new Converter struct
@@ -48,6 +71,7 @@ func NewConverter(opts *ConvertArgs) *Converter {
 		output: Stackerfile{},
 		subs:   map[string]string{},
 		args:   []string{},
+		state:  map[string]*stage{},
 	}
 }
 
@@ -71,6 +95,75 @@ type Command struct {
 	Value     []string // The contents of the command (ex: `ubuntu:xenial`)
 }
 
+// todo is an instruction of the Dockerfile that couldn't be converted.
+type todo struct {
+	cmd    *Command
+	layer  string
+	reason string
+}
+
+func (t todo) String() string {
+	original := strings.Join(strings.Fields(t.cmd.Original), " ")
+	return fmt.Sprintf("line %d (%s): %s: %s", t.cmd.StartLine, t.layer, original, t.reason)
+}
+
+// todo records that cmd of the current layer couldn't be converted, and why.
+func (c *Converter) todo(cmd *Command, reason string) {
+	t := todo{cmd: cmd, layer: c.currLayer, reason: reason}
+	log.Warnf("%s", t)
+	c.todos = append(c.todos, t)
+}
+
+// substituteArgs replaces the references to ARGs in val by the placeholders
+// of the substitutions they're converted to.
+func (c *Converter) substituteArgs(val string) string {
+	for _, arg := range c.args {
+		re := regexp.MustCompile(fmt.Sprintf(`\$(\{%[1]s\}|\(%[1]s\)|%[1]s\b)`, regexp.QuoteMeta(arg)))
+		val = re.ReplaceAllLiteralString(val, fmt.Sprintf("${{%s}}", arg))
+	}
+	return val
+}
+
+// saveStage saves what the current stage passes on to the stages built on it.
+func (c *Converter) saveStage() {
+	if c.currLayer == "" {
+		return
+	}
+	c.state[c.currLayer] = &stage{
+		named:   c.currNamed,
+		env:     c.env,
+		dir:     c.currDir,
+		uid:     c.currUid,
+		gid:     c.currGid,
+		onbuild: c.onbuild,
+	}
+}
+
+// copySource is the layer that COPY --from=from copies from: a stage, by name
+// or index, or else an image, which gets a build only layer of its own.
+func (c *Converter) copySource(from string) string {
+	if slices.Contains(c.stages, from) {
+		return from
+	}
+	if i, err := strconv.Atoi(from); err == nil && i >= 0 && i < len(c.stages) {
+		return c.stages[i]
+	}
+
+	name := invalidLayerNameChars.ReplaceAllString(from, "_")
+	if _, ok := c.output[name]; !ok {
+		layer := types.Layer{BuildOnly: true}
+		layer.From.Type = types.DockerLayer
+		layer.From.Url = fmt.Sprintf("docker://%s", from)
+		c.output[name] = &layer
+	}
+	return name
+}
+
+// archiveSuffixes are those of the files ADD extracts.
+var archiveSuffixes = []string{".tar", ".tar.gz", ".tgz", ".tar.bz2", ".tbz2", ".tar.xz", ".txz", ".tar.zst"}
+
+var invalidLayerNameChars = regexp.MustCompile(`[^A-Za-z0-9._-]`)
+
 func (c *Converter) convertCommand(cmd *Command) error {
 	var layer *types.Layer
 	if c.currLayer != "" {
@@ -80,56 +173,83 @@ func (c *Converter) convertCommand(cmd *Command) error {
 	log.Debugf("cmd: %+v", cmd)
 	switch strings.ToLower(cmd.Cmd) {
 	case "from":
+		c.saveStage()
+
 		layer := types.Layer{BuildEnv: map[string]string{"arch": "x86_64"}}
 		c.currDir = ""
 		c.currUid = ""
 		c.currGid = ""
+		c.env = map[string]string{}
+		c.onbuild = nil
 		if len(cmd.Value) == 1 {
-			c.currLayer = "${{IMAGE}}"
-			c.subs["IMAGE"] = "app"
+			// unnamed stages can only be referred to by their index;
+			// the last one is the image
+			c.currLayer = fmt.Sprintf("stage-%d", len(c.stages))
+			c.currNamed = false
 		} else if len(cmd.Value) == 3 && strings.EqualFold(cmd.Value[1], "as") {
 			c.currLayer = cmd.Value[2]
-			// layer.BuildOnly = true	// FIXME: should be enabled
+			c.currNamed = true
 		} else {
 			return errors.Errorf("unsupported FROM directive")
 		}
-		if !strings.EqualFold(cmd.Value[0], "scratch") {
-			layer.From.Type = "docker"
-			layer.From.Url = fmt.Sprintf("docker://%s", cmd.Value[0])
+
+		base := c.substituteArgs(cmd.Value[0])
+		var triggers []Command
+		if strings.EqualFold(base, "scratch") {
+			layer.From.Type = types.ScratchLayer
+		} else if st, ok := c.state[base]; ok {
+			// a previous stage: it's built first, and what it sets
+			// up is inherited
+			layer.From.Type = types.BuiltLayer
+			layer.From.Tag = base
+			c.env = maps.Clone(st.env)
+			c.currDir = st.dir
+			c.currUid = st.uid
+			c.currGid = st.gid
+			triggers = st.onbuild
 		} else {
-			layer.From.Type = cmd.Value[0]
+			layer.From.Type = types.DockerLayer
+			layer.From.Url = fmt.Sprintf("docker://%s", base)
 		}
+		c.stages = append(c.stages, c.currLayer)
 		c.output[c.currLayer] = &layer
+
+		// the ONBUILD triggers of the stage this one is built on run
+		// first
+		for _, trigger := range triggers {
+			trigger := trigger
+			trigger.Value = slices.Clone(trigger.Value)
+			if err := c.convertCommand(&trigger); err != nil {
+				return err
+			}
+		}
+	case "onbuild":
+		trigger := *cmd
+		trigger.Cmd = cmd.SubCmd
+		trigger.SubCmd = ""
+		c.onbuild = append(c.onbuild, trigger)
 	case "run":
 		// setup the environment
 		for k, v := range c.env {
 			layer.Run = append(layer.Run, fmt.Sprintf("export %s=%s", k, v))
 		}
 
+		if len(cmd.Flags) > 0 {
+			c.todo(cmd, fmt.Sprintf("RUN flags %s aren't converted, see binds and secrets", strings.Join(cmd.Flags, " ")))
+		}
+
 		// replace any ARGs first
 		for i, val := range cmd.Value {
-			for _, arg := range c.args {
-				repl := strings.ReplaceAll(val, fmt.Sprintf("$%s", arg), fmt.Sprintf("${{%s}}", arg))
-				if repl != val {
-					cmd.Value[i] = repl
-					break
-				}
-
-				repl = strings.ReplaceAll(val, fmt.Sprintf("${%s}", arg), fmt.Sprintf("${{%s}}", arg))
-				if repl != val {
-					cmd.Value[i] = repl
-					break
-				}
+			cmd.Value[i] = c.substituteArgs(val)
+		}
 
-				repl = strings.ReplaceAll(val, fmt.Sprintf("$(%s)", arg), fmt.Sprintf("${{%s}}", arg))
-				if repl != val {
-					cmd.Value[i] = repl
-					break
-				}
-			}
+		lines := cmd.Value
+		if cmd.Json {
+			// the exec form is a single command
+			lines = []string{shquot.POSIXShell(cmd.Value)}
 		}
 
-		for _, line := range cmd.Value {
+		for _, line := range lines {
 			// patch some cmds
 			re := regexp.MustCompile(`\bmkdir\b`)
 			line = re.ReplaceAllString(line, "mkdir -p")
@@ -142,7 +262,7 @@ func (c *Converter) convertCommand(cmd *Command) error {
 			}
 		}
 	case "cmd":
-		layer.Cmd = cmd.Value
+		layer.Cmd = shellForm(cmd)
 	case "label":
 		if layer.Labels == nil {
 			layer.Labels = map[string]string{}
@@ -180,37 +300,33 @@ func (c *Converter) convertCommand(cmd *Command) error {
 
 		for i := 0; i < len(cmd.Value); i += 2 {
 			key = cmd.Value[i]
-			val = cmd.Value[i+1]
-
-			for _, arg := range c.args {
-				repl := strings.ReplaceAll(val, fmt.Sprintf("$%s", arg), fmt.Sprintf("${{%s}}", arg))
-				if repl != val {
-					val = repl
-					break
-				}
-
-				repl = strings.ReplaceAll(val, fmt.Sprintf("${%s}", arg), fmt.Sprintf("${{%s}}", arg))
-				if repl != val {
-					val = repl
-					break
-				}
-
-				repl = strings.ReplaceAll(val, fmt.Sprintf("$(%s)", arg), fmt.Sprintf("${{%s}}", arg))
-				if repl != val {
-					val = repl
-					break
-				}
-			}
+			val = c.substituteArgs(cmd.Value[i+1])
 
 			if c.env == nil {
 				c.env = map[string]string{}
 			}
 
 			c.env[key] = val
+
+			// the environment of the image too, unless it refers to
+			// variables that are only known at build time
+			if strings.Contains(strings.ReplaceAll(val, "${{", ""), "$") {
+				c.todo(cmd, fmt.Sprintf("%s refers to other variables, so it's only set in the run section; add it to environment by hand", key))
+				continue
+			}
+			if layer.Environment == nil {
+				layer.Environment = map[string]string{}
+			}
+			layer.Environment[key] = val
 		}
 	case "workdir":
-		layer.Run = append(layer.Run, fmt.Sprintf("cd %s", cmd.Value[0]))
-		c.currDir = cmd.Value[0]
+		dir := cmd.Value[0]
+		if !filepath.IsAbs(dir) {
+			dir = filepath.Join("/", c.currDir, dir)
+		}
+		layer.Run = append(layer.Run, fmt.Sprintf("mkdir -p %s", dir), fmt.Sprintf("cd %s", dir))
+		layer.WorkingDir = dir
+		c.currDir = dir
 	case "arg":
 		if len(cmd.Value) != 1 {
 			return errors.Errorf("invalid arg - %v", cmd.Value)
@@ -225,46 +341,73 @@ func (c *Converter) convertCommand(cmd *Command) error {
 		} else {
 			return errors.Errorf("invalid arg - %v", cmd.Value)
 		}
-	case "copy":
-		// if --from is specified, then import, else just "cp"
-		imp := types.Import{Path: cmd.Value[0]}
-		dest := ""
-		if len(cmd.Value) == 2 {
-			dest = cmd.Value[1]
-			if !filepath.IsAbs(dest) {
-				dest = filepath.Join(c.currDir, dest)
-			}
+	case "copy", "add":
+		if len(cmd.Value) < 2 {
+			return errors.Errorf("invalid %s - %v", cmd.Cmd, cmd.Value)
 		}
-		imp.Dest = dest
 
-		if len(cmd.Flags) > 0 {
-			for _, flag := range cmd.Flags {
-				if strings.HasPrefix(flag, "--from=") {
-					layer := strings.TrimPrefix(flag, "--from=")
-					imp.Path = fmt.Sprintf("stacker://%s", filepath.Join(layer, cmd.Value[0]))
-				} else if strings.HasPrefix(flag, "--chown=") {
-					mode := strings.TrimPrefix(flag, "--chown=")
-					parts := strings.Split(mode, ":")
-					uid, err := strconv.ParseInt(parts[0], 0, 32)
+		// the last one is where the others are copied to
+		sources := cmd.Value[:len(cmd.Value)-1]
+		dest := c.substituteArgs(cmd.Value[len(cmd.Value)-1])
+		if !filepath.IsAbs(dest) {
+			dest = filepath.Join("/", c.currDir, dest)
+		}
+
+		// if --from is specified, then import from that layer, else
+		// just from the host
+		proto := types.Import{Dest: dest}
+		from := ""
+		for _, flag := range cmd.Flags {
+			if strings.HasPrefix(flag, "--from=") {
+				from = c.copySource(strings.TrimPrefix(flag, "--from="))
+			} else if strings.HasPrefix(flag, "--chown=") {
+				mode := strings.TrimPrefix(flag, "--chown=")
+				parts := strings.Split(mode, ":")
+				uid, err := strconv.ParseInt(parts[0], 0, 32)
+				if err != nil {
+					c.todo(cmd, "only numeric --chown is converted")
+					continue
+				}
+
+				proto.Uid = int(uid)
+				if len(parts) == 2 {
+					gid, err := strconv.ParseInt(parts[1], 0, 32)
 					if err != nil {
-						log.Errorf("unable to parse COPY directive: %s", cmd.Original)
-						return err
+						c.todo(cmd, "only numeric --chown is converted")
+						continue
 					}
+					proto.Gid = int(gid)
+				}
+			} else if strings.HasPrefix(flag, "--chmod=") {
+				mode, err := strconv.ParseUint(strings.TrimPrefix(flag, "--chmod="), 8, 32)
+				if err != nil {
+					c.todo(cmd, "only octal --chmod is converted")
+					continue
+				}
+				fileMode := fs.FileMode(mode)
+				proto.Mode = &fileMode
+			} else if strings.HasPrefix(flag, "--checksum=") {
+				proto.Hash = strings.TrimPrefix(strings.TrimPrefix(flag, "--checksum="), "sha256:")
+			} else {
+				c.todo(cmd, fmt.Sprintf("%s isn't converted", flag))
+			}
+		}
 
-					imp.Uid = int(uid)
-					if len(parts) == 2 {
-						gid, err := strconv.ParseInt(parts[1], 0, 32)
-						if err != nil {
-							log.Errorf("unable to parse COPY directive: %s", cmd.Original)
-							return err
-						}
-						imp.Gid = int(gid)
+		for _, source := range sources {
+			imp := proto
+			imp.Path = c.substituteArgs(source)
+			if from != "" {
+				imp.Path = fmt.Sprintf("stacker://%s", filepath.Join(from, imp.Path))
+			} else if cmd.Cmd == "add" {
+				for _, suffix := range archiveSuffixes {
+					if strings.HasSuffix(imp.Path, suffix) && !strings.Contains(imp.Path, "://") {
+						c.todo(cmd, fmt.Sprintf("ADD extracts %s, imports don't; extract it in the run section", imp.Path))
+						break
 					}
 				}
 			}
+			layer.Imports = append(layer.Imports, imp)
 		}
-
-		layer.Imports = append(layer.Imports, imp)
 	case "volume":
 		c.vols++
 		vol := fmt.Sprintf("STACKER_VOL%d", c.vols)
@@ -273,7 +416,7 @@ func (c *Converter) convertCommand(cmd *Command) error {
 		layer.Binds = append(layer.Binds, bind)
 		log.Infof("Bind-mounted volume %q found (substituted via %s) - make sure volume is present on host", cmd.Value[0], vol)
 	case "entrypoint":
-		layer.Entrypoint = cmd.Value
+		layer.Entrypoint = shellForm(cmd)
 	case "user":
 		// su uid:gid
 		parts := strings.Split(cmd.Value[0], ":")
@@ -281,14 +424,29 @@ func (c *Converter) convertCommand(cmd *Command) error {
 		if len(parts) == 2 {
 			c.currGid = parts[1]
 		}
+		layer.RuntimeUser = cmd.Value[0]
+	case "healthcheck":
+		c.todo(cmd, "health checks aren't part of OCI images, configure them where the image is run")
+	case "stopsignal":
+		c.todo(cmd, "stop signals aren't converted, configure them where the image is run")
+	case "shell":
+		c.todo(cmd, "the run section is always run with sh, use the shell explicitly")
 	default:
-		log.Errorf("unknown Dockerfile cmd: %s", cmd.Cmd)
-		return errors.Errorf("unknown Dockerfile cmd: %s", cmd.Cmd)
+		c.todo(cmd, "unknown Dockerfile instruction")
 	}
 
 	return nil
 }
 
+// shellForm is the command of a CMD or ENTRYPOINT, which is run by sh unless
+// it's in the exec (json) form.
+func shellForm(cmd *Command) types.Command {
+	if cmd.Json {
+		return cmd.Value
+	}
+	return types.Command{"/bin/sh", "-c", strings.Join(cmd.Value, " ")}
+}
+
 func (c *Converter) parseFile() error {
 	file, err := os.Open(c.opts.InputFile)
 	if err != nil {
@@ -316,6 +474,7 @@ func (c *Converter) parseFile() error {
 		if child.Next != nil && len(child.Next.Children) > 0 {
 			cmd.SubCmd = child.Next.Children[0].Value
 			child = child.Next.Children[0]
+			cmd.Flags = child.Flags
 		}
 
 		cmd.Json = child.Attributes["json"]
@@ -328,13 +487,48 @@ func (c *Converter) parseFile() error {
 		}
 	}
 
+	c.saveStage()
+	if len(c.stages) == 0 {
+		return errors.Errorf("no FROM in %s", c.opts.InputFile)
+	}
+
+	// only the last stage is the image, the others are just for building
+	// it
+	for _, name := range c.stages[:len(c.stages)-1] {
+		c.output[name].BuildOnly = true
+	}
+
+	final := c.stages[len(c.stages)-1]
+	for _, trigger := range c.state[final].onbuild {
+		trigger := trigger
+		c.todo(&trigger, "images have no triggers, add it to the layers that are built on this one")
+	}
+	if !c.state[final].named {
+		c.output["${{IMAGE}}"] = c.output[final]
+		delete(c.output, final)
+		c.subs["IMAGE"] = "app"
+		for i := range c.todos {
+			if c.todos[i].layer == final {
+				c.todos[i].layer = "${{IMAGE}}"
+			}
+		}
+	}
+
 	out, err := yaml.Marshal(c.output)
 	if err != nil {
 		return err
 	}
 
+	if len(c.todos) > 0 {
+		header := "# TODO: these Dockerfile instructions weren't (completely) converted:\n"
+		for _, todo := range c.todos {
+			header += fmt.Sprintf("#   %s\n", todo.String())
+		}
+		out = append([]byte(header), out...)
+	}
+
 	if err := os.WriteFile(c.opts.OutputFile, out, 0644); err != nil {
-		return nil
+		return err
 	}
 
 	// we have substitutions, so write that out also
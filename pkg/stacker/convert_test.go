@@ -0,0 +1,115 @@
+package stacker
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"sigs.k8s.io/yaml"
+	"stackerbuild.io/stacker/pkg/types"
+)
+
+func TestConvertMultiStage(t *testing.T) {
+	assert := assert.New(t)
+
+	dir := t.TempDir()
+	dockerfile := `ARG GO_VERSION=1.21
+FROM golang:${GO_VERSION} AS builder
+ONBUILD RUN echo triggered
+ENV CGO_ENABLED=0
+WORKDIR /src
+COPY go.mod go.sum ./
+RUN go build -o /out/app .
+
+FROM builder AS test
+RUN go test ./...
+
+FROM alpine:3.19
+ENV PATH=/app:$PATH
+COPY --from=builder /out/app /app/
+COPY --from=0 --chmod=755 /src/run.sh /app/
+COPY --from=nginx:latest /etc/nginx/nginx.conf /etc/nginx/
+ADD --checksum=sha256:abcd https://example.com/data.tar.gz /data/
+USER 1000
+HEALTHCHECK CMD wget -q -O- http://localhost/
+ONBUILD COPY . /app
+ENTRYPOINT ["/app/app"]
+CMD serve --verbose
+`
+	assert.NoError(os.WriteFile(path.Join(dir, "Dockerfile"), []byte(dockerfile), 0644))
+
+	opts := ConvertArgs{
+		InputFile:      path.Join(dir, "Dockerfile"),
+		OutputFile:     path.Join(dir, "stacker.yaml"),
+		SubstituteFile: path.Join(dir, "stacker-subs.yaml"),
+	}
+	if !assert.NoError(NewConverter(&opts).Convert()) {
+		return
+	}
+
+	out, err := os.ReadFile(opts.OutputFile)
+	assert.NoError(err)
+	assert.True(strings.HasPrefix(string(out), "# TODO: "))
+	assert.Contains(string(out), "line 13 (${{IMAGE}}): ENV PATH=/app:$PATH")
+	assert.Contains(string(out), "line 19 (${{IMAGE}}): HEALTHCHECK")
+	assert.Contains(string(out), "line 20 (${{IMAGE}}): ONBUILD COPY . /app")
+
+	raw, err := os.ReadFile(opts.SubstituteFile)
+	assert.NoError(err)
+	subs := map[string]string{}
+	assert.NoError(yaml.Unmarshal(raw, &subs))
+	assert.Equal(map[string]string{"GO_VERSION": "1.21", "IMAGE": "app"}, subs)
+
+	substitutions := []string{}
+	for k, v := range subs {
+		substitutions = append(substitutions, fmt.Sprintf("%s=%s", k, v))
+	}
+	sf, err := types.NewStackerfile(opts.OutputFile, false, substitutions)
+	if !assert.NoError(err) {
+		return
+	}
+
+	builder, ok := sf.Get("builder")
+	assert.True(ok)
+	assert.True(builder.BuildOnly)
+	assert.Equal("docker://golang:1.21", builder.From.Url)
+	assert.Equal(map[string]string{"CGO_ENABLED": "0"}, builder.Environment)
+	assert.Equal("/src", builder.WorkingDir)
+	assert.Equal("/src", builder.Imports[1].Dest)
+
+	// stages built on another inherit its environment and triggers
+	test, ok := sf.Get("test")
+	assert.True(ok)
+	assert.True(test.BuildOnly)
+	assert.Equal(types.BuiltLayer, test.From.Type)
+	assert.Equal("builder", test.From.Tag)
+	assert.Contains(test.Run[0], "CGO_ENABLED=0")
+	assert.Contains(test.Run[1], "echo triggered")
+	assert.Contains(test.Run[len(test.Run)-1], "go test")
+
+	image, ok := sf.Get("app")
+	assert.True(ok)
+	assert.False(image.BuildOnly)
+	assert.Equal("1000", image.RuntimeUser)
+	assert.Equal(types.Command{"/app/app"}, image.Entrypoint)
+	assert.Equal(types.Command{"/bin/sh", "-c", "serve --verbose"}, image.Cmd)
+	assert.Equal("stacker://builder/out/app", image.Imports[0].Path)
+	assert.Equal("stacker://builder/src/run.sh", image.Imports[1].Path)
+	assert.NotNil(image.Imports[1].Mode)
+	assert.Equal(os.FileMode(0755), *image.Imports[1].Mode)
+	assert.Equal("stacker://nginx_latest/etc/nginx/nginx.conf", image.Imports[2].Path)
+	assert.Equal("https://example.com/data.tar.gz", image.Imports[3].Path)
+	assert.Equal("abcd", image.Imports[3].Hash)
+
+	nginx, ok := sf.Get("nginx_latest")
+	assert.True(ok)
+	assert.True(nginx.BuildOnly)
+	assert.Equal("docker://nginx:latest", nginx.From.Url)
+
+	order, err := sf.DependencyOrder(types.StackerFiles{sf.Path(): sf})
+	assert.NoError(err)
+	assert.Equal("app", order[len(order)-1])
+}
@@ -0,0 +1,206 @@
+package stacker
+
+import (
+	"archive/tar"
+	"context"
+	"io"
+	"io/fs"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/minio/sha256-simd"
+	"github.com/opencontainers/go-digest"
+	"github.com/opencontainers/umoci/oci/casext"
+	"github.com/pkg/errors"
+	stackeroci "stackerbuild.io/stacker/pkg/oci"
+)
+
+// ImageFile is what stacker diff compares of a file of an image.
+type ImageFile struct {
+	Mode     fs.FileMode   `json:"mode"`
+	Size     int64         `json:"size"`
+	Uid      int           `json:"uid"`
+	Gid      int           `json:"gid"`
+	Linkname string        `json:"linkname,omitempty"`
+	Digest   digest.Digest `json:"digest,omitempty"`
+}
+
+const (
+	FileAdded    = "added"
+	FileRemoved  = "removed"
+	FileModified = "modified"
+)
+
+// FileChange is a file that is different in two images: Before is it in the
+// first, and After in the second, either of which is nil if it's not there.
+type FileChange struct {
+	Path   string     `json:"path"`
+	Change string     `json:"change"`
+	Before *ImageFile `json:"before,omitempty"`
+	After  *ImageFile `json:"after,omitempty"`
+}
+
+// removeTree removes the files at or under p from files, except for those in
+// keep.
+func removeTree(files map[string]ImageFile, p string, keep map[string]bool) {
+	for name := range files {
+		if (p == "/" || name == p || strings.HasPrefix(name, p+"/")) && !keep[name] {
+			delete(files, name)
+		}
+	}
+}
+
+// ImageFiles returns the files of the image tagged tag in oci, by their
+// absolute paths, as its tar layers add and remove them.
+func ImageFiles(oci casext.Engine, tag string) (map[string]ImageFile, error) {
+	manifest, err := stackeroci.LookupManifest(oci, tag)
+	if err != nil {
+		return nil, err
+	}
+
+	files := map[string]ImageFile{}
+	for _, layer := range manifest.Layers {
+		blob, err := oci.GetVerifiedBlob(context.Background(), layer)
+		if err != nil {
+			return nil, errors.Wrapf(err, "couldn't read layer %s", layer.Digest)
+		}
+
+		err = func() error {
+			defer blob.Close()
+
+			uncompressed, closer, err := uncompressLayer(layer, blob)
+			if err != nil {
+				return err
+			}
+			defer closer()
+
+			// whiteouts only remove what's in the layers below
+			inLayer := map[string]bool{}
+
+			tr := tar.NewReader(uncompressed)
+			for {
+				hdr, err := tr.Next()
+				if err == io.EOF {
+					break
+				}
+				if err != nil {
+					return err
+				}
+
+				name := filepath.Clean("/" + hdr.Name)
+				base := path.Base(name)
+				if base == ".wh..wh..opq" {
+					// only what's in the directory
+					dir := path.Dir(name)
+					info, ok := files[dir]
+					removeTree(files, dir, inLayer)
+					if ok {
+						files[dir] = info
+					}
+					continue
+				}
+				if deleted, ok := strings.CutPrefix(base, ".wh."); ok {
+					removeTree(files, path.Join(path.Dir(name), deleted), inLayer)
+					continue
+				}
+				if name == "/" {
+					continue
+				}
+
+				info := ImageFile{
+					Mode:     hdr.FileInfo().Mode(),
+					Uid:      hdr.Uid,
+					Gid:      hdr.Gid,
+					Linkname: hdr.Linkname,
+				}
+				switch hdr.Typeflag {
+				case tar.TypeReg:
+					h := sha256.New()
+					info.Size, err = io.Copy(h, tr)
+					if err != nil {
+						return err
+					}
+					info.Digest = digest.NewDigest(digest.SHA256, h)
+				case tar.TypeLink:
+					// a hard link is the same file as what it
+					// links to
+					target := files[filepath.Clean("/"+hdr.Linkname)]
+					info.Mode = target.Mode
+					info.Size = target.Size
+					info.Digest = target.Digest
+				}
+
+				// a directory only replaces the metadata of one
+				// that's already there, anything else replaces what
+				// was in it too
+				if prev, ok := files[name]; ok && prev.Mode.IsDir() && !info.Mode.IsDir() {
+					removeTree(files, name, inLayer)
+				}
+				files[name] = info
+				inLayer[name] = true
+			}
+
+			return nil
+		}()
+		if err != nil {
+			return nil, errors.Wrapf(err, "couldn't read layer %s of %s", layer.Digest, tag)
+		}
+	}
+
+	return files, nil
+}
+
+// inPaths returns true if name is one of paths or under one of them, or if
+// there are no paths.
+func inPaths(name string, paths []string) bool {
+	if len(paths) == 0 {
+		return true
+	}
+	for _, p := range paths {
+		p = filepath.Clean("/" + p)
+		if p == "/" || name == p || strings.HasPrefix(name, p+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// Diff returns the files that are different in the images tagged a and b in
+// oci, by path, optionally only those at or under paths.
+func Diff(oci casext.Engine, a string, b string, paths []string) ([]FileChange, error) {
+	before, err := ImageFiles(oci, a)
+	if err != nil {
+		return nil, err
+	}
+
+	after, err := ImageFiles(oci, b)
+	if err != nil {
+		return nil, err
+	}
+
+	changes := []FileChange{}
+	for name, info := range before {
+		if !inPaths(name, paths) {
+			continue
+		}
+		info := info
+		other, ok := after[name]
+		if !ok {
+			changes = append(changes, FileChange{Path: name, Change: FileRemoved, Before: &info})
+		} else if other != info {
+			changes = append(changes, FileChange{Path: name, Change: FileModified, Before: &info, After: &other})
+		}
+	}
+	for name, info := range after {
+		if _, ok := before[name]; ok || !inPaths(name, paths) {
+			continue
+		}
+		info := info
+		changes = append(changes, FileChange{Path: name, Change: FileAdded, After: &info})
+	}
+
+	sort.Slice(changes, func(i, j int) bool { return changes[i].Path < changes[j].Path })
+	return changes, nil
+}
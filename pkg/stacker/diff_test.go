@@ -0,0 +1,122 @@
+package stacker
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"path"
+	"testing"
+
+	"github.com/opencontainers/image-spec/specs-go"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/opencontainers/umoci"
+	"github.com/opencontainers/umoci/oci/casext"
+	"github.com/stretchr/testify/assert"
+)
+
+type tarEntry struct {
+	name     string
+	content  string
+	typeflag byte
+	mode     int64
+}
+
+// putTarImage adds an image of the uncompressed tar layers to oci, tagged tag.
+func putTarImage(t *testing.T, oci casext.Engine, tag string, layers ...[]tarEntry) {
+	ctx := context.Background()
+
+	manifest := ispec.Manifest{Versioned: specs.Versioned{SchemaVersion: 2}, MediaType: ispec.MediaTypeImageManifest}
+	for _, entries := range layers {
+		buf := bytes.Buffer{}
+		tw := tar.NewWriter(&buf)
+		for _, e := range entries {
+			typeflag := e.typeflag
+			if typeflag == 0 {
+				typeflag = tar.TypeReg
+			}
+			mode := e.mode
+			if mode == 0 {
+				mode = 0644
+			}
+			hdr := &tar.Header{Name: e.name, Typeflag: typeflag, Mode: mode, Size: int64(len(e.content))}
+			if typeflag != tar.TypeReg {
+				hdr.Size = 0
+			}
+			assert.NoError(t, tw.WriteHeader(hdr))
+			if typeflag == tar.TypeReg {
+				_, err := tw.Write([]byte(e.content))
+				assert.NoError(t, err)
+			}
+		}
+		assert.NoError(t, tw.Close())
+
+		d, size, err := oci.PutBlob(ctx, &buf)
+		assert.NoError(t, err)
+		manifest.Layers = append(manifest.Layers, ispec.Descriptor{MediaType: ispec.MediaTypeImageLayer, Digest: d, Size: size})
+	}
+
+	d, size, err := oci.PutBlobJSON(ctx, ispec.Image{})
+	assert.NoError(t, err)
+	manifest.Config = ispec.Descriptor{MediaType: ispec.MediaTypeImageConfig, Digest: d, Size: size}
+
+	d, size, err = oci.PutBlobJSON(ctx, manifest)
+	assert.NoError(t, err)
+	assert.NoError(t, oci.UpdateReference(ctx, tag, ispec.Descriptor{MediaType: ispec.MediaTypeImageManifest, Digest: d, Size: size}))
+}
+
+func TestDiff(t *testing.T) {
+	assert := assert.New(t)
+
+	oci, err := umoci.CreateLayout(path.Join(t.TempDir(), "oci"))
+	if !assert.NoError(err) {
+		return
+	}
+	defer oci.Close()
+
+	base := []tarEntry{
+		{name: "etc/", typeflag: tar.TypeDir, mode: 0755},
+		{name: "etc/passwd", content: "root"},
+		{name: "etc/motd", content: "hello"},
+		{name: "var/", typeflag: tar.TypeDir, mode: 0755},
+		{name: "var/cache/", typeflag: tar.TypeDir, mode: 0755},
+		{name: "var/cache/a", content: "a"},
+	}
+	putTarImage(t, oci, "a", base)
+	putTarImage(t, oci, "b", base, []tarEntry{
+		{name: "etc/passwd", content: "root:x:0:0"},
+		{name: "etc/motd", content: "hello", mode: 0600},
+		{name: "etc/hosts", content: "localhost"},
+		{name: "var/cache/", typeflag: tar.TypeDir, mode: 0755},
+		{name: "var/cache/.wh..wh..opq", typeflag: tar.TypeReg},
+		{name: "var/cache/b", content: "b"},
+	})
+
+	files, err := ImageFiles(oci, "b")
+	assert.NoError(err)
+	assert.NotContains(files, "/var/cache/a")
+	assert.Equal(int64(10), files["/etc/passwd"].Size)
+
+	changes, err := Diff(oci, "a", "b", nil)
+	assert.NoError(err)
+	summary := map[string]string{}
+	for _, c := range changes {
+		summary[c.Path] = c.Change
+	}
+	assert.Equal(map[string]string{
+		"/etc/hosts":   FileAdded,
+		"/etc/motd":    FileModified,
+		"/etc/passwd":  FileModified,
+		"/var/cache/a": FileRemoved,
+		"/var/cache/b": FileAdded,
+	}, summary)
+	assert.Equal("/etc/hosts", changes[0].Path)
+
+	changes, err = Diff(oci, "a", "b", []string{"/var"})
+	assert.NoError(err)
+	assert.Len(changes, 2)
+
+	// an image doesn't differ from itself
+	changes, err = Diff(oci, "b", "b", nil)
+	assert.NoError(err)
+	assert.Empty(changes)
+}
@@ -0,0 +1,103 @@
+package stacker
+
+import (
+	"encoding/hex"
+	"strings"
+
+	"github.com/pkg/errors"
+	"stackerbuild.io/stacker/pkg/lib"
+)
+
+// digestLengths are the lengths of the hex encoded digests of the algorithms
+// we know about.
+var digestLengths = map[string]int{
+	"sha256": 64,
+	"sha512": 128,
+	"sha1":   40,
+}
+
+// ParseDigest canonicalizes a digest as found in build files, headers and
+// sidecars: "sha256:ABC...", "sha256=abc...", or bare hex, with any
+// surrounding whitespace and in any case. It returns the algorithm and the
+// lowercase hex digest. Bare hex digests are taken to be of the algorithm
+// their length fits, sha256 for 64 characters. Malformed digests, and digests
+// of the wrong length for their algorithm, are rejected.
+func ParseDigest(s string) (string, string, error) {
+	v := strings.TrimSpace(s)
+	algorithm := ""
+	if i := strings.IndexAny(v, ":="); i >= 0 {
+		algorithm = strings.ToLower(strings.TrimSpace(v[:i]))
+		v = strings.TrimSpace(v[i+1:])
+	}
+	v = strings.ToLower(v)
+
+	if algorithm == "" {
+		for a, l := range digestLengths {
+			if len(v) == l {
+				algorithm = a
+			}
+		}
+		if algorithm == "" {
+			return "", "", errors.Errorf("invalid digest %q: %d hex characters fit no known algorithm", s, len(v))
+		}
+	}
+
+	l, ok := digestLengths[algorithm]
+	if !ok {
+		return "", "", errors.Errorf("invalid digest %q: unknown algorithm %s", s, algorithm)
+	}
+	if len(v) != l {
+		return "", "", errors.Errorf("invalid digest %q: a %s digest has %d hex characters, not %d", s, algorithm, l, len(v))
+	}
+	if _, err := hex.DecodeString(v); err != nil {
+		return "", "", errors.Errorf("invalid digest %q: not hex encoded", s)
+	}
+
+	return algorithm, v, nil
+}
+
+// canonicalSHA256 returns the sha256 digest s as lowercase hex, or the empty
+// string if s is empty.
+func canonicalSHA256(s string) (string, error) {
+	if strings.TrimSpace(s) == "" {
+		return "", nil
+	}
+
+	algorithm, v, err := ParseDigest(s)
+	if err != nil {
+		return "", err
+	}
+	if algorithm != "sha256" {
+		return "", errors.Errorf("invalid digest %q: expected a sha256 digest, not %s", s, algorithm)
+	}
+
+	return v, nil
+}
+
+// sha256File returns the sha256 of the file name, as lowercase hex.
+func sha256File(name string) (string, error) {
+	hash, err := lib.HashFile(name, false)
+	if err != nil {
+		return "", err
+	}
+
+	_, v, err := ParseDigest(hash)
+	return v, err
+}
+
+// canonicalHashes returns opts with its expected hashes canonicalized, so that
+// they can be compared as they are with the digests we compute.
+func canonicalHashes(opts DownloadOptions) (DownloadOptions, error) {
+	var err error
+	opts.ExpectedHash, err = canonicalSHA256(opts.ExpectedHash)
+	if err != nil {
+		return opts, errors.Wrapf(err, "invalid expected hash")
+	}
+
+	opts.ExpectedUncompressedHash, err = canonicalSHA256(opts.ExpectedUncompressedHash)
+	if err != nil {
+		return opts, errors.Wrapf(err, "invalid expected uncompressed hash")
+	}
+
+	return opts, nil
+}
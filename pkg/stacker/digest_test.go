@@ -0,0 +1,46 @@
+package stacker
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseDigest(t *testing.T) {
+	sha256 := "b94d27b9934d3e08a52e52d7da7dabfac484efe37a5380ee9088f7ace2efcde9"
+	sha1 := "2aae6c35c94fcfb415dbe95f408b9ce91ee846ed"
+	sha512 := strings.Repeat("0f", 64)
+
+	for _, tc := range []struct {
+		digest    string
+		algorithm string
+		hex       string
+	}{
+		{sha256, "sha256", sha256},
+		{strings.ToUpper(sha256), "sha256", sha256},
+		{" sha256:" + sha256 + "\n", "sha256", sha256},
+		{"SHA256=" + sha256, "sha256", sha256},
+		{sha1, "sha1", sha1},
+		{"sha512:" + sha512, "sha512", sha512},
+		{sha512, "sha512", sha512},
+		{"", "", ""},
+		{"sha256:", "", ""},
+		{sha256[1:], "", ""},
+		{sha256 + "0", "", ""},
+		{"sha1:" + sha256, "", ""},
+		{"md5:d41d8cd98f00b204e9800998ecf8427e", "", ""},
+		{"g" + sha256[1:], "", ""},
+	} {
+		t.Run(tc.digest, func(t *testing.T) {
+			algorithm, hex, err := ParseDigest(tc.digest)
+			if tc.hex == "" {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tc.algorithm, algorithm)
+			assert.Equal(t, tc.hex, hex)
+		})
+	}
+}
@@ -0,0 +1,293 @@
+package stacker
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+)
+
+// DownloadRequest is a single file for DownloadAll to fetch.
+type DownloadRequest struct {
+	URL  string
+	Opts DownloadOptions
+
+	// CacheDir, if set, is where this file is cached instead of
+	// DownloadAll's cacheDir (which still holds the journal).
+	CacheDir string
+
+	// Critical downloads are those without which the rest are useless:
+	// if one fails, DownloadAll gives up on all the others.
+	Critical bool
+}
+
+// DownloadResult describes a file that was downloaded into the cache.
+type DownloadResult struct {
+	URL    string
+	Path   string
+	Digest digest.Digest
+
+	// FinalURL is where URL redirected to when the cached file was
+	// downloaded, i.e. what actually served it; it is URL (without any
+	// checksum fragment) if there were no redirects.
+	FinalURL string
+}
+
+// DownloadWithResult is DownloadWithOptions, also returning the digest of the
+// cached file.
+func DownloadWithResult(cacheDir string, url string, opts DownloadOptions) (DownloadResult, error) {
+	name, err := DownloadWithOptions(cacheDir, url, opts)
+	if err != nil {
+		return DownloadResult{}, err
+	}
+
+	src, _ := splitChecksumFragment(url)
+	hash, err := cachedDigest(name, src, opts)
+	if err != nil {
+		return DownloadResult{}, err
+	}
+
+	meta, err := readCacheMeta(name)
+	if err != nil {
+		return DownloadResult{}, err
+	}
+
+	result := DownloadResult{URL: url, Path: name, Digest: digest.NewDigestFromEncoded(digest.SHA256, hash), FinalURL: src}
+	if meta.Source == src && meta.FinalURL != "" {
+		result.FinalURL = meta.FinalURL
+	}
+
+	return result, nil
+}
+
+// DownloadAll downloads each of reqs into cacheDir, returning the results in
+// the same order. Failures name the URL that failed; they are all reported
+// once the other downloads are done, except for those of critical requests,
+// which abort the downloads in progress and are returned right away. Progress
+// is journaled (see DownloadAllOptions.Journal), so a DownloadAll that was
+// interrupted picks up where it left off when it is run again.
+func DownloadAll(cacheDir string, reqs []DownloadRequest) ([]DownloadResult, error) {
+	return DownloadAllWithOptions(cacheDir, reqs, DownloadAllOptions{Jobs: 1, Journal: true})
+}
+
+// defaultUnknownSizeWeight is how much of a ByteBudget a download of unknown
+// size takes by default.
+const defaultUnknownSizeWeight = 64 << 20
+
+// DownloadAllOptions configure how DownloadAllWithOptions runs downloads
+// concurrently.
+type DownloadAllOptions struct {
+	// Jobs is how many downloads may run at once; zero means as many as
+	// ByteBudget allows.
+	Jobs int
+
+	// ByteBudget, if set, caps the sum of the sizes of the downloads in
+	// progress: a download only starts once it fits. Sizes come from
+	// the requests' ExpectedSize, or else from asking the server (see
+	// FileInfo). A download bigger than the whole budget runs alone.
+	ByteBudget int64
+
+	// UnknownSizeWeight is what a download whose size can't be found out
+	// counts against ByteBudget, 64MiB if zero.
+	UnknownSizeWeight int64
+
+	// Journal, if set, records the progress of the downloads in cacheDir
+	// and makes them resumable (see DownloadOptions.Resume): if the
+	// process dies, running the same downloads again skips those that
+	// completed and resumes the others. The journal is removed once all
+	// of them succeeded.
+	Journal bool
+}
+
+// DownloadAllWithOptions is DownloadAll, running the downloads concurrently
+// as opts allow. Downloads are started in order; when a critical one fails,
+// those in progress are cancelled and no new ones are started.
+func DownloadAllWithOptions(cacheDir string, reqs []DownloadRequest, opts DownloadAllOptions) ([]DownloadResult, error) {
+	jobs := opts.Jobs
+	if jobs <= 0 {
+		jobs = len(reqs)
+	}
+
+	budget := newByteBudget(opts.ByteBudget)
+	slots := make(chan struct{}, max(jobs, 1))
+
+	var journal *downloadJournal
+	if opts.Journal {
+		var err error
+		journal, err = openJournal(cacheDir)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	results := make([]DownloadResult, len(reqs))
+	errs := make([]error, len(reqs))
+	var abort error
+	abortOnce := sync.Once{}
+	wg := sync.WaitGroup{}
+	for i, req := range reqs {
+		if ctx.Err() != nil {
+			break
+		}
+
+		if req.CacheDir == "" {
+			req.CacheDir = cacheDir
+		}
+
+		if journal != nil {
+			if result, ok := journal.completed(req); ok {
+				results[i] = result
+				continue
+			}
+			req.Opts.Resume = true
+		}
+
+		weight := int64(0)
+		if opts.ByteBudget > 0 {
+			weight = downloadWeight(ctx, req, opts)
+		}
+
+		slots <- struct{}{}
+		budget.acquire(weight)
+		if ctx.Err() != nil {
+			budget.release(weight)
+			<-slots
+			break
+		}
+
+		wg.Add(1)
+		go func(i int, req DownloadRequest, weight int64) {
+			defer wg.Done()
+			defer func() { <-slots }()
+			defer budget.release(weight)
+
+			req.Opts.ctx = ctx
+			result, err := DownloadWithResult(req.CacheDir, req.URL, req.Opts)
+			if journal != nil {
+				journal.update(req, result, err)
+			}
+			if err != nil {
+				errs[i] = errors.Wrapf(err, "couldn't download %s", req.URL)
+				if req.Critical {
+					abortOnce.Do(func() {
+						abort = errs[i]
+						cancel()
+					})
+				}
+				return
+			}
+			results[i] = result
+		}(i, req, weight)
+	}
+	wg.Wait()
+
+	if abort != nil {
+		return nil, abort
+	}
+
+	failures := []error{}
+	for _, err := range errs {
+		if err != nil {
+			failures = append(failures, err)
+		}
+	}
+
+	switch len(failures) {
+	case 0:
+		if journal != nil {
+			return results, journal.clear()
+		}
+		return results, nil
+	case 1:
+		return nil, failures[0]
+	}
+
+	for _, err := range failures {
+		netLog.Errorf("%v", err)
+	}
+	return nil, errors.Wrapf(failures[0], "%d downloads failed, the first", len(failures))
+}
+
+// downloadWeight returns how much of the byte budget downloading req takes.
+func downloadWeight(ctx context.Context, req DownloadRequest, opts DownloadAllOptions) int64 {
+	if req.Opts.ExpectedSize > 0 {
+		return req.Opts.ExpectedSize
+	}
+
+	url, _ := splitChecksumFragment(req.URL)
+	info, err := fileInfo(ctx, url, req.Opts)
+	if err == nil && info.Size >= 0 {
+		return info.Size
+	}
+
+	if opts.UnknownSizeWeight > 0 {
+		return opts.UnknownSizeWeight
+	}
+	return defaultUnknownSizeWeight
+}
+
+// byteBudget is a semaphore counting bytes. It never blocks a weight when
+// nothing else holds any of the budget, so that downloads bigger than the
+// whole budget still run, alone.
+type byteBudget struct {
+	capacity int64
+
+	mu       sync.Mutex
+	cond     *sync.Cond
+	inFlight int64
+}
+
+// newByteBudget returns a byteBudget of capacity bytes; zero is unlimited.
+func newByteBudget(capacity int64) *byteBudget {
+	b := &byteBudget{capacity: capacity}
+	b.cond = sync.NewCond(&b.mu)
+	return b
+}
+
+func (b *byteBudget) acquire(n int64) {
+	if b.capacity <= 0 {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for b.inFlight > 0 && b.inFlight+n > b.capacity {
+		b.cond.Wait()
+	}
+	b.inFlight += n
+}
+
+func (b *byteBudget) release(n int64) {
+	if b.capacity <= 0 {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.inFlight -= n
+	b.cond.Broadcast()
+}
+
+// InputsDigest combines the results of all of a build's downloads into a
+// single digest: builds that downloaded the same content from the same URLs
+// get the same one, regardless of the order they were downloaded in.
+func InputsDigest(results []DownloadResult) digest.Digest {
+	inputs := make([]string, 0, len(results))
+	for _, r := range results {
+		inputs = append(inputs, fmt.Sprintf("%s %s\n", r.Digest, r.URL))
+	}
+	sort.Strings(inputs)
+
+	digester := digest.Canonical.Digester()
+	for _, input := range inputs {
+		digester.Hash().Write([]byte(input))
+	}
+
+	return digester.Digest()
+}
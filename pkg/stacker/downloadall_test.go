@@ -0,0 +1,145 @@
+package stacker
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestInputsDigest(t *testing.T) {
+	assert := assert.New(t)
+
+	a := DownloadResult{URL: "https://example.com/a", Digest: "sha256:aaaa"}
+	b := DownloadResult{URL: "https://example.com/b", Digest: "sha256:bbbb"}
+
+	assert.Equal(InputsDigest([]DownloadResult{a, b}), InputsDigest([]DownloadResult{b, a}))
+
+	changed := b
+	changed.Digest = "sha256:cccc"
+	assert.NotEqual(InputsDigest([]DownloadResult{a, b}), InputsDigest([]DownloadResult{a, changed}))
+
+	moved := b
+	moved.URL = "https://example.com/c"
+	assert.NotEqual(InputsDigest([]DownloadResult{a, b}), InputsDigest([]DownloadResult{a, moved}))
+}
+
+func TestDownloadFinalURL(t *testing.T) {
+	assert := assert.New(t)
+
+	srv := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/stable/file":
+			http.Redirect(w, r, "/v1.2/file?signature=abc", http.StatusFound)
+		case "/v1.2/file":
+			w.Write([]byte("hello world"))
+		}
+	})
+
+	cacheDir := t.TempDir()
+	for i := 0; i < 2; i++ {
+		result, err := DownloadWithResult(cacheDir, srv.URL+"/stable/file", DownloadOptions{})
+		assert.NoError(err)
+		assert.Equal(srv.URL+"/stable/file", result.URL)
+		assert.Equal(srv.URL+"/v1.2/file?signature=abc", result.FinalURL)
+	}
+}
+
+func TestDownloadAllByteBudget(t *testing.T) {
+	assert := assert.New(t)
+
+	var mu sync.Mutex
+	inFlight, most := 0, 0
+	srv := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		inFlight++
+		most = max(most, inFlight)
+		mu.Unlock()
+
+		time.Sleep(20 * time.Millisecond)
+		if r.URL.Path == "/bad" {
+			w.WriteHeader(http.StatusNotFound)
+		} else {
+			w.Write(bytes.Repeat([]byte("x"), 100))
+		}
+
+		mu.Lock()
+		inFlight--
+		mu.Unlock()
+	})
+
+	reqs := []DownloadRequest{}
+	for i := 0; i < 6; i++ {
+		reqs = append(reqs, DownloadRequest{URL: fmt.Sprintf("%s/file%d", srv.URL, i), Opts: DownloadOptions{ChecksumOptions: ChecksumOptions{ExpectedSize: 100}}})
+	}
+
+	results, err := DownloadAllWithOptions(t.TempDir(), reqs, DownloadAllOptions{ByteBudget: 250})
+	assert.NoError(err)
+	assert.Len(results, 6)
+	for i, r := range results {
+		assert.Equal(reqs[i].URL, r.URL)
+	}
+	mu.Lock()
+	assert.Equal(2, most)
+	most = 0
+	mu.Unlock()
+
+	// files bigger than the budget still get downloaded, one at a time
+	_, err = DownloadAllWithOptions(t.TempDir(), reqs, DownloadAllOptions{ByteBudget: 50})
+	assert.NoError(err)
+	mu.Lock()
+	assert.Equal(1, most)
+	mu.Unlock()
+
+	reqs[1].URL = srv.URL + "/bad"
+	_, err = DownloadAllWithOptions(t.TempDir(), reqs, DownloadAllOptions{ByteBudget: 250})
+	assert.ErrorContains(err, "/bad")
+}
+
+func TestDownloadAllCritical(t *testing.T) {
+	assert := assert.New(t)
+
+	var slowCancelled atomic.Bool
+	srv := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/slow":
+			select {
+			case <-r.Context().Done():
+				slowCancelled.Store(true)
+			case <-time.After(10 * time.Second):
+			}
+		case "/ok":
+			w.Write([]byte("hello world"))
+		default:
+			time.Sleep(20 * time.Millisecond)
+			w.WriteHeader(http.StatusNotFound)
+		}
+	})
+
+	// a critical failure cancels the downloads in progress
+	reqs := []DownloadRequest{
+		{URL: srv.URL + "/slow"},
+		{URL: srv.URL + "/base", Critical: true},
+		{URL: srv.URL + "/ok"},
+	}
+	start := time.Now()
+	_, err := DownloadAllWithOptions(t.TempDir(), reqs, DownloadAllOptions{})
+	assert.ErrorContains(err, "/base")
+	assert.Less(time.Since(start), 5*time.Second)
+	assert.Eventually(slowCancelled.Load, time.Second, 10*time.Millisecond)
+
+	// other failures are all collected
+	reqs = []DownloadRequest{
+		{URL: srv.URL + "/missing1"},
+		{URL: srv.URL + "/ok"},
+		{URL: srv.URL + "/missing2"},
+	}
+	_, err = DownloadAllWithOptions(t.TempDir(), reqs, DownloadAllOptions{Jobs: 1})
+	assert.ErrorContains(err, "2 downloads failed")
+	assert.ErrorContains(err, "/missing1")
+}
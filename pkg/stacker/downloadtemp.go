@@ -0,0 +1,134 @@
+package stacker
+
+import (
+	"os"
+	"path"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// DownloadTemp downloads url, configured by opts, into a new temporary
+// directory under root (or the default temporary directory if root is empty)
+// instead of a long-lived cache dir. It returns the downloaded file and a
+// function that removes it again.
+func DownloadTemp(root string, url string, opts DownloadOptions) (string, func() error, error) {
+	if root != "" {
+		err := createCacheDir(root, opts.DirMode)
+		if err != nil {
+			return "", nil, errors.Wrapf(err, "couldn't create temp dir %s", root)
+		}
+	}
+
+	dir, err := os.MkdirTemp(root, "download-")
+	if err != nil {
+		return "", nil, errors.Wrapf(err, "couldn't create temp dir for %s", url)
+	}
+
+	cleanup := func() error {
+		return errors.Wrapf(os.RemoveAll(dir), "couldn't remove temp download of %s", url)
+	}
+
+	// nothing else may be seeded into or left in a throwaway dir
+	opts.BaseCaches = nil
+	opts.Resume = false
+
+	name, err := DownloadWithOptions(dir, url, opts)
+	if err != nil {
+		cleanup()
+		return "", nil, err
+	}
+
+	return name, cleanup, nil
+}
+
+// TempDownloads tracks the temporary downloads of a build, so that they can
+// all be removed when it finishes. It is safe for concurrent use.
+type TempDownloads struct {
+	Root string
+
+	mu       sync.Mutex
+	cleanups []func() error
+}
+
+// Download is DownloadTemp under t.Root, registering the download for removal
+// by Cleanup.
+func (t *TempDownloads) Download(url string, opts DownloadOptions) (string, error) {
+	name, cleanup, err := DownloadTemp(t.Root, url, opts)
+	if err != nil {
+		return "", err
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.cleanups = append(t.cleanups, cleanup)
+	return name, nil
+}
+
+// Cleanup removes all the downloads made through t, returning the first error
+// it ran into.
+func (t *TempDownloads) Cleanup() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var first error
+	for _, cleanup := range t.cleanups {
+		if err := cleanup(); err != nil && first == nil {
+			first = err
+		}
+	}
+	t.cleanups = nil
+
+	return first
+}
+
+// DownloadVerified downloads url fresh to dest, without reading or writing
+// any cache, for one-shot uses where caching is pointless but integrity is
+// not optional: a digest to verify the download against is required, either
+// opts.ExpectedHash or a #sha256=<hash> fragment on url. dest may be a file or
+// an existing directory to download into; if it is empty, the download goes
+// to a new temporary file, which the caller is responsible for removing. The
+// returned name is where the file ended up; nothing is left behind if the
+// download fails or doesn't verify.
+func DownloadVerified(dest string, url string, opts DownloadOptions) (string, error) {
+	if _, fragmentHash := splitChecksumFragment(url); opts.ExpectedHash == "" && fragmentHash == "" {
+		return "", errors.Errorf("no digest to verify %s against", url)
+	}
+
+	root := ""
+	target := dest
+	if dest == "" {
+		f, err := os.CreateTemp("", "download-*-"+path.Base(CachePath("", url)))
+		if err != nil {
+			return "", errors.Wrapf(err, "couldn't create temp file for %s", url)
+		}
+		f.Close()
+		target = f.Name()
+	} else if fi, err := os.Stat(dest); err == nil && fi.IsDir() {
+		root = dest
+		target = path.Join(dest, path.Base(CachePath("", url)))
+	} else {
+		// stay on dest's filesystem, so that the download can be
+		// moved in place
+		root = path.Dir(dest)
+	}
+
+	name, cleanup, err := DownloadTemp(root, url, opts)
+	if err != nil {
+		if dest == "" {
+			os.Remove(target)
+		}
+		return "", err
+	}
+	defer cleanup()
+
+	err = os.Rename(name, target)
+	if err != nil {
+		if dest == "" {
+			os.Remove(target)
+		}
+		return "", errors.Wrapf(err, "couldn't move download of %s to %s", url, target)
+	}
+
+	return target, nil
+}
@@ -0,0 +1,64 @@
+package stacker
+
+import (
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTempDownloads(t *testing.T) {
+	assert := assert.New(t)
+
+	temp := TempDownloads{Root: t.TempDir()}
+	opts := DownloadOptions{Uid: os.Getuid(), Gid: os.Getgid(), TransportOptions: TransportOptions{Transport: &fakeTransport{body: "hello world"}}}
+
+	a, err := temp.Download("https://example.com/foo", opts)
+	assert.NoError(err)
+	b, err := temp.Download("https://example.com/foo", opts)
+	assert.NoError(err)
+	assert.NotEqual(a, b)
+	assert.FileExists(a)
+
+	assert.NoError(temp.Cleanup())
+	assert.NoFileExists(a)
+	assert.NoFileExists(b)
+}
+
+func TestDownloadVerified(t *testing.T) {
+	assert := assert.New(t)
+
+	hash := "b94d27b9934d3e08a52e52d7da7dabfac484efe37a5380ee9088f7ace2efcde9"
+	opts := DownloadOptions{Uid: os.Getuid(), Gid: os.Getgid(), TransportOptions: TransportOptions{Transport: &fakeTransport{body: "hello world"}}}
+
+	_, err := DownloadVerified("", "https://example.com/foo", opts)
+	assert.ErrorContains(err, "no digest")
+
+	dir := t.TempDir()
+	name, err := DownloadVerified(path.Join(dir, "bar"), "https://example.com/foo#sha256="+hash, opts)
+	assert.NoError(err)
+	assert.Equal(path.Join(dir, "bar"), name)
+
+	name, err = DownloadVerified(dir, "https://example.com/foo", DownloadOptions{ChecksumOptions: ChecksumOptions{ExpectedHash: hash}, TransportOptions: TransportOptions{Transport: opts.Transport}})
+	assert.NoError(err)
+	assert.Equal(path.Join(dir, "foo"), name)
+
+	// nothing but the downloads is left behind
+	entries, err := os.ReadDir(dir)
+	assert.NoError(err)
+	assert.Len(entries, 2)
+
+	name, err = DownloadVerified("", "https://example.com/foo", DownloadOptions{ChecksumOptions: ChecksumOptions{ExpectedHash: hash}, TransportOptions: TransportOptions{Transport: opts.Transport}})
+	assert.NoError(err)
+	assert.FileExists(name)
+	os.Remove(name)
+
+	_, err = DownloadVerified(path.Join(dir, "bad"), "https://example.com/foo", DownloadOptions{ChecksumOptions: ChecksumOptions{ExpectedHash: strings.Repeat("0", 64)}, TransportOptions: TransportOptions{Transport: opts.Transport}})
+	assert.ErrorAs(err, new(*ChecksumMismatchError))
+	assert.NoFileExists(path.Join(dir, "bad"))
+	entries, err = os.ReadDir(dir)
+	assert.NoError(err)
+	assert.Len(entries, 2)
+}
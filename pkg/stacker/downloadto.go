@@ -0,0 +1,28 @@
+package stacker
+
+import (
+	"io"
+	"os"
+
+	"github.com/pkg/errors"
+)
+
+// DownloadTo downloads url into cacheDir as DownloadWithOptions does, and then
+// copies the cached file to w, e.g. os.Stdout for a pipeline. The copy only
+// starts once the file has been verified, so nothing that fails verification
+// ever reaches w. Logs and the progress bar go to stderr, never to w.
+func DownloadTo(w io.Writer, cacheDir string, url string, opts DownloadOptions) error {
+	name, err := DownloadWithOptions(cacheDir, url, opts)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.Open(name)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer f.Close()
+
+	_, err = io.Copy(w, f)
+	return errors.Wrapf(err, "couldn't write %s", url)
+}
@@ -0,0 +1,33 @@
+package stacker
+
+import (
+	"bytes"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDownloadTo(t *testing.T) {
+	assert := assert.New(t)
+
+	srv := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hello world"))
+	})
+
+	cacheDir := t.TempDir()
+	out := &bytes.Buffer{}
+	err := DownloadTo(out, cacheDir, srv.URL+"/file", DownloadOptions{
+		ChecksumOptions: ChecksumOptions{
+			ExpectedHash: "b94d27b9934d3e08a52e52d7da7dabfac484efe37a5380ee9088f7ace2efcde9",
+		},
+	})
+	assert.NoError(err)
+	assert.Equal("hello world", out.String())
+
+	out.Reset()
+	err = DownloadTo(out, cacheDir, srv.URL+"/other", DownloadOptions{ChecksumOptions: ChecksumOptions{ExpectedHash: strings.Repeat("0", 64)}})
+	assert.ErrorAs(err, new(*ChecksumMismatchError))
+	assert.Equal(0, out.Len())
+}
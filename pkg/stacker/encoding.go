@@ -0,0 +1,50 @@
+package stacker
+
+import (
+	"compress/gzip"
+	"io"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/pkg/errors"
+)
+
+// acceptEncoding returns the Accept-Encoding header for opts.Encodings, or ""
+// if the server should send the file as is.
+func acceptEncoding(opts DownloadOptions) string {
+	return strings.Join(opts.Encodings, ", ")
+}
+
+// decodeBody undoes the Content-Encoding the server applied to body.
+func decodeBody(encoding string, body io.Reader) (io.ReadCloser, error) {
+	switch strings.ToLower(strings.TrimSpace(encoding)) {
+	case "", "identity":
+		return io.NopCloser(body), nil
+	case "gzip", "x-gzip":
+		gz, err := gzip.NewReader(body)
+		if err != nil {
+			return nil, errors.Wrapf(err, "couldn't decompress gzip response")
+		}
+		return gz, nil
+	case "zstd":
+		zr, err := zstd.NewReader(body)
+		if err != nil {
+			return nil, errors.Wrapf(err, "couldn't decompress zstd response")
+		}
+		return zr.IOReadCloser(), nil
+	}
+
+	return nil, errors.Errorf("unsupported Content-Encoding %s", encoding)
+}
+
+// countingReader counts the bytes read through it.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,42 @@
+package stacker
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDownloadEncoding(t *testing.T) {
+	assert := assert.New(t)
+
+	compressed := bytes.Buffer{}
+	gz := gzip.NewWriter(&compressed)
+	gz.Write([]byte("hello world"))
+	gz.Close()
+
+	srv := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		if !strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") {
+			w.Write([]byte("hello world"))
+			return
+		}
+		w.Header().Set("Content-Encoding", "gzip")
+		w.Header().Set("Content-Length", fmt.Sprintf("%d", compressed.Len()))
+		w.Write(compressed.Bytes())
+	})
+
+	dir := t.TempDir()
+	opts := DownloadOptions{Uid: os.Getuid(), Gid: os.Getgid(), TransportOptions: TransportOptions{Encodings: []string{"zstd", "gzip"}}}
+
+	name, err := DownloadWithOptions(dir, srv.URL+"/foo", opts)
+	assert.NoError(err)
+
+	content, err := os.ReadFile(name)
+	assert.NoError(err)
+	assert.Equal("hello world", string(content))
+}
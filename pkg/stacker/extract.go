@@ -0,0 +1,163 @@
+package stacker
+
+import (
+	"archive/zip"
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+
+	securejoin "github.com/cyphar/filepath-securejoin"
+	"github.com/opencontainers/umoci/oci/layer"
+	"github.com/pkg/errors"
+)
+
+var zipMagic = []byte("PK\x03\x04")
+
+// DownloadAndExtract downloads url into cacheDir like DownloadWithOptions,
+// verifying it as configured by opts, and then extracts the archive into
+// destDir. tar archives (compressed with gzip, zstd or bzip2, or not at all)
+// are streamed straight from the cached file, as are zip archives. Cached
+// archives are extracted without downloading them again. Nothing is extracted
+// from an archive that fails verification.
+func DownloadAndExtract(cacheDir string, url string, destDir string, opts DownloadOptions) (string, error) {
+	name, err := DownloadWithOptions(cacheDir, url, opts)
+	if err != nil {
+		return "", err
+	}
+
+	err = os.MkdirAll(destDir, 0755)
+	if err != nil {
+		return "", errors.Wrapf(err, "couldn't create %s", destDir)
+	}
+
+	netLog.Infof("extracting %s to %s", name, destDir)
+	return name, extractArchive(name, destDir, opts)
+}
+
+// extractArchive extracts the archive name into destDir, showing progress as
+// configured by opts.
+func extractArchive(name string, destDir string, opts DownloadOptions) error {
+	f, err := os.Open(name)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	head := make([]byte, len(zipMagic))
+	_, err = io.ReadFull(f, head)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return errors.Wrapf(err, "couldn't read %s", name)
+	}
+
+	progress := newDownloadProgress(opts)
+	defer progress.finish()
+
+	if bytes.Equal(head, zipMagic) {
+		return extractZip(f, fi.Size(), destDir, progress)
+	}
+
+	_, err = f.Seek(0, io.SeekStart)
+	if err != nil {
+		return errors.Wrapf(err, "couldn't seek %s", name)
+	}
+
+	progress.start(fi.Size(), 0)
+	uncompressed, err := decompressedReader(progress.proxy(f))
+	if err != nil {
+		return errors.Wrapf(err, "couldn't read %s", name)
+	}
+	defer uncompressed.Close()
+
+	err = layer.UnpackLayer(destDir, uncompressed, &layer.UnpackOptions{
+		KeepDirlinks: true,
+		MapOptions:   layer.MapOptions{Rootless: os.Geteuid() != 0},
+	})
+	return errors.Wrapf(err, "couldn't extract %s", name)
+}
+
+// extractZip extracts the size bytes zip archive in r into destDir. Entries
+// can't escape destDir, not even through symlinks extracted earlier.
+func extractZip(r io.ReaderAt, size int64, destDir string, progress *downloadProgress) error {
+	zr, err := zip.NewReader(r, size)
+	if err != nil {
+		return errors.Wrapf(err, "couldn't read zip archive")
+	}
+
+	total := int64(0)
+	for _, zf := range zr.File {
+		total += int64(zf.UncompressedSize64)
+	}
+	progress.start(total, 0)
+
+	for _, zf := range zr.File {
+		target, err := securejoin.SecureJoin(destDir, zf.Name)
+		if err != nil {
+			return errors.Wrapf(err, "bad zip entry %s", zf.Name)
+		}
+
+		mode := zf.Mode()
+		switch {
+		case mode.IsDir():
+			err = os.MkdirAll(target, mode.Perm()|0700)
+		case mode&os.ModeSymlink != 0:
+			err = extractZipSymlink(zf, target)
+		case mode.IsRegular():
+			err = extractZipFile(zf, target, progress)
+		default:
+			err = errors.Errorf("unsupported type %v", mode.Type())
+		}
+		if err != nil {
+			return errors.Wrapf(err, "couldn't extract %s", zf.Name)
+		}
+	}
+
+	return nil
+}
+
+func extractZipFile(zf *zip.File, target string, progress *downloadProgress) error {
+	err := os.MkdirAll(filepath.Dir(target), 0755)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	in, err := zf.Open()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, zf.Mode().Perm())
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer out.Close()
+
+	_, err = io.Copy(out, progress.proxy(in))
+	return errors.WithStack(err)
+}
+
+func extractZipSymlink(zf *zip.File, target string) error {
+	in, err := zf.Open()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer in.Close()
+
+	link, err := io.ReadAll(in)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	err = os.MkdirAll(filepath.Dir(target), 0755)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	return errors.WithStack(os.Symlink(string(link), target))
+}
@@ -0,0 +1,57 @@
+package stacker
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDownloadAndExtract(t *testing.T) {
+	assert := assert.New(t)
+
+	tgz := bytes.Buffer{}
+	gz := gzip.NewWriter(&tgz)
+	tw := tar.NewWriter(gz)
+	tw.WriteHeader(&tar.Header{Name: "dir/hello", Mode: 0644, Size: 11, Typeflag: tar.TypeReg})
+	tw.Write([]byte("hello world"))
+	tw.Close()
+	gz.Close()
+
+	zipped := bytes.Buffer{}
+	zw := zip.NewWriter(&zipped)
+	w, _ := zw.Create("dir/hello")
+	w.Write([]byte("hello world"))
+	w, _ = zw.Create("../escaped")
+	w.Write([]byte("nope"))
+	zw.Close()
+
+	srv := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, ".zip") {
+			w.Write(zipped.Bytes())
+			return
+		}
+		w.Write(tgz.Bytes())
+	})
+
+	cache := t.TempDir()
+	opts := DownloadOptions{Uid: os.Getuid(), Gid: os.Getgid()}
+
+	for _, archive := range []string{"foo.tar.gz", "foo.zip"} {
+		dest := path.Join(t.TempDir(), "dest")
+		_, err := DownloadAndExtract(cache, srv.URL+"/"+archive, dest, opts)
+		assert.NoError(err, archive)
+
+		content, err := os.ReadFile(path.Join(dest, "dir", "hello"))
+		assert.NoError(err, archive)
+		assert.Equal("hello world", string(content), archive)
+		assert.NoFileExists(path.Join(dest, "..", "escaped"), archive)
+	}
+}
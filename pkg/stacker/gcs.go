@@ -0,0 +1,188 @@
+package stacker
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"time"
+
+	"github.com/minio/sha256-simd"
+	"github.com/pkg/errors"
+)
+
+// gcsScope is all that imports need.
+const gcsScope = "https://www.googleapis.com/auth/devstorage.read_only"
+
+// gcsToken looks for an access token for GCS in some of the places Google's
+// client libraries do: $GOOGLE_OAUTH_ACCESS_TOKEN, the service account or
+// user application default credentials ($GOOGLE_APPLICATION_CREDENTIALS, or
+// those `gcloud auth application-default login` saved), and the GCE
+// metadata service. It returns "" if there is none.
+func gcsToken(ctx context.Context) (string, error) {
+	if token := os.Getenv("GOOGLE_OAUTH_ACCESS_TOKEN"); token != "" {
+		return token, nil
+	}
+
+	cloudCredentials.Lock()
+	token, until := cloudCredentials.gcs, cloudCredentials.gcsUntil
+	cloudCredentials.Unlock()
+	if token != "" && time.Until(until) > 5*time.Minute {
+		return token, nil
+	}
+
+	token, lifetime, err := gcsDefaultCredentialsToken(ctx)
+	if err == nil && token == "" {
+		token, lifetime, err = gcsMetadataToken(ctx)
+	}
+	if err != nil || token == "" {
+		return "", err
+	}
+
+	cloudCredentials.Lock()
+	cloudCredentials.gcs, cloudCredentials.gcsUntil = token, time.Now().Add(lifetime)
+	cloudCredentials.Unlock()
+	return token, nil
+}
+
+// gcsCredentialsFile is an application default credentials file, either of a
+// service account or of a user.
+type gcsCredentialsFile struct {
+	Type string `json:"type"`
+
+	ClientEmail string `json:"client_email"`
+	PrivateKey  string `json:"private_key"`
+	TokenURI    string `json:"token_uri"`
+
+	ClientID     string `json:"client_id"`
+	ClientSecret string `json:"client_secret"`
+	RefreshToken string `json:"refresh_token"`
+}
+
+func gcsDefaultCredentialsToken(ctx context.Context) (string, time.Duration, error) {
+	file := os.Getenv("GOOGLE_APPLICATION_CREDENTIALS")
+	if file == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return "", 0, nil
+		}
+		file = path.Join(home, ".config", "gcloud", "application_default_credentials.json")
+	}
+
+	content, err := os.ReadFile(file)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return "", 0, nil
+		}
+		return "", 0, errors.WithStack(err)
+	}
+
+	creds := gcsCredentialsFile{}
+	err = json.Unmarshal(content, &creds)
+	if err != nil {
+		return "", 0, errors.Wrapf(err, "couldn't parse %s", file)
+	}
+
+	netLog.Debugf("using the GCS %s credentials in %s", creds.Type, file)
+	switch creds.Type {
+	case "service_account":
+		tokenURI := creds.TokenURI
+		if tokenURI == "" {
+			tokenURI = "https://oauth2.googleapis.com/token"
+		}
+
+		assertion, err := serviceAccountJWT(creds, tokenURI, time.Now())
+		if err != nil {
+			return "", 0, errors.Wrapf(err, "bad service account in %s", file)
+		}
+
+		return postForToken(ctx, tokenURI, url.Values{
+			"grant_type": []string{"urn:ietf:params:oauth:grant-type:jwt-bearer"},
+			"assertion":  []string{assertion},
+		})
+	case "authorized_user":
+		return postForToken(ctx, "https://oauth2.googleapis.com/token", url.Values{
+			"grant_type":    []string{"refresh_token"},
+			"client_id":     []string{creds.ClientID},
+			"client_secret": []string{creds.ClientSecret},
+			"refresh_token": []string{creds.RefreshToken},
+		})
+	}
+
+	return "", 0, errors.Errorf("unsupported credentials type %q in %s", creds.Type, file)
+}
+
+// serviceAccountJWT returns the signed assertion exchanged for the service
+// account's access token.
+func serviceAccountJWT(creds gcsCredentialsFile, audience string, now time.Time) (string, error) {
+	block, _ := pem.Decode([]byte(creds.PrivateKey))
+	if block == nil {
+		return "", errors.Errorf("no private key")
+	}
+
+	var key *rsa.PrivateKey
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err == nil {
+		var ok bool
+		key, ok = parsed.(*rsa.PrivateKey)
+		if !ok {
+			return "", errors.Errorf("private key isn't an RSA key")
+		}
+	} else {
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+		if err != nil {
+			return "", errors.Wrapf(err, "couldn't parse private key")
+		}
+	}
+
+	header, err := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT"})
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+	claims, err := json.Marshal(map[string]any{
+		"iss":   creds.ClientEmail,
+		"scope": gcsScope,
+		"aud":   audience,
+		"iat":   now.Unix(),
+		"exp":   now.Add(time.Hour).Unix(),
+	})
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+
+	unsigned := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(claims)
+	hashed := sha256.Sum256([]byte(unsigned))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, hashed[:])
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+
+	return unsigned + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+// gcsMetadataToken gets the token of the GCE instance's service account.
+func gcsMetadataToken(ctx context.Context) (string, time.Duration, error) {
+	host := os.Getenv("GCE_METADATA_HOST")
+	if host == "" {
+		host = "metadata.google.internal"
+	}
+
+	content, err := metadataRequest(ctx, http.MethodGet, "http://"+host,
+		"/computeMetadata/v1/instance/service-accounts/default/token",
+		http.Header{"Metadata-Flavor": []string{"Google"}})
+	if err != nil || content == nil {
+		return "", 0, err
+	}
+
+	netLog.Debugf("using the GCS token of the instance's service account")
+	return decodeToken(bytes.NewReader(content), host)
+}
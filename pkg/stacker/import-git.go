@@ -0,0 +1,252 @@
+package stacker
+
+import (
+	"io/fs"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// gitImportPrefix marks imports that are the tree of a git repo at some ref,
+// e.g. git:https://github.com/org/repo@<sha>.
+const gitImportPrefix = "git:"
+
+func isGitImport(ref string) bool {
+	return strings.HasPrefix(ref, gitImportPrefix)
+}
+
+// commitRegex matches full commit hashes (sha1 or sha256 repos), the only
+// refs that are pinned.
+var commitRegex = regexp.MustCompile(`^([0-9a-f]{40}|[0-9a-f]{64})$`)
+
+// parseGitImport splits a git:<repo>@<ref> reference.
+func parseGitImport(ref string) (string, string, error) {
+	s := strings.TrimPrefix(ref, gitImportPrefix)
+	idx := strings.LastIndex(s, "@")
+	if idx <= 0 || idx == len(s)-1 || strings.Contains(s[idx+1:], ":") {
+		return "", "", errors.Errorf("invalid git import %s: expected git:<repo>@<ref>", ref)
+	}
+
+	repo, rev := s[:idx], s[idx+1:]
+	if _, rest, ok := strings.Cut(repo, "://"); ok && !strings.Contains(rest, "/") {
+		return "", "", errors.Errorf("invalid git import %s: expected git:<repo>@<ref>", ref)
+	}
+
+	return repo, rev, nil
+}
+
+// gitRepoName is the name the tree of repo is imported as: the last element
+// of its path, without .git.
+func gitRepoName(repo string) string {
+	name := path.Base(strings.TrimSuffix(strings.TrimSuffix(repo, "/"), ".git"))
+	if idx := strings.LastIndex(name, ":"); idx >= 0 {
+		name = name[idx+1:]
+	}
+	return strings.TrimSuffix(name, ".git")
+}
+
+// importBaseName is the name imp is imported as in the imports dir (when it
+// has no dest).
+func importBaseName(imp string) string {
+	if isGitImport(imp) {
+		if repo, _, err := parseGitImport(imp); err == nil {
+			return gitRepoName(repo)
+		}
+	}
+
+	return path.Base(imp)
+}
+
+func git(args ...string) (string, error) {
+	cmd := exec.Command("git", args...)
+	// never ask for credentials, there's no one to answer
+	cmd.Env = append(os.Environ(), "GIT_TERMINAL_PROMPT=0")
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return "", errors.Errorf("git %s failed: %s: %s", strings.Join(args, " "), err, strings.TrimSpace(string(output)))
+	}
+
+	return strings.TrimSpace(string(output)), nil
+}
+
+// resolveGitRef returns the commit rev is at in repo. Full commit hashes are
+// returned as they are; branches and tags are looked up on the server.
+func resolveGitRef(repo string, rev string) (string, error) {
+	if commitRegex.MatchString(rev) {
+		return rev, nil
+	}
+
+	output, err := git("ls-remote", "--", repo, rev, rev+"^{}")
+	if err != nil {
+		return "", err
+	}
+
+	// annotated tags are listed twice, the commit they point to (^{})
+	// is the one we want
+	commit := ""
+	for _, line := range strings.Split(output, "\n") {
+		sha, name, ok := strings.Cut(line, "\t")
+		if !ok {
+			continue
+		}
+		if commit == "" || strings.HasSuffix(name, "^{}") {
+			commit = sha
+		}
+	}
+
+	if commit == "" {
+		return "", errors.Errorf("%s has no branch or tag %s (git imports need those, or a full commit hash)", repo, rev)
+	}
+
+	return commit, nil
+}
+
+// DownloadGit checks the tree of a repo at a ref out into cacheDir, without
+// the .git directory. The checked out tree is re-used as long as the ref is
+// the commit it was checked out at: for full commit hashes, forever, without
+// asking the server; branches and tags are looked up every time (and, if the
+// server can't be reached, the tree that was checked out last is used).
+func DownloadGit(cacheDir string, ref string, opts DownloadOptions) (string, error) {
+	repo, rev, err := parseGitImport(ref)
+	if err != nil {
+		return "", err
+	}
+
+	err = createCacheDir(cacheDir, opts.DirMode)
+	if err != nil {
+		return "", errors.Wrapf(err, "couldn't create cache dir %s", cacheDir)
+	}
+
+	name := cachePath(cacheDir, gitRepoName(repo), opts.Dest)
+
+	meta, err := readCacheMeta(name)
+	if err != nil {
+		return "", err
+	}
+
+	_, statErr := os.Stat(name)
+	cached := statErr == nil && meta.Source == ref && meta.Commit != ""
+
+	commit, err := resolveGitRef(repo, rev)
+	if err != nil {
+		if !cached {
+			return "", err
+		}
+		netLog.Warnf("couldn't look %s up, using the cached checkout at %s: %v", ref, meta.Commit, err)
+		return name, nil
+	}
+
+	if cached && meta.Commit == commit {
+		netLog.Infof("cache hit for %s: it is still at %s", ref, commit)
+		return name, nil
+	}
+
+	netLog.Infof("cloning %s at %s", repo, rev)
+
+	tmp, err := os.MkdirTemp(cacheDir, ".git-import-")
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	err = shallowCheckout(tmp, repo, rev, commit)
+	if err != nil {
+		return "", err
+	}
+
+	err = os.RemoveAll(path.Join(tmp, ".git"))
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+
+	// MkdirTemp's 0700 would hide the tree from the build's user
+	mode := opts.DirMode
+	if mode == 0 {
+		mode = defaultCacheDirMode
+	}
+	err = os.Chmod(tmp, mode)
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+
+	err = chownTree(tmp, opts)
+	if err != nil {
+		return "", err
+	}
+
+	err = os.RemoveAll(name)
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+
+	err = os.Rename(tmp, name)
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+
+	return name, writeCacheMeta(name, cacheMeta{Source: ref, Commit: commit}, opts)
+}
+
+// shallowCheckout checks commit (which rev resolved to) of repo out in dir,
+// fetching as little history as the server lets us.
+func shallowCheckout(dir string, repo string, rev string, commit string) error {
+	_, err := git("-C", dir, "init", "--quiet")
+	if err != nil {
+		return err
+	}
+
+	// not every server lets us fetch a commit by its hash, so fetch
+	// branches and tags by name, and fall back on the whole history
+	_, err = git("-C", dir, "fetch", "--quiet", "--depth", "1", "--", repo, rev)
+	if err != nil {
+		netLog.Debugf("shallow fetch of %s failed, fetching all of it: %v", repo, err)
+		_, err = git("-C", dir, "fetch", "--quiet", "--", repo, "+refs/heads/*:refs/remotes/origin/*", "+refs/tags/*:refs/tags/*")
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = git("-C", dir, "-c", "advice.detachedHead=false", "checkout", "--quiet", commit)
+	if err != nil {
+		return err
+	}
+
+	head, err := git("-C", dir, "rev-parse", "HEAD")
+	if err != nil {
+		return err
+	}
+
+	if head != commit {
+		return errors.Errorf("checked out %s at %s, but expected %s", repo, head, commit)
+	}
+
+	return nil
+}
+
+// chownTree gives the checked out tree in dir the ownership (and its files the
+// mode) the import asks for.
+func chownTree(dir string, opts DownloadOptions) error {
+	return filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return errors.WithStack(err)
+		}
+
+		if opts.Mode != nil && d.Type().IsRegular() {
+			err = os.Chmod(p, *opts.Mode)
+			if err != nil {
+				return errors.Wrapf(err, "couldn't chmod %s", p)
+			}
+		}
+
+		if opts.Uid == os.Getuid() && opts.Gid == os.Getgid() {
+			return nil
+		}
+
+		return errors.Wrapf(os.Lchown(p, opts.Uid, opts.Gid), "couldn't chown %s", p)
+	})
+}
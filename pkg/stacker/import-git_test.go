@@ -0,0 +1,105 @@
+package stacker
+
+import (
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseGitImport(t *testing.T) {
+	assert := assert.New(t)
+
+	for ref, expected := range map[string][2]string{
+		"git:https://github.com/org/repo@v1.0":                    {"https://github.com/org/repo", "v1.0"},
+		"git:ssh://git@github.com/org/repo.git@main":              {"ssh://git@github.com/org/repo.git", "main"},
+		"git:git@github.com:org/repo.git@release/1.x":             {"git@github.com:org/repo.git", "release/1.x"},
+		"git:github.com:org/repo@v1.0":                            {"github.com:org/repo", "v1.0"},
+		"git:https://example.com/repo@" + strings.Repeat("a", 40): {"https://example.com/repo", strings.Repeat("a", 40)},
+	} {
+		repo, rev, err := parseGitImport(ref)
+		assert.NoError(err, ref)
+		assert.Equal(expected, [2]string{repo, rev}, ref)
+		assert.Equal("repo", importBaseName(ref), ref)
+	}
+
+	for _, ref := range []string{
+		"git:https://github.com/org/repo",
+		"git:ssh://git@github.com/org/repo",
+		"git:git@github.com:org/repo.git",
+		"git:https://github.com/org/repo@",
+	} {
+		_, _, err := parseGitImport(ref)
+		assert.Error(err, ref)
+	}
+}
+
+func TestDownloadGit(t *testing.T) {
+	assert := assert.New(t)
+
+	upstream := t.TempDir()
+	commit := func(content string) string {
+		for _, args := range [][]string{
+			{"-C", upstream, "init", "--quiet", "--initial-branch", "main"},
+			{"-C", upstream, "add", "file"},
+			{"-C", upstream, "-c", "user.name=stacker", "-c", "user.email=stacker@example.com", "commit", "--quiet", "-m", content},
+		} {
+			if args[2] == "add" {
+				assert.NoError(os.WriteFile(path.Join(upstream, "file"), []byte(content), 0644))
+			}
+			_, err := git(args...)
+			assert.NoError(err)
+		}
+
+		sha, err := git("-C", upstream, "rev-parse", "HEAD")
+		assert.NoError(err)
+		return sha
+	}
+
+	first := commit("first")
+	second := commit("second")
+
+	read := func(name string) string {
+		content, err := os.ReadFile(path.Join(name, "file"))
+		assert.NoError(err)
+		return string(content)
+	}
+
+	cacheDir := t.TempDir()
+	opts := DownloadOptions{Uid: os.Getuid(), Gid: os.Getgid()}
+
+	name, err := DownloadGit(cacheDir, "git:file://"+upstream+"@"+first, opts)
+	assert.NoError(err)
+	assert.Equal(path.Join(cacheDir, path.Base(upstream)), name)
+	assert.Equal("first", read(name))
+	assert.NoDirExists(path.Join(name, ".git"))
+
+	// pinned checkouts are re-used without asking upstream
+	_, err = DownloadGit(cacheDir, "git:file:///nonexistent@"+first, opts)
+	assert.Error(err)
+	assert.NoError(os.WriteFile(path.Join(name, "marker"), nil, 0644))
+	_, err = DownloadGit(cacheDir, "git:file://"+upstream+"@"+first, opts)
+	assert.NoError(err)
+	assert.FileExists(path.Join(name, "marker"))
+
+	// branches follow upstream
+	name, err = DownloadGit(cacheDir, "git:file://"+upstream+"@main", opts)
+	assert.NoError(err)
+	assert.Equal("second", read(name))
+	meta, err := readCacheMeta(name)
+	assert.NoError(err)
+	assert.Equal(second, meta.Commit)
+
+	third := commit("third")
+	_, err = DownloadGit(cacheDir, "git:file://"+upstream+"@main", opts)
+	assert.NoError(err)
+	assert.Equal("third", read(name))
+	meta, err = readCacheMeta(name)
+	assert.NoError(err)
+	assert.Equal(third, meta.Commit)
+
+	_, err = DownloadGit(t.TempDir(), "git:file://"+upstream+"@nope", opts)
+	assert.ErrorContains(err, "has no branch or tag nope")
+}
@@ -0,0 +1,238 @@
+package stacker
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/opencontainers/umoci"
+	"github.com/opencontainers/umoci/oci/casext"
+	"github.com/pkg/errors"
+	stackeroci "stackerbuild.io/stacker/pkg/oci"
+)
+
+// ociImportPrefix marks imports that come from a local OCI layout, e.g.
+// oci:/path/to/layout:tag//etc/os-release.
+const ociImportPrefix = "oci:"
+
+func isOCIImport(ref string) bool {
+	return strings.HasPrefix(ref, ociImportPrefix)
+}
+
+// parseOCIImport splits an oci:<layout>:<tag>//<path> reference.
+func parseOCIImport(ref string) (string, string, string, error) {
+	image, file, ok := strings.Cut(strings.TrimPrefix(ref, ociImportPrefix), "//")
+	if !ok || file == "" {
+		return "", "", "", errors.Errorf("invalid oci import %s: expected oci:<layout>:<tag>//<path>", ref)
+	}
+
+	idx := strings.LastIndex(image, ":")
+	if idx <= 0 || idx == len(image)-1 {
+		return "", "", "", errors.Errorf("invalid oci import %s: missing tag", ref)
+	}
+
+	return image[:idx], image[idx+1:], path.Clean("/" + file), nil
+}
+
+// DownloadOCI extracts a single file from an image in a local OCI layout into
+// cacheDir. The cached copy is keyed on the digests of the layer the file was
+// found in and the layers above it, so it is re-used until one of those
+// changes; since blobs are verified against their digest as they are read,
+// the layer digest is what anchors the file's integrity.
+func DownloadOCI(cacheDir string, ref string, opts DownloadOptions) (string, error) {
+	layout, tag, file, err := parseOCIImport(ref)
+	if err != nil {
+		return "", err
+	}
+
+	err = createCacheDir(cacheDir, opts.DirMode)
+	if err != nil {
+		return "", errors.Wrapf(err, "couldn't create cache dir %s", cacheDir)
+	}
+
+	err = checkCacheDir(cacheDir)
+	if err != nil {
+		return "", err
+	}
+
+	name := cachePath(cacheDir, file, opts.Dest)
+
+	oci, err := umoci.OpenLayout(layout)
+	if err != nil {
+		return "", errors.Wrapf(err, "couldn't open oci layout %s", layout)
+	}
+	defer oci.Close()
+
+	manifest, err := stackeroci.LookupManifest(oci, tag)
+	if err != nil {
+		return "", errors.Wrapf(err, "couldn't find %s in %s", tag, layout)
+	}
+
+	meta, err := readCacheMeta(name)
+	if err != nil {
+		return "", err
+	}
+
+	if _, err := os.Stat(name); err == nil && meta.Source == ref && ociLayersUnchanged(manifest, meta.Layers) {
+		netLog.Infof("cache hit (verified) for %s: layer %s is unchanged", ref, meta.Layers[0])
+		return name, nil
+	}
+
+	out, err := createCacheFile(name, os.O_RDWR|os.O_TRUNC, opts.FileMode)
+	if err != nil {
+		return "", err
+	}
+	defer out.Close()
+
+	netLog.Infof("extracting %s from %s:%s", file, layout, tag)
+
+	// the top most layer that has the file wins
+	for i := len(manifest.Layers) - 1; i >= 0; i-- {
+		found, err := extractFromLayer(oci, manifest.Layers[i], file, out)
+		if err != nil {
+			os.RemoveAll(name)
+			return "", err
+		}
+
+		if !found {
+			continue
+		}
+
+		err = verifyImportFileHash(name, opts.ExpectedHash)
+		if err != nil {
+			os.RemoveAll(name)
+			return "", err
+		}
+
+		if opts.Mode != nil {
+			err = out.Chmod(*opts.Mode)
+			if err != nil {
+				return "", errors.Wrapf(err, "couldn't chmod file %s", name)
+			}
+		}
+
+		err = out.Chown(opts.Uid, opts.Gid)
+		if err != nil {
+			return "", errors.Wrapf(err, "couldn't chown file %s", name)
+		}
+
+		meta = cacheMeta{Source: ref}
+		for _, l := range manifest.Layers[i:] {
+			meta.Layers = append(meta.Layers, l.Digest.String())
+		}
+
+		return name, writeCacheMeta(name, meta, opts)
+	}
+
+	os.RemoveAll(name)
+	return "", errors.Errorf("%s not found in %s:%s", file, layout, tag)
+}
+
+// ociLayersUnchanged returns true if the top layers of the manifest are the
+// ones recorded in layers.
+func ociLayersUnchanged(manifest ispec.Manifest, layers []string) bool {
+	if len(layers) == 0 || len(layers) > len(manifest.Layers) {
+		return false
+	}
+
+	top := manifest.Layers[len(manifest.Layers)-len(layers):]
+	for i, l := range top {
+		if l.Digest.String() != layers[i] {
+			return false
+		}
+	}
+
+	return true
+}
+
+// extractFromLayer copies file out of layer into out, returning false if the
+// layer doesn't contain it. If the layer deletes file, that's an error: lower
+// layers' copies are not visible in the image.
+// uncompressLayer returns the tar of layer from its blob, and what to close
+// once it's read. It doesn't read ahead of what's asked, so the rest of blob
+// can still be drained to verify its digest.
+func uncompressLayer(layer ispec.Descriptor, blob io.Reader) (io.Reader, func(), error) {
+	switch layer.MediaType {
+	case ispec.MediaTypeImageLayerGzip:
+		// not pgzip: its read ahead would race with draining blob
+		gz, err := gzip.NewReader(blob)
+		if err != nil {
+			return nil, nil, errors.Wrapf(err, "couldn't decompress it")
+		}
+		return gz, func() { gz.Close() }, nil
+	case ispec.MediaTypeImageLayerZstd:
+		// nor concurrent decoding, for the same reason
+		zr, err := zstd.NewReader(blob, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return nil, nil, errors.Wrapf(err, "couldn't decompress it")
+		}
+		return zr, zr.Close, nil
+	case ispec.MediaTypeImageLayer:
+		return blob, func() {}, nil
+	default:
+		return nil, nil, errors.Errorf("%s isn't a tar layer", layer.MediaType)
+	}
+}
+
+func extractFromLayer(oci casext.Engine, layer ispec.Descriptor, file string, out *os.File) (bool, error) {
+	blob, err := oci.GetBlob(context.Background(), layer.Digest)
+	if err != nil {
+		return false, errors.Wrapf(err, "couldn't read layer %s", layer.Digest)
+	}
+	defer blob.Close()
+
+	uncompressed, closer, err := uncompressLayer(layer, blob)
+	if err != nil {
+		return false, errors.Wrapf(err, "can't import from layer %s", layer.Digest)
+	}
+	defer closer()
+
+	whiteout := path.Join(path.Dir(file), ".wh."+path.Base(file))
+
+	found := false
+	tr := tar.NewReader(uncompressed)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return false, errors.Wrapf(err, "couldn't read layer %s", layer.Digest)
+		}
+
+		entry := filepath.Clean("/" + hdr.Name)
+		if entry == whiteout {
+			return false, errors.Errorf("%s is deleted by layer %s", file, layer.Digest)
+		}
+
+		if entry != file {
+			continue
+		}
+
+		if hdr.Typeflag != tar.TypeReg {
+			return false, errors.Errorf("%s in layer %s is not a regular file", file, layer.Digest)
+		}
+
+		_, err = io.Copy(out, tr)
+		if err != nil {
+			return false, errors.Wrapf(err, "couldn't extract %s from layer %s", file, layer.Digest)
+		}
+		found = true
+		break
+	}
+
+	// read the rest of the blob, so that its digest gets verified
+	_, err = io.Copy(io.Discard, blob)
+	if err != nil {
+		return false, errors.Wrapf(err, "couldn't verify layer %s", layer.Digest)
+	}
+
+	return found, nil
+}
@@ -0,0 +1,87 @@
+package stacker
+
+import (
+	"os"
+	"path"
+	"testing"
+
+	"github.com/opencontainers/umoci"
+	"github.com/stretchr/testify/assert"
+	stackeroci "stackerbuild.io/stacker/pkg/oci"
+)
+
+func TestParseOCIImport(t *testing.T) {
+	assert := assert.New(t)
+
+	layout, tag, file, err := parseOCIImport("oci:/srv/oci:base//etc/os-release")
+	assert.NoError(err)
+	assert.Equal([]string{"/srv/oci", "base", "/etc/os-release"}, []string{layout, tag, file})
+
+	for _, ref := range []string{"oci:/srv/oci:base", "oci:/srv/oci//etc/os-release", "oci:/srv/oci://etc/os-release"} {
+		_, _, _, err := parseOCIImport(ref)
+		assert.Error(err, ref)
+	}
+}
+
+func TestDownloadOCI(t *testing.T) {
+	assert := assert.New(t)
+
+	layout := path.Join(t.TempDir(), "oci")
+	oci, err := umoci.CreateLayout(layout)
+	if !assert.NoError(err) {
+		return
+	}
+	defer oci.Close()
+
+	lower := []tarEntry{{name: "etc/os-release", content: "lower"}, {name: "etc/motd", content: "hello"}}
+	putTarImage(t, oci, "base", lower, []tarEntry{{name: "etc/os-release", content: "upper"}})
+
+	// the top most layer that has the file wins
+	cacheDir := t.TempDir()
+	ref := "oci:" + layout + ":base//etc/os-release"
+	opts := DownloadOptions{Uid: os.Getuid(), Gid: os.Getgid()}
+	name, err := DownloadOCI(cacheDir, ref, opts)
+	assert.NoError(err)
+	assert.Equal(path.Join(cacheDir, "os-release"), name)
+	content, err := os.ReadFile(name)
+	assert.NoError(err)
+	assert.Equal("upper", string(content))
+
+	// and is what the cache entry is keyed on
+	manifest, err := stackeroci.LookupManifest(oci, "base")
+	assert.NoError(err)
+	meta, err := readCacheMeta(name)
+	assert.NoError(err)
+	assert.Equal(ref, meta.Source)
+	assert.Equal([]string{manifest.Layers[1].Digest.String()}, meta.Layers)
+
+	// so that it is used as long as that layer is unchanged
+	assert.NoError(os.WriteFile(name, []byte("cached"), 0644))
+	name, err = DownloadOCI(cacheDir, ref, opts)
+	assert.NoError(err)
+	content, err = os.ReadFile(name)
+	assert.NoError(err)
+	assert.Equal("cached", string(content))
+
+	// and extracted again once it changed
+	putTarImage(t, oci, "base", lower, []tarEntry{{name: "etc/os-release", content: "newer"}})
+	name, err = DownloadOCI(cacheDir, ref, opts)
+	assert.NoError(err)
+	content, err = os.ReadFile(name)
+	assert.NoError(err)
+	assert.Equal("newer", string(content))
+
+	// files of lower layers are keyed on the layers above them too
+	name, err = DownloadOCI(cacheDir, "oci:"+layout+":base//etc/motd", opts)
+	assert.NoError(err)
+	content, err = os.ReadFile(name)
+	assert.NoError(err)
+	assert.Equal("hello", string(content))
+	meta, err = readCacheMeta(name)
+	assert.NoError(err)
+	assert.Len(meta.Layers, 2)
+
+	_, err = DownloadOCI(cacheDir, "oci:"+layout+":base//etc/missing", opts)
+	assert.ErrorContains(err, "not found")
+	assert.NoFileExists(path.Join(cacheDir, "missing"))
+}
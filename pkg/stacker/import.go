@@ -1,12 +1,14 @@
 package stacker
 
 import (
+	"context"
 	"io/fs"
 	"os"
 	"path"
+	"path/filepath"
+	"strconv"
 	"strings"
-
-	"github.com/opencontainers/go-digest"
+	"time"
 
 	"github.com/pkg/errors"
 	"github.com/udhos/equalfile"
@@ -71,13 +73,17 @@ func verifyImportFileHash(imp string, hash string) error {
 	if len(hash) == 0 {
 		return nil
 	}
-	actualHash, err := lib.HashFile(imp, false)
+	expected, err := canonicalSHA256(hash)
 	if err != nil {
 		return err
 	}
 
-	actualHash = strings.TrimPrefix(actualHash, "sha256:")
-	if actualHash != strings.ToLower(hash) {
+	actualHash, err := sha256File(imp)
+	if err != nil {
+		return err
+	}
+
+	if actualHash != expected {
 		return errors.Errorf("The requested hash of %s import is different than the actual hash: %s != %s",
 			imp, hash, actualHash)
 	}
@@ -228,20 +234,144 @@ func importFile(imp string, cacheDir string, hash string, idest string, mode *fs
 
 }
 
-func validateHash(hash string) error {
+// validateHash checks the hash given in a stackerfile, returning it
+// canonicalized (see ParseDigest).
+func validateHash(hash string) (string, error) {
 	if len(hash) > 0 {
 		log.Debugf("hash: %#v", hash)
-		// Validate given hash from stackerfile
-		validator := digest.Algorithm("sha256")
-		if err := validator.Validate(strings.ToLower(hash)); err != nil {
-			return errors.Wrapf(err, "Given hash %s is not valid", hash)
+	}
+
+	canonical, err := canonicalSHA256(hash)
+	if err != nil {
+		return "", errors.Wrapf(err, "Given hash %s is not valid", hash)
+	}
+	return canonical, nil
+}
+
+// baseCaches returns the read-only counterparts of cache in the configured
+// base stacker dirs.
+func baseCaches(c types.StackerConfig, cache string) []CacheStore {
+	rel, err := filepath.Rel(c.StackerDir, cache)
+	if err != nil || strings.HasPrefix(rel, "..") {
+		return nil
+	}
+
+	stores := []CacheStore{}
+	for _, base := range c.BaseStackerDirs {
+		stores = append(stores, NewDirCacheStore(path.Join(base, rel), true))
+	}
+
+	return stores
+}
+
+// remoteImportOptions returns the options the http(s) import i is downloaded
+// into cache with. Unless a cached copy is known to be good, the server is
+// asked about the file first, so that it can decide about the cache.
+func remoteImportOptions(c types.StackerConfig, i string, cache string, expectedHash string, expectedSize int64,
+	ttl time.Duration, idest string, mode *fs.FileMode, uid, gid int, progress bool, metrics DownloadMetrics,
+) (DownloadOptions, error) {
+	policy, err := ParseChecksumPolicy(c.ChecksumPolicy)
+	if err != nil {
+		return DownloadOptions{}, err
+	}
+
+	sizePolicy, err := ParseSizeChangePolicy(c.SizeChangePolicy)
+	if err != nil {
+		return DownloadOptions{}, err
+	}
+
+	creds, err := NewCredentials(c.DownloadCredentials)
+	if err != nil {
+		return DownloadOptions{}, err
+	}
+
+	// otherwise, we need to download it
+	// first verify the hashes
+	opts := DownloadOptions{
+		Progress: progress,
+		// the command line already decided whether a bar
+		// makes sense, see shouldShowProgress
+		ForceProgress:     progress,
+		ProgressThreshold: defaultProgressThreshold,
+		Dest:              idest,
+		Mode:              mode,
+		Uid:               uid,
+		Gid:               gid,
+		Metrics:           metrics,
+		ChecksumOptions: ChecksumOptions{
+			ExpectedHash:   expectedHash,
+			ExpectedSize:   expectedSize,
+			ChecksumPolicy: policy,
+		},
+		CacheOptions: CacheOptions{
+			TTL:              ttl,
+			Revalidate:       true,
+			BaseCaches:       baseCaches(c, cache),
+			SizeChangePolicy: sizePolicy,
+		},
+		RetryOptions: RetryOptions{
+			Retries:          c.DownloadRetries,
+			RetryBackoff:     c.DownloadRetryBackoff,
+			RetryStatusCodes: c.DownloadRetryStatusCodes,
+		},
+		TransportOptions: TransportOptions{
+			Resume:         true,
+			ConnectTimeout: c.ConnectTimeout,
+			StallTimeout:   c.StallTimeout,
+			CacheProxy:     c.CacheProxy,
+			Credentials:    creds,
+			Network:        c.DownloadNetwork,
+			RateLimiter:    configRateLimiter(c.DownloadRateLimits),
+		},
+	}
+
+	// with a cached copy of the expected size, or matching the
+	// pinned hash (or that of the url), there's nothing to ask the
+	// server. The cache knows the url without its checksum fragment.
+	src, fragmentHash := splitChecksumFragment(i)
+	pinned := opts
+	if pinned.ExpectedHash == "" {
+		pinned.ExpectedHash, _ = canonicalSHA256(fragmentHash)
+	}
+
+	name := cachePath(cache, src, idest)
+	cached, err := cacheHasExpectedSize(name, src, opts)
+	if err != nil {
+		return DownloadOptions{}, err
+	}
+	if cached || (pinned.ExpectedHash != "" && cacheMatchesExpectedHash(name, src, pinned)) {
+		return opts, nil
+	}
+
+	remoteAlgorithm, remoteHash, remoteSize := "", "", ""
+	info, err := fileInfo(context.Background(), i, opts)
+	if err != nil {
+		// Needed for "working offline"
+		// See https://stackerbuild.io/stacker/issues/44
+		netLog.Infof("cannot obtain file info of %s", i)
+	} else {
+		remoteAlgorithm, remoteHash = pickRemoteChecksum(i, info, opts.HashPriority)
+		if info.Size >= 0 {
+			remoteSize = strconv.FormatInt(info.Size, 10)
 		}
+		opts.RemoteETag = info.ETag
+		opts.RemoteLastModified = info.LastModified
 	}
-	return nil
+	netLog.Debugf("Remote file: hash: %s length: %s", remoteHash, remoteSize)
+	// verify if the given hash from stackerfile matches the remote one.
+	if len(expectedHash) > 0 && remoteAlgorithm == "sha256" && expectedHash != remoteHash {
+		return DownloadOptions{}, errors.Errorf("The requested hash of %s import is different than the actual hash: %s != %s",
+			i, expectedHash, remoteHash)
+	}
+	opts.RemoteHash = remoteHash
+	opts.RemoteHashAlgorithm = remoteAlgorithm
+	opts.RemoteSize = remoteSize
+	return opts, nil
 }
 
 func acquireUrl(c types.StackerConfig, storage types.Storage, i string, cache string, expectedHash string,
-	idest string, mode *fs.FileMode, uid, gid int, progress bool,
+	expectedSize int64, ttl time.Duration, idest string, mode *fs.FileMode, uid, gid int, progress bool,
+	metrics DownloadMetrics,
 ) (string, error) {
 	url, err := types.NewDockerishUrl(i)
 	if err != nil {
@@ -249,29 +379,41 @@ func acquireUrl(c types.StackerConfig, storage types.Storage, i string, cache st
 	}
 
 	// validate the given hash
-	if err = validateHash(expectedHash); err != nil {
+	expectedHash, err = validateHash(expectedHash)
+	if err != nil {
 		return "", err
 	}
 
+	if isOCIImport(i) {
+		return DownloadOCI(cache, i, DownloadOptions{
+			Dest: idest,
+			Mode: mode,
+			Uid:  uid,
+			Gid:  gid,
+			ChecksumOptions: ChecksumOptions{
+				ExpectedHash: expectedHash,
+			},
+		})
+	}
+
+	if isGitImport(i) {
+		return DownloadGit(cache, i, DownloadOptions{
+			Dest: idest,
+			Mode: mode,
+			Uid:  uid,
+			Gid:  gid,
+		})
+	}
+
 	// It's just a path, let's copy it to .stacker.
 	if url.Scheme == "" {
 		return importFile(i, cache, expectedHash, idest, mode, uid, gid)
-	} else if url.Scheme == "http" || url.Scheme == "https" {
-		// otherwise, we need to download it
-		// first verify the hashes
-		remoteHash, remoteSize, err := getHttpFileInfo(i)
+	} else if isRemoteURL(i) {
+		opts, err := remoteImportOptions(c, i, cache, expectedHash, expectedSize, ttl, idest, mode, uid, gid, progress, metrics)
 		if err != nil {
-			// Needed for "working offline"
-			// See https://stackerbuild.io/stacker/issues/44
-			log.Infof("cannot obtain file info of %s", i)
-		}
-		log.Debugf("Remote file: hash: %s length: %s", remoteHash, remoteSize)
-		// verify if the given hash from stackerfile matches the remote one.
-		if len(expectedHash) > 0 && len(remoteHash) > 0 && strings.ToLower(expectedHash) != remoteHash {
-			return "", errors.Errorf("The requested hash of %s import is different than the actual hash: %s != %s",
-				i, expectedHash, remoteHash)
+			return "", err
 		}
-		return Download(cache, i, progress, expectedHash, remoteHash, remoteSize, idest, mode, uid, gid)
+		return DownloadWithOptions(cache, i, opts)
 	} else if url.Scheme == "stacker" {
 		// we always Grab() things from stacker://, because we need to
 		// mount the container's rootfs to get them and don't
@@ -310,7 +452,7 @@ func CleanImportsDir(c types.StackerConfig, name string, imports types.Imports,
 
 	dir = path.Join(c.StackerDir, "imports", name)
 
-	cacheEntry, cacheHit := cache.Cache[name]
+	cacheEntry, cacheHit := cache.get(name)
 	if !cacheHit {
 		// no previous build means we should delete everything that was
 		// imported; who knows where it came from.
@@ -322,9 +464,9 @@ func CleanImportsDir(c types.StackerConfig, name string, imports types.Imports,
 	// make sure we invalidate the cached version.
 	for _, i := range imports {
 		for cached := range cacheEntry.Imports {
-			if path.Base(cached) == path.Base(i.Path) && cached != i.Path {
+			if importBaseName(cached) == importBaseName(i.Path) && cached != i.Path {
 				log.Infof("%s url changed to %s, pruning cache", cached, i.Path)
-				err := os.RemoveAll(path.Join(dir, path.Base(i.Path)))
+				err := os.RemoveAll(path.Join(dir, importBaseName(i.Path)))
 				if err != nil {
 					return err
 				}
@@ -336,7 +478,7 @@ func CleanImportsDir(c types.StackerConfig, name string, imports types.Imports,
 }
 
 // Import files from different sources to an ephemeral or permanent destination.
-func Import(c types.StackerConfig, storage types.Storage, name string, imports types.Imports, overlayDirs *types.OverlayDirs, progress bool) error {
+func Import(c types.StackerConfig, storage types.Storage, name string, imports types.Imports, overlayDirs *types.OverlayDirs, progress bool, metrics DownloadMetrics) error {
 	dir := path.Join(c.StackerDir, "artifacts", name)
 
 	if err := os.MkdirAll(dir, 0755); err != nil {
@@ -345,6 +487,12 @@ func Import(c types.StackerConfig, storage types.Storage, name string, imports t
 
 	dir = path.Join(c.StackerDir, "imports", name)
 
+	if c.CacheDirPerBuild {
+		if err := os.RemoveAll(dir); err != nil {
+			return err
+		}
+	}
+
 	if err := os.MkdirAll(dir, 0755); err != nil {
 		return err
 	}
@@ -360,7 +508,8 @@ func Import(c types.StackerConfig, storage types.Storage, name string, imports t
 		return errors.Wrapf(err, "couldn't read existing directory")
 	}
 
-	for _, i := range imports {
+	caches := make([]string, len(imports))
+	for n, i := range imports {
 		cache := dir
 
 		// if "import" directives has a "dest", then convert them into overlay_dir entries
@@ -382,9 +531,40 @@ func Import(c types.StackerConfig, storage types.Storage, name string, imports t
 			cache = tmpdir
 		}
 
-		name, err := acquireUrl(c, storage, i.Path, cache, i.Hash, i.Dest, i.Mode, i.Uid, i.Gid, progress)
-		if err != nil {
-			return err
+		caches[n] = cache
+	}
+
+	names, err := acquireImports(c, storage, dir, imports, caches, progress, metrics)
+	if err != nil {
+		return err
+	}
+
+	if log.EventsEnabled() {
+		for n, i := range imports {
+			fetched := log.Fields{"layer": name, "import": i.Path}
+			fi, err := os.Stat(names[n])
+			if err == nil && fi.Mode().IsRegular() {
+				hash, err := sha256File(names[n])
+				if err != nil {
+					return err
+				}
+				fetched["digest"] = "sha256:" + hash
+			}
+			log.Event("import-fetched", fetched)
+		}
+	}
+
+	for n, name := range names {
+		if caches[n] == dir {
+			// for PruneCache
+			markUsed(name, DownloadOptions{})
+		} else {
+			// this cache dir ends up in the rootfs; don't leak the
+			// download metadata into it.
+			err = os.RemoveAll(path.Join(caches[n], metaDirName))
+			if err != nil {
+				return err
+			}
 		}
 
 		for i, ext := range existing {
@@ -397,6 +577,15 @@ func Import(c types.StackerConfig, storage types.Storage, name string, imports t
 
 	// Now, delete all the old imports.
 	for _, ext := range existing {
+		if ext.Name() == metaDirName {
+			continue
+		}
+
+		err = removeSidecars(path.Join(dir, ext.Name()))
+		if err != nil {
+			return err
+		}
+
 		err = os.RemoveAll(path.Join(dir, ext.Name()))
 		if err != nil {
 			return err
@@ -405,3 +594,63 @@ func Import(c types.StackerConfig, storage types.Storage, name string, imports t
 
 	return nil
 }
+
+// acquireImports acquires each of imports into the matching caches, returning
+// where they ended up. The http(s) imports are downloaded together with
+// DownloadAllWithOptions, up to c.DownloadConcurrency of them at once, and
+// journaled in dir; the others (local files, git and oci imports, files from
+// other layers) are acquired one at a time first. Concurrent downloads don't
+// get progress bars, which would draw over each other.
+func acquireImports(c types.StackerConfig, storage types.Storage, dir string, imports types.Imports, caches []string, progress bool, metrics DownloadMetrics) ([]string, error) {
+	names := make([]string, len(imports))
+
+	reqs := []DownloadRequest{}
+	downloads := []int{}
+	for n, i := range imports {
+		if !isRemoteURL(i.Path) {
+			name, err := acquireUrl(c, storage, i.Path, caches[n], i.Hash, int64(i.Size), i.TTL, i.Dest, i.Mode,
+				i.Uid, i.Gid, progress, metrics)
+			if err != nil {
+				return nil, err
+			}
+			names[n] = name
+			continue
+		}
+
+		hash, err := validateHash(i.Hash)
+		if err != nil {
+			return nil, err
+		}
+
+		opts, err := remoteImportOptions(c, i.Path, caches[n], hash, int64(i.Size), i.TTL, i.Dest, i.Mode,
+			i.Uid, i.Gid, progress, metrics)
+		if err != nil {
+			return nil, err
+		}
+
+		reqs = append(reqs, DownloadRequest{URL: i.Path, Opts: opts, CacheDir: caches[n], Critical: i.Critical})
+		downloads = append(downloads, n)
+	}
+
+	if len(reqs) == 0 {
+		return names, nil
+	}
+
+	jobs := max(c.DownloadConcurrency, 1)
+	if jobs > 1 && len(reqs) > 1 {
+		for r := range reqs {
+			reqs[r].Opts.Progress = false
+		}
+	}
+
+	results, err := DownloadAllWithOptions(dir, reqs, DownloadAllOptions{Jobs: jobs, Journal: true})
+	if err != nil {
+		return nil, err
+	}
+
+	for r, n := range downloads {
+		names[n] = results[r].Path
+	}
+
+	return names, nil
+}
@@ -0,0 +1,168 @@
+package stacker
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"stackerbuild.io/stacker/pkg/types"
+)
+
+func TestAcquireImportsConcurrently(t *testing.T) {
+	assert := assert.New(t)
+
+	var mu sync.Mutex
+	inFlight, most := 0, 0
+	srv := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet {
+			mu.Lock()
+			inFlight++
+			most = max(most, inFlight)
+			mu.Unlock()
+
+			time.Sleep(50 * time.Millisecond)
+
+			mu.Lock()
+			inFlight--
+			mu.Unlock()
+		}
+		w.Write([]byte(r.URL.Path))
+	})
+
+	imports := types.Imports{}
+	for i := 0; i < 6; i++ {
+		imports = append(imports, types.Import{Path: fmt.Sprintf("%s/file%d", srv.URL, i), Uid: os.Getuid(), Gid: os.Getgid()})
+	}
+
+	for jobs, expected := range map[int]int{0: 1, 3: 3} {
+		cacheDir := t.TempDir()
+		caches := []string{}
+		for range imports {
+			caches = append(caches, cacheDir)
+		}
+
+		most = 0
+		names, err := acquireImports(types.StackerConfig{DownloadConcurrency: jobs}, nil, cacheDir, imports, caches, false, nil)
+		assert.NoError(err)
+		assert.Equal(expected, most, "concurrency %d", jobs)
+
+		for i, name := range names {
+			content, err := os.ReadFile(name)
+			assert.NoError(err)
+			assert.Equal(fmt.Sprintf("/file%d", i), string(content))
+		}
+	}
+
+	imports = append(imports, types.Import{Path: srv.URL + "/bad", Hash: strings.Repeat("0", 64)})
+	caches := []string{}
+	for range imports {
+		caches = append(caches, t.TempDir())
+	}
+	_, err := acquireImports(types.StackerConfig{DownloadConcurrency: 3}, nil, t.TempDir(), imports, caches, false, nil)
+	assert.Error(err)
+}
+
+func TestAcquireImportsCritical(t *testing.T) {
+	assert := assert.New(t)
+
+	var slowCancelled atomic.Bool
+	var mu sync.Mutex
+	requests := map[string]int{}
+	srv := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet {
+			mu.Lock()
+			requests[r.URL.Path]++
+			mu.Unlock()
+		}
+
+		switch r.URL.Path {
+		case "/slow":
+			if r.Method == http.MethodHead {
+				return
+			}
+			select {
+			case <-r.Context().Done():
+				slowCancelled.Store(true)
+			case <-time.After(10 * time.Second):
+			}
+		case "/base.tar":
+			w.WriteHeader(http.StatusNotFound)
+		default:
+			w.Write([]byte("hello world"))
+		}
+	})
+
+	dir := t.TempDir()
+	imports := types.Imports{
+		{Path: srv.URL + "/file", Uid: os.Getuid(), Gid: os.Getgid()},
+		{Path: srv.URL + "/slow", Uid: os.Getuid(), Gid: os.Getgid()},
+		{Path: srv.URL + "/base.tar", Critical: true, Uid: os.Getuid(), Gid: os.Getgid()},
+	}
+	caches := []string{dir, dir, dir}
+
+	// the critical import failing gives up on the others right away
+	start := time.Now()
+	_, err := acquireImports(types.StackerConfig{DownloadConcurrency: 3}, nil, dir, imports, caches, false, nil)
+	assert.ErrorContains(err, "/base.tar")
+	assert.Less(time.Since(start), 5*time.Second)
+	assert.Eventually(slowCancelled.Load, time.Second, 10*time.Millisecond)
+
+	// what was downloaded before that is kept for the next build
+	imports = imports[:1]
+	names, err := acquireImports(types.StackerConfig{DownloadConcurrency: 3}, nil, dir, imports, caches, false, nil)
+	assert.NoError(err)
+	assert.Equal([]string{path.Join(dir, "file")}, names)
+	mu.Lock()
+	assert.Equal(1, requests["/file"])
+	mu.Unlock()
+}
+
+func TestRemoteImportOptionsCached(t *testing.T) {
+	assert := assert.New(t)
+
+	heads := 0
+	srv := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodHead {
+			heads++
+		}
+		w.Write([]byte("hello world"))
+	})
+
+	hash := "b94d27b9934d3e08a52e52d7da7dabfac484efe37a5380ee9088f7ace2efcde9"
+	cache := t.TempDir()
+	for _, url := range []string{srv.URL + "/pinned", srv.URL + "/fragment#sha256=" + hash, srv.URL + "/sized"} {
+		_, err := DownloadWithOptions(cache, url, DownloadOptions{Uid: os.Getuid(), Gid: os.Getgid()})
+		assert.NoError(err)
+	}
+
+	// a cached copy matching the pin, the url's checksum or the expected
+	// size is used without asking the server
+	for _, tc := range []struct {
+		url  string
+		hash string
+		size int64
+	}{
+		{url: srv.URL + "/pinned", hash: hash},
+		{url: srv.URL + "/fragment#sha256=" + hash},
+		{url: srv.URL + "/sized", size: 11},
+	} {
+		heads = 0
+		opts, err := remoteImportOptions(types.StackerConfig{}, tc.url, cache, tc.hash, tc.size, 0, "", nil, -1, -1, false, nil)
+		assert.NoError(err)
+		assert.Equal(0, heads, tc.url)
+		assert.Equal("", opts.RemoteSize, tc.url)
+	}
+
+	heads = 0
+	opts, err := remoteImportOptions(types.StackerConfig{}, srv.URL+"/pinned", cache, "", 0, 0, "", nil, -1, -1, false, nil)
+	assert.NoError(err)
+	assert.Equal(1, heads)
+	assert.Equal("11", opts.RemoteSize)
+}
@@ -0,0 +1,169 @@
+package stacker
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"strings"
+
+	"github.com/in-toto/in-toto-golang/in_toto"
+	slsa "github.com/in-toto/in-toto-golang/in_toto/slsa_provenance/v1"
+	"github.com/opencontainers/go-digest"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/opencontainers/umoci/oci/casext"
+	"github.com/pkg/errors"
+	stackeroci "stackerbuild.io/stacker/pkg/oci"
+)
+
+// Inspection is what stacker knows about an image in an OCI layout.
+type Inspection struct {
+	Tag         string             `json:"tag"`
+	Digest      digest.Digest      `json:"digest"`
+	Layers      []ispec.Descriptor `json:"layers"`
+	Annotations map[string]string  `json:"annotations,omitempty"`
+	Config      ispec.Image        `json:"config"`
+
+	// Build is how stacker built the image, if it did.
+	Build *BuildMetadata `json:"build,omitempty"`
+}
+
+// BuildMetadata is what stacker recorded about how it built an image: what's
+// in its annotations, and its provenance if it was built with --provenance.
+type BuildMetadata struct {
+	StackerVersion string `json:"stackerVersion,omitempty"`
+	GitVersion     string `json:"gitVersion,omitempty"`
+
+	// Stackerfile is the content of the stacker file after substitutions.
+	Stackerfile string `json:"stackerfile,omitempty"`
+
+	// The rest is only known from the provenance.
+	Provenance    bool                      `json:"provenance"`
+	Substitutions map[string]string         `json:"substitutions,omitempty"`
+	Dependencies  []slsa.ResourceDescriptor `json:"dependencies,omitempty"`
+}
+
+// annotationSuffix returns the value of the annotation whose key ends with
+// the suffix of the stacker annotation format (e.g. StackerVersionAnnotation),
+// whatever the namespace it was built with.
+func annotationSuffix(annotations map[string]string, format string) string {
+	suffix := strings.TrimPrefix(format, "%s")
+	for k, v := range annotations {
+		if strings.HasSuffix(k, suffix) {
+			return v
+		}
+	}
+	return ""
+}
+
+// buildMetadata returns what stacker recorded about how it built the image
+// tagged tag with manifest, or nil if it doesn't look like stacker built it.
+func buildMetadata(oci casext.Engine, tag string, manifest ispec.Manifest) (*BuildMetadata, error) {
+	build := &BuildMetadata{
+		StackerVersion: annotationSuffix(manifest.Annotations, StackerVersionAnnotation),
+		GitVersion:     annotationSuffix(manifest.Annotations, GitVersionAnnotation),
+		Stackerfile:    annotationSuffix(manifest.Annotations, StackerContentsAnnotation),
+	}
+
+	provenance, ok, err := findProvenance(oci, tag)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		if build.StackerVersion == "" && build.Stackerfile == "" {
+			return nil, nil
+		}
+		return build, nil
+	}
+
+	reader, err := oci.GetVerifiedBlob(context.Background(), provenance.Layers[0])
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	content, err := io.ReadAll(reader)
+	if err != nil {
+		return nil, err
+	}
+
+	statement := in_toto.ProvenanceStatementSLSA1{}
+	if err := json.Unmarshal(content, &statement); err != nil {
+		return nil, errors.Wrapf(err, "couldn't parse the provenance of %s", tag)
+	}
+
+	// the external parameters are decoded as a map; go through json again
+	// for their actual type
+	raw, err := json.Marshal(statement.Predicate.BuildDefinition.ExternalParameters)
+	if err != nil {
+		return nil, err
+	}
+	params := ProvenanceParams{}
+	if err := json.Unmarshal(raw, &params); err != nil {
+		return nil, errors.Wrapf(err, "couldn't parse the provenance of %s", tag)
+	}
+
+	build.Provenance = true
+	build.Substitutions = params.Substitutions
+	build.Dependencies = statement.Predicate.BuildDefinition.ResolvedDependencies
+	return build, nil
+}
+
+// Inspect returns what's known about the image tagged tag in oci.
+func Inspect(oci casext.Engine, tag string) (*Inspection, error) {
+	descPaths, err := oci.ResolveReference(context.Background(), tag)
+	if err != nil {
+		return nil, err
+	}
+	if len(descPaths) != 1 {
+		return nil, errors.Errorf("bad descriptor %s", tag)
+	}
+
+	manifest, err := stackeroci.LookupManifest(oci, tag)
+	if err != nil {
+		return nil, err
+	}
+
+	config, err := stackeroci.LookupConfig(oci, manifest.Config)
+	if err != nil {
+		return nil, err
+	}
+
+	build, err := buildMetadata(oci, tag, manifest)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Inspection{
+		Tag:         tag,
+		Digest:      descPaths[0].Descriptor().Digest,
+		Layers:      manifest.Layers,
+		Annotations: manifest.Annotations,
+		Config:      config,
+		Build:       build,
+	}, nil
+}
+
+// InspectableTags returns the tags of the images in oci, leaving out those of
+// what's attached to them, like their SBOMs.
+func InspectableTags(oci casext.Engine) ([]string, error) {
+	ctx := context.Background()
+
+	tags, err := oci.ListReferences(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	images := []string{}
+	for _, tag := range tags {
+		descPaths, err := oci.ResolveReference(ctx, tag)
+		if err != nil {
+			return nil, err
+		}
+		if len(descPaths) == 1 && descPaths[0].Descriptor().ArtifactType != "" {
+			continue
+		}
+		images = append(images, tag)
+	}
+
+	return images, nil
+}
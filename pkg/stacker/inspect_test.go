@@ -0,0 +1,63 @@
+package stacker
+
+import (
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/opencontainers/umoci"
+	"github.com/stretchr/testify/assert"
+	"stackerbuild.io/stacker/pkg/types"
+)
+
+func TestInspect(t *testing.T) {
+	assert := assert.New(t)
+
+	dir := t.TempDir()
+	config := types.StackerConfig{
+		StackerDir: path.Join(dir, ".stacker"),
+		OCIDir:     path.Join(dir, "oci"),
+		RootFSDir:  path.Join(dir, "roots"),
+	}
+
+	oci, err := umoci.CreateLayout(config.OCIDir)
+	assert.NoError(err)
+	defer oci.Close()
+	assert.NoError(umoci.NewImage(oci, "foo"))
+
+	inspection, err := Inspect(oci, "foo")
+	if !assert.NoError(err) {
+		return
+	}
+	assert.Equal("foo", inspection.Tag)
+	assert.Empty(inspection.Layers)
+	assert.Nil(inspection.Build)
+
+	content := "foo:\n  from:\n    type: scratch\n  run: echo ${{GREETING}}\n"
+	stackerfile := path.Join(dir, "stacker.yaml")
+	assert.NoError(os.WriteFile(stackerfile, []byte(content), 0644))
+	sf, err := types.NewStackerfile(stackerfile, false, []string{"GREETING=hello"})
+	assert.NoError(err)
+	l, _ := sf.Get("foo")
+
+	tar, err := types.NewLayerType("tar", false)
+	assert.NoError(err)
+	subject := ispec.Descriptor{MediaType: ispec.MediaTypeImageManifest, Digest: inspection.Digest}
+	err = attachProvenance(config, oci, sf, l, "foo", []string{"GREETING=hello"}, map[types.LayerType]ispec.Descriptor{tar: subject}, time.Now())
+	assert.NoError(err)
+
+	inspection, err = Inspect(oci, "foo")
+	assert.NoError(err)
+	if assert.NotNil(inspection.Build) {
+		assert.True(inspection.Build.Provenance)
+		assert.Equal(map[string]string{"GREETING": "hello"}, inspection.Build.Substitutions)
+		assert.Equal(stackerfile, inspection.Build.Dependencies[0].URI)
+	}
+
+	// what's attached to the image isn't an image of its own
+	tags, err := InspectableTags(oci)
+	assert.NoError(err)
+	assert.Equal([]string{"foo"}, tags)
+}
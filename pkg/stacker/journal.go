@@ -0,0 +1,181 @@
+package stacker
+
+import (
+	"encoding/json"
+	"os"
+	"path"
+	"sync"
+
+	"github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+)
+
+// journalName is the file in a cache dir's metaDirName where DownloadAll keeps
+// its journal; it can't be mistaken for the sidecar of a cached file.
+const journalName = ".download-all"
+
+// journalEntry is what a journal knows about a download: once it completed,
+// where it was cached and what its digest was; until then, how much of it was
+// checkpointed by the last attempt.
+type journalEntry struct {
+	Path     string `json:"path,omitempty"`
+	Digest   string `json:"digest,omitempty"`
+	FinalURL string `json:"final_url,omitempty"`
+	Offset   int64  `json:"offset,omitempty"`
+}
+
+// downloadJournal records the progress of a DownloadAll in its cache dir, so
+// that when the process dies, running it again skips the downloads that
+// completed and resumes the others.
+type downloadJournal struct {
+	cacheDir string
+
+	mu      sync.Mutex
+	entries map[string]journalEntry
+}
+
+func journalPath(cacheDir string) string {
+	return path.Join(cacheDir, metaDirName, journalName)
+}
+
+// openJournal reads the journal of cacheDir, if there is one.
+func openJournal(cacheDir string) (*downloadJournal, error) {
+	j := &downloadJournal{cacheDir: cacheDir, entries: map[string]journalEntry{}}
+
+	content, err := os.ReadFile(journalPath(cacheDir))
+	if os.IsNotExist(err) {
+		return j, nil
+	} else if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	err = json.Unmarshal(content, &j.entries)
+	if err != nil {
+		netLog.Warnf("ignoring corrupt download journal in %s: %v", cacheDir, err)
+		j.entries = map[string]journalEntry{}
+	}
+
+	return j, nil
+}
+
+// journalKey is what the journal knows the download req by: its url, and its
+// cache dir if that isn't the journal's. DownloadAll sets req.CacheDir.
+func (j *downloadJournal) journalKey(req DownloadRequest) string {
+	if req.CacheDir == j.cacheDir {
+		return req.URL
+	}
+	return req.CacheDir + " " + req.URL
+}
+
+// completed returns the result of req if the journal says it completed and
+// the cached file is still what was downloaded then.
+func (j *downloadJournal) completed(req DownloadRequest) (DownloadResult, bool) {
+	url, opts := req.URL, req.Opts
+
+	j.mu.Lock()
+	e, ok := j.entries[j.journalKey(req)]
+	j.mu.Unlock()
+	if !ok {
+		return DownloadResult{}, false
+	}
+
+	if e.Path == "" {
+		if e.Offset > 0 {
+			netLog.Infof("resuming download of %s from the journal, %d bytes were downloaded", url, e.Offset)
+		}
+		return DownloadResult{}, false
+	}
+
+	src, _ := splitChecksumFragment(url)
+	hash, err := cachedDigest(e.Path, src, opts)
+	if err != nil || hash != e.Digest {
+		netLog.Infof("journaled download of %s changed since, downloading it again", url)
+		return DownloadResult{}, false
+	}
+
+	finalURL := e.FinalURL
+	if finalURL == "" {
+		finalURL = src
+	}
+
+	netLog.Debugf("download of %s completed in an earlier run, using %s", url, e.Path)
+	return DownloadResult{URL: url, Path: e.Path, Digest: digest.NewDigestFromEncoded(digest.SHA256, hash), FinalURL: finalURL}, true
+}
+
+// update records how the download req went; the journal is only an
+// optimization, so failing to write it doesn't fail the download.
+func (j *downloadJournal) update(req DownloadRequest, result DownloadResult, downloadErr error) {
+	var err error
+	if downloadErr == nil {
+		err = j.complete(req, result)
+	} else {
+		err = j.fail(req)
+	}
+	if err != nil {
+		netLog.Warnf("couldn't update download journal: %v", err)
+	}
+}
+
+// complete records the download req that produced result.
+func (j *downloadJournal) complete(req DownloadRequest, result DownloadResult) error {
+	src, _ := splitChecksumFragment(req.URL)
+	e := journalEntry{Path: result.Path, Digest: result.Digest.Encoded()}
+	if result.FinalURL != src {
+		e.FinalURL = result.FinalURL
+	}
+	return j.record(req, e)
+}
+
+// fail records the failed download req, and how much of it can be resumed.
+func (j *downloadJournal) fail(req DownloadRequest) error {
+	src, _ := splitChecksumFragment(req.URL)
+	e := journalEntry{}
+	if cp, err := readCheckpoint(cachePath(req.CacheDir, src, req.Opts.Dest)); err == nil && cp.Source == src {
+		e.Offset = cp.Offset
+	}
+	return j.record(req, e)
+}
+
+func (j *downloadJournal) record(req DownloadRequest, e journalEntry) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	j.entries[j.journalKey(req)] = e
+	content, err := json.Marshal(j.entries)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	err = createCacheDir(path.Join(j.cacheDir, metaDirName), 0)
+	if err != nil {
+		return err
+	}
+
+	// replaced in one go, so that a crash leaves either journal behind
+	tmp := journalPath(j.cacheDir) + partialExt
+	f, err := createCacheFile(tmp, os.O_RDWR|os.O_TRUNC, 0)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(content)
+	f.Close()
+	if err != nil {
+		os.RemoveAll(tmp)
+		return errors.Wrapf(err, "couldn't write download journal of %s", j.cacheDir)
+	}
+
+	return errors.Wrapf(os.Rename(tmp, journalPath(j.cacheDir)), "couldn't write download journal of %s", j.cacheDir)
+}
+
+// clear removes the journal, once everything it tracked was downloaded.
+func (j *downloadJournal) clear() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	j.entries = map[string]journalEntry{}
+	err := os.Remove(journalPath(j.cacheDir))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return errors.WithStack(err)
+}
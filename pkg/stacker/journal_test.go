@@ -0,0 +1,70 @@
+package stacker
+
+import (
+	"net/http"
+	"os"
+	"path"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDownloadAllJournal(t *testing.T) {
+	assert := assert.New(t)
+
+	var mu sync.Mutex
+	requests := map[string]int{}
+	srv := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requests[r.URL.Path]++
+		n := requests[r.URL.Path]
+		mu.Unlock()
+
+		if r.URL.Path != "/big" {
+			w.Write([]byte("hello world"))
+			return
+		}
+
+		switch {
+		case n == 1:
+			// die half way through
+			w.Header().Set("Accept-Ranges", "bytes")
+			w.Header().Set("Content-Length", "11")
+			w.Write([]byte("hello"))
+			hangUp(t, w)
+		case r.Header.Get("Range") == "bytes=5-":
+			w.Header().Set("Content-Range", "bytes 5-10/11")
+			w.WriteHeader(http.StatusPartialContent)
+			w.Write([]byte(" world"))
+		default:
+			w.Write([]byte("hello world"))
+		}
+	})
+
+	cacheDir := t.TempDir()
+	reqs := []DownloadRequest{{URL: srv.URL + "/small"}, {URL: srv.URL + "/big"}}
+	_, err := DownloadAll(cacheDir, reqs)
+	assert.ErrorContains(err, "/big")
+
+	journal, err := openJournal(cacheDir)
+	assert.NoError(err)
+	assert.Equal(path.Join(cacheDir, "small"), journal.entries[reqs[0].URL].Path)
+	assert.EqualValues(5, journal.entries[reqs[1].URL].Offset)
+
+	// the completed download is skipped, the other one resumed
+	results, err := DownloadAll(cacheDir, reqs)
+	assert.NoError(err)
+	assert.Len(results, 2)
+	assert.Equal(path.Join(cacheDir, "small"), results[0].Path)
+	assert.Equal("sha256:b94d27b9934d3e08a52e52d7da7dabfac484efe37a5380ee9088f7ace2efcde9", results[1].Digest.String())
+	mu.Lock()
+	assert.Equal(map[string]int{"/small": 1, "/big": 2}, requests)
+	mu.Unlock()
+
+	content, err := os.ReadFile(results[1].Path)
+	assert.NoError(err)
+	assert.Equal("hello world", string(content))
+
+	assert.NoFileExists(journalPath(cacheDir))
+}
@@ -0,0 +1,91 @@
+package stacker
+
+import (
+	"os"
+	"path"
+
+	"stackerbuild.io/stacker/pkg/types"
+)
+
+// RemoteImport is an http(s) import of a layer.
+type RemoteImport struct {
+	StackerFile string
+	Layer       string
+	URL         string
+	Hash        string
+
+	// Cached is set if a copy of the import is already in the layer's
+	// import cache; whether it is still current is only known once the
+	// server has been asked.
+	Cached bool
+}
+
+// walkLayers calls f with every layer of the stacker files at paths, in the
+// order they would be built.
+func (b *Builder) walkLayers(paths []string, f func(stackerFile string, name string, l types.Layer) error) error {
+	opts := b.opts
+
+	stackerFiles, err := types.NewStackerFiles(paths, opts.HashRequired, append(opts.Substitute, opts.Config.Substitutions()...))
+	if err != nil {
+		return err
+	}
+
+	dag, err := NewStackerFilesDAG(stackerFiles)
+	if err != nil {
+		return err
+	}
+
+	for _, p := range dag.Sort() {
+		sf := dag.GetStackerFile(p)
+		order, err := sf.DependencyOrder(stackerFiles)
+		if err != nil {
+			return err
+		}
+
+		for _, name := range order {
+			l, ok := sf.Get(name)
+			if !ok {
+				// a layer of a prerequisite, walked with its own file
+				continue
+			}
+
+			err = f(p, name, l)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// ListImports returns every http(s) import of the stacker files at paths, in
+// the order they would be built.
+func (b *Builder) ListImports(paths []string) ([]RemoteImport, error) {
+	result := []RemoteImport{}
+	err := b.walkLayers(paths, func(p string, name string, l types.Layer) error {
+		cache := path.Join(b.opts.Config.StackerDir, "imports", name)
+		imports := append(types.Imports{}, l.Imports...)
+		for _, i := range append(imports, l.LegacyImport...) {
+			if !isRemoteURL(i.Path) {
+				continue
+			}
+
+			src, _ := splitChecksumFragment(i.Path)
+			_, err := os.Stat(cachePath(cache, src, i.Dest))
+			result = append(result, RemoteImport{
+				StackerFile: p,
+				Layer:       name,
+				URL:         i.Path,
+				Hash:        i.Hash,
+				Cached:      err == nil,
+			})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
@@ -0,0 +1,53 @@
+package stacker
+
+import (
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"stackerbuild.io/stacker/pkg/types"
+)
+
+func TestListImports(t *testing.T) {
+	assert := assert.New(t)
+
+	dir := t.TempDir()
+	hash := strings.Repeat("a", 64)
+	stackerYaml := path.Join(dir, "stacker.yaml")
+	assert.NoError(os.WriteFile(stackerYaml, []byte(`
+child:
+  from:
+    type: built
+    tag: parent
+  imports:
+    - https://example.com/child.tar.gz#sha256=`+hash+`
+    - path: https://example.com/config
+      dest: /etc/app.conf
+parent:
+  from:
+    type: docker
+    url: docker://ubuntu:latest
+  imports:
+    - path: https://example.com/parent.tar.gz
+      hash: `+hash+`
+    - local-file
+`), 0644))
+
+	// the dest import is already in the child's cache, under its dest
+	config := types.StackerConfig{StackerDir: path.Join(dir, ".stacker")}
+	cache := path.Join(config.StackerDir, "imports", "child")
+	assert.NoError(os.MkdirAll(cache, 0755))
+	assert.NoError(os.WriteFile(path.Join(cache, "app.conf"), nil, 0644))
+
+	imports, err := NewBuilder(&BuildArgs{Config: config}).ListImports([]string{stackerYaml})
+	assert.NoError(err)
+
+	// parents first, and only what is downloaded
+	assert.Equal([]RemoteImport{
+		{StackerFile: stackerYaml, Layer: "parent", URL: "https://example.com/parent.tar.gz", Hash: hash},
+		{StackerFile: stackerYaml, Layer: "child", URL: "https://example.com/child.tar.gz#sha256=" + hash},
+		{StackerFile: stackerYaml, Layer: "child", URL: "https://example.com/config", Cached: true},
+	}, imports)
+}
@@ -0,0 +1,142 @@
+package stacker
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path"
+
+	"github.com/containers/image/v5/docker/reference"
+	"github.com/pkg/errors"
+	"stackerbuild.io/stacker/pkg/lib"
+	"stackerbuild.io/stacker/pkg/log"
+	"stackerbuild.io/stacker/pkg/types"
+)
+
+const (
+	// RuntimeDocker loads images into the docker daemon, the one of
+	// $DOCKER_HOST if it's set.
+	RuntimeDocker = "docker"
+
+	// RuntimeContainerd loads images into a containerd namespace, with
+	// ctr.
+	RuntimeContainerd = "containerd"
+)
+
+// LoadArgs is where stacker load loads images and what they are called
+// there.
+type LoadArgs struct {
+	// Runtime is RuntimeDocker or RuntimeContainerd.
+	Runtime string
+
+	// Namespace is the containerd namespace images are loaded into.
+	Namespace string
+
+	// Repository, if set, is what the names of the images start with,
+	// e.g. registry.example.com/team.
+	Repository string
+
+	// Tag is the tag of the images, latest by default.
+	Tag string
+
+	Progress bool
+}
+
+// loadReference returns the name the image of the layer tag is loaded as, e.g.
+// docker.io/library/tag:latest.
+func loadReference(tag string, args LoadArgs) (reference.Named, error) {
+	name := tag
+	if args.Repository != "" {
+		name = args.Repository + "/" + tag
+	}
+
+	imageTag := args.Tag
+	if imageTag == "" {
+		imageTag = "latest"
+	}
+
+	ref, err := reference.ParseNormalizedNamed(name + ":" + imageTag)
+	if err != nil {
+		return nil, errors.Wrapf(err, "can't load %s as %s:%s", tag, name, imageTag)
+	}
+	return ref, nil
+}
+
+// Load loads the images of the layers tags in the OCI layout into the local
+// container runtime of args.
+func Load(config types.StackerConfig, tags []string, args LoadArgs) error {
+	if args.Runtime != RuntimeDocker && args.Runtime != RuntimeContainerd {
+		return errors.Errorf("can't load images into %s: only %s and %s are supported", args.Runtime, RuntimeDocker,
+			RuntimeContainerd)
+	}
+
+	for _, tag := range tags {
+		ref, err := loadReference(tag, args)
+		if err != nil {
+			return err
+		}
+
+		log.Infof("loading %s into %s as %s", tag, args.Runtime, ref)
+		if args.Runtime == RuntimeDocker {
+			err = loadDocker(config, tag, ref, args)
+		} else {
+			err = loadContainerd(config, tag, ref, args)
+		}
+		if err != nil {
+			return errors.Wrapf(err, "couldn't load %s into %s", tag, args.Runtime)
+		}
+	}
+
+	return nil
+}
+
+func loadDocker(config types.StackerConfig, tag string, ref reference.Named, args LoadArgs) error {
+	var progress io.Writer
+	if args.Progress {
+		progress = os.Stderr
+	}
+
+	return lib.ImageCopy(lib.ImageCopyOpts{
+		Src:      fmt.Sprintf("oci:%s:%s", config.OCIDir, tag),
+		Dest:     "docker-daemon:" + ref.String(),
+		Progress: progress,
+	})
+}
+
+// loadContainerd imports an OCI archive of the image into containerd. ctr only
+// names images after the refs of archives that start with its --base-name.
+func loadContainerd(config types.StackerConfig, tag string, ref reference.Named, args LoadArgs) error {
+	ctr, err := exec.LookPath("ctr")
+	if err != nil {
+		return errors.Errorf("couldn't find ctr, install containerd to load images into it")
+	}
+
+	dir, err := os.MkdirTemp(config.StackerDir, "load-")
+	if err != nil {
+		return errors.Wrapf(err, "couldn't create an archive dir")
+	}
+	defer os.RemoveAll(dir)
+
+	archive := path.Join(dir, "image.tar")
+	err = lib.ImageCopy(lib.ImageCopyOpts{
+		Src:  fmt.Sprintf("oci:%s:%s", config.OCIDir, tag),
+		Dest: fmt.Sprintf("oci-archive:%s:%s", archive, ref.String()),
+	})
+	if err != nil {
+		return err
+	}
+
+	namespace := args.Namespace
+	if namespace == "" {
+		namespace = "default"
+	}
+
+	output, err := exec.Command(ctr, "--namespace", namespace, "images", "import",
+		"--base-name", reference.TrimNamed(ref).String(), archive).CombinedOutput()
+	if err != nil {
+		return errors.Wrapf(err, "ctr images import failed: %s", output)
+	}
+
+	return nil
+}
@@ -0,0 +1,56 @@
+package stacker
+
+import (
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/opencontainers/umoci"
+	"github.com/stretchr/testify/assert"
+	"stackerbuild.io/stacker/pkg/types"
+)
+
+func TestLoadReference(t *testing.T) {
+	assert := assert.New(t)
+
+	ref, err := loadReference("app", LoadArgs{})
+	assert.NoError(err)
+	assert.Equal("docker.io/library/app:latest", ref.String())
+
+	ref, err = loadReference("app", LoadArgs{Repository: "registry.example.com/team", Tag: "dev"})
+	assert.NoError(err)
+	assert.Equal("registry.example.com/team/app:dev", ref.String())
+
+	_, err = loadReference("App", LoadArgs{})
+	assert.Error(err)
+}
+
+func TestLoadContainerd(t *testing.T) {
+	assert := assert.New(t)
+
+	dir := t.TempDir()
+	config := types.StackerConfig{StackerDir: path.Join(dir, ".stacker"), OCIDir: path.Join(dir, "oci")}
+	assert.NoError(os.MkdirAll(config.StackerDir, 0755))
+	oci, err := umoci.CreateLayout(config.OCIDir)
+	assert.NoError(err)
+	assert.NoError(umoci.NewImage(oci, "app"))
+	oci.Close()
+
+	// a ctr that records what it was asked to import
+	bin := path.Join(dir, "bin")
+	assert.NoError(os.Mkdir(bin, 0755))
+	record := path.Join(dir, "ctr-args")
+	script := "#!/bin/sh\necho \"$@\" > " + record + "\ntar -tf \"$7\" index.json\n"
+	assert.NoError(os.WriteFile(path.Join(bin, "ctr"), []byte(script), 0755))
+	t.Setenv("PATH", bin+":"+os.Getenv("PATH"))
+
+	err = Load(config, []string{"app"}, LoadArgs{Runtime: RuntimeContainerd, Namespace: "k8s.io"})
+	assert.NoError(err)
+	args, err := os.ReadFile(record)
+	assert.NoError(err)
+	fields := strings.Fields(string(args))
+	assert.Equal([]string{"--namespace", "k8s.io", "images", "import", "--base-name", "docker.io/library/app"}, fields[:6])
+
+	assert.ErrorContains(Load(config, []string{"app"}, LoadArgs{Runtime: "podman"}), "only docker and containerd")
+}
@@ -0,0 +1,106 @@
+package stacker
+
+import (
+	"bufio"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+	"stackerbuild.io/stacker/pkg/lib"
+	"stackerbuild.io/stacker/pkg/types"
+)
+
+// ReadImportManifest reads a manifest of local files to import. Each line is
+//
+//	<path> <dest> [<sha256>]
+//
+// where path is the local file or directory (relative paths, and file://
+// urls, are relative to the manifest's directory), dest is where it goes in
+// the image, and sha256 the digest the file must have. Empty lines and lines
+// starting with # are ignored. Every source must exist; errors name the
+// manifest line at fault.
+func ReadImportManifest(manifest string) (types.Imports, error) {
+	imports, _, err := readImportManifest(manifest)
+	return imports, err
+}
+
+// readImportManifest is ReadImportManifest, also returning the line of each
+// import.
+func readImportManifest(manifest string) (types.Imports, []int, error) {
+	f, err := os.Open(manifest)
+	if err != nil {
+		return nil, nil, errors.Wrapf(err, "couldn't open import manifest")
+	}
+	defer f.Close()
+
+	imports := types.Imports{}
+	lines := []int{}
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+
+		fields := strings.Fields(text)
+		if len(fields) < 2 || len(fields) > 3 {
+			return nil, nil, errors.Errorf("%s:%d: expected <path> <dest> [<sha256>], got %q", manifest, line, text)
+		}
+
+		i := types.Import{Path: strings.TrimPrefix(fields[0], "file://"), Dest: fields[1], Uid: lib.UidEmpty, Gid: lib.GidEmpty}
+		if len(fields) == 3 {
+			i.Hash = fields[2]
+		}
+
+		if !filepath.IsAbs(i.Path) {
+			i.Path = path.Join(path.Dir(manifest), i.Path)
+		}
+		if !filepath.IsAbs(i.Dest) {
+			return nil, nil, errors.Errorf("%s:%d: dest %s cannot be relative", manifest, line, i.Dest)
+		}
+		i.Hash, err = validateHash(i.Hash)
+		if err != nil {
+			return nil, nil, errors.Wrapf(err, "%s:%d", manifest, line)
+		}
+		if _, err := os.Lstat(i.Path); err != nil {
+			return nil, nil, errors.Wrapf(err, "%s:%d: missing import", manifest, line)
+		}
+
+		imports = append(imports, i)
+		lines = append(lines, line)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, nil, errors.Wrapf(err, "couldn't read import manifest %s", manifest)
+	}
+
+	return imports, lines, nil
+}
+
+// ImportManifest copies the local files listed in manifest (see
+// ReadImportManifest) into cacheDir, as local imports are, verifying each one
+// against its digest. It returns the copies in manifest order.
+func ImportManifest(cacheDir string, manifest string) ([]string, error) {
+	imports, lines, err := readImportManifest(manifest)
+	if err != nil {
+		return nil, err
+	}
+
+	err = os.MkdirAll(cacheDir, 0755)
+	if err != nil {
+		return nil, errors.Wrapf(err, "couldn't create cache dir %s", cacheDir)
+	}
+
+	names := make([]string, 0, len(imports))
+	for n, i := range imports {
+		name, err := importFile(i.Path, cacheDir, i.Hash, i.Dest, i.Mode, i.Uid, i.Gid)
+		if err != nil {
+			return nil, errors.Wrapf(err, "%s:%d", manifest, lines[n])
+		}
+		names = append(names, name)
+	}
+
+	return names, nil
+}
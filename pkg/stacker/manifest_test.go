@@ -0,0 +1,41 @@
+package stacker
+
+import (
+	"os"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestImportManifest(t *testing.T) {
+	assert := assert.New(t)
+
+	dir := t.TempDir()
+	assert.NoError(os.WriteFile(path.Join(dir, "a"), []byte("hello world"), 0644))
+	assert.NoError(os.MkdirAll(path.Join(dir, "tree"), 0755))
+	assert.NoError(os.WriteFile(path.Join(dir, "tree", "b"), []byte("b"), 0644))
+
+	hash := "b94d27b9934d3e08a52e52d7da7dabfac484efe37a5380ee9088f7ace2efcde9"
+	manifest := path.Join(dir, "imports.manifest")
+	assert.NoError(os.WriteFile(manifest, []byte(`# curated inputs
+a /etc/a.conf `+hash+`
+
+file://tree /opt/tree
+`), 0644))
+
+	cacheDir := t.TempDir()
+	names, err := ImportManifest(cacheDir, manifest)
+	assert.NoError(err)
+	assert.Equal([]string{path.Join(cacheDir, "a.conf"), path.Join(cacheDir, "tree")}, names)
+	assert.FileExists(path.Join(cacheDir, "tree", "b"))
+
+	assert.NoError(os.WriteFile(manifest, []byte("a /a\ntree/b /b "+hash+"\n"), 0644))
+	_, err = ImportManifest(t.TempDir(), manifest)
+	assert.ErrorContains(err, manifest+":2")
+	assert.ErrorContains(err, "different than the actual hash")
+
+	assert.NoError(os.WriteFile(manifest, []byte("a /a\n\nmissing /b\n"), 0644))
+	_, err = ReadImportManifest(manifest)
+	assert.ErrorContains(err, manifest+":3: missing import")
+}
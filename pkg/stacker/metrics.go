@@ -0,0 +1,62 @@
+package stacker
+
+import (
+	neturl "net/url"
+	"time"
+)
+
+// DownloadMetrics receives continuous measurements of downloads, e.g. to be
+// exported to Prometheus (see NewPrometheusMetrics, built with the prometheus
+// build tag). host is the host of the URL being downloaded. Implementations
+// must be safe for concurrent use.
+type DownloadMetrics interface {
+	// BytesDownloaded is called with the number of bytes received in
+	// each transfer, including failed ones.
+	BytesDownloaded(host string, n int64)
+
+	// DownloadFinished is called once per DownloadWithOptions call, with
+	// its outcome: "ok", "error" or "timeout".
+	DownloadFinished(host string, outcome string, duration time.Duration)
+
+	// CacheHit is called whenever a cached copy is used instead of
+	// downloading the file.
+	CacheHit(host string)
+
+	// Retried is called for every transfer that is attempted again.
+	Retried(host string)
+}
+
+type noMetrics struct{}
+
+func (noMetrics) BytesDownloaded(string, int64)                  {}
+func (noMetrics) DownloadFinished(string, string, time.Duration) {}
+func (noMetrics) CacheHit(string)                                {}
+func (noMetrics) Retried(string)                                 {}
+
+// metricsOf returns where the measurements of a download go.
+func metricsOf(opts DownloadOptions) DownloadMetrics {
+	if opts.Metrics == nil {
+		return noMetrics{}
+	}
+	return opts.Metrics
+}
+
+// downloadHost is the host label of the metrics of rawURL.
+func downloadHost(rawURL string) string {
+	u, err := neturl.Parse(rawURL)
+	if err != nil {
+		return ""
+	}
+	return u.Host
+}
+
+// downloadOutcome is the outcome label of a download that returned err.
+func downloadOutcome(err error) string {
+	switch {
+	case err == nil:
+		return "ok"
+	case isTimeout(err):
+		return "timeout"
+	}
+	return "error"
+}
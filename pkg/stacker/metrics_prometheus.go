@@ -0,0 +1,68 @@
+//go:build prometheus
+
+package stacker
+
+import (
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// prometheusMetrics exports DownloadMetrics as Prometheus metrics.
+type prometheusMetrics struct {
+	bytes    *prometheus.CounterVec
+	duration *prometheus.HistogramVec
+	hits     *prometheus.CounterVec
+	retries  *prometheus.CounterVec
+}
+
+// NewPrometheusMetrics registers the download metrics with reg, and returns
+// the DownloadMetrics that update them. It is only built with the prometheus
+// build tag, so that stacker itself doesn't depend on the Prometheus client.
+func NewPrometheusMetrics(reg prometheus.Registerer) (DownloadMetrics, error) {
+	m := &prometheusMetrics{
+		bytes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "stacker_download_bytes_total",
+			Help: "Bytes received while downloading imports.",
+		}, []string{"host"}),
+		duration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "stacker_download_duration_seconds",
+			Help:    "How long downloading (or finding a cached copy of) an import took.",
+			Buckets: prometheus.ExponentialBuckets(0.01, 4, 10),
+		}, []string{"host", "outcome"}),
+		hits: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "stacker_cache_hits_total",
+			Help: "Imports that were used from the cache instead of being downloaded.",
+		}, []string{"host"}),
+		retries: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "stacker_download_retries_total",
+			Help: "Transfers of imports that were attempted again.",
+		}, []string{"host"}),
+	}
+
+	for _, c := range []prometheus.Collector{m.bytes, m.duration, m.hits, m.retries} {
+		err := reg.Register(c)
+		if err != nil {
+			return nil, errors.Wrapf(err, "couldn't register download metrics")
+		}
+	}
+
+	return m, nil
+}
+
+func (m *prometheusMetrics) BytesDownloaded(host string, n int64) {
+	m.bytes.WithLabelValues(host).Add(float64(n))
+}
+
+func (m *prometheusMetrics) DownloadFinished(host string, outcome string, duration time.Duration) {
+	m.duration.WithLabelValues(host, outcome).Observe(duration.Seconds())
+}
+
+func (m *prometheusMetrics) CacheHit(host string) {
+	m.hits.WithLabelValues(host).Inc()
+}
+
+func (m *prometheusMetrics) Retried(host string) {
+	m.retries.WithLabelValues(host).Inc()
+}
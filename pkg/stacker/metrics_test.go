@@ -0,0 +1,58 @@
+package stacker
+
+import (
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// recordingMetrics remembers what it was told, as "event host [detail]".
+type recordingMetrics struct {
+	events []string
+}
+
+func (m *recordingMetrics) BytesDownloaded(host string, n int64) {
+	m.events = append(m.events, fmt.Sprintf("bytes %s %d", host, n))
+}
+
+func (m *recordingMetrics) DownloadFinished(host string, outcome string, duration time.Duration) {
+	m.events = append(m.events, fmt.Sprintf("finished %s %s", host, outcome))
+}
+
+func (m *recordingMetrics) CacheHit(host string) {
+	m.events = append(m.events, "hit "+host)
+}
+
+func (m *recordingMetrics) Retried(host string) {
+	m.events = append(m.events, "retried "+host)
+}
+
+func TestDownloadMetrics(t *testing.T) {
+	assert := assert.New(t)
+
+	dir := t.TempDir()
+	metrics := &recordingMetrics{}
+	opts := DownloadOptions{
+		Metrics: metrics,
+		Uid:     os.Getuid(),
+		Gid:     os.Getgid(),
+		TransportOptions: TransportOptions{
+			Transport: &fakeTransport{body: "hello world"},
+		},
+	}
+
+	_, err := DownloadWithOptions(dir, "https://example.com/foo", opts)
+	assert.NoError(err)
+	_, err = DownloadWithOptions(dir, "https://example.com/foo", opts)
+	assert.NoError(err)
+
+	assert.Equal([]string{
+		"bytes example.com 11",
+		"finished example.com ok",
+		"hit example.com",
+		"finished example.com ok",
+	}, metrics.events)
+}
@@ -0,0 +1,98 @@
+package stacker
+
+import (
+	"bytes"
+	"io"
+	"mime"
+	"os"
+
+	"github.com/pkg/errors"
+)
+
+// fileType is a kind of file we're confident enough to name by its content.
+type fileType struct {
+	ext string
+	// contentTypes are the Content-Types servers send for it; the magic has
+	// to match as well.
+	contentTypes []string
+	magicOffset  int
+	magic        []byte
+}
+
+var detectableTypes = []fileType{
+	{".gz", []string{"application/gzip", "application/x-gzip"}, 0, []byte{0x1f, 0x8b}},
+	{".xz", []string{"application/x-xz"}, 0, []byte{0xfd, '7', 'z', 'X', 'Z', 0x00}},
+	{".zst", []string{"application/zstd"}, 0, []byte{0x28, 0xb5, 0x2f, 0xfd}},
+	{".bz2", []string{"application/x-bzip2"}, 0, []byte("BZh")},
+	{".zip", []string{"application/zip"}, 0, []byte("PK\x03\x04")},
+	{".tar", []string{"application/x-tar"}, 257, []byte("ustar")},
+}
+
+// findDetectedExtension returns the name an earlier download of key was
+// cached under, or key itself if there was none.
+func findDetectedExtension(key string) string {
+	for _, t := range detectableTypes {
+		if _, err := os.Stat(key + t.ext); err == nil {
+			return key + t.ext
+		}
+	}
+
+	return key
+}
+
+// appendDetectedExtension renames the freshly downloaded name to carry the
+// extension of its type. This is conservative: the file's magic has to match
+// a known type, and the server's Content-Type must either agree or not say
+// anything specific. Otherwise name is left alone.
+func appendDetectedExtension(name string, contentType string) (string, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+	defer f.Close()
+
+	head := make([]byte, 512)
+	n, err := io.ReadFull(f, head)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return "", errors.Wrapf(err, "couldn't read %s", name)
+	}
+	head = head[:n]
+
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+
+	for _, t := range detectableTypes {
+		end := t.magicOffset + len(t.magic)
+		if len(head) < end || !bytes.Equal(head[t.magicOffset:end], t.magic) {
+			continue
+		}
+
+		if !contentTypeAgrees(mediaType, t) {
+			netLog.Debugf("%s looks like %s, but the server says it's %s; not renaming", name, t.ext, contentType)
+			return name, nil
+		}
+
+		err = os.Rename(name, name+t.ext)
+		if err != nil {
+			return "", errors.Wrapf(err, "couldn't rename %s", name)
+		}
+
+		return name + t.ext, nil
+	}
+
+	return name, nil
+}
+
+func contentTypeAgrees(mediaType string, t fileType) bool {
+	switch mediaType {
+	case "", "application/octet-stream", "binary/octet-stream":
+		return true
+	}
+
+	for _, ct := range t.contentTypes {
+		if mediaType == ct {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,57 @@
+package stacker
+
+import (
+	"bytes"
+	"compress/gzip"
+	"net/http"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDownloadDetectExtension(t *testing.T) {
+	assert := assert.New(t)
+
+	gz := bytes.Buffer{}
+	w := gzip.NewWriter(&gz)
+	w.Write([]byte("hello world"))
+	assert.NoError(w.Close())
+
+	srv := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/accepted/file":
+			w.Header().Set("Content-Type", "application/gzip")
+		case "/rejected/file":
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		case "/missing/file":
+			// not even what net/http would sniff
+			w.Header()["Content-Type"] = nil
+		}
+		w.Write(gz.Bytes())
+	})
+
+	opts := DownloadOptions{CacheOptions: CacheOptions{DetectExtension: true}}
+	for dir, expected := range map[string]string{
+		"accepted": "file.gz",
+		"rejected": "file",
+		"missing":  "file.gz",
+	} {
+		cacheDir := t.TempDir()
+		name, err := DownloadWithOptions(cacheDir, srv.URL+"/"+dir+"/file", opts)
+		assert.NoError(err, dir)
+		assert.Equal(path.Join(cacheDir, expected), name, dir)
+
+		// and the next download finds it under that name
+		name, err = DownloadWithOptions(cacheDir, srv.URL+"/"+dir+"/file", opts)
+		assert.NoError(err, dir)
+		assert.Equal(path.Join(cacheDir, expected), name, dir)
+		assert.NoFileExists(path.Join(cacheDir, "file.gz.gz"))
+	}
+
+	// names of a file dest are left alone
+	cacheDir := t.TempDir()
+	name, err := DownloadWithOptions(cacheDir, srv.URL+"/accepted/file", DownloadOptions{Dest: "/etc/file", CacheOptions: CacheOptions{DetectExtension: true}})
+	assert.NoError(err)
+	assert.Equal(path.Join(cacheDir, "file"), name)
+}
@@ -1,158 +1,1380 @@
 package stacker
 
 import (
+	"context"
+	"fmt"
 	"io"
 	"io/fs"
 	"net/http"
 	"net/url"
 	"os"
 	"path"
+	"slices"
 	"strconv"
 	"strings"
+	"time"
 
-	"github.com/cheggaaa/pb/v3"
 	"github.com/pkg/errors"
 	"stackerbuild.io/stacker/pkg/lib"
 	"stackerbuild.io/stacker/pkg/log"
 )
 
-// download with caching support in the specified cache dir.
+// DownloadOptions controls how DownloadWithOptions fetches and caches a file.
+// Most options are grouped by what they are about in the embedded
+// ChecksumOptions, CacheOptions, RetryOptions and TransportOptions; their
+// fields are read and assigned on DownloadOptions directly.
+type DownloadOptions struct {
+	// Progress shows a progress bar while downloading.
+	Progress bool
+
+	// ForceProgress shows the progress bar (if Progress allows it) even
+	// when stderr isn't a terminal. ProgressThreshold is the size below
+	// which files are downloaded without one.
+	ForceProgress     bool
+	ProgressThreshold int64
+
+	// Dest is the import's destination; if it names a file rather than a
+	// directory, the file is cached under that name.
+	Dest string
+
+	Mode *fs.FileMode
+	Uid  int
+	Gid  int
+
+	// Range, if set, downloads only that window of the file. The slice is
+	// cached on its own, under the file's name with the range appended,
+	// and ExpectedHash is the digest of the slice. The server must
+	// support range requests.
+	Range *ByteRange
+
+	// Metrics, if set, is told about the progress of downloads.
+	Metrics DownloadMetrics
+
+	// Validate, if set, is called with the path of each downloaded file
+	// once it has been verified, before it is moved into the cache, for
+	// checks of its content (e.g. that a tarball has some file). If it
+	// returns an error, the download is thrown away and fails.
+	Validate func(path string) error
+
+	ChecksumOptions
+	CacheOptions
+	RetryOptions
+	TransportOptions
+
+	// deadline is when OverallTimeout expires for the download in
+	// progress, set by fetch.
+	deadline time.Time
+
+	// ctx, if set, cancels the download when it is done, e.g. when
+	// DownloadAll gives up on a batch.
+	ctx context.Context
+}
+
+// ChecksumOptions are what a download is verified against.
+type ChecksumOptions struct {
+	// ExpectedHash is the (hex encoded) sha256 the downloaded file must
+	// have; if empty, the download is not checked.
+	ExpectedHash string
+
+	// ExpectedSize, if set, is the size the file must have. A cached copy
+	// of that size is used without asking the server about it, and
+	// downloads of any other size fail.
+	ExpectedSize int64
+
+	// ExpectedUncompressedHash is the (hex encoded) sha256 the decompressed
+	// content of the downloaded file must have, e.g. of the tar in a
+	// .tar.gz, regardless of how the server compressed it. When it is set,
+	// it alone decides whether a cached copy is valid; checksums reported
+	// by the server and ExpectedHash are of the compressed file, and are
+	// only checked against a fresh download. With CacheUncompressed, the
+	// decompressed content is cached instead of the download, under its
+	// name without the compression extension.
+	ExpectedUncompressedHash string
+	CacheUncompressed        bool
+
+	// HashPriority is the order in which the algorithms of the checksums
+	// a server advertises are preferred; only the local digest for the
+	// first one available is computed. It defaults to sha256, sha512,
+	// sha1.
+	HashPriority []string
+
+	// ChecksumPolicy is how much the download insists on being verified
+	// against a checksum, see ChecksumPolicy.
+	ChecksumPolicy ChecksumPolicy
+
+	// Verifier, if set, checks the file's detached signature before the
+	// file is accepted.
+	Verifier SignatureVerifier
+
+	// SignatureURL is where the detached signature lives; it defaults to
+	// the URL of the file with ".sig" appended.
+	SignatureURL string
+}
+
+// CacheOptions decide whether a cached copy of a file is used, and how the
+// cache is written.
+type CacheOptions struct {
+	// RemoteHash and RemoteSize are what the server reported for the file
+	// (see FileInfo); they decide whether a cached copy is valid.
+	RemoteHash string
+	RemoteSize string
+
+	// RemoteETag and RemoteLastModified are the validators the server
+	// reported for the file (see FileInfo). When Revalidate is set and
+	// they are those of the cached copy, it is used without a
+	// conditional request.
+	RemoteETag         string
+	RemoteLastModified string
+
+	// RemoteHashAlgorithm is the algorithm of RemoteHash, sha256 if
+	// empty. Only a sha256 RemoteHash can be what a download is verified
+	// against (see ChecksumPolicy); others only decide about the cache.
+	RemoteHashAlgorithm string
+
+	// FileMode, SidecarMode and DirMode are the permissions used when
+	// creating cached files, their sidecars (e.g. signatures) and the cache
+	// directory itself. They default to 0644, 0644 and 0755; when set
+	// explicitly they are applied regardless of the umask, so that e.g. a
+	// group writable cache can be shared between users.
+	FileMode    fs.FileMode
+	SidecarMode fs.FileMode
+	DirMode     fs.FileMode
+
+	// BaseCaches are consulted, in order, when a file isn't cached in the
+	// cache dir yet. A valid copy found in one of them is copied to the
+	// cache dir instead of being downloaded; they are never written to.
+	BaseCaches []CacheStore
+
+	// DetectExtension appends an extension matching the downloaded file's
+	// type (e.g. .gz) to the cached file's name when the URL doesn't end in
+	// one and the import has no file dest. See appendDetectedExtension.
+	DetectExtension bool
+
+	// RecheckInterval, if set, is how long a cached file is trusted after
+	// it was last verified against the digest recorded when it was
+	// downloaded. Older entries are re-hashed (and re-downloaded if they
+	// changed) before being used.
+	RecheckInterval time.Duration
+
+	// Revalidate makes Download check cached files whose validity can't
+	// be established from the server's checksum with a conditional
+	// request, using the ETag and Last-Modified the server sent with
+	// them.
+	Revalidate bool
+
+	// VerifyOnRead makes Download hash cached files every time they are
+	// used. Otherwise, the digest recorded in a cached file's metadata is
+	// trusted as long as its size and mtime haven't changed since.
+	VerifyOnRead bool
+
+	// SizeChangePolicy is what happens when the server reports a
+	// different size for a pinned file (one with ExpectedHash or a
+	// #sha256= fragment) than that of its cached copy.
+	SizeChangePolicy SizeChangePolicy
+
+	// TTL, if set, is how long a download is used before it is
+	// considered stale. Expired cached copies are revalidated with a
+	// conditional request when the server sent validators, and downloaded
+	// again otherwise, even if they match ExpectedHash.
+	TTL time.Duration
+}
+
+// RetryOptions decide which failed transfers are attempted again, and when.
+type RetryOptions struct {
+	// Retries is how many more times a transfer (or a request about the
+	// file, see FileInfo) that failed with a transient error is attempted.
+	Retries int
+
+	// RetryBackoff is how long to wait before the first retry; the wait
+	// doubles with every attempt, up to a minute. Zero retries right away.
+	RetryBackoff time.Duration
+
+	// RetryStatusCodes, if set, are the http statuses worth retrying,
+	// instead of 5xx and 429. Connection errors are always retried.
+	RetryStatusCodes []int
+
+	// ShouldRetry, if set, decides which failed transfers are worth
+	// retrying instead of DefaultShouldRetry. Checksum mismatches are
+	// never retried, whatever it says.
+	ShouldRetry func(resp *http.Response, err error) bool
+}
+
+// TransportOptions are how requests are made: timeouts, headers, the
+// connections they go over and how the file is transferred.
+type TransportOptions struct {
+	// ConnectTimeout bounds how long establishing a connection to the
+	// server may take, StallTimeout how long the server may go without
+	// sending us anything. If either expires and there is a cached copy of
+	// the file (that matches ExpectedHash, if set), the cached copy is used
+	// instead. Zero means no timeout.
+	ConnectTimeout time.Duration
+	StallTimeout   time.Duration
+
+	// ResponseHeaderTimeout bounds how long the server may take to start
+	// answering a request; it defaults to StallTimeout. OverallTimeout
+	// bounds the whole download, retries included. Zero means no timeout.
+	ResponseHeaderTimeout time.Duration
+	OverallTimeout        time.Duration
+
+	// Network, if set, is the network ("tcp4" or "tcp6") connections to
+	// the server are made over, e.g. to stay off a broken IPv6 route. By
+	// default both are tried.
+	Network string
+
+	// Headers are added to every request made for the download. Values
+	// of sensitive headers (see redactHeaders) are never logged.
+	Headers http.Header
+
+	// Credentials, if set, authenticate the requests; see Credentials.
+	Credentials *Credentials
+
+	// Transport, if set, is used to make the requests instead of the
+	// default transport; the timeouts above are then up to it.
+	Transport http.RoundTripper
+
+	// CacheProxy, if set, is the base URL of a pull-through cache that
+	// all requests are sent to instead: https://example.com/foo is
+	// requested as <CacheProxy>/https/example.com/foo. Everything else
+	// (cache names, metadata, logs) still uses the original URL.
+	CacheProxy string
+
+	// RateLimiter, if set, limits the rate of requests and bytes per
+	// server. It should be shared by all downloads.
+	RateLimiter *RateLimiter
+
+	// Encodings are the content codings (gzip, zstd) the server may
+	// compress the file with, in order of preference. The cached file,
+	// and so every digest of it, is the decompressed content. Resumed and
+	// segmented downloads are always requested as is.
+	Encodings []string
+
+	// Resume keeps partial downloads around, so that a later attempt can
+	// continue where they stopped with a range request. Only downloads
+	// from servers that advertise Accept-Ranges are kept; the bytes
+	// already downloaded are checked against a checkpoint of their digest
+	// before continuing, and If-Range makes sure the file didn't change
+	// upstream in the meantime.
+	Resume bool
+
+	// Segments, if more than one, is how many byte ranges of files of at
+	// least SegmentThreshold bytes are downloaded at once, when the server
+	// supports it. Each range is SegmentSize bytes, or an even share of
+	// the file if that's zero.
+	Segments         int
+	SegmentSize      int64
+	SegmentThreshold int64
+}
+
+// DefaultOptions returns conservative settings for downloads: servers get
+// half a minute to accept a connection and a minute to start answering, a
+// transfer may not stall for more than five minutes, and transient failures
+// are retried three times. There is no overall timeout, large files can take
+// as long as they take.
+func DefaultOptions() DownloadOptions {
+	return DownloadOptions{
+		Progress:          true,
+		ProgressThreshold: defaultProgressThreshold,
+		Uid:               os.Getuid(),
+		Gid:               os.Getgid(),
+		CacheOptions: CacheOptions{
+			Revalidate: true,
+		},
+		RetryOptions: RetryOptions{
+			Retries:      3,
+			RetryBackoff: time.Second,
+		},
+		TransportOptions: TransportOptions{
+			Resume:                true,
+			ConnectTimeout:        30 * time.Second,
+			ResponseHeaderTimeout: time.Minute,
+			StallTimeout:          5 * time.Minute,
+		},
+	}
+}
+
+// netLog is where downloads log, so that their noise can be tuned separately
+// from the rest of the build.
+var netLog = log.NewScope("network")
+
+const (
+	defaultCacheFileMode fs.FileMode = 0644
+	defaultCacheDirMode  fs.FileMode = 0755
+
+	// files smaller than this are not worth a progress bar
+	defaultProgressThreshold = 1024 * 1024
+)
+
+// createCacheFile opens name for writing, creating it with mode (or the
+// default cache file mode if mode is zero).
+func createCacheFile(name string, flag int, mode fs.FileMode) (*os.File, error) {
+	if mode == 0 {
+		return os.OpenFile(name, flag|os.O_CREATE, defaultCacheFileMode)
+	}
+
+	f, err := os.OpenFile(name, flag|os.O_CREATE, mode)
+	if err != nil {
+		return nil, err
+	}
+
+	err = f.Chmod(mode)
+	if err != nil {
+		f.Close()
+		return nil, errors.Wrapf(err, "couldn't chmod %s", name)
+	}
+
+	return f, nil
+}
+
+// createCacheDir makes sure dir exists, in the same way createCacheFile
+// treats files.
+func createCacheDir(dir string, mode fs.FileMode) error {
+	if mode == 0 {
+		return errors.WithStack(os.MkdirAll(dir, defaultCacheDirMode))
+	}
+
+	if _, err := os.Stat(dir); err == nil {
+		return nil
+	}
+
+	err := os.MkdirAll(dir, mode)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	return errors.WithStack(os.Chmod(dir, mode))
+}
+
+// download with caching support in the specified cache dir. It keeps the
+// behaviour it always had: no retries, timeouts, resume or revalidation; use
+// DownloadWithOptions (e.g. with DefaultOptions) for those.
 func Download(cacheDir string, url string, progress bool, expectedHash, remoteHash, remoteSize string,
 	idest string, mode *fs.FileMode, uid, gid int,
 ) (string, error) {
-	var name string
-	if idest != "" && idest[len(idest)-1:] != "/" {
-		name = path.Join(cacheDir, path.Base(idest))
-	} else {
-		name = path.Join(cacheDir, path.Base(url))
+	return DownloadWithOptions(cacheDir, url, DownloadOptions{
+		Progress: progress,
+		Dest:     idest,
+		Mode:     mode,
+		Uid:      uid,
+		Gid:      gid,
+		ChecksumOptions: ChecksumOptions{
+			ExpectedHash: expectedHash,
+		},
+		CacheOptions: CacheOptions{
+			RemoteHash: remoteHash,
+			RemoteSize: remoteSize,
+		},
+	})
+}
+
+// CachePath returns where Download places url in cacheDir, without doing any
+// I/O. The name is derived from the URL alone: a Content-Disposition header
+// sent by the server is ignored, so that the location is known before
+// anything is fetched. (Imports with a file dest are cached under the dest's
+// name instead, see cachePath.)
+func CachePath(cacheDir string, url string) string {
+	return cachePath(cacheDir, url, "")
+}
+
+// cachePath returns where src is cached in cacheDir when imported to dest;
+// a checksum fragment on src doesn't change where that is.
+func cachePath(cacheDir string, src string, dest string) string {
+	src, _ = splitChecksumFragment(src)
+	if dest != "" && dest[len(dest)-1:] != "/" {
+		return path.Join(cacheDir, path.Base(dest))
 	}
 
-	if fi, err := os.Stat(name); err == nil {
-		// Couldn't get remoteHash then use cached copy of import
-		if remoteHash == "" {
-			log.Infof("Couldn't obtain file info of %s, using cached copy", url)
-			return name, nil
-		}
-		// File is found in cache
-		// need to check if cache is valid before using it
-		localHash, err := lib.HashFile(name, false)
+	return path.Join(cacheDir, path.Base(src))
+}
+
+// DownloadWithOptions is Download, configured by opts.
+func DownloadWithOptions(cacheDir string, url string, opts DownloadOptions) (string, error) {
+	start := time.Now()
+	name, err := downloadWithOptions(cacheDir, url, opts)
+	metricsOf(opts).DownloadFinished(downloadHost(url), downloadOutcome(err), time.Since(start))
+	if err == nil {
+		markUsed(name, opts)
+	}
+	return name, err
+}
+
+func downloadWithOptions(cacheDir string, url string, opts DownloadOptions) (string, error) {
+	url, fragmentHash := splitChecksumFragment(url)
+	fragmentHash, err := canonicalSHA256(fragmentHash)
+	if err != nil {
+		return "", errors.Wrapf(err, "invalid checksum in url %s", url)
+	}
+
+	opts, err = canonicalHashes(opts)
+	if err != nil {
+		return "", errors.Wrapf(err, "couldn't download %s", url)
+	}
+
+	pinned := opts.ExpectedHash != "" || fragmentHash != ""
+	opts, err = applyChecksumPolicy(url, fragmentHash, opts)
+	if err != nil {
+		return "", err
+	}
+
+	if opts.CacheUncompressed && opts.ExpectedUncompressedHash == "" {
+		return "", errors.Errorf("can't cache %s uncompressed without its uncompressed hash", url)
+	}
+
+	err = createCacheDir(cacheDir, opts.DirMode)
+	if err != nil {
+		return "", errors.Wrapf(err, "couldn't create cache dir %s", cacheDir)
+	}
+
+	err = checkCacheDir(cacheDir)
+	if err != nil {
+		return "", err
+	}
+
+	if opts.Range != nil {
+		return downloadRange(cacheDir, url, opts)
+	}
+
+	key := cachePath(cacheDir, url, opts.Dest)
+	if opts.CacheUncompressed && (opts.Dest == "" || strings.HasSuffix(opts.Dest, "/")) {
+		key = uncompressedName(key)
+	}
+	name := key
+	detectExt := opts.DetectExtension && path.Ext(key) == "" && (opts.Dest == "" || strings.HasSuffix(opts.Dest, "/"))
+	if detectExt {
+		name = findDetectedExtension(key)
+	}
+
+	err = seedFromBaseCaches(name, url, opts)
+	if err != nil {
+		return "", err
+	}
+
+	// uncompressed copies aren't what the url has, and names with a
+	// detected extension aren't known up front
+	byDigest := !opts.CacheUncompressed && !detectExt
+	if byDigest {
+		_, err = relinkContent(name, url, opts)
 		if err != nil {
 			return "", err
 		}
-		localHash = strings.TrimPrefix(localHash, "sha256:")
-		localSize := strconv.FormatInt(fi.Size(), 10)
-		log.Debugf("Local file: hash: %s length: %s", localHash, localSize)
-
-		if localHash == remoteHash {
-			// Cached file has same hash as the remote file
-			log.Infof("matched hash of %s, using cached copy", url)
-			return name, nil
-		} else if localSize == remoteSize {
-			// Cached file has same content length as the remote file
-			log.Infof("matched content length of %s, taking a leap of faith and using cached copy", url)
-			return name, nil
-		}
-		// Cached file has a different hash from the remote one
-		// Need to cleanup
-		err = os.RemoveAll(name)
+	}
+
+	err = checkSizeChange(name, url, pinned, opts)
+	if err != nil {
+		return "", err
+	}
+
+	c, err := checkCache(name, url, pinned, opts)
+	if err != nil {
+		return "", err
+	}
+
+	if !c.cached {
+		if _, err := os.Stat(name); os.IsNotExist(err) {
+			c.why = "not cached"
+		} else if len(c.validators) > 0 && c.why == "cached copy is stale" {
+			c.why = "the server has a newer copy"
+		}
+
+		result, err := fetch(name, url, c.validators, opts)
+		switch {
+		case err != nil && len(c.validators) > 0 && isRetryable(err):
+			c.hit = cacheHit{reason: fmt.Sprintf("couldn't revalidate it: %v", err), warn: true}
+			c.cached = true
+		case err != nil && isTimeout(err) && cacheMatchesExpectedHash(name, url, opts):
+			c.hit = cacheHit{reason: err.Error(), warn: true}
+			c.cached = true
+		case err != nil:
+			return "", err
+		case result.notModified:
+			c.revalidated = true
+			c.cached = true
+			err = renewExpiry(name, opts)
+			if err != nil {
+				return "", err
+			}
+		default:
+			if detectExt && name == key {
+				name, err = appendDetectedExtension(name, result.contentType)
+				if err != nil {
+					return "", err
+				}
+			}
+
+			err = recordFetched(name, url, result, opts)
+			if err != nil {
+				return "", err
+			}
+		}
+	}
+
+	logCacheOutcome(url, c)
+
+	if c.cached {
+		metricsOf(opts).CacheHit(downloadHost(url))
+	}
+
+	if opts.Verifier != nil {
+		err = verifySignature(name, url, !c.cached, opts)
 		if err != nil {
+			os.RemoveAll(name)
 			return "", err
 		}
-	} else if !os.IsNotExist(err) {
+	}
+
+	if byDigest {
+		storeContent(name, url, opts)
+	}
+
+	return name, nil
+}
+
+// cacheCheck is what checkCache found out about a cached file: whether it
+// is used and why (hit), or why it is downloaded again instead (why, and the
+// validators to ask the server with). revalidated is set when the server
+// confirmed the cached copy is current.
+type cacheCheck struct {
+	cached      bool
+	hit         cacheHit
+	why         string
+	revalidated bool
+	validators  http.Header
+}
+
+// checkCache decides whether the cached copy name of url can be used, going
+// through the checks opts ask for in turn.
+func checkCache(name string, url string, pinned bool, opts DownloadOptions) (cacheCheck, error) {
+	c := cacheCheck{why: "cached copy is stale"}
+
+	cached, err := cacheHasExpectedSize(name, url, opts)
+	if err != nil {
+		return c, err
+	}
+	if cached {
+		c.hit = cacheHit{reason: fmt.Sprintf("it has the expected size of %d bytes", opts.ExpectedSize), verified: true}
+	}
+
+	switch {
+	case opts.ExpectedUncompressedHash != "":
+		cached, err = cacheMatchesUncompressedHash(name, url, opts)
+		if err != nil {
+			return c, err
+		}
+		c.hit = cacheHit{reason: "its uncompressed content matches the expected checksum", verified: true}
+	case pinned && !cached:
+		// the pin decides, whatever the server says about the file
+		cached = cacheMatchesExpectedHash(name, url, opts)
+		c.hit = cacheHit{reason: "it matches its pinned checksum", verified: true}
+		c.why = "cached copy doesn't match its pinned checksum"
+	case !cached:
+		c.hit, err = cacheIsValid(name, url, opts)
+		if err != nil {
+			return c, err
+		}
+		cached = c.hit.ok()
+	}
+
+	if cached && opts.ChecksumPolicy != ChecksumNone {
+		if !cacheMatchesExpectedHash(name, url, opts) {
+			c.why = "cached copy doesn't match its checksum"
+			cached = false
+		} else if !c.hit.verified && opts.ExpectedHash != "" {
+			c.hit = cacheHit{reason: "it matches its expected checksum", verified: true}
+		}
+	}
+
+	if cached && opts.RecheckInterval != 0 {
+		cached, err = recheckCache(name, url, opts)
+		if err != nil {
+			return c, err
+		}
+		if !cached {
+			c.why = "cached copy changed since it was downloaded"
+		}
+	}
+
+	if cached && opts.Revalidate && opts.RemoteHash == "" {
+		unchanged, err := validatorsUnchanged(name, url, opts)
+		if err != nil {
+			return c, err
+		}
+
+		if unchanged {
+			c.revalidated = true
+		} else {
+			c.validators, err = cachedValidators(name, url)
+			if err != nil {
+				return c, err
+			}
+			// without validators, the cached copy is trusted as before
+			cached = len(c.validators) == 0
+		}
+	}
+
+	if cached && opts.TTL != 0 {
+		expired, err := cacheExpired(name, url)
+		if err != nil {
+			return c, err
+		}
+		if expired {
+			netLog.Debugf("cached copy of %s expired, checking for a new one", url)
+			c.why = "cached copy expired"
+			c.validators, err = cachedValidators(name, url)
+			if err != nil {
+				return c, err
+			}
+			cached = false
+		}
+	}
+
+	c.cached = cached
+	return c, nil
+}
+
+// logCacheOutcome logs the one line about how the download of url was
+// served.
+func logCacheOutcome(url string, c cacheCheck) {
+	switch {
+	case !c.cached:
+		netLog.Infof("downloaded %s: %s", url, c.why)
+	case c.revalidated:
+		netLog.Infof("cache hit (revalidated) for %s: the server says it is not modified", url)
+	case c.hit.verified:
+		netLog.Infof("cache hit (verified) for %s: %s", url, c.hit.reason)
+	case c.hit.warn:
+		netLog.Warnf("cache hit (unverified) for %s: %s", url, c.hit.reason)
+	default:
+		netLog.Infof("cache hit (unverified) for %s: %s", url, c.hit.reason)
+	}
+}
+
+// localDigest returns the digest of the cached name of url, computed with
+// opts.RemoteHashAlgorithm so that it can be compared with opts.RemoteHash.
+func localDigest(name string, url string, opts DownloadOptions) (string, error) {
+	if opts.RemoteHashAlgorithm == "" || opts.RemoteHashAlgorithm == "sha256" {
+		return cachedDigest(name, url, opts)
+	}
+
+	netLog.Debugf("hashing %s with %s to compare it with the server's checksum", name, opts.RemoteHashAlgorithm)
+	return lib.HashFileAlgorithm(name, opts.RemoteHashAlgorithm)
+}
+
+// cacheHit is why a cached copy may be used, for the line Download logs about
+// it. The zero value means it may not.
+type cacheHit struct {
+	reason string
+	// verified is set if the copy was checked against a checksum (or
+	// the expected size), warn if using it is a leap of faith.
+	verified bool
+	warn     bool
+}
+
+func (h cacheHit) ok() bool {
+	return h.reason != ""
+}
+
+// cacheIsValid returns whether and why name is a usable cached copy of url.
+// Stale copies are left alone until a new copy has been downloaded, so that
+// they can still be used if the server is unreachable.
+func cacheIsValid(name string, url string, opts DownloadOptions) (cacheHit, error) {
+	fi, err := os.Stat(name)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return cacheHit{}, nil
+		}
 		// File is not found in cache but there are other errors
-		return "", err
+		return cacheHit{}, err
 	}
 
-	// File is not in cache
-	// it wasn't there in the first place or it was cleaned up
-	out, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE, 0644)
+	// another url with the same name was cached there
+	meta, err := readCacheMeta(name)
 	if err != nil {
-		return "", err
+		return cacheHit{}, err
+	}
+	if meta.Source != "" && meta.Source != url {
+		netLog.Debugf("cached %s was downloaded from %s, not %s", name, meta.Source, url)
+		return cacheHit{}, nil
 	}
-	defer out.Close()
 
-	log.Infof("downloading %v", url)
+	// Couldn't get remoteHash then use cached copy of import
+	if opts.RemoteHash == "" {
+		return cacheHit{reason: "the server reported no checksum to check it against"}, nil
+	}
+	// File is found in cache
+	// need to check if cache is valid before using it
+	localHash, err := localDigest(name, url, opts)
+	if err != nil {
+		return cacheHit{}, err
+	}
+	localSize := strconv.FormatInt(fi.Size(), 10)
+	netLog.Debugf("Local file: hash: %s length: %s", localHash, localSize)
 
-	resp, err := http.Get(url)
+	switch matchRemote(localHash, localSize, opts.RemoteHash, opts.RemoteSize) {
+	case HashMatch:
+		// Cached file has same hash as the remote file
+		return cacheHit{reason: fmt.Sprintf("it matches the server's %s checksum", hashAlgorithmName(opts)), verified: true}, nil
+	case LengthMatch:
+		// Cached file has same content length as the remote file
+		return cacheHit{reason: "it has the length the server reports, but not its checksum", warn: true}, nil
+	}
+	// Cached file has a different hash from the remote one
+	netLog.Debugf("cached copy of %s is stale: server checksum %s (length %s), local checksum %s (length %s)",
+		url, opts.RemoteHash, opts.RemoteSize, localHash, localSize)
+	return cacheHit{}, nil
+}
+
+// hashAlgorithmName returns the algorithm of opts.RemoteHash.
+func hashAlgorithmName(opts DownloadOptions) string {
+	if opts.RemoteHashAlgorithm == "" {
+		return "sha256"
+	}
+	return opts.RemoteHashAlgorithm
+}
+
+// cacheHasExpectedSize returns true if opts.ExpectedSize is set, and the cached
+// name has that size.
+func cacheHasExpectedSize(name string, url string, opts DownloadOptions) (bool, error) {
+	if opts.ExpectedSize == 0 {
+		return false, nil
+	}
+
+	fi, err := os.Stat(name)
+	if os.IsNotExist(err) {
+		return false, nil
+	} else if err != nil {
+		return false, errors.WithStack(err)
+	}
+
+	if fi.Size() != opts.ExpectedSize {
+		netLog.Debugf("cached copy of %s has %d bytes instead of %d", url, fi.Size(), opts.ExpectedSize)
+		return false, nil
+	}
+
+	return true, nil
+}
+
+// cacheMatchesExpectedHash returns true if there is a cached copy of name that
+// is acceptable as a fallback, i.e. it exists and matches the pinned hash, if
+// any.
+func cacheMatchesExpectedHash(name string, url string, opts DownloadOptions) bool {
+	if _, err := os.Stat(name); err != nil {
+		return false
+	}
+
+	if opts.ExpectedUncompressedHash != "" {
+		matches, err := cacheMatchesUncompressedHash(name, url, opts)
+		return err == nil && matches
+	}
+
+	if opts.ExpectedHash == "" {
+		return true
+	}
+
+	localHash, err := cachedDigest(name, url, opts)
+	return err == nil && localHash == opts.ExpectedHash
+}
+
+// ChecksumMismatchError is returned when a downloaded file doesn't match its
+// expected hash. Server is the checksum the server advertised for it, if any,
+// which tells an upstream change (Server == Actual) from a corrupted transfer.
+type ChecksumMismatchError struct {
+	URL      string
+	Expected string
+	Actual   string
+	Server   string
+}
+
+func (e *ChecksumMismatchError) Error() string {
+	msg := fmt.Sprintf("Downloaded file hash does not match. Expected: %s Actual: %s", e.Expected, e.Actual)
+	if e.Server != "" {
+		msg += fmt.Sprintf(" Server: %s", e.Server)
+	}
+	return msg
+}
+
+// downloadStatusError is returned when the server answers a download with
+// something other than 200 OK.
+type downloadStatusError struct {
+	url        string
+	status     string
+	statusCode int
+	resp       *http.Response
+}
+
+func (e *downloadStatusError) Error() string {
+	return fmt.Sprintf("couldn't download %s: %s", e.url, e.status)
+}
+
+// DefaultShouldRetry returns true if a failed transfer is worth attempting
+// again: the server had a (possibly transient) problem, asked us to slow down,
+// or we couldn't talk to it. resp is the server's answer, if it sent one (its
+// body is already closed), and err what went wrong.
+func DefaultShouldRetry(resp *http.Response, err error) bool {
+	if resp != nil {
+		return resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests
+	}
+
+	return true
+}
+
+// isRetryable returns true if DefaultShouldRetry says err is worth retrying.
+func isRetryable(err error) bool {
+	return shouldRetry(err, DownloadOptions{})
+}
+
+// shouldRetry returns true if opts.ShouldRetry (or DefaultShouldRetry) says
+// the failed transfer is worth retrying.
+func shouldRetry(err error, opts DownloadOptions) bool {
+	// retrying won't make a bad artifact good, nor one nobody wants
+	if errors.As(err, new(*ChecksumMismatchError)) || cancelled(opts) {
+		return false
+	}
+
+	var resp *http.Response
+	var statusErr *downloadStatusError
+	if errors.As(err, &statusErr) {
+		resp = statusErr.resp
+	}
+
+	if opts.ShouldRetry != nil {
+		return opts.ShouldRetry(resp, err)
+	}
+	if resp != nil && len(opts.RetryStatusCodes) > 0 {
+		return slices.Contains(opts.RetryStatusCodes, resp.StatusCode)
+	}
+	return DefaultShouldRetry(resp, err)
+}
+
+// fetch downloads url to name, checking it against opts.ExpectedHash. The
+// download goes to a temporary file which only replaces name once complete.
+func fetch(name string, url string, validators http.Header, opts DownloadOptions) (fetchResult, error) {
+	if opts.OverallTimeout != 0 {
+		opts.deadline = time.Now().Add(opts.OverallTimeout)
+	}
+
+	err := createCacheDir(path.Join(path.Dir(name), metaDirName), opts.DirMode)
 	if err != nil {
-		os.RemoveAll(name)
-		return "", err
+		return fetchResult{}, err
 	}
-	defer resp.Body.Close()
 
-	if resp.StatusCode != 200 {
-		os.RemoveAll(name)
-		return "", errors.Errorf("couldn't download %s: %s", url, resp.Status)
+	partial := sidecarPath(name, partialExt)
+	flags := os.O_RDWR
+	if !opts.Resume {
+		flags |= os.O_TRUNC
+	}
+	out, err := createCacheFile(partial, flags, opts.FileMode)
+	if err != nil {
+		return fetchResult{}, err
 	}
+	defer out.Close()
 
-	source := resp.Body
-	if progress {
-		bar := pb.New(int(resp.ContentLength)).Set(pb.Bytes, true)
-		bar.Start()
-		source = bar.NewProxyReader(source)
-		defer bar.Finish()
+	pw, err := newPartialWriter(out, name, url, opts)
+	if err != nil {
+		return fetchResult{}, err
 	}
 
-	_, err = io.Copy(out, source)
+	result, err := fetchTo(pw, url, validators, opts)
+	if err == nil && result.notModified {
+		removeCheckpoint(name)
+		return result, errors.WithStack(os.RemoveAll(partial))
+	} else if err != nil {
+		if opts.Resume && pw.offset > 0 && pw.acceptRanges && !errors.As(err, new(*ChecksumMismatchError)) {
+			// keep what we have for next time
+			return fetchResult{}, pw.errorWithCheckpoint(err)
+		}
+		removeCheckpoint(name)
+		os.RemoveAll(partial)
+		return fetchResult{}, err
+	}
 
+	removeCheckpoint(name)
+	err = validateDownload(partial, url, opts)
 	if err != nil {
-		return "", err
+		os.RemoveAll(partial)
+		return fetchResult{}, err
 	}
-	if expectedHash != "" {
-		log.Infof("Checking shasum of downloaded file")
 
-		downloadHash, err := lib.HashFile(name, false)
+	return result, errors.Wrapf(os.Rename(partial, name), "couldn't move download of %s into the cache", url)
+}
+
+// validateDownload runs opts.Validate, if any, on the download name of url.
+func validateDownload(name string, url string, opts DownloadOptions) error {
+	if opts.Validate == nil {
+		return nil
+	}
+
+	return errors.Wrapf(opts.Validate(name), "download of %s failed validation", url)
+}
+
+// fetchResult is what we learned about a file while downloading it.
+type fetchResult struct {
+	contentType  string
+	etag         string
+	lastModified string
+	// finalURL is where the file was downloaded from, after redirects.
+	finalURL string
+
+	// notModified is set when a conditional request found that the
+	// cached copy is still current; nothing was downloaded then.
+	notModified bool
+}
+
+func fetchTo(pw *partialWriter, url string, validators http.Header, opts DownloadOptions) (fetchResult, error) {
+	netLog.Infof("downloading %v", url)
+
+	progress := newDownloadProgress(opts)
+	defer progress.finish()
+
+	client := httpClient(opts)
+	out := pw.out
+
+	var result fetchResult
+	segmented := false
+	if opts.Segments > 1 && pw.offset == 0 && len(validators) == 0 && len(opts.Encodings) == 0 {
+		if size, headResult, ok := segmentedSize(url, opts); ok {
+			err := fetchSegments(client, out, url, size, opts, progress)
+			if err == nil {
+				segmented = true
+				result = headResult
+				pw.offset = size
+			} else {
+				netLog.Infof("segmented download of %s failed, downloading it in one go: %v", url, err)
+				err = pw.reset()
+				if err != nil {
+					return fetchResult{}, err
+				}
+			}
+		}
+	}
+
+	for attempt := 1; !segmented; attempt++ {
+		var err error
+		result, err = fetchOnce(client, pw, url, validators, opts, progress)
+		if err == nil && result.notModified {
+			return result, nil
+		} else if err == nil {
+			break
+		}
+
+		if attempt > opts.Retries || !shouldRetry(err, opts) || pastDeadline(opts) {
+			return fetchResult{}, err
+		}
+
+		netLog.Infof("download of %s failed, retrying (attempt %d): %v", url, attempt+1, err)
+		if waitErr := waitToRetry(context.Background(), attempt, opts); waitErr != nil {
+			return fetchResult{}, err
+		}
+		progress.retrying(attempt + 1)
+		metricsOf(opts).Retried(downloadHost(url))
+
+		if !opts.Resume {
+			// start over from scratch
+			err = pw.reset()
+			if err != nil {
+				return fetchResult{}, err
+			}
+		}
+	}
+
+	if opts.ExpectedSize != 0 && pw.offset != opts.ExpectedSize {
+		return fetchResult{}, errors.Errorf("Downloaded file size does not match. Expected: %d Actual: %d", opts.ExpectedSize, pw.offset)
+	}
+
+	if opts.ExpectedHash != "" {
+		netLog.Infof("Checking shasum of downloaded file")
+
+		downloadHash, err := sha256File(out.Name())
 		if err != nil {
-			return "", err
+			return fetchResult{}, err
 		}
 
-		downloadHash = strings.TrimPrefix(downloadHash, "sha256:")
-		log.Debugf("Downloaded file hash: %s", downloadHash)
+		netLog.Debugf("Downloaded file hash: %s", downloadHash)
 
-		if expectedHash != downloadHash {
-			os.RemoveAll(name)
-			return "", errors.Errorf("Downloaded file hash does not match. Expected: %s Actual: %s", expectedHash, downloadHash)
+		if opts.ExpectedHash != downloadHash {
+			return fetchResult{}, &ChecksumMismatchError{
+				URL:      url,
+				Expected: opts.ExpectedHash,
+				Actual:   downloadHash,
+				Server:   opts.remoteSHA256(),
+			}
+		}
+	}
+
+	if opts.ExpectedUncompressedHash != "" {
+		netLog.Infof("Checking uncompressed shasum of downloaded file")
+		err := checkUncompressed(out, url, opts)
+		if err != nil {
+			return fetchResult{}, err
 		}
 	}
 
-	if mode != nil {
-		err = out.Chmod(*mode)
+	if opts.Mode != nil {
+		err := out.Chmod(*opts.Mode)
 		if err != nil {
-			return "", errors.Wrapf(err, "Coudn't chmod file %s", name)
+			return fetchResult{}, errors.Wrapf(err, "couldn't chmod file %s", out.Name())
 		}
 	}
 
-	err = out.Chown(uid, gid)
+	err := out.Chown(opts.Uid, opts.Gid)
 	if err != nil {
-		return "", errors.Wrapf(err, "Coudn't chown file %s", source)
+		return fetchResult{}, errors.Wrapf(err, "couldn't chown file %s", out.Name())
 	}
 
-	return name, err
+	return result, nil
 }
 
-// getHttpFileInfo returns the hash and content size a file stored on a web server
-func getHttpFileInfo(remoteURL string) (string, string, error) {
+// fetchOnce makes a single attempt at downloading url into pw, continuing
+// where pw left off if it already has some of the file. validators make the
+// request conditional on the cached copy having changed.
+func fetchOnce(client *http.Client, pw *partialWriter, url string, validators http.Header, opts DownloadOptions, progress *downloadProgress) (fetchResult, error) {
+	ctx, cancel := downloadContext(opts)
+	defer cancel()
+
+	req, err := newRequest(ctx, http.MethodGet, url, opts)
+	if err != nil {
+		return fetchResult{}, err
+	}
+
+	if pw.offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", pw.offset))
+		// if the file changed since, the server sends all of it
+		if pw.validator != "" {
+			req.Header.Set("If-Range", pw.validator)
+		}
+	} else {
+		for k, v := range validators {
+			req.Header[k] = v
+		}
+		if encoding := acceptEncoding(opts); encoding != "" {
+			req.Header.Set("Accept-Encoding", encoding)
+		}
+	}
 
+	resp, err := client.Do(req)
+	if err != nil {
+		return fetchResult{}, err
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusNotModified && len(validators) > 0 && pw.offset == 0:
+		return fetchResult{notModified: true}, nil
+	case resp.StatusCode == http.StatusOK:
+		if pw.offset > 0 {
+			netLog.Infof("server can't resume %s, or it changed, starting over", url)
+			err = pw.reset()
+			if err != nil {
+				return fetchResult{}, err
+			}
+		}
+		progress.start(resp.ContentLength, 0)
+	case resp.StatusCode == http.StatusPartialContent && pw.offset == 0 && coversWholeFile(resp):
+		netLog.Debugf("server sent all of %s as a range, %s", url, resp.Header.Get("Content-Range"))
+		progress.start(resp.ContentLength, 0)
+	case resp.StatusCode == http.StatusPartialContent && pw.offset > 0:
+		if !strings.HasPrefix(resp.Header.Get("Content-Range"), fmt.Sprintf("bytes %d-", pw.offset)) {
+			return fetchResult{}, errors.Errorf("couldn't resume %s: unexpected range %s", url, resp.Header.Get("Content-Range"))
+		}
+		netLog.Infof("resuming download of %s at %d bytes", url, pw.offset)
+		progress.start(pw.offset+resp.ContentLength, pw.offset)
+	default:
+		return fetchResult{}, &downloadStatusError{url: url, status: resp.Status, statusCode: resp.StatusCode, resp: resp}
+	}
+	pw.noteResponse(resp)
+
+	var stall *stallReader
+	var body io.Reader = resp.Body
+	if opts.StallTimeout != 0 {
+		stall = newStallReader(resp.Body, opts.StallTimeout, cancel)
+		defer stall.stop()
+		body = stall
+	}
+
+	// Content-Length is the size of the encoded body
+	counted := &countingReader{r: progress.proxy(body)}
+	decoded, err := decodeBody(resp.Header.Get("Content-Encoding"), counted)
+	if err != nil {
+		return fetchResult{}, err
+	}
+	defer decoded.Close()
+
+	_, err = io.Copy(pw, decoded)
+	n := counted.n
+	metricsOf(opts).BytesDownloaded(downloadHost(url), n)
+	if err != nil && stall != nil && stall.stalled.Load() {
+		return fetchResult{}, &timeoutError{url: url, timeout: opts.StallTimeout}
+	} else if err != nil {
+		return fetchResult{}, err
+	}
+
+	// some proxies send a 200 and then hang up early; don't let that end
+	// up in the cache
+	if resp.ContentLength >= 0 && n != resp.ContentLength {
+		return fetchResult{}, errors.Errorf("short download of %s: got %d of %d bytes", url, n, resp.ContentLength)
+	}
+
+	return fetchResult{
+		contentType:  resp.Header.Get("Content-Type"),
+		etag:         resp.Header.Get("ETag"),
+		lastModified: resp.Header.Get("Last-Modified"),
+		finalURL:     finalURL(resp),
+	}, nil
+}
+
+// newRequest returns a request for url carrying opts.Headers and
+// opts.Credentials, sent through opts.CacheProxy if there is one. Requests for
+// objects in S3 or GCS are made to their https URL, with the cloud's
+// credentials instead.
+func newRequest(ctx context.Context, method string, url string, opts DownloadOptions) (*http.Request, error) {
+	var target string
+	var err error
+	if isObjectStoreURL(url) {
+		// signed requests can't go through the proxy
+		target, err = objectURL(url)
+	} else {
+		target, err = proxiedURL(url, opts.CacheProxy)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, target, nil)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	for k, v := range opts.Headers {
+		req.Header[http.CanonicalHeaderKey(k)] = v
+	}
+	if len(opts.Headers) > 0 {
+		netLog.Debugf("%s %s with extra headers %v", method, url, redactHeaders(opts.Headers))
+	}
+
+	if isObjectStoreURL(url) {
+		err = authorizeObjectRequest(req, url)
+	} else {
+		err = opts.Credentials.authorize(req, url)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return req, nil
+}
+
+// proxiedURL returns where to request rawURL from through the cache proxy.
+func proxiedURL(rawURL string, proxy string) (string, error) {
+	if proxy == "" {
+		return rawURL, nil
+	}
+
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "", errors.Wrapf(err, "couldn't parse %s", rawURL)
+	}
+
+	proxied := fmt.Sprintf("%s/%s/%s%s", strings.TrimSuffix(proxy, "/"), u.Scheme, u.Host, u.EscapedPath())
+	if u.RawQuery != "" {
+		proxied += "?" + u.RawQuery
+	}
+
+	netLog.Debugf("requesting %s as %s", rawURL, proxied)
+	return proxied, nil
+}
+
+// redactHeaders returns a copy of h that is safe to log.
+func redactHeaders(h http.Header) http.Header {
+	redacted := http.Header{}
+	for k, v := range h {
+		lower := strings.ToLower(k)
+		switch {
+		case lower == "authorization", lower == "proxy-authorization", lower == "cookie",
+			strings.Contains(lower, "token"), strings.Contains(lower, "secret"),
+			strings.Contains(lower, "key"), strings.Contains(lower, "password"):
+			redacted[k] = []string{"REDACTED"}
+		default:
+			redacted[k] = v
+		}
+	}
+
+	return redacted
+}
+
+// RemoteInfo is what a server says about a file, without sending it.
+type RemoteInfo struct {
+	// Size is the file's length in bytes, or -1 if the server didn't say.
+	Size int64
+	// Checksum is the hex encoded sha256 from the X-Checksum-Sha256
+	// header, if any. Checksums has all the checksums the server
+	// advertised, by algorithm (see checksumAlgorithms).
+	Checksum     string
+	Checksums    map[string]string
+	ETag         string
+	LastModified string
+	ContentType  string
+	// AcceptRanges is true if the server takes byte range requests.
+	AcceptRanges bool
+	// FinalURL is where the file actually is, after following redirects.
+	FinalURL string
+}
+
+// checksumAlgorithms are the algorithms of the checksum headers we know about,
+// and the headers themselves.
+var checksumAlgorithms = map[string]string{
+	"sha256": "X-Checksum-Sha256",
+	"sha512": "X-Checksum-Sha512",
+	"sha1":   "X-Checksum-Sha1",
+}
+
+var defaultHashPriority = []string{"sha256", "sha512", "sha1"}
+
+// checksumHeader returns the checksum using algorithm advertised in h,
+// canonicalized by ParseDigest so that it can be compared to lib.HashFile's.
+// Malformed checksums, or ones of another algorithm, are ignored.
+func checksumHeader(h http.Header, algorithm string) string {
+	v := h.Get(checksumAlgorithms[algorithm])
+	if v == "" {
+		return ""
+	}
+
+	a, hash, err := ParseDigest(v)
+	if err == nil && a != algorithm {
+		err = errors.Errorf("not a %s digest", algorithm)
+	}
+	if err != nil {
+		netLog.Debugf("ignoring %s header: %v", checksumAlgorithms[algorithm], err)
+		return ""
+	}
+	return hash
+}
+
+// checksumHeaders returns all the checksums advertised in h, by algorithm.
+func checksumHeaders(h http.Header) map[string]string {
+	checksums := map[string]string{}
+	for algorithm := range checksumAlgorithms {
+		if v := checksumHeader(h, algorithm); v != "" {
+			checksums[algorithm] = v
+		}
+	}
+	return checksums
+}
+
+// pickRemoteChecksum returns the algorithm and value of the checksum of url in
+// info that comes first in priority (or defaultHashPriority), or two empty
+// strings if there is none.
+func pickRemoteChecksum(url string, info RemoteInfo, priority []string) (string, string) {
+	if len(priority) == 0 {
+		priority = defaultHashPriority
+	}
+
+	for _, algorithm := range priority {
+		if v, ok := info.Checksums[algorithm]; ok {
+			netLog.Debugf("using the %s checksum %s advertised for %s", algorithm, v, url)
+			return algorithm, v
+		}
+	}
+
+	return "", ""
+}
+
+// remoteSHA256 returns the server's checksum of the download if it is a
+// sha256, and so comparable with ExpectedHash.
+func (opts DownloadOptions) remoteSHA256() string {
+	if opts.RemoteHashAlgorithm != "" && opts.RemoteHashAlgorithm != "sha256" {
+		return ""
+	}
+	return strings.ToLower(opts.RemoteHash)
+}
+
+// FileInfo asks the server about the file at the http(s) url. Redirects are
+// followed; for each algorithm, the checksum is the first one advertised along
+// the way, starting with url itself, everything else is what the final URL
+// reports.
+func FileInfo(ctx context.Context, url string) (RemoteInfo, error) {
+	return fileInfo(ctx, url, DownloadOptions{})
+}
+
+func fileInfo(ctx context.Context, remoteURL string, opts DownloadOptions) (RemoteInfo, error) {
 	// Verify URL scheme
 	u, err := url.Parse(remoteURL)
 	if err != nil {
-		return "", "", err
+		return RemoteInfo{}, errors.WithStack(err)
 	}
-	if u.Scheme != "http" && u.Scheme != "https" {
-		return "", "", errors.Errorf("cannot obtain content info for non HTTP URL: (%s)", remoteURL)
+	if u.Scheme != "http" && u.Scheme != "https" && !isObjectStoreURL(remoteURL) {
+		return RemoteInfo{}, errors.Errorf("cannot obtain content info for non HTTP URL: (%s)", remoteURL)
 	}
 
+	for attempt := 1; ; attempt++ {
+		info, err := fileInfoOnce(ctx, remoteURL, opts)
+		if err == nil || attempt > opts.Retries || !shouldRetry(err, opts) {
+			return info, err
+		}
+
+		netLog.Infof("asking about %s failed, retrying (attempt %d): %v", remoteURL, attempt+1, err)
+		if waitErr := waitToRetry(ctx, attempt, opts); waitErr != nil {
+			return RemoteInfo{}, err
+		}
+		metricsOf(opts).Retried(downloadHost(remoteURL))
+	}
+}
+
+// fileInfoOnce makes a single attempt at asking the server about remoteURL.
+func fileInfoOnce(ctx context.Context, remoteURL string, opts DownloadOptions) (RemoteInfo, error) {
 	// Make a HEAD call on remote URL
-	resp, err := http.Head(remoteURL)
+	req, err := newRequest(ctx, http.MethodHead, remoteURL, opts)
 	if err != nil {
-		return "", "", err
+		return RemoteInfo{}, err
+	}
+
+	// remember the checksums advertised along the redirects, signed CDN
+	// URLs often don't have one
+	redirects := []map[string]string{}
+	client := *httpClient(opts)
+	client.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		if len(via) >= 10 {
+			return errors.Errorf("stopped after 10 redirects")
+		}
+		redirects = append(redirects, checksumHeaders(req.Response.Header))
+		return nil
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return RemoteInfo{}, err
 	}
 	defer resp.Body.Close()
 
+	if resp.StatusCode != http.StatusOK {
+		return RemoteInfo{}, &downloadStatusError{url: remoteURL, status: resp.Status, statusCode: resp.StatusCode, resp: resp}
+	}
+
+	// the URL we were asked about is authoritative for the checksum, the
+	// rest describes what it finally redirected to
+	checksums := checksumHeaders(resp.Header)
+	for i := len(redirects) - 1; i >= 0; i-- {
+		for algorithm, c := range redirects[i] {
+			if later, ok := checksums[algorithm]; ok && later != c {
+				netLog.Debugf("%s advertises %s checksum %s, but redirects to a copy advertising %s", remoteURL, algorithm, c, later)
+			}
+			checksums[algorithm] = c
+		}
+	}
+
 	// Get file info from header
 	// If the hash is not present this is an empty string
-	hash := resp.Header.Get("X-Checksum-Sha256")
-	length := resp.Header.Get("Content-Length")
+	return RemoteInfo{
+		Size:         resp.ContentLength,
+		Checksum:     checksums["sha256"],
+		Checksums:    checksums,
+		ETag:         resp.Header.Get("ETag"),
+		LastModified: resp.Header.Get("Last-Modified"),
+		ContentType:  resp.Header.Get("Content-Type"),
+		AcceptRanges: resp.Header.Get("Accept-Ranges") == "bytes",
+		FinalURL:     finalURL(resp),
+	}, nil
+}
 
-	return hash, length, nil
+// finalURL returns the url that answered with resp, after redirects, without
+// any password it carries.
+func finalURL(resp *http.Response) string {
+	return resp.Request.URL.Redacted()
 }
@@ -0,0 +1,574 @@
+package stacker
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	apexlog "github.com/apex/log"
+	"github.com/stretchr/testify/assert"
+	"stackerbuild.io/stacker/pkg/log"
+)
+
+// fakeTransport answers every request with body, recording the requests.
+type fakeTransport struct {
+	body     string
+	requests []*http.Request
+}
+
+func (t *fakeTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	t.requests = append(t.requests, req)
+	return &http.Response{
+		StatusCode:    200,
+		Status:        "200 OK",
+		Header:        http.Header{},
+		Body:          io.NopCloser(strings.NewReader(t.body)),
+		ContentLength: int64(len(t.body)),
+		Request:       req,
+	}, nil
+}
+
+// newTestServer starts an httptest server answering with handler, which is
+// shut down when the test is done.
+func newTestServer(t *testing.T, handler http.HandlerFunc) *httptest.Server {
+	srv := httptest.NewServer(handler)
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// hangUp sends what has been written so far and drops the connection, like a
+// server going away in the middle of a body.
+func hangUp(t *testing.T, w http.ResponseWriter) {
+	w.(http.Flusher).Flush()
+	conn, _, err := w.(http.Hijacker).Hijack()
+	if err != nil {
+		t.Errorf("couldn't hijack connection: %v", err)
+		return
+	}
+	conn.Close()
+}
+
+func TestCachePath(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Equal("/cache/foo.tar.gz", CachePath("/cache", "https://example.com/dl/foo.tar.gz"))
+	assert.Equal("/cache/bar", cachePath("/cache", "https://example.com/dl/foo.tar.gz", "/etc/bar"))
+	assert.Equal("/cache/foo.tar.gz", cachePath("/cache", "https://example.com/dl/foo.tar.gz", "/etc/"))
+	assert.Equal("/cache/foo.tar.gz", cachePath("/cache", "https://example.com/dl/foo.tar.gz#sha256="+strings.Repeat("a", 64), ""))
+}
+
+func TestCacheHasExpectedSize(t *testing.T) {
+	assert := assert.New(t)
+
+	dir := t.TempDir()
+	name := path.Join(dir, "foo")
+	url := "https://example.com/foo"
+
+	cached, err := cacheHasExpectedSize(name, url, DownloadOptions{ChecksumOptions: ChecksumOptions{ExpectedSize: 11}})
+	assert.NoError(err)
+	assert.False(cached)
+
+	assert.NoError(os.WriteFile(name, []byte("hello world"), 0644))
+	for size, expected := range map[int64]bool{0: false, 10: false, 11: true, 12: false} {
+		cached, err = cacheHasExpectedSize(name, url, DownloadOptions{ChecksumOptions: ChecksumOptions{ExpectedSize: size}})
+		assert.NoError(err)
+		assert.Equal(expected, cached, "expected size %d", size)
+	}
+}
+
+func TestDownloadHeaders(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := os.MkdirTemp("", "stacker_download_test")
+	if err != nil {
+		t.Fatalf("couldn't create temp dir %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	transport := &fakeTransport{body: "hello world"}
+	opts := DownloadOptions{
+		Uid: os.Getuid(),
+		Gid: os.Getgid(),
+		TransportOptions: TransportOptions{
+			Headers: http.Header{
+				"Accept":        []string{"application/octet-stream"},
+				"x-api-version": []string{"2"},
+			},
+			Transport: transport,
+		},
+	}
+
+	_, err = fileInfo(context.Background(), "https://example.com/foo", opts)
+	assert.NoError(err)
+
+	name, err := DownloadWithOptions(dir, "https://example.com/foo", opts)
+	assert.NoError(err)
+
+	content, err := os.ReadFile(name)
+	assert.NoError(err)
+	assert.Equal("hello world", string(content))
+
+	assert.Len(transport.requests, 2)
+	for _, req := range transport.requests {
+		assert.Equal("application/octet-stream", req.Header.Get("Accept"))
+		assert.Equal("2", req.Header.Get("X-Api-Version"))
+	}
+	assert.Equal(http.MethodHead, transport.requests[0].Method)
+	assert.Equal(http.MethodGet, transport.requests[1].Method)
+}
+
+func TestRedactHeaders(t *testing.T) {
+	assert := assert.New(t)
+
+	redacted := redactHeaders(http.Header{
+		"Authorization": []string{"Bearer hunter2"},
+		"X-Auth-Token":  []string{"hunter2"},
+		"Accept":        []string{"*/*"},
+	})
+
+	assert.Equal("REDACTED", redacted.Get("Authorization"))
+	assert.Equal("REDACTED", redacted.Get("X-Auth-Token"))
+	assert.Equal("*/*", redacted.Get("Accept"))
+}
+
+func TestDownloadTruncatedBody(t *testing.T) {
+	assert := assert.New(t)
+
+	requests := 0
+	srv := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.Header().Set("Content-Length", "11")
+		if requests == 1 {
+			// hang up in the middle of the body
+			w.Write([]byte("hello"))
+			hangUp(t, w)
+			return
+		}
+		w.Write([]byte("hello world"))
+	})
+
+	dir := t.TempDir()
+	opts := DownloadOptions{Uid: os.Getuid(), Gid: os.Getgid()}
+
+	_, err := DownloadWithOptions(dir, srv.URL+"/foo", opts)
+	assert.Error(err)
+	assert.NoFileExists(path.Join(dir, "foo"))
+
+	requests = 0
+	opts.Retries = 1
+	name, err := DownloadWithOptions(dir, srv.URL+"/foo", opts)
+	assert.NoError(err)
+	assert.Equal(2, requests)
+
+	content, err := os.ReadFile(name)
+	assert.NoError(err)
+	assert.Equal("hello world", string(content))
+}
+
+func TestProxiedURL(t *testing.T) {
+	assert := assert.New(t)
+
+	proxied, err := proxiedURL("https://example.com/dl/foo.tar.gz?v=1", "http://cache.local/remote/")
+	assert.NoError(err)
+	assert.Equal("http://cache.local/remote/https/example.com/dl/foo.tar.gz?v=1", proxied)
+
+	proxied, err = proxiedURL("http://example.com:8080/foo", "http://cache.local")
+	assert.NoError(err)
+	assert.Equal("http://cache.local/http/example.com:8080/foo", proxied)
+
+	proxied, err = proxiedURL("https://example.com/foo", "")
+	assert.NoError(err)
+	assert.Equal("https://example.com/foo", proxied)
+}
+
+func TestChecksumHeader(t *testing.T) {
+	hash := "b94d27b9934d3e08a52e52d7da7dabfac484efe37a5380ee9088f7ace2efcde9"
+
+	for _, tc := range []struct {
+		header   string
+		expected string
+	}{
+		{"", ""},
+		{hash, hash},
+		{strings.ToUpper(hash), hash},
+		{"  " + hash + "\t", hash},
+		{"sha256:" + hash, hash},
+		{"SHA256:" + strings.ToUpper(hash), hash},
+		{"sha256=" + hash, hash},
+		{" sha256: " + hash + " ", hash},
+		{hash[1:], ""},
+		{"sha512:" + hash, ""},
+		{"zz" + hash[2:], ""},
+	} {
+		t.Run(tc.header, func(t *testing.T) {
+			h := http.Header{}
+			h.Set("X-Checksum-Sha256", tc.header)
+			assert.Equal(t, tc.expected, checksumHeader(h, "sha256"))
+		})
+	}
+}
+
+func TestDownloadMalformedHash(t *testing.T) {
+	cacheDir := t.TempDir()
+
+	_, err := Download(cacheDir, "http://127.0.0.1:1/file", false, "abc", "", "", "", nil, 0, 0)
+	assert.ErrorContains(t, err, "invalid expected hash")
+
+	_, err = DownloadWithOptions(cacheDir, "http://127.0.0.1:1/file#sha256=abc", DownloadOptions{})
+	assert.ErrorContains(t, err, "invalid checksum in url")
+}
+
+func TestDownloadLegacyOptions(t *testing.T) {
+	assert := assert.New(t)
+
+	requests := 0
+	srv := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if requests == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte("hello world"))
+	})
+
+	// Download doesn't retry, unlike DefaultOptions
+	cacheDir := t.TempDir()
+	_, err := Download(cacheDir, srv.URL+"/file", false, "", "", "", "", nil, os.Getuid(), os.Getgid())
+	assert.ErrorContains(err, "503")
+	assert.Equal(1, requests)
+
+	requests = 0
+	opts := DefaultOptions()
+	opts.RetryBackoff = 0
+	opts.Progress = false
+	_, err = DownloadWithOptions(cacheDir, srv.URL+"/file", opts)
+	assert.NoError(err)
+	assert.Equal(2, requests)
+}
+
+func TestFileInfoRedirect(t *testing.T) {
+	assert := assert.New(t)
+
+	srv := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/canonical":
+			w.Header().Set("X-Checksum-Sha256", strings.Repeat("a", 64))
+			http.Redirect(w, r, "/signed", http.StatusFound)
+		case "/unsigned":
+			http.Redirect(w, r, "/signed", http.StatusFound)
+		case "/signed":
+			w.Header().Set("ETag", `"signed"`)
+			w.Write([]byte("hello world"))
+		}
+	})
+
+	info, err := fileInfo(context.Background(), srv.URL+"/canonical", DownloadOptions{})
+	assert.NoError(err)
+	assert.Equal(strings.Repeat("a", 64), info.Checksum)
+	assert.Equal(`"signed"`, info.ETag)
+	assert.EqualValues(11, info.Size)
+	assert.Equal(srv.URL+"/signed", info.FinalURL)
+
+	info, err = fileInfo(context.Background(), srv.URL+"/unsigned", DownloadOptions{})
+	assert.NoError(err)
+	assert.Equal("", info.Checksum)
+}
+
+func TestPickRemoteChecksum(t *testing.T) {
+	assert := assert.New(t)
+
+	srv := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Checksum-Sha512", "SHA512:"+strings.Repeat("B", 128))
+		if r.URL.Path == "/both" {
+			w.Header().Set("X-Checksum-Sha256", strings.Repeat("a", 64))
+		}
+		w.Write([]byte("hello world"))
+	})
+
+	info, err := fileInfo(context.Background(), srv.URL+"/sha512", DownloadOptions{})
+	assert.NoError(err)
+	assert.Equal("", info.Checksum)
+	algorithm, checksum := pickRemoteChecksum(srv.URL+"/sha512", info, nil)
+	assert.Equal("sha512", algorithm)
+	assert.Equal(strings.Repeat("b", 128), checksum)
+
+	info, err = fileInfo(context.Background(), srv.URL+"/both", DownloadOptions{})
+	assert.NoError(err)
+	algorithm, checksum = pickRemoteChecksum(srv.URL+"/both", info, nil)
+	assert.Equal("sha256", algorithm)
+	assert.Equal(strings.Repeat("a", 64), checksum)
+
+	algorithm, _ = pickRemoteChecksum(srv.URL+"/both", info, []string{"sha1", "sha512"})
+	assert.Equal("sha512", algorithm)
+
+	algorithm, _ = pickRemoteChecksum(srv.URL+"/both", info, []string{"sha1"})
+	assert.Equal("", algorithm)
+}
+
+func TestDownloadNetwork(t *testing.T) {
+	assert := assert.New(t)
+
+	// listens on 127.0.0.1
+	srv := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hello world"))
+	})
+
+	opts := DownloadOptions{Uid: os.Getuid(), Gid: os.Getgid(), TransportOptions: TransportOptions{Network: "tcp6"}}
+	_, err := DownloadWithOptions(t.TempDir(), srv.URL+"/foo", opts)
+	assert.Error(err)
+
+	opts.Network = "tcp4"
+	_, err = DownloadWithOptions(t.TempDir(), srv.URL+"/foo", opts)
+	assert.NoError(err)
+}
+
+func TestDownloadTTL(t *testing.T) {
+	assert := assert.New(t)
+
+	content := "v1"
+	full, conditional := 0, 0
+	srv := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		etag := `"` + content + `"`
+		w.Header().Set("ETag", etag)
+		if r.Header.Get("If-None-Match") == etag {
+			conditional++
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		full++
+		w.Write([]byte(content))
+	})
+
+	cacheDir := t.TempDir()
+	opts := DownloadOptions{CacheOptions: CacheOptions{TTL: time.Hour}}
+
+	name, err := DownloadWithOptions(cacheDir, srv.URL+"/latest", opts)
+	assert.NoError(err)
+	_, err = DownloadWithOptions(cacheDir, srv.URL+"/latest", opts)
+	assert.NoError(err)
+	assert.Equal(1, full)
+	assert.Equal(0, conditional)
+
+	expire := func() {
+		meta, err := readCacheMeta(name)
+		assert.NoError(err)
+		meta.ExpiresAt = time.Now().Add(-time.Minute)
+		assert.NoError(writeCacheMeta(name, meta, opts))
+	}
+
+	// unchanged: revalidated, not downloaded again, and good for another hour
+	expire()
+	_, err = DownloadWithOptions(cacheDir, srv.URL+"/latest", opts)
+	assert.NoError(err)
+	assert.Equal(1, full)
+	assert.Equal(1, conditional)
+	meta, err := readCacheMeta(name)
+	assert.NoError(err)
+	assert.True(meta.ExpiresAt.After(time.Now()))
+
+	// changed
+	content = "v2"
+	expire()
+	_, err = DownloadWithOptions(cacheDir, srv.URL+"/latest", opts)
+	assert.NoError(err)
+	assert.Equal(2, full)
+	got, err := os.ReadFile(name)
+	assert.NoError(err)
+	assert.Equal("v2", string(got))
+}
+
+func TestDownloadPinnedCache(t *testing.T) {
+	assert := assert.New(t)
+
+	requests := 0
+	srv := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.Write([]byte("hello world"))
+	})
+
+	cacheDir := t.TempDir()
+	opts := DownloadOptions{ChecksumOptions: ChecksumOptions{ExpectedHash: "sha256:B94D27B9934D3E08A52E52D7DA7DABFAC484EFE37A5380EE9088F7ACE2EFCDE9"}}
+	name, err := DownloadWithOptions(cacheDir, srv.URL+"/file", opts)
+	assert.NoError(err)
+	assert.Equal(1, requests)
+
+	// the pin is trusted over what the server advertises
+	opts.RemoteHash = strings.Repeat("0", 64)
+	opts.RemoteSize = "11"
+	_, err = DownloadWithOptions(cacheDir, srv.URL+"/file", opts)
+	assert.NoError(err)
+	assert.Equal(1, requests)
+
+	// and a cached copy that doesn't match it is downloaded again, even
+	// though its length matches the server's
+	assert.NoError(os.WriteFile(name, []byte("hello there"), 0644))
+	_, err = DownloadWithOptions(cacheDir, srv.URL+"/file", opts)
+	assert.NoError(err)
+	assert.Equal(2, requests)
+	content, err := os.ReadFile(name)
+	assert.NoError(err)
+	assert.Equal("hello world", string(content))
+}
+
+func TestDownloadValidate(t *testing.T) {
+	assert := assert.New(t)
+
+	srv := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/good.json" {
+			w.Write([]byte(`{"hello": "world"}`))
+		} else {
+			w.Write([]byte("hello world"))
+		}
+	})
+
+	validated := []string{}
+	opts := DownloadOptions{Validate: func(name string) error {
+		validated = append(validated, name)
+		content, err := os.ReadFile(name)
+		if err != nil {
+			return err
+		}
+		if !json.Valid(content) {
+			return fmt.Errorf("not json")
+		}
+		return nil
+	}}
+
+	cacheDir := t.TempDir()
+	name, err := DownloadWithOptions(cacheDir, srv.URL+"/good.json", opts)
+	assert.NoError(err)
+	assert.Equal([]string{sidecarPath(name, partialExt)}, validated)
+
+	_, err = DownloadWithOptions(cacheDir, srv.URL+"/bad.json", opts)
+	assert.ErrorContains(err, "failed validation: not json")
+	assert.NoFileExists(path.Join(cacheDir, "bad.json"))
+	assert.NoFileExists(sidecarPath(path.Join(cacheDir, "bad.json"), partialExt))
+
+	// files that fail verification aren't validated
+	validated = nil
+	opts.ExpectedHash = strings.Repeat("0", 64)
+	_, err = DownloadWithOptions(cacheDir, srv.URL+"/other.json", opts)
+	assert.ErrorAs(err, new(*ChecksumMismatchError))
+	assert.Empty(validated)
+}
+
+type recordingHandler struct {
+	mu       sync.Mutex
+	messages []string
+}
+
+func (h *recordingHandler) HandleLog(e *apexlog.Entry) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.messages = append(h.messages, e.Level.String()+" "+e.Message)
+	return nil
+}
+
+// outcome returns the last message about whether the download was served
+// from the cache.
+func (h *recordingHandler) outcome() string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for i := len(h.messages) - 1; i >= 0; i-- {
+		if strings.Contains(h.messages[i], "cache hit") || strings.Contains(h.messages[i], "downloaded") {
+			return h.messages[i]
+		}
+	}
+	return ""
+}
+
+func TestDownloadCacheLogs(t *testing.T) {
+	assert := assert.New(t)
+
+	handler := &recordingHandler{}
+	log.FilterNonStackerLogs(handler, apexlog.InfoLevel)
+	defer log.FilterNonStackerLogs(log.NewTextHandler(os.Stderr, false), apexlog.InfoLevel)
+
+	srv := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("ETag", `"v1"`)
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Write([]byte("hello world"))
+	})
+
+	hash := "b94d27b9934d3e08a52e52d7da7dabfac484efe37a5380ee9088f7ace2efcde9"
+	url := srv.URL + "/file"
+	cacheDir := t.TempDir()
+
+	_, err := DownloadWithOptions(cacheDir, url, DownloadOptions{})
+	assert.NoError(err)
+	assert.Equal("info downloaded "+url+": not cached", handler.outcome())
+
+	_, err = DownloadWithOptions(cacheDir, url, DownloadOptions{CacheOptions: CacheOptions{RemoteHash: hash, RemoteSize: "11"}})
+	assert.NoError(err)
+	assert.Equal("info cache hit (verified) for "+url+": it matches the server's sha256 checksum", handler.outcome())
+
+	_, err = DownloadWithOptions(cacheDir, url, DownloadOptions{CacheOptions: CacheOptions{RemoteHash: strings.Repeat("0", 64), RemoteSize: "11"}})
+	assert.NoError(err)
+	assert.Equal("warn cache hit (unverified) for "+url+": it has the length the server reports, but not its checksum", handler.outcome())
+
+	_, err = DownloadWithOptions(cacheDir, url, DownloadOptions{CacheOptions: CacheOptions{Revalidate: true}})
+	assert.NoError(err)
+	assert.Equal("info cache hit (revalidated) for "+url+": the server says it is not modified", handler.outcome())
+
+	_, err = DownloadWithOptions(cacheDir, url, DownloadOptions{CacheOptions: CacheOptions{RemoteHash: strings.Repeat("0", 64), RemoteSize: "12"}})
+	assert.NoError(err)
+	assert.Equal("info downloaded "+url+": cached copy is stale", handler.outcome())
+}
+
+func TestDownloadModes(t *testing.T) {
+	assert := assert.New(t)
+
+	srv := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("ETag", `"v1"`)
+		w.Write([]byte("hello world"))
+	})
+
+	perm := func(p string) os.FileMode {
+		fi, err := os.Stat(p)
+		assert.NoError(err, p)
+		if err != nil {
+			return 0
+		}
+		return fi.Mode().Perm()
+	}
+
+	// modes that are set are applied whatever the umask
+	old := syscall.Umask(077)
+	defer syscall.Umask(old)
+
+	cacheDir := path.Join(t.TempDir(), "cache")
+	opts := DownloadOptions{Uid: os.Getuid(), Gid: os.Getgid(), CacheOptions: CacheOptions{FileMode: 0664, SidecarMode: 0640, DirMode: 0775}}
+	name, err := DownloadWithOptions(cacheDir, srv.URL+"/file", opts)
+	assert.NoError(err)
+	assert.Equal(os.FileMode(0775), perm(cacheDir))
+	assert.Equal(os.FileMode(0775), perm(path.Join(cacheDir, metaDirName)))
+	assert.Equal(os.FileMode(0664), perm(name))
+	assert.Equal(os.FileMode(0640), perm(sidecarPath(name, cacheMetaExt)))
+
+	// a file's own mode wins over the cache's
+	mode := os.FileMode(0600)
+	opts.Mode = &mode
+	name, err = DownloadWithOptions(cacheDir, srv.URL+"/other", opts)
+	assert.NoError(err)
+	assert.Equal(os.FileMode(0600), perm(name))
+
+	// and the defaults are subject to it
+	cacheDir = path.Join(t.TempDir(), "cache")
+	name, err = DownloadWithOptions(cacheDir, srv.URL+"/file", DownloadOptions{Uid: os.Getuid(), Gid: os.Getgid()})
+	assert.NoError(err)
+	assert.Equal(os.FileMode(0700), perm(cacheDir))
+	assert.Equal(os.FileMode(0600), perm(name))
+}
@@ -0,0 +1,205 @@
+package stacker
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Imports can name objects in S3 (s3://bucket/key) and GCS (gs://bucket/object)
+// directly. They are downloaded over https like any other import, and so are
+// cached and validated the same way, only the requests are authenticated with
+// the cloud's own credentials. Everything else (cache names, metadata, logs)
+// uses the s3:// or gs:// URL.
+const (
+	s3Scheme = "s3://"
+	gsScheme = "gs://"
+)
+
+func isObjectStoreURL(rawURL string) bool {
+	return strings.HasPrefix(rawURL, s3Scheme) || strings.HasPrefix(rawURL, gsScheme)
+}
+
+// isRemoteURL returns true if rawURL is downloaded rather than copied, i.e. it
+// is an http(s) URL or an object in S3 or GCS.
+func isRemoteURL(rawURL string) bool {
+	return strings.HasPrefix(rawURL, "http://") || strings.HasPrefix(rawURL, "https://") || isObjectStoreURL(rawURL)
+}
+
+// IsRemoteURL is isRemoteURL, for the command line.
+func IsRemoteURL(rawURL string) bool {
+	return isRemoteURL(rawURL)
+}
+
+// objectURL returns the URL the object storage URL rawURL is requested from,
+// or rawURL if it isn't one.
+func objectURL(rawURL string) (string, error) {
+	if !isObjectStoreURL(rawURL) {
+		return rawURL, nil
+	}
+
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "", errors.Wrapf(err, "couldn't parse %s", rawURL)
+	}
+
+	bucket, key := u.Host, strings.TrimPrefix(u.Path, "/")
+	if bucket == "" || key == "" {
+		return "", errors.Errorf("invalid object url %s: expected %sbucket/key", rawURL, u.Scheme+"://")
+	}
+
+	target := &url.URL{Scheme: "https", RawQuery: u.RawQuery}
+	switch {
+	case u.Scheme == "gs" && os.Getenv("STORAGE_EMULATOR_HOST") != "":
+		endpoint := os.Getenv("STORAGE_EMULATOR_HOST")
+		if !strings.Contains(endpoint, "://") {
+			endpoint = "http://" + endpoint
+		}
+		return strings.TrimSuffix(endpoint, "/") + "/" + bucket + "/" + key, nil
+	case u.Scheme == "gs":
+		target.Host = "storage.googleapis.com"
+		target.Path = "/" + bucket + "/" + key
+	case s3Endpoint() != "":
+		return strings.TrimSuffix(s3Endpoint(), "/") + "/" + bucket + "/" + key, nil
+	case strings.Contains(bucket, "."):
+		// the wildcard certificate doesn't cover buckets with dots
+		target.Host = "s3." + s3Region() + ".amazonaws.com"
+		target.Path = "/" + bucket + "/" + key
+	default:
+		target.Host = bucket + ".s3." + s3Region() + ".amazonaws.com"
+		target.Path = "/" + key
+	}
+
+	return target.String(), nil
+}
+
+// authorizeObjectRequest authenticates req for the object storage URL rawURL,
+// if there are credentials for it; without any, the request is made
+// anonymously, which is fine for public objects.
+func authorizeObjectRequest(req *http.Request, rawURL string) error {
+	switch {
+	case strings.HasPrefix(rawURL, s3Scheme):
+		creds, err := awsCredentialChain(req.Context())
+		if err != nil || creds == nil {
+			return err
+		}
+
+		signV4(req, *creds, s3Region(), time.Now())
+		return nil
+	case strings.HasPrefix(rawURL, gsScheme):
+		token, err := gcsToken(req.Context())
+		if err != nil || token == "" {
+			return err
+		}
+
+		req.Header.Set("Authorization", "Bearer "+token)
+		return nil
+	}
+
+	return nil
+}
+
+// cloudCredentials are the short lived credentials obtained from the
+// metadata services and token endpoints, which are worth re-using until they
+// are about to expire.
+var cloudCredentials = struct {
+	sync.Mutex
+	aws      *awsCredentials
+	gcs      string
+	gcsUntil time.Time
+	// unreachable are the metadata services that didn't answer, they
+	// aren't asked again.
+	unreachable map[string]bool
+}{unreachable: map[string]bool{}}
+
+// cloudClient makes the requests for credentials; they don't go through a
+// download's transport or rate limits.
+var cloudClient = &http.Client{Timeout: 10 * time.Second}
+
+// metadataRequest gets what the metadata service at base has at path, or
+// nothing if it has nothing there. Services that don't answer at all (e.g.
+// when not running in the cloud) aren't asked again.
+func metadataRequest(ctx context.Context, method string, base string, path string, header http.Header) ([]byte, error) {
+	cloudCredentials.Lock()
+	unreachable := cloudCredentials.unreachable[base]
+	cloudCredentials.Unlock()
+	if unreachable {
+		return nil, nil
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, base+path, nil)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+
+	// metadata services are local, anything slower isn't there
+	client := &http.Client{Timeout: 2 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		netLog.Debugf("no metadata service at %s: %v", base, err)
+		cloudCredentials.Lock()
+		cloudCredentials.unreachable[base] = true
+		cloudCredentials.Unlock()
+		return nil, nil
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		netLog.Debugf("metadata service at %s has nothing at %s: %s", base, path, resp.Status)
+		return nil, nil
+	}
+
+	content, err := io.ReadAll(resp.Body)
+	return content, errors.Wrapf(err, "couldn't read %s%s", base, path)
+}
+
+// postForToken posts form to the OAuth token endpoint tokenURL, returning the
+// access token it grants and how long it is good for.
+func postForToken(ctx context.Context, tokenURL string, form url.Values) (string, time.Duration, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, tokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", 0, errors.WithStack(err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	resp, err := cloudClient.Do(req)
+	if err != nil {
+		return "", 0, errors.Wrapf(err, "couldn't get an access token from %s", tokenURL)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", 0, errors.Errorf("couldn't get an access token from %s: %s", tokenURL, resp.Status)
+	}
+
+	return decodeToken(resp.Body, tokenURL)
+}
+
+// decodeToken decodes an OAuth token response.
+func decodeToken(r io.Reader, source string) (string, time.Duration, error) {
+	token := struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int64  `json:"expires_in"`
+	}{}
+
+	err := json.NewDecoder(r).Decode(&token)
+	if err != nil {
+		return "", 0, errors.Wrapf(err, "couldn't parse the access token from %s", source)
+	}
+	if token.AccessToken == "" {
+		return "", 0, errors.Errorf("no access token from %s", source)
+	}
+
+	return token.AccessToken, time.Duration(token.ExpiresIn) * time.Second, nil
+}
@@ -0,0 +1,31 @@
+package stacker
+
+import (
+	"io"
+	"os"
+
+	"github.com/pkg/errors"
+)
+
+// Open makes sure there is a valid cached copy of url in cacheDir, downloading
+// it using DefaultOptions if there isn't, and opens it. It is for consumers
+// that only read parts of the file (e.g. to index a tarball): they can seek
+// around the cached copy instead of having it copied out for them.
+func Open(cacheDir string, url string) (io.ReadSeekCloser, DownloadResult, error) {
+	return OpenWithOptions(cacheDir, url, DefaultOptions())
+}
+
+// OpenWithOptions is Open, downloading url with opts.
+func OpenWithOptions(cacheDir string, url string, opts DownloadOptions) (io.ReadSeekCloser, DownloadResult, error) {
+	result, err := DownloadWithResult(cacheDir, url, opts)
+	if err != nil {
+		return nil, DownloadResult{}, err
+	}
+
+	f, err := os.Open(result.Path)
+	if err != nil {
+		return nil, DownloadResult{}, errors.Wrapf(err, "couldn't open cached copy of %s", url)
+	}
+
+	return f, result, nil
+}
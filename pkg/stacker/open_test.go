@@ -0,0 +1,44 @@
+package stacker
+
+import (
+	"io"
+	"net/http"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOpen(t *testing.T) {
+	assert := assert.New(t)
+
+	requests := 0
+	srv := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.Write([]byte("hello world"))
+	})
+
+	cacheDir := t.TempDir()
+	opts := DownloadOptions{ChecksumOptions: ChecksumOptions{ExpectedHash: "b94d27b9934d3e08a52e52d7da7dabfac484efe37a5380ee9088f7ace2efcde9"}}
+	f, result, err := OpenWithOptions(cacheDir, srv.URL+"/file", opts)
+	assert.NoError(err)
+	defer f.Close()
+	assert.Equal(path.Join(cacheDir, "file"), result.Path)
+	assert.Equal("sha256:"+opts.ExpectedHash, result.Digest.String())
+
+	_, err = f.Seek(6, io.SeekStart)
+	assert.NoError(err)
+	content, err := io.ReadAll(f)
+	assert.NoError(err)
+	assert.Equal("world", string(content))
+
+	// the valid cached copy is opened without downloading it again
+	g, _, err := OpenWithOptions(cacheDir, srv.URL+"/file", opts)
+	assert.NoError(err)
+	g.Close()
+	assert.Equal(1, requests)
+
+	_, _, err = OpenWithOptions(cacheDir, srv.URL+"/other", DownloadOptions{ChecksumOptions: ChecksumOptions{ExpectedHash: strings.Repeat("0", 64)}})
+	assert.ErrorAs(err, new(*ChecksumMismatchError))
+}
@@ -0,0 +1,334 @@
+package stacker
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path"
+	"runtime"
+	"strings"
+
+	"github.com/opencontainers/image-spec/specs-go"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/opencontainers/umoci"
+	"github.com/opencontainers/umoci/oci/casext"
+	"github.com/pkg/errors"
+	"stackerbuild.io/stacker/pkg/lib"
+	"stackerbuild.io/stacker/pkg/log"
+	stackeroci "stackerbuild.io/stacker/pkg/oci"
+	"stackerbuild.io/stacker/pkg/types"
+)
+
+// ParsePlatform parses an os/arch[/variant] platform, e.g. linux/arm64 or
+// linux/arm/v7.
+func ParsePlatform(s string) (ispec.Platform, error) {
+	parts := strings.Split(s, "/")
+	if len(parts) < 2 || len(parts) > 3 || parts[0] == "" || parts[1] == "" {
+		return ispec.Platform{}, errors.Errorf("invalid platform %q: expected os/arch[/variant]", s)
+	}
+
+	p := ispec.Platform{OS: parts[0], Architecture: parts[1]}
+	if len(parts) == 3 {
+		p.Variant = parts[2]
+	}
+	return p, nil
+}
+
+func platformString(p ispec.Platform) string {
+	s := p.OS + "/" + p.Architecture
+	if p.Variant != "" {
+		s += "/" + p.Variant
+	}
+	return s
+}
+
+// platformDirName is p as a file (or tag) name, e.g. linux-arm-v7.
+func platformDirName(p ispec.Platform) string {
+	return strings.ReplaceAll(platformString(p), "/", "-")
+}
+
+// platformLayerName is the tag the image of layerName for p gets in the OCI
+// layout, next to the index of all of them at layerName.
+func platformLayerName(layerName string, p ispec.Platform) string {
+	return fmt.Sprintf("%s-%s", layerName, platformDirName(p))
+}
+
+// platformConfig returns the config p is built with: a stacker dir, rootfs
+// dir and OCI layout of its own, since the layers of every platform have the
+// same names.
+func platformConfig(c types.StackerConfig, p ispec.Platform) types.StackerConfig {
+	dir := path.Join(c.StackerDir, "platforms", platformDirName(p))
+	c.Platform = platformString(p)
+	c.StackerDir = dir
+	c.OCIDir = path.Join(dir, "oci")
+	c.RootFSDir = path.Join(c.RootFSDir, "platforms", platformDirName(p))
+	return c
+}
+
+// qemuArchs are the names qemu-user-static registers its binfmt_misc
+// handlers under, for the architectures whose GOARCH name is different.
+var qemuArchs = map[string]string{
+	"386":      "i386",
+	"amd64":    "x86_64",
+	"arm64":    "aarch64",
+	"mips64le": "mips64el",
+}
+
+// nativeArchs are the architectures the CPUs of another one run natively.
+var nativeArchs = map[string][]string{
+	"amd64": {"386"},
+}
+
+// checkCanRun returns an error if the run sections of layers built for p
+// can't run here: p needs to be linux, and either the architecture (or one
+// the CPU runs natively) or one qemu-user-static is registered for.
+func checkCanRun(p ispec.Platform) error {
+	if p.OS != "linux" {
+		return errors.Errorf("can't build for %s: containers can only run linux", platformString(p))
+	}
+
+	if p.Architecture == runtime.GOARCH {
+		return nil
+	}
+	for _, arch := range nativeArchs[runtime.GOARCH] {
+		if p.Architecture == arch {
+			return nil
+		}
+	}
+
+	qemuArch, ok := qemuArchs[p.Architecture]
+	if !ok {
+		qemuArch = p.Architecture
+	}
+
+	// the F flag makes the kernel open the interpreter when it is
+	// registered; without it, it would be looked for in the container
+	handler := path.Join("/proc/sys/fs/binfmt_misc", "qemu-"+qemuArch)
+	content, err := os.ReadFile(handler)
+	if err != nil {
+		return errors.Errorf("can't build for %s: no binfmt_misc handler %s, is qemu-user-static installed?", platformString(p), handler)
+	}
+
+	enabled, fixBinary := false, false
+	for _, line := range strings.Split(string(content), "\n") {
+		if line == "enabled" {
+			enabled = true
+		}
+		if flags, ok := strings.CutPrefix(line, "flags: "); ok && strings.Contains(flags, "F") {
+			fixBinary = true
+		}
+	}
+
+	if !enabled {
+		return errors.Errorf("can't build for %s: binfmt_misc handler %s is disabled", platformString(p), handler)
+	}
+	if !fixBinary {
+		return errors.Errorf("can't build for %s: binfmt_misc handler %s needs the F (fix binary) flag to work in containers", platformString(p), handler)
+	}
+
+	return nil
+}
+
+// buildPlatforms builds paths for each of opts.Platforms, and then puts the
+// images of every layer into opts.Config.OCIDir as an image index of them.
+func (b *Builder) buildPlatforms(stackerFiles types.StackerFiles, paths []string) error {
+	opts := b.opts
+
+	for _, p := range opts.Platforms {
+		err := checkCanRun(p)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, p := range opts.Platforms {
+		log.Infof("building for %s", platformString(p))
+
+		platformOpts := *opts
+		platformOpts.Config = platformConfig(opts.Config, p)
+		platformOpts.Platforms = nil
+		platformOpts.CacheFrom = platformCacheRef(opts.CacheFrom, p)
+		platformOpts.CacheTo = platformCacheRef(opts.CacheTo, p)
+		pb := &Builder{
+			builtStackerfiles: map[string]*types.Stackerfile{},
+			opts:              &platformOpts,
+			metrics:           b.metrics,
+			platform:          platformString(p),
+		}
+
+		err := pb.BuildMultiple(paths)
+		if err != nil {
+			return errors.Wrapf(err, "couldn't build for %s", platformString(p))
+		}
+	}
+
+	var oci casext.Engine
+	var err error
+	if _, statErr := os.Stat(opts.Config.OCIDir); statErr != nil {
+		oci, err = umoci.CreateLayout(opts.Config.OCIDir)
+	} else {
+		oci, err = umoci.OpenLayout(opts.Config.OCIDir)
+	}
+	if err != nil {
+		return err
+	}
+	defer oci.Close()
+
+	for _, sf := range stackerFiles {
+		for _, name := range sf.FileOrder {
+			l, ok := sf.Get(name)
+			if !ok || l.BuildOnly {
+				continue
+			}
+
+			for _, layerType := range opts.LayerTypes {
+				err = b.writePlatformIndex(oci, layerType.LayerName(name))
+				if err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	return oci.GC(context.Background())
+}
+
+// writePlatformIndex copies the images of layerName that were built for each
+// platform into oci, and tags the index of them as layerName.
+func (b *Builder) writePlatformIndex(oci casext.Engine, layerName string) error {
+	opts := b.opts
+	ctx := context.Background()
+
+	manifests := []ispec.Descriptor{}
+	for _, p := range opts.Platforms {
+		platformName := platformLayerName(layerName, p)
+		err := lib.ImageCopy(lib.ImageCopyOpts{
+			Src:        fmt.Sprintf("oci:%s:%s", platformConfig(opts.Config, p).OCIDir, layerName),
+			Dest:       fmt.Sprintf("oci:%s:%s", opts.Config.OCIDir, platformName),
+			SrcSkipTLS: true,
+		})
+		if err != nil {
+			return errors.Wrapf(err, "couldn't copy %s for %s", layerName, platformString(p))
+		}
+
+		descPaths, err := oci.ResolveReference(ctx, platformName)
+		if err != nil {
+			return err
+		}
+		if len(descPaths) != 1 {
+			return errors.Errorf("expected one manifest for %s, found %d", platformName, len(descPaths))
+		}
+
+		desc := descPaths[0].Descriptor()
+		desc.Annotations = nil
+		desc.Platform = &ispec.Platform{OS: p.OS, Architecture: p.Architecture, Variant: p.Variant}
+		manifests = append(manifests, desc)
+	}
+
+	index := ispec.Index{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: ispec.MediaTypeImageIndex,
+		Manifests: manifests,
+	}
+
+	digest, size, err := oci.PutBlobJSON(ctx, index)
+	if err != nil {
+		return errors.Wrapf(err, "couldn't write the index of %s", layerName)
+	}
+
+	log.Infof("%s is an index of the images for %d platforms", layerName, len(manifests))
+	return oci.UpdateReference(ctx, layerName, ispec.Descriptor{
+		MediaType: ispec.MediaTypeImageIndex,
+		Digest:    digest,
+		Size:      size,
+	})
+}
+
+// setImageVariant sets the variant of the platform in the config of the
+// image tagged layerName, which umoci's mutator has no field for.
+func setImageVariant(oci casext.Engine, layerName string, variant string) error {
+	manifest, err := stackeroci.LookupManifest(oci, layerName)
+	if err != nil {
+		return err
+	}
+
+	config, err := stackeroci.LookupConfig(oci, manifest.Config)
+	if err != nil {
+		return err
+	}
+
+	config.Variant = variant
+	_, err = stackeroci.UpdateImageConfig(oci, layerName, config, manifest)
+	return err
+}
+
+// indexPlatforms returns the platforms of the images of the index tagged
+// layerName, or none if layerName isn't an index of images for platforms.
+func indexPlatforms(oci casext.Engine, layerName string) ([]ispec.Platform, error) {
+	descPaths, err := oci.ResolveReference(context.Background(), layerName)
+	if err != nil {
+		return nil, err
+	}
+
+	platforms := []ispec.Platform{}
+	for _, descPath := range descPaths {
+		desc := descPath.Descriptor()
+		if len(descPath.Walk) < 2 || desc.Platform == nil {
+			return nil, nil
+		}
+		platforms = append(platforms, *desc.Platform)
+	}
+	return platforms, nil
+}
+
+// builtForPlatforms returns true if name was built for every platform of the
+// index buildPlatforms last tagged its images as, which have no build cache in
+// config's stacker dir but one each of their own.
+func builtForPlatforms(config types.StackerConfig, sfm types.StackerFiles, name string, layerTypes []types.LayerType) (bool, error) {
+	if _, err := os.Stat(config.OCIDir); err != nil {
+		return false, nil
+	}
+
+	oci, err := umoci.OpenLayout(config.OCIDir)
+	if err != nil {
+		return false, err
+	}
+	defer oci.Close()
+
+	platforms := map[string]ispec.Platform{}
+	for _, layerType := range layerTypes {
+		ps, err := indexPlatforms(oci, layerType.LayerName(name))
+		if err != nil || len(ps) == 0 {
+			return false, err
+		}
+		for _, p := range ps {
+			platforms[platformString(p)] = p
+		}
+	}
+
+	if len(platforms) == 0 {
+		return false, nil
+	}
+
+	for _, p := range platforms {
+		pc := platformConfig(config, p)
+		oci, err := umoci.OpenLayout(pc.OCIDir)
+		if err != nil {
+			return false, nil
+		}
+
+		cache, err := OpenCache(pc, oci, sfm)
+		if err != nil {
+			oci.Close()
+			return false, err
+		}
+
+		_, ok, err := cache.Lookup(name)
+		oci.Close()
+		if err != nil || !ok {
+			return false, err
+		}
+	}
+
+	return true, nil
+}
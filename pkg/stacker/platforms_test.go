@@ -0,0 +1,84 @@
+package stacker
+
+import (
+	"context"
+	"path"
+	"testing"
+
+	"github.com/opencontainers/image-spec/specs-go"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/opencontainers/umoci"
+	"github.com/stretchr/testify/assert"
+	stackeroci "stackerbuild.io/stacker/pkg/oci"
+	"stackerbuild.io/stacker/pkg/types"
+)
+
+func TestParsePlatform(t *testing.T) {
+	assert := assert.New(t)
+
+	p, err := ParsePlatform("linux/arm64")
+	assert.NoError(err)
+	assert.Equal(ispec.Platform{OS: "linux", Architecture: "arm64"}, p)
+
+	p, err = ParsePlatform("linux/arm/v7")
+	assert.NoError(err)
+	assert.Equal(ispec.Platform{OS: "linux", Architecture: "arm", Variant: "v7"}, p)
+	assert.Equal("linux-arm-v7", platformDirName(p))
+	assert.Equal("app-linux-arm-v7", platformLayerName("app", p))
+
+	for _, s := range []string{"", "linux", "linux/", "/arm64", "linux/arm/v7/x"} {
+		_, err = ParsePlatform(s)
+		assert.Error(err, s)
+	}
+}
+
+func TestPlatformConfig(t *testing.T) {
+	assert := assert.New(t)
+
+	c := types.StackerConfig{StackerDir: "/s", OCIDir: "/o", RootFSDir: "/r"}
+	pc := platformConfig(c, ispec.Platform{OS: "linux", Architecture: "arm64"})
+	assert.Equal("linux/arm64", pc.Platform)
+	assert.Equal("/s/platforms/linux-arm64", pc.StackerDir)
+	assert.Equal("/s/platforms/linux-arm64/oci", pc.OCIDir)
+	assert.Equal("/r/platforms/linux-arm64", pc.RootFSDir)
+	assert.Contains(pc.Substitutions(), "STACKER_ARCH=arm64")
+	assert.Contains(pc.Substitutions(), "STACKER_OS=linux")
+
+	assert.Error(checkCanRun(ispec.Platform{OS: "windows", Architecture: "amd64"}))
+}
+
+func TestIndexPlatforms(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+
+	oci, err := umoci.CreateLayout(path.Join(t.TempDir(), "oci"))
+	assert.NoError(err)
+	defer oci.Close()
+
+	putTarImage(t, oci, "app-linux-arm-v7", []tarEntry{{name: "file", content: "arm"}})
+	assert.NoError(setImageVariant(oci, "app-linux-arm-v7", "v7"))
+	manifest, err := stackeroci.LookupManifest(oci, "app-linux-arm-v7")
+	assert.NoError(err)
+	config, err := stackeroci.LookupConfig(oci, manifest.Config)
+	assert.NoError(err)
+	assert.Equal("v7", config.Variant)
+
+	// a plain image isn't built for platforms
+	platforms, err := indexPlatforms(oci, "app-linux-arm-v7")
+	assert.NoError(err)
+	assert.Empty(platforms)
+
+	// the index says which platforms it has, whatever its tags are
+	descPaths, err := oci.ResolveReference(ctx, "app-linux-arm-v7")
+	assert.NoError(err)
+	desc := descPaths[0].Descriptor()
+	desc.Platform = &ispec.Platform{OS: "linux", Architecture: "arm", Variant: "v7"}
+	index := ispec.Index{Versioned: specs.Versioned{SchemaVersion: 2}, MediaType: ispec.MediaTypeImageIndex, Manifests: []ispec.Descriptor{desc}}
+	d, size, err := oci.PutBlobJSON(ctx, index)
+	assert.NoError(err)
+	assert.NoError(oci.UpdateReference(ctx, "app", ispec.Descriptor{MediaType: ispec.MediaTypeImageIndex, Digest: d, Size: size}))
+
+	platforms, err = indexPlatforms(oci, "app")
+	assert.NoError(err)
+	assert.Equal([]ispec.Platform{*desc.Platform}, platforms)
+}
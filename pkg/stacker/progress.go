@@ -0,0 +1,131 @@
+package stacker
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sync/atomic"
+
+	"github.com/cheggaaa/pb/v3"
+	"golang.org/x/term"
+)
+
+// downloadProgress is the progress bar for a single Download. It lives for
+// the whole call rather than a single HTTP request, so that retries (and
+// resumes) update the same bar instead of drawing a new one each time.
+//
+// The bar is cosmetic, so it is never allowed to fail a download: if drawing
+// it panics, a warning is logged and the transfer goes on without it.
+type downloadProgress struct {
+	enabled   bool
+	threshold int64
+	bar       *pb.ProgressBar
+
+	// failed is set once the bar panicked; segmented downloads update
+	// the bar from several goroutines.
+	failed atomic.Bool
+}
+
+// newDownloadProgress returns the progress bar for a download with opts.
+// opts.Progress only allows the bar: it is still left out when it would end up
+// somewhere other than a terminal (unless opts.ForceProgress is set), or when
+// the file is smaller than opts.ProgressThreshold.
+func newDownloadProgress(opts DownloadOptions) *downloadProgress {
+	enabled := opts.Progress && (opts.ForceProgress || term.IsTerminal(int(os.Stderr.Fd())))
+	return &downloadProgress{enabled: enabled, threshold: opts.ProgressThreshold}
+}
+
+// active returns true if the bar has been started and hasn't failed.
+func (p *downloadProgress) active() bool {
+	return p.bar != nil && !p.failed.Load()
+}
+
+// guard runs f, which updates the bar, turning the bar off if f panics.
+func (p *downloadProgress) guard(f func()) {
+	defer func() {
+		if r := recover(); r != nil {
+			if !p.failed.Swap(true) {
+				netLog.Warnf("progress bar failed, continuing without it: %v", r)
+			}
+		}
+	}()
+
+	f()
+}
+
+// start (re)starts the bar for a transfer of total bytes, offset of which are
+// already present locally.
+func (p *downloadProgress) start(total int64, offset int64) {
+	if !p.enabled || p.failed.Load() {
+		return
+	}
+
+	// a negative total is an unknown size, which gets a bar
+	if p.bar == nil && total >= 0 && total < p.threshold {
+		return
+	}
+
+	// pb takes a zero total as unknown; never hand it a total it can't
+	// draw
+	if total < 0 || offset < 0 || offset > total {
+		total = 0
+	}
+	if offset < 0 {
+		offset = 0
+	}
+
+	p.guard(func() {
+		if p.bar == nil {
+			bar := pb.New64(total).Set(pb.Bytes, true)
+			bar.SetCurrent(offset)
+			bar.Start()
+			p.bar = bar
+			return
+		}
+
+		p.bar.SetTotal(total)
+		p.bar.SetCurrent(offset)
+	})
+}
+
+// retrying notes on the bar that the transfer is being attempted again.
+func (p *downloadProgress) retrying(attempt int) {
+	if !p.active() {
+		return
+	}
+
+	p.guard(func() {
+		p.bar.Set("prefix", fmt.Sprintf("retrying (attempt %d)", attempt))
+	})
+}
+
+func (p *downloadProgress) proxy(r io.Reader) io.Reader {
+	if !p.active() {
+		return r
+	}
+
+	return &progressReader{r: r, p: p}
+}
+
+func (p *downloadProgress) finish() {
+	if !p.active() {
+		return
+	}
+
+	p.guard(func() { p.bar.Finish() })
+}
+
+// progressReader counts what is read from r on the bar of p, for as long as
+// the bar works.
+type progressReader struct {
+	r io.Reader
+	p *downloadProgress
+}
+
+func (pr *progressReader) Read(b []byte) (int, error) {
+	n, err := pr.r.Read(b)
+	if n > 0 && pr.p.active() {
+		pr.p.guard(func() { pr.p.bar.Add(n) })
+	}
+	return n, err
+}
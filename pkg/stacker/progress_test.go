@@ -0,0 +1,38 @@
+package stacker
+
+import (
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDownloadProgressFailure(t *testing.T) {
+	assert := assert.New(t)
+
+	srv := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hello world"))
+	})
+
+	progress := newDownloadProgress(DownloadOptions{Progress: true, ForceProgress: true})
+	progress.start(-1, 5)
+	progress.start(10, 20)
+	assert.True(progress.active())
+
+	progress.guard(func() { panic("garbled") })
+	assert.False(progress.active())
+
+	r := strings.NewReader("hello")
+	assert.Equal(io.Reader(r), progress.proxy(r))
+	progress.finish()
+
+	// a download with a bar still works
+	name, err := DownloadWithOptions(t.TempDir(), srv.URL+"/file", DownloadOptions{Progress: true, ForceProgress: true})
+	assert.NoError(err)
+	content, err := os.ReadFile(name)
+	assert.NoError(err)
+	assert.Equal("hello world", string(content))
+}
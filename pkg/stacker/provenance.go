@@ -0,0 +1,210 @@
+package stacker
+
+import (
+	"context"
+	"encoding/json"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/in-toto/in-toto-golang/in_toto"
+	"github.com/in-toto/in-toto-golang/in_toto/slsa_provenance/common"
+	slsa "github.com/in-toto/in-toto-golang/in_toto/slsa_provenance/v1"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/opencontainers/umoci"
+	"github.com/opencontainers/umoci/oci/casext"
+	"github.com/pkg/errors"
+	"stackerbuild.io/stacker/pkg/lib"
+	"stackerbuild.io/stacker/pkg/types"
+)
+
+const (
+	// ProvenanceMediaType is the media type of the provenance of the
+	// images stacker builds: an in-toto statement with a SLSA provenance
+	// predicate.
+	ProvenanceMediaType = "application/vnd.in-toto+json"
+
+	// ProvenanceBuildType is the build type of the provenance, which
+	// says what its external parameters are.
+	ProvenanceBuildType = "https://stackerbuild.io/provenance/build/v1"
+
+	// ProvenanceBuilderID is the builder of the provenance.
+	ProvenanceBuilderID = "https://stackerbuild.io/stacker"
+)
+
+// ProvenanceParams are the external parameters of the provenance of a layer:
+// what it was asked to build.
+type ProvenanceParams struct {
+	Stackerfile   string            `json:"stackerfile"`
+	Layer         string            `json:"layer"`
+	Substitutions map[string]string `json:"substitutions,omitempty"`
+}
+
+// provenanceTag is the tag of the provenance of the image tagged layerName in
+// an OCI layout.
+func provenanceTag(layerName string) string {
+	return attachedTag(layerName, "provenance")
+}
+
+// digestSet is d as the digests of a resource descriptor.
+func digestSet(d string) common.DigestSet {
+	algorithm, hex, ok := strings.Cut(d, ":")
+	if !ok || hex == "" {
+		return nil
+	}
+	return common.DigestSet{algorithm: hex}
+}
+
+// baseDependency is the image l was built on, along with the digest of its
+// manifest if it was an image, or nil if it was built from scratch.
+func baseDependency(config types.StackerConfig, oci casext.Engine, l types.Layer, layerType types.LayerType) (*slsa.ResourceDescriptor, error) {
+	ctx := context.Background()
+
+	switch l.From.Type {
+	case types.ScratchLayer:
+		return nil, nil
+	case types.BuiltLayer:
+		dep := &slsa.ResourceDescriptor{Name: l.From.Tag}
+		descPaths, err := oci.ResolveReference(ctx, layerType.LayerName(l.From.Tag))
+		if err != nil {
+			return nil, err
+		}
+		if len(descPaths) == 1 {
+			dep.Digest = digestSet(descPaths[0].Descriptor().Digest.String())
+		}
+		return dep, nil
+	case types.DockerLayer, types.OCILayer, types.DockerArchiveLayer, types.OCIArchiveLayer:
+		dep := &slsa.ResourceDescriptor{URI: l.From.Url}
+		tag, err := l.From.ParseTag()
+		if err != nil {
+			return nil, err
+		}
+
+		bases, err := umoci.OpenLayout(path.Join(config.StackerDir, "layer-bases", "oci"))
+		if err != nil {
+			return nil, err
+		}
+		defer bases.Close()
+
+		descPaths, err := bases.ResolveReference(ctx, tag)
+		if err != nil {
+			return nil, err
+		}
+		if len(descPaths) == 1 {
+			dep.Digest = digestSet(descPaths[0].Descriptor().Digest.String())
+		}
+		return dep, nil
+	default:
+		return &slsa.ResourceDescriptor{URI: l.From.Url}, nil
+	}
+}
+
+// renderProvenance renders the provenance of subject, the image of the layer
+// name of sf that was built from started to finished.
+func renderProvenance(sf *types.Stackerfile, name string, subject ispec.Descriptor, layerName string,
+	substitutions []string, base *slsa.ResourceDescriptor, imports []sbomImport, started time.Time, finished time.Time,
+) ([]byte, error) {
+	params := ProvenanceParams{Stackerfile: sf.Path(), Layer: name}
+	for _, sub := range substitutions {
+		k, v, ok := strings.Cut(sub, "=")
+		if !ok {
+			continue
+		}
+		if params.Substitutions == nil {
+			params.Substitutions = map[string]string{}
+		}
+		params.Substitutions[k] = v
+	}
+
+	deps := []slsa.ResourceDescriptor{{
+		URI:    sf.Path(),
+		Digest: digestSet(sf.Digest.String()),
+	}}
+	if base != nil {
+		deps = append(deps, *base)
+	}
+	for _, imp := range imports {
+		deps = append(deps, slsa.ResourceDescriptor{URI: imp.Path, Digest: digestSet(imp.Digest)})
+	}
+
+	statement := in_toto.ProvenanceStatementSLSA1{
+		StatementHeader: in_toto.StatementHeader{
+			Type:          in_toto.StatementInTotoV01,
+			PredicateType: slsa.PredicateSLSAProvenance,
+			Subject: []in_toto.Subject{{
+				Name:   layerName,
+				Digest: digestSet(subject.Digest.String()),
+			}},
+		},
+		Predicate: slsa.ProvenancePredicate{
+			BuildDefinition: slsa.ProvenanceBuildDefinition{
+				BuildType:            ProvenanceBuildType,
+				ExternalParameters:   params,
+				ResolvedDependencies: deps,
+			},
+			RunDetails: slsa.ProvenanceRunDetails{
+				Builder: slsa.Builder{
+					ID:      ProvenanceBuilderID,
+					Version: map[string]string{"stacker": lib.StackerVersion},
+				},
+				BuildMetadata: slsa.BuildMetadata{
+					StartedOn:  &started,
+					FinishedOn: &finished,
+				},
+			},
+		},
+	}
+
+	content, err := json.MarshalIndent(statement, "", "  ")
+	if err != nil {
+		return nil, errors.Wrapf(err, "couldn't render the provenance of %s", layerName)
+	}
+	return content, nil
+}
+
+// attachProvenance generates the provenance of each of the manifests of the
+// layer name of sf that was built from started until now, and adds it to oci.
+func attachProvenance(config types.StackerConfig, oci casext.Engine, sf *types.Stackerfile, l types.Layer, name string,
+	substitutions []string, manifests map[types.LayerType]ispec.Descriptor, started time.Time,
+) error {
+	finished := time.Now().UTC()
+
+	imports, err := layerImports(config, name, l)
+	if err != nil {
+		return err
+	}
+
+	for layerType, desc := range manifests {
+		layerName := layerType.LayerName(name)
+
+		base, err := baseDependency(config, oci, l, layerType)
+		if err != nil {
+			return errors.Wrapf(err, "couldn't find the base image of %s", name)
+		}
+
+		content, err := renderProvenance(sf, name, desc, layerName, substitutions, base, imports, started, finished)
+		if err != nil {
+			return err
+		}
+
+		err = writeAttached(oci, provenanceTag(layerName), desc, ProvenanceMediaType, content)
+		if err != nil {
+			return errors.Wrapf(err, "couldn't add the provenance of %s", name)
+		}
+	}
+
+	return nil
+}
+
+// hasProvenance returns true if the image subject tagged layerName in oci has
+// a provenance.
+func hasProvenance(oci casext.Engine, layerName string, subject ispec.Descriptor) (bool, error) {
+	_, ok, err := readAttached(oci, provenanceTag(layerName), subject, ProvenanceMediaType)
+	return ok, err
+}
+
+// findProvenance returns the manifest of the provenance of the image tagged
+// layerName in oci.
+func findProvenance(oci casext.Engine, layerName string) (*ispec.Manifest, bool, error) {
+	return findAttached(oci, layerName, provenanceTag(layerName), ProvenanceMediaType)
+}
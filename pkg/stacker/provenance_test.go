@@ -0,0 +1,90 @@
+package stacker
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/in-toto/in-toto-golang/in_toto"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/opencontainers/umoci"
+	"github.com/stretchr/testify/assert"
+	"stackerbuild.io/stacker/pkg/types"
+)
+
+func TestProvenance(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+
+	dir := t.TempDir()
+	config := types.StackerConfig{
+		StackerDir: path.Join(dir, ".stacker"),
+		OCIDir:     path.Join(dir, "oci"),
+		RootFSDir:  path.Join(dir, "roots"),
+	}
+
+	content := "foo:\n  from:\n    type: scratch\n  imports:\n    - path: https://example.com/bar.tar.gz\n      hash: ABCD\n  run: echo ${{GREETING}}\n"
+	stackerfile := path.Join(dir, "stacker.yaml")
+	assert.NoError(os.WriteFile(stackerfile, []byte(content), 0644))
+	sf, err := types.NewStackerfile(stackerfile, false, []string{"GREETING=hello"})
+	assert.NoError(err)
+	l, ok := sf.Get("foo")
+	assert.True(ok)
+
+	oci, err := umoci.CreateLayout(config.OCIDir)
+	assert.NoError(err)
+	defer oci.Close()
+	assert.NoError(umoci.NewImage(oci, "foo"))
+	descPaths, err := oci.ResolveReference(ctx, "foo")
+	assert.NoError(err)
+	subject := descPaths[0].Descriptor()
+
+	ok, err = hasProvenance(oci, "foo", subject)
+	assert.NoError(err)
+	assert.False(ok)
+
+	tar, err := types.NewLayerType("tar", false)
+	assert.NoError(err)
+	started := time.Now().UTC()
+	err = attachProvenance(config, oci, sf, l, "foo", []string{"GREETING=hello"}, map[types.LayerType]ispec.Descriptor{tar: subject}, started)
+	assert.NoError(err)
+
+	ok, err = hasProvenance(oci, "foo", subject)
+	assert.NoError(err)
+	assert.True(ok)
+
+	manifest, ok, err := findProvenance(oci, "foo")
+	assert.NoError(err)
+	assert.True(ok)
+	file, err := extractAttached(oci, manifest, t.TempDir())
+	assert.NoError(err)
+	raw, err := os.ReadFile(file)
+	assert.NoError(err)
+
+	statement := in_toto.ProvenanceStatementSLSA1{}
+	assert.NoError(json.Unmarshal(raw, &statement))
+	assert.Equal([]in_toto.Subject{{Name: "foo", Digest: digestSet(subject.Digest.String())}}, statement.Subject)
+
+	predicate := statement.Predicate
+	assert.Equal(ProvenanceBuildType, predicate.BuildDefinition.BuildType)
+	assert.Equal(map[string]interface{}{
+		"stackerfile":   stackerfile,
+		"layer":         "foo",
+		"substitutions": map[string]interface{}{"GREETING": "hello"},
+	}, predicate.BuildDefinition.ExternalParameters)
+
+	// the stackerfile as it was before substitutions, and the imports
+	deps := predicate.BuildDefinition.ResolvedDependencies
+	assert.Len(deps, 2)
+	assert.Equal(stackerfile, deps[0].URI)
+	assert.Equal(digestSet(sf.Digest.String()), deps[0].Digest)
+	assert.Equal("https://example.com/bar.tar.gz", deps[1].URI)
+	assert.Equal("abcd", deps[1].Digest["sha256"])
+
+	assert.Equal(ProvenanceBuilderID, predicate.RunDetails.Builder.ID)
+	assert.True(started.Equal(*predicate.RunDetails.BuildMetadata.StartedOn))
+	assert.False(predicate.RunDetails.BuildMetadata.FinishedOn.Before(started))
+}
@@ -1,14 +1,19 @@
 package stacker
 
 import (
+	"context"
 	"fmt"
 	"io"
 	"os"
 	"path"
 	"path/filepath"
 	"regexp"
+	"slices"
 	"strings"
+	"time"
 
+	"github.com/containers/image/v5/signature/signer"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
 	"github.com/opencontainers/umoci"
 	"github.com/opencontainers/umoci/oci/casext"
 	"github.com/pkg/errors"
@@ -24,7 +29,7 @@ type PublishArgs struct {
 	SubstituteFile string
 	Substitute     []string
 	Tags           []string
-	Url            string
+	Urls           []string
 	Username       string
 	Password       string
 	Force          bool
@@ -32,12 +37,41 @@ type PublishArgs struct {
 	SkipTLS        bool
 	LayerTypes     []types.LayerType
 	Images         []string
+
+	// Sign, if its Key is set, is how the images are signed as they
+	// are published.
+	Sign SignOpts
+
+	// TarCompression, if set, is what tar layers are recompressed with
+	// as they are published, if they were built compressed otherwise.
+	TarCompression *types.TarCompression
+
+	// UploadChunkSize is how much of a blob is uploaded to registries per
+	// request (DefaultUploadChunkSize if it's 0), and UploadRetries how
+	// many times in a row an upload is retried after failing, waiting
+	// UploadRetryBackoff, doubled each time, before each retry.
+	UploadChunkSize    int64
+	UploadRetries      int
+	UploadRetryBackoff time.Duration
 }
 
 // Publisher is responsible for publishing the layers based on stackerfiles
 type Publisher struct {
 	stackerfiles types.StackerFiles // Keep track of all the Stackerfiles to publish
 	opts         *PublishArgs       // Publish options
+	signer       *signer.Signer     // Signs the images as they are published
+	metrics      *BuildMetrics      // How long publishing each image took
+	uploaded     uploadedBlobs      // The blobs uploaded to each registry so far
+}
+
+// tagRegexp is what the tags of images in registries look like, according to
+// the distribution spec.
+var tagRegexp = regexp.MustCompile(`^[A-Za-z0-9_][A-Za-z0-9._-]{0,127}$`)
+
+// publishTarget is one of the urls the images are published to.
+type publishTarget struct {
+	url string
+	is  *types.ImageSource
 }
 
 // NewPublisher initializes a new Publisher struct
@@ -63,9 +97,16 @@ func NewPublisher(opts *PublishArgs) *Publisher {
 	return &Publisher{
 		stackerfiles: make(map[string]*types.Stackerfile, 1),
 		opts:         opts,
+		metrics:      NewBuildMetrics(),
+		uploaded:     uploadedBlobs{},
 	}
 }
 
+// Metrics returns the measurements of what was published so far.
+func (p *Publisher) Metrics() *BuildMetrics {
+	return p.metrics
+}
+
 // Publish layers in a single stackerfile
 func (p *Publisher) Publish(file string) error {
 	opts := p.opts
@@ -94,17 +135,27 @@ func (p *Publisher) Publish(file string) error {
 	}
 
 	// Determine list of tags to be used
-	tags := make([]string, len(opts.Tags))
-	copy(tags, opts.Tags)
+	tags, err := p.expandTags(sf)
+	if err != nil {
+		return err
+	}
 
 	if len(tags) == 0 {
 		return errors.Errorf("can't save OCI images in %s since list of tags is empty\n", file)
 	}
 
-	// Need to determine if URL is docker/oci or something else
-	is, err := types.NewImageSource(opts.Url)
-	if err != nil {
-		return err
+	targets := []publishTarget{}
+	for _, url := range opts.Urls {
+		// Need to determine if URL is docker/oci or something else
+		is, err := types.NewImageSource(url)
+		if err != nil {
+			return err
+		}
+
+		if opts.Sign.Key != "" && is.Type != types.DockerLayer {
+			return errors.Errorf("can't sign the images published to %s: signatures can only be pushed to a registry", url)
+		}
+		targets = append(targets, publishTarget{url: url, is: is})
 	}
 
 	// Iterate through all layers defined in this stackerfile
@@ -138,6 +189,12 @@ func (p *Publisher) Publish(file string) error {
 		if err != nil {
 			return err
 		}
+		if !ok {
+			ok, err = builtForPlatforms(opts.Config, p.stackerfiles, name, opts.LayerTypes)
+			if err != nil {
+				return err
+			}
+		}
 		if !ok && !opts.Force {
 			return errors.Errorf("layer needs to be rebuilt before publishing: %s", name)
 		}
@@ -147,64 +204,120 @@ func (p *Publisher) Publish(file string) error {
 			for _, layerType := range opts.LayerTypes {
 				layerTypeTag := layerType.LayerName(tag)
 				layerName := layerType.LayerName(name)
-				// Determine full destination URL
-				var destUrl string
-				switch is.Type {
-				case types.DockerLayer:
-					destUrl = fmt.Sprintf("%s/%s:%s", strings.TrimRight(opts.Url, "/"), name, layerTypeTag)
-				case types.OCILayer:
-					destUrl = fmt.Sprintf("%s:%s_%s", opts.Url, name, layerTypeTag)
-				default:
-					return errors.Errorf("can't save layers to destination type: %s", is.Type)
-				}
-
-				if opts.ShowOnly {
-					// User has requested only to see what would be published
-					log.Infof("would publish: %s %s to %s", file, name, destUrl)
-					continue
-				}
+				for _, target := range targets {
+					is := target.is
+					// Determine full destination URL
+					var destUrl string
+					switch is.Type {
+					case types.DockerLayer:
+						destUrl = fmt.Sprintf("%s/%s:%s", strings.TrimRight(target.url, "/"), name, layerTypeTag)
+						// so that the attached artifacts go there too
+						destUrl = "docker://" + lib.RewriteReference(strings.TrimPrefix(destUrl, "docker://"), opts.Config.Registries)
+					case types.OCILayer:
+						destUrl = fmt.Sprintf("%s:%s_%s", target.url, name, layerTypeTag)
+					default:
+						return errors.Errorf("can't save layers to destination type: %s", is.Type)
+					}
 
-				var progressWriter io.Writer
-				if p.opts.Progress {
-					progressWriter = os.Stderr
-				}
+					if opts.ShowOnly {
+						// User has requested only to see what would be published
+						log.Infof("would publish: %s %s to %s", file, name, destUrl)
+						continue
+					}
 
-				// Store the layers to new destination
-				log.Infof("publishing %s %s to %s\n", file, layerName, destUrl)
-				err = lib.ImageCopy(lib.ImageCopyOpts{
-					Src:          fmt.Sprintf("oci:%s:%s", opts.Config.OCIDir, layerName),
-					Dest:         destUrl,
-					DestUsername: opts.Username,
-					DestPassword: opts.Password,
-					Progress:     progressWriter,
-					SrcSkipTLS:   true,
-					DestSkipTLS:  opts.SkipTLS,
-				})
-				if err != nil {
-					return err
-				}
+					var progressWriter io.Writer
+					if p.opts.Progress {
+						progressWriter = os.Stderr
+					}
 
-				if is.Type == types.DockerLayer && l.Bom != nil && l.Bom.Generate {
-					url, err := types.NewDockerishUrl(destUrl)
+					// Store the layers to new destination
+					log.Infof("publishing %s %s to %s\n", file, layerName, destUrl)
+					copyOpts := lib.ImageCopyOpts{
+						Src:          fmt.Sprintf("oci:%s:%s", opts.Config.OCIDir, layerName),
+						Dest:         destUrl,
+						DestUsername: opts.Username,
+						DestPassword: opts.Password,
+						Progress:     progressWriter,
+						SrcSkipTLS:   true,
+						DestSkipTLS:  opts.SkipTLS,
+						AllImages:    true,
+						Signers:      p.signers(),
+						Registries:   opts.Config.Registries,
+					}
+					if opts.TarCompression != nil && layerType.Type == "tar" {
+						copyOpts.Compression = opts.TarCompression.Name()
+						copyOpts.CompressionLevel = opts.TarCompression.Level
+					}
+					published := log.Fields{"layer": layerName, "url": destUrl}
+					descPaths, err := oci.ResolveReference(context.Background(), layerName)
 					if err != nil {
 						return err
 					}
+					if len(descPaths) == 1 {
+						published["digest"] = descPaths[0].Descriptor().Digest.String()
+					}
+					log.Event("publish-started", published)
+					publishStarted := time.Now()
+					// recompressed layers are only known as they're copied
+					if is.Type == types.DockerLayer && copyOpts.Compression == "" {
+						err = p.uploadBlobs(oci, layerName, destUrl)
+						if err != nil {
+							return err
+						}
+					}
+					err = lib.ImageCopy(copyOpts)
+					if err != nil {
+						return err
+					}
+					p.metrics.published(layerName, destUrl, time.Since(publishStarted))
+					log.Event("publish-finished", published)
 
-					registry := url.Host
-					repo := url.Path
-
-					// publish sbom
-					if err := publishArtifact(path.Join(opts.Config.StackerDir, "artifacts", layerName, fmt.Sprintf("%s.json", layerName)),
-						"application/spdx+json", registry, repo, layerTypeTag, p.opts.Username, p.opts.Password, opts.SkipTLS); err != nil {
+					sbom, ok, err := findSBOM(oci, layerName)
+					if err != nil {
 						return err
 					}
+					if ok {
+						log.Infof("publishing the sbom of %s to %s\n", layerName, destUrl)
+						err = p.publishAttached(oci, is, sbom, "sbom", layerName, layerTypeTag, destUrl, progressWriter)
+						if err != nil {
+							return errors.Wrapf(err, "couldn't publish the sbom of %s", layerName)
+						}
+					}
 
-					// publish inventory
-					if err := publishArtifact(path.Join(opts.Config.StackerDir, "artifacts", layerName, "inventory.json"),
-						"application/vnd.stackerbuild.inventory+json", registry, repo, layerTypeTag, p.opts.Username, p.opts.Password, opts.SkipTLS); err != nil {
+					provenance, ok, err := findProvenance(oci, layerName)
+					if err != nil {
 						return err
 					}
+					if ok {
+						log.Infof("publishing the provenance of %s to %s\n", layerName, destUrl)
+						err = p.publishAttached(oci, is, provenance, "provenance", layerName, layerTypeTag, destUrl, progressWriter)
+						if err != nil {
+							return errors.Wrapf(err, "couldn't publish the provenance of %s", layerName)
+						}
+					}
+
+					if is.Type == types.DockerLayer && l.Bom != nil && l.Bom.Generate {
+						url, err := types.NewDockerishUrl(destUrl)
+						if err != nil {
+							return err
+						}
+
+						registry := url.Host
+						repo := url.Path
 
+						// publish sbom
+						if err := publishArtifact(path.Join(opts.Config.StackerDir, "artifacts", layerName, fmt.Sprintf("%s.json", layerName)),
+							"application/spdx+json", registry, repo, layerTypeTag, p.opts.Username, p.opts.Password, opts.SkipTLS); err != nil {
+							return err
+						}
+
+						// publish inventory
+						if err := publishArtifact(path.Join(opts.Config.StackerDir, "artifacts", layerName, "inventory.json"),
+							"application/vnd.stackerbuild.inventory+json", registry, repo, layerTypeTag, p.opts.Username, p.opts.Password, opts.SkipTLS); err != nil {
+							return err
+						}
+
+					}
 				}
 			}
 		}
@@ -213,6 +326,86 @@ func (p *Publisher) Publish(file string) error {
 	return nil
 }
 
+// expandTags returns the tags the images of sf are published with, with the
+// ${{FOO}} placeholders in them substituted like in stackerfiles, as well as
+// ${{STACKER_GIT_VERSION}} and ${{STACKER_GIT_SHA}}, the git describe version
+// and short commit hash of the repo sf is in.
+func (p *Publisher) expandTags(sf *types.Stackerfile) ([]string, error) {
+	substitutions := append(slices.Clone(p.opts.Substitute), p.opts.Config.Substitutions()...)
+	if version, err := GitVersion(sf.ReferenceDirectory); err == nil {
+		substitutions = append(substitutions, "STACKER_GIT_VERSION="+version)
+	}
+	if sha, err := gitHash(sf.ReferenceDirectory, true); err == nil {
+		substitutions = append(substitutions, "STACKER_GIT_SHA="+sha)
+	}
+
+	tags := []string{}
+	for _, tag := range p.opts.Tags {
+		if !strings.Contains(tag, "${{") {
+			tags = append(tags, tag)
+			continue
+		}
+
+		expanded, err := types.Substitute(tag, substitutions)
+		if err != nil {
+			return nil, errors.Wrapf(err, "couldn't expand tag %s", tag)
+		}
+		if !tagRegexp.MatchString(expanded) {
+			return nil, errors.Errorf("tag %s expanded to %q, which isn't a valid tag", tag, expanded)
+		}
+		tags = append(tags, expanded)
+	}
+	return tags, nil
+}
+
+// signers are what the images are signed with as they are published.
+func (p *Publisher) signers() []*signer.Signer {
+	if p.signer == nil {
+		return nil
+	}
+	return []*signer.Signer{p.signer}
+}
+
+// publishAttached publishes manifest, the artifact of kind attached to
+// layerName, which was published to destUrl, as an artifact referring to it.
+func (p *Publisher) publishAttached(oci casext.Engine, is *types.ImageSource, manifest *ispec.Manifest, kind string,
+	layerName string, layerTypeTag string, destUrl string, progressWriter io.Writer,
+) error {
+	opts := p.opts
+
+	if is.Type == types.OCILayer {
+		return lib.ImageCopy(lib.ImageCopyOpts{
+			Src:          fmt.Sprintf("oci:%s:%s", opts.Config.OCIDir, attachedTag(layerName, kind)),
+			Dest:         attachedTag(destUrl, kind),
+			DestUsername: opts.Username,
+			DestPassword: opts.Password,
+			Progress:     progressWriter,
+			SrcSkipTLS:   true,
+			DestSkipTLS:  opts.SkipTLS,
+			Registries:   opts.Config.Registries,
+		})
+	}
+
+	url, err := types.NewDockerishUrl(destUrl)
+	if err != nil {
+		return err
+	}
+
+	dir, err := os.MkdirTemp(opts.Config.StackerDir, kind+"-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	file, err := extractAttached(oci, manifest, dir)
+	if err != nil {
+		return err
+	}
+
+	return publishArtifact(file, manifest.ArtifactType, url.Host, url.Path, layerTypeTag, opts.Username, opts.Password,
+		opts.SkipTLS || lib.PlainHTTP(url.Host, opts.Config.Registries))
+}
+
 // PublishMultiple published layers defined in a list of stackerfiles
 func (p *Publisher) PublishMultiple(paths []string) error {
 
@@ -228,6 +421,17 @@ func (p *Publisher) PublishMultiple(paths []string) error {
 	}
 	p.stackerfiles = sfm
 
+	if p.opts.Sign.Key != "" && !p.opts.ShowOnly {
+		p.signer, err = NewSigner(p.opts.Sign)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			p.signer.Close()
+			p.signer = nil
+		}()
+	}
+
 	// Publish all Stackerfiles
 	for _, path := range paths {
 		err := p.Publish(path)
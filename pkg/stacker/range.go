@@ -0,0 +1,202 @@
+package stacker
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// ByteRange is the window of a file from Start to End, both inclusive, as in
+// an http Range header.
+type ByteRange struct {
+	Start int64
+	End   int64
+}
+
+func (r ByteRange) String() string {
+	return fmt.Sprintf("bytes=%d-%d", r.Start, r.End)
+}
+
+// Len is the number of bytes in the range.
+func (r ByteRange) Len() int64 {
+	return r.End - r.Start + 1
+}
+
+// rangeCachePath returns where the slice r of url is cached in cacheDir.
+func rangeCachePath(cacheDir string, url string, r ByteRange, dest string) string {
+	return fmt.Sprintf("%s.%d-%d", cachePath(cacheDir, url, dest), r.Start, r.End)
+}
+
+// downloadRange downloads the slice opts.Range of url into cacheDir, re-using
+// a cached copy of the same slice of the same url.
+func downloadRange(cacheDir string, url string, opts DownloadOptions) (string, error) {
+	r := *opts.Range
+	if r.Start < 0 || r.End < r.Start {
+		return "", errors.Errorf("invalid range %d-%d for %s", r.Start, r.End, url)
+	}
+
+	name := rangeCachePath(cacheDir, url, r, opts.Dest)
+
+	cached, err := cachedRangeIsValid(name, url, opts)
+	if err != nil {
+		return "", err
+	}
+	if cached {
+		netLog.Infof("cache hit (verified) for %s of %s: it is the recorded slice", r, url)
+		metricsOf(opts).CacheHit(downloadHost(url))
+		return name, nil
+	}
+
+	final, err := fetchRange(name, url, opts)
+	if err != nil {
+		return "", err
+	}
+
+	meta := cacheMeta{Source: url, FinalURL: final, Range: r.String(), Digest: opts.ExpectedHash}
+	return name, recordDigest(name, meta, opts)
+}
+
+// cachedRangeIsValid returns true if name is a cached copy of the slice
+// opts.Range of url: it was recorded as such, has the slice's length and, if
+// opts.ExpectedHash is set, its digest.
+func cachedRangeIsValid(name string, url string, opts DownloadOptions) (bool, error) {
+	fi, err := os.Stat(name)
+	if os.IsNotExist(err) {
+		return false, nil
+	} else if err != nil {
+		return false, errors.WithStack(err)
+	}
+
+	meta, err := readCacheMeta(name)
+	if err != nil {
+		return false, err
+	}
+
+	if meta.Source != url || meta.Range != opts.Range.String() || fi.Size() != opts.Range.Len() {
+		return false, nil
+	}
+
+	if opts.ExpectedHash == "" {
+		return true, nil
+	}
+
+	hash, err := cachedDigest(name, url, opts)
+	if err != nil {
+		return false, err
+	}
+
+	return hash == opts.ExpectedHash, nil
+}
+
+// fetchRange downloads the slice opts.Range of url to name, checking it
+// against opts.ExpectedHash. It returns where url redirected to, if it did.
+func fetchRange(name string, url string, opts DownloadOptions) (string, error) {
+	r := *opts.Range
+
+	ctx, cancel := downloadContext(opts)
+	defer cancel()
+
+	req, err := newRequest(ctx, http.MethodGet, url, opts)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Range", r.String())
+
+	netLog.Infof("downloading %s of %v", r, url)
+
+	resp, err := httpClient(opts).Do(req)
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusOK:
+		return "", errors.Errorf("couldn't download %s of %s: the server doesn't support range requests", r, url)
+	case resp.StatusCode != http.StatusPartialContent:
+		return "", &downloadStatusError{url: url, status: resp.Status, statusCode: resp.StatusCode, resp: resp}
+	}
+
+	// servers cut ranges that go past the end of the file short
+	contentRange := resp.Header.Get("Content-Range")
+	if !strings.HasPrefix(contentRange, fmt.Sprintf("bytes %d-%d/", r.Start, r.End)) {
+		return "", errors.Errorf("couldn't download %s of %s: server sent range %q", r, url, contentRange)
+	}
+
+	err = createCacheDir(path.Join(path.Dir(name), metaDirName), opts.DirMode)
+	if err != nil {
+		return "", err
+	}
+
+	partial := sidecarPath(name, partialExt)
+	out, err := createCacheFile(partial, os.O_RDWR|os.O_TRUNC, opts.FileMode)
+	if err != nil {
+		return "", err
+	}
+	defer out.Close()
+
+	progress := newDownloadProgress(opts)
+	defer progress.finish()
+	progress.start(r.Len(), 0)
+
+	n, err := io.Copy(out, io.LimitReader(progress.proxy(resp.Body), r.Len()))
+	metricsOf(opts).BytesDownloaded(downloadHost(url), n)
+	if err == nil && n != r.Len() {
+		err = errors.Errorf("short download of %s of %s: got %d of %d bytes", r, url, n, r.Len())
+	}
+	if err != nil {
+		os.RemoveAll(partial)
+		return "", err
+	}
+
+	if opts.ExpectedHash != "" {
+		hash, err := sha256File(partial)
+		if err != nil {
+			os.RemoveAll(partial)
+			return "", err
+		}
+
+		if hash != opts.ExpectedHash {
+			os.RemoveAll(partial)
+			return "", &ChecksumMismatchError{URL: url, Expected: opts.ExpectedHash, Actual: hash}
+		}
+	}
+
+	if opts.Mode != nil {
+		err = out.Chmod(*opts.Mode)
+		if err != nil {
+			return "", errors.Wrapf(err, "couldn't chmod file %s", name)
+		}
+	}
+
+	err = out.Chown(opts.Uid, opts.Gid)
+	if err != nil {
+		return "", errors.Wrapf(err, "couldn't chown file %s", name)
+	}
+
+	err = validateDownload(partial, url, opts)
+	if err != nil {
+		os.RemoveAll(partial)
+		return "", err
+	}
+
+	final := finalURL(resp)
+	if final == url {
+		final = ""
+	}
+	return final, errors.Wrapf(os.Rename(partial, name), "couldn't move download of %s into the cache", url)
+}
+
+// coversWholeFile returns true if the Content-Range of the 206 resp is all of
+// the file, i.e. bytes 0 to its length-1. Some servers answer requests that
+// didn't ask for a range that way.
+func coversWholeFile(resp *http.Response) bool {
+	var start, end, size int64
+	_, err := fmt.Sscanf(resp.Header.Get("Content-Range"), "bytes %d-%d/%d", &start, &end, &size)
+	return err == nil && start == 0 && end == size-1
+}
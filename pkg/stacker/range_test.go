@@ -0,0 +1,57 @@
+package stacker
+
+import (
+	"bytes"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDownloadRange(t *testing.T) {
+	assert := assert.New(t)
+
+	content := []byte("0123456789abcdef")
+	requests := 0
+	srv := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if r.URL.Path == "/norange" {
+			w.Write(content)
+			return
+		}
+		http.ServeContent(w, r, "blob", time.Time{}, bytes.NewReader(content))
+	})
+
+	cacheDir := t.TempDir()
+	opts := DownloadOptions{
+		Range: &ByteRange{Start: 2, End: 6},
+		ChecksumOptions: ChecksumOptions{
+			// sha256 of "23456"
+			ExpectedHash: "9b56ca8566a48b98a8c29a7fd307038ed555123439a937eb85d9c45166881e6e",
+		},
+	}
+
+	name, err := DownloadWithOptions(cacheDir, srv.URL+"/blob", opts)
+	assert.NoError(err)
+	assert.Equal(path.Join(cacheDir, "blob.2-6"), name)
+	got, err := os.ReadFile(name)
+	assert.NoError(err)
+	assert.Equal("23456", string(got))
+
+	_, err = DownloadWithOptions(cacheDir, srv.URL+"/blob", opts)
+	assert.NoError(err)
+	assert.Equal(1, requests)
+
+	opts.ExpectedHash = strings.Repeat("0", 64)
+	_, err = DownloadWithOptions(cacheDir, srv.URL+"/blob", opts)
+	assert.ErrorAs(err, new(*ChecksumMismatchError))
+
+	_, err = DownloadWithOptions(cacheDir, srv.URL+"/norange", DownloadOptions{Range: &ByteRange{Start: 2, End: 6}})
+	assert.ErrorContains(err, "doesn't support range requests")
+	_, err = os.Stat(path.Join(cacheDir, "norange.2-6"))
+	assert.True(os.IsNotExist(err))
+}
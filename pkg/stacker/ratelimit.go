@@ -0,0 +1,184 @@
+package stacker
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"stackerbuild.io/stacker/pkg/types"
+)
+
+// bucket is a token bucket holding up to a second's worth of tokens. Takers
+// may go into debt, and then wait until it is paid off, so that a single
+// take can be larger than the bucket.
+type bucket struct {
+	mu     sync.Mutex
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+func newBucket(rate float64) *bucket {
+	if rate <= 0 {
+		return nil
+	}
+	return &bucket{rate: rate, tokens: rate, last: time.Now()}
+}
+
+// take removes n tokens from the bucket, waiting until they are available.
+func (b *bucket) take(ctx context.Context, n float64) error {
+	if b == nil {
+		return nil
+	}
+
+	b.mu.Lock()
+	now := time.Now()
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.rate {
+		b.tokens = b.rate
+	}
+	b.last = now
+	b.tokens -= n
+	wait := time.Duration(-b.tokens / b.rate * float64(time.Second))
+	b.mu.Unlock()
+
+	if wait <= 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// hostLimiter is the state of a types.RateLimit.
+type hostLimiter struct {
+	bytes    *bucket
+	requests *bucket
+}
+
+// RateLimiter limits the rate of the requests made to, and bytes downloaded
+// from, each server, as configured by types.RateLimits. Hosts that aren't
+// listed there share the default limit. A RateLimiter is meant to be shared by
+// all downloads, and is safe for concurrent use.
+type RateLimiter struct {
+	mu       sync.Mutex
+	limits   types.RateLimits
+	hosts    map[string]*hostLimiter
+	fallback *hostLimiter
+}
+
+// NewRateLimiter returns a RateLimiter enforcing limits.
+func NewRateLimiter(limits types.RateLimits) *RateLimiter {
+	return &RateLimiter{
+		limits:   limits,
+		hosts:    map[string]*hostLimiter{},
+		fallback: newHostLimiter(limits.Default),
+	}
+}
+
+func newHostLimiter(limit types.RateLimit) *hostLimiter {
+	return &hostLimiter{
+		bytes:    newBucket(float64(limit.BytesPerSecond)),
+		requests: newBucket(limit.RequestsPerSecond),
+	}
+}
+
+func (l *RateLimiter) limiter(host string) *hostLimiter {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	limit, ok := l.limits.Hosts[host]
+	if !ok {
+		return l.fallback
+	}
+
+	hl, ok := l.hosts[host]
+	if !ok {
+		hl = newHostLimiter(limit)
+		l.hosts[host] = hl
+	}
+	return hl
+}
+
+// transport returns a RoundTripper making requests through next within l's
+// limits. The limits apply to the server actually talked to, e.g. the cache
+// proxy rather than the server it proxies.
+func (l *RateLimiter) transport(next http.RoundTripper) http.RoundTripper {
+	return rateLimitedTransport{limiter: l, next: next}
+}
+
+type rateLimitedTransport struct {
+	limiter *RateLimiter
+	next    http.RoundTripper
+}
+
+func (t rateLimitedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	hl := t.limiter.limiter(req.URL.Host)
+
+	err := hl.requests.take(req.Context(), 1)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := t.next.RoundTrip(req)
+	if err != nil || hl.bytes == nil {
+		return resp, err
+	}
+
+	resp.Body = &rateLimitedBody{ReadCloser: resp.Body, ctx: req.Context(), bytes: hl.bytes}
+	return resp, nil
+}
+
+type rateLimitedBody struct {
+	io.ReadCloser
+	ctx   context.Context
+	bytes *bucket
+}
+
+func (b *rateLimitedBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if n > 0 {
+		if werr := b.bytes.take(b.ctx, float64(n)); werr != nil && err == nil {
+			err = werr
+		}
+	}
+	return n, err
+}
+
+var (
+	configRateLimitersMu sync.Mutex
+	configRateLimiters   = map[string]*RateLimiter{}
+)
+
+// configRateLimiter returns the RateLimiter shared by all imports configured
+// with limits, or nil if there are none.
+func configRateLimiter(limits types.RateLimits) *RateLimiter {
+	if limits.Default == (types.RateLimit{}) && len(limits.Hosts) == 0 {
+		return nil
+	}
+
+	// map keys are sorted, so equal limits have the same key
+	key, err := json.Marshal(limits)
+	if err != nil {
+		return NewRateLimiter(limits)
+	}
+
+	configRateLimitersMu.Lock()
+	defer configRateLimitersMu.Unlock()
+
+	l, ok := configRateLimiters[string(key)]
+	if !ok {
+		l = NewRateLimiter(limits)
+		configRateLimiters[string(key)] = l
+	}
+	return l
+}
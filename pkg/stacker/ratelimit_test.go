@@ -0,0 +1,41 @@
+package stacker
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"stackerbuild.io/stacker/pkg/types"
+)
+
+func TestRateLimiter(t *testing.T) {
+	assert := assert.New(t)
+
+	limiter := NewRateLimiter(types.RateLimits{
+		Hosts: map[string]types.RateLimit{"slow.example.com": {RequestsPerSecond: 10}},
+	})
+	opts := DownloadOptions{
+		Uid: os.Getuid(),
+		Gid: os.Getgid(),
+		TransportOptions: TransportOptions{
+			Transport:   &fakeTransport{body: "hello world"},
+			RateLimiter: limiter,
+		},
+	}
+
+	// the first second's worth of requests go through right away
+	start := time.Now()
+	for i := 0; i < 15; i++ {
+		_, err := DownloadWithOptions(t.TempDir(), "https://slow.example.com/foo", opts)
+		assert.NoError(err)
+	}
+	assert.GreaterOrEqual(time.Since(start), 400*time.Millisecond)
+
+	start = time.Now()
+	for i := 0; i < 15; i++ {
+		_, err := DownloadWithOptions(t.TempDir(), "https://fast.example.com/foo", opts)
+		assert.NoError(err)
+	}
+	assert.Less(time.Since(start), 400*time.Millisecond)
+}
@@ -0,0 +1,360 @@
+package stacker
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/opencontainers/go-digest"
+	"github.com/opencontainers/image-spec/specs-go"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/opencontainers/umoci"
+	"github.com/opencontainers/umoci/oci/casext"
+	"github.com/pkg/errors"
+	"stackerbuild.io/stacker/pkg/lib"
+	"stackerbuild.io/stacker/pkg/log"
+	"stackerbuild.io/stacker/pkg/types"
+)
+
+const (
+	// RemoteCacheArtifactType is the artifact type of the manifest of
+	// the build cache metadata in an exported build cache.
+	RemoteCacheArtifactType = "application/vnd.stackerbuild.cache.v1"
+
+	// RemoteCacheMediaType is the media type of the build cache metadata,
+	// which is in the format of the local build cache file.
+	RemoteCacheMediaType = "application/vnd.stackerbuild.cache.v1+json"
+
+	remoteCacheTag = "cache"
+)
+
+// RemoteCacheOpts are where a build cache is exported to or imported from: a
+// containers/image reference, e.g. docker://registry:5000/project/cache:main
+// or oci:/some/layout:cache.
+type RemoteCacheOpts struct {
+	Ref      string
+	SkipTLS  bool
+	Progress bool
+}
+
+// ExportCache pushes the build cache of config to opts.Ref, as an image index
+// of the cached images of every layer along with an artifact with the cache
+// metadata. Build only layers aren't exported, since what is cached for them
+// is their rootfs.
+func ExportCache(config types.StackerConfig, opts RemoteCacheOpts) error {
+	ctx := context.Background()
+
+	oci, err := umoci.OpenLayout(config.OCIDir)
+	if err != nil {
+		return err
+	}
+	defer oci.Close()
+
+	cache, err := OpenCache(config, oci, types.StackerFiles{})
+	if err != nil {
+		return err
+	}
+
+	dir := path.Join(config.StackerDir, "cache-export")
+	err = os.RemoveAll(dir)
+	if err != nil {
+		return errors.Wrapf(err, "couldn't clean %s", dir)
+	}
+	defer os.RemoveAll(dir)
+
+	export, err := umoci.CreateLayout(dir)
+	if err != nil {
+		return err
+	}
+	defer export.Close()
+
+	names := []string{}
+	for name, ent := range cache.Cache {
+		if !ent.Layer.BuildOnly {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	exported := BuildCache{Cache: map[string]CacheEntry{}, Version: currentCacheVersion}
+	manifests := []ispec.Descriptor{}
+	seen := map[digest.Digest]bool{}
+	for _, name := range names {
+		ent := cache.Cache[name]
+		for _, desc := range ent.Manifests {
+			if seen[desc.Digest] {
+				continue
+			}
+			seen[desc.Digest] = true
+
+			err = copyBlobs(ctx, oci, export, desc)
+			if err != nil {
+				return errors.Wrapf(err, "couldn't export %s", name)
+			}
+			manifests = append(manifests, desc)
+		}
+		exported.Cache[name] = ent
+	}
+
+	metaDigest, metaSize, err := export.PutBlobJSON(ctx, &exported)
+	if err != nil {
+		return err
+	}
+
+	_, _, err = export.PutBlob(ctx, bytes.NewReader(ispec.DescriptorEmptyJSON.Data))
+	if err != nil {
+		return err
+	}
+
+	metaManifest := ispec.Manifest{
+		Versioned:    specs.Versioned{SchemaVersion: 2},
+		MediaType:    ispec.MediaTypeImageManifest,
+		ArtifactType: RemoteCacheArtifactType,
+		Config:       ispec.DescriptorEmptyJSON,
+		Layers: []ispec.Descriptor{{
+			MediaType: RemoteCacheMediaType,
+			Digest:    metaDigest,
+			Size:      metaSize,
+		}},
+	}
+
+	manifestDigest, manifestSize, err := export.PutBlobJSON(ctx, metaManifest)
+	if err != nil {
+		return err
+	}
+
+	index := ispec.Index{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: ispec.MediaTypeImageIndex,
+		Manifests: append([]ispec.Descriptor{{
+			MediaType:    ispec.MediaTypeImageManifest,
+			ArtifactType: RemoteCacheArtifactType,
+			Digest:       manifestDigest,
+			Size:         manifestSize,
+		}}, manifests...),
+	}
+
+	indexDigest, indexSize, err := export.PutBlobJSON(ctx, index)
+	if err != nil {
+		return err
+	}
+
+	err = export.UpdateReference(ctx, remoteCacheTag, ispec.Descriptor{
+		MediaType: ispec.MediaTypeImageIndex,
+		Digest:    indexDigest,
+		Size:      indexSize,
+	})
+	if err != nil {
+		return err
+	}
+
+	var progressWriter io.Writer
+	if opts.Progress {
+		progressWriter = os.Stderr
+	}
+
+	log.Infof("exporting the build cache of %d layers to %s", len(exported.Cache), opts.Ref)
+	return lib.ImageCopy(lib.ImageCopyOpts{
+		Src:         "oci:" + dir + ":" + remoteCacheTag,
+		Dest:        opts.Ref,
+		DestSkipTLS: opts.SkipTLS,
+		Progress:    progressWriter,
+		AllImages:   true,
+		Registries:  config.Registries,
+	})
+}
+
+// ImportCache pulls the build cache ExportCache pushed to opts.Ref, and adds
+// the layers the build cache of config doesn't have yet to it, tagging their
+// images in config's OCI layout as if they were built. A build cache that
+// can't be pulled (e.g. because it wasn't exported yet) is only warned about.
+func ImportCache(config types.StackerConfig, opts RemoteCacheOpts) error {
+	ctx := context.Background()
+
+	err := os.MkdirAll(config.StackerDir, 0755)
+	if err != nil {
+		return errors.Wrapf(err, "couldn't create %s", config.StackerDir)
+	}
+
+	dir := path.Join(config.StackerDir, "cache-import")
+	err = os.RemoveAll(dir)
+	if err != nil {
+		return errors.Wrapf(err, "couldn't clean %s", dir)
+	}
+	defer os.RemoveAll(dir)
+
+	var progressWriter io.Writer
+	if opts.Progress {
+		progressWriter = os.Stderr
+	}
+
+	log.Infof("importing the build cache from %s", opts.Ref)
+	err = lib.ImageCopy(lib.ImageCopyOpts{
+		Src:        opts.Ref,
+		Dest:       "oci:" + dir + ":" + remoteCacheTag,
+		SrcSkipTLS: opts.SkipTLS,
+		Progress:   progressWriter,
+		AllImages:  true,
+		Registries: config.Registries,
+	})
+	if err != nil {
+		log.Warnf("couldn't import the build cache from %s, building without it: %v", opts.Ref, err)
+		return nil
+	}
+
+	imported, err := umoci.OpenLayout(dir)
+	if err != nil {
+		return err
+	}
+	defer imported.Close()
+
+	remote, err := readRemoteCache(ctx, imported)
+	if err != nil {
+		return errors.Wrapf(err, "couldn't read the build cache from %s", opts.Ref)
+	}
+
+	if remote.Version != currentCacheVersion {
+		log.Warnf("the build cache from %s is version %d, not %d, building without it", opts.Ref, remote.Version, currentCacheVersion)
+		return nil
+	}
+
+	var oci casext.Engine
+	if _, statErr := os.Stat(config.OCIDir); statErr != nil {
+		oci, err = umoci.CreateLayout(config.OCIDir)
+	} else {
+		oci, err = umoci.OpenLayout(config.OCIDir)
+	}
+	if err != nil {
+		return err
+	}
+	defer oci.Close()
+
+	cache, err := OpenCache(config, oci, types.StackerFiles{})
+	if err != nil {
+		return err
+	}
+
+	added := 0
+	for name, ent := range remote.Cache {
+		if _, ok := cache.Cache[name]; ok || ent.Layer.BuildOnly {
+			continue
+		}
+
+		for layerType, desc := range ent.Manifests {
+			err = copyBlobs(ctx, imported, oci, desc)
+			if err != nil {
+				return errors.Wrapf(err, "couldn't import %s", name)
+			}
+
+			err = oci.UpdateReference(ctx, layerType.LayerName(name), desc)
+			if err != nil {
+				return err
+			}
+		}
+
+		cache.Cache[name] = ent
+		added++
+	}
+
+	log.Infof("imported the build cache of %d layers", added)
+	return cache.persist()
+}
+
+// readRemoteCache reads the build cache metadata out of the exported build
+// cache tagged remoteCacheTag in oci.
+func readRemoteCache(ctx context.Context, oci casext.Engine) (*BuildCache, error) {
+	descPaths, err := oci.ResolveReference(ctx, remoteCacheTag)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, descPath := range descPaths {
+		blob, err := oci.FromDescriptor(ctx, descPath.Descriptor())
+		if err != nil {
+			return nil, err
+		}
+		manifest, ok := blob.Data.(ispec.Manifest)
+		blob.Close()
+		if !ok || manifest.ArtifactType != RemoteCacheArtifactType {
+			continue
+		}
+
+		if len(manifest.Layers) != 1 || manifest.Layers[0].MediaType != RemoteCacheMediaType {
+			return nil, errors.Errorf("invalid build cache manifest %s", descPath.Descriptor().Digest)
+		}
+
+		reader, err := oci.GetVerifiedBlob(ctx, manifest.Layers[0])
+		if err != nil {
+			return nil, err
+		}
+		defer reader.Close()
+
+		remote := &BuildCache{}
+		err = json.NewDecoder(reader).Decode(remote)
+		if err != nil {
+			return nil, errors.Wrapf(err, "couldn't parse the build cache")
+		}
+		return remote, nil
+	}
+
+	return nil, errors.Errorf("no %s manifest in the index", RemoteCacheArtifactType)
+}
+
+// copyBlobs copies root and all the blobs it references from src to dest.
+func copyBlobs(ctx context.Context, src casext.Engine, dest casext.Engine, root ispec.Descriptor) error {
+	return src.Walk(ctx, root, func(descPath casext.DescriptorPath) error {
+		desc := descPath.Descriptor()
+		ok, err := dest.StatBlob(ctx, desc.Digest)
+		if err != nil {
+			return err
+		}
+		if ok {
+			// and so does everything it references
+			return casext.ErrSkipDescriptor
+		}
+
+		reader, err := src.GetVerifiedBlob(ctx, desc)
+		if err != nil {
+			return err
+		}
+		defer reader.Close()
+
+		_, _, err = dest.PutBlob(ctx, reader)
+		return err
+	})
+}
+
+// platformCacheRef is the reference the build cache of p is exported to or
+// imported from when building for several platforms: the tag of ref with the
+// platform appended.
+func platformCacheRef(ref string, p ispec.Platform) string {
+	if ref == "" {
+		return ""
+	}
+
+	if strings.LastIndex(ref, ":") > strings.LastIndex(ref, "/") {
+		return ref + "-" + platformDirName(p)
+	}
+	return ref + ":" + platformDirName(p)
+}
+
+// restoreCachedRootfs sets up the rootfs of name, whose build was a cache hit
+// but whose rootfs isn't in storage (e.g. since it was imported from a remote
+// build cache), from its image, so layers that are built on it can be.
+func restoreCachedRootfs(config types.StackerConfig, s types.Storage, name string, layerName string) error {
+	tag := "stacker-cached-" + name
+	err := lib.ImageCopy(lib.ImageCopyOpts{
+		Src:  "oci:" + config.OCIDir + ":" + layerName,
+		Dest: "oci:" + path.Join(config.StackerDir, "layer-bases", "oci") + ":" + tag,
+	})
+	if err != nil {
+		return errors.Wrapf(err, "couldn't restore the rootfs of %s", name)
+	}
+
+	return s.Unpack(tag, name)
+}
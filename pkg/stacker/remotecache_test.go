@@ -0,0 +1,74 @@
+package stacker
+
+import (
+	"context"
+	"os"
+	"path"
+	"testing"
+
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/opencontainers/umoci"
+	"github.com/stretchr/testify/assert"
+	"stackerbuild.io/stacker/pkg/types"
+)
+
+func TestRemoteCache(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+
+	newConfig := func() types.StackerConfig {
+		dir := t.TempDir()
+		return types.StackerConfig{
+			StackerDir: path.Join(dir, ".stacker"),
+			OCIDir:     path.Join(dir, "oci"),
+			RootFSDir:  path.Join(dir, "roots"),
+		}
+	}
+
+	// a build cache with a layer and a build only layer
+	config := newConfig()
+	oci, err := umoci.CreateLayout(config.OCIDir)
+	assert.NoError(err)
+	defer oci.Close()
+	assert.NoError(umoci.NewImage(oci, "foo"))
+	descPaths, err := oci.ResolveReference(ctx, "foo")
+	assert.NoError(err)
+	desc := descPaths[0].Descriptor()
+
+	tar, err := types.NewLayerType("tar", false)
+	assert.NoError(err)
+	cache, err := OpenCache(config, oci, types.StackerFiles{})
+	assert.NoError(err)
+	cache.Cache["foo"] = CacheEntry{Name: "foo", Manifests: map[types.LayerType]ispec.Descriptor{tar: desc}}
+	cache.Cache["bar"] = CacheEntry{Name: "bar", Layer: types.Layer{BuildOnly: true}}
+	assert.NoError(os.MkdirAll(config.StackerDir, 0755))
+	assert.NoError(os.MkdirAll(path.Join(config.RootFSDir, "bar"), 0755))
+	assert.NoError(cache.persist())
+
+	remote := RemoteCacheOpts{Ref: "oci:" + path.Join(t.TempDir(), "remote") + ":main"}
+	assert.NoError(ExportCache(config, remote))
+
+	// a fresh build gets the layer, with its image tagged in the layout
+	fresh := newConfig()
+	assert.NoError(ImportCache(fresh, remote))
+
+	freshOCI, err := umoci.OpenLayout(fresh.OCIDir)
+	assert.NoError(err)
+	defer freshOCI.Close()
+	descPaths, err = freshOCI.ResolveReference(ctx, tar.LayerName("foo"))
+	assert.NoError(err)
+	assert.Len(descPaths, 1)
+	assert.Equal(desc.Digest, descPaths[0].Descriptor().Digest)
+
+	freshCache, err := OpenCache(fresh, freshOCI, types.StackerFiles{})
+	assert.NoError(err)
+	assert.Contains(freshCache.Cache, "foo")
+	assert.NotContains(freshCache.Cache, "bar")
+
+	// a build cache that isn't there isn't an error
+	missing := RemoteCacheOpts{Ref: "oci:" + path.Join(t.TempDir(), "missing") + ":main"}
+	assert.NoError(ImportCache(newConfig(), missing))
+
+	assert.Equal("docker://r/c:main-linux-arm64", platformCacheRef("docker://r/c:main", ispec.Platform{OS: "linux", Architecture: "arm64"}))
+	assert.Equal("oci:/r/c:linux-arm64", platformCacheRef("oci:/r/c", ispec.Platform{OS: "linux", Architecture: "arm64"}))
+}
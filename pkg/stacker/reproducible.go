@@ -0,0 +1,20 @@
+package stacker
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// ParseSourceDateEpoch parses a SOURCE_DATE_EPOCH, the seconds since the unix
+// epoch that reproducible builds clamp their timestamps to; see
+// https://reproducible-builds.org/specs/source-date-epoch/.
+func ParseSourceDateEpoch(s string) (time.Time, error) {
+	secs, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || secs < 0 {
+		return time.Time{}, errors.Errorf("invalid SOURCE_DATE_EPOCH %q: expected a number of seconds since the epoch", s)
+	}
+
+	return time.Unix(secs, 0).UTC(), nil
+}
@@ -0,0 +1,35 @@
+package stacker
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseSourceDateEpoch(t *testing.T) {
+	assert := assert.New(t)
+
+	epoch, err := ParseSourceDateEpoch("1700000000")
+	assert.NoError(err)
+	assert.Equal(time.Date(2023, time.November, 14, 22, 13, 20, 0, time.UTC), epoch)
+
+	for _, s := range []string{"", "-1", "yesterday", "1700000000.5"} {
+		_, err = ParseSourceDateEpoch(s)
+		assert.Error(err, s)
+	}
+}
+
+func TestSameSourceDateEpoch(t *testing.T) {
+	assert := assert.New(t)
+
+	a := time.Unix(1700000000, 0)
+	b := time.Unix(1700000000, 0).UTC()
+	c := time.Unix(1700000001, 0)
+
+	assert.True(sameSourceDateEpoch(nil, nil))
+	assert.True(sameSourceDateEpoch(&a, &b))
+	assert.False(sameSourceDateEpoch(&a, &c))
+	assert.False(sameSourceDateEpoch(&a, nil))
+	assert.False(sameSourceDateEpoch(nil, &a))
+}
@@ -0,0 +1,195 @@
+package stacker
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"hash"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/minio/sha256-simd"
+	"github.com/pkg/errors"
+)
+
+const (
+	checkpointExt = ".checkpoint"
+
+	// how often (in bytes) the checkpoint of a resumable download is
+	// updated while it is in progress.
+	checkpointInterval = 16 * 1024 * 1024
+)
+
+// checkpoint records how much of a resumable download is in its partial file,
+// and the digest of those bytes.
+type checkpoint struct {
+	Source string `json:"source"`
+	Offset int64  `json:"offset"`
+	Digest string `json:"digest"`
+
+	// Validator is the strong ETag (or else the Last-Modified) of the
+	// file being downloaded, so that resuming it continues the same file.
+	Validator string `json:"validator,omitempty"`
+}
+
+// partialWriter writes a download to its partial file. For resumable
+// downloads it keeps a running hash of everything in the file, which is
+// checkpointed so that the next attempt can verify the bytes it resumes from.
+type partialWriter struct {
+	out    *os.File
+	name   string
+	url    string
+	opts   DownloadOptions
+	offset int64
+
+	h              hash.Hash
+	lastCheckpoint int64
+
+	// acceptRanges is whether the server said the download can be
+	// resumed; validator is the version of the file being downloaded.
+	acceptRanges bool
+	validator    string
+}
+
+// newPartialWriter returns a writer for the partial download of url to name
+// in out. If opts.Resume is set and out has a prefix that matches its
+// checkpoint, the writer continues after it; anything else in out is
+// discarded.
+func newPartialWriter(out *os.File, name string, url string, opts DownloadOptions) (*partialWriter, error) {
+	pw := &partialWriter{out: out, name: name, url: url, opts: opts}
+	if !opts.Resume {
+		return pw, nil
+	}
+
+	pw.h = sha256.New()
+
+	cp, err := readCheckpoint(name)
+	if err != nil || cp.Source != url || cp.Offset == 0 {
+		return pw, pw.reset()
+	}
+
+	_, err = io.CopyN(pw.h, out, cp.Offset)
+	if err != nil || hex.EncodeToString(pw.h.Sum(nil)) != cp.Digest {
+		netLog.Infof("partial download of %s doesn't match its checkpoint, starting over", url)
+		return pw, pw.reset()
+	}
+
+	// anything after the checkpoint wasn't verified, drop it
+	err = out.Truncate(cp.Offset)
+	if err != nil {
+		return nil, errors.Wrapf(err, "couldn't truncate %s", out.Name())
+	}
+	_, err = out.Seek(cp.Offset, io.SeekStart)
+	if err != nil {
+		return nil, errors.Wrapf(err, "couldn't seek %s", out.Name())
+	}
+
+	pw.offset = cp.Offset
+	pw.lastCheckpoint = cp.Offset
+	pw.validator = cp.Validator
+	// it was only checkpointed because the server said it could resume it
+	pw.acceptRanges = true
+	return pw, nil
+}
+
+func (pw *partialWriter) Write(p []byte) (int, error) {
+	n, err := pw.out.Write(p)
+	pw.offset += int64(n)
+	if pw.h == nil {
+		return n, err
+	}
+
+	pw.h.Write(p[:n])
+	if err == nil && pw.offset-pw.lastCheckpoint >= checkpointInterval {
+		err = pw.checkpoint()
+	}
+
+	return n, err
+}
+
+// reset discards everything downloaded so far.
+func (pw *partialWriter) reset() error {
+	err := pw.out.Truncate(0)
+	if err != nil {
+		return errors.Wrapf(err, "couldn't truncate %s", pw.out.Name())
+	}
+	_, err = pw.out.Seek(0, io.SeekStart)
+	if err != nil {
+		return errors.Wrapf(err, "couldn't seek %s", pw.out.Name())
+	}
+
+	pw.offset = 0
+	pw.lastCheckpoint = 0
+	pw.validator = ""
+	if pw.h != nil {
+		pw.h.Reset()
+		removeCheckpoint(pw.name)
+	}
+
+	return nil
+}
+
+func (pw *partialWriter) checkpoint() error {
+	content, err := json.Marshal(checkpoint{
+		Source:    pw.url,
+		Offset:    pw.offset,
+		Digest:    hex.EncodeToString(pw.h.Sum(nil)),
+		Validator: pw.validator,
+	})
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	f, err := createSidecar(pw.name, checkpointExt, pw.opts)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = f.Write(content)
+	if err != nil {
+		return errors.Wrapf(err, "couldn't checkpoint download of %s", pw.url)
+	}
+
+	pw.lastCheckpoint = pw.offset
+	return nil
+}
+
+// noteResponse records what resp, the server's answer to a request for the
+// file, says about resuming its download.
+func (pw *partialWriter) noteResponse(resp *http.Response) {
+	pw.acceptRanges = resp.Header.Get("Accept-Ranges") == "bytes" || resp.StatusCode == http.StatusPartialContent
+
+	pw.validator = resp.Header.Get("Last-Modified")
+	if etag := resp.Header.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		pw.validator = etag
+	}
+}
+
+// errorWithCheckpoint checkpoints a download that failed with err, so that it
+// can be resumed.
+func (pw *partialWriter) errorWithCheckpoint(err error) error {
+	cpErr := pw.checkpoint()
+	if cpErr != nil {
+		netLog.Warnf("couldn't save partial download of %s: %v", pw.url, cpErr)
+	}
+
+	return err
+}
+
+func readCheckpoint(name string) (checkpoint, error) {
+	cp := checkpoint{}
+
+	content, err := os.ReadFile(sidecarPath(name, checkpointExt))
+	if err != nil {
+		return cp, errors.WithStack(err)
+	}
+
+	err = json.Unmarshal(content, &cp)
+	return cp, errors.Wrapf(err, "couldn't parse checkpoint of %s", name)
+}
+
+func removeCheckpoint(name string) {
+	os.RemoveAll(sidecarPath(name, checkpointExt))
+}
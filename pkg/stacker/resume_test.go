@@ -0,0 +1,254 @@
+package stacker
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDownloadResumeAcceptRanges(t *testing.T) {
+	assert := assert.New(t)
+
+	ranges := false
+	var last *http.Request
+	srv := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		last = r
+		if ranges {
+			w.Header().Set("Accept-Ranges", "bytes")
+			w.Header().Set("ETag", `"v1"`)
+		}
+		if r.Header.Get("Range") == "bytes=5-" {
+			w.Header().Set("Content-Range", "bytes 5-10/11")
+			w.WriteHeader(http.StatusPartialContent)
+			w.Write([]byte(" world"))
+			return
+		}
+		if !strings.HasPrefix(r.URL.Path, "/die/") {
+			w.Write([]byte("hello world"))
+			return
+		}
+		w.Header().Set("Content-Length", "11")
+		w.Write([]byte("hello"))
+		hangUp(t, w)
+	})
+
+	dir := t.TempDir()
+	opts := DefaultOptions()
+	opts.Retries = 0
+	opts.Progress = false
+
+	// without Accept-Ranges, there is no point keeping what was downloaded
+	_, err := DownloadWithOptions(dir, srv.URL+"/die/foo", opts)
+	assert.Error(err)
+	assert.NoFileExists(sidecarPath(path.Join(dir, "foo"), partialExt))
+
+	ranges = true
+	_, err = DownloadWithOptions(dir, srv.URL+"/die/bar", opts)
+	assert.Error(err)
+	assert.FileExists(sidecarPath(path.Join(dir, "bar"), partialExt))
+
+	name, err := DownloadWithOptions(dir, srv.URL+"/die/bar", opts)
+	assert.NoError(err)
+	assert.Equal("bytes=5-", last.Header.Get("Range"))
+	assert.Equal(`"v1"`, last.Header.Get("If-Range"))
+
+	content, err := os.ReadFile(name)
+	assert.NoError(err)
+	assert.Equal("hello world", string(content))
+}
+
+func TestDownloadPartialContentWithoutRange(t *testing.T) {
+	assert := assert.New(t)
+
+	content := "hello world"
+	srv := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal("", r.Header.Get("Range"))
+		end := len(content) - 1
+		if r.URL.Path == "/part" {
+			end = 4
+		}
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes 0-%d/%d", end, len(content)))
+		w.WriteHeader(http.StatusPartialContent)
+		w.Write([]byte(content[:end+1]))
+	})
+
+	cacheDir := t.TempDir()
+	name, err := DownloadWithOptions(cacheDir, srv.URL+"/whole", DownloadOptions{})
+	assert.NoError(err)
+	got, err := os.ReadFile(name)
+	assert.NoError(err)
+	assert.Equal(content, string(got))
+
+	// a slice of the file is not the file
+	_, err = DownloadWithOptions(cacheDir, srv.URL+"/part", DownloadOptions{})
+	assert.ErrorContains(err, "206")
+	_, err = os.Stat(path.Join(cacheDir, "part"))
+	assert.True(os.IsNotExist(err))
+}
+
+// dyingServer serves content, with an ETag of version, but hangs up after its
+// first 5 bytes until die is cleared. Range requests are answered with a 206
+// while version is still what If-Range asks for, unless ignoreRange.
+type dyingServer struct {
+	content     string
+	version     string
+	die         bool
+	ignoreRange bool
+	last        *http.Request
+}
+
+func (s *dyingServer) start(t *testing.T) string {
+	srv := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		s.last = r
+		w.Header().Set("Accept-Ranges", "bytes")
+		w.Header().Set("ETag", s.version)
+
+		start := 0
+		if rng := r.Header.Get("Range"); rng != "" && !s.ignoreRange && r.Header.Get("If-Range") == s.version {
+			fmt.Sscanf(rng, "bytes=%d-", &start)
+		}
+		if start > 0 {
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, len(s.content)-1, len(s.content)))
+			w.WriteHeader(http.StatusPartialContent)
+			w.Write([]byte(s.content[start:]))
+			return
+		}
+
+		if !s.die {
+			w.Write([]byte(s.content))
+			return
+		}
+		w.Header().Set("Content-Length", fmt.Sprint(len(s.content)))
+		w.Write([]byte(s.content[:5]))
+		hangUp(t, w)
+	})
+	return srv.URL + "/file"
+}
+
+func resumeOptions() DownloadOptions {
+	opts := DefaultOptions()
+	opts.Retries = 0
+	opts.Progress = false
+	return opts
+}
+
+func TestDownloadResumeRangeIgnored(t *testing.T) {
+	assert := assert.New(t)
+
+	s := &dyingServer{content: "hello world", version: `"v1"`, die: true}
+	url := s.start(t)
+	dir := t.TempDir()
+
+	_, err := DownloadWithOptions(dir, url, resumeOptions())
+	assert.Error(err)
+
+	// a 200 to a range request is all of the file, not the rest of it
+	s.die = false
+	s.ignoreRange = true
+	name, err := DownloadWithOptions(dir, url, resumeOptions())
+	assert.NoError(err)
+	assert.Equal("bytes=5-", s.last.Header.Get("Range"))
+
+	content, err := os.ReadFile(name)
+	assert.NoError(err)
+	assert.Equal("hello world", string(content))
+}
+
+func TestDownloadResumeChangedValidator(t *testing.T) {
+	assert := assert.New(t)
+
+	s := &dyingServer{content: "hello world", version: `"v1"`, die: true}
+	url := s.start(t)
+	dir := t.TempDir()
+
+	_, err := DownloadWithOptions(dir, url, resumeOptions())
+	assert.Error(err)
+
+	// the file changed since, so what was downloaded of it is dropped
+	s.die = false
+	s.content = "HOWDY world"
+	s.version = `"v2"`
+	name, err := DownloadWithOptions(dir, url, resumeOptions())
+	assert.NoError(err)
+	assert.Equal(`"v1"`, s.last.Header.Get("If-Range"))
+
+	content, err := os.ReadFile(name)
+	assert.NoError(err)
+	assert.Equal("HOWDY world", string(content))
+	assert.NoFileExists(sidecarPath(name, checkpointExt))
+}
+
+func TestDownloadResumeTruncatedPartial(t *testing.T) {
+	assert := assert.New(t)
+
+	s := &dyingServer{content: "hello world", version: `"v1"`, die: true}
+	url := s.start(t)
+	dir := t.TempDir()
+
+	_, err := DownloadWithOptions(dir, url, resumeOptions())
+	assert.Error(err)
+
+	// a partial file shorter than its checkpoint can't be resumed
+	partial := sidecarPath(path.Join(dir, "file"), partialExt)
+	assert.NoError(os.Truncate(partial, 2))
+
+	s.die = false
+	name, err := DownloadWithOptions(dir, url, resumeOptions())
+	assert.NoError(err)
+	assert.Equal("", s.last.Header.Get("Range"))
+
+	content, err := os.ReadFile(name)
+	assert.NoError(err)
+	assert.Equal("hello world", string(content))
+}
+
+func TestPartialWriter(t *testing.T) {
+	assert := assert.New(t)
+
+	name := path.Join(t.TempDir(), "file")
+	url := "https://example.com/file"
+	opts := DownloadOptions{TransportOptions: TransportOptions{Resume: true}}
+	assert.NoError(os.MkdirAll(path.Join(path.Dir(name), metaDirName), 0755))
+	out, err := os.Create(sidecarPath(name, partialExt))
+	assert.NoError(err)
+	defer out.Close()
+
+	pw, err := newPartialWriter(out, name, url, opts)
+	assert.NoError(err)
+	_, err = pw.Write([]byte("hello"))
+	assert.NoError(err)
+	pw.validator = `"v1"`
+	assert.NoError(pw.checkpoint())
+
+	// bytes after the checkpoint weren't verified, and are dropped
+	_, err = pw.Write([]byte(" wor"))
+	assert.NoError(err)
+
+	_, err = out.Seek(0, io.SeekStart)
+	assert.NoError(err)
+	pw, err = newPartialWriter(out, name, url, opts)
+	assert.NoError(err)
+	assert.Equal(int64(5), pw.offset)
+	assert.Equal(`"v1"`, pw.validator)
+	assert.True(pw.acceptRanges)
+	fi, err := out.Stat()
+	assert.NoError(err)
+	assert.Equal(int64(5), fi.Size())
+
+	// nor is a checkpoint of another url
+	_, err = out.Seek(0, io.SeekStart)
+	assert.NoError(err)
+	pw, err = newPartialWriter(out, name, url+".other", opts)
+	assert.NoError(err)
+	assert.Equal(int64(0), pw.offset)
+	fi, err = out.Stat()
+	assert.NoError(err)
+	assert.Equal(int64(0), fi.Size())
+	assert.NoFileExists(sidecarPath(name, checkpointExt))
+}
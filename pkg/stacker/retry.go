@@ -0,0 +1,43 @@
+package stacker
+
+import (
+	"context"
+	"time"
+)
+
+// maxRetryBackoff caps how long a retry waits, however many attempts failed.
+const maxRetryBackoff = time.Minute
+
+// retryDelay returns how long to wait after attempt failed before trying
+// again: opts.RetryBackoff, doubled for every attempt after the first.
+func retryDelay(attempt int, opts DownloadOptions) time.Duration {
+	delay := opts.RetryBackoff
+	for i := 1; i < attempt && delay < maxRetryBackoff; i++ {
+		delay *= 2
+	}
+	return min(delay, maxRetryBackoff)
+}
+
+// waitToRetry waits out the retryDelay after attempt. It gives up early, with
+// an error, if ctx is done or the download's deadline passes first.
+func waitToRetry(ctx context.Context, attempt int, opts DownloadOptions) error {
+	delay := retryDelay(attempt, opts)
+	if delay <= 0 {
+		return nil
+	}
+
+	parent, cancel := downloadContext(opts)
+	defer cancel()
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-parent.Done():
+		return parent.Err()
+	}
+}
@@ -0,0 +1,104 @@
+package stacker
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDownloadRetryBackoff(t *testing.T) {
+	assert := assert.New(t)
+
+	var mu sync.Mutex
+	requests := map[string][]time.Time{}
+	srv := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		key := r.Method + " " + r.URL.Path
+		requests[key] = append(requests[key], time.Now())
+		n := len(requests[key])
+		mu.Unlock()
+
+		switch {
+		case r.URL.Path == "/missing":
+			w.WriteHeader(http.StatusNotFound)
+		case r.URL.Path == "/unavailable" || n < 3:
+			w.WriteHeader(http.StatusServiceUnavailable)
+		default:
+			w.Write([]byte("hello world"))
+		}
+	})
+
+	opts := DownloadOptions{RetryOptions: RetryOptions{Retries: 2, RetryBackoff: 50 * time.Millisecond}}
+	_, err := DownloadWithOptions(t.TempDir(), srv.URL+"/flaky", opts)
+	assert.NoError(err)
+
+	info, err := fileInfo(context.Background(), srv.URL+"/flaky-head", opts)
+	assert.NoError(err)
+	assert.EqualValues(11, info.Size)
+
+	mu.Lock()
+	for _, key := range []string{"GET /flaky", "HEAD /flaky-head"} {
+		times := requests[key]
+		if assert.Len(times, 3, key) {
+			assert.GreaterOrEqual(times[1].Sub(times[0]), 50*time.Millisecond, key)
+			assert.GreaterOrEqual(times[2].Sub(times[1]), 100*time.Millisecond, key)
+		}
+	}
+	mu.Unlock()
+
+	// only the configured statuses are retried
+	opts = DownloadOptions{RetryOptions: RetryOptions{Retries: 1, RetryStatusCodes: []int{http.StatusNotFound}}}
+	_, err = DownloadWithOptions(t.TempDir(), srv.URL+"/missing", opts)
+	assert.Error(err)
+	_, err = DownloadWithOptions(t.TempDir(), srv.URL+"/unavailable", opts)
+	assert.Error(err)
+	mu.Lock()
+	assert.Len(requests["GET /missing"], 2)
+	assert.Len(requests["GET /unavailable"], 1)
+	mu.Unlock()
+
+	assert.Equal(time.Duration(0), retryDelay(1, DownloadOptions{}))
+	assert.Equal(4*time.Second, retryDelay(3, DownloadOptions{RetryOptions: RetryOptions{RetryBackoff: time.Second}}))
+	assert.Equal(maxRetryBackoff, retryDelay(30, DownloadOptions{RetryOptions: RetryOptions{RetryBackoff: time.Second}}))
+}
+
+func TestDownloadShouldRetry(t *testing.T) {
+	assert := assert.New(t)
+
+	requests := 0
+	srv := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if requests%2 == 1 {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		w.Write([]byte("hello world"))
+	})
+
+	opts := DownloadOptions{RetryOptions: RetryOptions{Retries: 3}}
+	_, err := DownloadWithOptions(t.TempDir(), srv.URL+"/file", opts)
+	assert.ErrorContains(err, "403")
+	assert.Equal(1, requests)
+
+	opts.ShouldRetry = func(resp *http.Response, err error) bool {
+		return resp != nil && resp.StatusCode == http.StatusForbidden
+	}
+	requests = 0
+	_, err = DownloadWithOptions(t.TempDir(), srv.URL+"/file", opts)
+	assert.NoError(err)
+	assert.Equal(2, requests)
+
+	// bad artifacts are never retried
+	opts.ShouldRetry = func(*http.Response, error) bool { return true }
+	opts.ExpectedHash = strings.Repeat("0", 64)
+	requests = 1
+	_, err = DownloadWithOptions(t.TempDir(), srv.URL+"/file", opts)
+	assert.ErrorAs(err, new(*ChecksumMismatchError))
+	assert.Equal(2, requests)
+	assert.False(shouldRetry(err, opts))
+}
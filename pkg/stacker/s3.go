@@ -0,0 +1,275 @@
+package stacker
+
+import (
+	"bufio"
+	"context"
+	"crypto/hmac"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/minio/sha256-simd"
+	"github.com/pkg/errors"
+)
+
+// awsCredentials are what requests to S3 are signed with.
+type awsCredentials struct {
+	AccessKeyID     string    `json:"AccessKeyId"`
+	SecretAccessKey string    `json:"SecretAccessKey"`
+	SessionToken    string    `json:"Token"`
+	Expiration      time.Time `json:"Expiration"`
+}
+
+func s3Region() string {
+	for _, env := range []string{"AWS_REGION", "AWS_DEFAULT_REGION"} {
+		if region := os.Getenv(env); region != "" {
+			return region
+		}
+	}
+	return "us-east-1"
+}
+
+// s3Endpoint is the S3 compatible service (e.g. minio) to use instead of AWS,
+// if any. Buckets are then always addressed in the path.
+func s3Endpoint() string {
+	if endpoint := os.Getenv("AWS_ENDPOINT_URL_S3"); endpoint != "" {
+		return endpoint
+	}
+	return os.Getenv("AWS_ENDPOINT_URL")
+}
+
+// awsCredentialChain looks for AWS credentials in some of the places the AWS
+// SDKs do: in the environment, as static keys in the shared credentials file,
+// and from the ECS container or EC2 instance metadata services. Web identity
+// tokens, assumed roles, credential processes and SSO aren't supported. It
+// returns nil if there are none.
+func awsCredentialChain(ctx context.Context) (*awsCredentials, error) {
+	if id := os.Getenv("AWS_ACCESS_KEY_ID"); id != "" {
+		return &awsCredentials{
+			AccessKeyID:     id,
+			SecretAccessKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+			SessionToken:    os.Getenv("AWS_SESSION_TOKEN"),
+		}, nil
+	}
+
+	creds, err := sharedAWSCredentials()
+	if err != nil || creds != nil {
+		return creds, err
+	}
+
+	cloudCredentials.Lock()
+	cached := cloudCredentials.aws
+	cloudCredentials.Unlock()
+	if cached != nil && time.Until(cached.Expiration) > 5*time.Minute {
+		return cached, nil
+	}
+
+	creds, err = awsMetadataCredentials(ctx)
+	if err != nil || creds == nil {
+		return nil, err
+	}
+
+	cloudCredentials.Lock()
+	cloudCredentials.aws = creds
+	cloudCredentials.Unlock()
+	return creds, nil
+}
+
+// sharedAWSCredentials reads the credentials of $AWS_PROFILE (or the default
+// profile) from $AWS_SHARED_CREDENTIALS_FILE, or ~/.aws/credentials.
+func sharedAWSCredentials() (*awsCredentials, error) {
+	file := os.Getenv("AWS_SHARED_CREDENTIALS_FILE")
+	if file == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return nil, nil
+		}
+		file = path.Join(home, ".aws", "credentials")
+	}
+
+	profile := os.Getenv("AWS_PROFILE")
+	if profile == "" {
+		profile = "default"
+	}
+
+	f, err := os.Open(file)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, errors.WithStack(err)
+	}
+	defer f.Close()
+
+	creds := awsCredentials{}
+	section := ""
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			section = strings.TrimSpace(line[1 : len(line)-1])
+			continue
+		}
+
+		k, v, ok := strings.Cut(line, "=")
+		if !ok || section != profile {
+			continue
+		}
+
+		switch strings.TrimSpace(k) {
+		case "aws_access_key_id":
+			creds.AccessKeyID = strings.TrimSpace(v)
+		case "aws_secret_access_key":
+			creds.SecretAccessKey = strings.TrimSpace(v)
+		case "aws_session_token":
+			creds.SessionToken = strings.TrimSpace(v)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, errors.Wrapf(err, "couldn't read %s", file)
+	}
+
+	if creds.AccessKeyID == "" {
+		return nil, nil
+	}
+
+	netLog.Debugf("using the AWS credentials of profile %s in %s", profile, file)
+	return &creds, nil
+}
+
+// awsMetadataCredentials gets the credentials of the ECS task, or else of the
+// EC2 instance's role (with IMDSv2).
+func awsMetadataCredentials(ctx context.Context) (*awsCredentials, error) {
+	var content []byte
+	var err error
+
+	if uri := os.Getenv("AWS_CONTAINER_CREDENTIALS_RELATIVE_URI"); uri != "" {
+		content, err = metadataRequest(ctx, http.MethodGet, "http://169.254.170.2", uri, nil)
+	} else if os.Getenv("AWS_EC2_METADATA_DISABLED") != "true" {
+		content, err = ec2RoleCredentials(ctx)
+	}
+	if err != nil || content == nil {
+		return nil, err
+	}
+
+	creds := awsCredentials{}
+	err = json.Unmarshal(content, &creds)
+	if err != nil {
+		return nil, errors.Wrapf(err, "couldn't parse AWS credentials from the metadata service")
+	}
+
+	netLog.Debugf("using the AWS credentials from the metadata service, until %s", creds.Expiration)
+	return &creds, nil
+}
+
+func ec2RoleCredentials(ctx context.Context) ([]byte, error) {
+	imds := os.Getenv("AWS_EC2_METADATA_SERVICE_ENDPOINT")
+	if imds == "" {
+		imds = "http://169.254.169.254"
+	}
+	imds = strings.TrimSuffix(imds, "/")
+
+	token, err := metadataRequest(ctx, http.MethodPut, imds, "/latest/api/token",
+		http.Header{"X-Aws-Ec2-Metadata-Token-Ttl-Seconds": []string{"21600"}})
+	if err != nil || token == nil {
+		return nil, err
+	}
+
+	header := http.Header{"X-Aws-Ec2-Metadata-Token": []string{string(token)}}
+	role, err := metadataRequest(ctx, http.MethodGet, imds, "/latest/meta-data/iam/security-credentials/", header)
+	if err != nil || role == nil {
+		return nil, err
+	}
+
+	name, _, _ := strings.Cut(strings.TrimSpace(string(role)), "\n")
+	return metadataRequest(ctx, http.MethodGet, imds, "/latest/meta-data/iam/security-credentials/"+name, header)
+}
+
+// signV4 signs req for S3 in region with AWS Signature Version 4. The host,
+// the Range and all the X-Amz-* headers are signed; the payload isn't, unless
+// req already has its X-Amz-Content-Sha256.
+func signV4(req *http.Request, creds awsCredentials, region string, now time.Time) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	day := amzDate[:8]
+
+	payload := req.Header.Get("X-Amz-Content-Sha256")
+	if payload == "" {
+		payload = "UNSIGNED-PAYLOAD"
+		req.Header.Set("X-Amz-Content-Sha256", payload)
+	}
+	req.Header.Set("X-Amz-Date", amzDate)
+	if creds.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", creds.SessionToken)
+	}
+
+	host := req.Host
+	if host == "" {
+		host = req.URL.Host
+	}
+	headers := map[string]string{"host": host}
+	for k, v := range req.Header {
+		lower := strings.ToLower(k)
+		if lower == "range" || strings.HasPrefix(lower, "x-amz-") {
+			headers[lower] = strings.TrimSpace(strings.Join(v, ","))
+		}
+	}
+
+	names := make([]string, 0, len(headers))
+	for k := range headers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+
+	canonicalHeaders := ""
+	for _, k := range names {
+		canonicalHeaders += k + ":" + headers[k] + "\n"
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	// S3 wants everything but the unreserved characters escaped; send the
+	// path exactly as it was signed
+	req.URL.RawPath = awsEscapePath(req.URL.Path)
+	query := strings.ReplaceAll(req.URL.Query().Encode(), "+", "%20")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method, req.URL.RawPath, query, canonicalHeaders, signedHeaders, payload,
+	}, "\n")
+
+	scope := day + "/" + region + "/s3/aws4_request"
+	hashed := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(hashed[:])
+
+	key := []byte("AWS4" + creds.SecretAccessKey)
+	for _, part := range []string{day, region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		creds.AccessKeyID, scope, signedHeaders, signature))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+func awsEscapePath(p string) string {
+	escaped := strings.Builder{}
+	for i := 0; i < len(p); i++ {
+		c := p[i]
+		if ('A' <= c && c <= 'Z') || ('a' <= c && c <= 'z') || ('0' <= c && c <= '9') || strings.IndexByte("-_.~/", c) >= 0 {
+			escaped.WriteByte(c)
+		} else {
+			fmt.Fprintf(&escaped, "%%%02X", c)
+		}
+	}
+	return escaped.String()
+}
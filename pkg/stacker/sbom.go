@@ -0,0 +1,472 @@
+package stacker
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	cdx "github.com/CycloneDX/cyclonedx-go"
+	rpmdb "github.com/knqyf263/go-rpmdb/pkg"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/opencontainers/umoci/oci/casext"
+	"github.com/pkg/errors"
+	"sigs.k8s.io/bom/pkg/serialize"
+	"sigs.k8s.io/bom/pkg/spdx"
+	"stackerbuild.io/stacker/pkg/container"
+	"stackerbuild.io/stacker/pkg/lib"
+	"stackerbuild.io/stacker/pkg/types"
+)
+
+const (
+	SBOMFormatSPDX      = "spdx"
+	SBOMFormatCycloneDX = "cyclonedx"
+
+	artifactTypeCycloneDX = "application/vnd.cyclonedx+json"
+)
+
+// SBOMMediaType returns the media type of SBOMs in format, or an error if
+// stacker can't generate them.
+func SBOMMediaType(format string) (string, error) {
+	switch format {
+	case SBOMFormatSPDX:
+		return artifactTypeSPDX, nil
+	case SBOMFormatCycloneDX:
+		return artifactTypeCycloneDX, nil
+	default:
+		return "", errors.Errorf("unknown sbom format %q, expected %s or %s", format, SBOMFormatSPDX, SBOMFormatCycloneDX)
+	}
+}
+
+// InstalledPackage is a package a distro's package manager installed.
+type InstalledPackage struct {
+	// Type is the package manager's: deb, rpm or apk.
+	Type    string `json:"type"`
+	Distro  string `json:"distro,omitempty"`
+	Name    string `json:"name"`
+	Version string `json:"version"`
+	Arch    string `json:"arch,omitempty"`
+	License string `json:"license,omitempty"`
+}
+
+// PURL is the package url of p, e.g. pkg:deb/debian/bash@5.2-2?arch=amd64.
+func (p InstalledPackage) PURL() string {
+	purl := "pkg:" + p.Type + "/"
+	if p.Distro != "" {
+		purl += url.PathEscape(p.Distro) + "/"
+	}
+	purl += url.PathEscape(p.Name) + "@" + url.PathEscape(p.Version)
+	if p.Arch != "" {
+		purl += "?arch=" + url.QueryEscape(p.Arch)
+	}
+	return purl
+}
+
+// ScanInstalledPackages returns the packages in the dpkg, rpm and apk
+// databases of the filesystem at root.
+func ScanInstalledPackages(root string) ([]InstalledPackage, error) {
+	distro := osReleaseID(root)
+
+	pkgs, err := scanDpkg(path.Join(root, "var/lib/dpkg/status"), distro)
+	if err != nil {
+		return nil, err
+	}
+
+	apks, err := scanApk(path.Join(root, "lib/apk/db/installed"), distro)
+	if err != nil {
+		return nil, err
+	}
+	pkgs = append(pkgs, apks...)
+
+	rpms, err := scanRpm(root, distro)
+	if err != nil {
+		return nil, err
+	}
+	pkgs = append(pkgs, rpms...)
+
+	sort.Slice(pkgs, func(i, j int) bool {
+		if pkgs[i].Type != pkgs[j].Type {
+			return pkgs[i].Type < pkgs[j].Type
+		}
+		return pkgs[i].Name < pkgs[j].Name
+	})
+	return pkgs, nil
+}
+
+// osReleaseID is the ID in root's os-release, e.g. debian, or "" if there
+// is none.
+func osReleaseID(root string) string {
+	for _, p := range []string{"etc/os-release", "usr/lib/os-release"} {
+		content, err := os.ReadFile(path.Join(root, p))
+		if err != nil {
+			continue
+		}
+
+		for _, line := range strings.Split(string(content), "\n") {
+			if id, ok := strings.CutPrefix(line, "ID="); ok {
+				return strings.Trim(id, `"'`)
+			}
+		}
+	}
+
+	return ""
+}
+
+// scanStanzas calls stanza with the fields of each of the blank line
+// separated stanzas of the file at p, split at sep. Lines that don't
+// have sep (e.g. continuation lines) are skipped.
+func scanStanzas(p string, sep string, stanza func(fields map[string]string)) error {
+	f, err := os.Open(p)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return errors.Wrapf(err, "couldn't open %s", p)
+	}
+	defer f.Close()
+
+	fields := map[string]string{}
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" {
+			if len(fields) > 0 {
+				stanza(fields)
+			}
+			fields = map[string]string{}
+			continue
+		}
+
+		key, value, ok := strings.Cut(line, sep)
+		if ok && !strings.HasPrefix(line, " ") {
+			fields[key] = strings.TrimSpace(value)
+		}
+	}
+	if len(fields) > 0 {
+		stanza(fields)
+	}
+
+	return errors.Wrapf(scanner.Err(), "couldn't read %s", p)
+}
+
+func scanDpkg(status string, distro string) ([]InstalledPackage, error) {
+	pkgs := []InstalledPackage{}
+	err := scanStanzas(status, ":", func(fields map[string]string) {
+		if !strings.HasSuffix(fields["Status"], " installed") {
+			return
+		}
+		pkgs = append(pkgs, InstalledPackage{
+			Type:    "deb",
+			Distro:  distro,
+			Name:    fields["Package"],
+			Version: fields["Version"],
+			Arch:    fields["Architecture"],
+		})
+	})
+	return pkgs, err
+}
+
+func scanApk(installed string, distro string) ([]InstalledPackage, error) {
+	pkgs := []InstalledPackage{}
+	err := scanStanzas(installed, ":", func(fields map[string]string) {
+		if fields["P"] == "" {
+			return
+		}
+		pkgs = append(pkgs, InstalledPackage{
+			Type:    "apk",
+			Distro:  distro,
+			Name:    fields["P"],
+			Version: fields["V"],
+			Arch:    fields["A"],
+			License: fields["L"],
+		})
+	})
+	return pkgs, err
+}
+
+func scanRpm(root string, distro string) ([]InstalledPackage, error) {
+	for _, p := range []string{"var/lib/rpm/rpmdb.sqlite", "usr/lib/sysimage/rpm/rpmdb.sqlite", "var/lib/rpm/Packages"} {
+		dbPath := path.Join(root, p)
+		if _, err := os.Stat(dbPath); err != nil {
+			continue
+		}
+
+		db, err := rpmdb.Open(dbPath)
+		if err != nil {
+			return nil, errors.Wrapf(err, "couldn't open %s", dbPath)
+		}
+
+		infos, err := db.ListPackages()
+		if err != nil {
+			return nil, errors.Wrapf(err, "couldn't read %s", dbPath)
+		}
+
+		pkgs := []InstalledPackage{}
+		for _, info := range infos {
+			version := info.Version + "-" + info.Release
+			if info.Epoch != nil && *info.Epoch != 0 {
+				version = fmt.Sprintf("%d:%s", *info.Epoch, version)
+			}
+			pkgs = append(pkgs, InstalledPackage{
+				Type:    "rpm",
+				Distro:  distro,
+				Name:    info.Name,
+				Version: version,
+				Arch:    info.Arch,
+				License: info.License,
+			})
+		}
+		return pkgs, nil
+	}
+
+	return nil, nil
+}
+
+// sbomImport is an import of a layer as its SBOM records it.
+type sbomImport struct {
+	Path string
+	// Digest is of the file that was imported, or empty for
+	// directories.
+	Digest string
+}
+
+// layerImports are the imports of l as they were imported for name.
+func layerImports(config types.StackerConfig, name string, l types.Layer) ([]sbomImport, error) {
+	imports := []sbomImport{}
+	for _, imp := range l.Imports {
+		si := sbomImport{Path: imp.Path}
+
+		diskPath := path.Join(config.StackerDir, "imports", name, importBaseName(imp.Path))
+		st, err := os.Stat(diskPath)
+		if err == nil && !st.IsDir() {
+			si.Digest, err = lib.HashFile(diskPath, false)
+			if err != nil {
+				return nil, err
+			}
+		} else if imp.Hash != "" {
+			si.Digest = "sha256:" + strings.ToLower(imp.Hash)
+		}
+
+		imports = append(imports, si)
+	}
+
+	return imports, nil
+}
+
+// renderSBOM renders the SBOM of the layer name in format.
+func renderSBOM(format string, name string, pkgs []InstalledPackage, imports []sbomImport) ([]byte, error) {
+	switch format {
+	case SBOMFormatSPDX:
+		return renderSPDX(name, pkgs, imports)
+	case SBOMFormatCycloneDX:
+		return renderCycloneDX(name, pkgs, imports)
+	default:
+		_, err := SBOMMediaType(format)
+		return nil, err
+	}
+}
+
+func renderSPDX(name string, pkgs []InstalledPackage, imports []sbomImport) ([]byte, error) {
+	doc := spdx.NewDocument()
+	doc.Name = name
+	doc.Namespace = fmt.Sprintf("https://stackerbuild.io/spdx/%s-%d", url.PathEscape(name), time.Now().UnixNano())
+
+	for _, p := range pkgs {
+		sp := spdx.NewPackage()
+		sp.Name = p.Name
+		sp.Version = p.Version
+		sp.DownloadLocation = spdx.NONE
+		sp.LicenseDeclared = p.License
+		sp.ExternalRefs = []spdx.ExternalRef{{
+			Category: "PACKAGE-MANAGER",
+			Type:     "purl",
+			Locator:  p.PURL(),
+		}}
+		err := doc.AddPackage(sp)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for _, imp := range imports {
+		sp := spdx.NewPackage()
+		sp.Name = imp.Path
+		sp.DownloadLocation = imp.Path
+		if algorithm, hex, ok := strings.Cut(imp.Digest, ":"); ok {
+			sp.Checksum = map[string]string{strings.ToUpper(algorithm): hex}
+		}
+		sp.Comment = "imported by stacker"
+		err := doc.AddPackage(sp)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	content, err := (&serialize.JSON{}).Serialize(doc)
+	if err != nil {
+		return nil, err
+	}
+	return []byte(content), nil
+}
+
+func renderCycloneDX(name string, pkgs []InstalledPackage, imports []sbomImport) ([]byte, error) {
+	bom := cdx.NewBOM()
+	bom.Metadata = &cdx.Metadata{
+		Timestamp: time.Now().UTC().Format(time.RFC3339),
+		Tools:     &[]cdx.Tool{{Name: "stacker", Version: lib.StackerVersion}},
+		Component: &cdx.Component{Type: cdx.ComponentTypeContainer, Name: name},
+	}
+
+	components := []cdx.Component{}
+	for _, p := range pkgs {
+		c := cdx.Component{
+			BOMRef:     p.PURL(),
+			Type:       cdx.ComponentTypeLibrary,
+			Name:       p.Name,
+			Version:    p.Version,
+			PackageURL: p.PURL(),
+		}
+		if p.License != "" {
+			c.Licenses = &cdx.Licenses{{License: &cdx.License{Name: p.License}}}
+		}
+		components = append(components, c)
+	}
+
+	for _, imp := range imports {
+		c := cdx.Component{
+			BOMRef: imp.Path,
+			Type:   cdx.ComponentTypeFile,
+			Name:   imp.Path,
+			ExternalReferences: &[]cdx.ExternalReference{{
+				Type: cdx.ERTypeDistribution,
+				URL:  imp.Path,
+			}},
+		}
+		if hex, ok := strings.CutPrefix(imp.Digest, "sha256:"); ok {
+			c.Hashes = &[]cdx.Hash{{Algorithm: cdx.HashAlgoSHA256, Value: hex}}
+		}
+		components = append(components, c)
+	}
+	bom.Components = &components
+
+	buf := &bytes.Buffer{}
+	err := cdx.NewBOMEncoder(buf, cdx.BOMFileFormatJSON).SetPretty(true).Encode(bom)
+	if err != nil {
+		return nil, errors.Wrapf(err, "couldn't render the sbom")
+	}
+	return buf.Bytes(), nil
+}
+
+// scanLayerPackages returns the packages installed in the rootfs of name,
+// which is scanned from inside a container of it.
+func scanLayerPackages(config types.StackerConfig, storage types.Storage, name string) ([]InstalledPackage, error) {
+	snap, cleanup, err := storage.TemporaryWritableSnapshot(name)
+	if err != nil {
+		return nil, err
+	}
+	defer cleanup()
+
+	c, err := container.New(config, snap)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+
+	err = SetupBuildContainerConfig(config, storage, c, types.InternalStackerDir, snap)
+	if err != nil {
+		return nil, err
+	}
+
+	outDir, err := os.MkdirTemp(config.StackerDir, "sbom-")
+	if err != nil {
+		return nil, errors.Wrapf(err, "couldn't create sbom dir")
+	}
+	defer os.RemoveAll(outDir)
+
+	inDir := filepath.Join(types.InternalStackerDir, "sbom")
+	err = c.BindMount(outDir, inDir, "")
+	if err != nil {
+		return nil, err
+	}
+
+	cmd := []string{filepath.Join(types.InternalStackerDir, types.BinStacker), "internal-go", "scan-packages", filepath.Join(inDir, "packages.json")}
+	err = c.Execute(cmd, nil)
+	if err != nil {
+		return nil, errors.Wrapf(err, "couldn't scan the packages of %s", name)
+	}
+
+	content, err := os.ReadFile(path.Join(outDir, "packages.json"))
+	if err != nil {
+		return nil, errors.Wrapf(err, "couldn't read the packages of %s", name)
+	}
+
+	pkgs := []InstalledPackage{}
+	err = json.Unmarshal(content, &pkgs)
+	if err != nil {
+		return nil, errors.Wrapf(err, "couldn't parse the packages of %s", name)
+	}
+
+	return pkgs, nil
+}
+
+// sbomTag is the tag of the SBOM of the image tagged layerName in an OCI
+// layout.
+func sbomTag(layerName string) string {
+	return attachedTag(layerName, "sbom")
+}
+
+// attachSBOMs generates the SBOM of the layer name that was built with pkgs
+// installed, and adds it to oci for each of its manifests.
+func attachSBOMs(config types.StackerConfig, oci casext.Engine, format string, l types.Layer, name string,
+	pkgs []InstalledPackage, manifests map[types.LayerType]ispec.Descriptor,
+) error {
+	mediaType, err := SBOMMediaType(format)
+	if err != nil {
+		return err
+	}
+
+	imports, err := layerImports(config, name, l)
+	if err != nil {
+		return err
+	}
+
+	sbom, err := renderSBOM(format, name, pkgs, imports)
+	if err != nil {
+		return err
+	}
+
+	for layerType, desc := range manifests {
+		err = writeAttached(oci, sbomTag(layerType.LayerName(name)), desc, mediaType, sbom)
+		if err != nil {
+			return errors.Wrapf(err, "couldn't add the sbom of %s", name)
+		}
+	}
+
+	return nil
+}
+
+// hasSBOM returns true if the image subject tagged layerName in oci has an
+// SBOM in format.
+func hasSBOM(oci casext.Engine, layerName string, subject ispec.Descriptor, format string) (bool, error) {
+	mediaType, err := SBOMMediaType(format)
+	if err != nil {
+		return false, err
+	}
+
+	_, ok, err := readAttached(oci, sbomTag(layerName), subject, mediaType)
+	return ok, err
+}
+
+// findSBOM returns the manifest of the SBOM of the image tagged layerName in
+// oci, in whichever format it was generated.
+func findSBOM(oci casext.Engine, layerName string) (*ispec.Manifest, bool, error) {
+	return findAttached(oci, layerName, sbomTag(layerName), artifactTypeSPDX, artifactTypeCycloneDX)
+}
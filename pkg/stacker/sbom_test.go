@@ -0,0 +1,130 @@
+package stacker
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+	"github.com/opencontainers/umoci"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestScanInstalledPackages(t *testing.T) {
+	assert := assert.New(t)
+
+	root := t.TempDir()
+	files := map[string]string{
+		"etc/os-release": "NAME=\"Debian GNU/Linux\"\nID=debian\n",
+		"var/lib/dpkg/status": `Package: bash
+Status: install ok installed
+Architecture: amd64
+Version: 5.2.15-2
+Description: GNU Bourne Again SHell
+ Bash is an sh-compatible command language interpreter.
+
+Package: removed
+Status: deinstall ok config-files
+Architecture: amd64
+Version: 1.0
+`,
+		"lib/apk/db/installed": `C:Q1abc=
+P:musl
+V:1.2.4-r2
+A:x86_64
+L:MIT
+
+P:busybox
+V:1.36.1-r5
+A:x86_64
+L:GPL-2.0-only
+`,
+	}
+	for name, content := range files {
+		assert.NoError(os.MkdirAll(path.Dir(path.Join(root, name)), 0755))
+		assert.NoError(os.WriteFile(path.Join(root, name), []byte(content), 0644))
+	}
+
+	pkgs, err := ScanInstalledPackages(root)
+	assert.NoError(err)
+	assert.Equal([]InstalledPackage{
+		{Type: "apk", Distro: "debian", Name: "busybox", Version: "1.36.1-r5", Arch: "x86_64", License: "GPL-2.0-only"},
+		{Type: "apk", Distro: "debian", Name: "musl", Version: "1.2.4-r2", Arch: "x86_64", License: "MIT"},
+		{Type: "deb", Distro: "debian", Name: "bash", Version: "5.2.15-2", Arch: "amd64"},
+	}, pkgs)
+
+	assert.Equal("pkg:deb/debian/bash@5.2.15-2?arch=amd64", pkgs[2].PURL())
+
+	// nothing is installed in an empty rootfs
+	pkgs, err = ScanInstalledPackages(t.TempDir())
+	assert.NoError(err)
+	assert.Empty(pkgs)
+}
+
+func TestRenderSBOM(t *testing.T) {
+	assert := assert.New(t)
+
+	pkgs := []InstalledPackage{{Type: "deb", Distro: "debian", Name: "bash", Version: "5.2.15-2", Arch: "amd64"}}
+	imports := []sbomImport{{Path: "https://example.com/foo.tar.gz", Digest: "sha256:0123abcd"}}
+
+	for _, format := range []string{SBOMFormatSPDX, SBOMFormatCycloneDX} {
+		content, err := renderSBOM(format, "foo", pkgs, imports)
+		assert.NoError(err, format)
+		assert.True(json.Valid(content), format)
+		assert.Contains(string(content), "pkg:deb/debian/bash@5.2.15-2?arch=amd64", format)
+		assert.Contains(string(content), "https://example.com/foo.tar.gz", format)
+		assert.Contains(string(content), "0123abcd", format)
+	}
+
+	_, err := renderSBOM("swid", "foo", pkgs, imports)
+	assert.Error(err)
+}
+
+func TestWriteSBOM(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+
+	oci, err := umoci.CreateLayout(path.Join(t.TempDir(), "oci"))
+	assert.NoError(err)
+	defer oci.Close()
+	assert.NoError(umoci.NewImage(oci, "foo"))
+	descPaths, err := oci.ResolveReference(ctx, "foo")
+	assert.NoError(err)
+	subject := descPaths[0].Descriptor()
+
+	ok, err := hasSBOM(oci, "foo", subject, SBOMFormatSPDX)
+	assert.NoError(err)
+	assert.False(ok)
+
+	mediaType, err := SBOMMediaType(SBOMFormatCycloneDX)
+	assert.NoError(err)
+	assert.NoError(writeAttached(oci, sbomTag("foo"), subject, mediaType, []byte(`{"bomFormat": "CycloneDX"}`)))
+
+	// it only counts in the format it was generated in
+	ok, err = hasSBOM(oci, "foo", subject, SBOMFormatSPDX)
+	assert.NoError(err)
+	assert.False(ok)
+	ok, err = hasSBOM(oci, "foo", subject, SBOMFormatCycloneDX)
+	assert.NoError(err)
+	assert.True(ok)
+
+	manifest, ok, err := findSBOM(oci, "foo")
+	assert.NoError(err)
+	assert.True(ok)
+	assert.Equal(subject.Digest, manifest.Subject.Digest)
+
+	file, err := extractAttached(oci, manifest, t.TempDir())
+	assert.NoError(err)
+	content, err := os.ReadFile(file)
+	assert.NoError(err)
+	assert.Equal(`{"bomFormat": "CycloneDX"}`, string(content))
+
+	// nor once the image it was generated of is rebuilt
+	rebuilt := subject
+	rebuilt.Digest = digest.FromString("rebuilt")
+	ok, err = hasSBOM(oci, "foo", rebuilt, SBOMFormatCycloneDX)
+	assert.NoError(err)
+	assert.False(ok)
+}
@@ -0,0 +1,85 @@
+package stacker
+
+import (
+	"github.com/pkg/errors"
+)
+
+// scheduleLayers builds the layers in order, which is a dependency order of
+// them, with build. Up to jobs layers are built at once: a layer is started as
+// soon as all of its deps are built, earlier layers in order first. Once a
+// layer failed nothing else is started, and the first error is returned when
+// the layers already being built are done.
+func scheduleLayers(order []string, deps map[string][]string, jobs int, build func(name string) error) error {
+	if jobs <= 1 {
+		for _, name := range order {
+			err := build(name)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	type result struct {
+		name string
+		err  error
+	}
+
+	built := map[string]bool{}
+	started := map[string]bool{}
+	results := make(chan result)
+	running := 0
+	var firstErr error
+
+	ready := func(name string) bool {
+		for _, dep := range deps[name] {
+			if !built[dep] {
+				return false
+			}
+		}
+		return true
+	}
+
+	for {
+		if firstErr == nil {
+			for _, name := range order {
+				if running == jobs {
+					break
+				}
+				if started[name] || !ready(name) {
+					continue
+				}
+
+				started[name] = true
+				running++
+				go func(name string) {
+					results <- result{name, build(name)}
+				}(name)
+			}
+		}
+
+		if running == 0 {
+			break
+		}
+
+		r := <-results
+		running--
+		if r.err != nil {
+			if firstErr == nil {
+				firstErr = r.err
+			}
+			continue
+		}
+		built[r.name] = true
+	}
+
+	if firstErr != nil {
+		return firstErr
+	}
+
+	if len(built) != len(order) {
+		return errors.Errorf("couldn't build %d of %d layers, their dependencies were never built", len(order)-len(built), len(order))
+	}
+
+	return nil
+}
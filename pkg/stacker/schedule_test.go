@@ -0,0 +1,61 @@
+package stacker
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestScheduleLayers(t *testing.T) {
+	assert := assert.New(t)
+
+	order := []string{"a", "c", "b", "d", "e"}
+	deps := map[string][]string{"b": {"a"}, "d": {"b", "c"}}
+
+	for jobs, expected := range map[int]int{1: 1, 2: 2, 8: 3} {
+		var mu sync.Mutex
+		built := []string{}
+		inFlight, most := 0, 0
+
+		err := scheduleLayers(order, deps, jobs, func(name string) error {
+			mu.Lock()
+			for _, dep := range deps[name] {
+				assert.Contains(built, dep, "%s started before %s was built", name, dep)
+			}
+			inFlight++
+			most = max(most, inFlight)
+			mu.Unlock()
+
+			time.Sleep(20 * time.Millisecond)
+
+			mu.Lock()
+			inFlight--
+			built = append(built, name)
+			mu.Unlock()
+			return nil
+		})
+		assert.NoError(err)
+		assert.ElementsMatch(order, built)
+		assert.Equal(expected, most, "jobs %d", jobs)
+	}
+
+	// nothing that depends on a failed layer is built, nor anything
+	// that wasn't started yet
+	var mu sync.Mutex
+	built := []string{}
+	err := scheduleLayers(order, deps, 2, func(name string) error {
+		if name == "a" {
+			return fmt.Errorf("a failed")
+		}
+		time.Sleep(20 * time.Millisecond)
+		mu.Lock()
+		built = append(built, name)
+		mu.Unlock()
+		return nil
+	})
+	assert.EqualError(err, "a failed")
+	assert.Equal([]string{"c"}, built)
+}
@@ -0,0 +1,151 @@
+package stacker
+
+import (
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+	"stackerbuild.io/stacker/pkg/container"
+	"stackerbuild.io/stacker/pkg/log"
+	"stackerbuild.io/stacker/pkg/types"
+)
+
+// mountpoints are the mountpoints (and their parents) that the build
+// container of a layer creates in upperDir, where what the run section
+// changes ends up, which weren't in it before, and so are removed from it
+// once the run section ran.
+type mountpoints struct {
+	upperDir string
+	created  []string
+}
+
+// layerSecrets are the secrets of a layer as they are set up in its build
+// container.
+type layerSecrets struct {
+	mountpoints
+
+	// dir holds the secrets that don't come from a file on the host
+	// while they are mounted.
+	dir string
+}
+
+// setupSecrets mounts secrets into c, or exposes them in its environment, for
+// the run section of the layer name.
+func setupSecrets(config types.StackerConfig, c *container.Container, s types.Storage, name string, secrets types.Secrets) (*layerSecrets, error) {
+	ls := &layerSecrets{mountpoints: mountpoints{upperDir: s.TarExtractLocation(name)}}
+
+	for _, secret := range secrets {
+		value, err := secret.Value()
+		if err != nil {
+			ls.Cleanup()
+			return nil, err
+		}
+
+		target := secret.MountPath()
+		if target == "" {
+			err = c.SetSecretEnv(secret.Env, string(value))
+			if err != nil {
+				ls.Cleanup()
+				return nil, err
+			}
+			continue
+		}
+
+		source := secret.Source
+		if source == "" {
+			source, err = ls.write(config, secret.ID, value)
+			if err != nil {
+				ls.Cleanup()
+				return nil, err
+			}
+		}
+
+		ls.record(target)
+		err = c.BindMount(source, target, "ro")
+		if err != nil {
+			ls.Cleanup()
+			return nil, err
+		}
+		log.Debugf("mounting secret %s at %s", secret.ID, target)
+	}
+
+	return ls, nil
+}
+
+// write puts value in a file only the user stacker runs as can read, which
+// is removed by Cleanup.
+func (ls *layerSecrets) write(config types.StackerConfig, id string, value []byte) (string, error) {
+	if ls.dir == "" {
+		dir, err := os.MkdirTemp(config.StackerDir, "secrets-")
+		if err != nil {
+			return "", errors.Wrapf(err, "couldn't create secrets dir")
+		}
+		ls.dir = dir
+	}
+
+	p := path.Join(ls.dir, id)
+	err := os.WriteFile(p, value, 0400)
+	if err != nil {
+		return "", errors.Wrapf(err, "couldn't write secret %s", id)
+	}
+	return p, nil
+}
+
+// record records which of target and its parents the build container will
+// create to mount something at target, since they aren't in upperDir yet.
+func (m *mountpoints) record(target string) {
+	for p := target; p != "/" && p != "."; p = path.Dir(p) {
+		_, err := os.Lstat(filepath.Join(m.upperDir, p))
+		if err == nil {
+			return
+		}
+		if !slices.Contains(m.created, p) {
+			m.created = append(m.created, p)
+		}
+	}
+}
+
+// remove removes the mountpoints that were created from upperDir, so nothing
+// of them is in the layer's diff; what is the kind of thing mounted on them,
+// for errors.
+func (m *mountpoints) remove(what string) error {
+	var result error
+
+	// deepest first, so that parents are empty by the time they are
+	// removed, unless the run section put something else in them
+	sort.Slice(m.created, func(i, j int) bool {
+		return strings.Count(m.created[i], "/") > strings.Count(m.created[j], "/")
+	})
+	for _, p := range m.created {
+		err := os.Remove(filepath.Join(m.upperDir, p))
+		if err == nil || os.IsNotExist(err) || errors.Is(err, unix.ENOTEMPTY) {
+			continue
+		}
+		result = errors.Wrapf(err, "couldn't remove the mountpoint of a %s at %s", what, p)
+	}
+	m.created = nil
+
+	return result
+}
+
+// Cleanup removes the mountpoints of the secrets from the layer, so nothing
+// of them is in its diff, and the secrets that were written for mounting
+// them.
+func (ls *layerSecrets) Cleanup() error {
+	result := ls.remove("secret")
+
+	if ls.dir != "" {
+		err := os.RemoveAll(ls.dir)
+		if err != nil {
+			result = errors.Wrapf(err, "couldn't remove secrets")
+		}
+		ls.dir = ""
+	}
+
+	return result
+}
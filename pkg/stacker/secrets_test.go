@@ -0,0 +1,54 @@
+package stacker
+
+import (
+	"os"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"stackerbuild.io/stacker/pkg/types"
+)
+
+func TestSecretsCleanup(t *testing.T) {
+	assert := assert.New(t)
+
+	config := types.StackerConfig{StackerDir: t.TempDir()}
+	upper := t.TempDir()
+	assert.NoError(os.MkdirAll(path.Join(upper, "root"), 0755))
+
+	ls := &layerSecrets{mountpoints: mountpoints{upperDir: upper}}
+	ls.record("/run/secrets/a")
+	ls.record("/run/secrets/b")
+	ls.record("/root/.npmrc")
+	assert.ElementsMatch([]string{"/run/secrets/a", "/run/secrets", "/run", "/run/secrets/b", "/root/.npmrc"}, ls.created)
+
+	source, err := ls.write(config, "a", []byte("hunter2"))
+	assert.NoError(err)
+	content, err := os.ReadFile(source)
+	assert.NoError(err)
+	assert.Equal("hunter2", string(content))
+
+	// what the build container creates to mount them, and what the run
+	// section adds next to them
+	assert.NoError(os.MkdirAll(path.Join(upper, "run/secrets"), 0755))
+	for _, p := range []string{"run/secrets/a", "run/secrets/b", "root/.npmrc", "root/.bashrc"} {
+		assert.NoError(os.WriteFile(path.Join(upper, p), nil, 0644))
+	}
+	assert.NoError(os.Mkdir(path.Join(upper, "run/lock"), 0755))
+
+	assert.NoError(ls.Cleanup())
+	for _, p := range []string{"run/secrets", "root/.npmrc", source} {
+		_, err = os.Lstat(path.Join(upper, p))
+		if p == source {
+			_, err = os.Lstat(p)
+		}
+		assert.True(os.IsNotExist(err), p)
+	}
+	for _, p := range []string{"run/lock", "root/.bashrc"} {
+		_, err = os.Lstat(path.Join(upper, p))
+		assert.NoError(err, p)
+	}
+
+	// it's fine to clean up twice
+	assert.NoError(ls.Cleanup())
+}
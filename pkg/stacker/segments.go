@@ -0,0 +1,136 @@
+package stacker
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// segmentedSize returns the size of url (and what the server said about it) if
+// it can be fetched in segments: the server has to accept byte ranges and know
+// the length, and the file has to be at least opts.SegmentThreshold big.
+func segmentedSize(url string, opts DownloadOptions) (int64, fetchResult, bool) {
+	info, err := fileInfo(context.Background(), url, opts)
+	if err != nil || !info.AcceptRanges || info.Size <= 0 {
+		return 0, fetchResult{}, false
+	}
+
+	result := fetchResult{
+		contentType:  info.ContentType,
+		etag:         info.ETag,
+		lastModified: info.LastModified,
+		finalURL:     info.FinalURL,
+	}
+	return info.Size, result, info.Size >= opts.SegmentThreshold
+}
+
+// fetchSegments downloads the size bytes of url into out as byte ranges of
+// opts.SegmentSize, opts.Segments of them at a time. The caller verifies the
+// assembled file.
+func fetchSegments(client *http.Client, out *os.File, url string, size int64, opts DownloadOptions, progress *downloadProgress) error {
+	segmentSize := opts.SegmentSize
+	if segmentSize <= 0 {
+		segmentSize = (size + int64(opts.Segments) - 1) / int64(opts.Segments)
+	}
+
+	err := out.Truncate(size)
+	if err != nil {
+		return errors.Wrapf(err, "couldn't truncate %s", out.Name())
+	}
+
+	netLog.Infof("downloading %s in %d byte segments", url, segmentSize)
+	progress.start(size, 0)
+
+	// stop handing out segments once one of them failed
+	ctx, cancel := downloadContext(opts)
+	defer cancel()
+
+	offsets := make(chan int64)
+	go func() {
+		defer close(offsets)
+		for offset := int64(0); offset < size; offset += segmentSize {
+			select {
+			case offsets <- offset:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	var wg sync.WaitGroup
+	var once sync.Once
+	var firstErr error
+	for i := 0; i < opts.Segments; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for offset := range offsets {
+				end := min(offset+segmentSize, size) - 1
+				err := fetchSegment(ctx, client, out, url, offset, end, opts, progress)
+				if err != nil {
+					once.Do(func() { firstErr = err })
+					cancel()
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	return firstErr
+}
+
+// fetchSegment downloads bytes start through end of url into the same place
+// in out.
+func fetchSegment(ctx context.Context, client *http.Client, out *os.File, url string, start int64, end int64, opts DownloadOptions, progress *downloadProgress) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	req, err := newRequest(ctx, http.MethodGet, url, opts)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", start, end))
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusPartialContent {
+		return errors.Errorf("server didn't honor range %d-%d of %s: %s", start, end, url, resp.Status)
+	}
+
+	if !strings.HasPrefix(resp.Header.Get("Content-Range"), fmt.Sprintf("bytes %d-%d/", start, end)) {
+		return errors.Errorf("server sent range %s instead of %d-%d of %s", resp.Header.Get("Content-Range"), start, end, url)
+	}
+
+	var stall *stallReader
+	var body io.Reader = resp.Body
+	if opts.StallTimeout != 0 {
+		stall = newStallReader(resp.Body, opts.StallTimeout, cancel)
+		defer stall.stop()
+		body = stall
+	}
+
+	want := end - start + 1
+	n, err := io.Copy(io.NewOffsetWriter(out, start), progress.proxy(io.LimitReader(body, want)))
+	metricsOf(opts).BytesDownloaded(downloadHost(url), n)
+	if err != nil && stall != nil && stall.stalled.Load() {
+		return &timeoutError{url: url, timeout: opts.StallTimeout}
+	} else if err != nil {
+		return err
+	}
+
+	if n != want {
+		return errors.Errorf("short segment %d-%d of %s: got %d bytes", start, end, url, n)
+	}
+
+	return nil
+}
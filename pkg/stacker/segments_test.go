@@ -0,0 +1,126 @@
+package stacker
+
+import (
+	"bytes"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// rangeServer serves content with range support, recording the ranges asked
+// for by GETs; failRange, if set, is answered with a 500.
+type rangeServer struct {
+	content   []byte
+	failRange string
+
+	mu     sync.Mutex
+	ranges []string
+}
+
+func (s *rangeServer) start(t *testing.T) string {
+	srv := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		rng := r.Header.Get("Range")
+		if r.Method == http.MethodGet {
+			s.mu.Lock()
+			s.ranges = append(s.ranges, rng)
+			s.mu.Unlock()
+		}
+		if rng != "" && rng == s.failRange {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		http.ServeContent(w, r, "file", time.Time{}, bytes.NewReader(s.content))
+	})
+	return srv.URL + "/file"
+}
+
+func (s *rangeServer) gets() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ranges := append([]string{}, s.ranges...)
+	sort.Strings(ranges)
+	return ranges
+}
+
+func segmentOptions(segments int, segmentSize int64) DownloadOptions {
+	opts := DownloadOptions{}
+	opts.Segments = segments
+	opts.SegmentSize = segmentSize
+	return opts
+}
+
+func TestDownloadSegments(t *testing.T) {
+	assert := assert.New(t)
+
+	for _, tc := range []struct {
+		size        int
+		segmentSize int64
+		ranges      []string
+	}{
+		// segments that divide the file evenly
+		{20, 10, []string{"bytes=0-9", "bytes=10-19"}},
+		// one byte more is a segment of its own
+		{21, 10, []string{"bytes=0-9", "bytes=10-19", "bytes=20-20"}},
+		// one byte less shortens the last one
+		{19, 10, []string{"bytes=0-9", "bytes=10-18"}},
+		// a file smaller than a segment is a single one
+		{5, 10, []string{"bytes=0-4"}},
+		// without a segment size, the segments share the file
+		{10, 0, []string{"bytes=0-3", "bytes=4-7", "bytes=8-9"}},
+	} {
+		s := &rangeServer{content: []byte(strings.Repeat("0123456789", 3)[:tc.size])}
+		url := s.start(t)
+
+		name, err := DownloadWithOptions(t.TempDir(), url, segmentOptions(3, tc.segmentSize))
+		assert.NoError(err, tc.size)
+		assert.Equal(tc.ranges, s.gets(), tc.size)
+
+		content, err := os.ReadFile(name)
+		assert.NoError(err)
+		assert.Equal(s.content, content, tc.size)
+	}
+}
+
+func TestDownloadSegmentFails(t *testing.T) {
+	assert := assert.New(t)
+
+	// a failed segment means downloading the file in one go instead
+	s := &rangeServer{content: []byte("0123456789abcdefghij"), failRange: "bytes=10-14"}
+	url := s.start(t)
+
+	name, err := DownloadWithOptions(t.TempDir(), url, segmentOptions(2, 5))
+	assert.NoError(err)
+	assert.Contains(s.gets(), "bytes=10-14")
+	assert.Contains(s.gets(), "")
+
+	content, err := os.ReadFile(name)
+	assert.NoError(err)
+	assert.Equal(s.content, content)
+}
+
+func TestDownloadSegmentsWithoutRanges(t *testing.T) {
+	assert := assert.New(t)
+
+	gets := []string{}
+	srv := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet {
+			gets = append(gets, r.Header.Get("Range"))
+		}
+		w.Write([]byte("0123456789abcdefghij"))
+	})
+
+	// a server that doesn't advertise Accept-Ranges isn't asked for any
+	name, err := DownloadWithOptions(t.TempDir(), srv.URL+"/file", segmentOptions(2, 5))
+	assert.NoError(err)
+	assert.Equal([]string{""}, gets)
+
+	content, err := os.ReadFile(name)
+	assert.NoError(err)
+	assert.Equal("0123456789abcdefghij", string(content))
+}
@@ -0,0 +1,98 @@
+package stacker
+
+import (
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/containers/image/v5/signature/signer"
+	"github.com/containers/image/v5/signature/sigstore"
+	"github.com/containers/image/v5/signature/sigstore/fulcio"
+	"github.com/containers/image/v5/signature/sigstore/rekor"
+	"github.com/pkg/errors"
+)
+
+const (
+	// SignKeyless is the SignOpts.Key that signs with a short-lived key
+	// whose certificate fulcio issues for an OIDC identity.
+	SignKeyless = "keyless"
+
+	DefaultFulcioURL    = "https://fulcio.sigstore.dev"
+	DefaultRekorURL     = "https://rekor.sigstore.dev"
+	DefaultOIDCIssuer   = "https://oauth2.sigstore.dev/auth"
+	DefaultOIDCClientID = "sigstore"
+)
+
+// kmsSchemes are the schemes of the KMS key URIs cosign accepts.
+var kmsSchemes = []string{"awskms://", "gcpkms://", "azurekms://", "hashivault://"}
+
+// SignOpts are how the images stacker publishes are signed, in the format
+// cosign signs them in.
+type SignOpts struct {
+	// Key is the path of a cosign private key, or SignKeyless.
+	Key string
+
+	// Passphrase is the passphrase of Key.
+	Passphrase []byte
+
+	// FulcioURL, OIDCIssuer and OIDCClientID are where a keyless
+	// signing certificate is issued, for IdentityToken, or for the
+	// identity that is logged in to OIDCIssuer interactively if it is
+	// empty.
+	FulcioURL     string
+	OIDCIssuer    string
+	OIDCClientID  string
+	IdentityToken string
+
+	// RekorURL, if set, is the transparency log signatures are uploaded
+	// to. Keyless signatures can't be verified without it.
+	RekorURL string
+}
+
+// NewSigner returns the signer that signs images as opts says to. Callers
+// need to Close it.
+func NewSigner(opts SignOpts) (*signer.Signer, error) {
+	for _, scheme := range kmsSchemes {
+		if strings.HasPrefix(opts.Key, scheme) {
+			return nil, errors.Errorf("can't sign with %s: KMS keys aren't supported, use a key file or %s", opts.Key, SignKeyless)
+		}
+	}
+
+	sigstoreOpts := []sigstore.Option{}
+	if opts.Key == SignKeyless {
+		fulcioURL, err := url.Parse(opts.FulcioURL)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid fulcio url %s", opts.FulcioURL)
+		}
+
+		if opts.IdentityToken != "" {
+			sigstoreOpts = append(sigstoreOpts, fulcio.WithFulcioAndPreexistingOIDCIDToken(fulcioURL, opts.IdentityToken))
+		} else {
+			issuerURL, err := url.Parse(opts.OIDCIssuer)
+			if err != nil {
+				return nil, errors.Wrapf(err, "invalid oidc issuer %s", opts.OIDCIssuer)
+			}
+			sigstoreOpts = append(sigstoreOpts, fulcio.WithFulcioAndInteractiveOIDC(fulcioURL, issuerURL, opts.OIDCClientID, "", os.Stdin, os.Stderr))
+		}
+	} else {
+		passphrase := opts.Passphrase
+		if passphrase == nil {
+			passphrase = []byte{}
+		}
+		sigstoreOpts = append(sigstoreOpts, sigstore.WithPrivateKeyFile(opts.Key, passphrase))
+	}
+
+	if opts.RekorURL != "" {
+		rekorURL, err := url.Parse(opts.RekorURL)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid rekor url %s", opts.RekorURL)
+		}
+		sigstoreOpts = append(sigstoreOpts, rekor.WithRekor(rekorURL))
+	}
+
+	s, err := sigstore.NewSigner(sigstoreOpts...)
+	if err != nil {
+		return nil, errors.Wrapf(err, "couldn't set up signing with %s", opts.Key)
+	}
+	return s, nil
+}
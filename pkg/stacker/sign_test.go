@@ -0,0 +1,55 @@
+package stacker
+
+import (
+	"os"
+	"path"
+	"testing"
+
+	"github.com/containers/image/v5/signature/signer"
+	"github.com/containers/image/v5/signature/sigstore"
+	"github.com/stretchr/testify/assert"
+	"stackerbuild.io/stacker/pkg/lib"
+)
+
+func TestNewSigner(t *testing.T) {
+	assert := assert.New(t)
+
+	keys, err := sigstore.GenerateKeyPair([]byte("hunter2"))
+	assert.NoError(err)
+	key := path.Join(t.TempDir(), "cosign.key")
+	assert.NoError(os.WriteFile(key, keys.PrivateKey, 0600))
+
+	s, err := NewSigner(SignOpts{Key: key, Passphrase: []byte("hunter2")})
+	assert.NoError(err)
+	s.Close()
+
+	_, err = NewSigner(SignOpts{Key: key, Passphrase: []byte("wrong")})
+	assert.Error(err)
+
+	_, err = NewSigner(SignOpts{Key: path.Join(t.TempDir(), "missing.key")})
+	assert.Error(err)
+
+	_, err = NewSigner(SignOpts{Key: "awskms:///alias/stacker"})
+	assert.ErrorContains(err, "KMS keys aren't supported")
+}
+
+func TestSignOnlyToRegistries(t *testing.T) {
+	assert := assert.New(t)
+
+	keys, err := sigstore.GenerateKeyPair([]byte{})
+	assert.NoError(err)
+	key := path.Join(t.TempDir(), "cosign.key")
+	assert.NoError(os.WriteFile(key, keys.PrivateKey, 0600))
+
+	s, err := NewSigner(SignOpts{Key: key})
+	assert.NoError(err)
+	defer s.Close()
+
+	dir := t.TempDir()
+	err = lib.ImageCopy(lib.ImageCopyOpts{
+		Src:     "oci:" + path.Join(dir, "src") + ":foo",
+		Dest:    "oci:" + path.Join(dir, "dest") + ":foo",
+		Signers: []*signer.Signer{s},
+	})
+	assert.ErrorContains(err, "signatures can only be pushed to a registry")
+}
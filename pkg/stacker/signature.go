@@ -0,0 +1,108 @@
+package stacker
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+
+	"github.com/pkg/errors"
+)
+
+// SignatureVerifier checks a detached signature of an artifact. Download only
+// knows about this interface, so that the crypto used to do the checking
+// (see pkg/signature for gpg and cosign implementations) stays optional.
+type SignatureVerifier interface {
+	Verify(artifact io.Reader, signature []byte) error
+}
+
+// SignatureError is returned when a downloaded artifact's detached signature
+// does not verify.
+type SignatureError struct {
+	URL string
+	Err error
+}
+
+func (e *SignatureError) Error() string {
+	return fmt.Sprintf("signature verification of %s failed: %v", e.URL, e.Err)
+}
+
+func (e *SignatureError) Unwrap() error {
+	return e.Err
+}
+
+func signatureURL(url string, opts DownloadOptions) string {
+	if opts.SignatureURL != "" {
+		return opts.SignatureURL
+	}
+	return url + ".sig"
+}
+
+// verifySignature checks name against its detached signature. The signature
+// is cached as a sidecar of the file; it is re-fetched when refresh is set
+// (i.e. the file itself was just downloaded) or when it isn't cached yet.
+func verifySignature(name string, url string, refresh bool, opts DownloadOptions) error {
+	sigURL := signatureURL(url, opts)
+	sigExt := path.Ext(sigURL)
+	sigName := sidecarPath(name, sigExt)
+
+	if _, err := os.Stat(sigName); refresh || err != nil {
+		err = fetchSignature(name, sigExt, sigURL, opts)
+		if err != nil {
+			return err
+		}
+	}
+
+	sig, err := os.ReadFile(sigName)
+	if err != nil {
+		return errors.Wrapf(err, "couldn't read signature %s", sigName)
+	}
+
+	f, err := os.Open(name)
+	if err != nil {
+		return errors.Wrapf(err, "couldn't open %s for signature verification", name)
+	}
+	defer f.Close()
+
+	netLog.Infof("verifying signature of %s", url)
+	err = opts.Verifier.Verify(f, sig)
+	if err != nil {
+		os.RemoveAll(sigName)
+		return &SignatureError{URL: url, Err: err}
+	}
+
+	return nil
+}
+
+func fetchSignature(name string, sigExt string, sigURL string, opts DownloadOptions) error {
+	req, err := newRequest(context.Background(), http.MethodGet, sigURL, opts)
+	if err != nil {
+		return err
+	}
+
+	resp, err := httpClient(opts).Do(req)
+	if err != nil {
+		return errors.Wrapf(err, "couldn't download signature %s", sigURL)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		return errors.Errorf("couldn't download signature %s: %s", sigURL, resp.Status)
+	}
+
+	out, err := createSidecar(name, sigExt, opts)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	_, err = io.Copy(out, resp.Body)
+	if err != nil {
+		os.RemoveAll(out.Name())
+		return errors.Wrapf(err, "couldn't download signature %s", sigURL)
+	}
+
+	return nil
+}
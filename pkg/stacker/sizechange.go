@@ -0,0 +1,102 @@
+package stacker
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+
+	"github.com/pkg/errors"
+)
+
+// SizeChangePolicy is what Download does when the server reports a different
+// size for a file with a pinned hash than that of its cached copy: the file
+// was supposed to never change, so that may mean it was tampered with or
+// moved upstream.
+type SizeChangePolicy int
+
+const (
+	// SizeChangeRefetch goes on as for any other stale cached copy.
+	SizeChangeRefetch SizeChangePolicy = iota
+	// SizeChangeWarn logs a warning, then goes on.
+	SizeChangeWarn
+	// SizeChangeError fails the download.
+	SizeChangeError
+)
+
+func (p SizeChangePolicy) String() string {
+	switch p {
+	case SizeChangeRefetch:
+		return "refetch"
+	case SizeChangeWarn:
+		return "warn"
+	case SizeChangeError:
+		return "error"
+	}
+	return "unknown"
+}
+
+// ParseSizeChangePolicy parses a policy as named by
+// SizeChangePolicy.String(); the empty string is SizeChangeRefetch.
+func ParseSizeChangePolicy(s string) (SizeChangePolicy, error) {
+	switch s {
+	case "", "refetch":
+		return SizeChangeRefetch, nil
+	case "warn":
+		return SizeChangeWarn, nil
+	case "error":
+		return SizeChangeError, nil
+	}
+	return SizeChangeRefetch, errors.Errorf("unknown size change policy %q (expected refetch, warn or error)", s)
+}
+
+// SizeChangedError is returned under SizeChangeError when a pinned file
+// changed size upstream.
+type SizeChangedError struct {
+	URL    string
+	Cached int64
+	Remote int64
+}
+
+func (e *SizeChangedError) Error() string {
+	return fmt.Sprintf("%s has a pinned hash, but changed size upstream: the cached copy has %d bytes, the server reports %d",
+		e.URL, e.Cached, e.Remote)
+}
+
+// checkSizeChange applies opts.SizeChangePolicy to name, the cached copy of
+// url, if url is pinned and the server reports a size (opts.RemoteSize) other
+// than name's.
+func checkSizeChange(name string, url string, pinned bool, opts DownloadOptions) error {
+	if !pinned || opts.RemoteSize == "" || opts.SizeChangePolicy == SizeChangeRefetch {
+		return nil
+	}
+
+	remote, err := strconv.ParseInt(opts.RemoteSize, 10, 64)
+	if err != nil || remote < 0 {
+		return nil
+	}
+
+	fi, err := os.Stat(name)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return errors.WithStack(err)
+	}
+
+	meta, err := readCacheMeta(name)
+	if err != nil {
+		return err
+	}
+
+	// only copies known to have come from url say anything about it
+	if meta.Source != url || fi.Size() == remote {
+		return nil
+	}
+
+	sizeErr := &SizeChangedError{URL: url, Cached: fi.Size(), Remote: remote}
+	if opts.SizeChangePolicy == SizeChangeError {
+		return sizeErr
+	}
+
+	netLog.Warnf("%v", sizeErr)
+	return nil
+}
@@ -0,0 +1,38 @@
+package stacker
+
+import (
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDownloadSizeChangePolicy(t *testing.T) {
+	assert := assert.New(t)
+
+	hash := "b94d27b9934d3e08a52e52d7da7dabfac484efe37a5380ee9088f7ace2efcde9"
+	opts := DownloadOptions{Uid: os.Getuid(), Gid: os.Getgid(), ChecksumOptions: ChecksumOptions{ExpectedHash: hash}, TransportOptions: TransportOptions{Transport: &fakeTransport{body: "hello world"}}}
+
+	cacheDir := t.TempDir()
+	_, err := DownloadWithOptions(cacheDir, "https://example.com/foo", opts)
+	assert.NoError(err)
+
+	opts.RemoteSize = "12"
+	for _, policy := range []SizeChangePolicy{SizeChangeRefetch, SizeChangeWarn} {
+		opts.SizeChangePolicy = policy
+		_, err = DownloadWithOptions(cacheDir, "https://example.com/foo", opts)
+		assert.NoError(err, "policy %s", policy)
+	}
+
+	opts.SizeChangePolicy = SizeChangeError
+	_, err = DownloadWithOptions(cacheDir, "https://example.com/foo", opts)
+	assert.ErrorAs(err, new(*SizeChangedError))
+
+	// unpinned imports are refetched as before
+	opts.ExpectedHash = ""
+	_, err = DownloadWithOptions(cacheDir, "https://example.com/foo", opts)
+	assert.NoError(err)
+
+	_, err = ParseSizeChangePolicy("ignore")
+	assert.Error(err)
+}
@@ -13,6 +13,43 @@ import (
 
 var storageTypeFile = "storage.type"
 
+// StorageTypes are the storage types stacker can use, for which
+// unpriv-setup looks for one that works in that order.
+var StorageTypes = []string{"overlay", "fuse-overlayfs"}
+
+// CheckStorage returns an error if storageType can't work for the current
+// task.
+func CheckStorage(c types.StackerConfig, storageType string) error {
+	switch storageType {
+	case "overlay":
+		return overlay.Check(c)
+	case "fuse-overlayfs":
+		return overlay.CheckFuse(c)
+	default:
+		return errors.Errorf("unknown storage type %s", storageType)
+	}
+}
+
+// RecordedStorageType returns the storage type of the previous stacker run,
+// or the one unpriv-setup found works, if there was either.
+func RecordedStorageType(c types.StackerConfig) (string, error) {
+	content, err := os.ReadFile(path.Join(c.StackerDir, storageTypeFile))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return "", nil
+		}
+		return "", errors.Wrapf(err, "couldn't read storage type")
+	}
+	return string(content), nil
+}
+
+// RecordStorageType records c's storage type as the one to use when none is
+// asked for.
+func RecordStorageType(c types.StackerConfig) error {
+	err := os.WriteFile(path.Join(c.StackerDir, storageTypeFile), []byte(c.StorageType), 0644)
+	return errors.Wrapf(err, "couldn't write storage type")
+}
+
 // openStorage just opens a storage type, without doing any pre-existing
 // storage checks
 func openStorage(c types.StackerConfig, storageType string) (types.Storage, error) {
@@ -24,6 +61,13 @@ func openStorage(c types.StackerConfig, storageType string) (types.Storage, erro
 		}
 
 		return overlay.NewOverlay(c)
+	case "fuse-overlayfs":
+		err := overlay.CheckFuse(c)
+		if err != nil {
+			return nil, err
+		}
+
+		return overlay.NewFuseOverlay(c)
 	default:
 		return nil, errors.Errorf("unknown storage type %s", storageType)
 	}
@@ -123,9 +167,9 @@ func NewStorage(c types.StackerConfig) (types.Storage, *StackerLocks, error) {
 		return nil, nil, errors.Wrapf(err, "couldn't make rootfs dir")
 	}
 
-	err = os.WriteFile(path.Join(c.StackerDir, storageTypeFile), []byte(c.StorageType), 0644)
+	err = RecordStorageType(c)
 	if err != nil {
-		return nil, nil, errors.Wrapf(err, "couldn't write storage type")
+		return nil, nil, err
 	}
 
 	s, err := openStorage(c, c.StorageType)
@@ -154,6 +198,8 @@ func UnprivSetup(c types.StackerConfig, username string, uid, gid int) error {
 	switch c.StorageType {
 	case "overlay":
 		return overlay.UnprivSetup(c, uid, gid)
+	case "fuse-overlayfs":
+		return overlay.UnprivSetupFuse(c, uid, gid)
 	default:
 		return errors.Errorf("unknown storage type %s", c.StorageType)
 	}
@@ -0,0 +1,144 @@
+package stacker
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// timeoutError is returned when a download stalls for longer than
+// DownloadOptions.StallTimeout.
+type timeoutError struct {
+	url     string
+	timeout time.Duration
+}
+
+func (e *timeoutError) Error() string {
+	return fmt.Sprintf("download of %s stalled for %v", e.url, e.timeout)
+}
+
+func (e *timeoutError) Timeout() bool {
+	return true
+}
+
+// isTimeout returns true if err is the result of one of the download timeouts
+// expiring.
+func isTimeout(err error) bool {
+	var t interface{ Timeout() bool }
+	return errors.As(err, &t) && t.Timeout()
+}
+
+// httpClient returns the client to talk to the server with, honoring opts'
+// timeouts, network and rate limits.
+func httpClient(opts DownloadOptions) *http.Client {
+	client := baseHTTPClient(opts)
+	if opts.RateLimiter == nil {
+		return client
+	}
+
+	limited := *client
+	transport := client.Transport
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+	limited.Transport = opts.RateLimiter.transport(transport)
+	return &limited
+}
+
+func baseHTTPClient(opts DownloadOptions) *http.Client {
+	if opts.Transport != nil {
+		return &http.Client{Transport: opts.Transport}
+	}
+
+	pinned := opts.Network != "" && opts.Network != "tcp"
+	if opts.ConnectTimeout == 0 && opts.StallTimeout == 0 && opts.ResponseHeaderTimeout == 0 && !pinned {
+		return http.DefaultClient
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if opts.ConnectTimeout != 0 || pinned {
+		// the same as the default transport's dialer otherwise
+		dialer := &net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}
+		if opts.ConnectTimeout != 0 {
+			dialer.Timeout = opts.ConnectTimeout
+			transport.TLSHandshakeTimeout = opts.ConnectTimeout
+		}
+		transport.DialContext = func(ctx context.Context, network string, addr string) (net.Conn, error) {
+			if pinned {
+				network = opts.Network
+			}
+			return dialer.DialContext(ctx, network, addr)
+		}
+	}
+	// not sending a response at all is a stall as well
+	transport.ResponseHeaderTimeout = opts.StallTimeout
+	if opts.ResponseHeaderTimeout != 0 {
+		transport.ResponseHeaderTimeout = opts.ResponseHeaderTimeout
+	}
+
+	return &http.Client{Transport: transport}
+}
+
+// downloadContext returns the context for the requests of a download, which
+// is cancelled with opts.ctx and expires at the download's overall deadline,
+// if it has one.
+func downloadContext(opts DownloadOptions) (context.Context, context.CancelFunc) {
+	parent := opts.ctx
+	if parent == nil {
+		parent = context.Background()
+	}
+
+	if opts.deadline.IsZero() {
+		return context.WithCancel(parent)
+	}
+	return context.WithDeadline(parent, opts.deadline)
+}
+
+// cancelled returns true if the download was cancelled by whoever started it.
+func cancelled(opts DownloadOptions) bool {
+	return opts.ctx != nil && opts.ctx.Err() != nil
+}
+
+// pastDeadline returns true if the download's overall deadline has expired.
+func pastDeadline(opts DownloadOptions) bool {
+	return !opts.deadline.IsZero() && time.Now().After(opts.deadline)
+}
+
+// stallReader cancels a transfer when no data has been read from it for
+// timeout. The timer is reset on every read that returns data.
+type stallReader struct {
+	r       io.Reader
+	timeout time.Duration
+	timer   *time.Timer
+	stalled atomic.Bool
+}
+
+func newStallReader(r io.Reader, timeout time.Duration, cancel func()) *stallReader {
+	s := &stallReader{r: r, timeout: timeout}
+	s.timer = time.AfterFunc(timeout, func() {
+		s.stalled.Store(true)
+		cancel()
+	})
+	return s
+}
+
+func (s *stallReader) Read(p []byte) (int, error) {
+	n, err := s.r.Read(p)
+	if n > 0 {
+		s.timer.Reset(s.timeout)
+	}
+	return n, err
+}
+
+func (s *stallReader) stop() {
+	s.timer.Stop()
+}
@@ -0,0 +1,74 @@
+package stacker
+
+import (
+	"net/http"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDownloadOverallTimeout(t *testing.T) {
+	assert := assert.New(t)
+
+	done := make(chan struct{})
+	srv := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", "11")
+		w.Write([]byte("hello"))
+		w.(http.Flusher).Flush()
+		select {
+		case <-done:
+		case <-r.Context().Done():
+		}
+	})
+	defer close(done)
+
+	opts := DownloadOptions{Uid: os.Getuid(), Gid: os.Getgid(), RetryOptions: RetryOptions{Retries: 5}, TransportOptions: TransportOptions{OverallTimeout: 100 * time.Millisecond}}
+
+	start := time.Now()
+	_, err := DownloadWithOptions(t.TempDir(), srv.URL+"/foo", opts)
+	assert.Error(err)
+	assert.True(isTimeout(err))
+	assert.Less(time.Since(start), 5*time.Second)
+}
+
+func TestDownloadStallTimeout(t *testing.T) {
+	assert := assert.New(t)
+
+	done := make(chan struct{})
+	srv := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", "11")
+		if r.URL.Path == "/slow" {
+			// slow, but never silent for long
+			for _, c := range []byte("hello world") {
+				w.Write([]byte{c})
+				w.(http.Flusher).Flush()
+				time.Sleep(20 * time.Millisecond)
+			}
+			return
+		}
+		w.Write([]byte("hello"))
+		w.(http.Flusher).Flush()
+		select {
+		case <-done:
+		case <-r.Context().Done():
+		}
+	})
+	defer close(done)
+
+	opts := DownloadOptions{Uid: os.Getuid(), Gid: os.Getgid(), TransportOptions: TransportOptions{StallTimeout: 200 * time.Millisecond}}
+
+	start := time.Now()
+	_, err := DownloadWithOptions(t.TempDir(), srv.URL+"/stalls", opts)
+	assert.ErrorContains(err, "stalled for 200ms")
+	assert.True(isTimeout(err))
+	assert.GreaterOrEqual(time.Since(start), 200*time.Millisecond)
+	assert.Less(time.Since(start), 2*time.Second)
+
+	name, err := DownloadWithOptions(t.TempDir(), srv.URL+"/slow", opts)
+	assert.NoError(err)
+	content, err := os.ReadFile(name)
+	assert.NoError(err)
+	assert.Equal("hello world", string(content))
+}
@@ -0,0 +1,180 @@
+package stacker
+
+import (
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"encoding/hex"
+	"io"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/minio/sha256-simd"
+	"github.com/pkg/errors"
+)
+
+// decompressedReader returns the decompressed content of r, recognizing the
+// compression by its magic. Content that isn't compressed (in a way we know)
+// is returned as is, so that a plain tarball has the same uncompressed digest
+// as any compressed copy of it.
+func decompressedReader(r io.Reader) (io.ReadCloser, error) {
+	br := bufio.NewReader(r)
+	head, err := br.Peek(4)
+	if err != nil && err != io.EOF {
+		return nil, errors.WithStack(err)
+	}
+
+	switch {
+	case bytes.HasPrefix(head, []byte{0x1f, 0x8b}):
+		gz, err := gzip.NewReader(br)
+		if err != nil {
+			return nil, errors.Wrapf(err, "couldn't decompress gzip")
+		}
+		return gz, nil
+	case bytes.HasPrefix(head, []byte{0x28, 0xb5, 0x2f, 0xfd}):
+		zr, err := zstd.NewReader(br)
+		if err != nil {
+			return nil, errors.Wrapf(err, "couldn't decompress zstd")
+		}
+		return zr.IOReadCloser(), nil
+	case bytes.HasPrefix(head, []byte("BZh")):
+		return io.NopCloser(bzip2.NewReader(br)), nil
+	}
+
+	return io.NopCloser(br), nil
+}
+
+// uncompressedExts are the extensions CacheUncompressed drops from the name
+// of the cached file, and what they are replaced with.
+var uncompressedExts = map[string]string{
+	".gz":  "",
+	".zst": "",
+	".bz2": "",
+	".tgz": ".tar",
+}
+
+// uncompressedName is the name the decompressed copy of name is cached under.
+func uncompressedName(name string) string {
+	ext := path.Ext(name)
+	if replacement, ok := uncompressedExts[ext]; ok {
+		return strings.TrimSuffix(name, ext) + replacement
+	}
+	return name
+}
+
+// checkUncompressed verifies that the decompressed content of the download in
+// out matches opts.ExpectedUncompressedHash. With opts.CacheUncompressed, out
+// is replaced with its decompressed content.
+func checkUncompressed(out *os.File, url string, opts DownloadOptions) error {
+	_, err := out.Seek(0, io.SeekStart)
+	if err != nil {
+		return errors.Wrapf(err, "couldn't seek %s", out.Name())
+	}
+
+	r, err := decompressedReader(out)
+	if err != nil {
+		return errors.Wrapf(err, "couldn't read %s", url)
+	}
+	defer r.Close()
+
+	h := sha256.New()
+	var w io.Writer = h
+	var tmp *os.File
+	if opts.CacheUncompressed {
+		tmp, err = os.CreateTemp(path.Dir(out.Name()), path.Base(out.Name())+".uncompressed-")
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		defer os.Remove(tmp.Name())
+		defer tmp.Close()
+		w = io.MultiWriter(h, tmp)
+	}
+
+	_, err = io.Copy(w, r)
+	if err != nil {
+		return errors.Wrapf(err, "couldn't decompress %s", url)
+	}
+
+	actual := hex.EncodeToString(h.Sum(nil))
+	netLog.Debugf("Downloaded file uncompressed hash: %s", actual)
+	if actual != opts.ExpectedUncompressedHash {
+		return &ChecksumMismatchError{URL: url, Expected: opts.ExpectedUncompressedHash, Actual: actual}
+	}
+
+	if tmp == nil {
+		return nil
+	}
+
+	_, err = tmp.Seek(0, io.SeekStart)
+	if err == nil {
+		err = out.Truncate(0)
+	}
+	if err == nil {
+		_, err = out.Seek(0, io.SeekStart)
+	}
+	if err == nil {
+		_, err = io.Copy(out, tmp)
+	}
+	return errors.Wrapf(err, "couldn't store decompressed %s", url)
+}
+
+// uncompressedDigest returns the sha256 of the decompressed content of name.
+func uncompressedDigest(name string) (string, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+	defer f.Close()
+
+	r, err := decompressedReader(f)
+	if err != nil {
+		return "", errors.Wrapf(err, "couldn't read %s", name)
+	}
+	defer r.Close()
+
+	h := sha256.New()
+	_, err = io.Copy(h, r)
+	if err != nil {
+		return "", errors.Wrapf(err, "couldn't decompress %s", name)
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// cacheMatchesUncompressedHash returns true if there is a cached copy name of
+// url whose decompressed content matches opts.ExpectedUncompressedHash. Like
+// cachedDigest, it trusts the digest recorded in name's metadata if name is
+// unchanged since.
+func cacheMatchesUncompressedHash(name string, url string, opts DownloadOptions) (bool, error) {
+	fi, err := os.Stat(name)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, errors.WithStack(err)
+	}
+
+	meta, err := readCacheMeta(name)
+	if err != nil {
+		return false, err
+	}
+
+	actual := meta.UncompressedDigest
+	if opts.VerifyOnRead || actual == "" || !meta.describes(url, fi) {
+		actual, err = uncompressedDigest(name)
+		if err != nil {
+			return false, err
+		}
+	}
+
+	if actual != opts.ExpectedUncompressedHash {
+		netLog.Debugf("cached copy of %s doesn't match its uncompressed checksum", url)
+		return false, nil
+	}
+
+	netLog.Debugf("matched uncompressed hash of %s", url)
+	return true, nil
+}
@@ -0,0 +1,70 @@
+package stacker
+
+import (
+	"bytes"
+	"compress/gzip"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDownloadUncompressedHash(t *testing.T) {
+	assert := assert.New(t)
+
+	compressed := bytes.Buffer{}
+	gz := gzip.NewWriter(&compressed)
+	gz.Write([]byte("hello world"))
+	gz.Close()
+
+	requests := 0
+	srv := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if r.URL.Path == "/plain/foo.tar" {
+			w.Write([]byte("hello world"))
+			return
+		}
+		w.Write(compressed.Bytes())
+	})
+
+	dir := t.TempDir()
+	opts := DownloadOptions{
+		Uid: os.Getuid(),
+		Gid: os.Getgid(),
+		ChecksumOptions: ChecksumOptions{
+			// sha256 of "hello world"
+			ExpectedUncompressedHash: "b94d27b9934d3e08a52e52d7da7dabfac484efe37a5380ee9088f7ace2efcde9",
+		},
+	}
+
+	name, err := DownloadWithOptions(dir, srv.URL+"/foo.tar.gz", opts)
+	assert.NoError(err)
+	content, err := os.ReadFile(name)
+	assert.NoError(err)
+	assert.Equal(compressed.Bytes(), content)
+
+	// a differently compressed mirror has the same content
+	_, err = DownloadWithOptions(t.TempDir(), srv.URL+"/plain/foo.tar", opts)
+	assert.NoError(err)
+
+	requests = 0
+	_, err = DownloadWithOptions(dir, srv.URL+"/foo.tar.gz", opts)
+	assert.NoError(err)
+	assert.Equal(0, requests)
+
+	opts.CacheUncompressed = true
+	name, err = DownloadWithOptions(dir, srv.URL+"/foo.tar.gz", opts)
+	assert.NoError(err)
+	assert.Equal(path.Join(dir, "foo.tar"), name)
+	content, err = os.ReadFile(name)
+	assert.NoError(err)
+	assert.Equal("hello world", string(content))
+
+	opts.ExpectedUncompressedHash = strings.Repeat("0", 64)
+	_, err = DownloadWithOptions(t.TempDir(), srv.URL+"/foo.tar.gz", opts)
+	var mismatch *ChecksumMismatchError
+	assert.ErrorAs(err, &mismatch)
+}
@@ -0,0 +1,589 @@
+package stacker
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	neturl "net/url"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/dustin/go-humanize"
+	"github.com/opencontainers/go-digest"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/opencontainers/umoci/oci/casext"
+	"github.com/pkg/errors"
+	"stackerbuild.io/stacker/pkg/lib"
+	"stackerbuild.io/stacker/pkg/log"
+)
+
+// DefaultUploadChunkSize is how much of a blob is uploaded per request, so
+// that an upload that fails only has to send the chunk it failed in again.
+const DefaultUploadChunkSize = 64 * 1024 * 1024
+
+// uploadStatusError is returned when the registry answers a request of an
+// upload with an unexpected status.
+type uploadStatusError struct {
+	url        string
+	status     string
+	statusCode int
+}
+
+func (e *uploadStatusError) Error() string {
+	return fmt.Sprintf("couldn't upload to %s: %s", e.url, e.status)
+}
+
+// uploadRetryable returns true if a failed upload request is worth
+// attempting again: the registry had a (possibly transient) problem, asked
+// us to slow down, or we couldn't talk to it.
+func uploadRetryable(err error) bool {
+	var statusErr *uploadStatusError
+	if errors.As(err, &statusErr) {
+		return statusErr.statusCode >= 500 || statusErr.statusCode == http.StatusTooManyRequests
+	}
+	return true
+}
+
+// uploadedBlobs are the repositories blobs were uploaded to, by the host of
+// their registry and their digest, so that they can be mounted in the other
+// repositories of the registry they're published to rather than uploaded
+// again.
+type uploadedBlobs map[string]map[digest.Digest]string
+
+// blobUploader uploads the blobs of images to a repository of a registry in
+// chunks (see the OCI distribution spec), resuming the uploads that failed
+// where the registry says they got to, before the images are published. The
+// images' manifests are then published as usual, which finds their blobs are
+// already there.
+type blobUploader struct {
+	client   *http.Client
+	scheme   string
+	host     string
+	repo     string
+	username string
+	password string
+
+	// skipTLS falls back to http for registries that don't talk https.
+	skipTLS bool
+
+	// auth is the Authorization header the registry asked for, once it
+	// did.
+	auth string
+
+	chunkSize int64
+	retries   int
+	backoff   time.Duration
+
+	// uploaded are the repositories of the registry that blobs are in.
+	uploaded map[digest.Digest]string
+}
+
+func newBlobUploader(opts *PublishArgs, destUrl string) (*blobUploader, error) {
+	url, err := neturl.Parse(destUrl)
+	if err != nil {
+		return nil, errors.Wrapf(err, "couldn't parse %s", destUrl)
+	}
+	repo, _, _ := strings.Cut(strings.TrimPrefix(url.Path, "/"), ":")
+	repo, _, _ = strings.Cut(repo, "@")
+
+	tlsConfig, err := lib.TLSConfig(url.Host, opts.SkipTLS, opts.Config.Registries)
+	if err != nil {
+		return nil, err
+	}
+
+	scheme := "https"
+	if lib.PlainHTTP(url.Host, opts.Config.Registries) {
+		scheme = "http"
+	}
+
+	chunkSize := opts.UploadChunkSize
+	if chunkSize <= 0 {
+		chunkSize = DefaultUploadChunkSize
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+	return &blobUploader{
+		client:    &http.Client{Transport: transport},
+		scheme:    scheme,
+		host:      url.Host,
+		repo:      repo,
+		username:  opts.Username,
+		password:  opts.Password,
+		skipTLS:   opts.SkipTLS,
+		chunkSize: chunkSize,
+		retries:   opts.UploadRetries,
+		backoff:   opts.UploadRetryBackoff,
+		uploaded:  map[digest.Digest]string{},
+	}, nil
+}
+
+// url returns the url of p in the registry, resolving the relative locations
+// of uploads.
+func (u *blobUploader) url(p string) string {
+	if strings.HasPrefix(p, "http://") || strings.HasPrefix(p, "https://") {
+		return p
+	}
+	return fmt.Sprintf("%s://%s%s", u.scheme, u.host, p)
+}
+
+// authenticate gets what the registry asked for in challenge (the
+// WWW-Authenticate header of a 401): basic auth, or a bearer token from its
+// token server.
+func (u *blobUploader) authenticate(challenge string) error {
+	kind, params, _ := strings.Cut(challenge, " ")
+	switch strings.ToLower(kind) {
+	case "basic":
+		if u.username == "" {
+			return errors.Errorf("%s wants credentials", u.host)
+		}
+		u.auth = "Basic " + basicAuth(u.username, u.password)
+		return nil
+	case "bearer":
+	default:
+		return errors.Errorf("%s wants unknown authentication %s", u.host, kind)
+	}
+
+	values := map[string]string{}
+	for _, param := range strings.Split(params, ",") {
+		k, v, ok := strings.Cut(strings.TrimSpace(param), "=")
+		if ok {
+			values[k] = strings.Trim(v, `"`)
+		}
+	}
+	if values["realm"] == "" {
+		return errors.Errorf("%s wants a bearer token from nowhere", u.host)
+	}
+
+	tokenURL, err := neturl.Parse(values["realm"])
+	if err != nil {
+		return errors.Wrapf(err, "bad token realm of %s", u.host)
+	}
+	query := tokenURL.Query()
+	if values["service"] != "" {
+		query.Set("service", values["service"])
+	}
+	scope := values["scope"]
+	if scope == "" {
+		scope = fmt.Sprintf("repository:%s:pull,push", u.repo)
+	}
+	query.Set("scope", scope)
+	tokenURL.RawQuery = query.Encode()
+
+	req, err := http.NewRequest(http.MethodGet, tokenURL.String(), nil)
+	if err != nil {
+		return err
+	}
+	if u.username != "" {
+		req.SetBasicAuth(u.username, u.password)
+	}
+	resp, err := u.client.Do(req)
+	if err != nil {
+		return errors.Wrapf(err, "couldn't get a token for %s", u.host)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return &uploadStatusError{url: tokenURL.String(), status: resp.Status, statusCode: resp.StatusCode}
+	}
+
+	token := struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}{}
+	if err := json.NewDecoder(resp.Body).Decode(&token); err != nil {
+		return errors.Wrapf(err, "bad token from %s", tokenURL)
+	}
+	if token.Token == "" {
+		token.Token = token.AccessToken
+	}
+	u.auth = "Bearer " + token.Token
+	return nil
+}
+
+// do sends the request newRequest makes to the registry, authenticating as
+// it asks and falling back to http if it's allowed to and needs to. The
+// request is made again for each of those, so that bodies can be re-read.
+func (u *blobUploader) do(ctx context.Context, method string, p string, body func() io.Reader, header http.Header) (*http.Response, error) {
+	for authenticated := false; ; {
+		var reader io.Reader
+		if body != nil {
+			reader = body()
+		}
+		req, err := http.NewRequestWithContext(ctx, method, u.url(p), reader)
+		if err != nil {
+			return nil, err
+		}
+		for k, v := range header {
+			req.Header[k] = v
+		}
+		if u.auth != "" {
+			req.Header.Set("Authorization", u.auth)
+		}
+		switch r := reader.(type) {
+		case nil:
+			req.ContentLength = 0
+		case *io.SectionReader:
+			// rather than chunked encoding, which some registries
+			// don't take for uploads
+			req.ContentLength = r.Size()
+		}
+
+		resp, err := u.client.Do(req)
+		if err != nil && u.skipTLS && u.scheme == "https" && strings.Contains(err.Error(), "server gave HTTP response to HTTPS client") {
+			u.scheme = "http"
+			p = strings.Replace(p, "https://", "http://", 1)
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		if resp.StatusCode == http.StatusUnauthorized && !authenticated {
+			resp.Body.Close()
+			err = u.authenticate(resp.Header.Get("WWW-Authenticate"))
+			if err != nil {
+				return nil, err
+			}
+			authenticated = true
+			continue
+		}
+
+		return resp, nil
+	}
+}
+
+// exists returns true if the repository already has the blob desc.
+func (u *blobUploader) exists(ctx context.Context, desc ispec.Descriptor) (bool, error) {
+	p := fmt.Sprintf("/v2/%s/blobs/%s", u.repo, desc.Digest)
+	resp, err := u.do(ctx, http.MethodHead, p, nil, nil)
+	if err != nil {
+		return false, err
+	}
+	resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return true, nil
+	case http.StatusNotFound:
+		return false, nil
+	}
+	return false, &uploadStatusError{url: u.url(p), status: resp.Status, statusCode: resp.StatusCode}
+}
+
+// start starts an upload, returning where it goes.
+func (u *blobUploader) start(ctx context.Context) (string, error) {
+	p := fmt.Sprintf("/v2/%s/blobs/uploads/", u.repo)
+	resp, err := u.do(ctx, http.MethodPost, p, nil, nil)
+	if err != nil {
+		return "", err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusAccepted {
+		return "", &uploadStatusError{url: u.url(p), status: resp.Status, statusCode: resp.StatusCode}
+	}
+	return resp.Header.Get("Location"), nil
+}
+
+// mount asks the registry to mount the blob d, which is in the repository
+// from, in the repository. If it doesn't, it may start an upload instead,
+// whose location is returned.
+func (u *blobUploader) mount(ctx context.Context, d digest.Digest, from string) (bool, string, error) {
+	query := neturl.Values{}
+	query.Set("mount", d.String())
+	query.Set("from", from)
+	p := fmt.Sprintf("/v2/%s/blobs/uploads/?%s", u.repo, query.Encode())
+	resp, err := u.do(ctx, http.MethodPost, p, nil, nil)
+	if err != nil {
+		return false, "", err
+	}
+	resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusCreated:
+		return true, "", nil
+	case http.StatusAccepted:
+		return false, resp.Header.Get("Location"), nil
+	}
+	return false, "", &uploadStatusError{url: u.url(p), status: resp.Status, statusCode: resp.StatusCode}
+}
+
+// uploadedSize returns how much of the upload at location the registry has, or
+// false if it doesn't know about the upload (any more).
+func (u *blobUploader) uploadedSize(ctx context.Context, location string) (int64, bool, error) {
+	resp, err := u.do(ctx, http.MethodGet, location, nil, nil)
+	if err != nil {
+		return 0, false, err
+	}
+	resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusNoContent, http.StatusAccepted:
+	case http.StatusNotFound:
+		return 0, false, nil
+	default:
+		return 0, false, &uploadStatusError{url: u.url(location), status: resp.Status, statusCode: resp.StatusCode}
+	}
+
+	end, ok := uploadedEnd(resp.Header.Get("Range"))
+	return end, ok, nil
+}
+
+// uploadedEnd returns how much of a blob is uploaded according to the Range
+// header a registry answers an upload with, "0-<last byte>". Registries say
+// "0-0" both for an empty upload and for one with a single byte, so that is
+// taken to be nothing; sendFrom finds out if it was the byte.
+func uploadedEnd(r string) (int64, bool) {
+	if r == "" {
+		return 0, true
+	}
+	var start, end int64
+	_, err := fmt.Sscanf(strings.TrimPrefix(r, "bytes="), "%d-%d", &start, &end)
+	if err != nil || start != 0 {
+		return 0, false
+	}
+	if end == 0 {
+		return 0, true
+	}
+	return end + 1, true
+}
+
+// patch uploads the n bytes of f at offset to the upload at location,
+// returning where the upload continues.
+func (u *blobUploader) patch(ctx context.Context, location string, f *os.File, offset int64, n int64) (string, error) {
+	header := http.Header{}
+	header.Set("Content-Type", "application/octet-stream")
+	header.Set("Content-Range", fmt.Sprintf("%d-%d", offset, offset+n-1))
+	body := func() io.Reader { return io.NewSectionReader(f, offset, n) }
+
+	resp, err := u.do(ctx, http.MethodPatch, location, body, header)
+	if err != nil {
+		return "", err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusAccepted {
+		return "", &uploadStatusError{url: u.url(location), status: resp.Status, statusCode: resp.StatusCode}
+	}
+	if next := resp.Header.Get("Location"); next != "" {
+		return next, nil
+	}
+	return location, nil
+}
+
+// sendFrom uploads f, of size bytes, to the upload at location from offset
+// on, returning where the upload continues and whether any of it was sent.
+// If the registry doesn't take a chunk where we thought the upload got to,
+// the upload's location is asked again where that is.
+func (u *blobUploader) sendFrom(ctx context.Context, location string, f *os.File, offset int64, size int64) (string, bool, error) {
+	progressed := false
+	confirmed := false
+	for offset < size {
+		n := min(u.chunkSize, size-offset)
+		next, err := u.patch(ctx, location, f, offset, n)
+		var statusErr *uploadStatusError
+		if errors.As(err, &statusErr) && statusErr.statusCode == http.StatusRequestedRangeNotSatisfiable && !confirmed {
+			confirmed = true
+			actual, ok, cerr := u.uploadedSize(ctx, location)
+			if cerr != nil {
+				return location, progressed, cerr
+			}
+			// the "0-0" that said nothing was uploaded was the
+			// first byte
+			if ok && actual == 0 && offset == 0 {
+				actual = 1
+			}
+			if ok && actual != offset {
+				log.Debugf("registry has %s of the upload, not %s", humanize.Bytes(uint64(actual)), humanize.Bytes(uint64(offset)))
+				offset = actual
+				continue
+			}
+		}
+		if err != nil {
+			return location, progressed, err
+		}
+		location = next
+		offset += n
+		progressed = true
+		confirmed = false
+		log.Debugf("uploaded %s of %s", humanize.Bytes(uint64(offset)), humanize.Bytes(uint64(size)))
+	}
+	return location, progressed, nil
+}
+
+// finish completes the upload at location of the blob with digest d.
+func (u *blobUploader) finish(ctx context.Context, location string, d digest.Digest) error {
+	url, err := neturl.Parse(u.url(location))
+	if err != nil {
+		return errors.Wrapf(err, "bad upload location %s", location)
+	}
+	query := url.Query()
+	query.Set("digest", d.String())
+	url.RawQuery = query.Encode()
+
+	resp, err := u.do(ctx, http.MethodPut, url.String(), nil, nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusCreated {
+		return &uploadStatusError{url: url.String(), status: resp.Status, statusCode: resp.StatusCode}
+	}
+	return nil
+}
+
+// upload uploads the blob desc of the OCI layout ociDir, unless the
+// repository has it already. Failures are retried u.retries times in a row,
+// continuing from what the registry got of the blob.
+func (u *blobUploader) upload(ctx context.Context, ociDir string, desc ispec.Descriptor) error {
+	exists, err := u.exists(ctx, desc)
+	if err != nil {
+		return err
+	}
+	if exists {
+		log.Debugf("%s already has blob %s", u.repo, desc.Digest)
+		u.uploaded[desc.Digest] = u.repo
+		return nil
+	}
+
+	location := ""
+	if from, ok := u.uploaded[desc.Digest]; ok {
+		mounted, mountLocation, err := u.mount(ctx, desc.Digest, from)
+		if err != nil {
+			log.Debugf("couldn't mount blob %s from %s in %s: %v", desc.Digest, from, u.repo, err)
+		} else if mounted {
+			log.Infof("mounted blob %s from %s in %s/%s", desc.Digest, from, u.host, u.repo)
+			u.uploaded[desc.Digest] = u.repo
+			return nil
+		}
+		location = mountLocation
+	}
+
+	f, err := os.Open(path.Join(ociDir, "blobs", desc.Digest.Algorithm().String(), desc.Digest.Encoded()))
+	if err != nil {
+		return errors.Wrapf(err, "couldn't read blob %s", desc.Digest)
+	}
+	defer f.Close()
+
+	log.Infof("uploading blob %s (%s) to %s/%s", desc.Digest, humanize.Bytes(uint64(desc.Size)), u.host, u.repo)
+
+	var offset int64
+	for failures := 0; ; {
+		progressed := false
+		err := func() error {
+			var err error
+			if location != "" {
+				var ok bool
+				offset, ok, err = u.uploadedSize(ctx, location)
+				if err != nil {
+					return err
+				}
+				if !ok {
+					log.Infof("registry lost the upload of %s, starting over", desc.Digest)
+					location = ""
+				} else if offset > 0 {
+					log.Infof("resuming upload of %s at %s", desc.Digest, humanize.Bytes(uint64(offset)))
+				}
+			}
+			if location == "" {
+				offset = 0
+				location, err = u.start(ctx)
+				if err != nil {
+					return err
+				}
+			}
+
+			location, progressed, err = u.sendFrom(ctx, location, f, offset, desc.Size)
+			if err != nil {
+				return err
+			}
+
+			return u.finish(ctx, location, desc.Digest)
+		}()
+		if err == nil {
+			u.uploaded[desc.Digest] = u.repo
+			return nil
+		}
+
+		// only failures in a row count
+		if progressed {
+			failures = 0
+		}
+		failures++
+		if failures > u.retries || !uploadRetryable(err) {
+			return errors.Wrapf(err, "couldn't upload blob %s", desc.Digest)
+		}
+
+		log.Infof("upload of %s failed, retrying (attempt %d): %v", desc.Digest, failures+1, err)
+		if err := waitToRetry(ctx, failures, DownloadOptions{RetryOptions: RetryOptions{RetryBackoff: u.backoff}}); err != nil {
+			return err
+		}
+	}
+}
+
+// imageBlobs returns the blobs of the image (or the images of the index) desc
+// in oci: their layers and configs.
+func imageBlobs(oci casext.Engine, desc ispec.Descriptor) ([]ispec.Descriptor, error) {
+	blob, err := oci.FromDescriptor(context.Background(), desc)
+	if err != nil {
+		return nil, err
+	}
+	defer blob.Close()
+
+	switch data := blob.Data.(type) {
+	case ispec.Index:
+		blobs := []ispec.Descriptor{}
+		for _, m := range data.Manifests {
+			mblobs, err := imageBlobs(oci, m)
+			if err != nil {
+				return nil, err
+			}
+			blobs = append(blobs, mblobs...)
+		}
+		return blobs, nil
+	case ispec.Manifest:
+		return append(data.Layers, data.Config), nil
+	}
+
+	return nil, errors.Errorf("%s is a %s, not an image", desc.Digest, desc.MediaType)
+}
+
+// uploadBlobs uploads the blobs of the image tagged layerName in oci to
+// destUrl, a docker:// url.
+func (p *Publisher) uploadBlobs(oci casext.Engine, layerName string, destUrl string) error {
+	descPaths, err := oci.ResolveReference(context.Background(), layerName)
+	if err != nil {
+		return err
+	}
+	if len(descPaths) != 1 {
+		return errors.Errorf("bad descriptor %s", layerName)
+	}
+
+	blobs, err := imageBlobs(oci, descPaths[0].Descriptor())
+	if err != nil {
+		return err
+	}
+
+	u, err := newBlobUploader(p.opts, destUrl)
+	if err != nil {
+		return err
+	}
+	if _, ok := p.uploaded[u.host]; !ok {
+		p.uploaded[u.host] = map[digest.Digest]string{}
+	}
+	u.uploaded = p.uploaded[u.host]
+
+	ctx := context.Background()
+	for _, blob := range blobs {
+		err = u.upload(ctx, p.opts.Config.OCIDir, blob)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
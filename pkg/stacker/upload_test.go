@@ -0,0 +1,243 @@
+package stacker
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	neturl "net/url"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/assert"
+	"stackerbuild.io/stacker/pkg/lib"
+	"stackerbuild.io/stacker/pkg/types"
+)
+
+// fakeRegistry implements the blob uploads of the distribution spec, of the
+// repositories repo and other, failing every failEvery'th chunk after taking
+// half of it.
+type fakeRegistry struct {
+	mu        sync.Mutex
+	blobs     map[string]map[digest.Digest][]byte
+	uploads   map[string][]byte
+	patches   int
+	failEvery int
+	posts     int
+	mounts    int
+}
+
+func (r *fakeRegistry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	repo, _, _ := strings.Cut(strings.TrimPrefix(req.URL.Path, "/v2/"), "/")
+	blobs, ok := r.blobs[repo]
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	uploads := fmt.Sprintf("/v2/%s/blobs/uploads/", repo)
+	switch {
+	case req.Method == http.MethodHead && strings.HasPrefix(req.URL.Path, fmt.Sprintf("/v2/%s/blobs/", repo)):
+		if _, ok := blobs[digest.Digest(path.Base(req.URL.Path))]; !ok {
+			w.WriteHeader(http.StatusNotFound)
+		}
+	case req.Method == http.MethodPost && req.URL.Path == uploads:
+		d := digest.Digest(req.URL.Query().Get("mount"))
+		if content, ok := r.blobs[req.URL.Query().Get("from")][d]; ok {
+			r.mounts++
+			blobs[d] = content
+			w.WriteHeader(http.StatusCreated)
+			return
+		}
+		r.posts++
+		id := fmt.Sprintf("%d", r.posts)
+		r.uploads[id] = []byte{}
+		w.Header().Set("Location", uploads+id)
+		w.WriteHeader(http.StatusAccepted)
+	case strings.HasPrefix(req.URL.Path, uploads):
+		id := strings.TrimPrefix(req.URL.Path, uploads)
+		content, ok := r.uploads[id]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		switch req.Method {
+		case http.MethodGet:
+			if len(content) > 0 {
+				w.Header().Set("Range", fmt.Sprintf("0-%d", len(content)-1))
+			}
+			w.WriteHeader(http.StatusNoContent)
+		case http.MethodPatch:
+			var start, end int
+			fmt.Sscanf(req.Header.Get("Content-Range"), "%d-%d", &start, &end)
+			if start != len(content) {
+				w.WriteHeader(http.StatusRequestedRangeNotSatisfiable)
+				return
+			}
+			chunk, _ := io.ReadAll(req.Body)
+			r.patches++
+			if r.failEvery > 0 && r.patches%r.failEvery == 0 {
+				r.uploads[id] = append(content, chunk[:len(chunk)/2]...)
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+			r.uploads[id] = append(content, chunk...)
+			w.Header().Set("Location", uploads+id)
+			w.WriteHeader(http.StatusAccepted)
+		case http.MethodPut:
+			d := digest.Digest(req.URL.Query().Get("digest"))
+			if d != digest.FromBytes(content) {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			blobs[d] = content
+			delete(r.uploads, id)
+			w.WriteHeader(http.StatusCreated)
+		}
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func writeBlob(t *testing.T, ociDir string, content []byte) ispec.Descriptor {
+	d := digest.FromBytes(content)
+	dir := path.Join(ociDir, "blobs", d.Algorithm().String())
+	assert.NoError(t, os.MkdirAll(dir, 0755))
+	assert.NoError(t, os.WriteFile(path.Join(dir, d.Encoded()), content, 0644))
+	return ispec.Descriptor{Digest: d, Size: int64(len(content))}
+}
+
+func TestBlobUpload(t *testing.T) {
+	assert := assert.New(t)
+
+	registry := &fakeRegistry{
+		blobs:     map[string]map[digest.Digest][]byte{"repo": {}, "other": {}},
+		uploads:   map[string][]byte{},
+		failEvery: 3,
+	}
+	server := httptest.NewServer(registry)
+	defer server.Close()
+	url, err := neturl.Parse(server.URL)
+	assert.NoError(err)
+
+	opts := &PublishArgs{
+		Config: types.StackerConfig{
+			Registries: []lib.Registry{{Prefix: url.Host, RegistryEndpoint: lib.RegistryEndpoint{PlainHTTP: true}}},
+		},
+		UploadChunkSize: 10,
+		UploadRetries:   1,
+	}
+	u, err := newBlobUploader(opts, fmt.Sprintf("docker://%s/repo:latest", url.Host))
+	assert.NoError(err)
+	assert.Equal("http", u.scheme)
+	assert.Equal("repo", u.repo)
+
+	ociDir := t.TempDir()
+	content := bytes.Repeat([]byte("0123456789abcdef"), 10)
+	desc := writeBlob(t, ociDir, content)
+
+	// every third chunk fails, but each retry gets further
+	assert.NoError(u.upload(context.Background(), ociDir, desc))
+	assert.Equal(content, registry.blobs["repo"][desc.Digest])
+	assert.Equal(1, registry.posts)
+
+	// already there
+	patches := registry.patches
+	assert.NoError(u.upload(context.Background(), ociDir, desc))
+	assert.Equal(patches, registry.patches)
+
+	// mounted from the repository it was uploaded to
+	other, err := newBlobUploader(opts, fmt.Sprintf("docker://%s/other:latest", url.Host))
+	assert.NoError(err)
+	other.uploaded = u.uploaded
+	assert.NoError(other.upload(context.Background(), ociDir, desc))
+	assert.Equal(content, registry.blobs["other"][desc.Digest])
+	assert.Equal(1, registry.mounts)
+	assert.Equal(patches, registry.patches)
+
+	// every chunk fails: retries run out
+	registry.failEvery = 1
+	failing := writeBlob(t, ociDir, []byte("something else entirely"))
+	err = u.upload(context.Background(), ociDir, failing)
+	assert.ErrorContains(err, "503")
+	assert.NotContains(registry.blobs["repo"], failing.Digest)
+}
+
+func TestUploadedEnd(t *testing.T) {
+	assert := assert.New(t)
+
+	end, ok := uploadedEnd("0-99")
+	assert.True(ok)
+	assert.EqualValues(100, end)
+
+	// which could also be one byte
+	end, ok = uploadedEnd("bytes=0-0")
+	assert.True(ok)
+	assert.EqualValues(0, end)
+
+	end, ok = uploadedEnd("")
+	assert.True(ok)
+	assert.EqualValues(0, end)
+
+	_, ok = uploadedEnd("5-10")
+	assert.False(ok)
+}
+
+func TestBlobUploadOneByteUploaded(t *testing.T) {
+	assert := assert.New(t)
+
+	registry := &fakeRegistry{
+		blobs:   map[string]map[digest.Digest][]byte{"repo": {}},
+		uploads: map[string][]byte{},
+	}
+	server := httptest.NewServer(registry)
+	defer server.Close()
+	url, err := neturl.Parse(server.URL)
+	assert.NoError(err)
+
+	opts := &PublishArgs{
+		Config: types.StackerConfig{
+			Registries: []lib.Registry{{Prefix: url.Host, RegistryEndpoint: lib.RegistryEndpoint{PlainHTTP: true}}},
+		},
+		UploadChunkSize: 10,
+	}
+	u, err := newBlobUploader(opts, fmt.Sprintf("docker://%s/repo:latest", url.Host))
+	assert.NoError(err)
+
+	ociDir := t.TempDir()
+	content := []byte("0123456789abcdef")
+	desc := writeBlob(t, ociDir, content)
+	f, err := os.Open(path.Join(ociDir, "blobs", "sha256", desc.Digest.Encoded()))
+	assert.NoError(err)
+	defer f.Close()
+
+	ctx := context.Background()
+	location, err := u.start(ctx)
+	assert.NoError(err)
+	location, err = u.patch(ctx, location, f, 0, 1)
+	assert.NoError(err)
+
+	// the registry says "0-0", which is taken to be nothing...
+	offset, ok, err := u.uploadedSize(ctx, location)
+	assert.NoError(err)
+	assert.True(ok)
+	assert.EqualValues(0, offset)
+
+	// ...until it doesn't take the upload from there
+	location, progressed, err := u.sendFrom(ctx, location, f, offset, desc.Size)
+	assert.NoError(err)
+	assert.True(progressed)
+	assert.NoError(u.finish(ctx, location, desc.Digest))
+	assert.Equal(content, registry.blobs["repo"][desc.Digest])
+}
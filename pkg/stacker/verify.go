@@ -0,0 +1,231 @@
+package stacker
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+
+	"github.com/containers/image/v5/manifest"
+	"github.com/opencontainers/go-digest"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"stackerbuild.io/stacker/pkg/lib"
+	"stackerbuild.io/stacker/pkg/types"
+)
+
+// VerifyArgs is what stacker verify checks, besides the imports and the OCI
+// layout.
+type VerifyArgs struct {
+	// Key, if set, is the cosign public key the docker base images have to
+	// be signed with, rather than what the base image policy allows.
+	Key string
+
+	// SkipTLS skips verifying the certificates of the registries the
+	// signatures are fetched from.
+	SkipTLS bool
+}
+
+// VerifyProblem is something stacker verify found to be wrong.
+type VerifyProblem struct {
+	// What is what is wrong, e.g. an import of a layer or a blob.
+	What string
+	Err  error
+}
+
+func (p VerifyProblem) String() string {
+	return fmt.Sprintf("%s: %v", p.What, p.Err)
+}
+
+// Verify checks, without building anything, that the imports of the stacker
+// files at paths with a hash have it, that the blobs of the OCI layout are all
+// there and intact, and that the docker base images are signed with the key of
+// args or else allowed by the base image policy. It returns what it found
+// wrong.
+func (b *Builder) Verify(paths []string, args VerifyArgs) ([]VerifyProblem, error) {
+	config := b.opts.Config
+	problems := []VerifyProblem{}
+
+	policy := config.BaseImagePolicy
+	if args.Key != "" {
+		policy = lib.BaseImagePolicy{Keys: []string{args.Key}}
+	}
+
+	err := b.walkLayers(paths, func(_ string, name string, l types.Layer) error {
+		cache := path.Join(config.StackerDir, "imports", name)
+		imports := append(types.Imports{}, l.Imports...)
+		for _, i := range append(imports, l.LegacyImport...) {
+			err := verifyImportHash(cache, i)
+			if err != nil {
+				problems = append(problems, VerifyProblem{What: fmt.Sprintf("%s import %s", name, i.Path), Err: err})
+			}
+		}
+
+		if policy.Empty() || l.From.Type != types.DockerLayer {
+			return nil
+		}
+
+		src, err := l.From.ContainersImageURL()
+		if err != nil {
+			return err
+		}
+		err = policy.Check(context.Background(), src, args.SkipTLS || l.From.Insecure, config.Registries)
+		if err != nil {
+			problems = append(problems, VerifyProblem{What: fmt.Sprintf("%s base %s", name, src), Err: err})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return append(problems, verifyOCILayout(config.OCIDir)...), nil
+}
+
+// verifyImportHash checks that the import i has its hash, if it has one;
+// http(s) imports have to have been downloaded to cache already. Only file
+// imports have hashes, so the others aren't checked.
+func verifyImportHash(cache string, i types.Import) error {
+	if isRemoteURL(i.Path) {
+		src, fragmentHash := splitChecksumFragment(i.Path)
+		hash := i.Hash
+		if hash == "" {
+			hash = fragmentHash
+		}
+		if hash == "" {
+			return nil
+		}
+
+		cached := cachePath(cache, src, i.Dest)
+		if _, err := os.Stat(cached); err != nil {
+			return errors.Errorf("not downloaded to %s yet", cache)
+		}
+		return verifyImportFileHash(cached, hash)
+	}
+
+	url, err := types.NewDockerishUrl(i.Path)
+	if err != nil {
+		return err
+	}
+	if i.Hash == "" || url.Scheme != "" || isOCIImport(i.Path) || isGitImport(i.Path) {
+		return nil
+	}
+
+	fi, err := os.Stat(i.Path)
+	if err != nil {
+		return errors.Wrapf(err, "couldn't stat import")
+	}
+	if fi.IsDir() {
+		return nil
+	}
+	return verifyImportFileHash(i.Path, i.Hash)
+}
+
+// verifyOCILayout checks that the blobs of every image of the OCI layout at
+// dir, from the index down, exist and have their digests and sizes.
+func verifyOCILayout(dir string) []VerifyProblem {
+	content, err := os.ReadFile(path.Join(dir, "index.json"))
+	if os.IsNotExist(err) {
+		// nothing built yet
+		return nil
+	}
+	if err != nil {
+		return []VerifyProblem{{What: dir, Err: errors.Wrapf(err, "couldn't read the index")}}
+	}
+
+	index := ispec.Index{}
+	err = json.Unmarshal(content, &index)
+	if err != nil {
+		return []VerifyProblem{{What: dir, Err: errors.Wrapf(err, "couldn't parse the index")}}
+	}
+
+	problems := []VerifyProblem{}
+	verified := map[digest.Digest]bool{}
+	var verify func(desc ispec.Descriptor)
+	verify = func(desc ispec.Descriptor) {
+		if verified[desc.Digest] {
+			return
+		}
+		verified[desc.Digest] = true
+
+		children, err := verifyBlob(dir, desc)
+		if err != nil {
+			problems = append(problems, VerifyProblem{What: fmt.Sprintf("blob %s", desc.Digest), Err: err})
+			return
+		}
+		for _, child := range children {
+			verify(child)
+		}
+	}
+
+	for _, desc := range index.Manifests {
+		verify(desc)
+	}
+
+	return problems
+}
+
+// verifyBlob checks the blob of desc in the OCI layout dir, returning the
+// descriptors it refers to if it's a manifest or an index.
+func verifyBlob(dir string, desc ispec.Descriptor) ([]ispec.Descriptor, error) {
+	if err := desc.Digest.Validate(); err != nil {
+		return nil, errors.Wrapf(err, "bad digest")
+	}
+
+	f, err := os.Open(path.Join(dir, "blobs", desc.Digest.Algorithm().String(), desc.Digest.Encoded()))
+	if os.IsNotExist(err) && len(desc.URLs) > 0 {
+		// a foreign layer, which is only downloaded when it's used
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "missing")
+	}
+	defer f.Close()
+
+	var content []byte
+	switch desc.MediaType {
+	case ispec.MediaTypeImageManifest, ispec.MediaTypeImageIndex, manifest.DockerV2Schema2MediaType, manifest.DockerV2ListMediaType:
+		content, err = io.ReadAll(io.LimitReader(f, desc.Size+1))
+		if err != nil {
+			return nil, errors.Wrapf(err, "couldn't read")
+		}
+		if int64(len(content)) != desc.Size {
+			return nil, errors.Errorf("size is %d, not %d", len(content), desc.Size)
+		}
+		if actual := desc.Digest.Algorithm().FromBytes(content); actual != desc.Digest {
+			return nil, errors.Errorf("digest is %s", actual)
+		}
+	default:
+		digester := desc.Digest.Algorithm().Digester()
+		n, err := io.Copy(digester.Hash(), f)
+		if err != nil {
+			return nil, errors.Wrapf(err, "couldn't read")
+		}
+		if n != desc.Size {
+			return nil, errors.Errorf("size is %d, not %d", n, desc.Size)
+		}
+		if actual := digester.Digest(); actual != desc.Digest {
+			return nil, errors.Errorf("digest is %s", actual)
+		}
+		return nil, nil
+	}
+
+	// manifests and indexes, of either OCI or docker images
+	refs := struct {
+		Config    *ispec.Descriptor  `json:"config"`
+		Layers    []ispec.Descriptor `json:"layers"`
+		Manifests []ispec.Descriptor `json:"manifests"`
+	}{}
+	err = json.Unmarshal(content, &refs)
+	if err != nil {
+		return nil, errors.Wrapf(err, "couldn't parse")
+	}
+
+	children := append(refs.Layers, refs.Manifests...)
+	if refs.Config != nil {
+		children = append(children, *refs.Config)
+	}
+	return children, nil
+}
@@ -0,0 +1,74 @@
+package stacker
+
+import (
+	"context"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/opencontainers/umoci"
+	"github.com/stretchr/testify/assert"
+	"stackerbuild.io/stacker/pkg/types"
+)
+
+func TestVerifyOCILayout(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+
+	dir := path.Join(t.TempDir(), "oci")
+	assert.Empty(verifyOCILayout(dir))
+
+	oci, err := umoci.CreateLayout(dir)
+	assert.NoError(err)
+	defer oci.Close()
+	putTarImage(t, oci, "a", []tarEntry{{name: "etc/a", content: "a"}}, []tarEntry{{name: "etc/b", content: "b"}})
+	putTarImage(t, oci, "b", []tarEntry{{name: "etc/a", content: "a"}})
+	assert.Empty(verifyOCILayout(dir))
+
+	manifest := func(tag string) ispec.Manifest {
+		descPaths, err := oci.ResolveReference(ctx, tag)
+		assert.NoError(err)
+		blob, err := oci.FromDescriptor(ctx, descPaths[0].Descriptor())
+		assert.NoError(err)
+		return blob.Data.(ispec.Manifest)
+	}
+	blobPath := func(desc ispec.Descriptor) string {
+		return path.Join(dir, "blobs", desc.Digest.Algorithm().String(), desc.Digest.Encoded())
+	}
+
+	// the layer both images share is only reported once
+	layer := manifest("b").Layers[0]
+	assert.NoError(os.WriteFile(blobPath(layer), []byte("something else"), 0644))
+	config := manifest("a").Config
+	assert.NoError(os.Remove(blobPath(config)))
+
+	problems := verifyOCILayout(dir)
+	assert.Len(problems, 2)
+	whats := map[string]string{}
+	for _, p := range problems {
+		whats[p.What] = p.Err.Error()
+	}
+	assert.Contains(whats["blob "+layer.Digest.String()], "size is 14")
+	assert.Contains(whats["blob "+config.Digest.String()], "missing")
+}
+
+func TestVerifyImportHash(t *testing.T) {
+	assert := assert.New(t)
+
+	dir := t.TempDir()
+	file := path.Join(dir, "file")
+	assert.NoError(os.WriteFile(file, []byte("hello\n"), 0644))
+	hash := "5891b5b522d5df086d0ff0b110fbd9d21bb4fc7163af34d08286a2e846f6be03"
+
+	assert.NoError(verifyImportHash(dir, types.Import{Path: file, Hash: hash}))
+	assert.NoError(verifyImportHash(dir, types.Import{Path: file}))
+	assert.ErrorContains(verifyImportHash(dir, types.Import{Path: file, Hash: strings.Repeat("0", 64)}), "different than the actual hash")
+
+	url := "https://example.com/file"
+	assert.ErrorContains(verifyImportHash(path.Join(dir, "cache"), types.Import{Path: url, Hash: hash}), "not downloaded")
+	assert.NoError(verifyImportHash(dir, types.Import{Path: url, Hash: hash}))
+	assert.NoError(verifyImportHash(dir, types.Import{Path: url + "#sha256=" + hash}))
+	assert.NoError(verifyImportHash(path.Join(dir, "cache"), types.Import{Path: url}))
+}
@@ -0,0 +1,101 @@
+package stacker
+
+import (
+	"context"
+	"os"
+	"strconv"
+
+	"github.com/pkg/errors"
+	"stackerbuild.io/stacker/pkg/lib"
+)
+
+// Match is how a local file compares to what a server has at a url.
+type Match int
+
+const (
+	// NoMatch means neither the checksum nor the length match.
+	NoMatch Match = iota
+	// HashMatch means the local file has the checksum the server
+	// advertises.
+	HashMatch
+	// LengthMatch means the server advertises no matching checksum, but
+	// the local file has the length the server advertises. This is the
+	// leap of faith Download takes for cached copies.
+	LengthMatch
+)
+
+func (m Match) String() string {
+	switch m {
+	case HashMatch:
+		return "hash match"
+	case LengthMatch:
+		return "length match"
+	default:
+		return "mismatch"
+	}
+}
+
+// matchRemote compares a local file's hash and length with the checksum and
+// length a server advertises, the same way for cached copies and for
+// VerifyLocalAgainstRemote. An empty remoteHash never matches.
+func matchRemote(localHash string, localSize string, remoteHash string, remoteSize string) Match {
+	if remoteHash != "" && localHash == remoteHash {
+		return HashMatch
+	}
+	if localSize == remoteSize {
+		return LengthMatch
+	}
+	return NoMatch
+}
+
+// LocalInfo describes a local file compared with a url by
+// VerifyLocalAgainstRemote.
+type LocalInfo struct {
+	Size int64
+	// Checksum is the hex encoded digest of the file, computed with
+	// Algorithm: that of the checksum the server advertises, or sha256 if
+	// it advertises none.
+	Checksum  string
+	Algorithm string
+	// Match is how the file compares to what the server has.
+	Match Match
+}
+
+// VerifyLocalAgainstRemote checks whether localPath is what the server would
+// serve for url, without downloading it or touching any cache: the file is
+// hashed and compared with what FileInfo reports, by checksum or, if that
+// doesn't match, by length. It returns true if either matches.
+func VerifyLocalAgainstRemote(localPath, url string) (bool, RemoteInfo, LocalInfo, error) {
+	remote, err := FileInfo(context.Background(), url)
+	if err != nil {
+		return false, RemoteInfo{}, LocalInfo{}, err
+	}
+
+	algorithm, remoteHash := pickRemoteChecksum(url, remote, nil)
+	if algorithm == "" {
+		algorithm = "sha256"
+	}
+
+	local := LocalInfo{Algorithm: algorithm}
+	local.Checksum, err = lib.HashFileAlgorithm(localPath, algorithm)
+	if err != nil {
+		return false, remote, local, err
+	}
+
+	fi, err := os.Stat(localPath)
+	if err != nil {
+		return false, remote, local, errors.WithStack(err)
+	}
+	local.Size = fi.Size()
+
+	remoteSize := ""
+	if remote.Size >= 0 {
+		remoteSize = strconv.FormatInt(remote.Size, 10)
+	}
+
+	local.Match = matchRemote(local.Checksum, strconv.FormatInt(local.Size, 10), remoteHash, remoteSize)
+	netLog.Debugf("%s against %s: %s (local %s %s, length %d; remote %s, length %d)",
+		localPath, url, local.Match, algorithm, local.Checksum, local.Size, remoteHash, remote.Size)
+
+	return local.Match != NoMatch, remote, local, nil
+}
@@ -0,0 +1,52 @@
+package stacker
+
+import (
+	"net/http"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestVerifyLocalAgainstRemote(t *testing.T) {
+	assert := assert.New(t)
+
+	content := []byte("hello world")
+	srv := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/signed" {
+			w.Header().Set("X-Checksum-Sha256", "b94d27b9934d3e08a52e52d7da7dabfac484efe37a5380ee9088f7ace2efcde9")
+		}
+		assert.Equal(http.MethodHead, r.Method)
+		w.Write(content)
+	})
+
+	dir := t.TempDir()
+	same := path.Join(dir, "same")
+	assert.NoError(os.WriteFile(same, content, 0644))
+	other := path.Join(dir, "other")
+	assert.NoError(os.WriteFile(other, []byte("hello WORLD"), 0644))
+	short := path.Join(dir, "short")
+	assert.NoError(os.WriteFile(short, []byte("hello"), 0644))
+
+	ok, _, local, err := VerifyLocalAgainstRemote(same, srv.URL+"/signed")
+	assert.NoError(err)
+	assert.True(ok)
+	assert.Equal(HashMatch, local.Match)
+
+	ok, _, local, err = VerifyLocalAgainstRemote(other, srv.URL+"/unsigned")
+	assert.NoError(err)
+	assert.True(ok)
+	assert.Equal(LengthMatch, local.Match)
+
+	ok, remote, local, err := VerifyLocalAgainstRemote(short, srv.URL+"/signed")
+	assert.NoError(err)
+	assert.False(ok)
+	assert.Equal(NoMatch, local.Match)
+	assert.EqualValues(11, remote.Size)
+	assert.EqualValues(5, local.Size)
+
+	entries, err := os.ReadDir(dir)
+	assert.NoError(err)
+	assert.Len(entries, 3)
+}
@@ -0,0 +1,71 @@
+package types
+
+import (
+	"path"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// CacheDir is a directory that the run section of a layer keeps its caches
+// in (e.g. /root/.cache/go-build), which persists from one build to the next
+// and isn't part of the layer.
+type CacheDir struct {
+	// Dest is where it is mounted in the container.
+	Dest string `yaml:"dest" json:"dest"`
+
+	// ID names the directory stacker keeps it in, so that layers with
+	// the same ID share it; by default it's derived from Dest.
+	ID string `yaml:"id" json:"id,omitempty"`
+
+	// Source, if set, is a directory on the host that is used instead
+	// of one stacker keeps.
+	Source string `yaml:"source" json:"source,omitempty"`
+}
+
+type CacheDirs []CacheDir
+
+func (cd *CacheDir) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	dest := ""
+	if err := unmarshal(&dest); err == nil {
+		*cd = CacheDir{Dest: dest}
+		return nil
+	}
+
+	type cacheDir CacheDir
+	return unmarshal((*cacheDir)(cd))
+}
+
+// CacheID is the ID of the directory stacker keeps cd in.
+func (cd CacheDir) CacheID() string {
+	if cd.ID != "" {
+		return cd.ID
+	}
+	return strings.ReplaceAll(strings.Trim(path.Clean(cd.Dest), "/"), "/", "-")
+}
+
+func (cd CacheDir) validate() error {
+	if !path.IsAbs(cd.Dest) || path.Clean(cd.Dest) == "/" {
+		return errors.Errorf("invalid cache dir dest %q: expected an absolute path", cd.Dest)
+	}
+
+	if cd.ID != "" && (strings.Contains(cd.ID, "/") || cd.ID == "." || cd.ID == "..") {
+		return errors.Errorf("invalid cache dir id %q", cd.ID)
+	}
+
+	return nil
+}
+
+func (cds CacheDirs) validate() error {
+	dests := map[string]bool{}
+	for _, cd := range cds {
+		if err := cd.validate(); err != nil {
+			return err
+		}
+		if dests[path.Clean(cd.Dest)] {
+			return errors.Errorf("duplicate cache dir %s", cd.Dest)
+		}
+		dests[path.Clean(cd.Dest)] = true
+	}
+	return nil
+}
@@ -0,0 +1,71 @@
+package types
+
+import (
+	"fmt"
+
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+)
+
+const (
+	GzipCompression = "gzip"
+	ZstdCompression = "zstd"
+
+	// EstargzCompression is gzip, in the seekable eStargz format that
+	// containerd's stargz snapshotter can lazily pull.
+	EstargzCompression = "estargz"
+)
+
+// TarCompression is how tar layers are compressed: with Algorithm (gzip if
+// it is empty) at Level, or at the algorithm's default level if it is zero.
+type TarCompression struct {
+	Algorithm string `json:",omitempty"`
+	Level     int    `json:",omitempty"`
+}
+
+// NewTarCompression validates the compression of tar layers with algorithm
+// at level.
+func NewTarCompression(algorithm string, level int) (TarCompression, error) {
+	var max int
+	switch algorithm {
+	case "", GzipCompression:
+		algorithm = GzipCompression
+		max = 9
+	case EstargzCompression:
+		max = 9
+	case ZstdCompression:
+		max = 22
+	default:
+		return TarCompression{}, errors.Errorf("invalid tar layer compression %s: expected %s, %s or %s",
+			algorithm, GzipCompression, ZstdCompression, EstargzCompression)
+	}
+
+	if level < 0 || level > max {
+		return TarCompression{}, errors.Errorf("invalid %s compression level %d: expected 1 to %d", algorithm, level, max)
+	}
+
+	return TarCompression{Algorithm: algorithm, Level: level}, nil
+}
+
+// Name is the name of the compression algorithm.
+func (c TarCompression) Name() string {
+	if c.Algorithm == "" {
+		return GzipCompression
+	}
+	return c.Algorithm
+}
+
+func (c TarCompression) String() string {
+	if c.Level == 0 {
+		return c.Name()
+	}
+	return fmt.Sprintf("%s:%d", c.Name(), c.Level)
+}
+
+// MediaType is the media type of tar layers compressed this way.
+func (c TarCompression) MediaType() string {
+	if c.Name() == EstargzCompression {
+		return ispec.MediaTypeImageLayerGzip
+	}
+	return ispec.MediaTypeImageLayer + "+" + c.Name()
+}
@@ -4,6 +4,11 @@ import (
 	"embed"
 	"fmt"
 	"path"
+	"runtime"
+	"strings"
+	"time"
+
+	"stackerbuild.io/stacker/pkg/lib"
 )
 
 // StackerConfig is a struct that contains global (or widely used) stacker
@@ -16,19 +21,133 @@ type StackerConfig struct {
 	Debug       bool   `yaml:"-"`
 	StorageType string `yaml:"-"`
 
+	// Platform is the os/arch[/variant] being built for when building
+	// for several platforms (see stacker build --platforms), where each
+	// of them gets its own stacker, rootfs and OCI dirs. Empty means the
+	// platform stacker runs on.
+	Platform string `yaml:"-"`
+
+	// SourceDateEpoch, if set, is what the timestamps of the layers that
+	// are built are clamped to, so that they are reproducible (see stacker
+	// build --reproducible-strict).
+	SourceDateEpoch *time.Time `yaml:"-"`
+
+	// TarCompression is how the tar layers that are built are compressed
+	// (see stacker build --tar-compression).
+	TarCompression TarCompression `yaml:"-"`
+
+	// ConnectTimeout and StallTimeout bound how long downloading an import
+	// may block; see stacker.DownloadOptions.
+	ConnectTimeout time.Duration `yaml:"connect_timeout,omitempty"`
+	StallTimeout   time.Duration `yaml:"stall_timeout,omitempty"`
+
+	// BaseStackerDirs are other (e.g. shared) stacker dirs whose import
+	// caches are used, read-only, before downloading anything.
+	BaseStackerDirs []string `yaml:"base_stacker_dirs,omitempty"`
+
+	// CacheDirPerBuild starts every build with an empty import cache, so
+	// that only BaseStackerDirs are shared between builds.
+	CacheDirPerBuild bool `yaml:"cache_dir_per_build,omitempty"`
+
+	// ChecksumPolicy is how much downloads insist on being verified; see
+	// stacker.ChecksumPolicy.
+	ChecksumPolicy string `yaml:"checksum_policy,omitempty"`
+
+	// SizeChangePolicy is what happens when a cached import with a pinned
+	// hash changes size upstream; see stacker.SizeChangePolicy.
+	SizeChangePolicy string `yaml:"size_change_policy,omitempty"`
+
+	// CacheProxy is the base URL of a pull-through cache that downloads
+	// are requested from; see stacker.DownloadOptions.
+	CacheProxy string `yaml:"cache_proxy,omitempty"`
+
+	// DownloadNetwork pins downloads to "tcp4" or "tcp6"; see
+	// stacker.DownloadOptions.
+	DownloadNetwork string `yaml:"download_network,omitempty"`
+
+	// DownloadRetries is how many more times a download that failed with
+	// a transient error is attempted, waiting DownloadRetryBackoff (or a
+	// second) before the first retry, and twice as long after each one.
+	// DownloadRetryStatusCodes are the http statuses that are worth
+	// retrying, 5xx and 429 by default; see stacker.DownloadOptions.
+	DownloadRetries          int           `yaml:"download_retries,omitempty"`
+	DownloadRetryBackoff     time.Duration `yaml:"download_retry_backoff,omitempty"`
+	DownloadRetryStatusCodes []int         `yaml:"download_retry_status_codes,omitempty"`
+
+	// DownloadConcurrency is how many of a layer's imports are downloaded
+	// at once; one at a time if zero.
+	DownloadConcurrency int `yaml:"download_concurrency,omitempty"`
+
+	// DownloadRateLimits limit how fast imports are downloaded from each
+	// server.
+	DownloadRateLimits RateLimits `yaml:"download_rate_limits,omitempty"`
+
+	// DownloadCredentials authenticate downloads from the URLs they are
+	// for; see stacker.Credentials.
+	DownloadCredentials []DownloadCredential `yaml:"download_credentials,omitempty"`
+
+	// Registries are how the images of each registry are pulled (by
+	// docker type layers and --cache-from) and pushed (by stacker publish
+	// and --cache-to): through mirrors, at another location, or with a
+	// private CA or without TLS. They replace the system's
+	// registries.conf and certs.d.
+	Registries []lib.Registry `yaml:"registries,omitempty"`
+
+	// BaseImagePolicy is which images docker type layers may be built
+	// from; they are checked before they are pulled.
+	BaseImagePolicy lib.BaseImagePolicy `yaml:"base_image_policy,omitempty"`
+
+	// Security is how the run sections of the layers that don't set
+	// their own security are locked down.
+	Security Security `yaml:"security,omitempty"`
+
 	// EmbeddedFS should contain a (statically linked) lxc-wrapper binary
 	// (built from cmd/lxc-wrapper/lxc-wrapper.c) at
 	// lxc-wrapper/lxc-wrapper.
 	EmbeddedFS embed.FS `yaml:"-"`
 }
 
+// RateLimit caps how fast stacker downloads from a server; zero fields are
+// unlimited.
+type RateLimit struct {
+	BytesPerSecond    int64   `yaml:"bytes_per_second,omitempty" json:"bytes_per_second,omitempty"`
+	RequestsPerSecond float64 `yaml:"requests_per_second,omitempty" json:"requests_per_second,omitempty"`
+}
+
+// DownloadCredential is how to authenticate downloads of the URLs starting
+// with URL: with a bearer token read from the environment variable TokenEnv,
+// or else with Username and Password (or the password in the environment
+// variable PasswordEnv, which keeps it out of the config file).
+type DownloadCredential struct {
+	URL         string `yaml:"url"`
+	Username    string `yaml:"username,omitempty"`
+	Password    string `yaml:"password,omitempty"`
+	PasswordEnv string `yaml:"password_env,omitempty"`
+	TokenEnv    string `yaml:"token_env,omitempty"`
+}
+
+// RateLimits are the RateLimit of each server (by host, as in the URL), and
+// the Default one shared by all other servers.
+type RateLimits struct {
+	Default RateLimit            `yaml:"default,omitempty" json:"default"`
+	Hosts   map[string]RateLimit `yaml:"hosts,omitempty" json:"hosts,omitempty"`
+}
+
 // Substitutions - return an array of substitutions for StackerFiles
 func (sc *StackerConfig) Substitutions() []string {
+	goos, goarch := runtime.GOOS, runtime.GOARCH
+	if platformOS, rest, ok := strings.Cut(sc.Platform, "/"); ok {
+		goos = platformOS
+		goarch, _, _ = strings.Cut(rest, "/")
+	}
+
 	return []string{
 		fmt.Sprintf("STACKER_ROOTFS_DIR=%s", sc.RootFSDir),
 		fmt.Sprintf("STACKER_STACKER_DIR=%s", sc.StackerDir),
 		fmt.Sprintf("STACKER_OCI_DIR=%s", sc.OCIDir),
 		fmt.Sprintf("STACKER_WORK_DIR=%s", sc.WorkDir),
+		fmt.Sprintf("STACKER_OS=%s", goos),
+		fmt.Sprintf("STACKER_ARCH=%s", goarch),
 	}
 }
 
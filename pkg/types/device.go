@@ -0,0 +1,78 @@
+package types
+
+import (
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Device is a device node of the host that is passed through to the
+// container the run section of a layer runs in, e.g. /dev/kvm.
+type Device struct {
+	// Path is the device node on the host.
+	Path string `yaml:"path" json:"path"`
+
+	// Dest is where it is in the container, the same path by default.
+	Dest string `yaml:"dest" json:"dest,omitempty"`
+
+	// Permissions are what the container may do with it, as in the
+	// devices cgroup: some of r(ead), w(rite) and m(knod); rwm by default.
+	Permissions string `yaml:"permissions" json:"permissions,omitempty"`
+}
+
+type Devices []Device
+
+func (d *Device) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	path := ""
+	if err := unmarshal(&path); err == nil {
+		*d = Device{Path: path}
+		return nil
+	}
+
+	type device Device
+	return unmarshal((*device)(d))
+}
+
+// DestPath is where d is in the container.
+func (d Device) DestPath() string {
+	if d.Dest == "" {
+		return d.Path
+	}
+	return d.Dest
+}
+
+// CgroupPermissions are what the container may do with d.
+func (d Device) CgroupPermissions() string {
+	if d.Permissions == "" {
+		return "rwm"
+	}
+	return d.Permissions
+}
+
+func (d Device) validate() error {
+	if !filepath.IsAbs(d.Path) {
+		return errors.Errorf("device %q isn't an absolute path", d.Path)
+	}
+
+	if !filepath.IsAbs(d.DestPath()) {
+		return errors.Errorf("dest %s of device %s isn't an absolute path", d.Dest, d.Path)
+	}
+
+	for _, p := range d.CgroupPermissions() {
+		if !strings.ContainsRune("rwm", p) || strings.Count(d.CgroupPermissions(), string(p)) != 1 {
+			return errors.Errorf("invalid permissions %s of device %s: expected some of r, w and m", d.Permissions, d.Path)
+		}
+	}
+
+	return nil
+}
+
+func (ds Devices) validate() error {
+	for _, d := range ds {
+		if err := d.validate(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
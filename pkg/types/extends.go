@@ -0,0 +1,133 @@
+package types
+
+import (
+	"maps"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// templatePrefix marks the layers of a stackerfile that are never built, and
+// are only there for other layers to extend.
+const templatePrefix = "."
+
+// IsTemplate returns true if name is a template rather than a layer.
+func IsTemplate(name string) bool {
+	return strings.HasPrefix(name, templatePrefix)
+}
+
+// optional is set if it was, or else is fallback.
+func optional[T comparable](set T, fallback T) T {
+	var zero T
+	if set == zero {
+		return fallback
+	}
+	return set
+}
+
+// union is base with the entries of m added, replacing those with the same
+// keys.
+func union(base map[string]string, m map[string]string) map[string]string {
+	if len(base) == 0 {
+		return m
+	}
+	ret := maps.Clone(base)
+	maps.Copy(ret, m)
+	return ret
+}
+
+// extend returns l on top of base: lists (the run steps, imports, binds, etc.)
+// are those of base followed by those of l, maps are merged with the entries
+// of l winning, and everything else is taken from base unless l sets it.
+// build_only isn't inherited, so that build only layers can be extended by
+// ones that are published.
+func (l Layer) extend(base Layer) Layer {
+	ret := l
+
+	if l.From.Type == "" {
+		ret.From = base.From
+	}
+
+	ret.Imports = append(append(Imports{}, base.Imports...), l.Imports...)
+	ret.LegacyImport = append(append(Imports{}, base.LegacyImport...), l.LegacyImport...)
+	ret.OverlayDirs = append(append(OverlayDirs{}, base.OverlayDirs...), l.OverlayDirs...)
+	ret.Run = append(append(StringList{}, base.Run...), l.Run...)
+	ret.BuildEnvPt = append(append([]string{}, base.BuildEnvPt...), l.BuildEnvPt...)
+	ret.Volumes = append(append([]string{}, base.Volumes...), l.Volumes...)
+	ret.GenerateLabels = append(append(StringList{}, base.GenerateLabels...), l.GenerateLabels...)
+	ret.Binds = append(append(Binds{}, base.Binds...), l.Binds...)
+	ret.Secrets = append(append(Secrets{}, base.Secrets...), l.Secrets...)
+	ret.Devices = append(append(Devices{}, base.Devices...), l.Devices...)
+	ret.CacheDirs = append(append(CacheDirs{}, base.CacheDirs...), l.CacheDirs...)
+
+	ret.BuildEnv = union(base.BuildEnv, l.BuildEnv)
+	ret.Environment = union(base.Environment, l.Environment)
+	ret.Labels = union(base.Labels, l.Labels)
+	ret.Annotations = union(base.Annotations, l.Annotations)
+
+	if l.Cmd == nil {
+		ret.Cmd = base.Cmd
+	}
+	if l.Entrypoint == nil {
+		ret.Entrypoint = base.Entrypoint
+	}
+	if l.FullCommand == nil {
+		ret.FullCommand = base.FullCommand
+	}
+	ret.WorkingDir = optional(l.WorkingDir, base.WorkingDir)
+	ret.Network = optional(l.Network, base.Network)
+	ret.Squash = optional(l.Squash, base.Squash)
+	ret.Resources = l.Resources.Or(base.Resources)
+	ret.Security = l.Security.Or(base.Security)
+	ret.RuntimeUser = optional(l.RuntimeUser, base.RuntimeUser)
+	ret.OS = optional(l.OS, base.OS)
+	ret.Arch = optional(l.Arch, base.Arch)
+	ret.Bom = optional(l.Bom, base.Bom)
+	ret.WasLegacyImport = l.WasLegacyImport || base.WasLegacyImport
+
+	return ret
+}
+
+// resolveExtends replaces each of the layers that extends another, as named in
+// extends, by itself on top of that layer. The layers extended are looked up
+// in layers first and then in included, the (already resolved) layers of the
+// stackerfiles that were included.
+func resolveExtends(layers map[string]Layer, extends map[string]string, included map[string]Layer) error {
+	resolved := map[string]bool{}
+
+	var resolve func(name string, chain []string) error
+	resolve = func(name string, chain []string) error {
+		baseName, ok := extends[name]
+		if !ok || resolved[name] {
+			return nil
+		}
+
+		for _, other := range chain {
+			if other == name {
+				return errors.Errorf("%s: extends cycle: %s", name, strings.Join(append(chain, name), " -> "))
+			}
+		}
+
+		base, ok := layers[baseName]
+		if ok {
+			if err := resolve(baseName, append(chain, name)); err != nil {
+				return err
+			}
+			base = layers[baseName]
+		} else if base, ok = included[baseName]; !ok {
+			return errors.Errorf("%s: couldn't find %s to extend", name, baseName)
+		}
+
+		layers[name] = layers[name].extend(base)
+		resolved[name] = true
+		return nil
+	}
+
+	for name := range extends {
+		if err := resolve(name, nil); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
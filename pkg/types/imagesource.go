@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"path"
 	"reflect"
+	"regexp"
 	"strings"
 
 	"github.com/pkg/errors"
@@ -81,6 +82,12 @@ func (is *ImageSource) ContainersImageURL() (string, error) {
 		return is.Url, nil
 	case OCILayer:
 		return fmt.Sprintf("oci:%s", is.Url), nil
+	case DockerArchiveLayer, OCIArchiveLayer:
+		// the tag, if set, picks one of the images in the archive
+		if is.Tag != "" {
+			return fmt.Sprintf("%s:%s:%s", is.Type, is.Url, is.Tag), nil
+		}
+		return fmt.Sprintf("%s:%s", is.Type, is.Url), nil
 	default:
 		return "", errors.Errorf("can't get containers/image url for source type: %s", is.Type)
 	}
@@ -111,6 +118,12 @@ func (is *ImageSource) ParseTag() (string, error) {
 		}
 
 		return pieces[1], nil
+	case DockerArchiveLayer, OCIArchiveLayer:
+		tag := strings.TrimSuffix(path.Base(is.Url), path.Ext(is.Url))
+		if is.Tag != "" {
+			tag += "_" + is.Tag
+		}
+		return invalidTagChars.ReplaceAllString(tag, "_"), nil
 	default:
 		return "", errors.Errorf("unsupported type: %s", is.Type)
 	}
@@ -118,6 +131,10 @@ func (is *ImageSource) ParseTag() (string, error) {
 
 var (
 	imageSourceFields []string
+
+	// invalidTagChars are what can't be in the tags of images in an OCI
+	// layout.
+	invalidTagChars = regexp.MustCompile(`[^A-Za-z0-9._-]`)
 )
 
 func init() {
@@ -10,6 +10,7 @@ import (
 	"regexp"
 	"runtime"
 	"strings"
+	"time"
 
 	"github.com/anmitsu/go-shlex"
 	"github.com/pkg/errors"
@@ -19,11 +20,13 @@ import (
 )
 
 const (
-	DockerLayer  = "docker"
-	TarLayer     = "tar"
-	OCILayer     = "oci"
-	BuiltLayer   = "built"
-	ScratchLayer = "scratch"
+	DockerLayer        = "docker"
+	TarLayer           = "tar"
+	OCILayer           = "oci"
+	BuiltLayer         = "built"
+	ScratchLayer       = "scratch"
+	DockerArchiveLayer = "docker-archive"
+	OCIArchiveLayer    = "oci-archive"
 )
 
 const (
@@ -32,12 +35,21 @@ const (
 	LicenseAnnotation = "org.opencontainers.image.licenses"
 )
 
+// The networks a layer's run section can have: the host's, which is the
+// default, or none at all.
+const (
+	NetworkHost = "host"
+	NetworkNone = "none"
+)
+
 func IsContainersImageLayer(from string) bool {
 	switch from {
 	case DockerLayer:
 		return true
 	case OCILayer:
 		return true
+	case DockerArchiveLayer, OCIArchiveLayer:
+		return true
 	}
 
 	return false
@@ -50,6 +62,13 @@ type Import struct {
 	Mode *fs.FileMode `yaml:"mode" json:"mode,omitempty"`
 	Uid  int          `yaml:"uid" json:"uid,omitempty"`
 	Gid  int          `yaml:"gid" json:"gid,omitempty"`
+	Size int          `yaml:"size" json:"size,omitempty"`
+	// TTL is how long a downloaded copy is used before it is
+	// revalidated with the server, e.g. "24h"; forever if zero.
+	TTL time.Duration `yaml:"ttl" json:"ttl,omitempty"`
+	// Critical imports are those the build can't do without: when one
+	// fails to download, the other downloads are abandoned.
+	Critical bool `yaml:"critical" json:"critical,omitempty"`
 }
 
 type Imports []Import
@@ -254,7 +273,14 @@ type Layer struct {
 	GenerateLabels  StringList        `yaml:"generate_labels" json:"generate_labels,omitempty"`
 	WorkingDir      string            `yaml:"working_dir" json:"working_dir,omitempty"`
 	BuildOnly       bool              `yaml:"build_only" json:"build_only,omitempty"`
+	Squash          Squash            `yaml:"squash" json:"squash,omitempty"`
 	Binds           Binds             `yaml:"binds" json:"binds,omitempty"`
+	Secrets         Secrets           `yaml:"secrets" json:"secrets,omitempty"`
+	Network         string            `yaml:"network" json:"network,omitempty"`
+	Resources       Resources         `yaml:"resources" json:"resources,omitempty" hash:"ignore"`
+	Security        Security          `yaml:"security" json:"security,omitempty"`
+	Devices         Devices           `yaml:"devices" json:"devices,omitempty"`
+	CacheDirs       CacheDirs         `yaml:"cache_dirs" json:"cache_dirs,omitempty" hash:"ignore"`
 	RuntimeUser     string            `yaml:"runtime_user" json:"runtime_user,omitempty"`
 	Annotations     map[string]string `yaml:"annotations" json:"annotations,omitempty"`
 	OS              *string           `yaml:"os" json:"os,omitempty"`
@@ -263,11 +289,28 @@ type Layer struct {
 	WasLegacyImport bool              `yaml:"was_legacy_import" json:"was_legacy_import,omitempty"`
 }
 
-func parseLayers(referenceDirectory string, lms yaml.MapSlice, requireHash bool) (map[string]Layer, error) {
+func parseLayers(referenceDirectory string, lms yaml.MapSlice, requireHash bool, included map[string]Layer) (map[string]Layer, error) {
+	// the layer each layer extends, if any
+	extends := map[string]string{}
+
 	// Let's make sure that all the things people supplied in the layers are
 	// actually things this stacker understands.
 	for _, e := range lms {
-		for _, directive := range e.Value.(yaml.MapSlice) {
+		layerDirectives, ok := e.Value.(yaml.MapSlice)
+		if !ok {
+			return nil, errors.Errorf("stackerfile: %v isn't a layer definition", e.Key)
+		}
+
+		for _, directive := range layerDirectives {
+			if directive.Key.(string) == "extends" {
+				base, ok := directive.Value.(string)
+				if !ok || base == "" {
+					return nil, errors.Errorf("stackerfile: %v: extends must be the name of a layer", e.Key)
+				}
+				extends[e.Key.(string)] = base
+				continue
+			}
+
 			found := false
 			for _, field := range layerFields {
 				if directive.Key.(string) == field {
@@ -317,6 +360,10 @@ func parseLayers(referenceDirectory string, lms yaml.MapSlice, requireHash bool)
 		return nil, err
 	}
 
+	if err := resolveExtends(ret, extends, included); err != nil {
+		return nil, err
+	}
+
 	for name, layer := range ret {
 		if requireHash {
 			err = requireImportHash(layer.Imports)
@@ -330,6 +377,10 @@ func parseLayers(referenceDirectory string, lms yaml.MapSlice, requireHash bool)
 			if len(layer.From.Tag) == 0 {
 				return nil, errors.Errorf("%s: from tag cannot be empty for image type 'built'", name)
 			}
+		case DockerArchiveLayer, OCIArchiveLayer:
+			if len(layer.From.Url) == 0 {
+				return nil, errors.Errorf("%s: from url cannot be empty for image type '%s'", name, layer.From.Type)
+			}
 		}
 
 		if layer.Bom != nil && layer.Bom.Generate {
@@ -351,6 +402,32 @@ func parseLayers(referenceDirectory string, lms yaml.MapSlice, requireHash bool)
 			}
 		}
 
+		if err := layer.Secrets.validate(); err != nil {
+			return nil, errors.Wrapf(err, "%s", name)
+		}
+
+		switch layer.Network {
+		case "", NetworkHost, NetworkNone:
+		default:
+			return nil, errors.Errorf("%s: invalid network %s: expected %s or %s", name, layer.Network, NetworkHost, NetworkNone)
+		}
+
+		if err := layer.Resources.Validate(); err != nil {
+			return nil, errors.Wrapf(err, "%s", name)
+		}
+
+		if err := layer.Security.Validate(); err != nil {
+			return nil, errors.Wrapf(err, "%s", name)
+		}
+
+		if err := layer.Devices.validate(); err != nil {
+			return nil, errors.Wrapf(err, "%s", name)
+		}
+
+		if err := layer.CacheDirs.validate(); err != nil {
+			return nil, errors.Wrapf(err, "%s", name)
+		}
+
 		if layer.OS == nil {
 			// if not specified, default to runtime
 			os := runtime.GOOS
@@ -383,6 +460,27 @@ func parseLayers(referenceDirectory string, lms yaml.MapSlice, requireHash bool)
 
 func (l Layer) absolutify(referenceDirectory string) (Layer, error) {
 	getAbsPath := func(path string) (string, error) {
+		// oci:<layout>:<tag>//<path> imports; only the layout is a
+		// path on the host
+		if layout, ok := strings.CutPrefix(path, "oci:"); ok {
+			if filepath.IsAbs(layout) {
+				return path, nil
+			}
+			abs, err := filepath.Abs(referenceDirectory)
+			return "oci:" + abs + "/" + layout, errors.WithStack(err)
+		}
+
+		// git:<repo>@<ref> imports; like git, take a repo with a ':'
+		// to be remote, be it a URL or scp-like (git@host:org/repo),
+		// and anything else to be a path
+		if repo, ok := strings.CutPrefix(path, "git:"); ok {
+			if strings.Contains(repo, ":") || filepath.IsAbs(repo) {
+				return path, nil
+			}
+			abs, err := filepath.Abs(filepath.Join(referenceDirectory, repo))
+			return "git:" + abs, errors.WithStack(err)
+		}
+
 		parsedPath, err := NewDockerishUrl(path)
 		if err != nil {
 			return "", err
@@ -400,6 +498,15 @@ func (l Layer) absolutify(referenceDirectory string) (Layer, error) {
 
 	ret := l
 
+	// archives are local files, like imports
+	if ret.From.Type == DockerArchiveLayer || ret.From.Type == OCIArchiveLayer {
+		absUrl, err := getAbsPath(ret.From.Url)
+		if err != nil {
+			return ret, err
+		}
+		ret.From.Url = absUrl
+	}
+
 	ret.Imports = nil
 	for _, rawImport := range l.Imports {
 		absImportPath, err := getAbsPath(rawImport.Path)
@@ -409,7 +516,8 @@ func (l Layer) absolutify(referenceDirectory string) (Layer, error) {
 		if rawImport.Path[len(rawImport.Path)-1:] == "/" {
 			absImportPath += "/"
 		}
-		absImport := Import{Hash: rawImport.Hash, Path: absImportPath, Dest: rawImport.Dest, Mode: rawImport.Mode, Uid: rawImport.Uid, Gid: rawImport.Gid}
+		absImport := rawImport
+		absImport.Path = absImportPath
 		ret.Imports = append(ret.Imports, absImport)
 	}
 
@@ -439,6 +547,40 @@ func (l Layer) absolutify(referenceDirectory string) (Layer, error) {
 		ret.Binds = append(ret.Binds, b)
 	}
 
+	ret.Secrets = nil
+	for _, rawSecret := range l.Secrets {
+		secret := rawSecret
+		if secret.Source != "" {
+			absSource, err := getAbsPath(secret.Source)
+			if err != nil {
+				return ret, err
+			}
+			secret.Source = absSource
+		}
+		ret.Secrets = append(ret.Secrets, secret)
+	}
+
+	ret.CacheDirs = nil
+	for _, rawCacheDir := range l.CacheDirs {
+		cacheDir := rawCacheDir
+		if cacheDir.Source != "" {
+			absSource, err := getAbsPath(cacheDir.Source)
+			if err != nil {
+				return ret, err
+			}
+			cacheDir.Source = absSource
+		}
+		ret.CacheDirs = append(ret.CacheDirs, cacheDir)
+	}
+
+	if l.Security.SeccompProfile != "" {
+		absProfile, err := getAbsPath(l.Security.SeccompProfile)
+		if err != nil {
+			return ret, err
+		}
+		ret.Security.SeccompProfile = absProfile
+	}
+
 	return ret, nil
 }
 
@@ -448,7 +590,8 @@ func requireImportHash(imports Imports) error {
 		if err != nil {
 			return err
 		}
-		if (url.Scheme == "http" || url.Scheme == "https") && imp.Hash == "" {
+		remote := url.Scheme == "http" || url.Scheme == "https" || url.Scheme == "s3" || url.Scheme == "gs"
+		if remote && imp.Hash == "" {
 			return errors.Errorf("Remote import needs a hash in yaml for path: %s", imp.Path)
 		}
 	}
@@ -461,6 +604,7 @@ func requireImportHash(imports Imports) error {
 //	  imports:
 //	   - /path/to-file
 //	   - path: /path/f2
+//	   - git: https://github.com/org/repo@<ref>
 //	This function gets a single entry in that list and returns the Import.
 func getImportFromInterface(v interface{}) (Import, error) {
 	mode := -1
@@ -485,7 +629,8 @@ func getImportFromInterface(v interface{}) (Import, error) {
 	}
 
 	// if present, these must have string values.
-	for name, dest := range map[string]*string{"hash": &ret.Hash, "path": &ret.Path, "dest": &ret.Dest} {
+	git := ""
+	for name, dest := range map[string]*string{"hash": &ret.Hash, "path": &ret.Path, "dest": &ret.Dest, "git": &git} {
 		val, found := m[name]
 		if !found {
 			continue
@@ -498,7 +643,7 @@ func getImportFromInterface(v interface{}) (Import, error) {
 	}
 
 	// if present, these must have int values
-	for name, dest := range map[string]*int{"mode": &mode, "uid": &ret.Uid, "gid": &ret.Gid} {
+	for name, dest := range map[string]*int{"mode": &mode, "uid": &ret.Uid, "gid": &ret.Gid, "size": &ret.Size} {
 		val, found := m[name]
 		if !found {
 			continue
@@ -510,6 +655,37 @@ func getImportFromInterface(v interface{}) (Import, error) {
 		*dest = i
 	}
 
+	if val, found := m["ttl"]; found {
+		s, ok := val.(string)
+		if !ok {
+			return Import{}, errors.Errorf("value for 'ttl' in import is not a string: %#v", v)
+		}
+		ttl, err := time.ParseDuration(s)
+		if err != nil {
+			return Import{}, errors.Wrapf(err, "invalid 'ttl' in import: %#v", v)
+		}
+		if ttl < 0 {
+			return Import{}, errors.Errorf("'ttl' (%s) cannot be negative: %v", ttl, v)
+		}
+		ret.TTL = ttl
+	}
+
+	if val, found := m["critical"]; found {
+		b, ok := val.(bool)
+		if !ok {
+			return Import{}, errors.Errorf("value for 'critical' in import is not a boolean: %#v", v)
+		}
+		ret.Critical = b
+	}
+
+	// "git: <repo>@<ref>" is short for "path: git:<repo>@<ref>"
+	if git != "" {
+		if ret.Path != "" {
+			return Import{}, errors.Errorf("import has both 'path' and 'git': %#v", v)
+		}
+		ret.Path = "git:" + git
+	}
+
 	if ret.Path == "" {
 		return ret, errors.Errorf("No 'path' entry found in import: %#v", v)
 	}
@@ -530,6 +706,9 @@ func getImportFromInterface(v interface{}) (Import, error) {
 	if ret.Gid != lib.GidEmpty && ret.Gid < 0 {
 		return Import{}, errors.Errorf("'gid' (%d) cannot be negative: %v", ret.Gid, v)
 	}
+	if ret.Size < 0 {
+		return Import{}, errors.Errorf("'size' (%d) cannot be negative: %v", ret.Size, v)
+	}
 
 	return ret, nil
 }
@@ -0,0 +1,48 @@
+package types
+
+import (
+	"os"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCacheDirs(t *testing.T) {
+	assert := assert.New(t)
+
+	dir := t.TempDir()
+	stackerfile := path.Join(dir, "stacker.yaml")
+	content := `.go:
+  from:
+    type: scratch
+  cache_dirs:
+    - /root/.cache/go-build/
+foo:
+  extends: .go
+  cache_dirs:
+    - dest: /root/.m2/repository
+      id: m2
+    - dest: /var/cache/apt
+      source: apt-cache
+`
+	assert.NoError(os.WriteFile(stackerfile, []byte(content), 0644))
+	sf, err := NewStackerfile(stackerfile, false, nil)
+	if !assert.NoError(err) {
+		return
+	}
+	l, ok := sf.Get("foo")
+	assert.True(ok)
+	assert.Equal(CacheDirs{
+		{Dest: "/root/.cache/go-build/"},
+		{Dest: "/root/.m2/repository", ID: "m2"},
+		{Dest: "/var/cache/apt", Source: path.Join(dir, "apt-cache")},
+	}, l.CacheDirs)
+	assert.Equal("root-.cache-go-build", l.CacheDirs[0].CacheID())
+	assert.Equal("m2", l.CacheDirs[1].CacheID())
+
+	assert.Error(CacheDir{Dest: "root/.cache"}.validate())
+	assert.Error(CacheDir{Dest: "/"}.validate())
+	assert.Error(CacheDir{Dest: "/root/.cache", ID: "../cache"}.validate())
+	assert.Error(CacheDirs{{Dest: "/root/.cache"}, {Dest: "/root/.cache/", ID: "other"}}.validate())
+}
@@ -0,0 +1,47 @@
+package types
+
+import (
+	"os"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDevices(t *testing.T) {
+	assert := assert.New(t)
+
+	dir := t.TempDir()
+	stackerfile := path.Join(dir, "stacker.yaml")
+	content := `.kvm:
+  from:
+    type: scratch
+  devices:
+    - /dev/kvm
+foo:
+  extends: .kvm
+  devices:
+    - path: /dev/nvidia0
+      dest: /dev/gpu
+      permissions: rw
+`
+	assert.NoError(os.WriteFile(stackerfile, []byte(content), 0644))
+	sf, err := NewStackerfile(stackerfile, false, nil)
+	if !assert.NoError(err) {
+		return
+	}
+	l, ok := sf.Get("foo")
+	assert.True(ok)
+	assert.Equal(Devices{
+		{Path: "/dev/kvm"},
+		{Path: "/dev/nvidia0", Dest: "/dev/gpu", Permissions: "rw"},
+	}, l.Devices)
+	assert.Equal("/dev/kvm", l.Devices[0].DestPath())
+	assert.Equal("rwm", l.Devices[0].CgroupPermissions())
+	assert.Equal("/dev/gpu", l.Devices[1].DestPath())
+
+	assert.Error(Device{Path: "dev/kvm"}.validate())
+	assert.Error(Device{Path: "/dev/kvm", Dest: "kvm"}.validate())
+	assert.Error(Device{Path: "/dev/kvm", Permissions: "rx"}.validate())
+	assert.Error(Device{Path: "/dev/kvm", Permissions: "rr"}.validate())
+}
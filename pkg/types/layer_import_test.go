@@ -2,7 +2,9 @@ package types
 
 import (
 	"io/fs"
+	"reflect"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"gopkg.in/yaml.v2"
@@ -71,6 +73,32 @@ func TestGetImportFromInterface(t *testing.T) {
 				"mode": 0755,
 			},
 			expected: Import{Path: "src1", Dest: "", Mode: modePtr(0755), Uid: eUGid, Gid: eUGid}},
+		{desc: "ttl present",
+			val: map[interface{}]interface{}{
+				"path": "https://example.com/latest",
+				"ttl":  "24h",
+			},
+			expected: Import{Path: "https://example.com/latest", TTL: 24 * time.Hour, Uid: eUGid, Gid: eUGid}},
+		{desc: "ttl must be a duration",
+			val: map[interface{}]interface{}{
+				"path": "src1",
+				"ttl":  "tomorrow",
+			},
+			errstr: "invalid 'ttl'",
+		},
+		{desc: "critical present",
+			val: map[interface{}]interface{}{
+				"path":     "https://example.com/base.tar",
+				"critical": true,
+			},
+			expected: Import{Path: "https://example.com/base.tar", Critical: true, Uid: eUGid, Gid: eUGid}},
+		{desc: "critical must be a boolean",
+			val: map[interface{}]interface{}{
+				"path":     "src1",
+				"critical": "yes",
+			},
+			errstr: "not a boolean",
+		},
 		{desc: "path must be present",
 			val: map[interface{}]interface{}{
 				"uid":  0,
@@ -135,10 +163,19 @@ func TestUnmarshalImports(t *testing.T) {
 				Import{Path: "f1", Uid: eUGid, Gid: eUGid},
 				Import{Path: "f2", Uid: eUGid, Gid: eUGid},
 			}},
+		{desc: "git is short for a git: path",
+			yblob: "- git: https://github.com/org/repo@v1.0\n",
+			expected: Imports{
+				Import{Path: "git:https://github.com/org/repo@v1.0", Uid: eUGid, Gid: eUGid},
+			}},
+		{desc: "git and path don't mix",
+			yblob:  "- git: https://github.com/org/repo@v1.0\n  path: f1\n",
+			errstr: "both 'path' and 'git'"},
 	}
 	var err error
 	found := Imports{}
 	for _, t := range tables {
+		found = Imports{}
 		err = yaml.Unmarshal([]byte(t.yblob), &found)
 		if t.errstr == "" {
 			if !assert.NoError(err, t.desc) {
@@ -150,3 +187,50 @@ func TestUnmarshalImports(t *testing.T) {
 		}
 	}
 }
+
+// TestAbsolutifyKeepsImportFields sets every field of an Import, so that a
+// field added later which absolutify forgets to copy fails here.
+func TestAbsolutifyKeepsImportFields(t *testing.T) {
+	assert := assert.New(t)
+
+	imp := Import{}
+	v := reflect.ValueOf(&imp).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		f := v.Field(i)
+		switch f.Kind() {
+		case reflect.String:
+			f.SetString("https://example.com/" + v.Type().Field(i).Name)
+		case reflect.Int, reflect.Int64:
+			f.SetInt(int64(i + 1))
+		case reflect.Bool:
+			f.SetBool(true)
+		case reflect.Ptr:
+			f.Set(reflect.New(f.Type().Elem()))
+		default:
+			t.Fatalf("no test value for Import.%s of kind %s", v.Type().Field(i).Name, f.Kind())
+		}
+	}
+
+	l := Layer{Imports: Imports{imp, {Path: "file", Dest: "/etc/", Uid: eUGid, Gid: eUGid}}}
+
+	abs, err := l.absolutify("/ref")
+	assert.NoError(err)
+	assert.Equal(imp, abs.Imports[0])
+	assert.Equal(Import{Path: "/ref/file", Dest: "/etc/", Uid: eUGid, Gid: eUGid}, abs.Imports[1])
+}
+
+func TestAbsolutifyGitImports(t *testing.T) {
+	assert := assert.New(t)
+
+	for path, expected := range map[string]string{
+		"git:https://github.com/org/repo@v1.0":        "git:https://github.com/org/repo@v1.0",
+		"git:git@github.com:org/repo.git@release/1.x": "git:git@github.com:org/repo.git@release/1.x",
+		"git:/srv/repo@main":                          "git:/srv/repo@main",
+		"git:repo@main":                               "git:/ref/repo@main",
+	} {
+		l := Layer{Imports: Imports{{Path: path}}}
+		abs, err := l.absolutify("/ref")
+		assert.NoError(err, path)
+		assert.Equal(expected, abs.Imports[0].Path, path)
+	}
+}
@@ -0,0 +1,53 @@
+package types
+
+import (
+	"os"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestResources(t *testing.T) {
+	assert := assert.New(t)
+
+	dir := t.TempDir()
+	stackerfile := path.Join(dir, "stacker.yaml")
+	content := `.limited:
+  from:
+    type: scratch
+  resources:
+    memory: 2GiB
+    pids: 100
+foo:
+  extends: .limited
+  resources:
+    cpus: 1.5
+`
+	assert.NoError(os.WriteFile(stackerfile, []byte(content), 0644))
+	sf, err := NewStackerfile(stackerfile, false, nil)
+	if !assert.NoError(err) {
+		return
+	}
+	l, ok := sf.Get("foo")
+	assert.True(ok)
+	assert.Equal(Resources{Memory: "2GiB", CPUs: 1.5, Pids: 100}, l.Resources)
+
+	configs, err := l.Resources.Or(Resources{Memory: "1GiB", Pids: 10}).CgroupConfigs()
+	assert.NoError(err)
+	assert.Equal(map[string]string{
+		"lxc.cgroup2.memory.max": "2147483648",
+		"lxc.cgroup2.cpu.max":    "150000 100000",
+		"lxc.cgroup2.pids.max":   "100",
+	}, configs)
+
+	configs, err = Resources{}.CgroupConfigs()
+	assert.NoError(err)
+	assert.Empty(configs)
+
+	assert.Error(Resources{Memory: "lots"}.Validate())
+	assert.Error(Resources{Memory: "0"}.Validate())
+	assert.Error(Resources{CPUs: -1}.Validate())
+	assert.Error(Resources{CPUs: 0.001}.Validate())
+	assert.Error(Resources{Pids: -1}.Validate())
+}
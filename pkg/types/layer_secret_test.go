@@ -0,0 +1,91 @@
+package types
+
+import (
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSecrets(t *testing.T) {
+	assert := assert.New(t)
+
+	dir := t.TempDir()
+	stackerfile := path.Join(dir, "stacker.yaml")
+	content := `foo:
+  from:
+    type: scratch
+  secrets:
+    - id: npmrc
+      source: npmrc
+      target: /root/.npmrc
+    - id: token
+      from_env: STACKER_TEST_TOKEN
+      env: TOKEN
+    - id: key
+      from_env: STACKER_TEST_TOKEN
+  run: cat /run/secrets/key
+`
+	assert.NoError(os.WriteFile(stackerfile, []byte(content), 0644))
+	sf, err := NewStackerfile(stackerfile, false, nil)
+	if !assert.NoError(err) {
+		return
+	}
+	l, ok := sf.Get("foo")
+	assert.True(ok)
+
+	assert.Equal(Secrets{
+		{ID: "npmrc", Source: path.Join(dir, "npmrc"), Target: "/root/.npmrc"},
+		{ID: "token", FromEnv: "STACKER_TEST_TOKEN", Env: "TOKEN"},
+		{ID: "key", FromEnv: "STACKER_TEST_TOKEN"},
+	}, l.Secrets)
+
+	assert.Equal("/root/.npmrc", l.Secrets[0].MountPath())
+	assert.Equal("", l.Secrets[1].MountPath())
+	assert.Equal("/run/secrets/key", l.Secrets[2].MountPath())
+
+	assert.NoError(os.WriteFile(path.Join(dir, "npmrc"), []byte("//registry/:_authToken=hunter2"), 0600))
+	value, err := l.Secrets[0].Value()
+	assert.NoError(err)
+	assert.Equal("//registry/:_authToken=hunter2", string(value))
+
+	t.Setenv("STACKER_TEST_TOKEN", "hunter2")
+	value, err = l.Secrets[1].Value()
+	assert.NoError(err)
+	assert.Equal("hunter2", string(value))
+
+	os.Unsetenv("STACKER_TEST_TOKEN")
+	_, err = l.Secrets[1].Value()
+	assert.ErrorContains(err, "STACKER_TEST_TOKEN isn't set")
+}
+
+func TestInvalidSecrets(t *testing.T) {
+	assert := assert.New(t)
+
+	for _, secrets := range []string{
+		"- source: foo\n",
+		"- id: foo\n",
+		"- id: foo\n  source: foo\n  from_env: FOO\n",
+		"- id: foo\n  source: foo\n  target: relative\n",
+		"- id: foo\n  source: foo\n  target: /foo\n  env: FOO\n",
+		"- id: foo\n  source: foo\n- id: foo\n  from_env: FOO\n",
+	} {
+		stackerfile := path.Join(t.TempDir(), "stacker.yaml")
+		content := "foo:\n  from:\n    type: scratch\n  secrets:\n" + indent(secrets)
+		assert.NoError(os.WriteFile(stackerfile, []byte(content), 0644))
+		_, err := NewStackerfile(stackerfile, false, nil)
+		assert.Error(err, secrets)
+	}
+}
+
+func indent(s string) string {
+	result := ""
+	for _, line := range strings.SplitAfter(s, "\n") {
+		if line != "" {
+			result += "    " + line
+		}
+	}
+	return result
+}
@@ -0,0 +1,53 @@
+package types
+
+import (
+	"os"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSecurity(t *testing.T) {
+	assert := assert.New(t)
+
+	dir := t.TempDir()
+	stackerfile := path.Join(dir, "stacker.yaml")
+	content := `.locked:
+  from:
+    type: scratch
+  security:
+    seccomp_profile: build.seccomp
+foo:
+  extends: .locked
+  security:
+    capabilities: [CAP_CHOWN, setuid]
+`
+	assert.NoError(os.WriteFile(stackerfile, []byte(content), 0644))
+	sf, err := NewStackerfile(stackerfile, false, nil)
+	if !assert.NoError(err) {
+		return
+	}
+	l, ok := sf.Get("foo")
+	assert.True(ok)
+	profile := path.Join(dir, "build.seccomp")
+	assert.Equal(Security{SeccompProfile: profile, Capabilities: []string{"CAP_CHOWN", "setuid"}}, l.Security)
+
+	_, err = l.Security.LXCConfigs()
+	assert.ErrorContains(err, "couldn't find seccomp profile")
+
+	assert.NoError(os.WriteFile(profile, []byte("2\ndenylist\nmount errno 1\n"), 0644))
+	configs, err := l.Security.Or(Security{Capabilities: []string{"none"}}).LXCConfigs()
+	assert.NoError(err)
+	assert.Equal(map[string]string{
+		"lxc.seccomp.profile": profile,
+		"lxc.cap.keep":        "chown setuid",
+	}, configs)
+
+	configs, err = Security{}.Or(Security{Capabilities: []string{"none"}}).LXCConfigs()
+	assert.NoError(err)
+	assert.Equal(map[string]string{"lxc.cap.keep": "none"}, configs)
+
+	assert.Error(Security{Capabilities: []string{"sys_everything"}}.Validate())
+	assert.Error(Security{Capabilities: []string{"none", "chown"}}.Validate())
+}
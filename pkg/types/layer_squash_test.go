@@ -0,0 +1,50 @@
+package types
+
+import (
+	"os"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSquash(t *testing.T) {
+	assert := assert.New(t)
+
+	dir := t.TempDir()
+	stackerfile := path.Join(dir, "stacker.yaml")
+	content := `.squashed:
+  from:
+    type: scratch
+  squash: true
+foo:
+  extends: .squashed
+bar:
+  from:
+    type: scratch
+  squash: all
+baz:
+  from:
+    type: scratch
+  squash: false
+`
+	assert.NoError(os.WriteFile(stackerfile, []byte(content), 0644))
+	sf, err := NewStackerfile(stackerfile, false, nil)
+	if !assert.NoError(err) {
+		return
+	}
+	for name, squash := range map[string]Squash{"foo": SquashLayers, "bar": SquashAll, "baz": SquashNone} {
+		l, ok := sf.Get(name)
+		assert.True(ok)
+		assert.Equal(squash, l.Squash, name)
+	}
+
+	content = `foo:
+  from:
+    type: scratch
+  squash: some
+`
+	assert.NoError(os.WriteFile(stackerfile, []byte(content), 0644))
+	_, err = NewStackerfile(stackerfile, false, nil)
+	assert.ErrorContains(err, "squash must be true, false, layers or all, not some")
+}
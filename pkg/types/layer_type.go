@@ -79,6 +79,8 @@ func NewLayerTypeManifest(manifest ispec.Manifest) (LayerType, error) {
 		return NewLayerType("squashfs", squashfs.VerityMetadataPresent)
 	case ispec.MediaTypeImageLayerGzip:
 		fallthrough
+	case ispec.MediaTypeImageLayerZstd:
+		fallthrough
 	case ispec.MediaTypeImageLayer:
 		return NewLayerType("tar", squashfs.VerityMetadataMissing)
 	default:
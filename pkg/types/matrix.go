@@ -0,0 +1,192 @@
+package types
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v2"
+)
+
+// matrixDirective is the directive of the build matrix of a layer, which
+// expands it into a layer for each combination of the values of its
+// variables.
+const matrixDirective = "matrix"
+
+var matrixVariableName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// matrixVariable is a variable of a build matrix and its values.
+type matrixVariable struct {
+	name   string
+	values []string
+}
+
+// layerMatrix returns the build matrix of layer, or nil if it doesn't have
+// one.
+func layerMatrix(name string, layer yaml.MapSlice) ([]matrixVariable, error) {
+	for _, directive := range layer {
+		if directive.Key != matrixDirective {
+			continue
+		}
+
+		variables, ok := directive.Value.(yaml.MapSlice)
+		if !ok || len(variables) == 0 {
+			return nil, errors.Errorf("%s: matrix must map variables to their values", name)
+		}
+
+		matrix := []matrixVariable{}
+		for _, v := range variables {
+			variable, ok := v.Key.(string)
+			if !ok || !matrixVariableName.MatchString(variable) {
+				return nil, errors.Errorf("%s: invalid matrix variable %v", name, v.Key)
+			}
+
+			values, ok := v.Value.([]interface{})
+			if !ok || len(values) == 0 {
+				return nil, errors.Errorf("%s: matrix variable %s must have a list of values", name, variable)
+			}
+
+			mv := matrixVariable{name: variable}
+			for _, value := range values {
+				switch value.(type) {
+				case string, int, float64, bool:
+					mv.values = append(mv.values, fmt.Sprint(value))
+				default:
+					return nil, errors.Errorf("%s: invalid value %v of matrix variable %s", name, value, variable)
+				}
+			}
+			matrix = append(matrix, mv)
+		}
+
+		return matrix, nil
+	}
+
+	return nil, nil
+}
+
+// matrixVariables returns the names of the variables of the build matrices
+// of the layers in ms.
+func matrixVariables(ms yaml.MapSlice) []string {
+	names := []string{}
+	for _, e := range ms {
+		layer, ok := e.Value.(yaml.MapSlice)
+		if !ok {
+			continue
+		}
+		matrix, err := layerMatrix(fmt.Sprint(e.Key), layer)
+		if err != nil {
+			// reported when the layer is expanded
+			continue
+		}
+		for _, v := range matrix {
+			names = append(names, v.name)
+		}
+	}
+	return names
+}
+
+// substituteTree returns v with replace applied to all of the strings in its
+// keys and values.
+func substituteTree(v interface{}, replace func(string) (string, error)) (interface{}, error) {
+	switch v := v.(type) {
+	case string:
+		return replace(v)
+	case yaml.MapSlice:
+		ret := yaml.MapSlice{}
+		for _, item := range v {
+			key, err := substituteTree(item.Key, replace)
+			if err != nil {
+				return nil, err
+			}
+			value, err := substituteTree(item.Value, replace)
+			if err != nil {
+				return nil, err
+			}
+			ret = append(ret, yaml.MapItem{Key: key, Value: value})
+		}
+		return ret, nil
+	case []interface{}:
+		ret := []interface{}{}
+		for _, item := range v {
+			value, err := substituteTree(item, replace)
+			if err != nil {
+				return nil, err
+			}
+			ret = append(ret, value)
+		}
+		return ret, nil
+	default:
+		return v, nil
+	}
+}
+
+// expandMatrix returns a layer for each combination of the values of the
+// variables of the build matrix of layer, with the placeholders of the
+// variables replaced by those values. Each is named after name and its values
+// in the order of the variables, e.g. go-1.21-alpine. A layer without a build
+// matrix is returned as is.
+func expandMatrix(name string, layer yaml.MapSlice) (yaml.MapSlice, error) {
+	matrix, err := layerMatrix(name, layer)
+	if err != nil {
+		return nil, err
+	}
+	if matrix == nil {
+		return yaml.MapSlice{{Key: name, Value: layer}}, nil
+	}
+
+	definition := yaml.MapSlice{}
+	for _, directive := range layer {
+		if directive.Key != matrixDirective {
+			definition = append(definition, directive)
+		}
+	}
+
+	// combinations are listed with the values of the first variable
+	// changing the slowest
+	combinations := [][]string{{}}
+	for _, v := range matrix {
+		next := [][]string{}
+		for _, combination := range combinations {
+			for _, value := range v.values {
+				next = append(next, append(append([]string{}, combination...), value))
+			}
+		}
+		combinations = next
+	}
+
+	variants := yaml.MapSlice{}
+	for _, combination := range combinations {
+		variantName := name
+		for _, value := range combination {
+			variantName += "-" + invalidTagChars.ReplaceAllString(value, "_")
+		}
+
+		variant, err := substituteTree(definition, func(s string) (string, error) {
+			for i, v := range matrix {
+				re := regexp.MustCompile(fmt.Sprintf(`\$\{\{%s(:[^\}]*)?\}\}`, v.name))
+				s = re.ReplaceAllLiteralString(s, combination[i])
+			}
+			return s, nil
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		variants = append(variants, yaml.MapItem{Key: variantName, Value: variant})
+	}
+
+	return variants, nil
+}
+
+// substituteMatrixDefaults replaces the placeholders of the variables of the
+// build matrices that are left in layer, i.e. those outside of the layers
+// that have them, with their default values.
+func substituteMatrixDefaults(layer interface{}) (interface{}, error) {
+	return substituteTree(layer, func(s string) (string, error) {
+		if !strings.Contains(s, "${{") {
+			return s, nil
+		}
+		return substituteDefaults(s, nil)
+	})
+}
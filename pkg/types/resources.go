@@ -0,0 +1,81 @@
+package types
+
+import (
+	"fmt"
+
+	"github.com/dustin/go-humanize"
+	"github.com/pkg/errors"
+)
+
+// cpuPeriod is the period, in microseconds, that the CPU time of a layer's
+// run section is limited over, the kernel's default.
+const cpuPeriod = 100000
+
+// Resources are the limits of what the run section of a layer can use, which
+// are applied with cgroups to the container it runs in. The zero value of
+// each of them is no limit. They don't change what is built, so changing them
+// doesn't make a layer be rebuilt.
+type Resources struct {
+	// Memory is the most memory it can use before it's OOM killed,
+	// e.g. 4GiB.
+	Memory string `yaml:"memory" json:"memory,omitempty"`
+
+	// CPUs is how many CPUs worth of time it gets, e.g. 1.5.
+	CPUs float64 `yaml:"cpus" json:"cpus,omitempty"`
+
+	// Pids is how many processes and threads it can have at once.
+	Pids int64 `yaml:"pids" json:"pids,omitempty"`
+}
+
+// Validate returns an error if any of the limits of r are invalid.
+func (r Resources) Validate() error {
+	if r.Memory != "" {
+		memory, err := humanize.ParseBytes(r.Memory)
+		if err != nil {
+			return errors.Wrapf(err, "invalid memory limit %s", r.Memory)
+		}
+		if memory == 0 {
+			return errors.Errorf("invalid memory limit %s", r.Memory)
+		}
+	}
+
+	if r.CPUs < 0 || (r.CPUs > 0 && r.CPUs*cpuPeriod < 1000) {
+		return errors.Errorf("invalid cpus limit %v: expected at least 0.01", r.CPUs)
+	}
+
+	if r.Pids < 0 {
+		return errors.Errorf("invalid pids limit %d", r.Pids)
+	}
+
+	return nil
+}
+
+// Or is r, with the limits it doesn't set taken from fallback.
+func (r Resources) Or(fallback Resources) Resources {
+	return Resources{
+		Memory: optional(r.Memory, fallback.Memory),
+		CPUs:   optional(r.CPUs, fallback.CPUs),
+		Pids:   optional(r.Pids, fallback.Pids),
+	}
+}
+
+// CgroupConfigs are the cgroup2 controller settings that apply r, keyed as
+// LXC's lxc.cgroup2 config items are.
+func (r Resources) CgroupConfigs() (map[string]string, error) {
+	if err := r.Validate(); err != nil {
+		return nil, err
+	}
+
+	configs := map[string]string{}
+	if r.Memory != "" {
+		memory, _ := humanize.ParseBytes(r.Memory)
+		configs["lxc.cgroup2.memory.max"] = fmt.Sprintf("%d", memory)
+	}
+	if r.CPUs > 0 {
+		configs["lxc.cgroup2.cpu.max"] = fmt.Sprintf("%d %d", int64(r.CPUs*cpuPeriod), cpuPeriod)
+	}
+	if r.Pids > 0 {
+		configs["lxc.cgroup2.pids.max"] = fmt.Sprintf("%d", r.Pids)
+	}
+	return configs, nil
+}
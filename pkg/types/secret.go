@@ -0,0 +1,98 @@
+package types
+
+import (
+	"os"
+	"path"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// SecretsDir is where in the build container secrets are mounted, unless
+// they say otherwise.
+const SecretsDir = "/run/secrets"
+
+// Secret is something a layer's run section needs, e.g. a credential, that
+// must not end up in the layer: it is mounted into the build container, or
+// exposed in its environment, only while the run section runs.
+type Secret struct {
+	// ID names the secret.
+	ID string `yaml:"id" json:"id"`
+
+	// Source is the file on the host the secret is read from, or FromEnv
+	// the host environment variable.
+	Source  string `yaml:"source" json:"source,omitempty"`
+	FromEnv string `yaml:"from_env" json:"from_env,omitempty"`
+
+	// Target is where in the build container the secret is mounted,
+	// SecretsDir/ID by default, or Env the environment variable it is
+	// exposed as instead.
+	Target string `yaml:"target" json:"target,omitempty"`
+	Env    string `yaml:"env" json:"env,omitempty"`
+}
+
+// Secrets are the secrets of a layer.
+type Secrets []Secret
+
+func (s Secret) validate() error {
+	if s.ID == "" || strings.Contains(s.ID, "/") {
+		return errors.Errorf("invalid secret id %q", s.ID)
+	}
+
+	if (s.Source == "") == (s.FromEnv == "") {
+		return errors.Errorf("secret %s needs exactly one of source and from_env", s.ID)
+	}
+
+	if s.Target != "" && s.Env != "" {
+		return errors.Errorf("secret %s can't have both a target and an env", s.ID)
+	}
+
+	if s.Target != "" && !path.IsAbs(s.Target) {
+		return errors.Errorf("target %s of secret %s isn't an absolute path", s.Target, s.ID)
+	}
+
+	return nil
+}
+
+func (ss Secrets) validate() error {
+	ids := map[string]bool{}
+	for _, s := range ss {
+		if err := s.validate(); err != nil {
+			return err
+		}
+		if ids[s.ID] {
+			return errors.Errorf("duplicate secret %s", s.ID)
+		}
+		ids[s.ID] = true
+	}
+	return nil
+}
+
+// MountPath is where in the build container the secret is mounted, or "" if
+// it is exposed in its environment instead.
+func (s Secret) MountPath() string {
+	if s.Env != "" {
+		return ""
+	}
+	if s.Target != "" {
+		return path.Clean(s.Target)
+	}
+	return path.Join(SecretsDir, s.ID)
+}
+
+// Value reads the secret from the host.
+func (s Secret) Value() ([]byte, error) {
+	if s.FromEnv != "" {
+		v, ok := os.LookupEnv(s.FromEnv)
+		if !ok {
+			return nil, errors.Errorf("secret %s: %s isn't set", s.ID, s.FromEnv)
+		}
+		return []byte(v), nil
+	}
+
+	content, err := os.ReadFile(s.Source)
+	if err != nil {
+		return nil, errors.Wrapf(err, "couldn't read secret %s", s.ID)
+	}
+	return content, nil
+}
@@ -0,0 +1,99 @@
+package types
+
+import (
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// CapabilitiesNone are the capabilities of a run section that drops them
+// all.
+const CapabilitiesNone = "none"
+
+// capabilities are the names of the linux capabilities, as LXC knows them.
+var capabilities = []string{
+	"chown", "dac_override", "dac_read_search", "fowner", "fsetid", "kill",
+	"setgid", "setuid", "setpcap", "linux_immutable", "net_bind_service",
+	"net_broadcast", "net_admin", "net_raw", "ipc_lock", "ipc_owner",
+	"sys_module", "sys_rawio", "sys_chroot", "sys_ptrace", "sys_pacct",
+	"sys_admin", "sys_boot", "sys_nice", "sys_resource", "sys_time",
+	"sys_tty_config", "mknod", "lease", "audit_write", "audit_control",
+	"setfcap", "mac_override", "mac_admin", "syslog", "wake_alarm",
+	"block_suspend", "audit_read", "perfmon", "bpf", "checkpoint_restore",
+}
+
+// Security is how the container the run section of a layer runs in is locked
+// down. The zero value is LXC's default policy: no seccomp profile, and all
+// the capabilities of stacker's user namespace. Like Resources, it doesn't
+// change what is built, so changing it doesn't make a layer be rebuilt.
+type Security struct {
+	// SeccompProfile is the path of a seccomp policy, in LXC's format
+	// (see lxc.container.conf(5)).
+	SeccompProfile string `yaml:"seccomp_profile" json:"seccomp_profile,omitempty"`
+
+	// Capabilities, if set, are the only capabilities the run section
+	// has, e.g. [chown, setuid, setgid], or [none] for none at all.
+	Capabilities []string `yaml:"capabilities" json:"capabilities,omitempty"`
+}
+
+// normalizeCapability is the name of capability c, which may be spelled like
+// CAP_SYS_ADMIN, the way LXC wants it: sys_admin.
+func normalizeCapability(c string) string {
+	return strings.TrimPrefix(strings.ToLower(c), "cap_")
+}
+
+// Validate returns an error if s has unknown capabilities.
+func (s Security) Validate() error {
+	for _, c := range s.Capabilities {
+		name := normalizeCapability(c)
+		if name == CapabilitiesNone {
+			if len(s.Capabilities) != 1 {
+				return errors.Errorf("capabilities can't have %s along with other capabilities", CapabilitiesNone)
+			}
+			continue
+		}
+		if !slices.Contains(capabilities, name) {
+			return errors.Errorf("unknown capability %s", c)
+		}
+	}
+
+	return nil
+}
+
+// Or is s, with what it doesn't set taken from fallback.
+func (s Security) Or(fallback Security) Security {
+	ret := Security{
+		SeccompProfile: optional(s.SeccompProfile, fallback.SeccompProfile),
+		Capabilities:   s.Capabilities,
+	}
+	if ret.Capabilities == nil {
+		ret.Capabilities = fallback.Capabilities
+	}
+	return ret
+}
+
+// LXCConfigs are the LXC config items that apply s.
+func (s Security) LXCConfigs() (map[string]string, error) {
+	if err := s.Validate(); err != nil {
+		return nil, err
+	}
+
+	configs := map[string]string{}
+	if s.SeccompProfile != "" {
+		// LXC only says it couldn't start the container
+		if _, err := os.Stat(s.SeccompProfile); err != nil {
+			return nil, errors.Wrapf(err, "couldn't find seccomp profile")
+		}
+		configs["lxc.seccomp.profile"] = s.SeccompProfile
+	}
+	if len(s.Capabilities) > 0 {
+		names := []string{}
+		for _, c := range s.Capabilities {
+			names = append(names, normalizeCapability(c))
+		}
+		configs["lxc.cap.keep"] = strings.Join(names, " ")
+	}
+	return configs, nil
+}
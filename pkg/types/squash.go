@@ -0,0 +1,45 @@
+package types
+
+import (
+	"github.com/pkg/errors"
+)
+
+// Squash is which of the layers of a layer's image are collapsed into one
+// when it's built.
+type Squash string
+
+const (
+	// SquashNone keeps every layer.
+	SquashNone Squash = ""
+
+	// SquashLayers collapses the layers stacker built (squash: true),
+	// keeping those of the image the layer is based on.
+	SquashLayers Squash = "layers"
+
+	// SquashAll collapses all of them, leaving a single layer.
+	SquashAll Squash = "all"
+)
+
+func (s *Squash) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	squash := false
+	if err := unmarshal(&squash); err == nil {
+		*s = SquashNone
+		if squash {
+			*s = SquashLayers
+		}
+		return nil
+	}
+
+	value := ""
+	if err := unmarshal(&value); err != nil {
+		return errors.Errorf("squash must be true, false, %s or %s", SquashLayers, SquashAll)
+	}
+
+	switch Squash(value) {
+	case SquashLayers, SquashAll:
+		*s = Squash(value)
+		return nil
+	}
+
+	return errors.Errorf("squash must be true, false, %s or %s, not %s", SquashLayers, SquashAll, value)
+}
@@ -8,8 +8,10 @@ import (
 	"os"
 	"path/filepath"
 	"regexp"
+	"slices"
 	"strings"
 
+	"github.com/opencontainers/go-digest"
 	"github.com/pkg/errors"
 	"gopkg.in/yaml.v2"
 	"stackerbuild.io/stacker/pkg/log"
@@ -23,6 +25,7 @@ const (
 
 type BuildConfig struct {
 	Prerequisites []string `yaml:"prerequisites"`
+	Include       []string `yaml:"include"`
 }
 
 type Stackerfile struct {
@@ -30,12 +33,20 @@ type Stackerfile struct {
 	// substitutions (i.e., the content that is actually used by stacker).
 	AfterSubstitutions string
 
+	// Digest is the digest of the contents of the stacker file before
+	// substitutions.
+	Digest digest.Digest
+
 	// internal is the actual representation of the stackerfile as a map.
 	internal map[string]Layer
 
-	// FileOrder is the order of elements as they appear in the stackerfile.
+	// FileOrder is the order of elements as they appear in the stackerfile,
+	// after those of the stackerfiles it includes.
 	FileOrder []string
 
+	// templates are the layers that are only there to be extended.
+	templates map[string]Layer
+
 	// configuration specific for this specific build
 	buildConfig *BuildConfig
 
@@ -53,11 +64,33 @@ func (sf *Stackerfile) Get(name string) (Layer, bool) {
 	return layer, ok
 }
 
+// Path is the absolute path of the stacker file, or its url if it was
+// downloaded.
+func (sf *Stackerfile) Path() string {
+	return sf.path
+}
+
 func (sf *Stackerfile) Len() int {
 	return len(sf.internal)
 }
 
 func substitute(content string, substitutions []string) (string, error) {
+	content, err := substituteProvided(content, substitutions)
+	if err != nil {
+		return "", err
+	}
+
+	return substituteDefaults(content, nil)
+}
+
+// Substitute replaces the ${{FOO}} placeholders in content with the
+// substitutions, KEY=VALUE pairs, or their defaults.
+func Substitute(content string, substitutions []string) (string, error) {
+	return substitute(content, substitutions)
+}
+
+// substituteProvided replaces the placeholders of the substitutions provided.
+func substituteProvided(content string, substitutions []string) (string, error) {
 	// replace all placeholders where we have a substitution provided
 	sub_usage := []int{}
 	unsupported_messages := []string{}
@@ -128,20 +161,30 @@ func substitute(content string, substitutions []string) (string, error) {
 		return "", errors.Errorf("%d instances of unsupported placeholders found. Review log for how to update.", len(unsupported_messages))
 	}
 
-	// now, anything that's left was not provided in substitutions but should
-	// have a default value. Not having a default here is an error.
+	return content, nil
+}
+
+// substituteDefaults replaces the placeholders that are left, which weren't
+// provided in substitutions, with their default values. Not having a default
+// is an error, except for the placeholders of the variables in keep, which are
+// left as they are.
+func substituteDefaults(content string, keep []string) (string, error) {
 	re := regexp.MustCompile(`\$\{\{[^\}]*\}\}`)
 	for {
-		indexes := re.FindAllStringIndex(content, -1)
-		if len(indexes) == 0 {
+		var idx []int
+		var variable string
+		for _, indexes := range re.FindAllStringIndex(content, -1) {
+			// get content without ${{}}
+			variable = content[indexes[0]+3 : indexes[1]-2]
+			if !slices.Contains(keep, strings.SplitN(variable, ":", 2)[0]) {
+				idx = indexes
+				break
+			}
+		}
+		if idx == nil {
 			break
 		}
 
-		idx := indexes[0]
-
-		// get content without ${{}}
-		variable := content[idx[0]+3 : idx[1]-2]
-
 		membs := strings.SplitN(variable, ":", 2)
 		if len(membs) != 2 {
 			return "", errors.Errorf("no value for substitution %s", variable)
@@ -168,6 +211,68 @@ func substitute(content string, substitutions []string) (string, error) {
 // explicitly not a map, because the substitutions are performed one at a time
 // in the order that they are given.
 func NewStackerfile(stackerfile string, validateHash bool, substitutions []string) (*Stackerfile, error) {
+	return newStackerfile(stackerfile, validateHash, substitutions, nil)
+}
+
+// includePath is the path of the stackerfile include refers to, relative to
+// the reference directory of sf unless it's absolute or an url.
+func (sf *Stackerfile) includePath(include string) (string, error) {
+	url, err := NewDockerishUrl(include)
+	if err != nil {
+		return "", err
+	}
+	if url.Scheme != "" || filepath.IsAbs(include) {
+		return include, nil
+	}
+	return filepath.Abs(filepath.Join(sf.ReferenceDirectory, include))
+}
+
+// include reads the stackerfiles sf includes, and adds their layers and
+// templates, which must not have the same names as any others, to layers. The
+// layers of the included stackerfiles are added to the file order of sf, and
+// their prerequisites to the prerequisites of sf. chain is the stackerfiles
+// that include sf, to detect cycles.
+func (sf *Stackerfile) include(validateHash bool, substitutions []string, chain []string, layers map[string]Layer) error {
+	chain = append(chain, sf.path)
+
+	definedIn := map[string]string{}
+	for _, include := range sf.buildConfig.Include {
+		includePath, err := sf.includePath(include)
+		if err != nil {
+			return err
+		}
+
+		if slices.Contains(chain, includePath) {
+			return errors.Errorf("stackerfile: include cycle: %s", strings.Join(append(chain, includePath), " -> "))
+		}
+
+		included, err := newStackerfile(includePath, validateHash, substitutions, chain)
+		if err != nil {
+			return errors.Wrapf(err, "couldn't include %s", include)
+		}
+
+		for _, things := range []map[string]Layer{included.internal, included.templates} {
+			for name, layer := range things {
+				if other, ok := definedIn[name]; ok {
+					return errors.Errorf("stackerfile: both %s and %s define %s", other, included.path, name)
+				}
+				definedIn[name] = included.path
+				layers[name] = layer
+			}
+		}
+		sf.FileOrder = append(sf.FileOrder, included.FileOrder...)
+
+		prerequisites, err := included.Prerequisites()
+		if err != nil {
+			return err
+		}
+		sf.buildConfig.Prerequisites = append(sf.buildConfig.Prerequisites, prerequisites...)
+	}
+
+	return nil
+}
+
+func newStackerfile(stackerfile string, validateHash bool, substitutions []string, chain []string) (*Stackerfile, error) {
 	var err error
 
 	sf := Stackerfile{}
@@ -221,7 +326,28 @@ func NewStackerfile(stackerfile string, validateHash bool, substitutions []strin
 		// Continue to use the working directory
 	}
 
-	content, err := substitute(string(raw), substitutions)
+	sf.Digest = digest.FromBytes(raw)
+
+	content, err := substituteProvided(string(raw), substitutions)
+	if err != nil {
+		return nil, err
+	}
+
+	// The variables of build matrices are substituted once the layers that
+	// have them are expanded
+	pre := yaml.MapSlice{}
+	matrixVars := []string{}
+	if err := yaml.Unmarshal([]byte(content), &pre); err == nil {
+		matrixVars = matrixVariables(pre)
+	}
+	for _, subst := range substitutions {
+		name, _, _ := strings.Cut(subst, "=")
+		if slices.Contains(matrixVars, name) {
+			return nil, errors.Errorf("stackerfile: %s is both a substitution and a matrix variable", name)
+		}
+	}
+
+	content, err = substituteDefaults(content, matrixVars)
 	if err != nil {
 		return nil, err
 	}
@@ -240,6 +366,7 @@ func NewStackerfile(stackerfile string, validateHash bool, substitutions []strin
 		Prerequisites: []string{},
 	}
 	lms := yaml.MapSlice{} // Actual list of layers excluding the config directive
+	layerOrder := []string{}
 	for _, e := range ms {
 		keyName, ok := e.Key.(string)
 		if !ok {
@@ -257,17 +384,70 @@ func NewStackerfile(stackerfile string, validateHash bool, substitutions []strin
 				return nil, errors.New(msg)
 			}
 		} else {
-			sf.FileOrder = append(sf.FileOrder, e.Key.(string))
-			lms = append(lms, e)
+			layer, ok := e.Value.(yaml.MapSlice)
+			if !ok {
+				return nil, errors.Errorf("stackerfile: %s isn't a layer definition", keyName)
+			}
+
+			variants, err := expandMatrix(keyName, layer)
+			if err != nil {
+				return nil, err
+			}
+
+			for _, variant := range variants {
+				name := variant.Key.(string)
+				if slices.ContainsFunc(lms, func(e yaml.MapItem) bool { return e.Key == name }) {
+					return nil, errors.Errorf("stackerfile: %s is defined more than once", name)
+				}
+
+				if len(matrixVars) > 0 {
+					variant.Value, err = substituteMatrixDefaults(variant.Value)
+					if err != nil {
+						return nil, errors.Wrapf(err, "%s", name)
+					}
+				}
+
+				if !IsTemplate(name) {
+					layerOrder = append(layerOrder, name)
+				}
+				lms = append(lms, variant)
+			}
 		}
 	}
 
-	sf.internal, err = parseLayers(sf.ReferenceDirectory, lms, validateHash)
+	// The layers of the stackerfiles this one includes come first
+	included := map[string]Layer{}
+	if err := sf.include(validateHash, substitutions, chain, included); err != nil {
+		return nil, err
+	}
+
+	layers, err := parseLayers(sf.ReferenceDirectory, lms, validateHash, included)
 	if err != nil {
 		return nil, err
 	}
 
-	for _, name := range sf.FileOrder {
+	sf.internal = map[string]Layer{}
+	sf.templates = map[string]Layer{}
+	for name, layer := range included {
+		if IsTemplate(name) {
+			sf.templates[name] = layer
+		} else {
+			sf.internal[name] = layer
+		}
+	}
+	for name, layer := range layers {
+		if _, ok := included[name]; ok {
+			return nil, errors.Errorf("stackerfile: %s is defined in both %s and a stackerfile it includes", name, sf.path)
+		}
+		if IsTemplate(name) {
+			sf.templates[name] = layer
+		} else {
+			sf.internal[name] = layer
+		}
+	}
+	sf.FileOrder = append(sf.FileOrder, layerOrder...)
+
+	for _, name := range layerOrder {
 		layer := sf.internal[name]
 		if layer.WasLegacyImport {
 			log.Warnf("'import' directive used in layer '%s' inside file '%s' is deprecated. "+
@@ -417,6 +597,48 @@ func (s *Stackerfile) DependencyOrder(sfm StackerFiles) ([]string, error) {
 	return ret, nil
 }
 
+// LayerDependencies returns the layers of s that the layer name builds on: its
+// built base and the layers it imports from with stacker:// urls. Layers of
+// other stackerfiles, which are built before s, aren't included.
+func (s *Stackerfile) LayerDependencies(name string) ([]string, error) {
+	layer, ok := s.internal[name]
+	if !ok {
+		return nil, errors.Errorf("no layer %s in %s", name, s.path)
+	}
+
+	refs := []string{}
+	for _, imp := range layer.Imports {
+		refs = append(refs, imp.Path)
+	}
+	if layer.From.Type == TarLayer {
+		refs = append(refs, layer.From.Url)
+	}
+
+	deps := []string{}
+	add := func(dep string) {
+		if _, ok := s.internal[dep]; ok && dep != name && !slices.Contains(deps, dep) {
+			deps = append(deps, dep)
+		}
+	}
+
+	if layer.From.Type == BuiltLayer {
+		add(layer.From.Tag)
+	}
+
+	for _, ref := range refs {
+		url, err := NewDockerishUrl(ref)
+		if err != nil {
+			return nil, err
+		}
+
+		if url.Scheme == "stacker" {
+			add(url.Host)
+		}
+	}
+
+	return deps, nil
+}
+
 // Prerequisites provides the absolute paths to the Stackerfiles which are dependencies
 // for building this Stackerfile
 func (sf *Stackerfile) Prerequisites() ([]string, error) {
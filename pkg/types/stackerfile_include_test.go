@@ -0,0 +1,112 @@
+package types
+
+import (
+	"os"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIncludeAndExtends(t *testing.T) {
+	assert := assert.New(t)
+
+	dir := t.TempDir()
+	assert.NoError(os.Mkdir(path.Join(dir, "common"), 0755))
+
+	common := `.apk:
+  run: apk add ${{PACKAGES:curl}}
+  environment:
+    FOO: common
+    BAR: common
+base:
+  from:
+    type: docker
+    url: docker://alpine:3.19
+  imports:
+    - setup.sh
+  build_only: true
+`
+	assert.NoError(os.WriteFile(path.Join(dir, "common", "common.yaml"), []byte(common), 0644))
+
+	content := `config:
+  include:
+    - common/common.yaml
+app:
+  extends: .apk
+  from:
+    type: built
+    tag: base
+  run: make
+  environment:
+    FOO: app
+app-debug:
+  extends: app
+  run: make debug
+`
+	stackerfile := path.Join(dir, "stacker.yaml")
+	assert.NoError(os.WriteFile(stackerfile, []byte(content), 0644))
+
+	sf, err := NewStackerfile(stackerfile, false, []string{"PACKAGES=make"})
+	if !assert.NoError(err) {
+		return
+	}
+
+	// templates aren't built
+	assert.Equal([]string{"base", "app", "app-debug"}, sf.FileOrder)
+	assert.Equal(3, sf.Len())
+	_, ok := sf.Get(".apk")
+	assert.False(ok)
+
+	// included layers are relative to the file they're in
+	base, ok := sf.Get("base")
+	assert.True(ok)
+	assert.Equal(path.Join(dir, "common", "setup.sh"), base.Imports[0].Path)
+
+	app, ok := sf.Get("app")
+	assert.True(ok)
+	assert.Equal(BuiltLayer, app.From.Type)
+	assert.Equal(StringList{"apk add make", "make"}, app.Run)
+	assert.Equal(map[string]string{"FOO": "app", "BAR": "common"}, app.Environment)
+
+	debug, ok := sf.Get("app-debug")
+	assert.True(ok)
+	assert.Equal("base", debug.From.Tag)
+	assert.Equal(StringList{"apk add make", "make", "make debug"}, debug.Run)
+	assert.False(debug.BuildOnly)
+
+	order, err := sf.DependencyOrder(StackerFiles{sf.Path(): sf})
+	assert.NoError(err)
+	assert.Equal([]string{"base", "app", "app-debug"}, order)
+}
+
+func TestIncludeAndExtendsErrors(t *testing.T) {
+	assert := assert.New(t)
+
+	dir := t.TempDir()
+	for name, content := range map[string]string{
+		"a.yaml":    "config:\n  include:\n    - b.yaml\na:\n  from:\n    type: scratch\n",
+		"b.yaml":    "config:\n  include:\n    - a.yaml\nb:\n  from:\n    type: scratch\n",
+		"dup.yaml":  "config:\n  include:\n    - base.yaml\nbase:\n  from:\n    type: scratch\n",
+		"base.yaml": "base:\n  from:\n    type: scratch\n",
+	} {
+		assert.NoError(os.WriteFile(path.Join(dir, name), []byte(content), 0644))
+	}
+
+	_, err := NewStackerfile(path.Join(dir, "a.yaml"), false, nil)
+	assert.ErrorContains(err, "include cycle")
+
+	_, err = NewStackerfile(path.Join(dir, "dup.yaml"), false, nil)
+	assert.ErrorContains(err, "base is defined in both")
+
+	for content, expected := range map[string]string{
+		"a:\n  extends: b\n  from:\n    type: scratch\nb:\n  extends: a\n": "extends cycle",
+		"a:\n  extends: missing\n":  "couldn't find missing to extend",
+		"a:\n  extends:\n    - b\n": "extends must be the name of a layer",
+	} {
+		stackerfile := path.Join(dir, "stacker.yaml")
+		assert.NoError(os.WriteFile(stackerfile, []byte(content), 0644))
+		_, err = NewStackerfile(stackerfile, false, nil)
+		assert.ErrorContains(err, expected, content)
+	}
+}
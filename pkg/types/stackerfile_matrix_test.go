@@ -0,0 +1,85 @@
+package types
+
+import (
+	"os"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMatrix(t *testing.T) {
+	assert := assert.New(t)
+
+	dir := t.TempDir()
+	content := `base:
+  matrix:
+    DISTRO: [bookworm, alpine]
+  from:
+    type: docker
+    url: docker://${{REGISTRY}}/base:${{DISTRO}}
+go:
+  matrix:
+    GO_VERSION: ["1.20", "1.21"]
+    DISTRO: [bookworm, alpine]
+  from:
+    type: built
+    tag: base-${{DISTRO}}
+  run: install-go ${{GO_VERSION}} ${{PREFIX:/usr/local}}
+  labels:
+    go-version: ${{GO_VERSION:latest}}
+plain:
+  from:
+    type: scratch
+  run: echo ${{DISTRO:none}}
+`
+	stackerfile := path.Join(dir, "stacker.yaml")
+	assert.NoError(os.WriteFile(stackerfile, []byte(content), 0644))
+
+	sf, err := NewStackerfile(stackerfile, false, []string{"REGISTRY=example.com"})
+	if !assert.NoError(err) {
+		return
+	}
+
+	// the first variable changes the slowest
+	assert.Equal([]string{
+		"base-bookworm",
+		"base-alpine",
+		"go-1.20-bookworm",
+		"go-1.20-alpine",
+		"go-1.21-bookworm",
+		"go-1.21-alpine",
+		"plain",
+	}, sf.FileOrder)
+
+	base, ok := sf.Get("base-alpine")
+	assert.True(ok)
+	assert.Equal("docker://example.com/base:alpine", base.From.Url)
+
+	goLayer, ok := sf.Get("go-1.21-bookworm")
+	assert.True(ok)
+	assert.Equal("base-bookworm", goLayer.From.Tag)
+	assert.Equal(StringList{"install-go 1.21 /usr/local"}, goLayer.Run)
+	assert.Equal(map[string]string{"go-version": "1.21"}, goLayer.Labels)
+
+	// outside of a matrix, the variables have their defaults
+	plain, ok := sf.Get("plain")
+	assert.True(ok)
+	assert.Equal(StringList{"echo none"}, plain.Run)
+
+	order, err := sf.DependencyOrder(StackerFiles{sf.Path(): sf})
+	assert.NoError(err)
+	assert.Len(order, 7)
+
+	for content, expected := range map[string]string{
+		"a:\n  matrix:\n    V: [1, 2]\n  from:\n    type: scratch\na-1:\n  from:\n    type: scratch\n": "a-1 is defined more than once",
+		"a:\n  matrix:\n    V: 1\n  from:\n    type: scratch\n":                                        "matrix variable V must have a list of values",
+		"a:\n  matrix:\n    V-1: [1]\n  from:\n    type: scratch\n":                                    "invalid matrix variable V-1",
+		"a:\n  matrix:\n    V: [1]\n  from:\n    type: scratch\nb:\n  run: echo ${{V}}\n":              "no value for substitution V",
+		"a:\n  matrix:\n    REGISTRY: [1]\n  from:\n    type: scratch\n":                               "REGISTRY is both a substitution and a matrix variable",
+	} {
+		assert.NoError(os.WriteFile(stackerfile, []byte(content), 0644))
+		_, err = NewStackerfile(stackerfile, false, []string{"REGISTRY=example.com"})
+		assert.ErrorContains(err, expected, content)
+	}
+}
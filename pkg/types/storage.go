@@ -61,3 +61,13 @@ type Storage interface {
 	// in the lxc container, works only for storage-type 'overlay'
 	SetOverlayDirs(name string, overlayDirs []OverlayDir, layerTypes []LayerType) error
 }
+
+// RootfsMounter is implemented by the storages whose rootfs LXC can't mount
+// by itself (e.g. with fuse-overlayfs).
+type RootfsMounter interface {
+	// LXCRootfsHooks returns the lxc.hook.pre-start and
+	// lxc.hook.post-stop commands that mount the rootfs of name at what
+	// GetLXCRootfsConfig returned before a container starts, and unmount
+	// it once it stops.
+	LXCRootfsHooks(name string) (string, string, error)
+}
@@ -2,7 +2,9 @@ package types
 
 import (
 	"os"
+	"path/filepath"
 	"reflect"
+	"strings"
 	"testing"
 )
 
@@ -176,3 +178,111 @@ func TestContainerProxyPassThroughByDefault(t *testing.T) {
 			expected, result)
 	}
 }
+
+func TestTarCompression(t *testing.T) {
+	c, err := NewTarCompression("zstd", 19)
+	if err != nil {
+		t.Fatalf("couldn't use zstd:19: %s", err)
+	}
+	if c.String() != "zstd:19" || c.MediaType() != "application/vnd.oci.image.layer.v1.tar+zstd" {
+		t.Fatalf("bad zstd compression %s %s", c, c.MediaType())
+	}
+
+	c, err = NewTarCompression("estargz", 6)
+	if err != nil {
+		t.Fatalf("couldn't use estargz:6: %s", err)
+	}
+	if c.String() != "estargz:6" || c.MediaType() != "application/vnd.oci.image.layer.v1.tar+gzip" {
+		t.Fatalf("bad estargz compression %s %s", c, c.MediaType())
+	}
+
+	c, err = NewTarCompression("", 0)
+	if err != nil {
+		t.Fatalf("couldn't use the default compression: %s", err)
+	}
+	if c.String() != (TarCompression{}).String() {
+		t.Fatalf("the default compression %s isn't the zero one", c)
+	}
+
+	for _, bad := range []struct {
+		algorithm string
+		level     int
+	}{{"xz", 0}, {"gzip", 10}, {"zstd", 23}, {"zstd", -1}, {"estargz", 10}} {
+		_, err = NewTarCompression(bad.algorithm, bad.level)
+		if err == nil {
+			t.Fatalf("%s at level %d should be invalid", bad.algorithm, bad.level)
+		}
+	}
+}
+
+func TestNetwork(t *testing.T) {
+	content := `isolated:
+    from:
+        type: scratch
+    network: none
+`
+	sf := parse(t, content)
+	l, ok := sf.Get("isolated")
+	if !ok {
+		t.Fatalf("missing isolated layer")
+	}
+	if l.Network != NetworkNone {
+		t.Fatalf("bad network %s", l.Network)
+	}
+
+	tf, err := os.CreateTemp("", "stacker_test_")
+	if err != nil {
+		t.Fatalf("couldn't create tempfile: %s", err)
+	}
+	defer tf.Close()
+	defer os.Remove(tf.Name())
+
+	_, err = tf.WriteString("bad:\n    from:\n        type: scratch\n    network: bridge\n")
+	if err != nil {
+		t.Fatalf("couldn't write content: %s", err)
+	}
+
+	_, err = NewStackerfile(tf.Name(), false, nil)
+	if err == nil {
+		t.Fatalf("network bridge should be invalid")
+	}
+}
+
+func TestArchiveFrom(t *testing.T) {
+	content := `docker:
+    from:
+        type: docker-archive
+        url: images/busybox.tar
+oci:
+    from:
+        type: oci-archive
+        url: /images/busybox.tar
+        tag: busybox:1.36
+`
+	sf := parse(t, content)
+
+	l, ok := sf.Get("docker")
+	if !ok {
+		t.Fatalf("missing docker layer")
+	}
+	if !filepath.IsAbs(l.From.Url) || !strings.HasSuffix(l.From.Url, "/images/busybox.tar") {
+		t.Fatalf("archive url %s isn't absolute", l.From.Url)
+	}
+	tag, err := l.From.ParseTag()
+	if err != nil || tag != "busybox" {
+		t.Fatalf("bad tag %s: %v", tag, err)
+	}
+
+	l, ok = sf.Get("oci")
+	if !ok {
+		t.Fatalf("missing oci layer")
+	}
+	url, err := l.From.ContainersImageURL()
+	if err != nil || url != "oci-archive:/images/busybox.tar:busybox:1.36" {
+		t.Fatalf("bad containers/image url %s: %v", url, err)
+	}
+	tag, err = l.From.ParseTag()
+	if err != nil || tag != "busybox_busybox_1.36" {
+		t.Fatalf("bad tag %s: %v", tag, err)
+	}
+}
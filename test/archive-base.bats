@@ -0,0 +1,43 @@
+load helpers
+
+function setup() {
+    stacker_setup
+}
+
+function teardown() {
+    cleanup
+}
+
+@test "docker-archive and oci-archive bases" {
+    _skopeo copy oci:${BUSYBOX_OCI} docker-archive:busybox-docker.tar:busybox:latest
+    _skopeo copy oci:${BUSYBOX_OCI} oci-archive:busybox-oci.tar
+
+    cat > stacker.yaml <<"EOF"
+from-docker-archive:
+    from:
+        type: docker-archive
+        url: busybox-docker.tar
+    run: |
+        echo docker > /built
+from-oci-archive:
+    from:
+        type: oci-archive
+        url: busybox-oci.tar
+    run: |
+        echo oci > /built
+EOF
+    stacker build
+
+    umoci unpack --image oci:from-docker-archive docker
+    [ "$(cat docker/rootfs/built)" = "docker" ]
+    [ -f docker/rootfs/bin/busybox ]
+
+    umoci unpack --image oci:from-oci-archive oci-dest
+    [ "$(cat oci-dest/rootfs/built)" = "oci" ]
+    [ -f oci-dest/rootfs/bin/busybox ]
+
+    # and they're cached like any other base
+    out=$(stacker build)
+    echo "$out" | grep "found cached layer from-docker-archive"
+    echo "$out" | grep "found cached layer from-oci-archive"
+}
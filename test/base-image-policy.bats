@@ -0,0 +1,46 @@
+load helpers
+
+function setup() {
+    stacker_setup
+    cat > stacker.yaml <<EOF
+policy-test:
+    from:
+        type: docker
+        url: oci:${BUSYBOX_OCI}
+    run: |
+        true
+EOF
+}
+
+function teardown() {
+    cleanup
+}
+
+@test "base image policy rejects bases it doesn't allow" {
+    cat > config.yaml <<EOF
+base_image_policy:
+    allow_digests: true
+EOF
+    bad_stacker --config=config.yaml build
+    echo "$output" | grep "isn't allowed by the base image policy: it isn't pinned by digest"
+
+    echo '{"default": [{"type": "reject"}]}' > policy.json
+    cat > config.yaml <<EOF
+base_image_policy:
+    policy_file: policy.json
+EOF
+    bad_stacker --config=config.yaml build
+    echo "$output" | grep "not accepted by $(pwd)/policy.json"
+    bad_stacker --config=config.yaml verify
+    echo "$output" | grep "policy-test base oci:${BUSYBOX_OCI}"
+}
+
+@test "base image policy allows bases it accepts" {
+    echo '{"default": [{"type": "insecureAcceptAnything"}]}' > policy.json
+    cat > config.yaml <<EOF
+base_image_policy:
+    policy_file: policy.json
+EOF
+    stacker --config=config.yaml build
+    stacker --config=config.yaml verify
+}
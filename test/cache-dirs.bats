@@ -0,0 +1,61 @@
+load helpers
+
+function setup() {
+    stacker_setup
+}
+
+function teardown() {
+    cleanup
+}
+
+@test "cache dirs persist between builds and aren't in the layer" {
+    cat > stacker.yaml <<"EOF"
+cached:
+    from:
+        type: oci
+        url: ${{BUSYBOX_OCI}}
+    cache_dirs:
+        - /root/.cache/build
+    run: |
+        date +%s%N >> /root/.cache/build/runs
+        cat /root/.cache/build/runs
+EOF
+    stacker build --substitute BUSYBOX_OCI=${BUSYBOX_OCI}
+    [ "$(wc -l < .stacker/cache-dirs/root-.cache-build/runs)" = "1" ]
+
+    stacker build --no-cache --substitute BUSYBOX_OCI=${BUSYBOX_OCI}
+    [ "$(wc -l < .stacker/cache-dirs/root-.cache-build/runs)" = "2" ]
+
+    umoci unpack --image oci:cached dest
+    [ ! -e dest/rootfs/root/.cache ]
+}
+
+@test "cache dirs can be shared by id, or be on the host" {
+    mkdir host-cache
+    cat > stacker.yaml <<"EOF"
+first:
+    from:
+        type: oci
+        url: ${{BUSYBOX_OCI}}
+    cache_dirs:
+        - dest: /cache
+          id: shared
+        - dest: /host
+          source: host-cache
+    run: |
+        echo first > /cache/first
+        echo host > /host/file
+second:
+    from:
+        type: built
+        tag: first
+    cache_dirs:
+        - dest: /other
+          id: shared
+    run: |
+        [ "$(cat /other/first)" = "first" ]
+        [ ! -e /cache ]
+EOF
+    stacker build --substitute BUSYBOX_OCI=${BUSYBOX_OCI}
+    [ "$(cat host-cache/file)" = "host" ]
+}
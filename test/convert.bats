@@ -89,3 +89,25 @@ EOF
   rm -f stacker.yaml stacker-subs.yaml
   stacker clean
 }
+
+@test "convert a multi-stage Dockerfile" {
+  cat > Dockerfile <<"EOF"
+FROM alpine:3.16 AS builder
+RUN echo built > /built
+HEALTHCHECK CMD true
+
+FROM alpine:3.16
+COPY --from=builder /built /
+EOF
+  stacker convert --docker-file Dockerfile --output-file stacker.yaml --substitute-file stacker-subs.yaml
+  cat stacker.yaml
+  grep "^# TODO: " stacker.yaml
+  grep "HEALTHCHECK CMD true" stacker.yaml
+  grep "build_only: true" stacker.yaml
+  grep "stacker://builder/built" stacker.yaml
+  stacker build -f stacker.yaml --substitute-file stacker-subs.yaml --substitute IMAGE=app
+  umoci unpack --image oci:app dest
+  [ "$(cat dest/rootfs/built)" = "built" ]
+  rm -f stacker.yaml stacker-subs.yaml
+  stacker clean
+}
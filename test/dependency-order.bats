@@ -90,3 +90,42 @@ atomix-installer-iso:
 EOF
     stacker build
 }
+
+@test "independent layers are built in parallel with --jobs" {
+    cat > stacker.yaml <<"EOF"
+base:
+    from:
+        type: oci
+        url: ${{BUSYBOX_OCI}}
+    build_only: true
+left:
+    from:
+        type: built
+        tag: base
+    run: |
+        echo left > /left
+right:
+    from:
+        type: built
+        tag: base
+    run: |
+        echo right > /right
+both:
+    from:
+        type: built
+        tag: left
+    imports:
+        - stacker://right/right
+    run: |
+        cp /stacker/imports/right /right
+EOF
+    stacker build --jobs 2 --substitute BUSYBOX_OCI=${BUSYBOX_OCI}
+    echo "${output}" | grep -F "[left] preparing image left"
+    echo "${output}" | grep -F "[right] preparing image right"
+    umoci unpack --image oci:both dest
+    [ "$(cat dest/rootfs/left)" == "left" ]
+    [ "$(cat dest/rootfs/right)" == "right" ]
+
+    bad_stacker build --jobs 0 --substitute BUSYBOX_OCI=${BUSYBOX_OCI}
+    echo "${output}" | grep -- "--jobs must be at least 1"
+}
@@ -0,0 +1,46 @@
+load helpers
+
+function setup() {
+    stacker_setup
+}
+
+function teardown() {
+    cleanup
+}
+
+@test "devices are passed through" {
+    [ -c /dev/fuse ] || skip "no /dev/fuse"
+
+    cat > stacker.yaml <<"EOF"
+fuse:
+    from:
+        type: oci
+        url: ${{BUSYBOX_OCI}}
+    devices:
+        - /dev/fuse
+        - path: /dev/fuse
+          dest: /dev/other-fuse
+          permissions: r
+    run: |
+        [ -c /dev/fuse ]
+        [ -c /dev/other-fuse ]
+        # opening it doesn't read anything, but needs the cgroup's permission
+        exec 3<>/dev/fuse
+EOF
+    stacker build --substitute BUSYBOX_OCI=${BUSYBOX_OCI}
+}
+
+@test "devices that aren't devices fail" {
+    cat > stacker.yaml <<"EOF"
+bad:
+    from:
+        type: oci
+        url: ${{BUSYBOX_OCI}}
+    devices:
+        - /etc/passwd
+    run: |
+        true
+EOF
+    bad_stacker build --substitute BUSYBOX_OCI=${BUSYBOX_OCI}
+    echo "$output" | grep "/etc/passwd isn't a device"
+}
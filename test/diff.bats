@@ -0,0 +1,40 @@
+load helpers
+
+function setup() {
+    stacker_setup
+}
+
+function teardown() {
+    cleanup
+}
+
+@test "diff prints what a layer changed" {
+    cat > stacker.yaml <<"EOF"
+before:
+    from:
+        type: oci
+        url: ${{BUSYBOX_OCI}}
+    run: |
+        echo one > /one
+        echo two > /two
+after:
+    from:
+        type: built
+        tag: before
+    run: |
+        rm /one
+        echo changed > /two
+        mkdir /three
+        chmod 700 /three
+EOF
+    stacker build --substitute BUSYBOX_OCI=${BUSYBOX_OCI}
+
+    stacker diff before after
+    stacker diff before after | grep "^D /one "
+    stacker diff before after | grep "^M /two "
+    stacker diff before after | grep "^A /three (drwx------"
+
+    [ "$(stacker diff --path /two before after | wc -l)" = "1" ]
+    [ "$(stacker diff --json before after | jq -r '.[] | select(.path == "/one") | .change')" = "removed" ]
+    [ -z "$(stacker diff after after)" ]
+}
@@ -0,0 +1,44 @@
+load helpers
+
+function setup() {
+    stacker_setup
+    if ! command -v fuse-overlayfs >/dev/null; then
+        skip "skipping test because fuse-overlayfs isn't installed"
+    fi
+}
+
+function teardown() {
+    cleanup
+}
+
+@test "fuse-overlayfs storage builds layers with whiteouts" {
+    cat > stacker.yaml <<EOF
+base:
+    from:
+        type: oci
+        url: $BUSYBOX_OCI
+    run: |
+        mkdir -p /opaque /removed
+        touch /opaque/old /removed/file
+top:
+    from:
+        type: built
+        tag: base
+    run: |
+        rm -rf /removed /opaque
+        mkdir /opaque
+        touch /opaque/new
+EOF
+    stacker --storage-driver=fuse-overlayfs build
+    [ "$(cat .stacker/storage.type)" = "fuse-overlayfs" ]
+
+    umoci unpack --image oci:top top
+    [ ! -e top/rootfs/removed ]
+    [ -f top/rootfs/opaque/new ]
+    [ ! -e top/rootfs/opaque/old ]
+
+    # the storage type is remembered
+    stacker build
+    bad_stacker --storage-type=overlay build
+    echo "$output" | grep "previous storage type fuse-overlayfs not compatible"
+}
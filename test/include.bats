@@ -0,0 +1,74 @@
+load helpers
+
+function setup() {
+    stacker_setup
+}
+
+function teardown() {
+    cleanup
+}
+
+@test "included layers and templates can be extended" {
+    mkdir -p common
+    echo -n "from common" > common/greeting
+    cat > common/common.yaml <<"EOF"
+.greet:
+    imports:
+        - greeting
+    run: |
+        cp /stacker/imports/greeting /root/greeting
+    environment:
+        GREETING: common
+base:
+    from:
+        type: oci
+        url: ${{BUSYBOX_OCI}}
+    build_only: true
+    run: |
+        touch /root/base
+EOF
+    cat > stacker.yaml <<"EOF"
+config:
+    include:
+        - common/common.yaml
+app:
+    extends: .greet
+    from:
+        type: built
+        tag: base
+    run: |
+        echo -n "$GREETING" > /root/env
+    environment:
+        GREETING: app
+EOF
+    stacker build --substitute BUSYBOX_OCI=${BUSYBOX_OCI}
+
+    umoci unpack --image oci:app dest
+    [ -f dest/rootfs/root/base ]
+    [ "$(cat dest/rootfs/root/greeting)" = "from common" ]
+    [ "$(cat dest/rootfs/root/env)" = "app" ]
+
+    # build_only layers and templates aren't in the output
+    ! umoci ls --layout oci | grep base
+    ! umoci ls --layout oci | grep greet
+}
+
+@test "including a stackerfile that defines the same layer fails" {
+    cat > common.yaml <<"EOF"
+app:
+    from:
+        type: oci
+        url: ${{BUSYBOX_OCI}}
+EOF
+    cat > stacker.yaml <<"EOF"
+config:
+    include:
+        - common.yaml
+app:
+    from:
+        type: oci
+        url: ${{BUSYBOX_OCI}}
+EOF
+    bad_stacker build --substitute BUSYBOX_OCI=${BUSYBOX_OCI}
+    echo "$output" | grep "app is defined in both"
+}
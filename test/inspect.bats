@@ -0,0 +1,36 @@
+load helpers
+
+function setup() {
+    stacker_setup
+}
+
+function teardown() {
+    cleanup
+}
+
+@test "inspect prints the build of an image" {
+    cat > stacker.yaml <<"EOF"
+greeting:
+    from:
+        type: oci
+        url: ${{BUSYBOX_OCI}}
+    run: |
+        echo ${{GREETING}} > /greeting
+    labels:
+        greeting: ${{GREETING}}
+EOF
+    stacker build --provenance --substitute GREETING=hello --substitute BUSYBOX_OCI=${BUSYBOX_OCI}
+
+    stacker inspect greeting
+    stacker inspect greeting | grep "substitution: GREETING=hello"
+    stacker inspect greeting | grep "label: greeting=hello"
+
+    stacker inspect --json greeting > inspect.json
+    [ "$(jq -r .tag inspect.json)" = "greeting" ]
+    [ "$(jq -r .build.substitutions.GREETING inspect.json)" = "hello" ]
+    [ "$(jq -r '.config.config.Labels.greeting' inspect.json)" = "hello" ]
+    [ "$(jq -r '.layers | length' inspect.json)" -gt 1 ]
+
+    # the provenance attached to it isn't listed as an image of its own
+    [ "$(stacker inspect --json | jq -r '.[].tag')" = "greeting" ]
+}
@@ -0,0 +1,35 @@
+load helpers
+
+function setup() {
+    stacker_setup
+}
+
+function teardown() {
+    cleanup
+    if command -v docker >/dev/null && docker info >/dev/null 2>&1; then
+        docker rmi -f stacker-load-test/load-test:bats >/dev/null 2>&1 || true
+    fi
+}
+
+@test "load puts the image into docker" {
+    if ! command -v docker >/dev/null || ! docker info >/dev/null 2>&1; then
+        skip "no docker daemon"
+    fi
+
+    cat > stacker.yaml <<"EOF"
+load-test:
+    from:
+        type: oci
+        url: ${{BUSYBOX_OCI}}
+    run: |
+        echo loaded > /loaded
+EOF
+    stacker build --substitute BUSYBOX_OCI=${BUSYBOX_OCI}
+    stacker load --repository stacker-load-test --tag bats load-test
+    [ "$(docker run --rm stacker-load-test/load-test:bats cat /loaded)" = "loaded" ]
+}
+
+@test "load rejects unknown runtimes" {
+    bad_stacker load --runtime podman load-test
+    echo "$output" | grep "only docker and containerd are supported"
+}
@@ -52,3 +52,32 @@ EOF
     stacker build --substitute BUSYBOX_OCI=${BUSYBOX_OCI}
     [ -z "$(echo "$output" | grep "Copying blob")" ]
 }
+
+@test "--log-format=json logs the build events" {
+    cat > stacker.yaml <<"EOF"
+test:
+    from:
+        type: oci
+        url: ${{BUSYBOX_OCI}}
+    run: |
+        echo built
+EOF
+
+    stacker --log-format=json --log-file=logfile build --substitute BUSYBOX_OCI=${BUSYBOX_OCI}
+    jq -e . logfile
+    [ "$(jq -r 'select(.event == "cache-miss") | .layer' logfile)" = "test" ]
+    digest=$(jq -r 'select(.event == "layer-committed") | .digest' logfile)
+    [ "$digest" = "$(jq -r '.manifests[0].digest' oci/index.json)" ]
+    [ -z "$(jq -r 'select(.event == "layer-finished") | .error // empty' logfile)" ]
+
+    # --quiet leaves only the events
+    NO_DEBUG=1
+    stacker --quiet --log-format=json --log-file=logfile build --substitute BUSYBOX_OCI=${BUSYBOX_OCI}
+    NO_DEBUG=0
+    [ "$(jq -r 'select(.event == "cache-hit") | .layer' logfile)" = "test" ]
+    [ -z "$(jq -r 'select(.event == null) | .msg' logfile)" ]
+}
+
+@test "--log-format must be text or json" {
+    bad_stacker --log-format=xml build --help
+}
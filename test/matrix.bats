@@ -0,0 +1,31 @@
+load helpers
+
+function setup() {
+    stacker_setup
+}
+
+function teardown() {
+    cleanup
+}
+
+@test "a matrix builds a layer for each combination" {
+    cat > stacker.yaml <<"EOF"
+variant:
+    matrix:
+        FLAVOR: [vanilla, chocolate]
+        SIZE: [small, large]
+    from:
+        type: oci
+        url: ${{BUSYBOX_OCI}}
+    run: |
+        echo -n "${{FLAVOR}} ${{SIZE}}" > /root/variant
+EOF
+    stacker build --substitute BUSYBOX_OCI=${BUSYBOX_OCI}
+
+    for flavor in vanilla chocolate; do
+        for size in small large; do
+            umoci unpack --image oci:variant-$flavor-$size dest-$flavor-$size
+            [ "$(cat dest-$flavor-$size/rootfs/root/variant)" = "$flavor $size" ]
+        done
+    done
+}
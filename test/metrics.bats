@@ -0,0 +1,51 @@
+load helpers
+
+function setup() {
+    stacker_setup
+}
+
+function teardown() {
+    cleanup
+    rm -f metrics.json stacker.prom
+}
+
+@test "--metrics-file records the layers that were built" {
+    cat > stacker.yaml <<"EOF"
+base:
+    from:
+        type: oci
+        url: ${{BUSYBOX_OCI}}
+    run: |
+        echo base > /base
+child:
+    from:
+        type: built
+        tag: base
+    run: |
+        echo child > /child
+EOF
+
+    stacker build --substitute BUSYBOX_OCI=${BUSYBOX_OCI} --metrics-file=metrics.json
+    echo "$output" | grep "built 2 layers"
+    [ "$(jq -r '.layers | length' metrics.json)" = "2" ]
+    [ "$(jq -r '.cacheHitRatio' metrics.json)" = "0" ]
+    [ "$(jq -r '.layers[0].outputs[0].tag' metrics.json)" = "base" ]
+    [ "$(jq -r '.layers[1].outputs[0].size > .layers[0].outputs[0].size' metrics.json)" = "true" ]
+
+    stacker build --substitute BUSYBOX_OCI=${BUSYBOX_OCI} --metrics-file=stacker.prom --metrics-format=prometheus
+    grep '^stacker_build_cache_hit_ratio 1$' stacker.prom
+    grep '^stacker_layer_cached{layer="child"} 1$' stacker.prom
+    grep '^stacker_image_size_bytes{layer="child",tag="child"} ' stacker.prom
+}
+
+@test "--metrics-format must be json or prometheus" {
+    cat > stacker.yaml <<"EOF"
+test:
+    from:
+        type: oci
+        url: ${{BUSYBOX_OCI}}
+EOF
+
+    bad_stacker build --substitute BUSYBOX_OCI=${BUSYBOX_OCI} --metrics-file=metrics.json --metrics-format=xml
+    [ ! -f metrics.json ]
+}
@@ -0,0 +1,54 @@
+load helpers
+
+function setup() {
+    stacker_setup
+}
+
+function teardown() {
+    cleanup
+}
+
+@test "network none only has a loopback interface" {
+    cat > stacker.yaml <<"EOF"
+isolated:
+    from:
+        type: oci
+        url: ${{BUSYBOX_OCI}}
+    network: none
+    run: |
+        # the two header lines and lo
+        [ "$(wc -l < /proc/net/dev)" = "3" ]
+        grep lo: /proc/net/dev
+connected:
+    from:
+        type: oci
+        url: ${{BUSYBOX_OCI}}
+    run: |
+        [ "$(wc -l < /proc/net/dev)" -gt "3" ]
+EOF
+    stacker build --substitute BUSYBOX_OCI=${BUSYBOX_OCI}
+}
+
+@test "--no-network isolates all layers" {
+    cat > stacker.yaml <<"EOF"
+isolated:
+    from:
+        type: oci
+        url: ${{BUSYBOX_OCI}}
+    run: |
+        [ "$(wc -l < /proc/net/dev)" = "3" ]
+EOF
+    stacker build --no-network --substitute BUSYBOX_OCI=${BUSYBOX_OCI}
+}
+
+@test "invalid network fails" {
+    cat > stacker.yaml <<"EOF"
+bad:
+    from:
+        type: oci
+        url: ${{BUSYBOX_OCI}}
+    network: bridge
+EOF
+    bad_stacker build --substitute BUSYBOX_OCI=${BUSYBOX_OCI}
+    echo "$output" | grep "invalid network bridge"
+}
@@ -103,6 +103,39 @@ function teardown() {
 }
 
 
+@test "publish layer to multiple urls" {
+    stacker build -f ocibuilds/sub4/stacker.yaml --substitute BUSYBOX_OCI=${BUSYBOX_OCI}
+    stacker publish -f ocibuilds/sub4/stacker.yaml --url oci:oci_publish --url oci:oci_publish2 --tag test1 --tag test2 --substitute BUSYBOX_OCI=${BUSYBOX_OCI}
+
+    for layout in oci_publish oci_publish2; do
+        for tag in test1 test2; do
+            umoci unpack --image $layout:layer4_$tag dest/$layout-$tag
+            [ -f dest/$layout-$tag/rootfs/root/ls_out ]
+        done
+    done
+}
+
+@test "publish layer with templated tags" {
+    git init -q ocibuilds/sub4
+    git -C ocibuilds/sub4 add stacker.yaml
+    git -C ocibuilds/sub4 -c user.name=test -c user.email=test@example.com commit -q -m "initial"
+    sha=$(git -C ocibuilds/sub4 rev-parse --short HEAD)
+
+    stacker build -f ocibuilds/sub4/stacker.yaml --substitute BUSYBOX_OCI=${BUSYBOX_OCI}
+    stacker publish -f ocibuilds/sub4/stacker.yaml --url oci:oci_publish \
+        --tag 'git-${{STACKER_GIT_SHA}}' --tag 'v${{VERSION}}' --tag '${{CHANNEL:stable}}' \
+        --substitute BUSYBOX_OCI=${BUSYBOX_OCI} --substitute VERSION=1.2.3
+
+    umoci ls --layout oci_publish > tags
+    grep -x "layer4_git-$sha" tags
+    grep -x "layer4_v1.2.3" tags
+    grep -x "layer4_stable" tags
+
+    bad_stacker publish -f ocibuilds/sub4/stacker.yaml --url oci:oci_publish --tag 'v${{MISSING}}' --substitute BUSYBOX_OCI=${BUSYBOX_OCI}
+    echo "$output" | grep "couldn't expand tag"
+}
+
+
 @test "publish multiple layers recursively" {
     stacker recursive-build -d ocibuilds --substitute BUSYBOX_OCI=${BUSYBOX_OCI}
     stacker publish -d ocibuilds --url oci:oci_publish --tag test1 --substitute BUSYBOX_OCI=${BUSYBOX_OCI}
@@ -0,0 +1,75 @@
+load helpers
+
+function setup() {
+    stacker_setup
+    [ -f /sys/fs/cgroup/cgroup.controllers ] || skip "resource limits need cgroup2"
+}
+
+function teardown() {
+    cleanup
+}
+
+@test "pids limit stops a fork bomb" {
+    cat > stacker.yaml <<"EOF"
+limited:
+    from:
+        type: oci
+        url: ${{BUSYBOX_OCI}}
+    resources:
+        pids: 16
+    run: |
+        for i in $(seq 64); do
+            sleep 10 &
+        done
+        wait
+EOF
+    bad_stacker build --substitute BUSYBOX_OCI=${BUSYBOX_OCI}
+}
+
+@test "limits from the command line are used by layers that don't set them" {
+    cat > stacker.yaml <<"EOF"
+limited:
+    from:
+        type: oci
+        url: ${{BUSYBOX_OCI}}
+    run: |
+        for i in $(seq 64); do
+            sleep 10 &
+        done
+        wait
+EOF
+    bad_stacker build --pids-limit 16 --substitute BUSYBOX_OCI=${BUSYBOX_OCI}
+
+    cat > stacker.yaml <<"EOF"
+unlimited:
+    from:
+        type: oci
+        url: ${{BUSYBOX_OCI}}
+    resources:
+        pids: 1024
+        memory: 1GiB
+        cpus: 0.5
+    run: |
+        for i in $(seq 64); do
+            sleep 1 &
+        done
+        wait
+EOF
+    stacker build --pids-limit 16 --substitute BUSYBOX_OCI=${BUSYBOX_OCI}
+}
+
+@test "invalid resource limits fail" {
+    cat > stacker.yaml <<"EOF"
+bad:
+    from:
+        type: oci
+        url: ${{BUSYBOX_OCI}}
+    resources:
+        memory: lots
+EOF
+    bad_stacker build --substitute BUSYBOX_OCI=${BUSYBOX_OCI}
+    echo "$output" | grep "invalid memory limit lots"
+
+    bad_stacker build --cpus -1 --substitute BUSYBOX_OCI=${BUSYBOX_OCI}
+    echo "$output" | grep "invalid cpus limit"
+}
@@ -0,0 +1,62 @@
+load helpers
+
+function setup() {
+    stacker_setup
+}
+
+function teardown() {
+    cleanup
+}
+
+@test "secrets are available to run but not in the layer" {
+    cat > stacker.yaml <<"EOF"
+secrets-test:
+    from:
+        type: oci
+        url: ${{BUSYBOX_OCI}}
+    secrets:
+        - id: file
+          source: secret.txt
+        - id: target
+          source: secret.txt
+          target: /root/.secret
+        - id: env
+          from_env: STACKER_SECRET
+          env: SECRET
+        - id: fromenv
+          from_env: STACKER_SECRET
+    run: |
+        [ "$(cat /run/secrets/file)" = "from a file" ]
+        [ "$(cat /root/.secret)" = "from a file" ]
+        [ "$SECRET" = "from the env" ]
+        [ "$(cat /run/secrets/fromenv)" = "from the env" ]
+        ! echo leaked > /run/secrets/file
+        echo built > /root/built
+EOF
+    echo -n "from a file" > secret.txt
+
+    STACKER_SECRET="from the env" stacker build --substitute BUSYBOX_OCI=${BUSYBOX_OCI}
+
+    umoci unpack --image oci:secrets-test dest
+    [ "$(cat dest/rootfs/root/built)" = "built" ]
+    [ ! -e dest/rootfs/run/secrets ]
+    [ ! -e dest/rootfs/root/.secret ]
+    ! grep -r "from the env" dest/rootfs oci
+    [ "$(cat secret.txt)" = "from a file" ]
+}
+
+@test "missing secrets fail the build" {
+    cat > stacker.yaml <<"EOF"
+secrets-test:
+    from:
+        type: oci
+        url: ${{BUSYBOX_OCI}}
+    secrets:
+        - id: env
+          from_env: STACKER_MISSING_SECRET
+    run: |
+        true
+EOF
+    bad_stacker build --substitute BUSYBOX_OCI=${BUSYBOX_OCI}
+    echo "$output" | grep "STACKER_MISSING_SECRET isn't set"
+}
@@ -0,0 +1,88 @@
+load helpers
+
+function setup() {
+    stacker_setup
+}
+
+function teardown() {
+    cleanup
+}
+
+@test "capabilities are the only ones kept" {
+    cat > stacker.yaml <<"EOF"
+nocaps:
+    from:
+        type: oci
+        url: ${{BUSYBOX_OCI}}
+    security:
+        capabilities: [none]
+    run: |
+        grep "CapEff:.*0000000000000000" /proc/self/status
+chown:
+    from:
+        type: oci
+        url: ${{BUSYBOX_OCI}}
+    security:
+        capabilities: [CAP_CHOWN]
+    run: |
+        grep "CapEff:.*0000000000000001" /proc/self/status
+EOF
+    stacker build --substitute BUSYBOX_OCI=${BUSYBOX_OCI}
+}
+
+@test "seccomp profile denies syscalls" {
+    cat > nomkdir.seccomp <<"EOF"
+2
+denylist
+mkdir errno 1
+mkdirat errno 1
+EOF
+    cat > stacker.yaml <<"EOF"
+nomkdir:
+    from:
+        type: oci
+        url: ${{BUSYBOX_OCI}}
+    security:
+        seccomp_profile: nomkdir.seccomp
+    run: |
+        ! mkdir /foo
+EOF
+    stacker build --substitute BUSYBOX_OCI=${BUSYBOX_OCI}
+}
+
+@test "security from the config is used by layers that don't set their own" {
+    cat > config.yaml <<EOF
+security:
+    capabilities: [none]
+EOF
+    cat > stacker.yaml <<"EOF"
+nocaps:
+    from:
+        type: oci
+        url: ${{BUSYBOX_OCI}}
+    run: |
+        grep "CapEff:.*0000000000000000" /proc/self/status
+chown:
+    from:
+        type: oci
+        url: ${{BUSYBOX_OCI}}
+    security:
+        capabilities: [chown]
+    run: |
+        grep "CapEff:.*0000000000000001" /proc/self/status
+EOF
+    stacker --config=config.yaml build --substitute BUSYBOX_OCI=${BUSYBOX_OCI}
+}
+
+@test "unknown capabilities fail" {
+    cat > stacker.yaml <<"EOF"
+bad:
+    from:
+        type: oci
+        url: ${{BUSYBOX_OCI}}
+    security:
+        capabilities: [sys_everything]
+EOF
+    bad_stacker build --substitute BUSYBOX_OCI=${BUSYBOX_OCI}
+    echo "$output" | grep "unknown capability sys_everything"
+}
@@ -0,0 +1,77 @@
+load helpers
+
+function setup() {
+    stacker_setup
+}
+
+function teardown() {
+    cleanup
+}
+
+function layer_count() {
+    manifest=$(cat oci/index.json | jq -r ".manifests[] | select(.annotations.\"org.opencontainers.image.ref.name\" == \"$1\") | .digest" | cut -f2 -d:)
+    cat oci/blobs/sha256/$manifest | jq -r '.layers | length'
+}
+
+@test "squash collapses the layers stacker built" {
+    cat > stacker.yaml <<"EOF"
+one:
+    from:
+        type: oci
+        url: ${{BUSYBOX_OCI}}
+    run: |
+        echo one > /one
+        echo gone > /gone
+two:
+    from:
+        type: built
+        tag: one
+    run: |
+        echo two > /two
+        rm /gone /bin/sed
+squashed:
+    from:
+        type: built
+        tag: two
+    squash: true
+    run: |
+        echo three > /three
+all:
+    from:
+        type: built
+        tag: two
+    squash: all
+    run: |
+        echo three > /three
+child:
+    from:
+        type: built
+        tag: squashed
+    run: |
+        echo four > /four
+EOF
+    stacker build --substitute BUSYBOX_OCI=${BUSYBOX_OCI}
+
+    base=$(($(layer_count one)-1))
+    [ "$(layer_count two)" = "$((base+2))" ]
+    [ "$(layer_count squashed)" = "$((base+1))" ]
+    [ "$(layer_count all)" = "1" ]
+    [ "$(layer_count child)" = "$((base+2))" ]
+
+    for tag in squashed all child; do
+        rm -rf dest
+        umoci unpack --image oci:$tag dest
+        [ "$(cat dest/rootfs/one)" = "one" ]
+        [ "$(cat dest/rootfs/two)" = "two" ]
+        [ "$(cat dest/rootfs/three)" = "three" ]
+        [ ! -e dest/rootfs/gone ]
+        [ ! -e dest/rootfs/bin/sed ]
+        [ -e dest/rootfs/bin/busybox ]
+    done
+    [ "$(cat dest/rootfs/four)" = "four" ]
+
+    # the squashed layers are cached like any other
+    stacker build --substitute BUSYBOX_OCI=${BUSYBOX_OCI}
+    echo "$output" | grep "found cached layer squashed"
+    [ "$(layer_count squashed)" = "$((base+1))" ]
+}
@@ -0,0 +1,43 @@
+load helpers
+
+function setup() {
+    stacker_setup
+}
+
+function teardown() {
+    cleanup
+}
+
+@test "verify checks import hashes and the oci layout" {
+    echo hello > file
+    cat > stacker.yaml <<"EOF"
+verify-test:
+    from:
+        type: oci
+        url: ${{BUSYBOX_OCI}}
+    imports:
+        - path: file
+          hash: ${{HASH}}
+    run: |
+        cp /stacker/imports/file /file
+EOF
+    hash=$(sha256sum file | cut -f1 -d" ")
+    stacker build --substitute BUSYBOX_OCI=${BUSYBOX_OCI} --substitute HASH=$hash
+    stacker verify --substitute BUSYBOX_OCI=${BUSYBOX_OCI} --substitute HASH=$hash
+
+    echo changed > file
+    bad_stacker verify --substitute BUSYBOX_OCI=${BUSYBOX_OCI} --substitute HASH=$hash
+    echo "$output" | grep "verify-test import .*file: .*different than the actual hash"
+    echo "$output" | grep "1 problems found"
+
+    echo hello > file
+    layer=$(cat oci/index.json | jq -r '.manifests[0].digest' | cut -f2 -d:)
+    layer=$(cat oci/blobs/sha256/$layer | jq -r '.layers[-1].digest' | cut -f2 -d:)
+    echo corrupted > oci/blobs/sha256/$layer
+    bad_stacker verify --substitute BUSYBOX_OCI=${BUSYBOX_OCI} --substitute HASH=$hash
+    echo "$output" | grep "blob sha256:$layer: size is 10"
+
+    rm oci/blobs/sha256/$layer
+    bad_stacker verify --substitute BUSYBOX_OCI=${BUSYBOX_OCI} --substitute HASH=$hash
+    echo "$output" | grep "blob sha256:$layer: missing"
+}